@@ -15,14 +15,32 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/01org/ciao/ciao-controller/types"
+	"github.com/01org/ciao/payloads"
 	"github.com/01org/ciao/service"
 	"github.com/01org/ciao/ssntp/uuid"
+	"github.com/golang/glog"
 	"github.com/gorilla/mux"
 )
 
@@ -41,14 +59,238 @@ const (
 
 	// TenantsV1 is the content-type string for v1 of our tenants resource
 	TenantsV1 = "x.ciao.tenants.v1"
+
+	// MergePatch is the content-type string for JSON Merge Patch
+	// documents, as described by RFC 7386
+	MergePatch = "merge-patch+json"
 )
 
+// DefaultMaxBodySize is the largest request body, in bytes, accepted by
+// routes which modify resources unless configured otherwise.
+const DefaultMaxBodySize = 1 << 20
+
+// errBodyTooLarge is returned when reading a request body which is
+// larger than its route allows.
+var errBodyTooLarge = errors.New("Request body too large")
+
+// errRequestTimeout is returned when a handler does not complete within
+// the configured request timeout.
+var errRequestTimeout = errors.New("Request timed out")
+
+// errInvalidWatchTimeout is returned when a watch asks to wait for a
+// number of seconds which is not a positive integer or is too long.
+var errInvalidWatchTimeout = errors.New("Invalid watch timeout")
+
+// errPreconditionFailed is returned when the If-Match header of a request
+// does not match the current entity tag of the resource.
+var errPreconditionFailed = errors.New("Precondition failed")
+
+// errInvalidCursor is returned when a listing is given a pagination
+// cursor which it did not hand out.
+var errInvalidCursor = errors.New("Invalid pagination cursor")
+
+// errUnknownResource is returned when negotiating the media type of a
+// resource the API does not serve.
+var errUnknownResource = errors.New("Unknown resource")
+
+// errNotAcceptable is returned when none of the media types a client
+// accepts are served for a resource.
+var errNotAcceptable = errors.New("No acceptable media type")
+
+// errUnsupportedMediaType is returned, when the Content-Type is enforced,
+// for requests which would change something but do not give a ciao media
+// type.
+var errUnsupportedMediaType = errors.New("Unsupported media type")
+
+// errMaintenance is returned for requests which would change something
+// while the API is in maintenance mode.
+var errMaintenance = errors.New("Service in maintenance mode")
+
+// errTooManyInFlight is returned when a route with a concurrency limit is
+// already serving as many requests as it may.
+var errTooManyInFlight = errors.New("Too many requests in progress")
+
+// DefaultMaintenanceRetryAfter is the number of seconds clients are asked
+// to wait when refused by maintenance mode, unless it was given another.
+const DefaultMaintenanceRetryAfter = 60
+
+// maintenanceMode holds the state of the API's maintenance mode. It is
+// shared by all of the routes.
+type maintenanceMode struct {
+	sync.RWMutex
+	types.Maintenance
+}
+
+// get returns the current state of maintenance mode, which is off unless
+// it has been set.
+func (m *maintenanceMode) get() types.Maintenance {
+	if m == nil {
+		return types.Maintenance{}
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.Maintenance
+}
+
+// set changes the state of maintenance mode.
+func (m *maintenanceMode) set(state types.Maintenance) {
+	if state.RetryAfter <= 0 {
+		state.RetryAfter = DefaultMaintenanceRetryAfter
+	}
+
+	m.Lock()
+	m.Maintenance = state
+	m.Unlock()
+}
+
+// errNoWebhook is returned when the webhook is tested but none is
+// configured.
+var errNoWebhook = errors.New("No webhook configured")
+
+// errNoImageChecker is returned when orphaned workloads are asked for
+// but no ImageChecker is configured.
+var errNoImageChecker = errors.New("No image checker configured")
+
+// errInvalidSnapshot is returned when a quota snapshot being restored
+// cannot be decoded, or was taken of another tenant.
+var errInvalidSnapshot = errors.New("Invalid quota snapshot")
+
+// errInvalidBundle is returned when a workload bundle being imported
+// does not hold a list of workloads.
+var errInvalidBundle = errors.New("Invalid workload bundle")
+
+// errInvalidInstanceID is returned when the instance ID of a request to
+// map an external IP does not match the configured pattern.
+var errInvalidInstanceID = errors.New("Invalid instance ID")
+
+// DefaultPageSize is the number of items on each page of a listing
+// paginated with a cursor, unless the client gives a limit.
+const DefaultPageSize = 100
+
+// cursorPrefix versions the contents of pagination cursors, so that they
+// may change without misreading cursors already handed out.
+const cursorPrefix = "v1:"
+
+// DefaultReclaimAge is how long a reservation must have been without an
+// instance to be reclaimable, unless the client asks otherwise.
+const DefaultReclaimAge = 24 * time.Hour
+
+// DefaultPoolActivityLimit is the most event log entries embedded in a
+// pool which includes its activity, unless configured otherwise.
+const DefaultPoolActivityLimit = 20
+
+// DefaultClaimTTL is how long a claim on external IPs lasts before it is
+// abandoned, unless the client asks otherwise.
+const DefaultClaimTTL = 5 * time.Minute
+
+// DefaultChurnWindow is the period over which the churn of a tenant's
+// external IPs is counted, unless the client asks otherwise.
+const DefaultChurnWindow = time.Hour
+
+// MaxChurnWindow is the longest period over which the churn of a tenant's
+// external IPs is kept.
+const MaxChurnWindow = 24 * time.Hour
+
+// DefaultWatchTimeout is how long a watch waits for a change before
+// returning 304 Not Modified, unless the client asks otherwise.
+const DefaultWatchTimeout = 30 * time.Second
+
+// maxWatchTimeout is the longest a client may ask a watch to wait.
+const maxWatchTimeout = 5 * time.Minute
+
+// eventStreamKeepAlive is how often an idle event stream is sent a
+// comment, so that proxies do not close it.
+const eventStreamKeepAlive = 15 * time.Second
+
+// eventStreamContentType is the media type of Server-Sent Events.
+const eventStreamContentType = "text/event-stream"
+
+// PublicRoutes are the path templates of the routes which concern no
+// tenant, and so may be used by any caller.
+var PublicRoutes = []string{
+	"/capabilities",
+	"/negotiate",
+	"/quotas/definitions",
+	"/schema/{resource}",
+}
+
+// ExpensiveRoutes are the path templates of the routes whose requests are
+// costly enough that ConcurrencyLimits may bound how many are served at
+// once.
+var ExpensiveRoutes = []string{
+	"/pools/export",
+	"/pools/{pool}/subnets/{subnet}/bitmap",
+}
+
+// ConcurrencyRetryAfter is the number of seconds clients are asked to wait
+// when refused because a route is serving as many requests as it may.
+const ConcurrencyRetryAfter = 1
+
+// uuidParams are the path parameters which must hold a UUID.
+var uuidParams = []string{
+	"tenant",
+	"for_tenant",
+	"pool",
+	"subnet",
+	"ip_id",
+	"mapping_id",
+	"workload_id",
+	"block_id",
+}
+
+var uuidPattern = regexp.MustCompile("^" + uuid.UUIDRegex + "$")
+
+// malformedUUIDError is returned when a path parameter which should
+// hold a UUID does not.
+type malformedUUIDError struct {
+	Parameter string `json:"parameter"`
+	Value     string `json:"value"`
+}
+
+func (e malformedUUIDError) Error() string {
+	return fmt.Sprintf("Malformed UUID for %s", e.Parameter)
+}
+
+// validateUUIDs checks the UUID path parameters of a request.
+func validateUUIDs(r *http.Request) error {
+	vars := mux.Vars(r)
+
+	for _, param := range uuidParams {
+		value, ok := vars[param]
+		if ok && !uuidPattern.MatchString(value) {
+			return malformedUUIDError{param, value}
+		}
+	}
+
+	return nil
+}
+
 // HTTPErrorData represents the HTTP response body for
 // a compute API request error.
 type HTTPErrorData struct {
-	Code    int    `json:"code"`
-	Name    string `json:"name"`
-	Message string `json:"message"`
+	Code    int         `json:"code"`
+	Name    string      `json:"name"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// problemContentType is the media type of error responses written as
+// RFC 7807 problem details.
+const problemContentType = "application/problem+json"
+
+// ProblemDetails is the body of an error response for clients which
+// accept application/problem+json, as described by RFC 7807. Details
+// is an extension member holding the same information as the details
+// of HTTPErrorData.
+type ProblemDetails struct {
+	Type     string      `json:"type"`
+	Title    string      `json:"title"`
+	Status   int         `json:"status"`
+	Detail   string      `json:"detail"`
+	Instance string      `json:"instance"`
+	Details  interface{} `json:"details,omitempty"`
 }
 
 // HTTPReturnErrorCode represents the unmarshalled version for Return codes
@@ -59,6 +301,398 @@ type HTTPReturnErrorCode struct {
 	Error HTTPErrorData `json:"error"`
 }
 
+// EnvelopeMeta describes the request an enveloped response answers.
+type EnvelopeMeta struct {
+	RequestID  string `json:"request_id"`
+	APIVersion string `json:"api_version,omitempty"`
+}
+
+// Envelope wraps the body of a GET response when enveloped responses
+// are enabled, so that lists and single resources share one shape.
+type Envelope struct {
+	Data interface{}  `json:"data"`
+	Meta EnvelopeMeta `json:"meta"`
+}
+
+// acceptParam returns the value of a parameter given on any of the media
+// types of a request's Accept header, or "" if it has none.
+func acceptParam(r *http.Request, name string) string {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		_, params, err := mime.ParseMediaType(accept)
+		if err != nil {
+			continue
+		}
+
+		if v, ok := params[name]; ok {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// wantsEnvelope reports whether a request asked for an enveloped
+// response with an envelope parameter on its Accept header, e.g.
+// "application/json; envelope=true".
+func wantsEnvelope(r *http.Request) bool {
+	return acceptParam(r, "envelope") == "true"
+}
+
+// wantsCamelCase reports whether a request asked, with a naming parameter
+// on its Accept header, e.g. "application/json; naming=camel", for the
+// member names of JSON documents to be written in camelCase rather than
+// snake_case. Its own body may then use either.
+func wantsCamelCase(r *http.Request) bool {
+	return acceptParam(r, "naming") == "camel"
+}
+
+// camelCase converts a snake_case name, e.g. "mapping_id", to camelCase,
+// e.g. "mappingId".
+func camelCase(name string) string {
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+
+	return strings.Join(parts, "")
+}
+
+// snakeCase converts a camelCase name, e.g. "mappingId", to snake_case,
+// e.g. "mapping_id". Names which are already snake_case are unchanged.
+func snakeCase(name string) string {
+	var b bytes.Buffer
+
+	for i, c := range name {
+		if c >= 'A' && c <= 'Z' {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			c += 'a' - 'A'
+		}
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
+
+// renameMembers renames every member of the JSON document b, however
+// deeply it is nested. The keys of maps are members too, so they are
+// renamed along with the fields of structs.
+func renameMembers(b []byte, rename func(string) string) ([]byte, error) {
+	var v interface{}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	err := d.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+
+	var walk func(v interface{}) interface{}
+	walk = func(v interface{}) interface{} {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			renamed := make(map[string]interface{}, len(v))
+			for k, m := range v {
+				renamed[rename(k)] = walk(m)
+			}
+			return renamed
+		case []interface{}:
+			for i, e := range v {
+				v[i] = walk(e)
+			}
+		}
+		return v
+	}
+
+	return json.Marshal(walk(v))
+}
+
+// snakeCaseBody is a request body whose JSON member names are converted
+// to snake_case as it is read. A body which is not JSON is read unchanged,
+// so that the handler reports the error as usual.
+type snakeCaseBody struct {
+	io.ReadCloser
+	converted *bytes.Reader
+}
+
+func (s *snakeCaseBody) Read(p []byte) (int, error) {
+	if s.converted == nil {
+		b, err := ioutil.ReadAll(s.ReadCloser)
+		if err != nil {
+			return 0, err
+		}
+
+		renamed, err := renameMembers(b, snakeCase)
+		if err == nil {
+			b = renamed
+		}
+
+		s.converted = bytes.NewReader(b)
+	}
+
+	return s.converted.Read(p)
+}
+
+// csvContentType is the media type of responses written as CSV.
+const csvContentType = "text/csv"
+
+// csvTable is a response body which is written as CSV rather than JSON.
+// The first row is the header.
+type csvTable [][]string
+
+// rangedDocument is a response body, such as an export, which clients may
+// download in parts. It is marshalled like any other body but is served
+// by http.ServeContent, so that requests with a Range header receive 206
+// Partial Content.
+type rangedDocument struct {
+	document interface{}
+}
+
+// staticDocument is a response body, such as the list of resources, which
+// rarely changes. Clients may cache it for staticMaxAge, where other
+// responses must be revalidated each time they are used.
+type staticDocument struct {
+	document interface{}
+}
+
+// staticMaxAge is how long clients may cache a staticDocument.
+const staticMaxAge = time.Hour
+
+// ndjsonContentType is the media type of responses written as
+// newline-delimited JSON, one document on each line.
+const ndjsonContentType = "application/x-ndjson"
+
+// routesContentType is the media type of listings of external IPs written
+// as NAT rules for edge routers, one line for each mapping reading
+// "nat <external_ip> <internal_ip>".
+const routesContentType = "text/x.ciao.routes"
+
+// streamedResponse is returned by handlers which have written the
+// response themselves as they went, rather than leave it to ServeHTTP.
+type streamedResponse struct{}
+
+// acceptsMediaType reports whether mediaType is one of the media types of
+// a request's Accept header.
+func acceptsMediaType(r *http.Request, mediaType string) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		m, _, err := mime.ParseMediaType(accept)
+		if err == nil && m == mediaType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// acceptsCSV reports whether text/csv is one of the media types of a
+// request's Accept header.
+func acceptsCSV(r *http.Request) bool {
+	return acceptsMediaType(r, csvContentType)
+}
+
+// acceptsNDJSON reports whether application/x-ndjson is one of the media
+// types of a request's Accept header.
+func acceptsNDJSON(r *http.Request) bool {
+	return acceptsMediaType(r, ndjsonContentType)
+}
+
+// omitLinks reports whether a request asked for a compact response
+// without links, either with a links=false query or a links parameter on
+// its Accept header, e.g. "application/json; links=false".
+func omitLinks(r *http.Request) bool {
+	return r.URL.Query().Get("links") == "false" || acceptParam(r, "links") == "false"
+}
+
+// stripLinks removes every "links" and "link" member from the JSON
+// encoded response b, however deeply it is nested.
+func stripLinks(b []byte) ([]byte, error) {
+	var v interface{}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	err := d.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+
+	var strip func(v interface{})
+	strip = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			delete(v, "links")
+			delete(v, "link")
+			for _, m := range v {
+				strip(m)
+			}
+		case []interface{}:
+			for _, e := range v {
+				strip(e)
+			}
+		}
+	}
+	strip(v)
+
+	return json.Marshal(v)
+}
+
+// rel returns the link relation name, in the configured namespace if
+// there is one, e.g. "ciao:pools".
+func (c *Context) rel(name string) string {
+	if c.relNamespace == "" {
+		return name
+	}
+
+	return c.relNamespace + ":" + name
+}
+
+// namespaceRels puts the rel of every link in the JSON encoded response b,
+// i.e. of each element of a "links" member and of each "link" member,
+// however deeply nested, in namespace.
+func namespaceRels(b []byte, namespace string) ([]byte, error) {
+	var v interface{}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	err := d.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+
+	rename := func(link interface{}) {
+		if l, ok := link.(map[string]interface{}); ok {
+			if rel, ok := l["rel"].(string); ok {
+				l["rel"] = namespace + ":" + rel
+			}
+		}
+	}
+
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if links, ok := v["links"].([]interface{}); ok {
+				for _, l := range links {
+					rename(l)
+				}
+			}
+			rename(v["link"])
+			for _, m := range v {
+				walk(m)
+			}
+		case []interface{}:
+			for _, e := range v {
+				walk(e)
+			}
+		}
+	}
+	walk(v)
+
+	return json.Marshal(v)
+}
+
+// ConfigTransformer may be set in Config to modify the config of every
+// workload created through the API, e.g. to add standard cloud-init
+// snippets. An error from TransformConfig rejects the workload.
+type ConfigTransformer interface {
+	TransformConfig(tenantID string, config string) (string, error)
+}
+
+// AuthorizationRequest describes a request for an Authorizer to allow or
+// deny.
+type AuthorizationRequest struct {
+	Method string
+
+	// Path is the path of the request and Route the path template of
+	// the route which matched it, e.g. "/pools/{pool}", neither
+	// including any BasePath.
+	Path  string
+	Route string
+
+	// TenantID is the tenant the request was authenticated for, empty
+	// if it was made by the admin.
+	TenantID   string
+	Privileged bool
+	Scopes     []string
+}
+
+// Authorizer may be set in Config to delegate the decision whether to
+// allow each request, e.g. to an external policy engine. It is consulted
+// after the privilege checks of the route, so can deny requests which
+// they would allow but not allow those which they deny.
+type Authorizer interface {
+	Authorize(req AuthorizationRequest) bool
+}
+
+// InstanceInfoProvider may be set in Config to describe the instances
+// external IPs are mapped to, for listings which ask for them with
+// expand=instance.
+type InstanceInfoProvider interface {
+	InstanceInfo(tenantID string, instanceID string) (types.InstanceInfo, error)
+}
+
+// ImageChecker may be set in Config to report whether the images the
+// storage of workloads is made from exist, so that workloads left
+// referring to deleted images can be found.
+type ImageChecker interface {
+	ImageExists(tenantID string, imageID string) (bool, error)
+}
+
+// configRejectedError is returned when the ConfigTransformer rejects the
+// config of a new workload.
+type configRejectedError struct {
+	Reason string `json:"reason"`
+}
+
+func (e configRejectedError) Error() string {
+	return "Workload config rejected"
+}
+
+// workloadDiffNotFoundError is returned when one of the workloads being
+// compared cannot be found, naming the parameter which gave it.
+type workloadDiffNotFoundError struct {
+	Param      string `json:"param"`
+	WorkloadID string `json:"workload_id"`
+}
+
+func (e workloadDiffNotFoundError) Error() string {
+	return fmt.Sprintf("Workload %s given as %s not found", e.WorkloadID, e.Param)
+}
+
+// workloadInvalidError is returned when a workload being validated would
+// not be created.
+type workloadInvalidError struct {
+	types.WorkloadValidation
+}
+
+func (e workloadInvalidError) Error() string {
+	return "Invalid workload"
+}
+
+// itemStatus returns the status code and message with which the outcome of
+// one item of a batch request is reported: success if err is nil,
+// otherwise the status err would have had were the item requested on its
+// own.
+func itemStatus(err error, success int) (int, string) {
+	if err == nil {
+		return success, ""
+	}
+
+	return errorResponse(err).status, err.Error()
+}
+
+// multiStatus returns the response of a batch request, whose results
+// report the outcome of each item since some may fail while the others
+// succeed. Requests for a single item are answered with its own status.
+func multiStatus(results interface{}) Response {
+	return Response{http.StatusMultiStatus, results}
+}
+
 // Response contains the http status and any response struct to be marshalled.
 type Response struct {
 	status   int
@@ -66,12 +700,48 @@ type Response struct {
 }
 
 func errorResponse(err error) Response {
+	// errors which carry extra information for the client
+	// are returned as the details of the error response.
+	switch e := err.(type) {
+	case types.PoolExhaustedError:
+		return Response{http.StatusConflict, e}
+	case malformedUUIDError:
+		return Response{http.StatusBadRequest, e}
+	case types.LastPoolInFamilyError:
+		return Response{http.StatusConflict, e}
+	case types.PoolNotEmptyError:
+		return Response{http.StatusConflict, e}
+	case types.AddressNotAllowedError:
+		return Response{http.StatusForbidden, e}
+	case types.AddressReservedError:
+		return Response{http.StatusConflict, e}
+	case types.InstanceMappingLimitError:
+		return Response{http.StatusForbidden, e}
+	case types.SubQuotaExceedsParentError:
+		return Response{http.StatusConflict, e}
+	case types.QuotaBelowUsageError:
+		return Response{http.StatusConflict, e}
+	case types.InternalIPMismatchError:
+		return Response{http.StatusUnprocessableEntity, e}
+	case configRejectedError:
+		return Response{http.StatusUnprocessableEntity, e}
+	case workloadDiffNotFoundError:
+		return Response{http.StatusNotFound, e}
+	case workloadInvalidError:
+		return Response{http.StatusUnprocessableEntity, e.WorkloadValidation}
+	}
+
 	switch err {
 	case types.ErrPoolNotFound,
 		types.ErrTenantNotFound,
+		types.ErrQuotaNotFound,
 		types.ErrAddressNotFound,
 		types.ErrInstanceNotFound,
-		types.ErrWorkloadNotFound:
+		types.ErrWorkloadNotFound,
+		types.ErrReservationNotFound,
+		errNoWebhook,
+		errNoImageChecker,
+		errNoSchema:
 		return Response{http.StatusNotFound, nil}
 
 	case types.ErrQuota,
@@ -82,26 +752,178 @@ func errorResponse(err error) Response {
 		types.ErrPoolNotEmpty,
 		types.ErrInvalidPoolAddress,
 		types.ErrBadRequest,
-		types.ErrPoolEmpty,
-		types.ErrDuplicatePoolName,
-		types.ErrWorkloadInUse:
+		types.ErrWorkloadInUse,
+		types.ErrWorkloadPublic,
+		types.ErrTenantSuspended,
+		types.ErrPoolLimitReached,
+		types.ErrMappingLimitReached,
+		types.ErrForbidden:
 		return Response{http.StatusForbidden, nil}
 
+	case types.ErrPoolEmpty,
+		types.ErrAddressAttached,
+		types.ErrAddressNotAttached,
+		types.ErrDuplicateMappingRole,
+		types.ErrDuplicatePoolName,
+		types.ErrTenantExists,
+		types.ErrTenantHasResources,
+		types.ErrAddressInUse,
+		types.ErrPoolExists,
+		types.ErrPoolDrained:
+		return Response{http.StatusConflict, nil}
+
+	case types.ErrInvalidFilter,
+		types.ErrInvalidSort,
+		types.ErrInvalidPoolSelection,
+		types.ErrInvalidStorage,
+		types.ErrInvalidWorkloadDefault,
+		types.ErrInvalidPoolName,
+		types.ErrPoolNameRequired,
+		types.ErrInvalidTenantName,
+		types.ErrPoolDescriptionTooLong,
+		types.ErrInvalidBlockSize,
+		types.ErrInvalidLabels,
+		types.ErrInvalidReservation,
+		errInvalidWatchTimeout,
+		errUnknownResource,
+		errInvalidCursor,
+		errInvalidBundle,
+		errInvalidSnapshot,
+		errInvalidInstanceID:
+		return Response{http.StatusBadRequest, nil}
+
+	case types.ErrIncompatibleFirmware:
+		return Response{http.StatusUnprocessableEntity, nil}
+
+	case errBodyTooLarge:
+		return Response{http.StatusRequestEntityTooLarge, nil}
+
+	case errNotAcceptable:
+		return Response{http.StatusNotAcceptable, nil}
+
+	case errUnsupportedMediaType:
+		return Response{http.StatusUnsupportedMediaType, nil}
+
+	case errRequestTimeout,
+		errMaintenance,
+		errTooManyInFlight:
+		return Response{http.StatusServiceUnavailable, nil}
+
+	case errPreconditionFailed:
+		return Response{http.StatusPreconditionFailed, nil}
+
 	default:
 		return Response{http.StatusInternalServerError, nil}
 	}
 }
 
-// Handler is a custom handler for the compute APIs.
+// routeMethods are the methods which routes may be registered for, in the
+// order they are given in an Allow header.
+var routeMethods = []string{
+	http.MethodGet,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+}
+
+// methodNotAllowedHandler is used for requests which the router has
+// no route for. If the path of the request matches a route for some
+// other method, 405 is returned along with the methods the path allows.
+type methodNotAllowedHandler struct {
+	router *mux.Router
+	next   http.Handler
+}
+
+func (h methodNotAllowedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// routes are matched on content type as well, so probe with a
+	// type that every route accepts.
+	matches := func(method string) bool {
+		probe := *r
+		probe.Method = method
+		probe.Header = http.Header{"Content-Type": {"application/json"}}
+
+		var match mux.RouteMatch
+		return h.router.Match(&probe, &match) && match.Route != nil
+	}
+
+	var allowed []string
+
+	// a request whose method is allowed failed to match for some
+	// other reason.
+	if !matches(r.Method) {
+		for _, method := range routeMethods {
+			if matches(method) {
+				allowed = append(allowed, method)
+			}
+		}
+	}
+
+	if len(allowed) == 0 {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+}
+
 // This custom handler allows us to more cleanly return an error and response,
 // and pass some package level context into the handler.
 type Handler struct {
 	*Context
-	Handler    func(*Context, http.ResponseWriter, *http.Request) (Response, error)
+	Handler    handlerFunc
 	Privileged bool
 }
 
+type handlerFunc func(*Context, http.ResponseWriter, *http.Request) (Response, error)
+
+// requireScope wraps a handler which makes changes needing scope.
+// Privileged callers without the scope are forbidden. Other callers are
+// left to the checks of the route and the handler.
+func requireScope(scope string, fn handlerFunc) handlerFunc {
+	return func(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+		ctx := r.Context()
+		if service.GetPrivilege(ctx) && !service.HasScope(ctx, scope) {
+			return errorResponse(types.ErrForbidden), types.ErrForbidden
+		}
+
+		return fn(c, w, r)
+	}
+}
+
+// limitConcurrency wraps the handler of one of the ExpensiveRoutes so that
+// it serves no more requests at once than ConcurrencyLimits allows for
+// path. Requests beyond the limit are refused with 503 Service
+// Unavailable rather than queued. Routes without a limit are not wrapped.
+func limitConcurrency(context *Context, path string, fn handlerFunc) handlerFunc {
+	limit := context.concurrencyLimits[path]
+	if limit <= 0 {
+		return fn
+	}
+
+	inFlight := make(chan struct{}, limit)
+
+	return func(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+		select {
+		case inFlight <- struct{}{}:
+			defer func() { <-inFlight }()
+			return fn(c, w, r)
+		default:
+			w.Header().Set("Retry-After", strconv.Itoa(ConcurrencyRetryAfter))
+			return errorResponse(errTooManyInFlight), errTooManyInFlight
+		}
+	}
+}
+
 func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.slowRequest > 0 {
+		start := time.Now()
+		defer func() {
+			h.logSlowRequest(r, time.Since(start))
+		}()
+	}
+
 	// check whether we should send permission denied for this route.
 	if h.Privileged {
 		privileged := service.GetPrivilege(r.Context())
@@ -114,12 +936,63 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// set the content type to whatever was requested.
 	contentType := r.Header.Get("Content-Type")
 
-	resp, err := h.Handler(h.Context, w, r)
+	// let clients of a deprecated media type know when it goes away.
+	if sunset, ok := h.deprecated[mediaVersion(contentType)]; ok {
+		w.Header().Set("Deprecation", "true")
+		if !sunset.IsZero() {
+			w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+		}
+	}
+
+	camel := wantsCamelCase(r)
+
+	switch r.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		r.Body = &limitedBody{r.Body, h.maxBodySize(r)}
+		if camel {
+			r.Body = &snakeCaseBody{ReadCloser: r.Body}
+		}
+	}
+
+	var resp Response
+
+	err := h.authorize(r)
+	if err == nil {
+		err = h.checkContentType(r)
+	}
+	if err == nil {
+		err = h.checkMaintenance(w, r)
+	}
+	if err == nil {
+		err = validateUUIDs(r)
+	}
+	if err != nil {
+		resp = errorResponse(err)
+	} else if h.budget > 0 {
+		timing := &serverTiming{}
+		start := time.Now()
+		resp, err = h.callHandler(h.timedContext(timing), w, r)
+		timing.setHeader(w, time.Since(start), h.budget)
+	} else {
+		resp, err = h.callHandler(h.Context, w, r)
+	}
 	if err != nil {
+		// clients told when addresses will be freed can retry then
+		// rather than giving up.
+		if e, ok := err.(types.PoolExhaustedError); ok && e.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(e.RetryAfter))
+		}
+
+		if acceptsMediaType(r, problemContentType) {
+			writeProblem(w, r, resp, err, camel)
+			return
+		}
+
 		data := HTTPErrorData{
 			Code:    resp.status,
 			Name:    http.StatusText(resp.status),
 			Message: err.Error(),
+			Details: resp.response,
 		}
 
 		code := HTTPReturnErrorCode{
@@ -127,6 +1000,9 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 
 		b, err := json.Marshal(code)
+		if err == nil && camel {
+			b, err = renameMembers(b, camelCase)
+		}
 		if err != nil {
 			http.Error(w, http.StatusText(resp.status), resp.status)
 			return
@@ -136,597 +1012,5001 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	b, err := json.Marshal(resp.response)
-	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError),
-			http.StatusInternalServerError)
+	// a streamed response has already been written.
+	if _, ok := resp.response.(streamedResponse); ok {
 		return
 	}
 
-	w.Header().Set("Content-Type", contentType)
-	w.WriteHeader(resp.status)
-	w.Write(b)
-}
+	// a 304 response has no body.
+	if resp.status == http.StatusNotModified {
+		w.WriteHeader(resp.status)
+		return
+	}
 
-func listResources(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
-	var links []types.APILink
-	vars := mux.Vars(r)
-	tenantID, ok := vars["tenant"]
+	table, isCSV := resp.response.(csvTable)
 
-	// we support the "pools" resource.
-	link := types.APILink{
-		Rel:        "pools",
-		Version:    PoolsV1,
-		MinVersion: PoolsV1,
+	doc, ranged := resp.response.(rangedDocument)
+	if ranged {
+		resp.response = doc.document
 	}
 
-	if !ok {
-		link.Href = fmt.Sprintf("%s/pools", c.URL)
-	} else {
-		link.Href = fmt.Sprintf("%s/%s/pools", c.URL, tenantID)
+	static, isStatic := resp.response.(staticDocument)
+	if isStatic {
+		resp.response = static.document
 	}
 
-	links = append(links, link)
-
-	// we support the "external-ips" resource
-	link = types.APILink{
-		Rel:        "external-ips",
-		Version:    ExternalIPsV1,
-		MinVersion: ExternalIPsV1,
-	}
+	var b []byte
+	if isCSV {
+		var buf bytes.Buffer
 
-	if !ok {
-		link.Href = fmt.Sprintf("%s/external-ips", c.URL)
+		err = csv.NewWriter(&buf).WriteAll(table)
+		b = buf.Bytes()
+		contentType = csvContentType
 	} else {
-		link.Href = fmt.Sprintf("%s/%s/external-ips", c.URL, tenantID)
+		b, err = json.Marshal(resp.response)
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
 	}
 
-	links = append(links, link)
+	// links are kept unless the client asks for them to be left out.
+	if !isCSV && omitLinks(r) {
+		b, err = stripLinks(b)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError),
+				http.StatusInternalServerError)
+			return
+		}
+	}
 
-	// we support the "workloads" resource
-	link = types.APILink{
-		Rel:        "workloads",
-		Version:    WorkloadsV1,
-		MinVersion: WorkloadsV1,
+	if !isCSV && h.relNamespace != "" && !omitLinks(r) {
+		b, err = namespaceRels(b, h.relNamespace)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError),
+				http.StatusInternalServerError)
+			return
+		}
 	}
 
-	if !ok {
-		link.Href = fmt.Sprintf("%s/workloads", c.URL)
-	} else {
-		link.Href = fmt.Sprintf("%s/%s/workloads", c.URL, tenantID)
+	if !isCSV && camel {
+		b, err = renameMembers(b, camelCase)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError),
+				http.StatusInternalServerError)
+			return
+		}
 	}
 
-	links = append(links, link)
+	// listings are polled frequently, so let clients revalidate
+	// the response they already have rather than fetch it again.
+	if r.Method == http.MethodGet && resp.status == http.StatusOK {
+		// handlers may set a strong entity tag of their own.
+		etag := w.Header().Get("ETag")
+		if etag == "" {
+			etag = weakETag(b)
+			w.Header().Set("ETag", etag)
+		}
 
-	// for the "tenants" resource
-	link = types.APILink{
-		Rel:        "tenants",
-		Version:    TenantsV1,
-		MinVersion: TenantsV1,
-	}
+		// responses depend on who is asking, so are only cached
+		// by the client.
+		if isStatic {
+			w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(staticMaxAge.Seconds())))
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
 
-	if !ok {
-		link.Href = fmt.Sprintf("%s/tenants", c.URL)
-	} else {
-		link.Href = fmt.Sprintf("%s/%s/tenants", c.URL, tenantID)
+		if etagMatch(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
 	}
 
-	links = append(links, link)
+	// the envelope is added after the ETag is computed, as its
+	// request ID differs between otherwise identical responses.
+	enveloped := r.Method == http.MethodGet && !isCSV && (h.envelope || wantsEnvelope(r))
+	if enveloped {
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" {
+			requestID = uuid.Generate().String()
+		}
 
-	return Response{http.StatusOK, links}, nil
-}
+		w.Header().Set("X-Request-ID", requestID)
 
-func showPool(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
-	vars := mux.Vars(r)
-	ID := vars["pool"]
+		envelope := Envelope{
+			Data: resp.response,
+			Meta: EnvelopeMeta{
+				RequestID:  requestID,
+				APIVersion: mediaVersion(contentType),
+			},
+		}
 
-	pool, err := c.ShowPool(ID)
-	if err != nil {
-		return errorResponse(err), err
+		b, err = json.Marshal(envelope)
+		if err == nil && camel {
+			b, err = renameMembers(b, camelCase)
+		}
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError),
+				http.StatusInternalServerError)
+			return
+		}
 	}
 
-	return Response{http.StatusOK, pool}, nil
-}
+	w.Header().Set("Content-Type", contentType)
 
-func listPools(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
-	var resp types.ListPoolsResponse
-	vars := mux.Vars(r)
-	_, ok := vars["tenant"]
+	// an enveloped document differs between requests, so ranges of it
+	// cannot be put back together.
+	if ranged && !enveloped && r.Method == http.MethodGet && resp.status == http.StatusOK {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+		return
+	}
 
-	pools, err := c.ListPools()
-	if err != nil {
-		return errorResponse(err), err
+	w.WriteHeader(resp.status)
+	w.Write(b)
+}
+
+// authorize returns ErrForbidden if the Authorizer, if there is one,
+// denies the request.
+func (h Handler) authorize(r *http.Request) error {
+	if h.authorizer == nil {
+		return nil
 	}
 
-	queries := r.URL.Query()
+	ctx := r.Context()
+	tenantID, _ := service.GetTenantID(ctx)
 
-	names, returnNamedPool := queries["name"]
+	req := AuthorizationRequest{
+		Method:     r.Method,
+		Path:       strings.TrimPrefix(r.URL.Path, h.basePath),
+		TenantID:   tenantID,
+		Privileged: service.GetPrivilege(ctx),
+		Scopes:     service.GetScopes(ctx),
+	}
 
-	var match bool
-	for i, p := range pools {
-		if returnNamedPool == true {
-			for _, name := range names {
-				if name == p.Name {
-					match = true
-				}
-			}
-		} else {
-			match = true
+	if route := mux.CurrentRoute(r); route != nil {
+		path, err := route.GetPathTemplate()
+		if err == nil {
+			req.Route = strings.TrimPrefix(path, h.basePath)
 		}
+	}
 
-		if match {
-			summary := types.PoolSummary{
-				ID:   p.ID,
-				Name: p.Name,
-			}
+	if !h.authorizer.Authorize(req) {
+		return types.ErrForbidden
+	}
 
-			if !ok {
-				summary.TotalIPs = &pools[i].TotalIPs
-				summary.Free = &pools[i].Free
-				summary.Links = pools[i].Links
-			}
+	return nil
+}
+
+// checkContentType returns errUnsupportedMediaType, if the Content-Type is
+// enforced, for a request which would change something and does not give
+// a ciao media type. DELETE requests need not have a body, so are only
+// checked if they do.
+func (h Handler) checkContentType(r *http.Request) error {
+	if !h.strictContentType {
+		return nil
+	}
 
-			resp.Pools = append(resp.Pools, summary)
+	switch r.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+	case http.MethodDelete:
+		if r.ContentLength == 0 {
+			return nil
 		}
+	default:
+		return nil
 	}
 
-	if returnNamedPool && !match {
-		return Response{http.StatusNotFound, nil}, types.ErrPoolNotFound
+	m, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return errUnsupportedMediaType
 	}
 
-	return Response{http.StatusOK, resp}, err
+	if strings.HasPrefix(m, "application/x.ciao.") || m == "application/"+MergePatch {
+		return nil
+	}
+
+	return errUnsupportedMediaType
 }
 
-func addPool(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
-	var req types.NewPoolRequest
+// checkMaintenance returns errMaintenance, and asks the client to retry
+// later, if the API is in maintenance mode and the request would change
+// something. Reads are always allowed, as are changes to maintenance mode
+// itself.
+func (h Handler) checkMaintenance(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return nil
+	}
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return errorResponse(err), err
+	state := h.maintenance.get()
+	if !state.Enabled {
+		return nil
 	}
 
-	err = json.Unmarshal(body, &req)
-	if err != nil {
-		return errorResponse(err), err
+	if state.AllowPrivileged && service.GetPrivilege(r.Context()) {
+		return nil
 	}
 
-	var ips []string
+	if route := mux.CurrentRoute(r); route != nil {
+		path, err := route.GetPathTemplate()
+		if err == nil && strings.TrimPrefix(path, h.basePath) == maintenancePath {
+			return nil
+		}
+	}
 
-	for _, ip := range req.IPs {
-		ips = append(ips, ip.IP)
+	w.Header().Set("Retry-After", strconv.Itoa(state.RetryAfter))
+
+	return errMaintenance
+}
+
+// writeProblem writes the error response of a failed request as RFC 7807
+// problem details, for clients which asked for them.
+func writeProblem(w http.ResponseWriter, r *http.Request, resp Response, err error, camel bool) {
+	problem := ProblemDetails{
+		Type:     "about:blank",
+		Title:    http.StatusText(resp.status),
+		Status:   resp.status,
+		Detail:   err.Error(),
+		Instance: r.URL.RequestURI(),
+		Details:  resp.response,
 	}
 
-	_, err = c.AddPool(req.Name, req.Subnet, ips)
+	b, err := json.Marshal(problem)
+	if err == nil && camel {
+		b, err = renameMembers(b, camelCase)
+	}
 	if err != nil {
-		return errorResponse(err), err
+		http.Error(w, http.StatusText(resp.status), resp.status)
+		return
 	}
 
-	return Response{http.StatusNoContent, nil}, nil
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(resp.status)
+	w.Write(b)
 }
 
-func deletePool(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
-	vars := mux.Vars(r)
-	ID := vars["pool"]
+// timedContext returns a copy of the handler's context whose calls to
+// the service are added to timing.
+func (h Handler) timedContext(timing *serverTiming) *Context {
+	c := *h.Context
+	c.Service = &timedService{Service: h.Service, timing: timing}
+	return &c
+}
 
-	err := c.DeletePool(ID)
-	if err != nil {
-		return errorResponse(err), err
+// callHandler calls the route's handler, giving up on it with
+// errRequestTimeout if it runs past the request timeout. The handler is
+// given a context with the timeout as its deadline, which is passed on
+// to the service if it is a ContextService. What the handler writes is
+// held back until it finishes, and dropped if it times out, so that it
+// cannot write to the response once the timeout has been reported.
+func (h Handler) callHandler(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	if h.timeout <= 0 {
+		return h.Handler(c, w, r)
 	}
 
-	return Response{http.StatusNoContent, nil}, nil
-}
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
 
-func addToPool(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
-	vars := mux.Vars(r)
-	ID := vars["pool"]
+	r = r.WithContext(ctx)
 
-	var req types.NewAddressRequest
+	bounded := *c
+	bounded.Service = serviceWithContext(c.Service, ctx)
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return errorResponse(err), err
+	tw := newTimeoutWriter(w)
+
+	type result struct {
+		resp Response
+		err  error
 	}
 
-	err = json.Unmarshal(body, &req)
-	if err != nil {
-		return errorResponse(err), err
+	done := make(chan result, 1)
+
+	go func() {
+		resp, err := h.Handler(&bounded, tw, r)
+		done <- result{resp, err}
+	}()
+
+	select {
+	case res := <-done:
+		tw.copyTo(w)
+		return res.resp, res.err
+	case <-ctx.Done():
+		tw.timeout()
+		return errorResponse(errRequestTimeout), errRequestTimeout
+	}
+}
+
+// serviceWithContext returns the service which should serve a request
+// with the given context. Timing is kept, with the service it times
+// given the context.
+func serviceWithContext(s Service, ctx context.Context) Service {
+	switch s := s.(type) {
+	case *timedService:
+		return &timedService{Service: serviceWithContext(s.Service, ctx), timing: s.timing}
+	case ContextService:
+		return s.WithContext(ctx)
 	}
 
-	var ips []string
+	return s
+}
 
-	for _, ip := range req.IPs {
-		ips = append(ips, ip.IP)
+// timeoutWriter holds what a handler with a timeout writes until it
+// finishes. Once the request has timed out writes fail with
+// http.ErrHandlerTimeout.
+type timeoutWriter struct {
+	sync.Mutex
+	header   http.Header
+	body     bytes.Buffer
+	status   int
+	timedOut bool
+}
+
+// newTimeoutWriter returns a timeoutWriter whose headers start as those
+// already set on w.
+func newTimeoutWriter(w http.ResponseWriter) *timeoutWriter {
+	header := make(http.Header)
+	for k, v := range w.Header() {
+		header[k] = v
 	}
 
-	err = c.AddAddress(ID, req.Subnet, ips)
-	if err != nil {
-		return errorResponse(err), err
+	return &timeoutWriter{header: header}
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.Lock()
+	defer tw.Unlock()
+
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
 	}
 
-	return Response{http.StatusNoContent, nil}, nil
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+
+	return tw.body.Write(b)
 }
 
-func deleteSubnet(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
-	vars := mux.Vars(r)
-	poolID := vars["pool"]
-	subnetID := vars["subnet"]
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.Lock()
+	defer tw.Unlock()
 
-	err := c.RemoveAddress(poolID, &subnetID, nil)
-	if err != nil {
-		return errorResponse(err), err
+	if tw.timedOut || tw.status != 0 {
+		return
 	}
 
-	return Response{http.StatusNoContent, nil}, nil
+	tw.status = status
 }
 
-func deleteExternalIP(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
-	vars := mux.Vars(r)
-	poolID := vars["pool"]
-	IPID := vars["ip_id"]
+// timeout stops anything further being written.
+func (tw *timeoutWriter) timeout() {
+	tw.Lock()
+	tw.timedOut = true
+	tw.Unlock()
+}
 
-	err := c.RemoveAddress(poolID, nil, &IPID)
-	if err != nil {
-		return errorResponse(err), err
+// copyTo writes the headers, and any status and body, the handler wrote
+// to w.
+func (tw *timeoutWriter) copyTo(w http.ResponseWriter) {
+	tw.Lock()
+	defer tw.Unlock()
+
+	dst := w.Header()
+	for k := range dst {
+		delete(dst, k)
+	}
+	for k, v := range tw.header {
+		dst[k] = v
 	}
 
-	return Response{http.StatusNoContent, nil}, nil
+	if tw.status != 0 {
+		w.WriteHeader(tw.status)
+		_, _ = w.Write(tw.body.Bytes())
+	}
 }
 
-func listMappedIPs(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
-	vars := mux.Vars(r)
-	tenantID, ok := vars["tenant"]
-	var IPs []types.MappedIP
-	var short []types.MappedIPShort
+// logSlowRequest logs requests which took longer than the slow request
+// threshold, along with the route they were for.
+func (h Handler) logSlowRequest(r *http.Request, duration time.Duration) {
+	if duration < h.slowRequest {
+		return
+	}
 
-	if !ok {
-		IPs = c.ListMappedAddresses(nil)
-		return Response{http.StatusOK, IPs}, nil
+	path := r.URL.Path
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			path = tpl
+		}
 	}
 
-	IPs = c.ListMappedAddresses(&tenantID)
-	for _, IP := range IPs {
-		s := types.MappedIPShort{
-			ID:         IP.ID,
-			ExternalIP: IP.ExternalIP,
-			InternalIP: IP.InternalIP,
-			InstanceID: IP.InstanceID,
-			Links:      IP.Links,
+	glog.Warningf("Slow request: %s %s took %v", r.Method, path, duration)
+}
+
+// maxBodySize returns the largest request body allowed for the route
+// matched by r.
+func (h Handler) maxBodySize(r *http.Request) int64 {
+	if route := mux.CurrentRoute(r); route != nil {
+		path, err := route.GetPathTemplate()
+		path = strings.TrimPrefix(path, h.basePath)
+		if size, ok := h.routeMaxBodySizes[path]; ok && err == nil {
+			return size
 		}
-		short = append(short, s)
 	}
 
-	return Response{http.StatusOK, short}, nil
+	return h.maxBody
 }
 
-func mapExternalIP(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
-	vars := mux.Vars(r)
-	var req types.MapIPRequest
+// limitedBody is a request body which fails with errBodyTooLarge once
+// more than the remaining number of bytes have been read from it.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return errorResponse(err), err
+func (l *limitedBody) Read(p []byte) (int, error) {
+	// read one byte past the limit so we can tell if it is exceeded.
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
 	}
 
-	err = json.Unmarshal(body, &req)
-	if err != nil {
-		return errorResponse(err), err
+	n, err := l.ReadCloser.Read(p)
+	if int64(n) > l.remaining {
+		n = int(l.remaining)
+		l.remaining = 0
+		return n, errBodyTooLarge
 	}
 
-	tenantID := vars["tenant"]
+	l.remaining -= int64(n)
+	return n, err
+}
 
-	err = c.MapAddress(tenantID, req.PoolName, req.InstanceID)
-	if err != nil {
-		return errorResponse(err), err
+// mediaVersion returns the ciao media type version named by a content
+// type, e.g. "x.ciao.pools.v1" for "application/x.ciao.pools.v1". Plain
+// application/json requests are always served the current version of a
+// resource, so they have no version here.
+func mediaVersion(contentType string) string {
+	version := strings.TrimPrefix(contentType, "application/")
+	if version == contentType || version == "json" {
+		return ""
 	}
 
-	return Response{http.StatusNoContent, nil}, nil
+	return version
 }
 
-func unmapExternalIP(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
-	vars := mux.Vars(r)
-	tenantID, ok := vars["tenant"]
-	mappingID := vars["mapping_id"]
-
-	var IPs []types.MappedIP
+// resourceVersions are the media type versions served for each resource,
+// keyed by the name of the resource as it appears in paths.
+var resourceVersions = map[string]string{
+	"pools":        PoolsV1,
+	"external-ips": ExternalIPsV1,
+	"workloads":    WorkloadsV1,
+	"tenants":      TenantsV1,
+}
 
+// negotiateVersion returns the media type version of a resource which
+// would be served to a request with the Accept header given. Plain JSON
+// and wildcards are served the current version, which is the only one
+// each resource has so far. Media types given a quality of 0 are not
+// acceptable. It also reports whether the version was named explicitly,
+// as only requests which name a deprecated version are told it is.
+func negotiateVersion(resource string, accept string) (string, bool, error) {
+	version, ok := resourceVersions[resource]
 	if !ok {
-		IPs = c.ListMappedAddresses(nil)
-	} else {
-		IPs = c.ListMappedAddresses(&tenantID)
+		return "", false, errUnknownResource
 	}
 
-	for _, m := range IPs {
-		if m.ID == mappingID {
-			err := c.UnMapAddress(m.ExternalIP)
+	if strings.TrimSpace(accept) == "" {
+		return version, false, nil
+	}
+
+	for _, a := range strings.Split(accept, ",") {
+		m, params, err := mime.ParseMediaType(a)
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(v, 64)
 			if err != nil {
-				return errorResponse(err), err
+				continue
+			}
+		}
+
+		if q <= 0 {
+			continue
+		}
+
+		switch m {
+		case "application/" + version:
+			return version, true, nil
+		case "application/json", "application/*", "*/*":
+			return version, false, nil
+		}
+	}
+
+	return "", false, errNotAcceptable
+}
+
+// weakETag returns a weak entity tag computed over a serialized response.
+func weakETag(body []byte) string {
+	return fmt.Sprintf("W/\"%x\"", sha256.Sum256(body))
+}
+
+// etagMatch reports whether an If-None-Match header value matches etag.
+// Weak comparison is used, as described in RFC 7232 section 2.3.2.
+func etagMatch(header string, etag string) bool {
+	if header == "" {
+		return false
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+
+		if strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// revisionETag returns the strong entity tag of a resource revision.
+func revisionETag(revision int) string {
+	return fmt.Sprintf("\"%d\"", revision)
+}
+
+// ifMatch reports whether an If-Match header value matches etag. Strong
+// comparison is used, as described in RFC 7232 section 3.1, so weak tags
+// never match. A missing header matches anything.
+func ifMatch(header string, etag string) bool {
+	if header == "" {
+		return true
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// page is the part of a listing asked for by a request. Listings may be
+// paginated by offset, or by cursor when the list may change between
+// requests, but not both at once.
+type page struct {
+	// cursor is set when the request asked for cursor pagination.
+	cursor bool
+
+	// after is the sort key of the last item of the previous page.
+	// It is empty for the first page.
+	after string
+
+	offset int
+
+	// limit is the most items on the page, or 0 for no limit.
+	limit int
+}
+
+// requestPage reads the offset, limit and cursor parameters of a listing.
+// An empty cursor parameter asks for the first page of a cursor
+// paginated listing.
+func requestPage(r *http.Request) (page, error) {
+	var p page
+	var err error
+
+	queries := r.URL.Query()
+
+	if o := queries.Get("offset"); o != "" {
+		p.offset, err = strconv.Atoi(o)
+		if err != nil || p.offset < 0 {
+			return p, types.ErrInvalidFilter
+		}
+	}
+
+	if l := queries.Get("limit"); l != "" {
+		p.limit, err = strconv.Atoi(l)
+		if err != nil || p.limit < 0 {
+			return p, types.ErrInvalidFilter
+		}
+	}
+
+	cursor, ok := queries["cursor"]
+	if !ok {
+		return p, nil
+	}
+
+	if _, ok := queries["offset"]; ok {
+		return p, types.ErrInvalidFilter
+	}
+
+	p.cursor = true
+	if p.limit == 0 {
+		p.limit = DefaultPageSize
+	}
+
+	if cursor[0] == "" {
+		return p, nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(cursor[0])
+	if err != nil || !strings.HasPrefix(string(b), cursorPrefix) {
+		return p, errInvalidCursor
+	}
+
+	p.after = strings.TrimPrefix(string(b), cursorPrefix)
+
+	return p, nil
+}
+
+// window returns the bounds of the page within a list of n items, and
+// the cursor for the next page, or "" if this is the last. key returns
+// the sort key of item i; with cursor pagination the items must be in
+// key order.
+func (p page) window(n int, key func(int) string) (int, int, string) {
+	var start int
+
+	if p.cursor {
+		start = sort.Search(n, func(i int) bool { return key(i) > p.after })
+	} else if p.offset < n {
+		start = p.offset
+	} else {
+		start = n
+	}
+
+	end := n
+	if p.limit > 0 && start+p.limit < n {
+		end = start + p.limit
+	}
+
+	if !p.cursor || end == n || end == start {
+		return start, end, ""
+	}
+
+	next := base64.RawURLEncoding.EncodeToString([]byte(cursorPrefix + key(end-1)))
+
+	return start, end, next
+}
+
+// setNextCursor tells the client how to fetch the next page of a cursor
+// paginated listing.
+func setNextCursor(w http.ResponseWriter, next string) {
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+}
+
+// metricsContentType is the media type of the Prometheus text exposition
+// format.
+const metricsContentType = "text/plain; version=0.0.4"
+
+// metricLabel escapes a value for use as a Prometheus label value.
+var metricLabel = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeGauge writes the values of a gauge for each pool.
+func writeGauge(b *bytes.Buffer, name string, help string, pools []types.Pool, value func(types.Pool) int) {
+	fmt.Fprintf(b, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(b, "# TYPE %s gauge\n", name)
+
+	for _, pool := range pools {
+		fmt.Fprintf(b, "%s{pool=\"%s\"} %d\n", name, metricLabel.Replace(pool.Name), value(pool))
+	}
+}
+
+// showMetrics reports the free and total addresses of each pool as
+// Prometheus gauges, read from the pools when they are scraped.
+func showMetrics(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	pools, err := c.ListPools()
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].Name < pools[j].Name
+	})
+
+	var b bytes.Buffer
+	writeGauge(&b, "ciao_pool_free", "External IPs of the pool which are not mapped or reserved.", pools, func(p types.Pool) int {
+		return p.Free
+	})
+	writeGauge(&b, "ciao_pool_total", "External IPs of the pool.", pools, func(p types.Pool) int {
+		return p.TotalIPs
+	})
+
+	w.Header().Set("Content-Type", metricsContentType)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(b.Bytes())
+
+	return Response{http.StatusOK, streamedResponse{}}, nil
+}
+
+func listResources(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	var links []types.APILink
+	vars := mux.Vars(r)
+	tenantID, ok := vars["tenant"]
+
+	// we support the "pools" resource.
+	link := types.APILink{
+		Rel:        c.rel("pools"),
+		Version:    PoolsV1,
+		MinVersion: PoolsV1,
+	}
+
+	if !ok {
+		link.Href = fmt.Sprintf("%s/pools", c.URL)
+	} else {
+		link.Href = fmt.Sprintf("%s/%s/pools", c.URL, tenantID)
+	}
+
+	links = append(links, link)
+
+	// we support the "external-ips" resource
+	link = types.APILink{
+		Rel:        c.rel("external-ips"),
+		Version:    ExternalIPsV1,
+		MinVersion: ExternalIPsV1,
+	}
+
+	if !ok {
+		link.Href = fmt.Sprintf("%s/external-ips", c.URL)
+	} else {
+		link.Href = fmt.Sprintf("%s/%s/external-ips", c.URL, tenantID)
+	}
+
+	links = append(links, link)
+
+	// we support the "workloads" resource
+	link = types.APILink{
+		Rel:        c.rel("workloads"),
+		Version:    WorkloadsV1,
+		MinVersion: WorkloadsV1,
+	}
+
+	if !ok {
+		link.Href = fmt.Sprintf("%s/workloads", c.URL)
+	} else {
+		link.Href = fmt.Sprintf("%s/%s/workloads", c.URL, tenantID)
+	}
+
+	links = append(links, link)
+
+	// for the "tenants" resource
+	link = types.APILink{
+		Rel:        c.rel("tenants"),
+		Version:    TenantsV1,
+		MinVersion: TenantsV1,
+	}
+
+	if !ok {
+		link.Href = fmt.Sprintf("%s/tenants", c.URL)
+	} else {
+		link.Href = fmt.Sprintf("%s/%s/tenants", c.URL, tenantID)
+	}
+
+	links = append(links, link)
+
+	return Response{http.StatusOK, staticDocument{links}}, nil
+}
+
+// listTenantResources lists the resources a tenant may use, with links
+// to the routes a tenant can reach them by, so that tenant clients need
+// not build them.
+func listTenantResources(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	tenantID := mux.Vars(r)["for_tenant"]
+
+	if !service.GetPrivilege(r.Context()) {
+		caller, err := service.GetTenantID(r.Context())
+		if err != nil || caller != tenantID {
+			return errorResponse(types.ErrForbidden), types.ErrForbidden
+		}
+	}
+
+	links := []types.APILink{
+		{
+			Rel:        c.rel("quotas"),
+			Href:       fmt.Sprintf("%s/%s/tenants/quotas", c.URL, tenantID),
+			Version:    TenantsV1,
+			MinVersion: TenantsV1,
+		},
+		{
+			Rel:        c.rel("external-ips"),
+			Href:       fmt.Sprintf("%s/%s/external-ips", c.URL, tenantID),
+			Version:    ExternalIPsV1,
+			MinVersion: ExternalIPsV1,
+		},
+		{
+			Rel:        c.rel("workloads"),
+			Href:       fmt.Sprintf("%s/%s/workloads", c.URL, tenantID),
+			Version:    WorkloadsV1,
+			MinVersion: WorkloadsV1,
+		},
+		{
+			Rel:        c.rel("pools"),
+			Href:       fmt.Sprintf("%s/tenants/%s/pools", c.URL, tenantID),
+			Version:    PoolsV1,
+			MinVersion: PoolsV1,
+		},
+	}
+
+	return Response{http.StatusOK, staticDocument{links}}, nil
+}
+
+// maintenancePath is the route which shows and changes maintenance mode.
+const maintenancePath = "/admin/maintenance"
+
+func showMaintenance(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	return Response{http.StatusOK, c.maintenance.get()}, nil
+}
+
+// updateMaintenance turns maintenance mode on or off. While it is on the
+// API only serves reads, e.g. so that the datastore can be migrated.
+func updateMaintenance(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	var req types.Maintenance
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	c.maintenance.set(req)
+
+	return Response{http.StatusOK, c.maintenance.get()}, nil
+}
+
+// showHealth reports the health of each dependency of the controller, so
+// that operators can see which one is failing. The report is served with
+// 503 unless every dependency is healthy.
+func showHealth(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	report, err := c.Health()
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	status := http.StatusOK
+	if report.Status != types.HealthOK {
+		status = http.StatusServiceUnavailable
+	}
+
+	return Response{status, report}, nil
+}
+
+// testWebhook sends a synthetic event to the configured webhook, so that
+// operators can check it is reachable before relying on it. A failed
+// delivery is reported in the result rather than failing the request.
+func testWebhook(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	if c.webhook == nil {
+		return errorResponse(errNoWebhook), errNoWebhook
+	}
+
+	return Response{http.StatusOK, c.webhook.test()}, nil
+}
+
+// listCapabilities reports which of the optional features of the API
+// this controller supports, so that clients need not probe for them.
+func listCapabilities(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	capabilities := map[string]bool{
+		"async_workloads":           true,
+		"camel_case":                true,
+		"csv":                       true,
+		"envelope_responses":        c.envelope,
+		"request_timeout":           c.timeout > 0,
+		"strict_content_type":       c.strictContentType,
+		"verify_mapped_instances":   c.verifyInstances,
+		"watch":                     true,
+		"webhooks":                  c.webhook != nil,
+		"orphaned_workloads":        c.images != nil,
+		"workload_config_transform": c.transformer != nil,
+	}
+
+	return Response{http.StatusOK, staticDocument{capabilities}}, nil
+}
+
+// negotiate reports the media type which would be served for a resource,
+// so that clients can check before making a real request.
+func negotiate(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	queries := r.URL.Query()
+	resource := queries.Get("resource")
+	accept := queries.Get("accept")
+
+	version, explicit, err := negotiateVersion(resource, accept)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	resp := types.NegotiationResponse{
+		Resource:  resource,
+		Accept:    accept,
+		MediaType: "application/" + version,
+		Version:   version,
+	}
+
+	if sunset, ok := c.deprecated[version]; ok && explicit {
+		resp.Deprecated = true
+		if !sunset.IsZero() {
+			sunset = sunset.UTC()
+			resp.Sunset = &sunset
+		}
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+func showPool(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	ID := vars["pool"]
+
+	pool, err := c.ShowPool(ID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	w.Header().Set("ETag", revisionETag(pool.Revision))
+
+	if r.URL.Query().Get("include_activity") != "true" {
+		return Response{http.StatusOK, pool}, nil
+	}
+
+	activity, err := c.PoolActivity(ID, c.poolActivityLimit)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	resp := types.PoolDetails{
+		Pool:     pool,
+		Activity: activity,
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+func poolHasName(pool types.Pool, names []string) bool {
+	for _, name := range names {
+		if strings.EqualFold(name, pool.Name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func poolHasTags(pool types.Pool, tags []string) bool {
+	for _, tag := range tags {
+		found := false
+
+		for _, t := range pool.Tags {
+			if t == tag {
+				found = true
+				break
 			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func listPools(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	var resp types.ListPoolsResponse
+	vars := mux.Vars(r)
+	_, ok := vars["tenant"]
+
+	queries := r.URL.Query()
+
+	// operators can find the pool an address came from, which is
+	// returned in full rather than listed.
+	if address, contains := queries["contains"]; contains {
+		if ok {
+			return errorResponse(types.ErrForbidden), types.ErrForbidden
+		}
+
+		if net.ParseIP(address[0]) == nil {
+			return errorResponse(types.ErrInvalidFilter), types.ErrInvalidFilter
+		}
+
+		pool, err := c.FindPoolByIP(address[0])
+		if err != nil {
+			return errorResponse(err), err
+		}
+
+		return Response{http.StatusOK, pool}, nil
+	}
+
+	pools, err := c.ListPools()
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	// only operators see how full pools are, so only they may sort by
+	// it.
+	if key, sorted := queries["sort"]; sorted {
+		if ok {
+			return errorResponse(types.ErrForbidden), types.ErrForbidden
+		}
+
+		if key[0] != "utilization" {
+			return errorResponse(types.ErrInvalidSort), types.ErrInvalidSort
+		}
+
+		sortPoolsByUtilization(pools)
+	}
+
+	names, returnNamedPool := queries["name"]
+
+	// multiple tags must all be present on a pool for it to match.
+	tags := queries["tag"]
+
+	for i, p := range pools {
+		if returnNamedPool && !poolHasName(p, names) {
+			continue
+		}
+
+		if !poolHasTags(p, tags) {
+			continue
+		}
+
+		summary := types.PoolSummary{
+			ID:          p.ID,
+			Name:        p.Name,
+			Description: p.Description,
+			Tags:        p.Tags,
+		}
+
+		if !ok {
+			summary.TotalIPs = &pools[i].TotalIPs
+			summary.Free = &pools[i].Free
+			summary.Links = pools[i].Links
+		}
+
+		resp.Pools = append(resp.Pools, summary)
+	}
+
+	if returnNamedPool && len(resp.Pools) == 0 {
+		return Response{http.StatusNotFound, nil}, types.ErrPoolNotFound
+	}
+
+	return Response{http.StatusOK, resp}, err
+}
+
+// poolUtilization returns the fraction of the addresses of a pool which
+// are in use. A pool with no addresses is not used at all.
+func poolUtilization(pool types.Pool) float64 {
+	if pool.TotalIPs == 0 {
+		return 0
+	}
+
+	return float64(pool.TotalIPs-pool.Free) / float64(pool.TotalIPs)
+}
+
+// sortPoolsByUtilization orders pools from the fullest to the emptiest,
+// breaking ties by name.
+func sortPoolsByUtilization(pools []types.Pool) {
+	sort.Slice(pools, func(i, j int) bool {
+		ui := poolUtilization(pools[i])
+		uj := poolUtilization(pools[j])
+		if ui != uj {
+			return ui > uj
+		}
+		return pools[i].Name < pools[j].Name
+	})
+}
+
+// recordFailure records an operation which failed in the events of the
+// tenant it was made for. Operations made by the admin outside of any
+// tenant are not recorded.
+func (c *Context) recordFailure(r *http.Request, tenantID string, operation string, err error) {
+	if tenantID == "" {
+		return
+	}
+
+	c.RecordTenantEvent(types.Event{
+		Timestamp: time.Now(),
+		TenantID:  tenantID,
+		Operation: operation,
+		RequestID: r.Header.Get("X-Request-ID"),
+		Error:     err.Error(),
+	})
+}
+
+// showTenantInventory gathers the workloads, mapped external IPs and
+// reservations of a tenant into one document, for checking before the
+// tenant is removed. Public workloads are not the tenant's, so are left
+// out.
+func showTenantInventory(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	tenantID := mux.Vars(r)["for_tenant"]
+
+	pool, err := c.TenantDefaultPool(tenantID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	wls, err := c.ListWorkloads(tenantID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	inventory := types.TenantInventory{
+		TenantID:     tenantID,
+		DefaultPool:  pool,
+		Workloads:    []types.Workload{},
+		Mappings:     []types.MappedIP{},
+		Reservations: []types.MappedIP{},
+	}
+
+	for _, wl := range wls {
+		if wl.TenantID == tenantID {
+			inventory.Workloads = append(inventory.Workloads, wl)
+		}
+	}
+
+	for _, m := range c.ListMappedAddresses(&tenantID) {
+		if m.Status == types.MappedIPReserved {
+			inventory.Reservations = append(inventory.Reservations, m)
+		} else {
+			inventory.Mappings = append(inventory.Mappings, m)
+		}
+	}
+
+	return Response{http.StatusOK, inventory}, nil
+}
+
+// deleteTenant removes the resources of a tenant which is being
+// offboarded. Unless cascade=true is given this fails with 409 Conflict
+// if the tenant still has any workloads, instances or external IPs. If
+// any resource could not be removed the results are returned with 207
+// Multi-Status, and the request can be repeated.
+func deleteTenant(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	tenantID := mux.Vars(r)["for_tenant"]
+	cascade := r.URL.Query().Get("cascade") == "true"
+
+	results, errs, err := c.DeleteTenantResources(tenantID, cascade)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	status := http.StatusOK
+
+	for i := range results {
+		results[i].Status, results[i].Error = itemStatus(errs[i], http.StatusOK)
+
+		if errs[i] != nil {
+			status = http.StatusMultiStatus
+		}
+	}
+
+	resp := types.DeleteTenantResponse{
+		TenantID: tenantID,
+		Results:  results,
+	}
+
+	return Response{status, resp}, nil
+}
+
+func listTenantEvents(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["for_tenant"]
+
+	if !service.GetPrivilege(r.Context()) {
+		caller, err := service.GetTenantID(r.Context())
+		if err != nil || caller != tenantID {
+			return errorResponse(types.ErrForbidden), types.ErrForbidden
+		}
+	}
+
+	events, err := c.TenantEvents(tenantID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, types.EventsResponse{Events: events}}, nil
+}
+
+// streamTenantEvents sends each event of a tenant as it happens, as
+// Server-Sent Events named after their operation. The stream lasts until
+// the client goes away, so it is not subject to the request timeout.
+func streamTenantEvents(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["for_tenant"]
+
+	if !service.GetPrivilege(r.Context()) {
+		caller, err := service.GetTenantID(r.Context())
+		if err != nil || caller != tenantID {
+			return errorResponse(types.ErrForbidden), types.ErrForbidden
+		}
+	}
+
+	events, stop, err := c.WatchTenantEvents(tenantID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+	defer stop()
+
+	w.Header().Set("Content-Type", eventStreamContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	flush()
+
+	ticker := time.NewTicker(eventStreamKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		var err error
+
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return Response{http.StatusOK, streamedResponse{}}, nil
+			}
+
+			b, _ := json.Marshal(event)
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Operation, b)
+		case <-ticker.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return Response{http.StatusOK, streamedResponse{}}, nil
+		}
+
+		// a failed write means the client has gone.
+		if err != nil {
+			return Response{http.StatusOK, streamedResponse{}}, nil
+		}
+		flush()
+	}
+}
+
+// churnWindow reads the window parameter of a request, in seconds, giving
+// the period over which churn is counted.
+func churnWindow(r *http.Request) (time.Duration, error) {
+	o := r.URL.Query().Get("window")
+	if o == "" {
+		return DefaultChurnWindow, nil
+	}
+
+	secs, err := strconv.ParseInt(o, 10, 64)
+	if err != nil || secs <= 0 || time.Duration(secs)*time.Second > MaxChurnWindow {
+		return 0, types.ErrInvalidFilter
+	}
+
+	return time.Duration(secs) * time.Second, nil
+}
+
+func showTenantChurn(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	tenantID := mux.Vars(r)["for_tenant"]
+
+	window, err := churnWindow(r)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	churn, err := c.TenantChurn(tenantID, window)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, churn}, nil
+}
+
+func showDefaultPool(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["for_tenant"]
+
+	if !service.GetPrivilege(r.Context()) {
+		caller, err := service.GetTenantID(r.Context())
+		if err != nil || caller != tenantID {
+			return errorResponse(types.ErrForbidden), types.ErrForbidden
+		}
+	}
+
+	pool, err := c.TenantDefaultPool(tenantID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, pool}, nil
+}
+
+// showPoolStrategy returns the pool selection strategy used for a tenant's
+// allocations which name no pool.
+func showPoolStrategy(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["for_tenant"]
+
+	if !service.GetPrivilege(r.Context()) {
+		caller, err := service.GetTenantID(r.Context())
+		if err != nil || caller != tenantID {
+			return errorResponse(types.ErrForbidden), types.ErrForbidden
+		}
+	}
+
+	strategy, err := c.TenantPoolStrategy(tenantID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, strategy}, nil
+}
+
+// updatePoolStrategy sets the pool selection strategy of a tenant. An
+// empty strategy returns the tenant to the controller's.
+func updatePoolStrategy(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["for_tenant"]
+
+	var req types.PoolSelection
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = c.SetTenantPoolStrategy(tenantID, req.Strategy)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	strategy, err := c.TenantPoolStrategy(tenantID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, strategy}, nil
+}
+
+// showPoolOrder explains which pools an allocation for a tenant which
+// does not name a pool would be made from.
+func showPoolOrder(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["for_tenant"]
+
+	if !service.GetPrivilege(r.Context()) {
+		caller, err := service.GetTenantID(r.Context())
+		if err != nil || caller != tenantID {
+			return errorResponse(types.ErrForbidden), types.ErrForbidden
+		}
+	}
+
+	order, err := c.PoolOrder(tenantID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, order}, nil
+}
+
+// updateDefaultPool sets the pool a tenant's external IPs come from when
+// no pool is named. Tenants may set their own default, but only to a pool
+// they can allocate from.
+func updateDefaultPool(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["for_tenant"]
+
+	if !service.GetPrivilege(r.Context()) {
+		caller, err := service.GetTenantID(r.Context())
+		if err != nil || caller != tenantID {
+			return errorResponse(types.ErrForbidden), types.ErrForbidden
+		}
+	}
+
+	var req types.DefaultPoolRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = c.SetTenantDefaultPool(tenantID, req.PoolName)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	pool, err := c.TenantDefaultPool(tenantID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, pool}, nil
+}
+
+func listTenantPools(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["for_tenant"]
+
+	if !service.GetPrivilege(r.Context()) {
+		caller, err := service.GetTenantID(r.Context())
+		if err != nil || caller != tenantID {
+			return errorResponse(types.ErrForbidden), types.ErrForbidden
+		}
+	}
+
+	pools, err := c.ListPools()
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	resp := types.TenantPoolsResponse{
+		Pools: []types.Pool{},
+	}
+
+	for _, p := range pools {
+		if p.AvailableTo(tenantID) {
+			resp.Pools = append(resp.Pools, p)
+		}
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+// showPoolSelection reports how a pool is chosen for external IPs mapped
+// without naming one.
+func showPoolSelection(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	return Response{http.StatusOK, types.PoolSelection{Strategy: c.PoolSelection()}}, nil
+}
+
+// showPoolCapacity reports the free and total addresses of the whole
+// deployment, for alerting when free capacity runs low.
+func showPoolCapacity(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	return Response{http.StatusOK, c.PoolCapacity()}, nil
+}
+
+// rebalancePools plans how reservations could be moved to even out the
+// use of the pools, and moves them if the client asks with apply=true.
+// Without it nothing is changed.
+func rebalancePools(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	apply := r.URL.Query().Get("apply") == "true"
+
+	rebalance, err := c.RebalancePools(apply)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, rebalance}, nil
+}
+
+// migratePool moves every mapping of a pool to the pool given by to. The
+// external IPs of instances change, unless dry_run is set, when nothing
+// does.
+func migratePool(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	queries := r.URL.Query()
+
+	toID := queries.Get("to")
+	if toID == "" {
+		return errorResponse(types.ErrBadRequest), types.ErrBadRequest
+	}
+
+	migration, err := c.MigratePool(mux.Vars(r)["pool"], toID, queries.Get("dry_run") == "true")
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	// the mappings have all moved, but some instances may not have.
+	if migration.Failed > 0 {
+		return multiStatus(migration), nil
+	}
+
+	return Response{http.StatusOK, migration}, nil
+}
+
+func exportPools(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	export, err := c.ExportPools()
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, rangedDocument{export}}, nil
+}
+
+func importPools(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	var req types.PoolExport
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	pools, err := c.ImportPools(req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	resp := types.ListPoolsResponse{
+		Pools: []types.PoolSummary{},
+	}
+
+	for i, p := range pools {
+		summary := types.PoolSummary{
+			ID:          p.ID,
+			Name:        p.Name,
+			Description: p.Description,
+			Free:        &pools[i].Free,
+			TotalIPs:    &pools[i].TotalIPs,
+			Tags:        p.Tags,
+			Links:       p.Links,
+		}
+
+		resp.Pools = append(resp.Pools, summary)
+	}
+
+	return Response{http.StatusCreated, resp}, nil
+}
+
+// createIfAbsent reports whether a request creating a resource asks for
+// an existing one of the same name to be returned rather than refused,
+// with If-None-Match: * or ?idempotent=true.
+func createIfAbsent(r *http.Request) bool {
+	return strings.TrimSpace(r.Header.Get("If-None-Match")) == "*" ||
+		r.URL.Query().Get("idempotent") == "true"
+}
+
+// existingPool returns the pool with the given name, ignoring case, for a
+// create request which found it already there.
+func existingPool(c *Context, w http.ResponseWriter, name string) (Response, error) {
+	pools, err := c.ListPools()
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	for _, p := range pools {
+		if !strings.EqualFold(p.Name, name) {
+			continue
+		}
+
+		pool, err := c.ShowPool(p.ID)
+		if err != nil {
+			return errorResponse(err), err
+		}
+
+		w.Header().Set("ETag", revisionETag(pool.Revision))
+
+		return Response{http.StatusOK, pool}, nil
+	}
+
+	// the pool was deleted since it was found to exist.
+	return errorResponse(types.ErrDuplicatePoolName), types.ErrDuplicatePoolName
+}
+
+func addPool(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	var req types.NewPoolRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	if strings.TrimSpace(req.Name) == "" {
+		return errorResponse(types.ErrPoolNameRequired), types.ErrPoolNameRequired
+	}
+
+	if req.TenantID != "" && !uuidPattern.MatchString(req.TenantID) {
+		err = malformedUUIDError{"tenant_id", req.TenantID}
+		return errorResponse(err), err
+	}
+
+	var ips []string
+
+	for _, ip := range req.IPs {
+		ips = append(ips, ip.IP)
+	}
+
+	_, err = c.AddPool(req.Name, req.Subnet, ips, req.Tags, req.Description, req.TenantID)
+	if err == types.ErrDuplicatePoolName && createIfAbsent(r) {
+		return existingPool(c, w, req.Name)
+	}
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	// addresses can be added to the pool later, but a pool without
+	// any is often a mistake.
+	if req.Subnet == nil && len(ips) == 0 {
+		w.Header().Set("Warning", `199 - "Pool has no addresses"`)
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+// addPools creates a batch of pools, reporting the outcome for each of
+// them with 207 Multi-Status.
+func addPools(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	var reqs []types.NewPoolRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = json.Unmarshal(body, &reqs)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	pools, errs := c.AddPools(reqs)
+
+	resp := types.PoolBatchResponse{
+		Results: []types.PoolBatchResult{},
+	}
+
+	for i, req := range reqs {
+		result := types.PoolBatchResult{
+			Name: req.Name,
+		}
+
+		result.Status, result.Error = itemStatus(errs[i], http.StatusCreated)
+		if errs[i] == nil {
+			result.Pool = &pools[i]
+		}
+
+		resp.Results = append(resp.Results, result)
+	}
+
+	return multiStatus(resp), nil
+}
+
+// validatePools checks a batch of proposed pools for conflicts with the
+// existing pools and with each other, without creating any of them.
+func validatePools(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	var reqs []types.NewPoolRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = json.Unmarshal(body, &reqs)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	conflicts, err := c.ValidatePools(reqs)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	resp := types.PoolValidationResponse{
+		Valid:     len(conflicts) == 0,
+		Conflicts: conflicts,
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+func updatePool(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	ID := vars["pool"]
+
+	var req types.PoolUpdateRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	// removing an address which is in use must be forced.
+	if len(req.AddIPs) > 0 || len(req.RemoveIPs) > 0 {
+		force := r.URL.Query().Get("force") == "true"
+
+		err = c.UpdatePoolIPs(ID, req.AddIPs, req.RemoveIPs, force)
+		if err != nil {
+			return errorResponse(err), err
+		}
+	}
+
+	if req.Name != nil {
+		err = c.RenamePool(ID, *req.Name)
+		if err != nil {
+			return errorResponse(err), err
+		}
+	}
+
+	if req.Tags != nil {
+		err = c.UpdatePoolTags(ID, *req.Tags)
+		if err != nil {
+			return errorResponse(err), err
+		}
+	}
+
+	if req.Description != nil {
+		err = c.UpdatePoolDescription(ID, *req.Description)
+		if err != nil {
+			return errorResponse(err), err
+		}
+	}
+
+	if req.Drained != nil {
+		err = c.DrainPool(ID, *req.Drained)
+		if err != nil {
+			return errorResponse(err), err
+		}
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+func deletePool(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	ID := vars["pool"]
+
+	// deleting a pool which is not empty, or is the last pool of an
+	// address family, must be forced.
+	force := r.URL.Query().Get("force") == "true"
+
+	// clients may ask that the pool is only deleted if it has not
+	// changed since they last read it.
+	if match := r.Header.Get("If-Match"); match != "" {
+		pool, err := c.ShowPool(ID)
+		if err != nil {
+			return errorResponse(err), err
+		}
+
+		if !ifMatch(match, revisionETag(pool.Revision)) {
+			return errorResponse(errPreconditionFailed), errPreconditionFailed
+		}
+	}
+
+	err := c.DeletePool(ID, force)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+func addToPool(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	ID := vars["pool"]
+
+	var req types.NewAddressRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	var ips []string
+
+	for _, ip := range req.IPs {
+		ips = append(ips, ip.IP)
+	}
+
+	err = c.AddAddress(ID, req.Subnet, ips)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+func showSubnet(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	poolID := vars["pool"]
+	subnetID := vars["subnet"]
+
+	var offset, limit int
+	var err error
+
+	if o := r.URL.Query().Get("offset"); o != "" {
+		offset, err = strconv.Atoi(o)
+		if err != nil {
+			return errorResponse(types.ErrInvalidFilter), types.ErrInvalidFilter
+		}
+	}
+
+	if l := r.URL.Query().Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil {
+			return errorResponse(types.ErrInvalidFilter), types.ErrInvalidFilter
+		}
+	}
+
+	inventory, err := c.ShowSubnet(poolID, subnetID, offset, limit)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, inventory}, nil
+}
+
+// showSubnetBitmap shows which addresses of a subnet are allocated, for
+// debugging fragmentation.
+func showSubnetBitmap(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+
+	bitmap, err := c.SubnetBitmap(vars["pool"], vars["subnet"])
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, bitmap}, nil
+}
+
+// showPoolFragmentation reports how the free addresses of a pool are split
+// up, to help decide whether it needs contiguous space.
+func showPoolFragmentation(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	frag, err := c.PoolFragmentation(mux.Vars(r)["pool"])
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, frag}, nil
+}
+
+func updateSubnet(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	poolID := vars["pool"]
+	subnetID := vars["subnet"]
+
+	var req types.SubnetUpdateRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	if req.Drained != nil {
+		err = c.DrainSubnet(poolID, subnetID, *req.Drained)
+		if err != nil {
+			return errorResponse(err), err
+		}
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+func deleteSubnet(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	poolID := vars["pool"]
+	subnetID := vars["subnet"]
+
+	err := c.RemoveAddress(poolID, &subnetID, nil)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+func deleteExternalIP(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	poolID := vars["pool"]
+	IPID := vars["ip_id"]
+
+	err := c.RemoveAddress(poolID, nil, &IPID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+func listMappedIPs(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID, ok := vars["tenant"]
+	var IPs []types.MappedIP
+	var short []types.MappedIPShort
+
+	// privileged callers see the mappings of every tenant unless
+	// they ask for a specific one. Tenant scoped callers may only
+	// ever name their own tenant.
+	queries := r.URL.Query()
+
+	filterTenant, filtered := queries["tenant_id"]
+	if filtered && ok && filterTenant[0] != tenantID {
+		return errorResponse(types.ErrForbidden), types.ErrForbidden
+	}
+
+	state := queries.Get("state")
+	switch state {
+	case "", types.MappedIPAttached, types.MappedIPReserved:
+	default:
+		return errorResponse(types.ErrInvalidFilter), types.ErrInvalidFilter
+	}
+
+	poolID := queries.Get("pool_id")
+
+	internalIP := queries.Get("internal_ip")
+	if internalIP != "" && net.ParseIP(internalIP) == nil {
+		return errorResponse(types.ErrInvalidFilter), types.ErrInvalidFilter
+	}
+
+	instanceID := queries.Get("instance_id")
+
+	// older_than selects long lived mappings, e.g. for policies which
+	// rotate external IPs.
+	var createdBefore time.Time
+	if olderThan := queries.Get("older_than"); olderThan != "" {
+		age, err := time.ParseDuration(olderThan)
+		if err != nil || age < 0 {
+			return errorResponse(types.ErrInvalidFilter), types.ErrInvalidFilter
+		}
+		createdBefore = time.Now().Add(-age)
+	}
+
+	// each label filter is given as key=value.
+	var labels map[string]string
+	for _, l := range queries["label"] {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return errorResponse(types.ErrInvalidFilter), types.ErrInvalidFilter
+		}
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[kv[0]] = kv[1]
+	}
+
+	expand := queries.Get("expand")
+	if expand != "" && expand != "instance" {
+		return errorResponse(types.ErrInvalidFilter), types.ErrInvalidFilter
+	}
+
+	sortKey := queries.Get("sort")
+	if _, ok := types.MappedIPSortKeys[strings.TrimPrefix(sortKey, "-")]; sortKey != "" && !ok {
+		return errorResponse(types.ErrInvalidSort), types.ErrInvalidSort
+	}
+
+	pg, err := requestPage(r)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	// cursors hold a mapping ID, so cursor paginated listings are
+	// always in mapping ID order.
+	if pg.cursor && sortKey != "" {
+		return errorResponse(types.ErrInvalidSort), types.ErrInvalidSort
+	}
+
+	// the state, pool, instance and internal IP filters may be used by
+	// either kind of caller.
+	filter := types.MappedIPFilter{
+		Status:     state,
+		PoolID:     poolID,
+		InternalIP: internalIP,
+		InstanceID: instanceID,
+		Labels:     labels,
+
+		CreatedBefore: createdBefore,
+	}
+
+	if ok {
+		filter.TenantID = tenantID
+	} else if filtered {
+		filter.TenantID = filterTenant[0]
+	}
+
+	if queries.Get("count") == "true" {
+		return Response{http.StatusOK, types.CountResponse{Count: c.CountMappedAddresses(filter)}}, nil
+	}
+
+	if acceptsMediaType(r, routesContentType) {
+		var tenant *string
+		if ok {
+			tenant = &tenantID
+		}
+
+		return writeRoutes(w, c.ListMappedAddresses(tenant), filter)
+	}
+
+	// a filter which matches nothing gives an empty list.
+	IPs = []types.MappedIP{}
+	short = []types.MappedIPShort{}
+
+	// the external IPs of an instance are listed in index order, unless
+	// the caller asks for another.
+	mappings := func(tenant *string) []types.MappedIP {
+		all := c.ListMappedAddresses(tenant)
+		if pg.cursor {
+			sort.SliceStable(all, func(i, j int) bool { return all[i].ID < all[j].ID })
+			return all
+		}
+		if instanceID != "" {
+			sort.Stable(types.SortedMappedIPsByIndex(all))
+		}
+		if sortKey != "" {
+			_ = types.SortMappedIPs(all, sortKey)
+		}
+		return all
+	}
+
+	if !ok {
+		for _, IP := range mappings(nil) {
+			if filter.Matches(IP) {
+				IPs = append(IPs, IP)
+			}
+		}
+
+		start, end, next := pg.window(len(IPs), func(i int) string { return IPs[i].ID })
+		IPs = IPs[start:end]
+		setNextCursor(w, next)
+
+		for i := range IPs {
+			IPs[i].PTR = ptrName(c.ptrTemplate, IPs[i].ExternalIP)
+		}
+
+		if acceptsCSV(r) {
+			return Response{http.StatusOK, mappedIPsTable(IPs, true)}, nil
+		}
+
+		if expand != "" {
+			expanded := []types.MappedIPWithInstance{}
+			for _, IP := range IPs {
+				expanded = append(expanded, types.MappedIPWithInstance{
+					MappedIP: IP,
+					Instance: c.instanceInfo(IP.TenantID, IP.InstanceID),
+				})
+			}
+			return Response{http.StatusOK, expanded}, nil
+		}
+
+		return Response{http.StatusOK, IPs}, nil
+	}
+
+	if acceptsCSV(r) {
+		for _, IP := range mappings(&tenantID) {
+			if filter.Matches(IP) {
+				IPs = append(IPs, IP)
+			}
+		}
+
+		start, end, next := pg.window(len(IPs), func(i int) string { return IPs[i].ID })
+		setNextCursor(w, next)
+
+		return Response{http.StatusOK, mappedIPsTable(IPs[start:end], false)}, nil
+	}
+
+	for _, IP := range mappings(&tenantID) {
+		if !filter.Matches(IP) {
+			continue
+		}
+
+		s := types.MappedIPShort{
+			ID:         IP.ID,
+			ExternalIP: IP.ExternalIP,
+			InternalIP: IP.InternalIP,
+			InstanceID: IP.InstanceID,
+			Status:     IP.Status,
+			Index:      IP.Index,
+			Role:       IP.Role,
+			Expires:    IP.Expires,
+			Labels:     IP.Labels,
+			PTR:        ptrName(c.ptrTemplate, IP.ExternalIP),
+			Links:      IP.Links,
+		}
+		short = append(short, s)
+	}
+
+	start, end, next := pg.window(len(short), func(i int) string { return short[i].ID })
+	short = short[start:end]
+	setNextCursor(w, next)
+
+	if expand != "" {
+		expanded := []types.MappedIPShortWithInstance{}
+		for _, s := range short {
+			expanded = append(expanded, types.MappedIPShortWithInstance{
+				MappedIPShort: s,
+				Instance:      c.instanceInfo(tenantID, s.InstanceID),
+			})
+		}
+		return Response{http.StatusOK, expanded}, nil
+	}
+
+	return Response{http.StatusOK, short}, nil
+}
+
+// ptrName returns the name the reverse DNS record of an external IP is
+// expected to give, made from template by replacing {ip} with the
+// address, its octets joined by dashes, and {reverse} with its octets
+// in reverse order joined by dots. It is empty if there is no template
+// or the address is not IPv4.
+func ptrName(template string, address string) string {
+	if template == "" {
+		return ""
+	}
+
+	ip := net.ParseIP(address).To4()
+	if ip == nil {
+		return ""
+	}
+
+	r := strings.NewReplacer(
+		"{ip}", fmt.Sprintf("%d-%d-%d-%d", ip[0], ip[1], ip[2], ip[3]),
+		"{reverse}", fmt.Sprintf("%d.%d.%d.%d", ip[3], ip[2], ip[1], ip[0]),
+	)
+
+	return r.Replace(template)
+}
+
+// instanceInfo describes the instance an external IP is mapped to for
+// listings which expand it. Nil is returned if there is no instance, no
+// InstanceInfoProvider, or the instance cannot be found.
+func (c *Context) instanceInfo(tenantID string, instanceID string) *types.InstanceInfo {
+	if c.instances == nil || instanceID == "" {
+		return nil
+	}
+
+	info, err := c.instances.InstanceInfo(tenantID, instanceID)
+	if err != nil {
+		return nil
+	}
+
+	return &info
+}
+
+// writeRoutes writes a NAT rule for each of the mappings matching filter
+// which is attached to an instance. Reservations have no internal IP to
+// route to, so are left out. All of the matching mappings are written,
+// whatever page was asked for.
+func writeRoutes(w http.ResponseWriter, IPs []types.MappedIP, filter types.MappedIPFilter) (Response, error) {
+	var b bytes.Buffer
+	for _, IP := range IPs {
+		if IP.Status != types.MappedIPAttached || IP.InternalIP == "" || !filter.Matches(IP) {
+			continue
+		}
+
+		fmt.Fprintf(&b, "nat %s %s\n", IP.ExternalIP, IP.InternalIP)
+	}
+
+	w.Header().Set("Content-Type", routesContentType)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(b.Bytes())
+
+	return Response{http.StatusOK, streamedResponse{}}, nil
+}
+
+// mappedIPsTable lays out mappings for a CSV download. Tenants are not
+// shown which pool their addresses come from, so the pool column is only
+// filled in for privileged callers.
+func mappedIPsTable(IPs []types.MappedIP, privileged bool) csvTable {
+	table := csvTable{
+		{"mapping_id", "external_ip", "internal_ip", "instance_id", "tenant_id", "pool_name"},
+	}
+
+	for _, IP := range IPs {
+		pool := ""
+		if privileged {
+			pool = IP.PoolName
+		}
+
+		table = append(table, []string{IP.ID, IP.ExternalIP, IP.InternalIP, IP.InstanceID, IP.TenantID, pool})
+	}
+
+	return table
+}
+
+// showAddressHistory lists who an external IP has been assigned to.
+func showAddressHistory(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	address := mux.Vars(r)["ip"]
+
+	history, err := c.AddressHistory(address)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	resp := types.AddressHistoryResponse{
+		ExternalIP: address,
+		History:    history,
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+// watchMappedIPs blocks until a mapping visible to the caller is created,
+// changed or deleted, and returns the changes made. If nothing changes
+// before the watch times out 304 is returned and the client should
+// watch again.
+func watchMappedIPs(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+
+	timeout := DefaultWatchTimeout
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		secs, err := strconv.Atoi(t)
+		if err != nil || secs <= 0 || time.Duration(secs)*time.Second > maxWatchTimeout {
+			return errorResponse(errInvalidWatchTimeout), errInvalidWatchTimeout
+		}
+		timeout = time.Duration(secs) * time.Second
+	}
+
+	var tenant *string
+	if tenantID, ok := vars["tenant"]; ok {
+		tenant = &tenantID
+	}
+
+	changes, stop := c.WatchMappedAddresses(tenant)
+	defer stop()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var change types.MappedIPChange
+	select {
+	case change = <-changes:
+	case <-timer.C:
+		return Response{http.StatusNotModified, nil}, nil
+	case <-r.Context().Done():
+		return errorResponse(errRequestTimeout), errRequestTimeout
+	}
+
+	// return any further changes already queued along with the first,
+	// so that clients are not woken once per mapping.
+	delta := []types.MappedIPChange{change}
+	for {
+		select {
+		case change = <-changes:
+			delta = append(delta, change)
+		default:
+			return Response{http.StatusOK, delta}, nil
+		}
+	}
+}
+
+func previewAllocation(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["tenant"]
+	poolName := r.URL.Query().Get("pool_name")
+
+	IP, err := c.PreviewAllocation(tenantID, poolName)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, IP}, nil
+}
+
+// showNextFree returns the address a pool would give out next, without
+// allocating it. The address may be taken by another request before the
+// client allocates one, so this is only a snapshot.
+func showNextFree(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	IP, err := c.NextFreeAddress(mux.Vars(r)["pool"])
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, IP}, nil
+}
+
+func mapExternalIP(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	var req types.MapIPRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	tenantID := vars["tenant"]
+
+	// only reservations can be leased.
+	if req.LeaseSeconds < 0 || (req.LeaseSeconds > 0 && req.InstanceID != "") {
+		c.recordFailure(r, tenantID, types.EventMapExternalIP, types.ErrBadRequest)
+		return errorResponse(types.ErrBadRequest), types.ErrBadRequest
+	}
+
+	err = types.ValidateMappingLabels(req.Labels)
+	if err != nil {
+		c.recordFailure(r, tenantID, types.EventMapExternalIP, err)
+		return errorResponse(err), err
+	}
+
+	if c.instanceIDPattern != nil && req.InstanceID != "" && !c.instanceIDPattern.MatchString(req.InstanceID) {
+		c.recordFailure(r, tenantID, types.EventMapExternalIP, errInvalidInstanceID)
+		return errorResponse(errInvalidInstanceID), errInvalidInstanceID
+	}
+
+	if c.verifyInstances && req.InstanceID != "" {
+		exists, err := c.InstanceExists(tenantID, req.InstanceID)
+		if err == nil && !exists {
+			err = types.ErrInstanceNotFound
+		}
+		if err != nil {
+			c.recordFailure(r, tenantID, types.EventMapExternalIP, err)
+			return errorResponse(err), err
+		}
+	}
+
+	lease := time.Duration(req.LeaseSeconds) * time.Second
+
+	m, err := c.MapAddress(tenantID, req.PoolName, req.InstanceID, req.InternalIP, req.Role, lease)
+	if err != nil {
+		c.recordFailure(r, tenantID, types.EventMapExternalIP, err)
+		return errorResponse(err), err
+	}
+
+	if len(req.Labels) > 0 {
+		labelled, err := c.SetMappingLabels(tenantID, m.ExternalIP, req.Labels)
+		if err != nil {
+			_ = c.UnMapAddress(m.ExternalIP)
+			c.recordFailure(r, tenantID, types.EventMapExternalIP, err)
+			return errorResponse(err), err
+		}
+		m = labelled
+	}
+
+	c.webhook.notify(ExternalIPMapped, m)
+
+	// older clients may still ask for the empty response they used
+	// to get.
+	if r.URL.Query().Get("no_content") == "true" {
+		return Response{http.StatusNoContent, nil}, nil
+	}
+
+	for _, link := range m.Links {
+		if link.Rel == "self" {
+			w.Header().Set("Location", link.Href)
+		}
+	}
+
+	return Response{http.StatusCreated, m}, nil
+}
+
+// releaseInstanceIPs frees all of the external IPs of an instance. It
+// is safe to repeat, an instance without any gives a count of zero.
+func releaseInstanceIPs(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+
+	count, err := c.ReleaseInstanceAddresses(vars["instance_id"])
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, types.CountResponse{Count: count}}, nil
+}
+
+// releaseAddresses frees every external IP a tenant holds from a pool, for
+// decommissioning the pool. Tenants may only release their own.
+func releaseAddresses(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	var req types.ReleaseAddressesRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	if tenantID, ok := mux.Vars(r)["tenant"]; ok {
+		if req.TenantID != "" && req.TenantID != tenantID {
+			return errorResponse(types.ErrForbidden), types.ErrForbidden
+		}
+		req.TenantID = tenantID
+	}
+
+	if req.TenantID == "" || req.PoolID == "" {
+		return errorResponse(types.ErrBadRequest), types.ErrBadRequest
+	}
+
+	released, err := c.ReleaseAddresses(req.TenantID, req.PoolID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	resp := types.ReleaseAddressesResponse{
+		Count:             len(released),
+		Released:          []types.ReleasedAddress{},
+		AffectedInstances: []string{},
+	}
+
+	affected := make(map[string]bool)
+
+	for _, m := range released {
+		c.webhook.notify(ExternalIPUnmapped, m)
+
+		resp.Released = append(resp.Released, types.ReleasedAddress{
+			MappingID:  m.ID,
+			ExternalIP: m.ExternalIP,
+			InstanceID: m.InstanceID,
+			Attached:   m.InstanceID != "",
+		})
+
+		if m.InstanceID != "" && !affected[m.InstanceID] {
+			affected[m.InstanceID] = true
+			resp.AffectedInstances = append(resp.AffectedInstances, m.InstanceID)
+		}
+	}
+
+	sort.Strings(resp.AffectedInstances)
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+// reserveBlock reserves a block of consecutive external IPs for a tenant.
+// The whole block is reserved or, if the pool cannot supply it, none.
+func reserveBlock(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["for_tenant"]
+
+	var req types.ReserveBlockRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	block, err := c.ReserveBlock(tenantID, req.PoolName, req.Count)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	resp := types.ReservedBlock{
+		BlockID:  block[0].BlockID,
+		Mappings: block,
+	}
+
+	return Response{http.StatusCreated, resp}, nil
+}
+
+// reclaimAge reads the older_than parameter of a request, in seconds,
+// giving how long reservations must have been unattached to be reclaimed.
+func reclaimAge(r *http.Request) (time.Duration, error) {
+	o := r.URL.Query().Get("older_than")
+	if o == "" {
+		return DefaultReclaimAge, nil
+	}
+
+	secs, err := strconv.ParseInt(o, 10, 64)
+	if err != nil || secs < 0 {
+		return 0, types.ErrInvalidFilter
+	}
+
+	return time.Duration(secs) * time.Second, nil
+}
+
+// listReclaimable lists the reservations of a pool which have been without
+// an instance for longer than older_than.
+func listReclaimable(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	poolID := mux.Vars(r)["pool"]
+
+	olderThan, err := reclaimAge(r)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	addresses, err := c.ReclaimableAddresses(poolID, olderThan)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	resp := types.ReclaimableResponse{
+		PoolID:           poolID,
+		OlderThanSeconds: int64(olderThan / time.Second),
+		Addresses:        addresses,
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+// reclaimAddresses releases the reservations listReclaimable would list.
+func reclaimAddresses(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	olderThan, err := reclaimAge(r)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	count, err := c.ReclaimAddresses(mux.Vars(r)["pool"], olderThan)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, types.CountResponse{Count: count}}, nil
+}
+
+// releaseBlock releases all of a block of external IPs reserved for a
+// tenant.
+func releaseBlock(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+
+	count, err := c.ReleaseBlock(vars["for_tenant"], vars["block_id"])
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, types.CountResponse{Count: count}}, nil
+}
+
+// listAddressReservations lists the address space held back from pools.
+func listAddressReservations(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	resp := types.ListAddressReservationsResponse{
+		Reservations: c.ListAddressReservations(),
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+// addAddressReservation holds a CIDR back from pools until the
+// reservation is deleted.
+func addAddressReservation(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	var req types.NewAddressReservationRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	reservation, err := c.AddAddressReservation(req.CIDR, req.Label)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusCreated, reservation}, nil
+}
+
+// deleteAddressReservation releases reserved address space to pools.
+func deleteAddressReservation(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	err := c.DeleteAddressReservation(mux.Vars(r)["id"])
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+// claimAddresses reserves external IPs for a tenant until the claim is
+// committed or abandoned with the token returned.
+func claimAddresses(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	var req types.ClaimRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	tenantID, ok := vars["tenant"]
+	if ok && req.TenantID != "" && req.TenantID != tenantID {
+		return errorResponse(types.ErrForbidden), types.ErrForbidden
+	}
+
+	if !ok {
+		tenantID = req.TenantID
+	}
+
+	if tenantID == "" || req.TTLSeconds < 0 {
+		return errorResponse(types.ErrBadRequest), types.ErrBadRequest
+	}
+
+	ttl := DefaultClaimTTL
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+
+	claim, err := c.ClaimAddresses(tenantID, req.PoolName, req.Count, ttl)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusCreated, claim}, nil
+}
+
+// commitClaim maps the external IPs of a claim to instances.
+func commitClaim(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	token := vars["token"]
+	var req types.CommitClaimRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	mappings, err := c.CommitClaim(vars["tenant"], token, req.InstanceIDs)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	resp := types.ExternalIPClaim{
+		Token:    token,
+		Mappings: mappings,
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+// abandonClaim releases the external IPs of a claim which has not been
+// committed.
+func abandonClaim(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+
+	count, err := c.ReleaseBlock(vars["tenant"], vars["token"])
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, types.CountResponse{Count: count}}, nil
+}
+
+func remapExternalIP(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID, ok := vars["tenant"]
+	mappingID := vars["mapping_id"]
+
+	var req types.RemapIPRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = types.ValidateMappingLabels(req.Labels)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	var IPs []types.MappedIP
+
+	if !ok {
+		IPs = c.ListMappedAddresses(nil)
+	} else {
+		IPs = c.ListMappedAddresses(&tenantID)
+	}
+
+	for _, m := range IPs {
+		if m.ID == mappingID {
+			// a request which only changes the labels leaves the
+			// mapping where it is.
+			if req.InstanceID != "" || req.Labels == nil {
+				err := c.RemapAddress(tenantID, m.ExternalIP, req.InstanceID)
+				if err != nil {
+					return errorResponse(err), err
+				}
+			}
+
+			if req.Labels != nil {
+				_, err := c.SetMappingLabels(tenantID, m.ExternalIP, req.Labels)
+				if err != nil {
+					return errorResponse(err), err
+				}
+			}
+
+			return Response{http.StatusNoContent, nil}, nil
+		}
+	}
+
+	return errorResponse(types.ErrAddressNotFound), types.ErrAddressNotFound
+}
+
+// swapAddress finds the external IP of the mapping with the given ID or,
+// if byInstance is set, of the only mapping of the instance with that ID.
+func swapAddress(IPs []types.MappedIP, ID string, byInstance bool) (string, error) {
+	var addresses []string
+
+	for _, m := range IPs {
+		if (byInstance && m.InstanceID == ID) || (!byInstance && m.ID == ID) {
+			addresses = append(addresses, m.ExternalIP)
+		}
+	}
+
+	switch len(addresses) {
+	case 0:
+		return "", types.ErrAddressNotFound
+	case 1:
+		return addresses[0], nil
+	default:
+		return "", types.ErrBadRequest
+	}
+}
+
+// swapExternalIPs swaps the instances of two mappings in one step. If
+// either mapping cannot be found neither is changed.
+func swapExternalIPs(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID, ok := vars["tenant"]
+
+	var req types.SwapIPsRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	IDs, byInstance := req.MappingIDs, false
+	if len(req.InstanceIDs) > 0 {
+		IDs, byInstance = req.InstanceIDs, true
+	}
+
+	if len(IDs) != 2 || (byInstance && len(req.MappingIDs) > 0) {
+		return errorResponse(types.ErrBadRequest), types.ErrBadRequest
+	}
+
+	var IPs []types.MappedIP
+
+	if !ok {
+		IPs = c.ListMappedAddresses(nil)
+	} else {
+		IPs = c.ListMappedAddresses(&tenantID)
+	}
+
+	var addresses [2]string
+	for i, ID := range IDs {
+		addresses[i], err = swapAddress(IPs, ID, byInstance)
+		if err != nil {
+			return errorResponse(err), err
+		}
+	}
+
+	err = c.SwapAddresses(addresses[0], addresses[1])
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+// labelExternalIPs adds labels to every mapping matched by a filter.
+// Tenants may only label their own mappings, and a filter naming
+// another tenant is refused.
+func labelExternalIPs(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID, ok := vars["tenant"]
+
+	var req types.LabelMappingsRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	filter := types.MappedIPFilter{
+		TenantID: req.Filter.TenantID,
+		Status:   req.Filter.State,
+		PoolID:   req.Filter.PoolID,
+	}
+
+	if ok {
+		if filter.TenantID != "" && filter.TenantID != tenantID {
+			return errorResponse(types.ErrForbidden), types.ErrForbidden
+		}
+		filter.TenantID = tenantID
+	}
+
+	switch filter.Status {
+	case "", types.MappedIPAttached, types.MappedIPReserved:
+	default:
+		return errorResponse(types.ErrInvalidFilter), types.ErrInvalidFilter
+	}
+
+	count, err := c.LabelMappings(filter, req.Labels)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, types.CountResponse{Count: count}}, nil
+}
+
+func unmapExternalIP(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID, ok := vars["tenant"]
+	mappingID := vars["mapping_id"]
+
+	var IPs []types.MappedIP
+
+	if !ok {
+		IPs = c.ListMappedAddresses(nil)
+	} else {
+		IPs = c.ListMappedAddresses(&tenantID)
+	}
+
+	for _, m := range IPs {
+		if m.ID == mappingID {
+			err := c.UnMapAddress(m.ExternalIP)
+			if err == types.ErrAddressNotFound {
+				// unmapped since we listed it.
+				return Response{http.StatusNoContent, nil}, nil
+			} else if err != nil {
+				c.recordFailure(r, tenantID, types.EventUnmapExternalIP, err)
+				return errorResponse(err), err
+			}
+
+			c.webhook.notify(ExternalIPUnmapped, m)
+
+			// reserved addresses are released straight away, but
+			// mapped ones are released once the CNCI has done so.
+			if m.InstanceID == "" {
+				return Response{http.StatusNoContent, nil}, nil
+			}
+
+			return Response{http.StatusAccepted, nil}, nil
+		}
+	}
+
+	// a mapping of another tenant may not be deleted, but deleting a
+	// mapping which does not exist succeeds, so that clients can
+	// safely retry deletes.
+	if ok {
+		for _, m := range c.ListMappedAddresses(nil) {
+			if m.ID == mappingID {
+				return errorResponse(types.ErrForbidden), types.ErrForbidden
+			}
+		}
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+// workloadRequest reads the workload to be created from the body of r,
+// giving it to the tenant of the route and transforming its config.
+func workloadRequest(c *Context, r *http.Request) (types.Workload, error) {
+	var req types.Workload
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return req, err
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return req, err
+	}
+
+	// we allow admin to create public workloads for any tenant. However,
+	// users scoped to a particular tenant may only create workloads
+	// for their own tenant.
+	vars := mux.Vars(r)
+	tenantID, ok := vars["tenant"]
+	if ok {
+		req.TenantID = tenantID
+	} else {
+		req.TenantID = "public"
+	}
+
+	return transformWorkload(c, req)
+}
+
+// transformWorkload passes the config of a workload being created through
+// the configured transformer, if there is one.
+func transformWorkload(c *Context, req types.Workload) (types.Workload, error) {
+	if c.transformer != nil {
+		config, err := c.transformer.TransformConfig(req.TenantID, req.Config)
+		if err != nil {
+			return req, configRejectedError{err.Error()}
+		}
+
+		req.Config = config
+	}
+
+	return req, nil
+}
+
+// workloadErrorResponse is the response to a failure to create or update
+// the workload req. When the workload was refused as invalid, and the
+// error has no details of its own, the details list each invalid field.
+func workloadErrorResponse(c *Context, req types.Workload, err error) Response {
+	resp := errorResponse(err)
+	if resp.response != nil {
+		return resp
+	}
+
+	v := c.ValidateWorkload(req)
+	if len(v.Fields) > 0 {
+		resp.response = types.FieldErrors{Fields: v.Fields}
+	}
+
+	return resp
+}
+
+func addWorkload(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID, ok := vars["tenant"]
+
+	req, err := workloadRequest(c, r)
+	if err != nil {
+		c.recordFailure(r, tenantID, types.EventCreateWorkload, err)
+		return errorResponse(err), err
+	}
+
+	if r.URL.Query().Get("async") == "true" {
+		return addWorkloadAsync(c, w, r, req)
+	}
+
+	wl, err := c.CreateWorkload(req)
+	if err != nil {
+		c.recordFailure(r, tenantID, types.EventCreateWorkload, err)
+		return workloadErrorResponse(c, req, err), err
+	}
+
+	var ref string
+
+	if ok {
+		ref = fmt.Sprintf("%s/%s/workloads/%s", c.URL, tenantID, wl.ID)
+	} else {
+		ref = fmt.Sprintf("%s/workloads/%s", c.URL, wl.ID)
+	}
+
+	link := types.Link{
+		Rel:  "self",
+		Href: ref,
+	}
+
+	resp := types.WorkloadResponse{
+		Workload: wl,
+		Link:     link,
+	}
+
+	return Response{http.StatusCreated, resp}, nil
+}
+
+// provision creates a workload, or uses an existing one, and reserves an
+// external IP for it in one request. If either fails neither is left
+// behind.
+func provision(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	var req types.ProvisionRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	tenantID, ok := mux.Vars(r)["tenant"]
+	if !ok {
+		tenantID = req.TenantID
+	}
+
+	if req.Workload != nil {
+		req.Workload.TenantID = tenantID
+
+		wl, err := transformWorkload(c, *req.Workload)
+		if err != nil {
+			c.recordFailure(r, tenantID, types.EventCreateWorkload, err)
+			return errorResponse(err), err
+		}
+		req.Workload = &wl
+	}
+
+	wl, m, err := c.Provision(tenantID, req.Workload, req.WorkloadID, req.PoolName)
+	if err != nil {
+		if req.Workload != nil {
+			return workloadErrorResponse(c, *req.Workload, err), err
+		}
+		return errorResponse(err), err
+	}
+
+	c.webhook.notify(ExternalIPMapped, m)
+
+	var ref string
+
+	if ok {
+		ref = fmt.Sprintf("%s/%s/workloads/%s", c.URL, tenantID, wl.ID)
+	} else {
+		ref = fmt.Sprintf("%s/workloads/%s", c.URL, wl.ID)
+	}
+
+	resp := types.ProvisionResponse{
+		Workload: types.WorkloadResponse{
+			Workload: wl,
+			Link: types.Link{
+				Rel:  "self",
+				Href: ref,
+			},
+		},
+		ExternalIP: m,
+	}
+
+	return Response{http.StatusCreated, resp}, nil
+}
+
+// workloadBundleStart reads a bundle, which has the layout of a workload
+// listing, from dec up to its first workload. Members before the list of
+// workloads are skipped.
+func workloadBundleStart(dec *json.Decoder) error {
+	t, err := dec.Token()
+	if err != nil || t != json.Delim('{') {
+		return errInvalidBundle
+	}
+
+	for dec.More() {
+		t, err = dec.Token()
+		if err != nil {
+			return errInvalidBundle
+		}
+
+		if t == "workloads" {
+			t, err = dec.Token()
+			if err != nil || t != json.Delim('[') {
+				return errInvalidBundle
+			}
+
+			return nil
+		}
+
+		var skip json.RawMessage
+		err = dec.Decode(&skip)
+		if err != nil {
+			return errInvalidBundle
+		}
+	}
+
+	return errInvalidBundle
+}
+
+// importWorkload creates one workload of a bundle. Workloads keep the
+// tenant they were exported from, and are public if they have none.
+func importWorkload(c *Context, r *http.Request, index int, entry json.RawMessage) types.WorkloadImportResult {
+	result := types.WorkloadImportResult{
+		Index:  index,
+		Status: http.StatusCreated,
+	}
+
+	var req types.Workload
+
+	err := json.Unmarshal(entry, &req)
+	if err != nil {
+		result.Status, result.Error = http.StatusBadRequest, err.Error()
+		return result
+	}
+
+	if req.TenantID == "" {
+		req.TenantID = "public"
+	}
+
+	req, err = transformWorkload(c, req)
+	if err == nil {
+		req, err = c.CreateWorkload(req)
+	}
+	if err != nil {
+		c.recordFailure(r, req.TenantID, types.EventCreateWorkload, err)
+		result.Status, result.Error = itemStatus(err, http.StatusCreated)
+		return result
+	}
+
+	result.ID = req.ID
+	return result
+}
+
+// importWorkloads creates the workloads of a bundle, reporting the outcome
+// for each of them with 207 Multi-Status. The bundle is decoded as it is
+// read, so that a large one need not be held in memory, and an entry
+// which is malformed or cannot be created does not stop the others from
+// being imported. Clients which accept application/x-ndjson are sent
+// each result as soon as it is known.
+func importWorkloads(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	dec := json.NewDecoder(r.Body)
+
+	err := workloadBundleStart(dec)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	resp := types.WorkloadImportResponse{
+		Results: []types.WorkloadImportResult{},
+	}
+
+	report := func(result types.WorkloadImportResult) {
+		resp.Results = append(resp.Results, result)
+	}
+
+	streamed := acceptsNDJSON(r)
+	if streamed {
+		w.Header().Set("Content-Type", ndjsonContentType)
+		w.WriteHeader(http.StatusMultiStatus)
+
+		enc := json.NewEncoder(w)
+		flusher, _ := w.(http.Flusher)
+
+		report = func(result types.WorkloadImportResult) {
+			_ = enc.Encode(result)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+
+	for i := 0; dec.More(); i++ {
+		if err := r.Context().Err(); err != nil {
+			result := types.WorkloadImportResult{Index: i}
+			result.Status, result.Error = itemStatus(errRequestTimeout, http.StatusCreated)
+			report(result)
+			break
+		}
+
+		var entry json.RawMessage
+
+		// the rest of the bundle cannot be found once its syntax is
+		// broken, but the workloads before it stay imported.
+		err := dec.Decode(&entry)
+		if err != nil {
+			report(types.WorkloadImportResult{
+				Index:  i,
+				Status: http.StatusBadRequest,
+				Error:  err.Error(),
+			})
+			break
+		}
+
+		report(importWorkload(c, r, i, entry))
+	}
+
+	if streamed {
+		return multiStatus(streamedResponse{}), nil
+	}
+
+	return multiStatus(resp), nil
+}
+
+// workloadStatusRef returns the URL of the status of a workload.
+func workloadStatusRef(c *Context, r *http.Request, workloadID string) string {
+	if tenantID, ok := mux.Vars(r)["tenant"]; ok {
+		return fmt.Sprintf("%s/%s/workloads/%s/status", c.URL, tenantID, workloadID)
+	}
+
+	return fmt.Sprintf("%s/workloads/%s/status", c.URL, workloadID)
+}
+
+// addWorkloadAsync is used by addWorkload for clients which ask for
+// async=true. The workload is created in the background and the client
+// is pointed at its status, which stays pending until the workload is
+// ready or has failed.
+func addWorkloadAsync(c *Context, w http.ResponseWriter, r *http.Request, req types.Workload) (Response, error) {
+	op, err := c.CreateWorkloadAsync(req)
+	if err != nil {
+		c.recordFailure(r, mux.Vars(r)["tenant"], types.EventCreateWorkload, err)
+		return workloadErrorResponse(c, req, err), err
+	}
+
+	ref := workloadStatusRef(c, r, op.WorkloadID)
+	op.Link = types.Link{
+		Rel:  "self",
+		Href: ref,
+	}
+
+	w.Header().Set("Location", ref)
+
+	return Response{http.StatusAccepted, op}, nil
+}
+
+func showWorkloadStatus(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+
+	op, err := c.WorkloadStatus(vars["tenant"], vars["workload_id"])
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	op.Link = types.Link{
+		Rel:  "self",
+		Href: workloadStatusRef(c, r, op.WorkloadID),
+	}
+
+	return Response{http.StatusOK, op}, nil
+}
+
+// validateWorkload checks a workload as addWorkload would, without
+// creating it.
+func validateWorkload(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	var v types.WorkloadValidation
+
+	req, err := workloadRequest(c, r)
+	if e, ok := err.(configRejectedError); ok {
+		v = types.WorkloadValidation{
+			Errors:   []string{fmt.Sprintf("%s: %s", e.Error(), e.Reason)},
+			Warnings: []string{},
+		}
+	} else if err != nil {
+		return errorResponse(err), err
+	} else {
+		v = c.ValidateWorkload(req)
+	}
+
+	if len(v.Errors) > 0 {
+		err = workloadInvalidError{v}
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, v}, nil
+}
+
+// requestWorkload finds the workload named by a request. Admins may see any
+// workload. Tenants may only see their own workloads and public ones.
+// Private workloads of other tenants are reported as not found, so that
+// their existence is not leaked.
+func requestWorkload(c *Context, r *http.Request) (types.Workload, error) {
+	return visibleWorkload(c, r, mux.Vars(r)["workload_id"])
+}
+
+// visibleWorkload returns the workload with ID if the caller may see it.
+func visibleWorkload(c *Context, r *http.Request, ID string) (types.Workload, error) {
+	tenantID, ok := mux.Vars(r)["tenant"]
+
+	wl, err := c.ShowWorkload("", ID)
+	if err != nil {
+		return types.Workload{}, err
+	}
+
+	if !ok && service.GetPrivilege(r.Context()) {
+		return wl, nil
+	}
+
+	if wl.TenantID != tenantID && wl.TenantID != "public" {
+		return types.Workload{}, types.ErrWorkloadNotFound
+	}
+
+	return wl, nil
+}
+
+func deleteWorkload(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID, ok := vars["tenant"]
+
+	wl, err := requestWorkload(c, r)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	// tenants can see public workloads, but not delete them.
+	if ok && wl.TenantID != tenantID {
+		return errorResponse(types.ErrForbidden), types.ErrForbidden
+	}
+
+	err = c.DeleteWorkload(wl.TenantID, wl.ID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+func transferWorkload(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	ID := vars["workload_id"]
+
+	var req types.WorkloadTransferRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	if req.TargetTenant == "" {
+		return errorResponse(types.ErrBadRequest), types.ErrBadRequest
+	}
+
+	err = c.TransferWorkload(ID, req.TargetTenant)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+// mergePatch applies an RFC 7386 merge patch to target, both decoded
+// from JSON. Members of the patch which are null are removed from the
+// target and anything which is not an object, including arrays, replaces
+// what was there.
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+
+	for name, value := range p {
+		if value == nil {
+			delete(t, name)
+			continue
+		}
+
+		t[name] = mergePatch(t[name], value)
+	}
+
+	return t
+}
+
+// diffPatch returns the JSON merge patch which would turn before into
+// after, holding only the members whose values differ. Members of after
+// which are objects in both are compared member by member.
+func diffPatch(before map[string]interface{}, after map[string]interface{}) map[string]interface{} {
+	diff := make(map[string]interface{})
+
+	for name, value := range after {
+		old, ok := before[name]
+		if ok && reflect.DeepEqual(old, value) {
+			continue
+		}
+
+		o, oldIsObject := old.(map[string]interface{})
+		v, isObject := value.(map[string]interface{})
+		if oldIsObject && isObject {
+			diff[name] = diffPatch(o, v)
+			continue
+		}
+
+		diff[name] = value
+	}
+
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			diff[name] = nil
+		}
+	}
+
+	return diff
+}
+
+// patchWorkload updates a workload with a JSON merge patch. The ID and
+// tenant of the workload cannot be changed. With ?return=diff only the
+// fields of the workload which changed are returned, as a merge patch.
+func patchWorkload(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID, ok := vars["tenant"]
+
+	wl, err := requestWorkload(c, r)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	// tenants can see public workloads, but not change them.
+	if ok && wl.TenantID != tenantID {
+		return errorResponse(types.ErrForbidden), types.ErrForbidden
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	var patch interface{}
+	err = json.Unmarshal(body, &patch)
+	if err != nil {
+		return errorResponse(types.ErrBadRequest), types.ErrBadRequest
+	}
+
+	current, err := json.Marshal(wl)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	var target interface{}
+	err = json.Unmarshal(current, &target)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	merged, err := json.Marshal(mergePatch(target, patch))
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	var req types.Workload
+	err = json.Unmarshal(merged, &req)
+	if err != nil {
+		return errorResponse(types.ErrBadRequest), types.ErrBadRequest
+	}
+
+	req.ID = wl.ID
+	req.TenantID = wl.TenantID
+
+	if c.transformer != nil && req.Config != wl.Config {
+		config, err := c.transformer.TransformConfig(req.TenantID, req.Config)
+		if err != nil {
+			err = configRejectedError{err.Error()}
+			return errorResponse(err), err
+		}
+
+		req.Config = config
+	}
+
+	wl, err = c.UpdateWorkload(req)
+	if err != nil {
+		// the workload being updated keeps its ID, which a new
+		// workload may not have.
+		check := req
+		check.ID = ""
+		return workloadErrorResponse(c, check, err), err
+	}
+
+	if r.URL.Query().Get("return") != "diff" {
+		return Response{http.StatusOK, wl}, nil
+	}
+
+	updated, err := json.Marshal(wl)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	var after map[string]interface{}
+	err = json.Unmarshal(updated, &after)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	// merging the patch changed target, so the workload as it was
+	// is decoded again.
+	var before map[string]interface{}
+	err = json.Unmarshal(current, &before)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, diffPatch(before, after)}, nil
+}
+
+// workloadGroupKeys are the workload fields a listing may be grouped by.
+var workloadGroupKeys = map[string]func(types.Workload) string{
+	"vm_type": func(wl types.Workload) string { return string(wl.VMType) },
+	"fw_type": func(wl types.Workload) string { return wl.FWType },
+}
+
+func listWorkloads(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+
+	// if we have no tenant variable, then we are admin
+	tenant, ok := vars["tenant"]
+	if !ok {
+		tenant = "public"
+	}
+
+	fwType := r.URL.Query().Get("fw_type")
+	if fwType != "" && fwType != string(payloads.EFI) && fwType != payloads.Legacy {
+		err := types.ErrInvalidFilter
+		return errorResponse(err), err
+	}
+
+	groupBy := r.URL.Query().Get("group_by")
+	groupKey, ok := workloadGroupKeys[groupBy]
+	if groupBy != "" && !ok {
+		err := types.ErrInvalidFilter
+		return errorResponse(err), err
+	}
+
+	if r.URL.Query().Get("count") == "true" {
+		count, err := c.CountWorkloads(tenant, fwType)
+		if err != nil {
+			return errorResponse(err), err
+		}
+
+		return Response{http.StatusOK, types.CountResponse{Count: count}}, nil
+	}
+
+	pg, err := requestPage(r)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	wls, err := c.ListWorkloads(tenant)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	// cursors hold a workload ID.
+	if pg.cursor {
+		sort.SliceStable(wls, func(i, j int) bool { return wls[i].ID < wls[j].ID })
+	}
+
+	var resp types.WorkloadListResponse
+
+	// the instances of every workload are counted at once rather than
+	// workload by workload. Tenants only see their own instances.
+	var counts map[string]int
+	if r.URL.Query().Get("include_instance_count") == "true" {
+		counted := ""
+		if _, scoped := vars["tenant"]; scoped {
+			counted = tenant
+		}
+		counts = c.WorkloadInstanceCounts(counted)
+	}
+
+	for _, wl := range wls {
+		if fwType != "" && wl.FWType != fwType {
+			continue
+		}
+
+		if counts != nil {
+			count := counts[wl.ID]
+			wl.InstanceCount = &count
+		}
+
+		resp.Workloads = append(resp.Workloads, wl)
+	}
+
+	// grouped listings are not paginated, as a page could split a
+	// group.
+	if groupBy != "" {
+		_, offset := r.URL.Query()["offset"]
+		_, limit := r.URL.Query()["limit"]
+		if pg.cursor || offset || limit {
+			err := types.ErrInvalidFilter
+			return errorResponse(err), err
+		}
+
+		groups := types.WorkloadGroups{}
+		for _, wl := range resp.Workloads {
+			key := groupKey(wl)
+			groups[key] = append(groups[key], wl)
+		}
+
+		return Response{http.StatusOK, groups}, nil
+	}
+
+	start, end, next := pg.window(len(resp.Workloads), func(i int) string { return resp.Workloads[i].ID })
+	resp.Workloads = resp.Workloads[start:end]
+	resp.NextCursor = next
+	setNextCursor(w, next)
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+func showWorkload(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	wl, err := requestWorkload(c, r)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	resp := types.WorkloadDetails{
+		Workload:       wl,
+		TotalStorageMB: wl.TotalStorageMB(),
+		ConfigChecksum: wl.ConfigChecksum(),
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+// diffValues appends to diffs each field under path whose value differs
+// between a and b, which are decoded JSON. Objects are compared member by
+// member and arrays element by element.
+func diffValues(diffs []types.WorkloadFieldDiff, path string, a interface{}, b interface{}) []types.WorkloadFieldDiff {
+	if reflect.DeepEqual(a, b) {
+		return diffs
+	}
+
+	objA, aIsObject := a.(map[string]interface{})
+	objB, bIsObject := b.(map[string]interface{})
+	if aIsObject && bIsObject {
+		names := make(map[string]bool)
+		for name := range objA {
+			names[name] = true
+		}
+		for name := range objB {
+			names[name] = true
+		}
+
+		sorted := make([]string, 0, len(names))
+		for name := range names {
+			sorted = append(sorted, name)
+		}
+		sort.Strings(sorted)
+
+		for _, name := range sorted {
+			field := name
+			if path != "" {
+				field = path + "." + name
+			}
+			diffs = diffValues(diffs, field, objA[name], objB[name])
+		}
+
+		return diffs
+	}
+
+	arrA, aIsArray := a.([]interface{})
+	arrB, bIsArray := b.([]interface{})
+	if aIsArray && bIsArray {
+		for i := 0; i < len(arrA) || i < len(arrB); i++ {
+			var elemA, elemB interface{}
+			if i < len(arrA) {
+				elemA = arrA[i]
+			}
+			if i < len(arrB) {
+				elemB = arrB[i]
+			}
+			diffs = diffValues(diffs, fmt.Sprintf("%s[%d]", path, i), elemA, elemB)
+		}
+
+		return diffs
+	}
+
+	return append(diffs, types.WorkloadFieldDiff{Field: path, A: a, B: b})
+}
+
+// workloadJSON returns a workload decoded from its JSON form, without its
+// ID, which always differs between the workloads being compared.
+func workloadJSON(wl types.Workload) (map[string]interface{}, error) {
+	b, err := json.Marshal(wl)
+	if err != nil {
+		return nil, err
+	}
+
+	var v map[string]interface{}
+	err = json.Unmarshal(b, &v)
+	if err != nil {
+		return nil, err
+	}
+	delete(v, "id")
+
+	return v, nil
+}
+
+// diffWorkloads compares the workloads given by the a and b parameters,
+// reporting each field which differs between them.
+func diffWorkloads(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	params := []string{"a", "b"}
+	IDs := make([]string, len(params))
+	decoded := make([]map[string]interface{}, len(params))
+
+	for i, param := range params {
+		ID := r.URL.Query().Get(param)
+		IDs[i] = ID
+		if ID == "" {
+			return errorResponse(types.ErrInvalidFilter), types.ErrInvalidFilter
+		}
+
+		wl, err := visibleWorkload(c, r, ID)
+		if err == types.ErrWorkloadNotFound {
+			err = workloadDiffNotFoundError{Param: param, WorkloadID: ID}
+		}
+		if err != nil {
+			return errorResponse(err), err
+		}
+
+		decoded[i], err = workloadJSON(wl)
+		if err != nil {
+			return errorResponse(err), err
+		}
+	}
+
+	diffs := diffValues([]types.WorkloadFieldDiff{}, "", decoded[0], decoded[1])
+
+	resp := types.WorkloadDiff{
+		A:           IDs[0],
+		B:           IDs[1],
+		Differences: diffs,
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+// listOrphanedWorkloads lists the workloads of the catalog whose storage
+// is made from images which no longer exist. The image_name of container
+// workloads is pulled by the launcher, so is not checked.
+func listOrphanedWorkloads(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	if c.images == nil {
+		return errorResponse(errNoImageChecker), errNoImageChecker
+	}
+
+	wls, err := c.ListWorkloads("")
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	resp := types.OrphanedWorkloadsResponse{
+		Workloads: []types.OrphanedWorkload{},
+	}
+
+	for _, wl := range wls {
+		var missing []string
+
+		for _, s := range wl.Storage {
+			if s.SourceType != types.ImageService || s.SourceID == "" {
+				continue
+			}
+
+			exists, err := c.images.ImageExists(wl.TenantID, s.SourceID)
+			if err != nil {
+				return errorResponse(err), err
+			}
+
+			if !exists {
+				missing = append(missing, s.SourceID)
+			}
+		}
+
+		if len(missing) == 0 {
+			continue
+		}
+
+		resp.Workloads = append(resp.Workloads, types.OrphanedWorkload{
+			WorkloadID:    wl.ID,
+			Description:   wl.Description,
+			MissingImages: missing,
+		})
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+func listQuotas(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID, ok := vars["tenant"]
+
+	if !ok {
+		tenantID = vars["for_tenant"]
+	}
+
+	var resp types.QuotaListResponse
+	resp.Quotas = c.ListQuotas(tenantID)
+
+	if r.URL.Query().Get("summary") == "true" {
+		summary := summarizeQuotas(resp.Quotas)
+		resp.Summary = &summary
+	}
+
+	if r.URL.Query().Get("breakdown") == "true" {
+		breakdown, err := c.QuotaBreakdown(tenantID)
+		if err != nil {
+			return errorResponse(err), err
+		}
+		resp.Breakdown = breakdown
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+// showQuota returns one of a tenant's quotas. The name must be exactly
+// that of a quota which can be set.
+func showQuota(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["for_tenant"]
+	name := vars["name"]
+
+	for _, qd := range c.ListQuotas(tenantID) {
+		if qd.Name == name {
+			return Response{http.StatusOK, &qd}, nil
+		}
+	}
+
+	return errorResponse(types.ErrQuotaNotFound), types.ErrQuotaNotFound
+}
+
+func recalculateQuotas(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	// only the admin may correct usage, but tenants are told they
+	// are forbidden rather than unauthorized.
+	if !service.GetPrivilege(r.Context()) {
+		return errorResponse(types.ErrForbidden), types.ErrForbidden
+	}
+
+	vars := mux.Vars(r)
+	tenantID := vars["for_tenant"]
+
+	var resp types.QuotaRecalculateResponse
+	resp.Previous = c.ListQuotas(tenantID)
+
+	err := c.RecalculateUsage(tenantID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	resp.Quotas = c.ListQuotas(tenantID)
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+// snapshotQuotas returns the quota configuration of a tenant as an opaque
+// snapshot, which restoreQuotas can put back later.
+func snapshotQuotas(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	tenantID := mux.Vars(r)["for_tenant"]
+
+	snapshot, err := c.QuotaSnapshot(tenantID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	resp := types.QuotaSnapshotResponse{
+		TenantID: tenantID,
+		Snapshot: base64.StdEncoding.EncodeToString(b),
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+// restoreQuotas puts the quota configuration of a tenant back as it was
+// when a snapshot was taken of it.
+func restoreQuotas(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	tenantID := mux.Vars(r)["for_tenant"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	var req types.QuotaRestoreRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	var snapshot types.QuotaSnapshot
+
+	b, err := base64.StdEncoding.DecodeString(req.Snapshot)
+	if err == nil {
+		err = json.Unmarshal(b, &snapshot)
+	}
+	if err != nil || snapshot.TenantID != tenantID {
+		return errorResponse(errInvalidSnapshot), errInvalidSnapshot
+	}
+
+	skipped, err := c.RestoreQuotas(tenantID, snapshot)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	resp := types.QuotaRestoreResponse{
+		Quotas:  c.ListQuotas(tenantID),
+		Skipped: skipped,
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+// listQuotaDefinitions lists the quotas which can be set for a tenant.
+func listQuotaDefinitions(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	resp := types.QuotaDefinitionsResponse{
+		Definitions: c.ListQuotaDefinitions(),
+	}
+
+	return Response{http.StatusOK, staticDocument{resp}}, nil
+}
+
+func listExceededQuotas(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	tenants, err := c.ExceededQuotas()
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, types.ExceededQuotasResponse{Tenants: tenants}}, nil
+}
+
+// listEffectiveQuotas shows where the value of each of a tenant's quotas
+// comes from.
+func listEffectiveQuotas(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+
+	eqs, err := c.EffectiveQuotas(vars["for_tenant"])
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, types.EffectiveQuotaResponse{Quotas: eqs}}, nil
+}
+
+// summarizeQuotas counts the quotas which are unlimited or close to
+// being used up. Limits have no usage, so are never near their limit.
+func summarizeQuotas(qds []types.QuotaDetails) types.QuotaSummary {
+	summary := types.QuotaSummary{Total: len(qds)}
+
+	for _, qd := range qds {
+		if qd.Value == -1 {
+			summary.Unlimited++
+			continue
+		}
+
+		if strings.Contains(qd.Name, "limit") {
+			continue
+		}
+
+		if qd.Usage*100 > qd.Value*80 {
+			summary.NearLimit++
+		}
+	}
+
+	return summary
+}
+
+func createTenant(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	var req types.CreateTenantRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	tenant, err := c.CreateTenant(types.Tenant{Name: req.Name})
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	if len(req.Quotas) > 0 {
+		err = c.UpdateQuotas(tenant.ID, req.Quotas)
+		if err != nil {
+			return errorResponse(err), err
+		}
+	}
+
+	return Response{http.StatusCreated, tenant}, nil
+}
+
+func updateTenant(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["for_tenant"]
+
+	var req types.TenantUpdateRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	if req.Enabled != nil {
+		err = c.SetTenantEnabled(tenantID, *req.Enabled)
+		if err != nil {
+			return errorResponse(err), err
+		}
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+// allowOvercommit reports whether a quota update may set quotas below what
+// the tenant already uses.
+func allowOvercommit(r *http.Request) bool {
+	return r.URL.Query().Get("allow_overcommit") == "true"
+}
+
+// checkQuotaUsage refuses quota updates which would set a limited quota
+// of a tenant below its current usage.
+func checkQuotaUsage(c *Context, tenantID string, qds []types.QuotaDetails) error {
+	usage := make(map[string]int)
+	for _, qd := range c.ListQuotas(tenantID) {
+		usage[qd.Name] = qd.Usage
+	}
+
+	var below []types.QuotaBelowUsage
+	for _, qd := range qds {
+		if qd.Value != -1 && qd.Value < usage[qd.Name] {
+			below = append(below, types.QuotaBelowUsage{
+				Name:  qd.Name,
+				Value: qd.Value,
+				Usage: usage[qd.Name],
+			})
+		}
+	}
+
+	if len(below) > 0 {
+		return types.QuotaBelowUsageError{Quotas: below}
+	}
+
+	return nil
+}
+
+func updateQuotas(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["for_tenant"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	var req types.QuotaUpdateRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	if !allowOvercommit(r) {
+		err = checkQuotaUsage(c, tenantID, req.Quotas)
+		if err != nil {
+			return errorResponse(err), err
+		}
+	}
+
+	err = c.UpdateQuotas(tenantID, req.Quotas)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	var resp types.QuotaListResponse
+	resp.Quotas = c.ListQuotas(tenantID)
+
+	return Response{http.StatusCreated, resp}, nil
+}
+
+func listSubQuotas(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID, ok := vars["tenant"]
+
+	if !ok {
+		tenantID = vars["for_tenant"]
+	}
+
+	var resp types.QuotaListResponse
+	resp.Quotas = c.ListSubQuotas(tenantID, vars["sub"])
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+func updateSubQuotas(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["for_tenant"]
+	sub := vars["sub"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	var req types.QuotaUpdateRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = c.UpdateSubQuotas(tenantID, sub, req.Quotas)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	var resp types.QuotaListResponse
+	resp.Quotas = c.ListSubQuotas(tenantID, sub)
+
+	return Response{http.StatusCreated, resp}, nil
+}
+
+// bulkUpdateQuotas applies quotas to several tenants, reporting the outcome
+// for each of them with 207 Multi-Status.
+func bulkUpdateQuotas(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	// tenants are told they are forbidden rather than unauthorized,
+	// as for recalculating quotas.
+	if !service.GetPrivilege(r.Context()) {
+		return errorResponse(types.ErrForbidden), types.ErrForbidden
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	var req []types.QuotaBulkUpdate
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	resp := types.QuotaBulkResponse{
+		Results: []types.QuotaBulkResult{},
+	}
+
+	overcommit := allowOvercommit(r)
+
+	// each tenant is updated in its own transaction, so a failure only
+	// affects the tenant it occurred for.
+	for _, update := range req {
+		result := types.QuotaBulkResult{
+			TenantID: update.TenantID,
+		}
+
+		err = nil
+		if !uuidPattern.MatchString(update.TenantID) {
+			err = malformedUUIDError{"tenant_id", update.TenantID}
+		} else if !overcommit {
+			err = checkQuotaUsage(c, update.TenantID, update.Quotas)
+		}
+
+		if err == nil {
+			err = c.UpdateQuotas(update.TenantID, update.Quotas)
+		}
+
+		result.Status, result.Error = itemStatus(err, http.StatusCreated)
+		result.Success = err == nil
+
+		resp.Results = append(resp.Results, result)
+	}
+
+	return multiStatus(resp), nil
+}
+
+// ContextService is implemented by Services which can stop the work of a
+// request once its context is done. Requests which have a timeout are
+// served by the Service WithContext returns, so that work given up on is
+// not finished after the client has been told it timed out.
+type ContextService interface {
+	WithContext(ctx context.Context) Service
+}
+
+// Service is an interface which must be implemented by the ciao API context.
+type Service interface {
+	AddPool(name string, subnet *string, ips []string, tags []string, description string, tenantID string) (types.Pool, error)
+	ListPools() ([]types.Pool, error)
+	ShowPool(id string) (types.Pool, error)
+	PoolActivity(id string, limit int) ([]types.LogEntry, error)
+	DeletePool(id string, force bool) error
+	UpdatePoolDescription(id string, description string) error
+	UpdatePoolTags(id string, tags []string) error
+	ExportPools() (types.PoolExport, error)
+	ImportPools(export types.PoolExport) ([]types.Pool, error)
+	AddPools(reqs []types.NewPoolRequest) ([]types.Pool, []error)
+	ValidatePools(reqs []types.NewPoolRequest) ([]types.PoolConflict, error)
+	RenamePool(id string, name string) error
+	UpdatePoolIPs(poolID string, add []string, remove []string, force bool) error
+	DrainPool(id string, drained bool) error
+	DrainSubnet(poolID string, subnetID string, drained bool) error
+	ShowSubnet(poolID string, subnetID string, offset int, limit int) (types.SubnetInventory, error)
+	SubnetBitmap(poolID string, subnetID string) (types.SubnetBitmap, error)
+	PoolFragmentation(poolID string) (types.PoolFragmentation, error)
+	PoolSelection() string
+	PoolCapacity() types.PoolCapacity
+	RebalancePools(apply bool) (types.PoolRebalance, error)
+	MigratePool(fromID string, toID string, dryRun bool) (types.PoolMigration, error)
+	FindPoolByIP(address string) (types.Pool, error)
+	AddAddress(poolID string, subnet *string, IPs []string) error
+	AddAddressReservation(cidr string, label string) (types.AddressReservation, error)
+	ListAddressReservations() []types.AddressReservation
+	DeleteAddressReservation(ID string) error
+	RemoveAddress(poolID string, subnetID *string, IPID *string) error
+	ListMappedAddresses(tenantID *string) []types.MappedIP
+	CountMappedAddresses(filter types.MappedIPFilter) int
+	WatchMappedAddresses(tenantID *string) (<-chan types.MappedIPChange, func())
+	MapAddress(tenantID string, poolName *string, instanceID string, internalIP string, role string, lease time.Duration) (types.MappedIP, error)
+	InstanceExists(tenantID string, instanceID string) (bool, error)
+	PreviewAllocation(tenantID string, poolName string) (types.ExternalIP, error)
+	NextFreeAddress(poolID string) (types.ExternalIP, error)
+	RemapAddress(tenantID string, address string, instanceID string) error
+	SwapAddresses(a string, b string) error
+	SetMappingLabels(tenantID string, address string, labels map[string]string) (types.MappedIP, error)
+	LabelMappings(filter types.MappedIPFilter, labels map[string]string) (int, error)
+	UnMapAddress(ID string) error
+	AddressHistory(address string) ([]types.AssignmentRecord, error)
+	ReleaseInstanceAddresses(instanceID string) (int, error)
+	ReleaseAddresses(tenantID string, poolID string) ([]types.MappedIP, error)
+	ReserveBlock(tenantID string, poolName string, count int) ([]types.MappedIP, error)
+	ReleaseBlock(tenantID string, blockID string) (int, error)
+	ClaimAddresses(tenantID string, poolName string, count int, ttl time.Duration) (types.ExternalIPClaim, error)
+	CommitClaim(tenantID string, token string, instanceIDs []string) ([]types.MappedIP, error)
+	ReclaimableAddresses(poolID string, olderThan time.Duration) ([]types.ReclaimableAddress, error)
+	ReclaimAddresses(poolID string, olderThan time.Duration) (int, error)
+	CreateWorkload(req types.Workload) (types.Workload, error)
+	CreateWorkloadAsync(req types.Workload) (types.WorkloadOperation, error)
+	Provision(tenantID string, req *types.Workload, workloadID string, poolName *string) (types.Workload, types.MappedIP, error)
+	WorkloadStatus(tenantID string, workloadID string) (types.WorkloadOperation, error)
+	ValidateWorkload(req types.Workload) types.WorkloadValidation
+	DeleteWorkload(tenantID string, workloadID string) error
+	TransferWorkload(workloadID string, targetTenantID string) error
+	UpdateWorkload(req types.Workload) (types.Workload, error)
+	ShowWorkload(tenantID string, workloadID string) (types.Workload, error)
+	CountWorkloads(tenantID string, fwType string) (int, error)
+	WorkloadInstanceCounts(tenantID string) map[string]int
+	ListWorkloads(tenantID string) ([]types.Workload, error)
+	CreateTenant(t types.Tenant) (types.Tenant, error)
+	SetTenantEnabled(tenantID string, enabled bool) error
+	DeleteTenantResources(tenantID string, cascade bool) ([]types.TenantResourceResult, []error, error)
+	ListQuotas(tenantID string) []types.QuotaDetails
+	QuotaBreakdown(tenantID string) ([]types.QuotaBreakdown, error)
+	ListQuotaDefinitions() []types.QuotaDefinition
+	ExceededQuotas() ([]types.TenantExceededQuotas, error)
+	EffectiveQuotas(tenantID string) ([]types.EffectiveQuota, error)
+	QuotaSnapshot(tenantID string) (types.QuotaSnapshot, error)
+	RestoreQuotas(tenantID string, snapshot types.QuotaSnapshot) ([]types.SkippedQuota, error)
+	UpdateQuotas(tenantID string, qds []types.QuotaDetails) error
+	ListSubQuotas(tenantID string, sub string) []types.QuotaDetails
+	UpdateSubQuotas(tenantID string, sub string, qds []types.QuotaDetails) error
+	RecordTenantEvent(event types.Event)
+	TenantEvents(tenantID string) ([]types.Event, error)
+	WatchTenantEvents(tenantID string) (<-chan types.Event, func(), error)
+	TenantChurn(tenantID string, window time.Duration) (types.TenantChurn, error)
+	TenantDefaultPool(tenantID string) (types.DefaultPool, error)
+	SetTenantDefaultPool(tenantID string, poolName string) error
+	TenantPoolStrategy(tenantID string) (types.TenantPoolStrategy, error)
+	SetTenantPoolStrategy(tenantID string, strategy string) error
+	PoolOrder(tenantID string) (types.PoolOrder, error)
+	RecalculateUsage(tenantID string) error
+	Health() (types.HealthReport, error)
+}
+
+// Context is used to provide the services and current URL to the handlers.
+type Context struct {
+	URL string
+	Service
+
+	deprecated        map[string]time.Time
+	maxBody           int64
+	routeMaxBodySizes map[string]int64
+	concurrencyLimits map[string]int
+	basePath          string
+	webhook           *webhook
+	envelope          bool
+	timeout           time.Duration
+	slowRequest       time.Duration
+	budget            time.Duration
+	transformer       ConfigTransformer
+	verifyInstances   bool
+	instanceIDPattern *regexp.Regexp
+	instances         InstanceInfoProvider
+	images            ImageChecker
+	authorizer        Authorizer
+	strictContentType bool
+	poolActivityLimit int
+	relNamespace      string
+	ptrTemplate       string
+	maintenance       *maintenanceMode
+}
+
+// Config is used to setup the Context for the ciao API.
+type Config struct {
+	URL         string
+	CiaoService Service
+
+	// BasePath, if set, e.g. "/ciao/api", is the path below which the
+	// API is served. It is prepended to the path of every route and to
+	// the links the API makes. Paths given elsewhere in the Config,
+	// such as the keys of RouteMaxBodySizes, do not include it.
+	BasePath string
+
+	// DeprecatedVersions maps media type versions, e.g. PoolsV1, to
+	// the date after which they will no longer be served. Responses to
+	// requests for a deprecated version carry a Deprecation header and,
+	// if the date is not zero, a Sunset header.
+	DeprecatedVersions map[string]time.Time
+
+	// MaxBodySize is the largest request body, in bytes, accepted by
+	// the POST, PUT, PATCH and DELETE routes. Larger requests fail
+	// with 413 Payload Too Large. DefaultMaxBodySize is used if this
+	// is zero.
+	MaxBodySize int64
+
+	// RouteMaxBodySizes overrides MaxBodySize for individual routes,
+	// keyed by the route's path template, e.g. "/workloads".
+	RouteMaxBodySizes map[string]int64
+
+	// ConcurrencyLimits bounds how many requests each of the
+	// ExpensiveRoutes, keyed by path template, serves at once. Further
+	// requests fail with 503 Service Unavailable and a Retry-After of
+	// ConcurrencyRetryAfter. Routes which are not listed, or are not
+	// expensive, are not limited.
+	ConcurrencyLimits map[string]int
+
+	// WebhookURL, if set, is sent an ExternalIPEvent as a JSON POST
+	// whenever an external IP is mapped or unmapped through the API.
+	// Events are delivered in the background and retried a few times
+	// before being dropped.
+	WebhookURL string
+
+	// EnvelopeResponses wraps the body of every successful GET response
+	// in an Envelope. Without it, clients can still ask for an Envelope
+	// by adding an envelope=true parameter to their Accept header.
+	EnvelopeResponses bool
+
+	// RequestTimeout, if set, is how long a handler may run before the
+	// request fails with 503 Service Unavailable. The request context
+	// passed to the handler is cancelled when the timeout expires.
+	RequestTimeout time.Duration
+
+	// SlowRequestThreshold, if set, logs a warning for every request
+	// which takes at least this long, giving its route and duration.
+	SlowRequestThreshold time.Duration
+
+	// ResponseTimeBudget, if set, adds a Server-Timing header to every
+	// response, giving the time spent calling CiaoService and in the
+	// handler as a whole alongside this budget, so that clients can
+	// tell which of them a slow response spent its time in.
+	ResponseTimeBudget time.Duration
+
+	// ConfigTransformer, if set, is given the config of each workload
+	// created through the API before it is stored. Workloads whose
+	// config it rejects fail with 422 Unprocessable Entity.
+	ConfigTransformer ConfigTransformer
+
+	// VerifyMappedInstances checks, with InstanceExists, that the
+	// instance named in a request to map an external IP exists before
+	// mapping it. Requests for unknown instances fail with 404 Not Found.
+	VerifyMappedInstances bool
+
+	// InstanceIDPattern, if set, is matched against the instance ID of
+	// each request to map an external IP. Requests whose ID does not
+	// match fail with 400 Bad Request. The pattern should be anchored
+	// if the whole ID is to match. Without it any instance ID is
+	// accepted.
+	InstanceIDPattern *regexp.Regexp
+
+	// InstanceInfo, if set, describes the instances embedded in
+	// listings of external IPs which ask for them. Without it, or if an
+	// instance cannot be found, the embedded instance is null.
+	InstanceInfo InstanceInfoProvider
+
+	// ImageChecker, if set, is asked whether the images workloads use
+	// exist when listing orphaned workloads. Without it the listing
+	// is not found.
+	ImageChecker ImageChecker
+
+	// Authorizer, if set, is asked whether to allow every request which
+	// passes the route's own privilege checks. Requests it denies fail
+	// with 403 Forbidden.
+	Authorizer Authorizer
+
+	// StrictContentType requires requests which change something to
+	// give a ciao media type, or a merge patch media type for merge
+	// patches, as their Content-Type. Others, such as those sending
+	// plain application/json, fail with 415 Unsupported Media Type.
+	// Without it any Content-Type the route matches is accepted.
+	StrictContentType bool
+
+	// PoolActivityLimit is the most event log entries embedded in a
+	// pool shown with include_activity=true, bounding the size of the
+	// response. DefaultPoolActivityLimit is used if this is zero.
+	PoolActivityLimit int
+
+	// LinkRelNamespace, if set, e.g. "ciao", prefixes the rel of every
+	// link the API returns, both in the resource indexes and in
+	// resources, giving rels such as "ciao:pools" and "ciao:self".
+	// Without it rels are not namespaced.
+	LinkRelNamespace string
+
+	// PTRTemplate, if set, e.g. "ip-{ip}.example.com", is used to give
+	// each external IP in listings the name its reverse DNS record is
+	// expected to give. {ip} is replaced by the address with its octets
+	// joined by dashes and {reverse} by its octets in reverse order.
+	// Without it no names are given.
+	PTRTemplate string
+}
+
+// Shutdown stops server accepting connections and waits up to timeout
+// for the requests it is serving to finish. Any still running after
+// timeout have their connections closed, and the context error is
+// returned.
+func Shutdown(server *http.Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if err == context.DeadlineExceeded {
+		_ = server.Close()
+	}
+
+	return err
+}
+
+// Routes returns the supported ciao API endpoints.
+// A plain application/json request will return v1 of the resource
+// since we only have one version of this api so far, that means
+// most routes will match both json as well as our custom
+// content type.
+func Routes(config Config, r *mux.Router) *mux.Router {
+	// make new Context
+	context := &Context{
+		URL:               config.URL + config.BasePath,
+		basePath:          config.BasePath,
+		Service:           config.CiaoService,
+		deprecated:        config.DeprecatedVersions,
+		maxBody:           config.MaxBodySize,
+		routeMaxBodySizes: config.RouteMaxBodySizes,
+		concurrencyLimits: config.ConcurrencyLimits,
+		webhook:           newWebhook(config.WebhookURL),
+		envelope:          config.EnvelopeResponses,
+		timeout:           config.RequestTimeout,
+		slowRequest:       config.SlowRequestThreshold,
+		budget:            config.ResponseTimeBudget,
+		transformer:       config.ConfigTransformer,
+		verifyInstances:   config.VerifyMappedInstances,
+		instanceIDPattern: config.InstanceIDPattern,
+		instances:         config.InstanceInfo,
+		images:            config.ImageChecker,
+		authorizer:        config.Authorizer,
+		strictContentType: config.StrictContentType,
+		poolActivityLimit: config.PoolActivityLimit,
+		relNamespace:      config.LinkRelNamespace,
+		ptrTemplate:       config.PTRTemplate,
+		maintenance:       &maintenanceMode{},
+	}
+
+	if context.maxBody == 0 {
+		context.maxBody = DefaultMaxBodySize
+	}
+
+	if context.poolActivityLimit == 0 {
+		context.poolActivityLimit = DefaultPoolActivityLimit
+	}
+
+	// watches and event streams wait for as long as their clients ask,
+	// so are not subject to the request timeout.
+	untimedContext := *context
+	untimedContext.timeout = 0
+
+	if r == nil {
+		r = mux.NewRouter()
+	}
+
+	handle := func(path string, h http.Handler) *mux.Route {
+		return r.Handle(config.BasePath+path, h)
+	}
+
+	// external IP pools
+	route := handle("/", Handler{context, listResources, true})
+	route.Methods("GET")
+
+	// the tenant is matched by the route here, rather than checked by
+	// the handler, so that it cannot shadow the top level resources.
+	route = handle("/{tenant:"+uuid.UUIDRegex+"}", Handler{context, listResources, false})
+	route.Methods("GET")
+
+	route = handle("/capabilities", Handler{context, listCapabilities, false})
+	route.Methods("GET")
+
+	route = handle("/negotiate", Handler{context, negotiate, false})
+	route.Methods("GET")
+
+	route = handle("/schema/{resource}", Handler{context, showSchema, false})
+	route.Methods("GET")
+
+	// scrapers do not give a Content-Type.
+	route = handle("/metrics", Handler{context, showMetrics, true})
+	route.Methods("GET")
+
+	route = handle("/config/webhook/test", Handler{context, testWebhook, true})
+	route.Methods("POST")
+
+	route = handle(maintenancePath, Handler{context, showMaintenance, true})
+	route.Methods("GET")
+
+	route = handle(maintenancePath, Handler{context, updateMaintenance, true})
+	route.Methods("POST")
+
+	route = handle("/admin/health", Handler{context, showHealth, true})
+	route.Methods("GET")
+
+	matchContent := fmt.Sprintf("application/(%s|json)", PoolsV1)
+
+	route = handle("/pools", Handler{context, listPools, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/{tenant}/pools", Handler{context, listPools, false})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	// tenants may only list their own pools, which the handler checks.
+	route = handle("/tenants/{for_tenant}/pools", Handler{context, listTenantPools, false})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/pools", Handler{context, requireScope(service.ScopePoolsWrite, addPool), true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	// these must come before the routes for individual pools, which
+	// would otherwise match them.
+	route = handle("/pools/export", Handler{context, limitConcurrency(context, "/pools/export", exportPools), true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/pools/import", Handler{context, requireScope(service.ScopePoolsWrite, importPools), true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/pools/batch", Handler{context, requireScope(service.ScopePoolsWrite, addPools), true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/pools/validate", Handler{context, validatePools, true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/pools/rebalance", Handler{context, requireScope(service.ScopePoolsWrite, rebalancePools), true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/pools/selection", Handler{context, showPoolSelection, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/pools/capacity", Handler{context, showPoolCapacity, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/pools/{pool}", Handler{context, showPool, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/pools/{pool}/fragmentation", Handler{context, showPoolFragmentation, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/pools/{pool}/migrate", Handler{context, requireScope(service.ScopePoolsWrite, migratePool), true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/pools/{pool}/next-free", Handler{context, showNextFree, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/pools/{pool}", Handler{context, requireScope(service.ScopePoolsWrite, deletePool), true})
+	route.Methods("DELETE")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/pools/{pool}", Handler{context, requireScope(service.ScopePoolsWrite, addToPool), true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/pools/{pool}", Handler{context, requireScope(service.ScopePoolsWrite, updatePool), true})
+	route.Methods("PATCH")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/pools/{pool}/subnets/{subnet}", Handler{context, requireScope(service.ScopePoolsWrite, deleteSubnet), true})
+	route.Methods("DELETE")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/pools/{pool}/subnets/{subnet}", Handler{context, showSubnet, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/pools/{pool}/subnets/{subnet}/bitmap", Handler{context, limitConcurrency(context, "/pools/{pool}/subnets/{subnet}/bitmap", showSubnetBitmap), true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/pools/{pool}/subnets/{subnet}", Handler{context, requireScope(service.ScopePoolsWrite, updateSubnet), true})
+	route.Methods("PATCH")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/pools/{pool}/reclaimable", Handler{context, listReclaimable, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/pools/{pool}/reclaim", Handler{context, requireScope(service.ScopeExternalIPsWrite, reclaimAddresses), true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/pools/{pool}/external-ips/{ip_id}", Handler{context, requireScope(service.ScopePoolsWrite, deleteExternalIP), true})
+	route.Methods("DELETE")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	// address space reserved from pools
+	route = handle("/reservations", Handler{context, listAddressReservations, true})
+	route.Methods("GET")
+
+	route = handle("/reservations", Handler{context, requireScope(service.ScopePoolsWrite, addAddressReservation), true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/reservations/{id}", Handler{context, requireScope(service.ScopePoolsWrite, deleteAddressReservation), true})
+	route.Methods("DELETE")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	// mapped external IPs
+	matchContent = fmt.Sprintf("application/(%s|json)", ExternalIPsV1)
+
+	route = handle("/external-ips", Handler{context, listMappedIPs, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/{tenant}/external-ips", Handler{context, listMappedIPs, false})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/external-ips/watch", Handler{&untimedContext, watchMappedIPs, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/{tenant}/external-ips/watch", Handler{&untimedContext, watchMappedIPs, false})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/external-ips/preview", Handler{context, previewAllocation, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/{tenant}/external-ips/preview", Handler{context, previewAllocation, false})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/external-ips", Handler{context, requireScope(service.ScopeExternalIPsWrite, mapExternalIP), true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/{tenant}/external-ips", Handler{context, requireScope(service.ScopeExternalIPsWrite, mapExternalIP), false})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-			return Response{http.StatusAccepted, nil}, nil
-		}
-	}
+	route = handle("/external-ips/swap", Handler{context, requireScope(service.ScopeExternalIPsWrite, swapExternalIPs), true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	return errorResponse(types.ErrAddressNotFound), types.ErrAddressNotFound
-}
+	route = handle("/{tenant}/external-ips/swap", Handler{context, requireScope(service.ScopeExternalIPsWrite, swapExternalIPs), false})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-func addWorkload(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
-	var req types.Workload
+	route = handle("/external-ips/label", Handler{context, requireScope(service.ScopeExternalIPsWrite, labelExternalIPs), true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return errorResponse(err), err
-	}
+	route = handle("/{tenant}/external-ips/label", Handler{context, requireScope(service.ScopeExternalIPsWrite, labelExternalIPs), false})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	err = json.Unmarshal(body, &req)
-	if err != nil {
-		return errorResponse(err), err
-	}
+	route = handle("/external-ips/release", Handler{context, requireScope(service.ScopeExternalIPsWrite, releaseAddresses), true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	// we allow admin to create public workloads for any tenant. However,
-	// users scoped to a particular tenant may only create workloads
-	// for their own tenant.
-	vars := mux.Vars(r)
-	tenantID, ok := vars["tenant"]
-	if ok {
-		req.TenantID = tenantID
-	} else {
-		req.TenantID = "public"
-	}
+	route = handle("/{tenant}/external-ips/release", Handler{context, requireScope(service.ScopeExternalIPsWrite, releaseAddresses), false})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	wl, err := c.CreateWorkload(req)
-	if err != nil {
-		return errorResponse(err), err
-	}
+	route = handle("/external-ips/claims", Handler{context, requireScope(service.ScopeExternalIPsWrite, claimAddresses), true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	var ref string
+	route = handle("/{tenant}/external-ips/claims", Handler{context, requireScope(service.ScopeExternalIPsWrite, claimAddresses), false})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	if ok {
-		ref = fmt.Sprintf("%s/%s/workloads/%s", c.URL, tenantID, wl.ID)
-	} else {
-		ref = fmt.Sprintf("%s/workloads/%s", c.URL, wl.ID)
-	}
+	route = handle("/external-ips/claims/{token}/commit", Handler{context, requireScope(service.ScopeExternalIPsWrite, commitClaim), true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	link := types.Link{
-		Rel:  "self",
-		Href: ref,
-	}
+	route = handle("/{tenant}/external-ips/claims/{token}/commit", Handler{context, requireScope(service.ScopeExternalIPsWrite, commitClaim), false})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	resp := types.WorkloadResponse{
-		Workload: wl,
-		Link:     link,
-	}
+	route = handle("/external-ips/claims/{token}", Handler{context, requireScope(service.ScopeExternalIPsWrite, abandonClaim), true})
+	route.Methods("DELETE")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	return Response{http.StatusCreated, resp}, nil
-}
+	route = handle("/{tenant}/external-ips/claims/{token}", Handler{context, requireScope(service.ScopeExternalIPsWrite, abandonClaim), false})
+	route.Methods("DELETE")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-func deleteWorkload(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
-	vars := mux.Vars(r)
-	ID := vars["workload_id"]
+	// history concerns every tenant the address was assigned to, so
+	// only the admin may see it.
+	route = handle("/external-ips/{ip}/history", Handler{context, showAddressHistory, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	// if we have no tenant variable, then we are admin
-	tenantID, ok := vars["tenant"]
-	if !ok {
-		tenantID = "public"
-	}
+	route = handle("/external-ips/{mapping_id}", Handler{context, requireScope(service.ScopeExternalIPsWrite, remapExternalIP), true})
+	route.Methods("PATCH")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	err := c.DeleteWorkload(tenantID, ID)
-	if err != nil {
-		return errorResponse(err), err
-	}
+	route = handle("/{tenant}/external-ips/{mapping_id}", Handler{context, requireScope(service.ScopeExternalIPsWrite, remapExternalIP), false})
+	route.Methods("PATCH")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	return Response{http.StatusNoContent, nil}, nil
-}
+	route = handle("/external-ips/{mapping_id}", Handler{context, requireScope(service.ScopeExternalIPsWrite, unmapExternalIP), true})
+	route.Methods("DELETE")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-func showWorkload(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
-	vars := mux.Vars(r)
-	ID := vars["workload_id"]
+	route = handle("/{tenant}/external-ips/{mapping_id}", Handler{context, requireScope(service.ScopeExternalIPsWrite, unmapExternalIP), false})
+	route.Methods("DELETE")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	// if we have no tenant variable, then we are admin
-	tenant, ok := vars["tenant"]
-	if !ok {
-		tenant = "public"
-	}
+	route = handle("/instances/{instance_id}/external-ips", Handler{context, requireScope(service.ScopeExternalIPsWrite, releaseInstanceIPs), true})
+	route.Methods("DELETE")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	wl, err := c.ShowWorkload(tenant, ID)
-	if err != nil {
-		return errorResponse(err), err
-	}
+	route = handle("/tenants/{for_tenant}/external-ips/reserve", Handler{context, requireScope(service.ScopeExternalIPsWrite, reserveBlock), true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	return Response{http.StatusOK, wl}, nil
-}
+	route = handle("/tenants/{for_tenant}/external-ips/reserve/{block_id}", Handler{context, requireScope(service.ScopeExternalIPsWrite, releaseBlock), true})
+	route.Methods("DELETE")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-func listQuotas(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
-	vars := mux.Vars(r)
-	tenantID, ok := vars["tenant"]
+	// workloads
+	matchContent = fmt.Sprintf("application/(%s|json)", WorkloadsV1)
+	matchMergePatch := regexp.QuoteMeta("application/" + MergePatch)
 
-	if !ok {
-		tenantID = vars["for_tenant"]
-	}
+	route = handle("/workloads", Handler{context, requireScope(service.ScopeWorkloadsWrite, addWorkload), true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	var resp types.QuotaListResponse
-	resp.Quotas = c.ListQuotas(tenantID)
+	route = handle("/workloads/validate", Handler{context, validateWorkload, true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	return Response{http.StatusOK, resp}, nil
-}
+	route = handle("/workloads/import", Handler{context, requireScope(service.ScopeWorkloadsWrite, importWorkloads), true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-func updateQuotas(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
-	vars := mux.Vars(r)
-	tenantID := vars["for_tenant"]
+	route = handle("/workloads", Handler{context, listWorkloads, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return errorResponse(err), err
-	}
+	route = handle("/workloads/orphaned", Handler{context, listOrphanedWorkloads, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	var req types.QuotaUpdateRequest
-	err = json.Unmarshal(body, &req)
-	if err != nil {
-		return errorResponse(err), err
-	}
+	route = handle("/workloads/diff", Handler{context, diffWorkloads, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	err = c.UpdateQuotas(tenantID, req.Quotas)
-	if err != nil {
-		return errorResponse(err), err
-	}
+	route = handle("/workloads/{workload_id}", Handler{context, requireScope(service.ScopeWorkloadsWrite, deleteWorkload), true})
+	route.Methods("DELETE")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	var resp types.QuotaListResponse
-	resp.Quotas = c.ListQuotas(tenantID)
+	route = handle("/workloads/{workload_id}", Handler{context, showWorkload, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	return Response{http.StatusCreated, resp}, nil
-}
+	route = handle("/workloads/{workload_id}", Handler{context, requireScope(service.ScopeWorkloadsWrite, patchWorkload), true})
+	route.Methods("PATCH")
+	route.HeadersRegexp("Content-Type", matchMergePatch)
 
-// Service is an interface which must be implemented by the ciao API context.
-type Service interface {
-	AddPool(name string, subnet *string, ips []string) (types.Pool, error)
-	ListPools() ([]types.Pool, error)
-	ShowPool(id string) (types.Pool, error)
-	DeletePool(id string) error
-	AddAddress(poolID string, subnet *string, IPs []string) error
-	RemoveAddress(poolID string, subnetID *string, IPID *string) error
-	ListMappedAddresses(tenantID *string) []types.MappedIP
-	MapAddress(tenantID string, poolName *string, instanceID string) error
-	UnMapAddress(ID string) error
-	CreateWorkload(req types.Workload) (types.Workload, error)
-	DeleteWorkload(tenantID string, workloadID string) error
-	ShowWorkload(tenantID string, workloadID string) (types.Workload, error)
-	ListQuotas(tenantID string) []types.QuotaDetails
-	UpdateQuotas(tenantID string, qds []types.QuotaDetails) error
-}
+	route = handle("/workloads/{workload_id}/status", Handler{context, showWorkloadStatus, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-// Context is used to provide the services and current URL to the handlers.
-type Context struct {
-	URL string
-	Service
-}
+	route = handle("/workloads/{workload_id}/transfer", Handler{context, requireScope(service.ScopeWorkloadsWrite, transferWorkload), true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-// Config is used to setup the Context for the ciao API.
-type Config struct {
-	URL         string
-	CiaoService Service
-}
+	route = handle("/{tenant}/workloads", Handler{context, requireScope(service.ScopeWorkloadsWrite, addWorkload), false})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-// Routes returns the supported ciao API endpoints.
-// A plain application/json request will return v1 of the resource
-// since we only have one version of this api so far, that means
-// most routes will match both json as well as our custom
-// content type.
-func Routes(config Config, r *mux.Router) *mux.Router {
-	// make new Context
-	context := &Context{config.URL, config.CiaoService}
+	// provisioning both creates a workload and reserves an external
+	// IP, so needs the scopes of each.
+	route = handle("/provision", Handler{context, requireScope(service.ScopeWorkloadsWrite, requireScope(service.ScopeExternalIPsWrite, provision)), true})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	if r == nil {
-		r = mux.NewRouter()
-	}
+	route = handle("/{tenant}/provision", Handler{context, requireScope(service.ScopeWorkloadsWrite, requireScope(service.ScopeExternalIPsWrite, provision)), false})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	// external IP pools
-	route := r.Handle("/", Handler{context, listResources, true})
+	route = handle("/{tenant}/workloads/validate", Handler{context, validateWorkload, false})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/{tenant}/workloads", Handler{context, listWorkloads, false})
 	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}", Handler{context, listResources, false})
+	route = handle("/{tenant}/workloads/diff", Handler{context, diffWorkloads, false})
 	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	matchContent := fmt.Sprintf("application/(%s|json)", PoolsV1)
+	route = handle("/{tenant}/workloads/{workload_id}", Handler{context, requireScope(service.ScopeWorkloadsWrite, deleteWorkload), false})
+	route.Methods("DELETE")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/pools", Handler{context, listPools, true})
+	route = handle("/{tenant}/workloads/{workload_id}", Handler{context, showWorkload, false})
 	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/pools", Handler{context, listPools, false})
+	route = handle("/{tenant}/workloads/{workload_id}", Handler{context, requireScope(service.ScopeWorkloadsWrite, patchWorkload), false})
+	route.Methods("PATCH")
+	route.HeadersRegexp("Content-Type", matchMergePatch)
+
+	route = handle("/{tenant}/workloads/{workload_id}/status", Handler{context, showWorkloadStatus, false})
 	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/pools", Handler{context, addPool, true})
+	// tenant quotas
+	matchContent = fmt.Sprintf("application/(%s|json)", TenantsV1)
+
+	route = handle("/tenants", Handler{context, requireScope(service.ScopeTenantsWrite, createTenant), true})
 	route.Methods("POST")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/pools/{pool:"+uuid.UUIDRegex+"}", Handler{context, showPool, true})
+	// tenants may only list their own resources, which the handler
+	// checks.
+	route = handle("/tenants/{for_tenant}/", Handler{context, listTenantResources, false})
 	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/pools/{pool:"+uuid.UUIDRegex+"}", Handler{context, deletePool, true})
-	route.Methods("DELETE")
+	route = handle("/tenants/{for_tenant}", Handler{context, requireScope(service.ScopeTenantsWrite, updateTenant), true})
+	route.Methods("PATCH")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/pools/{pool:"+uuid.UUIDRegex+"}", Handler{context, addToPool, true})
-	route.Methods("POST")
+	route = handle("/tenants/{for_tenant}", Handler{context, requireScope(service.ScopeTenantsWrite, deleteTenant), true})
+	route.Methods("DELETE")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/pools/{pool:"+uuid.UUIDRegex+"}/subnets/{subnet:"+uuid.UUIDRegex+"}", Handler{context, deleteSubnet, true})
-	route.Methods("DELETE")
+	route = handle("/{tenant}/tenants/quotas", Handler{context, listQuotas, false})
+	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/pools/{pool:"+uuid.UUIDRegex+"}/external-ips/{ip_id:"+uuid.UUIDRegex+"}", Handler{context, deleteExternalIP, true})
-	route.Methods("DELETE")
+	route = handle("/tenants/{for_tenant}/quotas", Handler{context, listQuotas, true})
+	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	// mapped external IPs
-	matchContent = fmt.Sprintf("application/(%s|json)", ExternalIPsV1)
+	route = handle("/tenants/{for_tenant}/quotas", Handler{context, requireScope(service.ScopeQuotasWrite, updateQuotas), true})
+	route.Methods("PUT")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/external-ips", Handler{context, listMappedIPs, true})
+	// this must come before the sub-quota routes, which would
+	// otherwise match it.
+	route = handle("/tenants/{for_tenant}/quotas/effective", Handler{context, listEffectiveQuotas, true})
 	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/external-ips", Handler{context, listMappedIPs, false})
+	route = handle("/tenants/{for_tenant}/quotas/recalculate", Handler{context, requireScope(service.ScopeQuotasWrite, recalculateQuotas), false})
+	route.Methods("POST")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/tenants/{for_tenant}/quotas/snapshot", Handler{context, snapshotQuotas, true})
 	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/external-ips", Handler{context, mapExternalIP, true})
+	route = handle("/tenants/{for_tenant}/quotas/restore", Handler{context, requireScope(service.ScopeQuotasWrite, restoreQuotas), true})
 	route.Methods("POST")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/external-ips", Handler{context, mapExternalIP, false})
+	route = handle("/quotas/bulk", Handler{context, requireScope(service.ScopeQuotasWrite, bulkUpdateQuotas), false})
 	route.Methods("POST")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/external-ips/{mapping_id:"+uuid.UUIDRegex+"}", Handler{context, unmapExternalIP, true})
-	route.Methods("DELETE")
+	route = handle("/quotas/definitions", Handler{context, listQuotaDefinitions, false})
+	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/external-ips/{mapping_id:"+uuid.UUIDRegex+"}", Handler{context, unmapExternalIP, false})
-	route.Methods("DELETE")
+	route = handle("/quotas/exceeded", Handler{context, listExceededQuotas, true})
+	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	// workloads
-	matchContent = fmt.Sprintf("application/(%s|json)", WorkloadsV1)
+	route = handle("/tenants/{for_tenant}/inventory", Handler{context, showTenantInventory, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/workloads", Handler{context, addWorkload, true})
-	route.Methods("POST")
+	// tenants may only list their own events, which the handler checks.
+	route = handle("/tenants/{for_tenant}/events", Handler{context, listTenantEvents, false})
+	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/workloads/{workload_id:"+uuid.UUIDRegex+"}", Handler{context, deleteWorkload, true})
-	route.Methods("DELETE")
+	// EventSource clients send no Content-Type.
+	route = handle("/tenants/{for_tenant}/events/stream", Handler{&untimedContext, streamTenantEvents, false})
+	route.Methods("GET")
+
+	route = handle("/tenants/{for_tenant}/churn", Handler{context, showTenantChurn, true})
+	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/workloads/{workload_id:"+uuid.UUIDRegex+"}", Handler{context, showWorkload, true})
+	// tenants may only see and set their own default pool, which the
+	// handlers check.
+	route = handle("/tenants/{for_tenant}/default-pool", Handler{context, showDefaultPool, false})
 	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/workloads", Handler{context, addWorkload, false})
-	route.Methods("POST")
+	route = handle("/tenants/{for_tenant}/default-pool", Handler{context, requireScope(service.ScopePoolsWrite, updateDefaultPool), false})
+	route.Methods("PUT")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/workloads/{workload_id:"+uuid.UUIDRegex+"}", Handler{context, deleteWorkload, false})
-	route.Methods("DELETE")
+	// tenants may see the strategy used for them, but only admins set
+	// it.
+	route = handle("/tenants/{for_tenant}/pool-strategy", Handler{context, showPoolStrategy, false})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
+
+	route = handle("/tenants/{for_tenant}/pool-strategy", Handler{context, requireScope(service.ScopePoolsWrite, updatePoolStrategy), true})
+	route.Methods("PUT")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/workloads/{workload_id:"+uuid.UUIDRegex+"}", Handler{context, showWorkload, false})
+	route = handle("/tenants/{for_tenant}/pool-order", Handler{context, showPoolOrder, false})
 	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	// tenant quotas
-	matchContent = fmt.Sprintf("application/(%s|json)", TenantsV1)
+	route = handle("/{tenant}/tenants/quotas/{sub}", Handler{context, listSubQuotas, false})
+	route.Methods("GET")
+	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/tenants/quotas", Handler{context, listQuotas, false})
+	// names of quotas, which all end in -quota or -limit, are taken to
+	// be quotas rather than sub-quotas.
+	route = handle("/tenants/{for_tenant}/quotas/{name:[a-z0-9-]+-(?:quota|limit)}", Handler{context, showQuota, true})
 	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/tenants/{for_tenant:"+uuid.UUIDRegex+"}/quotas", Handler{context, listQuotas, true})
+	route = handle("/tenants/{for_tenant}/quotas/{sub}", Handler{context, listSubQuotas, true})
 	route.Methods("GET")
 	route.HeadersRegexp("Content-Type", matchContent)
 
-	route = r.Handle("/tenants/{for_tenant:"+uuid.UUIDRegex+"}/quotas", Handler{context, updateQuotas, true})
+	route = handle("/tenants/{for_tenant}/quotas/{sub}", Handler{context, requireScope(service.ScopeQuotasWrite, updateSubQuotas), true})
 	route.Methods("PUT")
 	route.HeadersRegexp("Content-Type", matchContent)
 
+	notFound := r.NotFoundHandler
+	if notFound == nil {
+		notFound = http.NotFoundHandler()
+	}
+
+	r.NotFoundHandler = methodNotAllowedHandler{router: r, next: notFound}
+
 	return r
 }
@@ -16,14 +16,26 @@ package api
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/01org/ciao/ciao-controller/types"
 	"github.com/01org/ciao/payloads"
 	"github.com/01org/ciao/service"
+	"github.com/gorilla/mux"
 )
 
 type test struct {
@@ -50,7 +62,24 @@ var tests = []test{
 		"",
 		fmt.Sprintf("application/%s", PoolsV1),
 		http.StatusOK,
-		`{"pools":[{"id":"ba58f471-0735-4773-9550-188e2d012941","name":"testpool","free":0,"total_ips":0,"links":[{"rel":"self","href":"/pools/ba58f471-0735-4773-9550-188e2d012941"}]}]}`,
+		`{"pools":[{"id":"ba58f471-0735-4773-9550-188e2d012941","name":"testpool","free":0,"total_ips":0,"tags":["dmz","partner"],"links":[{"rel":"self","href":"/pools/ba58f471-0735-4773-9550-188e2d012941"}]}]}`,
+	},
+	{
+		"GET",
+		"/pools?sort=utilization",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"pools":[{"id":"ba58f471-0735-4773-9550-188e2d012941","name":"testpool","free":0,"total_ips":0,"tags":["dmz","partner"],"links":[{"rel":"self","href":"/pools/ba58f471-0735-4773-9550-188e2d012941"}]}]}`,
+	},
+	{
+		"GET",
+		"/pools?sort=name",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid sort key"}}
+`,
 	},
 	{
 		"GET",
@@ -58,7 +87,31 @@ var tests = []test{
 		"",
 		fmt.Sprintf("application/%s", PoolsV1),
 		http.StatusOK,
-		`{"pools":[{"id":"ba58f471-0735-4773-9550-188e2d012941","name":"testpool","free":0,"total_ips":0,"links":[{"rel":"self","href":"/pools/ba58f471-0735-4773-9550-188e2d012941"}]}]}`,
+		`{"pools":[{"id":"ba58f471-0735-4773-9550-188e2d012941","name":"testpool","free":0,"total_ips":0,"tags":["dmz","partner"],"links":[{"rel":"self","href":"/pools/ba58f471-0735-4773-9550-188e2d012941"}]}]}`,
+	},
+	{
+		"GET",
+		"/pools?name=TestPool",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"pools":[{"id":"ba58f471-0735-4773-9550-188e2d012941","name":"testpool","free":0,"total_ips":0,"tags":["dmz","partner"],"links":[{"rel":"self","href":"/pools/ba58f471-0735-4773-9550-188e2d012941"}]}]}`,
+	},
+	{
+		"GET",
+		"/pools?tag=dmz&tag=partner",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"pools":[{"id":"ba58f471-0735-4773-9550-188e2d012941","name":"testpool","free":0,"total_ips":0,"tags":["dmz","partner"],"links":[{"rel":"self","href":"/pools/ba58f471-0735-4773-9550-188e2d012941"}]}]}`,
+	},
+	{
+		"GET",
+		"/pools?tag=dmz&tag=internal",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"pools":null}`,
 	},
 	{
 		"POST",
@@ -68,13 +121,107 @@ var tests = []test{
 		http.StatusNoContent,
 		"null",
 	},
+	{
+		"POST",
+		"/pools",
+		`{"name":"testpool","tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22"}`,
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"POST",
+		"/pools",
+		`{"name":"testpool","tenant_id":"not-a-uuid"}`,
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Malformed UUID for tenant_id","details":{"parameter":"tenant_id","value":"not-a-uuid"}}}
+`,
+	},
+	{
+		"POST",
+		"/pools",
+		`{"name":"TestPool"}`,
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Pool by that name already exists"}}
+`,
+	},
+	{
+		"POST",
+		"/pools?idempotent=true",
+		`{"name":"TestPool"}`,
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"id":"ba58f471-0735-4773-9550-188e2d012941","name":"testpool","free":0,"total_ips":0,"links":[{"rel":"self","href":"/pools/ba58f471-0735-4773-9550-188e2d012941"}],"subnets":[],"ips":[],"revision":3}`,
+	},
+	{
+		"POST",
+		"/pools",
+		`{}`,
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Pool name is required"}}
+`,
+	},
+	{
+		"POST",
+		"/pools",
+		`{"name":" ","subnet":"192.168.0.0/24"}`,
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Pool name is required"}}
+`,
+	},
+	{
+		"POST",
+		"/pools",
+		`{"name":"testpool","description":"Addresses for the partner DMZ, owned by netops"}`,
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"POST",
+		"/pools",
+		fmt.Sprintf(`{"name":"testpool","description":%q}`, strings.Repeat("a", types.MaxPoolDescriptionLength+1)),
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Pool description too long"}}
+`,
+	},
+	{
+		"PATCH",
+		"/pools/ba58f471-0735-4773-9550-188e2d012941",
+		`{"description":"Retired, do not allocate"}`,
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"PATCH",
+		"/pools/ba58f471-0735-4773-9550-188e2d012941",
+		fmt.Sprintf(`{"description":%q}`, strings.Repeat("a", types.MaxPoolDescriptionLength+1)),
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Pool description too long"}}
+`,
+	},
 	{
 		"GET",
 		"/pools/ba58f471-0735-4773-9550-188e2d012941",
 		"",
 		fmt.Sprintf("application/%s", PoolsV1),
 		http.StatusOK,
-		`{"id":"ba58f471-0735-4773-9550-188e2d012941","name":"testpool","free":0,"total_ips":0,"links":[{"rel":"self","href":"/pools/ba58f471-0735-4773-9550-188e2d012941"}],"subnets":[],"ips":[]}`,
+		`{"id":"ba58f471-0735-4773-9550-188e2d012941","name":"testpool","free":0,"total_ips":0,"links":[{"rel":"self","href":"/pools/ba58f471-0735-4773-9550-188e2d012941"}],"subnets":[],"ips":[],"revision":3}`,
+	},
+	{
+		"GET",
+		"/pools/ba58f471-0735-4773-9550-188e2d012941?include_activity=true",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"id":"ba58f471-0735-4773-9550-188e2d012941","name":"testpool","free":0,"total_ips":0,"links":[{"rel":"self","href":"/pools/ba58f471-0735-4773-9550-188e2d012941"}],"subnets":[],"ips":[],"revision":3,"activity":[{"time_stamp":"2017-06-02T10:00:00Z","tenant_id":"test-tenant-id","type":"info","message":"Mapped 192.168.0.1 to 172.16.0.2"},{"time_stamp":"2017-06-01T10:00:00Z","tenant_id":"test-tenant-id","type":"info","message":"Unmapped 192.168.0.1 from 172.16.0.3"}]}`,
 	},
 	{
 		"DELETE",
@@ -85,250 +232,6162 @@ var tests = []test{
 		"null",
 	},
 	{
-		"POST",
+		"PATCH",
 		"/pools/ba58f471-0735-4773-9550-188e2d012941",
-		`{"subnet":"192.168.0.0/24"}`,
+		`{"tags":["internal"]}`,
 		fmt.Sprintf("application/%s", PoolsV1),
 		http.StatusNoContent,
 		"null",
 	},
 	{
-		"DELETE",
-		"/pools/ba58f471-0735-4773-9550-188e2d012941/subnets/ba58f471-0735-4773-9550-188e2d012941",
-		"",
+		"PATCH",
+		"/pools/ba58f471-0735-4773-9550-188e2d012941",
+		`{"add_ips":["192.168.0.5"],"remove_ips":["192.168.0.2"]}`,
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"PATCH",
+		"/pools/ba58f471-0735-4773-9550-188e2d012941",
+		`{"remove_ips":["192.168.0.1"]}`,
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Address is in use"}}
+`,
+	},
+	{
+		"PATCH",
+		"/pools/ba58f471-0735-4773-9550-188e2d012941?force=true",
+		`{"remove_ips":["192.168.0.1"]}`,
 		fmt.Sprintf("application/%s", PoolsV1),
 		http.StatusNoContent,
 		"null",
 	},
 	{
 		"DELETE",
-		"/pools/ba58f471-0735-4773-9550-188e2d012941/external-ips/ba58f471-0735-4773-9550-188e2d012941",
+		"/pools/f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Deleting pool mypool removes the last source of IPv4 addresses","details":{"pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"mypool","family":"IPv4"}}}
+`,
+	},
+	{
+		"DELETE",
+		"/pools/f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e?force=true",
 		"",
 		fmt.Sprintf("application/%s", PoolsV1),
 		http.StatusNoContent,
 		"null",
 	},
+	{
+		"DELETE",
+		"/pools/76f4fa99-e533-4cbd-ab36-f6c0f51292ed",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Pool busypool still has 1 subnets, 2 IPs and 3 mappings","details":{"pool_id":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","pool_name":"busypool","subnets":1,"ips":2,"mappings":3}}}
+`,
+	},
 	{
 		"GET",
-		"/external-ips",
+		"/pools/selection",
 		"",
-		fmt.Sprintf("application/%s", ExternalIPsV1),
+		fmt.Sprintf("application/%s", PoolsV1),
 		http.StatusOK,
-		`[{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","external_ip":"192.168.0.1","internal_ip":"172.16.0.1","instance_id":"","tenant_id":"8a497c68-a88a-4c1c-be56-12a4883208d3","pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"mypool","links":[{"rel":"self","href":"/external-ips/ba58f471-0735-4773-9550-188e2d012941"},{"rel":"pool","href":"/pools/f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e"}]}]`,
+		`{"strategy":"round-robin"}`,
 	},
 	{
-		"POST",
-		"/19df9b86-eda3-489d-b75f-d38710e210cb/external-ips",
-		`{"pool_name":"apool","instance_id":"validinstanceID"}`,
-		fmt.Sprintf("application/%s", ExternalIPsV1),
-		http.StatusNoContent,
-		"null",
+		"GET",
+		"/pools?contains=192.168.0.5",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"id":"ba58f471-0735-4773-9550-188e2d012941","name":"testpool","free":253,"total_ips":254,"links":null,"subnets":[{"id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","subnet":"192.168.0.0/24","links":null}],"ips":[],"revision":0}`,
+	},
+	{
+		"GET",
+		"/pools?contains=10.0.0.1",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Pool not found"}}
+`,
+	},
+	{
+		"GET",
+		"/pools?contains=not-an-ip",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid filter value"}}
+`,
+	},
+	{
+		"GET",
+		"/pools/capacity",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"ipv4":{"free":250,"total":254},"ipv6":{"free":1,"total":2}}`,
+	},
+	{
+		"GET",
+		"/pools/export",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"pools":[{"id":"ba58f471-0735-4773-9550-188e2d012941","name":"testpool","free":0,"total_ips":0,"links":[{"rel":"self","href":"/pools/ba58f471-0735-4773-9550-188e2d012941"}],"subnets":[],"ips":[],"tags":["dmz","partner"],"revision":0}],"mappings":[{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","external_ip":"192.168.0.1","internal_ip":"172.16.0.1","instance_id":"","tenant_id":"8a497c68-a88a-4c1c-be56-12a4883208d3","pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"mypool","status":"reserved","index":0,"links":[{"rel":"self","href":"/external-ips/ba58f471-0735-4773-9550-188e2d012941"},{"rel":"pool","href":"/pools/f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e"}]}]}`,
 	},
 	{
 		"POST",
-		"/workloads",
-		`{"id":"","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"this will totally work!","defaults":[]}`,
-		fmt.Sprintf("application/%s", WorkloadsV1),
+		"/pools/import",
+		`{"pools":[{"id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","name":"mypool","subnets":[{"subnet":"192.168.0.0/24"}]}],"mappings":[]}`,
+		fmt.Sprintf("application/%s", PoolsV1),
 		http.StatusCreated,
-		`{"workload":{"id":"ba58f471-0735-4773-9550-188e2d012941","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"this will totally work!","defaults":[],"storage":null},"link":{"rel":"self","href":"/workloads/ba58f471-0735-4773-9550-188e2d012941"}}`,
+		`{"pools":[{"id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","name":"mypool","free":0,"total_ips":0}]}`,
 	},
 	{
-		"DELETE",
-		"/workloads/76f4fa99-e533-4cbd-ab36-f6c0f51292ed",
+		"POST",
+		"/pools/batch",
+		`[{"name":"mypool","subnet":"192.168.0.0/24"},{"name":"testpool","ips":[{"ip":"10.0.0.1"}]}]`,
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusMultiStatus,
+		`{"results":[{"name":"mypool","status":201,"pool":{"id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","name":"mypool","free":0,"total_ips":0,"links":null,"subnets":null,"ips":null,"revision":0}},{"name":"testpool","status":409,"error":"Pool by that name already exists"}]}`,
+	},
+	{
+		"POST",
+		"/pools/validate",
+		`[{"name":"mypool","subnet":"192.168.0.0/24"},{"name":"testpool","ips":[{"ip":"10.0.0.1"}]}]`,
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"valid":false,"conflicts":[{"index":1,"name":"testpool","kind":"name","pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"testpool","message":"Pool by that name already exists"}]}`,
+	},
+	{
+		"POST",
+		"/pools/validate",
+		`[{"name":"mypool","subnet":"192.168.0.0/24"}]`,
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"valid":true,"conflicts":[]}`,
+	},
+	{
+		"POST",
+		"/pools/rebalance",
 		"",
-		fmt.Sprintf("application/%s", WorkloadsV1),
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"applied":false,"plan":[{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","tenant_id":"8a497c68-a88a-4c1c-be56-12a4883208d3","external_ip":"192.168.0.1","from_pool_id":"ba58f471-0735-4773-9550-188e2d012941","from_pool_name":"testpool","to_pool_id":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","to_pool_name":"otherpool"}]}`,
+	},
+	{
+		"POST",
+		"/pools/f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e/migrate?to=76f4fa99-e533-4cbd-ab36-f6c0f51292ed&dry_run=true",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"from_pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","to_pool_id":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","dry_run":true,"attached":1,"addresses":{"192.168.0.1":"192.168.1.1"},"mappings":[{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","tenant_id":"8a497c68-a88a-4c1c-be56-12a4883208d3","instance_id":"validinstanceID","external_ip":"192.168.0.1","new_external_ip":"192.168.1.1","attached":true}]}`,
+	},
+	{
+		"POST",
+		"/pools/f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e/migrate?to=76f4fa99-e533-4cbd-ab36-f6c0f51292ed",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"from_pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","to_pool_id":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","dry_run":false,"attached":1,"addresses":{"192.168.0.1":"192.168.1.1"},"mappings":[{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","new_mapping_id":"e2d3a5b8-1505-48e6-9c8a-b0a50e4e5cb2","tenant_id":"8a497c68-a88a-4c1c-be56-12a4883208d3","instance_id":"validinstanceID","external_ip":"192.168.0.1","new_external_ip":"192.168.1.1","attached":true}]}`,
+	},
+	{
+		"POST",
+		"/pools/f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e/migrate?to=e2d3a5b8-1505-48e6-9c8a-b0a50e4e5cb2",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusMultiStatus,
+		`{"from_pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","to_pool_id":"e2d3a5b8-1505-48e6-9c8a-b0a50e4e5cb2","dry_run":false,"attached":1,"failed":1,"addresses":{"192.168.0.1":"192.168.1.1"},"mappings":[{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","new_mapping_id":"e2d3a5b8-1505-48e6-9c8a-b0a50e4e5cb2","tenant_id":"8a497c68-a88a-4c1c-be56-12a4883208d3","instance_id":"validinstanceID","external_ip":"192.168.0.1","new_external_ip":"192.168.1.1","attached":true,"error":"CNCI not active"}]}`,
+	},
+	{
+		"POST",
+		"/pools/f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e/migrate",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusForbidden,
+		`{"error":{"code":403,"name":"Forbidden","message":"Invalid Request"}}
+`,
+	},
+	{
+		"POST",
+		"/pools/rebalance?apply=true",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"applied":true,"plan":[{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","tenant_id":"8a497c68-a88a-4c1c-be56-12a4883208d3","external_ip":"192.168.0.1","from_pool_id":"ba58f471-0735-4773-9550-188e2d012941","from_pool_name":"testpool","to_pool_id":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","to_pool_name":"otherpool"}],"moves":[{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","tenant_id":"8a497c68-a88a-4c1c-be56-12a4883208d3","external_ip":"192.168.0.1","from_pool_id":"ba58f471-0735-4773-9550-188e2d012941","from_pool_name":"testpool","to_pool_id":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","to_pool_name":"otherpool","new_external_ip":"192.168.1.1"}]}`,
+	},
+	{
+		"POST",
+		"/pools/import",
+		`{"pools":[{"id":"ba58f471-0735-4773-9550-188e2d012941","name":"testpool"}],"mappings":[]}`,
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Pool already exists"}}
+`,
+	},
+	{
+		"PATCH",
+		"/pools/ba58f471-0735-4773-9550-188e2d012941",
+		`{"name":"newpool"}`,
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"PATCH",
+		"/pools/ba58f471-0735-4773-9550-188e2d012941",
+		`{"name":"takenpool"}`,
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Pool by that name already exists"}}
+`,
+	},
+	{
+		"PATCH",
+		"/pools/ba58f471-0735-4773-9550-188e2d012941",
+		`{"name":""}`,
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid pool name"}}
+`,
+	},
+	{
+		"PATCH",
+		"/pools/ba58f471-0735-4773-9550-188e2d012941",
+		`{"drained":true}`,
+		fmt.Sprintf("application/%s", PoolsV1),
 		http.StatusNoContent,
 		"null",
 	},
 	{
 		"GET",
-		"/workloads/ba58f471-0735-4773-9550-188e2d012941",
+		"/pools/ba58f471-0735-4773-9550-188e2d012941/subnets/ba58f471-0735-4773-9550-188e2d012941",
 		"",
-		fmt.Sprintf("application/%s", WorkloadsV1),
+		fmt.Sprintf("application/%s", PoolsV1),
 		http.StatusOK,
-		`{"id":"ba58f471-0735-4773-9550-188e2d012941","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"this will totally work!","defaults":null,"storage":null}`,
+		`{"id":"ba58f471-0735-4773-9550-188e2d012941","subnet":"192.168.0.0/30","offset":0,"addresses":[{"address":"192.168.0.1","status":"attached","mapping_id":"ba58f471-0735-4773-9550-188e2d012941","instance_id":"validinstanceID","tenant_id":"8a497c68-a88a-4c1c-be56-12a4883208d3"},{"address":"192.168.0.2","status":"free"}],"links":[{"rel":"pool","href":"/pools/ba58f471-0735-4773-9550-188e2d012941"}]}`,
 	},
 	{
 		"GET",
-		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas",
+		"/pools/ba58f471-0735-4773-9550-188e2d012941/reclaimable?older_than=3600",
 		"",
-		fmt.Sprintf("application/%s", TenantsV1),
+		fmt.Sprintf("application/%s", PoolsV1),
 		http.StatusOK,
-		`{"quotas":[{"name":"test-quota-1","value":"10","usage":"3"},{"name":"test-quota-2","value":"unlimited","usage":"10"},{"name":"test-limit","value":"123"}]}`,
+		`{"pool_id":"ba58f471-0735-4773-9550-188e2d012941","older_than_seconds":3600,"addresses":[{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","external_ip":"192.168.0.1","tenant_id":"8a497c68-a88a-4c1c-be56-12a4883208d3","reserved_since":"2017-06-01T12:00:00Z","unattached_seconds":3660,"labels":{"owner":"ci"}}]}`,
 	},
-}
+	{
+		"GET",
+		"/pools/ba58f471-0735-4773-9550-188e2d012941/reclaimable?older_than=soon",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid filter value"}}
+`,
+	},
+	{
+		"POST",
+		"/pools/ba58f471-0735-4773-9550-188e2d012941/reclaim",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"count":1}`,
+	},
+	{
+		"GET",
+		"/pools/ba58f471-0735-4773-9550-188e2d012941/subnets/ba58f471-0735-4773-9550-188e2d012941/bitmap",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"id":"ba58f471-0735-4773-9550-188e2d012941","subnet":"192.168.0.0/30","allocated":1,"bitmap":"QA==","ranges":[{"first":"192.168.0.1","last":"192.168.0.1"}]}`,
+	},
+	{
+		"GET",
+		"/pools/ba58f471-0735-4773-9550-188e2d012941/fragmentation",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"pool_id":"ba58f471-0735-4773-9550-188e2d012941","free":2,"free_blocks":1,"largest_free_block":2,"largest_free_range":{"first":"192.168.0.2","last":"192.168.0.3"},"fragmentation":0,"subnets":[{"id":"ba58f471-0735-4773-9550-188e2d012941","subnet":"192.168.0.0/29","free":2,"free_blocks":1,"largest_free_block":2,"largest_free_range":{"first":"192.168.0.2","last":"192.168.0.3"}}]}`,
+	},
+	{
+		"GET",
+		"/pools/ba58f471-0735-4773-9550-188e2d012941/subnets/ba58f471-0735-4773-9550-188e2d012941?offset=-1",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid filter value"}}
+`,
+	},
+	{
+		"GET",
+		"/pools/ba58f471-0735-4773-9550-188e2d012941/subnets/ba58f471-0735-4773-9550-188e2d012941?limit=all",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid filter value"}}
+`,
+	},
+	{
+		"PATCH",
+		"/pools/ba58f471-0735-4773-9550-188e2d012941/subnets/ba58f471-0735-4773-9550-188e2d012941",
+		`{"drained":true}`,
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"PATCH",
+		"/pools/ba58f471-0735-4773-9550-188e2d012941/subnets/a6e7f58b-2b8c-4f77-9117-0b6bd4cbe1f2",
+		`{"drained":true}`,
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusForbidden,
+		`{"error":{"code":403,"name":"Forbidden","message":"The Address is not found in this pool"}}
+`,
+	},
+	{
+		"POST",
+		"/pools/ba58f471-0735-4773-9550-188e2d012941",
+		`{"subnet":"192.168.0.0/24"}`,
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"DELETE",
+		"/pools/ba58f471-0735-4773-9550-188e2d012941/subnets/ba58f471-0735-4773-9550-188e2d012941",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"DELETE",
+		"/pools/ba58f471-0735-4773-9550-188e2d012941/external-ips/ba58f471-0735-4773-9550-188e2d012941",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"GET",
+		"/external-ips",
+		"",
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusOK,
+		`[{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","external_ip":"192.168.0.1","internal_ip":"172.16.0.1","instance_id":"","tenant_id":"8a497c68-a88a-4c1c-be56-12a4883208d3","pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"mypool","status":"reserved","index":0,"links":[{"rel":"self","href":"/external-ips/ba58f471-0735-4773-9550-188e2d012941"},{"rel":"pool","href":"/pools/f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e"}]}]`,
+	},
+	{
+		"GET",
+		"/external-ips/preview?pool_name=mypool",
+		"",
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusOK,
+		`{"id":"","address":"192.168.0.2","links":[{"rel":"pool","href":"/pools/f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e"}]}`,
+	},
+	{
+		"POST",
+		"/external-ips",
+		`{"pool_name":"leasedpool"}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Pool leasedpool has no free IPs","details":{"pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"leasedpool","retry_after":70}}}
+`,
+	},
+	{
+		"GET",
+		"/external-ips/preview?pool_name=fullpool",
+		"",
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Pool fullpool has no free IPs","details":{"pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"fullpool"}}}
+`,
+	},
+	{
+		"GET",
+		"/pools/ba58f471-0735-4773-9550-188e2d012941/next-free",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"id":"","address":"192.168.0.2","links":[{"rel":"pool","href":"/pools/f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e"}]}`,
+	},
+	{
+		"GET",
+		"/pools/f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e/next-free",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Pool fullpool has no free IPs","details":{"pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"fullpool"}}}
+`,
+	},
+	{
+		"GET",
+		"/pools/76f4fa99-e533-4cbd-ab36-f6c0f51292ed/next-free",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Pool not found"}}
+`,
+	},
+	{
+		"POST",
+		"/19df9b86-eda3-489d-b75f-d38710e210cb/external-ips",
+		`{"pool_name":"apool","instance_id":"validinstanceID"}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusCreated,
+		`{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","external_ip":"192.168.0.1","internal_ip":"172.16.0.1","instance_id":"validinstanceID","tenant_id":"19df9b86-eda3-489d-b75f-d38710e210cb","pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"mypool","status":"attached","index":0,"links":null}`,
+	},
+	{
+		"POST",
+		"/19df9b86-eda3-489d-b75f-d38710e210cb/external-ips?no_content=true",
+		`{"pool_name":"apool","instance_id":"validinstanceID"}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"POST",
+		"/19df9b86-eda3-489d-b75f-d38710e210cb/external-ips",
+		`{"pool_name":"apool"}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusCreated,
+		`{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","external_ip":"192.168.0.1","internal_ip":"172.16.0.1","instance_id":"","tenant_id":"19df9b86-eda3-489d-b75f-d38710e210cb","pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"mypool","status":"attached","index":0,"links":null}`,
+	},
+	{
+		"POST",
+		"/19df9b86-eda3-489d-b75f-d38710e210cb/external-ips",
+		`{"pool_name":"apool","lease_seconds":600}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusCreated,
+		`{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","external_ip":"192.168.0.1","internal_ip":"172.16.0.1","instance_id":"","tenant_id":"19df9b86-eda3-489d-b75f-d38710e210cb","pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"mypool","status":"attached","index":0,"links":null}`,
+	},
+	{
+		"POST",
+		"/19df9b86-eda3-489d-b75f-d38710e210cb/external-ips",
+		`{"pool_name":"apool","instance_id":"validinstanceID","internal_ip":"172.16.0.1"}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusCreated,
+		`{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","external_ip":"192.168.0.1","internal_ip":"172.16.0.1","instance_id":"validinstanceID","tenant_id":"19df9b86-eda3-489d-b75f-d38710e210cb","pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"mypool","status":"attached","index":0,"links":null}`,
+	},
+	{
+		"POST",
+		"/19df9b86-eda3-489d-b75f-d38710e210cb/external-ips",
+		`{"pool_name":"apool","instance_id":"validinstanceID","internal_ip":"172.16.0.9"}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusUnprocessableEntity,
+		`{"error":{"code":422,"name":"Unprocessable Entity","message":"Internal IP 172.16.0.9 cannot be mapped: the instance's internal IP is 172.16.0.1","details":{"instance_id":"validinstanceID","internal_ip":"172.16.0.9","reason":"the instance's internal IP is 172.16.0.1"}}}
+`,
+	},
+	{
+		"POST",
+		"/19df9b86-eda3-489d-b75f-d38710e210cb/external-ips",
+		`{"pool_name":"apool","instance_id":"validinstanceID","labels":{"ticket":"OPS-42"}}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusCreated,
+		`{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","external_ip":"192.168.0.1","internal_ip":"172.16.0.1","instance_id":"","tenant_id":"19df9b86-eda3-489d-b75f-d38710e210cb","pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"mypool","status":"attached","index":0,"labels":{"ticket":"OPS-42"},"links":null}`,
+	},
+	{
+		"POST",
+		"/19df9b86-eda3-489d-b75f-d38710e210cb/external-ips",
+		fmt.Sprintf(`{"pool_name":"apool","instance_id":"validinstanceID","labels":{"%s":"x"}}`, strings.Repeat("k", types.MaxLabelKeyLength+1)),
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid external IP labels"}}
+`,
+	},
+	{
+		"POST",
+		"/19df9b86-eda3-489d-b75f-d38710e210cb/external-ips",
+		`{"pool_name":"apool","instance_id":"validinstanceID","lease_seconds":600}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusForbidden,
+		`{"error":{"code":403,"name":"Forbidden","message":"Invalid Request"}}
+`,
+	},
+	{
+		"DELETE",
+		"/instances/validinstanceID/external-ips",
+		"",
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusOK,
+		`{"count":2}`,
+	},
+	{
+		"DELETE",
+		"/instances/unmappedinstanceID/external-ips",
+		"",
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusOK,
+		`{"count":0}`,
+	},
+	{
+		"POST",
+		"/tenants/8a497c68-a88a-4c1c-be56-12a4883208d3/external-ips/reserve",
+		`{"pool_name":"mypool","count":2}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusCreated,
+		`{"block_id":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","mappings":[{"mapping_id":"ba58f471-0735-4773-9550-188e2d012940","external_ip":"192.168.0.1","internal_ip":"","instance_id":"","tenant_id":"8a497c68-a88a-4c1c-be56-12a4883208d3","pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"mypool","status":"reserved","index":0,"block_id":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","links":null},{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","external_ip":"192.168.0.2","internal_ip":"","instance_id":"","tenant_id":"8a497c68-a88a-4c1c-be56-12a4883208d3","pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"mypool","status":"reserved","index":0,"block_id":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","links":null}]}`,
+	},
+	{
+		"POST",
+		"/tenants/8a497c68-a88a-4c1c-be56-12a4883208d3/external-ips/reserve",
+		`{"pool_name":"fullpool","count":2}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Pool fullpool has no free IPs","details":{"pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"fullpool"}}}
+`,
+	},
+	{
+		"POST",
+		"/tenants/8a497c68-a88a-4c1c-be56-12a4883208d3/external-ips/reserve",
+		`{"pool_name":"mypool","count":0}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid external IP block size"}}
+`,
+	},
+	{
+		"DELETE",
+		"/tenants/8a497c68-a88a-4c1c-be56-12a4883208d3/external-ips/reserve/76f4fa99-e533-4cbd-ab36-f6c0f51292ed",
+		"",
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusOK,
+		`{"count":2}`,
+	},
+	{
+		"DELETE",
+		"/tenants/8a497c68-a88a-4c1c-be56-12a4883208d3/external-ips/reserve/ba58f471-0735-4773-9550-188e2d012941",
+		"",
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Address Not Found"}}
+`,
+	},
+	{
+		"GET",
+		"/admin/health",
+		"",
+		"application/json",
+		http.StatusOK,
+		`{"status":"ok","checks":[{"name":"datastore","status":"ok","latency_ms":1},{"name":"scheduler","status":"ok","latency_ms":0}]}`,
+	},
+	{
+		"GET",
+		"/reservations",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"reservations":[{"id":"d3a7ed9b-58a2-4b54-ab1c-d4b35a2ff1d1","cidr":"192.168.8.0/24","label":"handover","created":"2017-06-01T00:00:00Z"}]}`,
+	},
+	{
+		"POST",
+		"/reservations",
+		`{"cidr":"192.168.8.0/24","label":"handover"}`,
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusCreated,
+		`{"id":"d3a7ed9b-58a2-4b54-ab1c-d4b35a2ff1d1","cidr":"192.168.8.0/24","label":"handover","created":"2017-06-01T00:00:00Z"}`,
+	},
+	{
+		"POST",
+		"/reservations",
+		`{"cidr":"192.168.0.0/16","label":"other"}`,
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"192.168.0.0/16 overlaps address space reserved for \"handover\"","details":{"address":"192.168.0.0/16","reservation_id":"d3a7ed9b-58a2-4b54-ab1c-d4b35a2ff1d1","label":"handover"}}}
+`,
+	},
+	{
+		"POST",
+		"/reservations",
+		`{"cidr":"192.168.9.0/24"}`,
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Reservation needs a valid CIDR and a label"}}
+`,
+	},
+	{
+		"DELETE",
+		"/reservations/d3a7ed9b-58a2-4b54-ab1c-d4b35a2ff1d1",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"DELETE",
+		"/reservations/nosuchreservation",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Reservation not found"}}
+`,
+	},
+	{
+		"POST",
+		"/external-ips/release",
+		`{"tenant_id":"8a497c68-a88a-4c1c-be56-12a4883208d3","pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e"}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusOK,
+		`{"count":2,"released":[{"mapping_id":"ba58f471-0735-4773-9550-188e2d012940","external_ip":"192.168.0.1","instance_id":"validinstanceID","attached":true},{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","external_ip":"192.168.0.2","attached":false}],"affected_instances":["validinstanceID"]}`,
+	},
+	{
+		"POST",
+		"/8a497c68-a88a-4c1c-be56-12a4883208d3/external-ips/release",
+		`{"pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e"}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusOK,
+		`{"count":2,"released":[{"mapping_id":"ba58f471-0735-4773-9550-188e2d012940","external_ip":"192.168.0.1","instance_id":"validinstanceID","attached":true},{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","external_ip":"192.168.0.2","attached":false}],"affected_instances":["validinstanceID"]}`,
+	},
+	{
+		"POST",
+		"/8a497c68-a88a-4c1c-be56-12a4883208d3/external-ips/release",
+		`{"tenant_id":"3cf5b53d-4a21-4a1b-8c4d-6a7fb3fc0a2e","pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e"}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusForbidden,
+		`{"error":{"code":403,"name":"Forbidden","message":"Access to tenant not permitted"}}
+`,
+	},
+	{
+		"POST",
+		"/external-ips/release",
+		`{"pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e"}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusForbidden,
+		`{"error":{"code":403,"name":"Forbidden","message":"Invalid Request"}}
+`,
+	},
+	{
+		"POST",
+		"/external-ips/release",
+		`{"tenant_id":"8a497c68-a88a-4c1c-be56-12a4883208d3","pool_id":"nopool"}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Pool not found"}}
+`,
+	},
+	{
+		"POST",
+		"/external-ips/claims",
+		`{"tenant_id":"8a497c68-a88a-4c1c-be56-12a4883208d3","pool_name":"mypool","count":1,"ttl_seconds":60}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusCreated,
+		`{"token":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","expires":"2017-06-01T10:01:00Z","mappings":[{"mapping_id":"ba58f471-0735-4773-9550-188e2d012940","external_ip":"192.168.0.1","internal_ip":"","instance_id":"","tenant_id":"8a497c68-a88a-4c1c-be56-12a4883208d3","pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"mypool","status":"reserved","index":0,"block_id":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","links":null}]}`,
+	},
+	{
+		"POST",
+		"/8a497c68-a88a-4c1c-be56-12a4883208d3/external-ips/claims",
+		`{"pool_name":"mypool","count":1}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusCreated,
+		`{"token":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","expires":"2017-06-01T10:05:00Z","mappings":[{"mapping_id":"ba58f471-0735-4773-9550-188e2d012940","external_ip":"192.168.0.1","internal_ip":"","instance_id":"","tenant_id":"8a497c68-a88a-4c1c-be56-12a4883208d3","pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"mypool","status":"reserved","index":0,"block_id":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","links":null}]}`,
+	},
+	{
+		"POST",
+		"/external-ips/claims",
+		`{"pool_name":"mypool","count":1}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusForbidden,
+		`{"error":{"code":403,"name":"Forbidden","message":"Invalid Request"}}
+`,
+	},
+	{
+		"POST",
+		"/external-ips/claims/76f4fa99-e533-4cbd-ab36-f6c0f51292ed/commit",
+		`{"instance_ids":["3390740c-dce9-48d6-b83a-a717417072ce"]}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusOK,
+		`{"token":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","mappings":[{"mapping_id":"ba58f471-0735-4773-9550-188e2d012940","external_ip":"192.168.0.1","internal_ip":"172.16.0.2","instance_id":"3390740c-dce9-48d6-b83a-a717417072ce","tenant_id":"8a497c68-a88a-4c1c-be56-12a4883208d3","pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"mypool","status":"attached","index":0,"block_id":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","links":null}]}`,
+	},
+	{
+		"POST",
+		"/external-ips/claims/ba58f471-0735-4773-9550-188e2d012941/commit",
+		`{"instance_ids":["3390740c-dce9-48d6-b83a-a717417072ce"]}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Address Not Found"}}
+`,
+	},
+	{
+		"DELETE",
+		"/external-ips/claims/76f4fa99-e533-4cbd-ab36-f6c0f51292ed",
+		"",
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusOK,
+		`{"count":2}`,
+	},
+	{
+		"GET",
+		"/external-ips/192.168.0.1/history",
+		"",
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusOK,
+		`{"external_ip":"192.168.0.1","history":[{"time_stamp":"2017-06-01T12:00:00Z","action":"mapped","mapping_id":"ba58f471-0735-4773-9550-188e2d012941","tenant_id":"8a497c68-a88a-4c1c-be56-12a4883208d3","instance_id":"e2d3a5b8-1505-48e6-9c8a-b0a50e4e5cb2","internal_ip":"172.16.0.1"},{"time_stamp":"2017-06-02T12:00:00Z","action":"released","mapping_id":"ba58f471-0735-4773-9550-188e2d012941","tenant_id":"8a497c68-a88a-4c1c-be56-12a4883208d3"}]}`,
+	},
+	{
+		"GET",
+		"/external-ips/not-an-ip/history",
+		"",
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusForbidden,
+		`{"error":{"code":403,"name":"Forbidden","message":"The IP Address is not valid"}}
+`,
+	},
+	{
+		"POST",
+		"/external-ips/swap",
+		`{"mapping_ids":["ba58f471-0735-4773-9550-188e2d012941","76f4fa99-e533-4cbd-ab36-f6c0f51292ed"]}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Address Not Found"}}
+`,
+	},
+	{
+		"POST",
+		"/external-ips/label",
+		`{"filter":{"state":"reserved"},"labels":{"team":"web"}}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusOK,
+		`{"count":1}`,
+	},
+	{
+		"POST",
+		"/external-ips/label",
+		`{"filter":{"state":"leased"},"labels":{"team":"web"}}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid filter value"}}
+`,
+	},
+	{
+		"POST",
+		"/093ae09b-f653-464e-9ae6-5ae28bd03a22/external-ips/label",
+		`{"filter":{"tenant":"3dc0d0ba-2e0d-4a1e-8d8c-3e8a3c2e4d61"},"labels":{"team":"web"}}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusForbidden,
+		`{"error":{"code":403,"name":"Forbidden","message":"Access to tenant not permitted"}}
+`,
+	},
+	{
+		"POST",
+		"/external-ips/swap",
+		`{"mapping_ids":["ba58f471-0735-4773-9550-188e2d012941"]}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusForbidden,
+		`{"error":{"code":403,"name":"Forbidden","message":"Invalid Request"}}
+`,
+	},
+	{
+		"PATCH",
+		"/external-ips/ba58f471-0735-4773-9550-188e2d012941",
+		`{"instance_id":"validinstanceID"}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"PATCH",
+		"/external-ips/ba58f471-0735-4773-9550-188e2d012941",
+		`{"labels":{"service":"web"}}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"PATCH",
+		"/external-ips/ba58f471-0735-4773-9550-188e2d012941",
+		`{"labels":{"":"web"}}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid external IP labels"}}
+`,
+	},
+	{
+		"PATCH",
+		"/external-ips/76f4fa99-e533-4cbd-ab36-f6c0f51292ed",
+		`{"instance_id":"validinstanceID"}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Address Not Found"}}
+`,
+	},
+	{
+		"POST",
+		"/19df9b86-eda3-489d-b75f-d38710e210cb/external-ips",
+		`{"pool_name":"fullpool","instance_id":"validinstanceID"}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Pool fullpool has no free IPs","details":{"pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"fullpool"}}}
+`,
+	},
+	{
+		"POST",
+		"/workloads",
+		`{"id":"","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"this will totally work!","defaults":[]}`,
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusCreated,
+		`{"workload":{"id":"ba58f471-0735-4773-9550-188e2d012941","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"this will totally work!","defaults":[],"storage":null},"link":{"rel":"self","href":"/workloads/ba58f471-0735-4773-9550-188e2d012941"}}`,
+	},
+	{
+		"POST",
+		"/workloads",
+		`{"id":"","description":"testWorkload","fw_type":"efi","vm_type":"docker","image_name":"ubuntu","config":"this will totally work!","defaults":[]}`,
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusUnprocessableEntity,
+		`{"error":{"code":422,"name":"Unprocessable Entity","message":"Firmware type not supported by VM type"}}
+`,
+	},
+	{
+		"POST",
+		"/093ae09b-f653-464e-9ae6-5ae28bd03a22/provision",
+		`{"workload":{"description":"testWorkload","fw_type":"legacy","vm_type":"qemu","config":"this will totally work!","defaults":[]}}`,
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusCreated,
+		`{"workload":{"workload":{"id":"ba58f471-0735-4773-9550-188e2d012941","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"this will totally work!","defaults":[],"storage":null},"link":{"rel":"self","href":"/093ae09b-f653-464e-9ae6-5ae28bd03a22/workloads/ba58f471-0735-4773-9550-188e2d012941"}},"external_ip":{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","external_ip":"192.168.0.1","internal_ip":"172.16.0.1","instance_id":"","tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"mypool","status":"attached","index":0,"links":null}}`,
+	},
+	{
+		"POST",
+		"/093ae09b-f653-464e-9ae6-5ae28bd03a22/provision",
+		`{"workload_id":"ba58f471-0735-4773-9550-188e2d012941"}`,
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Workload not found"}}
+`,
+	},
+	{
+		"POST",
+		"/093ae09b-f653-464e-9ae6-5ae28bd03a22/provision",
+		`{"workload":{"description":"testWorkload","fw_type":"legacy","vm_type":"qemu","config":"this will totally work!","defaults":[]},"pool_name":"fullpool"}`,
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Pool fullpool has no free IPs","details":{"pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"fullpool"}}}
+`,
+	},
+	{
+		"POST",
+		"/093ae09b-f653-464e-9ae6-5ae28bd03a22/provision",
+		`{"pool_name":"mypool"}`,
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusForbidden,
+		`{"error":{"code":403,"name":"Forbidden","message":"Invalid Request"}}
+`,
+	},
+	{
+		"POST",
+		"/workloads?async=true",
+		`{"id":"","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"this will totally work!","defaults":[]}`,
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusAccepted,
+		`{"workload_id":"ba58f471-0735-4773-9550-188e2d012941","status":"pending","link":{"rel":"self","href":"/workloads/ba58f471-0735-4773-9550-188e2d012941/status"}}`,
+	},
+	{
+		"GET",
+		"/workloads/ba58f471-0735-4773-9550-188e2d012941/status",
+		"",
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusOK,
+		`{"workload_id":"ba58f471-0735-4773-9550-188e2d012941","status":"ready","link":{"rel":"self","href":"/workloads/ba58f471-0735-4773-9550-188e2d012941/status"}}`,
+	},
+	{
+		"GET",
+		"/8a497c68-a88a-4c1c-be56-12a4883208d3/workloads/76f4fa99-e533-4cbd-ab36-f6c0f51292ed/status",
+		"",
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusOK,
+		`{"workload_id":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","status":"failed","error":"Tenant not found","link":{"rel":"self","href":"/8a497c68-a88a-4c1c-be56-12a4883208d3/workloads/76f4fa99-e533-4cbd-ab36-f6c0f51292ed/status"}}`,
+	},
+	{
+		"GET",
+		"/workloads/19df9b86-eda3-489d-b75f-d38710e210cb/status",
+		"",
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Workload not found"}}
+`,
+	},
+	{
+		"POST",
+		"/workloads/validate",
+		`{"id":"","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"this will totally work!","defaults":[]}`,
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusOK,
+		`{"errors":[],"warnings":["No vcpus default is set, the launcher's default will be used"]}`,
+	},
+	{
+		"POST",
+		"/19df9b86-eda3-489d-b75f-d38710e210cb/workloads/validate",
+		`{"id":"","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"","defaults":[]}`,
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusUnprocessableEntity,
+		`{"error":{"code":422,"name":"Unprocessable Entity","message":"Invalid workload","details":{"errors":["Invalid Request"],"warnings":[],"fields":[{"field":"config","message":"must not be blank"}]}}}
+`,
+	},
+	{
+		"POST",
+		"/19df9b86-eda3-489d-b75f-d38710e210cb/workloads",
+		`{"id":"","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","config":"x","storage":[{"size":1},{"size":-1}]}`,
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid workload storage","details":{"fields":[{"field":"storage[1].size","message":"must not be negative"}]}}}
+`,
+	},
+	{
+		"POST",
+		"/workloads/import",
+		`{"next_cursor":"","workloads":[{"fw_type":"legacy","vm_type":"qemu"},{"fw_type":"efi","vm_type":"docker"}]}`,
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusMultiStatus,
+		`{"results":[{"index":0,"status":201,"id":"ba58f471-0735-4773-9550-188e2d012941"},{"index":1,"status":422,"error":"Firmware type not supported by VM type"}]}`,
+	},
+	{
+		"POST",
+		"/workloads/import",
+		`{"workloads":[{"fw_type":"legacy","vm_type":"qemu"},{"fw_type":"legacy"`,
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusMultiStatus,
+		`{"results":[{"index":0,"status":201,"id":"ba58f471-0735-4773-9550-188e2d012941"},{"index":1,"status":400,"error":"unexpected EOF"}]}`,
+	},
+	{
+		"POST",
+		"/workloads/import",
+		`[{"fw_type":"legacy","vm_type":"qemu"}]`,
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid workload bundle"}}
+`,
+	},
+	{
+		"DELETE",
+		"/workloads/76f4fa99-e533-4cbd-ab36-f6c0f51292ed",
+		"",
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"POST",
+		"/workloads/ba58f471-0735-4773-9550-188e2d012941/transfer",
+		`{"target_tenant":"19df9b86-eda3-489d-b75f-d38710e210cb"}`,
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"POST",
+		"/workloads/76f4fa99-e533-4cbd-ab36-f6c0f51292ed/transfer",
+		`{"target_tenant":"19df9b86-eda3-489d-b75f-d38710e210cb"}`,
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusForbidden,
+		`{"error":{"code":403,"name":"Forbidden","message":"Public workloads cannot be transferred"}}
+`,
+	},
+	{
+		"POST",
+		"/workloads/ba58f471-0735-4773-9550-188e2d012941/transfer",
+		`{"target_tenant":"8a497c68-a88a-4c1c-be56-12a4883208d4"}`,
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Tenant not found"}}
+`,
+	},
+	{
+		"GET",
+		"/workloads/ba58f471-0735-4773-9550-188e2d012941",
+		"",
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusOK,
+		`{"id":"ba58f471-0735-4773-9550-188e2d012941","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"this will totally work!","defaults":null,"storage":null,"total_storage_mb":0,"config_checksum":"7e665205798c13c453f94e747db80b0402f886afeb21cf5078a2438da99b8215"}`,
+	},
+	{
+		"GET",
+		"/workloads/76f4fa99-e533-4cbd-ab36-f6c0f51292ed",
+		"",
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusOK,
+		`{"id":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"this will totally work!","defaults":null,"storage":[{"id":"","bootable":true,"ephemeral":false,"size":10,"source_type":"image","source_id":"","tag":""},{"id":"","bootable":false,"ephemeral":false,"size":2,"source_type":"empty","source_id":"","tag":""}],"total_storage_mb":12288,"config_checksum":"7e665205798c13c453f94e747db80b0402f886afeb21cf5078a2438da99b8215"}`,
+	},
+	{
+		"GET",
+		"/workloads/diff?a=ba58f471-0735-4773-9550-188e2d012941&b=76f4fa99-e533-4cbd-ab36-f6c0f51292ed",
+		"",
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusOK,
+		`{"a":"ba58f471-0735-4773-9550-188e2d012941","b":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","differences":[{"field":"storage","a":null,"b":[{"bootable":true,"ephemeral":false,"id":"","size":10,"source_id":"","source_type":"image","tag":""},{"bootable":false,"ephemeral":false,"id":"","size":2,"source_id":"","source_type":"empty","tag":""}]}]}`,
+	},
+	{
+		"GET",
+		"/workloads/diff?a=76f4fa99-e533-4cbd-ab36-f6c0f51292ed&b=76f4fa99-e533-4cbd-ab36-f6c0f51292ed",
+		"",
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusOK,
+		`{"a":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","b":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","differences":[]}`,
+	},
+	{
+		"GET",
+		"/workloads/diff?a=ba58f471-0735-4773-9550-188e2d012941&b=c7f4fa99-e533-4cbd-ab36-f6c0f51292ed",
+		"",
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Workload c7f4fa99-e533-4cbd-ab36-f6c0f51292ed given as b not found","details":{"param":"b","workload_id":"c7f4fa99-e533-4cbd-ab36-f6c0f51292ed"}}}
+`,
+	},
+	{
+		"PATCH",
+		"/workloads/ba58f471-0735-4773-9550-188e2d012941",
+		`{"id":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","description":"patchedWorkload","config":null,"defaults":[{"Type":"vcpus","Value":2}]}`,
+		fmt.Sprintf("application/%s", MergePatch),
+		http.StatusOK,
+		`{"id":"ba58f471-0735-4773-9550-188e2d012941","description":"patchedWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"","defaults":[{"Type":"vcpus","Value":2,"ValueString":"","Mandatory":false}],"storage":null}`,
+	},
+	{
+		"PATCH",
+		"/workloads/ba58f471-0735-4773-9550-188e2d012941?return=diff",
+		`{"description":"patchedWorkload","config":null,"defaults":[{"Type":"vcpus","Value":2}]}`,
+		fmt.Sprintf("application/%s", MergePatch),
+		http.StatusOK,
+		`{"config":"","defaults":[{"Mandatory":false,"Type":"vcpus","Value":2,"ValueString":""}],"description":"patchedWorkload"}`,
+	},
+	{
+		"PATCH",
+		"/8a497c68-a88a-4c1c-be56-12a4883208d3/workloads/76f4fa99-e533-4cbd-ab36-f6c0f51292ed",
+		`{"description":"patchedWorkload"}`,
+		fmt.Sprintf("application/%s", MergePatch),
+		http.StatusForbidden,
+		`{"error":{"code":403,"name":"Forbidden","message":"Access to tenant not permitted"}}
+`,
+	},
+	{
+		"GET",
+		"/pools/not-a-uuid",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Malformed UUID for pool","details":{"parameter":"pool","value":"not-a-uuid"}}}
+`,
+	},
+	{
+		"GET",
+		"/not-a-uuid/external-ips",
+		"",
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Malformed UUID for tenant","details":{"parameter":"tenant","value":"not-a-uuid"}}}
+`,
+	},
+	{
+		"DELETE",
+		"/external-ips/12345",
+		"",
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Malformed UUID for mapping_id","details":{"parameter":"mapping_id","value":"12345"}}}
+`,
+	},
+	{
+		"GET",
+		"/workloads",
+		"",
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusOK,
+		`{"workloads":[{"id":"ba58f471-0735-4773-9550-188e2d012941","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"this will totally work!","defaults":null,"storage":null},{"id":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","description":"testEFIWorkload","fw_type":"efi","vm_type":"qemu","image_name":"","config":"this will also work!","defaults":null,"storage":null}]}`,
+	},
+	{
+		"GET",
+		"/workloads?include_instance_count=true",
+		"",
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusOK,
+		`{"workloads":[{"id":"ba58f471-0735-4773-9550-188e2d012941","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"this will totally work!","defaults":null,"storage":null,"instance_count":3},{"id":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","description":"testEFIWorkload","fw_type":"efi","vm_type":"qemu","image_name":"","config":"this will also work!","defaults":null,"storage":null,"instance_count":0}]}`,
+	},
+	{
+		"GET",
+		"/workloads?fw_type=legacy",
+		"",
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusOK,
+		`{"workloads":[{"id":"ba58f471-0735-4773-9550-188e2d012941","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"this will totally work!","defaults":null,"storage":null}]}`,
+	},
+	{
+		"GET",
+		"/workloads?group_by=vm_type",
+		"",
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusOK,
+		`{"qemu":[{"id":"ba58f471-0735-4773-9550-188e2d012941","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"this will totally work!","defaults":null,"storage":null},{"id":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","description":"testEFIWorkload","fw_type":"efi","vm_type":"qemu","image_name":"","config":"this will also work!","defaults":null,"storage":null}]}`,
+	},
+	{
+		"GET",
+		"/workloads?group_by=fw_type&fw_type=efi",
+		"",
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusOK,
+		`{"efi":[{"id":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","description":"testEFIWorkload","fw_type":"efi","vm_type":"qemu","image_name":"","config":"this will also work!","defaults":null,"storage":null}]}`,
+	},
+	{
+		"GET",
+		"/workloads?group_by=image_name",
+		"",
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid filter value"}}
+`,
+	},
+	{
+		"GET",
+		"/workloads?group_by=vm_type&limit=1",
+		"",
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid filter value"}}
+`,
+	},
+	{
+		"GET",
+		"/workloads?cursor=&limit=1",
+		"",
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusOK,
+		`{"workloads":[{"id":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","description":"testEFIWorkload","fw_type":"efi","vm_type":"qemu","image_name":"","config":"this will also work!","defaults":null,"storage":null}],"next_cursor":"djE6NzZmNGZhOTktZTUzMy00Y2JkLWFiMzYtZjZjMGY1MTI5MmVk"}`,
+	},
+	{
+		"GET",
+		"/workloads?cursor=djE6NzZmNGZhOTktZTUzMy00Y2JkLWFiMzYtZjZjMGY1MTI5MmVk&limit=1",
+		"",
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusOK,
+		`{"workloads":[{"id":"ba58f471-0735-4773-9550-188e2d012941","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"this will totally work!","defaults":null,"storage":null}]}`,
+	},
+	{
+		"GET",
+		"/workloads?cursor=&offset=1",
+		"",
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid filter value"}}
+`,
+	},
+	{
+		"GET",
+		"/workloads?fw_type=legacy&count=true",
+		"",
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusOK,
+		`{"count":1}`,
+	},
+	{
+		"GET",
+		"/workloads?fw_type=bios",
+		"",
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid filter value"}}
+`,
+	},
+	{
+		"POST",
+		"/tenants",
+		`{"name":"new-tenant"}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusCreated,
+		`{"id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","name":"new-tenant","enabled":true}`,
+	},
+	{
+		"POST",
+		"/tenants",
+		`{"name":"new-tenant","quotas":[{"name":"tenant-vcpu-quota","value":"10"}]}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusCreated,
+		`{"id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","name":"new-tenant","enabled":true}`,
+	},
+	{
+		"POST",
+		"/tenants",
+		`{"name":"taken"}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Tenant already exists"}}
+`,
+	},
+	{
+		"DELETE",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Tenant still has resources"}}
+`,
+	},
+	{
+		"DELETE",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22?cascade=true",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusMultiStatus,
+		`{"tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","results":[{"type":"external-ip","id":"ba58f471-0735-4773-9550-188e2d012941","status":200},{"type":"workload","id":"ba58f471-0735-4773-9550-188e2d012941","status":403,"error":"Workload definition still in use"}]}`,
+	},
+	{
+		"PATCH",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22",
+		`{"enabled":false}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"PATCH",
+		"/tenants/19df9b86-eda3-489d-b75f-d38710e210cb",
+		`{"enabled":false}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Tenant not found"}}
+`,
+	},
+	{
+		"GET",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas/effective",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"quotas":[{"quota":{"name":"tenant-vcpu-quota","value":"4","usage":"2","unit":"vcpu","usage_percent":50},"source":"override","sub_quotas":{"web":2}},{"quota":{"name":"tenant-mem-quota","value":"unlimited","usage":"512","unit":"mb","usage_percent":null},"source":"default"}]}`,
+	},
+	{
+		"GET",
+		"/quotas/definitions",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"definitions":[{"name":"test-quota-1","unit":"count","kind":"count","description":"Number of tests"}]}`,
+	},
+	{
+		"GET",
+		"/quotas/exceeded",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"tenants":[{"tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","quotas":[{"name":"tenant-vcpu-quota","value":"4","usage":"6","unit":"vcpu","usage_percent":150}]}]}`,
+	},
+	{
+		"GET",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"quotas":[{"name":"test-quota-1","value":"10","usage":"3","unit":"count","usage_percent":30},{"name":"test-quota-2","value":"unlimited","usage":"10","usage_percent":null},{"name":"test-limit","value":"123","unit":"mb"}]}`,
+	},
+	{
+		"GET",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas?summary=true",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"quotas":[{"name":"test-quota-1","value":"10","usage":"3","unit":"count","usage_percent":30},{"name":"test-quota-2","value":"unlimited","usage":"10","usage_percent":null},{"name":"test-limit","value":"123","unit":"mb"}],"summary":{"total":3,"near_limit":0,"unlimited":1}}`,
+	},
+	{
+		"GET",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas?breakdown=true",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"quotas":[{"name":"test-quota-1","value":"10","usage":"3","unit":"count","usage_percent":30},{"name":"test-quota-2","value":"unlimited","usage":"10","usage_percent":null},{"name":"test-limit","value":"123","unit":"mb"}],"breakdown":[{"name":"tenant-vcpu-quota","usage":6,"instances":[{"instance_id":"3390740c-dce9-48d6-b83a-a717417072ce","name":"web","workload_id":"ba58f471-0735-4773-9550-188e2d012941","usage":4},{"instance_id":"b8e7d6a2-58a5-4d76-a1e5-bba7a1c3ebab","workload_id":"ba58f471-0735-4773-9550-188e2d012941","usage":2}],"unattributed":0}]}`,
+	},
+	{
+		"POST",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas/recalculate",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"previous":[{"name":"test-quota-1","value":"10","usage":"3","unit":"count","usage_percent":30},{"name":"test-quota-2","value":"unlimited","usage":"10","usage_percent":null},{"name":"test-limit","value":"123","unit":"mb"}],"quotas":[{"name":"test-quota-1","value":"10","usage":"3","unit":"count","usage_percent":30},{"name":"test-quota-2","value":"unlimited","usage":"10","usage_percent":null},{"name":"test-limit","value":"123","unit":"mb"}]}`,
+	},
+	{
+		"GET",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas/test-limit",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"name":"test-limit","value":"123","unit":"mb"}`,
+	},
+	{
+		"GET",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas/test-unknown-quota",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Quota not found"}}
+`,
+	},
+	{
+		"GET",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas/research",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"quotas":[{"name":"tenant-vcpu-quota","value":"4","usage":"2","unit":"vcpu","usage_percent":50}]}`,
+	},
+	{
+		"PUT",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas/research",
+		`{"quotas":[{"name":"tenant-vcpu-quota","value":"4"}]}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusCreated,
+		`{"quotas":[{"name":"tenant-vcpu-quota","value":"4","usage":"2","unit":"vcpu","usage_percent":50}]}`,
+	},
+	{
+		"PUT",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas",
+		`{"quotas":[{"name":"test-quota-1","value":"5"},{"name":"test-quota-2","value":"unlimited"}]}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusCreated,
+		`{"quotas":[{"name":"test-quota-1","value":"10","usage":"3","unit":"count","usage_percent":30},{"name":"test-quota-2","value":"unlimited","usage":"10","usage_percent":null},{"name":"test-limit","value":"123","unit":"mb"}]}`,
+	},
+	{
+		"PUT",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas",
+		`{"quotas":[{"name":"test-quota-1","value":"2"}]}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Quota test-quota-1 of 2 is below the current usage of 3","details":{"quotas":[{"name":"test-quota-1","value":2,"usage":3}]}}}
+`,
+	},
+	{
+		"PUT",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas",
+		`{"quotas":[{"name":"test-quota-1","value":"2"},{"name":"test-quota-2","value":"4"}]}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"2 quotas are below the current usage","details":{"quotas":[{"name":"test-quota-1","value":2,"usage":3},{"name":"test-quota-2","value":4,"usage":10}]}}}
+`,
+	},
+	{
+		"PUT",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas?allow_overcommit=true",
+		`{"quotas":[{"name":"test-quota-1","value":"2"}]}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusCreated,
+		`{"quotas":[{"name":"test-quota-1","value":"10","usage":"3","unit":"count","usage_percent":30},{"name":"test-quota-2","value":"unlimited","usage":"10","usage_percent":null},{"name":"test-limit","value":"123","unit":"mb"}]}`,
+	},
+	{
+		"POST",
+		"/quotas/bulk",
+		`[{"tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","quotas":[{"name":"test-quota-1","value":"2"}]}]`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusMultiStatus,
+		`{"results":[{"tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","success":false,"status":409,"error":"Quota test-quota-1 of 2 is below the current usage of 3"}]}`,
+	},
+	{
+		"POST",
+		"/quotas/bulk?allow_overcommit=true",
+		`[{"tenant_id":"not-a-uuid","quotas":[]},{"tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","quotas":[{"name":"test-quota-1","value":"2"}]}]`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusMultiStatus,
+		`{"results":[{"tenant_id":"not-a-uuid","success":false,"status":400,"error":"Malformed UUID for tenant_id"},{"tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","success":true,"status":201}]}`,
+	},
+	{
+		"PUT",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas/research",
+		`{"quotas":[{"name":"tenant-vcpu-quota","value":"20"}]}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusConflict,
+		`{"error":{"code":409,"name":"Conflict","message":"Sub-quota tenant-vcpu-quota of 20 exceeds the 6 left in the tenant quota","details":{"name":"tenant-vcpu-quota","value":20,"available":6}}}
+`,
+	},
+	{
+		"GET",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`[{"rel":"quotas","href":"/093ae09b-f653-464e-9ae6-5ae28bd03a22/tenants/quotas","version":"x.ciao.tenants.v1","minimum_version":"x.ciao.tenants.v1"},{"rel":"external-ips","href":"/093ae09b-f653-464e-9ae6-5ae28bd03a22/external-ips","version":"x.ciao.external-ips.v1","minimum_version":"x.ciao.external-ips.v1"},{"rel":"workloads","href":"/093ae09b-f653-464e-9ae6-5ae28bd03a22/workloads","version":"x.ciao.workloads.v1","minimum_version":"x.ciao.workloads.v1"},{"rel":"pools","href":"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/pools","version":"x.ciao.pools.v1","minimum_version":"x.ciao.pools.v1"}]`,
+	},
+	{
+		"GET",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/events",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"events":[{"time_stamp":"2017-06-01T12:00:00Z","tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","operation":"map-external-ip","request_id":"test-request","error":"Pool fullpool has no free IPs"}]}`,
+	},
+	{
+		"GET",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/churn",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","window_seconds":3600,"maps":30,"unmaps":30,"operations_per_minute":1}`,
+	},
+	{
+		"GET",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/churn?window=600",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","window_seconds":600,"maps":30,"unmaps":30,"operations_per_minute":6}`,
+	},
+	{
+		"GET",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/churn?window=172800",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Invalid filter value"}}
+`,
+	},
+	{
+		"GET",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/inventory",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","default_pool":{"pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"mypool"},"workloads":[{"id":"ba58f471-0735-4773-9550-188e2d012941","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"this will totally work!","defaults":null,"storage":null},{"id":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","description":"testEFIWorkload","fw_type":"efi","vm_type":"qemu","image_name":"","config":"this will also work!","defaults":null,"storage":null}],"mappings":[],"reservations":[]}`,
+	},
+	{
+		"GET",
+		"/tenants/19df9b86-eda3-489d-b75f-d38710e210cb/inventory",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Tenant not found"}}
+`,
+	},
+	{
+		"GET",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/default-pool",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"mypool"}`,
+	},
+	{
+		"GET",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/pool-order",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","strategy":"fill-first","pools":[{"rank":1,"pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"mypool","free":2,"reason":"in ID order"}],"excluded":[]}`,
+	},
+	{
+		"PUT",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/default-pool",
+		`{"pool_name":"mypool"}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"mypool"}`,
+	},
+	{
+		"PUT",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/default-pool",
+		`{"pool_name":"privatepool"}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusForbidden,
+		`{"error":{"code":403,"name":"Forbidden","message":"Access to tenant not permitted"}}
+`,
+	},
+	{
+		"PUT",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/default-pool",
+		`{"pool_name":"nopool"}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Pool not found"}}
+`,
+	},
+	{
+		"GET",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/pool-strategy",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","strategy":"fill-first","inherited":false}`,
+	},
+	{
+		"PUT",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/pool-strategy",
+		`{"strategy":"fill-first"}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","strategy":"fill-first","inherited":false}`,
+	},
+	{
+		"PUT",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/pool-strategy",
+		`{"strategy":"random"}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusBadRequest,
+		`{"error":{"code":400,"name":"Bad Request","message":"Unknown pool selection strategy"}}
+`,
+	},
+	{
+		"GET",
+		"/tenants/19df9b86-eda3-489d-b75f-d38710e210cb/default-pool",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Tenant not found"}}
+`,
+	},
+	{
+		"GET",
+		"/tenants/19df9b86-eda3-489d-b75f-d38710e210cb/events",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusNotFound,
+		`{"error":{"code":404,"name":"Not Found","message":"Tenant not found"}}
+`,
+	},
+	{
+		"POST",
+		"/quotas/bulk",
+		`[{"tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","quotas":[{"name":"test-quota-1","value":"10"}]},{"tenant_id":"19df9b86-eda3-489d-b75f-d38710e210cb","quotas":[{"name":"test-quota-1","value":"10"}]},{"tenant_id":"not-a-uuid","quotas":[]}]`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusMultiStatus,
+		`{"results":[{"tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","success":true,"status":201},{"tenant_id":"19df9b86-eda3-489d-b75f-d38710e210cb","success":false,"status":404,"error":"Tenant not found"},{"tenant_id":"not-a-uuid","success":false,"status":400,"error":"Malformed UUID for tenant_id"}]}`,
+	},
+	{
+		"GET",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/pools",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"pools":[{"id":"ba58f471-0735-4773-9550-188e2d012941","name":"testpool","free":0,"total_ips":0,"links":[{"rel":"self","href":"/pools/ba58f471-0735-4773-9550-188e2d012941"}],"subnets":[],"ips":[],"tags":["dmz","partner"],"revision":0}]}`,
+	},
+}
+
+type testCiaoService struct{}
+
+func (ts testCiaoService) ListPools() ([]types.Pool, error) {
+	self := types.Link{
+		Rel:  "self",
+		Href: "/pools/ba58f471-0735-4773-9550-188e2d012941",
+	}
+
+	resp := types.Pool{
+		ID:       "ba58f471-0735-4773-9550-188e2d012941",
+		Name:     "testpool",
+		Free:     0,
+		TotalIPs: 0,
+		Subnets:  []types.ExternalSubnet{},
+		IPs:      []types.ExternalIP{},
+		Links:    []types.Link{self},
+		Tags:     []string{"dmz", "partner"},
+	}
+
+	return []types.Pool{resp}, nil
+}
+
+func (ts testCiaoService) AddPool(name string, subnet *string, ips []string, tags []string, description string, tenantID string) (types.Pool, error) {
+	if len(description) > types.MaxPoolDescriptionLength {
+		return types.Pool{}, types.ErrPoolDescriptionTooLong
+	}
+
+	if name == "TestPool" {
+		return types.Pool{}, types.ErrDuplicatePoolName
+	}
+
+	return types.Pool{}, nil
+}
+
+func (ts testCiaoService) UpdatePoolDescription(id string, description string) error {
+	if len(description) > types.MaxPoolDescriptionLength {
+		return types.ErrPoolDescriptionTooLong
+	}
+
+	return nil
+}
+
+func (ts testCiaoService) UpdatePoolTags(id string, tags []string) error {
+	return nil
+}
+
+func (ts testCiaoService) ExportPools() (types.PoolExport, error) {
+	pools, _ := ts.ListPools()
+
+	export := types.PoolExport{
+		Pools:    pools,
+		Mappings: ts.ListMappedAddresses(nil),
+	}
+
+	return export, nil
+}
+
+func (ts testCiaoService) ImportPools(export types.PoolExport) ([]types.Pool, error) {
+	for _, p := range export.Pools {
+		if p.ID == "ba58f471-0735-4773-9550-188e2d012941" {
+			return nil, types.ErrPoolExists
+		}
+	}
+
+	return export.Pools, nil
+}
+
+func (ts testCiaoService) AddPools(reqs []types.NewPoolRequest) ([]types.Pool, []error) {
+	pools := make([]types.Pool, len(reqs))
+	errs := make([]error, len(reqs))
+
+	for i, req := range reqs {
+		if req.Name == "testpool" {
+			errs[i] = types.ErrDuplicatePoolName
+			continue
+		}
+
+		pools[i] = types.Pool{
+			ID:   "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e",
+			Name: req.Name,
+		}
+	}
+
+	return pools, errs
+}
+
+func (ts testCiaoService) ValidatePools(reqs []types.NewPoolRequest) ([]types.PoolConflict, error) {
+	conflicts := []types.PoolConflict{}
+
+	for i, req := range reqs {
+		if req.Name == "testpool" {
+			conflicts = append(conflicts, types.PoolConflict{
+				Index:    i,
+				Name:     req.Name,
+				Kind:     types.PoolConflictName,
+				PoolID:   "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e",
+				PoolName: "testpool",
+				Message:  types.ErrDuplicatePoolName.Error(),
+			})
+		}
+	}
+
+	return conflicts, nil
+}
+
+func (ts testCiaoService) UpdatePoolIPs(poolID string, add []string, remove []string, force bool) error {
+	for _, address := range remove {
+		if address == "192.168.0.1" && !force {
+			return types.ErrAddressInUse
+		}
+	}
+
+	return nil
+}
+
+func (ts testCiaoService) RenamePool(id string, name string) error {
+	switch name {
+	case "":
+		return types.ErrInvalidPoolName
+	case "takenpool":
+		return types.ErrDuplicatePoolName
+	}
+
+	return nil
+}
+
+func (ts testCiaoService) PoolSelection() string {
+	return types.PoolSelectionRoundRobin
+}
+
+func (ts testCiaoService) PoolCapacity() types.PoolCapacity {
+	return types.PoolCapacity{
+		IPv4: types.AddressCapacity{Free: 250, Total: 254},
+		IPv6: types.AddressCapacity{Free: 1, Total: 2},
+	}
+}
+
+func (ts testCiaoService) MigratePool(fromID string, toID string, dryRun bool) (types.PoolMigration, error) {
+	// migrating to the second pool fails to update the CNCI.
+	cnciFailed := toID == "e2d3a5b8-1505-48e6-9c8a-b0a50e4e5cb2"
+
+	if fromID != "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e" || (toID != "76f4fa99-e533-4cbd-ab36-f6c0f51292ed" && !cnciFailed) {
+		return types.PoolMigration{}, types.ErrPoolNotFound
+	}
+
+	m := types.MigratedMapping{
+		MappingID:     "ba58f471-0735-4773-9550-188e2d012941",
+		TenantID:      "8a497c68-a88a-4c1c-be56-12a4883208d3",
+		InstanceID:    "validinstanceID",
+		ExternalIP:    "192.168.0.1",
+		NewExternalIP: "192.168.1.1",
+		Attached:      true,
+	}
+	if !dryRun {
+		m.NewMappingID = "e2d3a5b8-1505-48e6-9c8a-b0a50e4e5cb2"
+	}
+
+	migration := types.PoolMigration{
+		FromPoolID: fromID,
+		ToPoolID:   toID,
+		DryRun:     dryRun,
+		Attached:   1,
+		Addresses:  map[string]string{m.ExternalIP: m.NewExternalIP},
+	}
+
+	if cnciFailed && !dryRun {
+		m.Error = "CNCI not active"
+		migration.Failed = 1
+	}
+	migration.Mappings = []types.MigratedMapping{m}
+
+	return migration, nil
+}
+
+func (ts testCiaoService) RebalancePools(apply bool) (types.PoolRebalance, error) {
+	rebalance := types.PoolRebalance{
+		Plan: []types.PoolMove{
+			{
+				MappingID:    "ba58f471-0735-4773-9550-188e2d012941",
+				TenantID:     "8a497c68-a88a-4c1c-be56-12a4883208d3",
+				ExternalIP:   "192.168.0.1",
+				FromPoolID:   "ba58f471-0735-4773-9550-188e2d012941",
+				FromPoolName: "testpool",
+				ToPoolID:     "76f4fa99-e533-4cbd-ab36-f6c0f51292ed",
+				ToPoolName:   "otherpool",
+			},
+		},
+	}
+
+	if apply {
+		rebalance.Applied = true
+		rebalance.Moves = append([]types.PoolMove{}, rebalance.Plan...)
+		rebalance.Moves[0].NewExternalIP = "192.168.1.1"
+	}
+
+	return rebalance, nil
+}
+
+func (ts testCiaoService) FindPoolByIP(address string) (types.Pool, error) {
+	if address != "192.168.0.5" {
+		return types.Pool{}, types.ErrPoolNotFound
+	}
+
+	return types.Pool{
+		ID:       "ba58f471-0735-4773-9550-188e2d012941",
+		Name:     "testpool",
+		Free:     253,
+		TotalIPs: 254,
+		Subnets: []types.ExternalSubnet{
+			{ID: "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e", CIDR: "192.168.0.0/24"},
+		},
+		IPs: []types.ExternalIP{},
+	}, nil
+}
+
+func (ts testCiaoService) ShowPool(id string) (types.Pool, error) {
+	fmt.Println("ShowPool")
+	self := types.Link{
+		Rel:  "self",
+		Href: "/pools/ba58f471-0735-4773-9550-188e2d012941",
+	}
+
+	resp := types.Pool{
+		ID:       "ba58f471-0735-4773-9550-188e2d012941",
+		Name:     "testpool",
+		Free:     0,
+		TotalIPs: 0,
+		Subnets:  []types.ExternalSubnet{},
+		IPs:      []types.ExternalIP{},
+		Links:    []types.Link{self},
+		Revision: 3,
+	}
+
+	return resp, nil
+}
+
+func (ts testCiaoService) PoolActivity(id string, limit int) ([]types.LogEntry, error) {
+	activity := []types.LogEntry{
+		{
+			Timestamp: time.Date(2017, 6, 2, 10, 0, 0, 0, time.UTC),
+			TenantID:  "test-tenant-id",
+			EventType: "info",
+			Message:   "Mapped 192.168.0.1 to 172.16.0.2",
+		},
+		{
+			Timestamp: time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC),
+			TenantID:  "test-tenant-id",
+			EventType: "info",
+			Message:   "Unmapped 192.168.0.1 from 172.16.0.3",
+		},
+	}
+
+	if len(activity) > limit {
+		activity = activity[:limit]
+	}
+
+	return activity, nil
+}
+
+func (ts testCiaoService) DeletePool(id string, force bool) error {
+	if id == "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e" && !force {
+		return types.LastPoolInFamilyError{
+			PoolID:   id,
+			PoolName: "mypool",
+			Family:   "IPv4",
+		}
+	}
+
+	if id == "76f4fa99-e533-4cbd-ab36-f6c0f51292ed" && !force {
+		return types.PoolNotEmptyError{
+			PoolID:   id,
+			PoolName: "busypool",
+			Subnets:  1,
+			IPs:      2,
+			Mappings: 3,
+		}
+	}
+
+	return nil
+}
+
+func (ts testCiaoService) AddAddress(poolID string, subnet *string, ips []string) error {
+	return nil
+}
+
+var testAddressReservation = types.AddressReservation{
+	ID:      "d3a7ed9b-58a2-4b54-ab1c-d4b35a2ff1d1",
+	CIDR:    "192.168.8.0/24",
+	Label:   "handover",
+	Created: time.Date(2017, time.June, 1, 0, 0, 0, 0, time.UTC),
+}
+
+func (ts testCiaoService) AddAddressReservation(cidr string, label string) (types.AddressReservation, error) {
+	if cidr == "192.168.0.0/16" {
+		return types.AddressReservation{}, types.AddressReservedError{
+			Address:       cidr,
+			ReservationID: testAddressReservation.ID,
+			Label:         testAddressReservation.Label,
+		}
+	}
+
+	if label == "" {
+		return types.AddressReservation{}, types.ErrInvalidReservation
+	}
+
+	return testAddressReservation, nil
+}
+
+func (ts testCiaoService) ListAddressReservations() []types.AddressReservation {
+	return []types.AddressReservation{testAddressReservation}
+}
+
+func (ts testCiaoService) DeleteAddressReservation(ID string) error {
+	if ID != testAddressReservation.ID {
+		return types.ErrReservationNotFound
+	}
+
+	return nil
+}
+
+func (ts testCiaoService) DrainPool(id string, drained bool) error {
+	return nil
+}
+
+func (ts testCiaoService) SubnetBitmap(poolID string, subnetID string) (types.SubnetBitmap, error) {
+	return types.SubnetBitmap{
+		ID:        subnetID,
+		CIDR:      "192.168.0.0/30",
+		Allocated: 1,
+		Bitmap:    "QA==",
+		Ranges:    []types.AddressRange{{First: "192.168.0.1", Last: "192.168.0.1"}},
+	}, nil
+}
+
+func (ts testCiaoService) PoolFragmentation(poolID string) (types.PoolFragmentation, error) {
+	return types.PoolFragmentation{
+		PoolID:           poolID,
+		Free:             2,
+		FreeBlocks:       1,
+		LargestFreeBlock: 2,
+		LargestFreeRange: &types.AddressRange{First: "192.168.0.2", Last: "192.168.0.3"},
+		Subnets: []types.SubnetFragmentation{
+			{
+				ID:               "ba58f471-0735-4773-9550-188e2d012941",
+				CIDR:             "192.168.0.0/29",
+				Free:             2,
+				FreeBlocks:       1,
+				LargestFreeBlock: 2,
+				LargestFreeRange: &types.AddressRange{First: "192.168.0.2", Last: "192.168.0.3"},
+			},
+		},
+	}, nil
+}
+
+func (ts testCiaoService) ShowSubnet(poolID string, subnetID string, offset int, limit int) (types.SubnetInventory, error) {
+	if offset < 0 || limit < 0 {
+		return types.SubnetInventory{}, types.ErrInvalidFilter
+	}
+
+	return types.SubnetInventory{
+		ID:     subnetID,
+		CIDR:   "192.168.0.0/30",
+		Offset: offset,
+		Addresses: []types.SubnetAddress{
+			{
+				Address:    "192.168.0.1",
+				Status:     types.MappedIPAttached,
+				MappingID:  "ba58f471-0735-4773-9550-188e2d012941",
+				InstanceID: "validinstanceID",
+				TenantID:   "8a497c68-a88a-4c1c-be56-12a4883208d3",
+			},
+			{
+				Address: "192.168.0.2",
+				Status:  types.SubnetAddressFree,
+			},
+		},
+		Links: []types.Link{
+			{
+				Rel:  "pool",
+				Href: fmt.Sprintf("/pools/%s", poolID),
+			},
+		},
+	}, nil
+}
+
+func (ts testCiaoService) DrainSubnet(poolID string, subnetID string, drained bool) error {
+	if subnetID == "a6e7f58b-2b8c-4f77-9117-0b6bd4cbe1f2" {
+		return types.ErrInvalidPoolAddress
+	}
+
+	return nil
+}
+
+func (ts testCiaoService) RemoveAddress(poolID string, subnet *string, extIP *string) error {
+	return nil
+}
+
+func (ts testCiaoService) CountMappedAddresses(filter types.MappedIPFilter) int {
+	count := 0
+	for _, m := range ts.ListMappedAddresses(nil) {
+		if filter.Matches(m) {
+			count++
+		}
+	}
+
+	return count
+}
+
+func (ts testCiaoService) ListMappedAddresses(tenant *string) []types.MappedIP {
+	var ref string
+
+	m := types.MappedIP{
+		ID:         "ba58f471-0735-4773-9550-188e2d012941",
+		ExternalIP: "192.168.0.1",
+		InternalIP: "172.16.0.1",
+		TenantID:   "8a497c68-a88a-4c1c-be56-12a4883208d3",
+		PoolID:     "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e",
+		PoolName:   "mypool",
+		Status:     types.MappedIPReserved,
+	}
+
+	if tenant != nil && *tenant != m.TenantID {
+		return []types.MappedIP{}
+	}
+
+	if tenant != nil {
+		ref = fmt.Sprintf("%s/external-ips/%s", *tenant, m.ID)
+	} else {
+		ref = fmt.Sprintf("/external-ips/%s", m.ID)
+	}
+
+	link := types.Link{
+		Rel:  "self",
+		Href: ref,
+	}
+
+	m.Links = []types.Link{link}
+
+	if tenant == nil {
+		ref := fmt.Sprintf("/pools/%s", m.PoolID)
+
+		link := types.Link{
+			Rel:  "pool",
+			Href: ref,
+		}
+
+		m.Links = append(m.Links, link)
+	}
+
+	return []types.MappedIP{m}
+}
+
+func (ts testCiaoService) WatchMappedAddresses(tenant *string) (<-chan types.MappedIPChange, func()) {
+	changes := make(chan types.MappedIPChange, 1)
+
+	for _, m := range ts.ListMappedAddresses(tenant) {
+		if tenant == nil || m.TenantID == *tenant {
+			changes <- types.MappedIPChange{
+				Type:    types.MappedIPCreated,
+				Mapping: m,
+			}
+		}
+	}
+
+	return changes, func() {}
+}
+
+func (ts testCiaoService) InstanceExists(tenantID string, instanceID string) (bool, error) {
+	return instanceID == "validinstanceID", nil
+}
+
+func (ts testCiaoService) ReleaseInstanceAddresses(instanceID string) (int, error) {
+	if instanceID == "validinstanceID" {
+		return 2, nil
+	}
+
+	return 0, nil
+}
+
+func (ts testCiaoService) ReleaseAddresses(tenantID string, poolID string) ([]types.MappedIP, error) {
+	if poolID != "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e" {
+		return nil, types.ErrPoolNotFound
+	}
+
+	return []types.MappedIP{
+		{
+			ID:         "ba58f471-0735-4773-9550-188e2d012940",
+			ExternalIP: "192.168.0.1",
+			InternalIP: "172.16.0.1",
+			InstanceID: "validinstanceID",
+			TenantID:   tenantID,
+			PoolID:     poolID,
+			PoolName:   "mypool",
+		},
+		{
+			ID:         "ba58f471-0735-4773-9550-188e2d012941",
+			ExternalIP: "192.168.0.2",
+			TenantID:   tenantID,
+			PoolID:     poolID,
+			PoolName:   "mypool",
+		},
+	}, nil
+}
+
+func (ts testCiaoService) ReserveBlock(tenantID string, poolName string, count int) ([]types.MappedIP, error) {
+	if count < 1 {
+		return nil, types.ErrInvalidBlockSize
+	}
+
+	if poolName == "fullpool" {
+		return nil, types.PoolExhaustedError{
+			PoolID:   "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e",
+			PoolName: poolName,
+		}
+	}
+
+	var block []types.MappedIP
+	for i := 0; i < count; i++ {
+		block = append(block, types.MappedIP{
+			ID:         fmt.Sprintf("ba58f471-0735-4773-9550-188e2d01294%d", i),
+			ExternalIP: fmt.Sprintf("192.168.0.%d", i+1),
+			TenantID:   tenantID,
+			PoolID:     "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e",
+			PoolName:   poolName,
+			Status:     types.MappedIPReserved,
+			BlockID:    "76f4fa99-e533-4cbd-ab36-f6c0f51292ed",
+		})
+	}
+
+	return block, nil
+}
+
+func (ts testCiaoService) ReleaseBlock(tenantID string, blockID string) (int, error) {
+	if blockID != "76f4fa99-e533-4cbd-ab36-f6c0f51292ed" {
+		return 0, types.ErrAddressNotFound
+	}
+
+	return 2, nil
+}
+
+func (ts testCiaoService) ClaimAddresses(tenantID string, poolName string, count int, ttl time.Duration) (types.ExternalIPClaim, error) {
+	block, err := ts.ReserveBlock(tenantID, poolName, count)
+	if err != nil {
+		return types.ExternalIPClaim{}, err
+	}
+
+	expires := time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC).Add(ttl)
+
+	return types.ExternalIPClaim{
+		Token:    block[0].BlockID,
+		Expires:  &expires,
+		Mappings: block[:1],
+	}, nil
+}
+
+func (ts testCiaoService) CommitClaim(tenantID string, token string, instanceIDs []string) ([]types.MappedIP, error) {
+	if token != "76f4fa99-e533-4cbd-ab36-f6c0f51292ed" {
+		return nil, types.ErrAddressNotFound
+	}
+
+	if len(instanceIDs) != 1 {
+		return nil, types.ErrBadRequest
+	}
+
+	return []types.MappedIP{
+		{
+			ID:         "ba58f471-0735-4773-9550-188e2d012940",
+			ExternalIP: "192.168.0.1",
+			InternalIP: "172.16.0.2",
+			InstanceID: instanceIDs[0],
+			TenantID:   "8a497c68-a88a-4c1c-be56-12a4883208d3",
+			PoolID:     "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e",
+			PoolName:   "mypool",
+			Status:     types.MappedIPAttached,
+			BlockID:    token,
+		},
+	}, nil
+}
+
+func (ts testCiaoService) MapAddress(tenantID string, name *string, instanceID string, internalIP string, role string, lease time.Duration) (types.MappedIP, error) {
+	if name != nil && *name == "fullpool" {
+		return types.MappedIP{}, types.PoolExhaustedError{
+			PoolID:   "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e",
+			PoolName: *name,
+		}
+	}
+
+	if name != nil && *name == "leasedpool" {
+		return types.MappedIP{}, types.PoolExhaustedError{
+			PoolID:     "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e",
+			PoolName:   *name,
+			RetryAfter: 70,
+		}
+	}
+
+	if internalIP != "" && internalIP != "172.16.0.1" {
+		return types.MappedIP{}, types.InternalIPMismatchError{
+			InstanceID: instanceID,
+			InternalIP: internalIP,
+			Reason:     "the instance's internal IP is 172.16.0.1",
+		}
+	}
+
+	m := types.MappedIP{
+		ID:         "ba58f471-0735-4773-9550-188e2d012941",
+		ExternalIP: "192.168.0.1",
+		InternalIP: "172.16.0.1",
+		InstanceID: instanceID,
+		TenantID:   tenantID,
+		PoolID:     "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e",
+		PoolName:   "mypool",
+		Status:     types.MappedIPAttached,
+	}
+
+	return m, nil
+}
+
+func (ts testCiaoService) PreviewAllocation(tenantID string, poolName string) (types.ExternalIP, error) {
+	if poolName == "fullpool" {
+		return types.ExternalIP{}, types.PoolExhaustedError{
+			PoolID:   "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e",
+			PoolName: poolName,
+		}
+	}
+
+	return types.ExternalIP{
+		Address: "192.168.0.2",
+		Links: []types.Link{
+			{Rel: "pool", Href: "/pools/f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e"},
+		},
+	}, nil
+}
+
+func (ts testCiaoService) NextFreeAddress(poolID string) (types.ExternalIP, error) {
+	switch poolID {
+	case "ba58f471-0735-4773-9550-188e2d012941":
+		return ts.PreviewAllocation("", "testpool")
+	case "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e":
+		return ts.PreviewAllocation("", "fullpool")
+	}
+
+	return types.ExternalIP{}, types.ErrPoolNotFound
+}
+
+func (ts testCiaoService) RemapAddress(tenantID string, address string, instanceID string) error {
+	return nil
+}
+
+func (ts testCiaoService) ReclaimableAddresses(poolID string, olderThan time.Duration) ([]types.ReclaimableAddress, error) {
+	if poolID != "ba58f471-0735-4773-9550-188e2d012941" {
+		return nil, types.ErrPoolNotFound
+	}
+
+	return []types.ReclaimableAddress{
+		{
+			MappingID:         "ba58f471-0735-4773-9550-188e2d012941",
+			ExternalIP:        "192.168.0.1",
+			TenantID:          "8a497c68-a88a-4c1c-be56-12a4883208d3",
+			ReservedSince:     time.Date(2017, time.June, 1, 12, 0, 0, 0, time.UTC),
+			UnattachedSeconds: int64(olderThan/time.Second) + 60,
+			Labels:            map[string]string{"owner": "ci"},
+		},
+	}, nil
+}
+
+func (ts testCiaoService) ReclaimAddresses(poolID string, olderThan time.Duration) (int, error) {
+	if poolID != "ba58f471-0735-4773-9550-188e2d012941" {
+		return 0, types.ErrPoolNotFound
+	}
+
+	return 1, nil
+}
+
+func (ts testCiaoService) SwapAddresses(a string, b string) error {
+	if a == b {
+		return types.ErrBadRequest
+	}
+
+	return nil
+}
+
+func (ts testCiaoService) SetMappingLabels(tenantID string, address string, labels map[string]string) (types.MappedIP, error) {
+	m, err := ts.MapAddress(tenantID, nil, "", "", "", 0)
+	m.Labels = labels
+	return m, err
+}
+
+func (ts testCiaoService) LabelMappings(filter types.MappedIPFilter, labels map[string]string) (int, error) {
+	if len(labels) == 0 {
+		return 0, types.ErrInvalidLabels
+	}
+
+	count := 0
+	for _, m := range ts.ListMappedAddresses(nil) {
+		if filter.Matches(m) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (ts testCiaoService) UnMapAddress(string) error {
+	return nil
+}
+
+func (ts testCiaoService) AddressHistory(address string) ([]types.AssignmentRecord, error) {
+	if address != "192.168.0.1" {
+		return nil, types.ErrInvalidIP
+	}
+
+	return []types.AssignmentRecord{
+		{
+			Timestamp:  time.Date(2017, time.June, 1, 12, 0, 0, 0, time.UTC),
+			Action:     types.AssignmentMapped,
+			MappingID:  "ba58f471-0735-4773-9550-188e2d012941",
+			TenantID:   "8a497c68-a88a-4c1c-be56-12a4883208d3",
+			InstanceID: "e2d3a5b8-1505-48e6-9c8a-b0a50e4e5cb2",
+			InternalIP: "172.16.0.1",
+		},
+		{
+			Timestamp: time.Date(2017, time.June, 2, 12, 0, 0, 0, time.UTC),
+			Action:    types.AssignmentReleased,
+			MappingID: "ba58f471-0735-4773-9550-188e2d012941",
+			TenantID:  "8a497c68-a88a-4c1c-be56-12a4883208d3",
+		},
+	}, nil
+}
+
+func (ts testCiaoService) CreateWorkload(req types.Workload) (types.Workload, error) {
+	if !payloads.CompatibleFirmware(req.VMType, payloads.Firmware(req.FWType)) {
+		return req, types.ErrIncompatibleFirmware
+	}
+
+	for _, s := range req.Storage {
+		if s.Size < 0 {
+			return req, types.ErrInvalidStorage
+		}
+	}
+
+	req.ID = "ba58f471-0735-4773-9550-188e2d012941"
+	return req, nil
+}
+
+func (ts testCiaoService) CreateWorkloadAsync(req types.Workload) (types.WorkloadOperation, error) {
+	return types.WorkloadOperation{
+		WorkloadID: "ba58f471-0735-4773-9550-188e2d012941",
+		Status:     types.WorkloadPending,
+	}, nil
+}
+
+func (ts testCiaoService) Provision(tenantID string, req *types.Workload, workloadID string, poolName *string) (types.Workload, types.MappedIP, error) {
+	if tenantID == "" || (req == nil) == (workloadID == "") {
+		return types.Workload{}, types.MappedIP{}, types.ErrBadRequest
+	}
+
+	var wl types.Workload
+	var err error
+
+	if req != nil {
+		wl, err = ts.CreateWorkload(*req)
+	} else {
+		wl, err = ts.ShowWorkload(tenantID, workloadID)
+	}
+	if err != nil {
+		return types.Workload{}, types.MappedIP{}, err
+	}
+
+	m, err := ts.MapAddress(tenantID, poolName, "", "", "", 0)
+	if err != nil {
+		return types.Workload{}, types.MappedIP{}, err
+	}
+
+	return wl, m, nil
+}
+
+func (ts testCiaoService) WorkloadStatus(tenantID string, workloadID string) (types.WorkloadOperation, error) {
+	switch workloadID {
+	case "ba58f471-0735-4773-9550-188e2d012941":
+		return types.WorkloadOperation{
+			WorkloadID: workloadID,
+			Status:     types.WorkloadReady,
+		}, nil
+	case "76f4fa99-e533-4cbd-ab36-f6c0f51292ed":
+		return types.WorkloadOperation{
+			WorkloadID: workloadID,
+			Status:     types.WorkloadFailed,
+			Error:      types.ErrTenantNotFound.Error(),
+		}, nil
+	}
+
+	return types.WorkloadOperation{}, types.ErrWorkloadNotFound
+}
+
+func (ts testCiaoService) ValidateWorkload(req types.Workload) types.WorkloadValidation {
+	v := types.WorkloadValidation{
+		Errors:   []string{},
+		Warnings: []string{},
+	}
+
+	if req.Config == "" {
+		v.Errors = append(v.Errors, types.ErrBadRequest.Error())
+		v.Fields = []types.FieldError{{Field: "config", Message: "must not be blank"}}
+	} else if len(req.Storage) > 1 && req.Storage[1].Size < 0 {
+		v.Errors = append(v.Errors, types.ErrInvalidStorage.Error())
+		v.Fields = []types.FieldError{{Field: "storage[1].size", Message: "must not be negative"}}
+	} else if len(req.Defaults) == 0 {
+		v.Warnings = append(v.Warnings, "No vcpus default is set, the launcher's default will be used")
+	}
+
+	return v
+}
+
+func (ts testCiaoService) DeleteWorkload(tenant string, workload string) error {
+	return nil
+}
+
+func (ts testCiaoService) TransferWorkload(workloadID string, targetTenantID string) error {
+	wl, err := ts.ShowWorkload("", workloadID)
+	if err != nil {
+		return err
+	}
+
+	if wl.TenantID == "public" {
+		return types.ErrWorkloadPublic
+	}
+
+	if targetTenantID != "19df9b86-eda3-489d-b75f-d38710e210cb" {
+		return types.ErrTenantNotFound
+	}
+
+	return nil
+}
+
+func (ts testCiaoService) ShowWorkload(tenant string, ID string) (types.Workload, error) {
+	// one private workload and one public one.
+	owners := map[string]string{
+		"ba58f471-0735-4773-9550-188e2d012941": "8a497c68-a88a-4c1c-be56-12a4883208d3",
+		"76f4fa99-e533-4cbd-ab36-f6c0f51292ed": "public",
+	}
+
+	owner, ok := owners[ID]
+	if !ok || (tenant != "" && owner != tenant && owner != "public") {
+		return types.Workload{}, types.ErrWorkloadNotFound
+	}
+
+	wl := types.Workload{
+		ID:          ID,
+		TenantID:    owner,
+		Description: "testWorkload",
+		FWType:      payloads.Legacy,
+		VMType:      payloads.QEMU,
+		Config:      "this will totally work!",
+	}
+
+	if owner == "public" {
+		wl.Storage = []types.StorageResource{
+			{Bootable: true, Size: 10, SourceType: types.ImageService},
+			{Size: 2, SourceType: types.Empty},
+		}
+	}
+
+	return wl, nil
+}
+
+func (ts testCiaoService) UpdateWorkload(req types.Workload) (types.Workload, error) {
+	return req, nil
+}
+
+func (ts testCiaoService) ListWorkloads(tenant string) ([]types.Workload, error) {
+	return []types.Workload{
+		{
+			ID:          "ba58f471-0735-4773-9550-188e2d012941",
+			TenantID:    tenant,
+			Description: "testWorkload",
+			FWType:      payloads.Legacy,
+			VMType:      payloads.QEMU,
+			Config:      "this will totally work!",
+		},
+		{
+			ID:          "76f4fa99-e533-4cbd-ab36-f6c0f51292ed",
+			TenantID:    tenant,
+			Description: "testEFIWorkload",
+			FWType:      string(payloads.EFI),
+			VMType:      payloads.QEMU,
+			Config:      "this will also work!",
+		},
+	}, nil
+}
+
+func (ts testCiaoService) CountWorkloads(tenant string, fwType string) (int, error) {
+	wls, _ := ts.ListWorkloads(tenant)
+
+	count := 0
+	for _, wl := range wls {
+		if fwType == "" || wl.FWType == fwType {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (ts testCiaoService) WorkloadInstanceCounts(tenantID string) map[string]int {
+	counts := map[string]int{"ba58f471-0735-4773-9550-188e2d012941": 3}
+	if tenantID != "" {
+		counts["ba58f471-0735-4773-9550-188e2d012941"] = 1
+	}
+
+	return counts
+}
+
+func (ts testCiaoService) ListQuotaDefinitions() []types.QuotaDefinition {
+	return []types.QuotaDefinition{
+		{Name: "test-quota-1", Unit: types.QuotaUnitCount, Kind: types.QuotaKindCount, Description: "Number of tests"},
+	}
+}
+
+func (ts testCiaoService) ListQuotas(tenantID string) []types.QuotaDetails {
+	return []types.QuotaDetails{
+		{Name: "test-quota-1", Value: 10, Usage: 3, Unit: types.QuotaUnitCount},
+		{Name: "test-quota-2", Value: -1, Usage: 10},
+		{Name: "test-limit", Value: 123, Usage: 0, Unit: types.QuotaUnitMB},
+	}
+}
+
+func (ts testCiaoService) QuotaBreakdown(tenantID string) ([]types.QuotaBreakdown, error) {
+	return []types.QuotaBreakdown{
+		{
+			Name:  "tenant-vcpu-quota",
+			Usage: 6,
+			Instances: []types.InstanceUsage{
+				{
+					InstanceID: "3390740c-dce9-48d6-b83a-a717417072ce",
+					Name:       "web",
+					WorkloadID: "ba58f471-0735-4773-9550-188e2d012941",
+					Usage:      4,
+				},
+				{
+					InstanceID: "b8e7d6a2-58a5-4d76-a1e5-bba7a1c3ebab",
+					WorkloadID: "ba58f471-0735-4773-9550-188e2d012941",
+					Usage:      2,
+				},
+			},
+		},
+	}, nil
+}
+
+func (ts testCiaoService) ExceededQuotas() ([]types.TenantExceededQuotas, error) {
+	return []types.TenantExceededQuotas{
+		{
+			TenantID: "093ae09b-f653-464e-9ae6-5ae28bd03a22",
+			Quotas: []types.QuotaDetails{
+				{Name: "tenant-vcpu-quota", Value: 4, Usage: 6, Unit: types.QuotaUnitVCPU},
+			},
+		},
+	}, nil
+}
+
+func (ts testCiaoService) QuotaSnapshot(tenantID string) (types.QuotaSnapshot, error) {
+	if tenantID != "093ae09b-f653-464e-9ae6-5ae28bd03a22" {
+		return types.QuotaSnapshot{}, types.ErrTenantNotFound
+	}
+
+	return types.QuotaSnapshot{
+		TenantID: tenantID,
+		Quotas:   []types.QuotaDetails{{Name: "tenant-vcpu-quota", Value: 8}},
+		SubQuotas: map[string][]types.QuotaDetails{
+			"research": {{Name: "tenant-vcpu-quota", Value: 4}},
+		},
+	}, nil
+}
+
+func (ts testCiaoService) RestoreQuotas(tenantID string, snapshot types.QuotaSnapshot) ([]types.SkippedQuota, error) {
+	skipped := []types.SkippedQuota{}
+
+	for _, qd := range snapshot.Quotas {
+		if qd.Name == "tenant-retired-quota" {
+			skipped = append(skipped, types.SkippedQuota{Name: qd.Name, Reason: "unknown quota"})
+		}
+	}
+
+	return skipped, nil
+}
+
+func (ts testCiaoService) EffectiveQuotas(tenantID string) ([]types.EffectiveQuota, error) {
+	return []types.EffectiveQuota{
+		{
+			Quota:     types.QuotaDetails{Name: "tenant-vcpu-quota", Value: 4, Usage: 2, Unit: types.QuotaUnitVCPU},
+			Source:    types.QuotaSourceOverride,
+			SubQuotas: map[string]int{"web": 2},
+		},
+		{
+			Quota:  types.QuotaDetails{Name: "tenant-mem-quota", Value: -1, Usage: 512, Unit: types.QuotaUnitMB},
+			Source: types.QuotaSourceDefault,
+		},
+	}, nil
+}
+
+func (ts testCiaoService) RecalculateUsage(tenantID string) error {
+	return nil
+}
+
+func (ts testCiaoService) Health() (types.HealthReport, error) {
+	return types.HealthReport{
+		Status: types.HealthOK,
+		Checks: []types.HealthCheck{
+			{Name: "datastore", Status: types.HealthOK, LatencyMS: 1},
+			{Name: "scheduler", Status: types.HealthOK},
+		},
+	}, nil
+}
+
+func (ts testCiaoService) ListSubQuotas(tenantID string, sub string) []types.QuotaDetails {
+	return []types.QuotaDetails{
+		{Name: "tenant-vcpu-quota", Value: 4, Usage: 2, Unit: types.QuotaUnitVCPU},
+	}
+}
+
+func (ts testCiaoService) UpdateSubQuotas(tenantID string, sub string, qds []types.QuotaDetails) error {
+	for _, qd := range qds {
+		if qd.Value > 6 {
+			return types.SubQuotaExceedsParentError{
+				Name:      qd.Name,
+				Value:     qd.Value,
+				Available: 6,
+			}
+		}
+	}
+
+	return nil
+}
+
+func (ts testCiaoService) RecordTenantEvent(event types.Event) {
+}
+
+func (ts testCiaoService) TenantDefaultPool(tenantID string) (types.DefaultPool, error) {
+	if tenantID != "093ae09b-f653-464e-9ae6-5ae28bd03a22" {
+		return types.DefaultPool{}, types.ErrTenantNotFound
+	}
+
+	return types.DefaultPool{
+		PoolID:   "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e",
+		PoolName: "mypool",
+	}, nil
+}
+
+func (ts testCiaoService) PoolOrder(tenantID string) (types.PoolOrder, error) {
+	if tenantID != "093ae09b-f653-464e-9ae6-5ae28bd03a22" {
+		return types.PoolOrder{}, types.ErrTenantNotFound
+	}
+
+	return types.PoolOrder{
+		TenantID: tenantID,
+		Strategy: types.PoolSelectionFillFirst,
+		Pools: []types.PoolOrderEntry{{
+			Rank:     1,
+			PoolID:   "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e",
+			PoolName: "mypool",
+			Free:     2,
+			Reason:   "in ID order",
+		}},
+		Excluded: []types.PoolOrderEntry{},
+	}, nil
+}
+
+func (ts testCiaoService) SetTenantDefaultPool(tenantID string, poolName string) error {
+	switch poolName {
+	case "", "mypool":
+		return nil
+	case "privatepool":
+		return types.ErrForbidden
+	}
+
+	return types.ErrPoolNotFound
+}
+
+func (ts testCiaoService) TenantPoolStrategy(tenantID string) (types.TenantPoolStrategy, error) {
+	if tenantID != "093ae09b-f653-464e-9ae6-5ae28bd03a22" {
+		return types.TenantPoolStrategy{}, types.ErrTenantNotFound
+	}
+
+	return types.TenantPoolStrategy{
+		TenantID: tenantID,
+		Strategy: types.PoolSelectionFillFirst,
+	}, nil
+}
+
+func (ts testCiaoService) SetTenantPoolStrategy(tenantID string, strategy string) error {
+	if strategy != "" && !types.ValidPoolSelection(strategy) {
+		return types.ErrInvalidPoolSelection
+	}
+
+	return nil
+}
+
+func (ts testCiaoService) TenantEvents(tenantID string) ([]types.Event, error) {
+	if tenantID != "093ae09b-f653-464e-9ae6-5ae28bd03a22" {
+		return nil, types.ErrTenantNotFound
+	}
+
+	event := types.Event{
+		Timestamp: time.Date(2017, time.June, 1, 12, 0, 0, 0, time.UTC),
+		TenantID:  tenantID,
+		Operation: types.EventMapExternalIP,
+		RequestID: "test-request",
+		Error:     "Pool fullpool has no free IPs",
+	}
+
+	return []types.Event{event}, nil
+}
+
+func (ts testCiaoService) WatchTenantEvents(tenantID string) (<-chan types.Event, func(), error) {
+	if tenantID != "093ae09b-f653-464e-9ae6-5ae28bd03a22" {
+		return nil, nil, types.ErrTenantNotFound
+	}
+
+	events := make(chan types.Event, 2)
+	events <- types.Event{
+		Timestamp: time.Date(2017, time.June, 1, 12, 0, 0, 0, time.UTC),
+		TenantID:  tenantID,
+		Operation: types.EventMapExternalIP,
+	}
+	events <- types.Event{
+		Timestamp: time.Date(2017, time.June, 1, 12, 0, 1, 0, time.UTC),
+		TenantID:  tenantID,
+		Operation: types.EventExternalIPChange,
+		Change: &types.MappedIPChange{
+			Type: types.MappedIPDeleted,
+			Mapping: types.MappedIP{
+				ID:         "ba58f471-0735-4773-9550-188e2d012941",
+				ExternalIP: "192.168.0.1",
+				TenantID:   tenantID,
+			},
+		},
+	}
+	close(events)
+
+	return events, func() {}, nil
+}
+
+func (ts testCiaoService) TenantChurn(tenantID string, window time.Duration) (types.TenantChurn, error) {
+	if tenantID != "093ae09b-f653-464e-9ae6-5ae28bd03a22" {
+		return types.TenantChurn{}, types.ErrTenantNotFound
+	}
+
+	return types.TenantChurn{
+		TenantID:      tenantID,
+		WindowSeconds: int64(window / time.Second),
+		Maps:          30,
+		Unmaps:        30,
+		PerMinute:     60 / window.Minutes(),
+	}, nil
+}
+
+func (ts testCiaoService) CreateTenant(t types.Tenant) (types.Tenant, error) {
+	if t.Name == "taken" {
+		return types.Tenant{}, types.ErrTenantExists
+	}
+
+	t.ID = "093ae09b-f653-464e-9ae6-5ae28bd03a22"
+	t.Enabled = true
+	return t, nil
+}
+
+func (ts testCiaoService) SetTenantEnabled(tenantID string, enabled bool) error {
+	if tenantID == "19df9b86-eda3-489d-b75f-d38710e210cb" {
+		return types.ErrTenantNotFound
+	}
+
+	return nil
+}
+
+func (ts testCiaoService) DeleteTenantResources(tenantID string, cascade bool) ([]types.TenantResourceResult, []error, error) {
+	if tenantID == "19df9b86-eda3-489d-b75f-d38710e210cb" {
+		return nil, nil, types.ErrTenantNotFound
+	}
+
+	if !cascade {
+		return nil, nil, types.ErrTenantHasResources
+	}
+
+	results := []types.TenantResourceResult{
+		{Type: types.TenantResourceExternalIP, ID: "ba58f471-0735-4773-9550-188e2d012941"},
+		{Type: types.TenantResourceWorkload, ID: "ba58f471-0735-4773-9550-188e2d012941"},
+	}
+
+	return results, []error{nil, types.ErrWorkloadInUse}, nil
+}
+
+func (ts testCiaoService) UpdateQuotas(tenantID string, qds []types.QuotaDetails) error {
+	if tenantID == "19df9b86-eda3-489d-b75f-d38710e210cb" {
+		return types.ErrTenantNotFound
+	}
+
+	return nil
+}
+
+func TestResponse(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	for i, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.request, bytes.NewBuffer([]byte(tt.requestBody)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+
+		rr := httptest.NewRecorder()
+		req.Header.Set("Content-Type", tt.media)
+
+		mux.ServeHTTP(rr, req)
+
+		status := rr.Code
+		if status != tt.expectedStatus {
+			t.Errorf("test %d: got %v, expected %v", i, status, tt.expectedStatus)
+		}
+
+		if rr.Body.String() != tt.expectedResponse {
+			t.Errorf("test %d: %s: failed\ngot: %v\nexp: %v", i, tt.request, rr.Body.String(), tt.expectedResponse)
+		}
+	}
+}
+
+func TestScopes(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	pools := []string{service.ScopePoolsWrite}
+
+	tests := []struct {
+		scopes []string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{pools, "GET", "/pools", "", http.StatusOK},
+		{pools, "GET", "/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas", "", http.StatusOK},
+		{pools, "DELETE", "/pools/ba58f471-0735-4773-9550-188e2d012941", "", http.StatusNoContent},
+		{pools, "PUT", "/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas", `{"quotas":[]}`, http.StatusForbidden},
+		{pools, "POST", "/19df9b86-eda3-489d-b75f-d38710e210cb/external-ips", `{"pool_name":"apool"}`, http.StatusForbidden},
+		{service.Scopes, "PUT", "/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas/research", `{"quotas":[{"name":"tenant-vcpu-quota","value":"4"}]}`, http.StatusCreated},
+		{nil, "GET", "/pools", "", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetScopes(req.Context(), tt.scopes...))
+		req.Header.Set("Content-Type", "application/json")
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.status {
+			t.Errorf("%s %s with scopes %v: got %v, expected %v", tt.method, tt.path, tt.scopes, rr.Code, tt.status)
+		}
+	}
+
+	// callers which are not privileged are unaffected by scopes.
+	req, err := http.NewRequest("POST", "/19df9b86-eda3-489d-b75f-d38710e210cb/external-ips", strings.NewReader(`{"pool_name":"apool"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req = req.WithContext(service.SetPrivilege(req.Context(), false))
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Errorf("tenant mapping: got %v, expected %v", rr.Code, http.StatusCreated)
+	}
+}
+
+// blockingExportCiaoService holds each pool export until released.
+type blockingExportCiaoService struct {
+	testCiaoService
+	started chan struct{}
+	release chan struct{}
+}
+
+func (ts blockingExportCiaoService) ExportPools() (types.PoolExport, error) {
+	ts.started <- struct{}{}
+	<-ts.release
+	return ts.testCiaoService.ExportPools()
+}
+
+func TestConcurrencyLimits(t *testing.T) {
+	ts := blockingExportCiaoService{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+
+	mux := Routes(Config{URL: "", CiaoService: ts, ConcurrencyLimits: map[string]int{"/pools/export": 1}}, nil)
+
+	export := func() *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/pools/export", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", PoolsV1))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	done := make(chan int)
+	go func() {
+		done <- export().Code
+	}()
+	<-ts.started
+
+	rr := export()
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %v, expected %v", rr.Code, http.StatusServiceUnavailable)
+	}
+
+	if retry := rr.Header().Get("Retry-After"); retry != fmt.Sprint(ConcurrencyRetryAfter) {
+		t.Errorf("got Retry-After %q, expected %d", retry, ConcurrencyRetryAfter)
+	}
+
+	close(ts.release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("got %v, expected %v", code, http.StatusOK)
+	}
+
+	// the limit is freed once the first export finishes.
+	go func() { <-ts.started }()
+
+	rr = export()
+	if rr.Code != http.StatusOK {
+		t.Errorf("got %v, expected %v once the export finished", rr.Code, http.StatusOK)
+	}
+}
+
+func TestConditionalGet(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	for _, request := range []string{"/pools", "/external-ips"} {
+		req, err := http.NewRequest("GET", request, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", "application/json")
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: got %v, expected %v", request, rr.Code, http.StatusOK)
+		}
+
+		etag := rr.Header().Get("ETag")
+		if etag == "" {
+			t.Fatalf("%s: no ETag returned", request)
+		}
+
+		req.Header.Set("If-None-Match", etag)
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusNotModified {
+			t.Errorf("%s: got %v, expected %v", request, rr.Code, http.StatusNotModified)
+		}
+
+		if rr.Body.Len() != 0 {
+			t.Errorf("%s: unexpected body in 304 response: %s", request, rr.Body.String())
+		}
+
+		req.Header.Set("If-None-Match", `W/"stale"`)
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: stale etag: got %v, expected %v", request, rr.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestCreatePoolIfAbsent(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	req, err := http.NewRequest("POST", "/pools", bytes.NewBufferString(`{"name":"TestPool"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req = req.WithContext(service.SetPrivilege(req.Context(), true))
+	req.Header.Set("Content-Type", fmt.Sprintf("application/%s", PoolsV1))
+	req.Header.Set("If-None-Match", "*")
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got %v, expected %v", rr.Code, http.StatusOK)
+	}
+
+	var pool types.Pool
+	err = json.Unmarshal(rr.Body.Bytes(), &pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pool.ID != "ba58f471-0735-4773-9550-188e2d012941" {
+		t.Errorf("expected the existing pool, got %+v", pool)
+	}
+
+	if etag := rr.Header().Get("ETag"); etag != `"3"` {
+		t.Errorf("got ETag %q, expected %q", etag, `"3"`)
+	}
+}
+
+func TestListMappedIPsTenantFilter(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	tests := []struct {
+		privileged     bool
+		request        string
+		expectedStatus int
+		expectedIDs    int
+	}{
+		{true, "/external-ips", http.StatusOK, 1},
+		{true, "/external-ips?tenant_id=8a497c68-a88a-4c1c-be56-12a4883208d3", http.StatusOK, 1},
+		{true, "/external-ips?tenant_id=19df9b86-eda3-489d-b75f-d38710e210cb", http.StatusOK, 0},
+		{true, "/external-ips?state=reserved", http.StatusOK, 1},
+		{true, "/external-ips?state=attached", http.StatusOK, 0},
+		{true, "/external-ips?state=stale", http.StatusBadRequest, 0},
+		{true, "/external-ips?state=reserved&pool_id=f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e", http.StatusOK, 1},
+		{true, "/external-ips?state=reserved&pool_id=19df9b86-eda3-489d-b75f-d38710e210cb", http.StatusOK, 0},
+		{true, "/external-ips?state=reserved&tenant_id=19df9b86-eda3-489d-b75f-d38710e210cb", http.StatusOK, 0},
+		{true, "/external-ips?internal_ip=172.16.0.1", http.StatusOK, 1},
+		{true, "/external-ips?internal_ip=172.16.0.2", http.StatusOK, 0},
+		{true, "/external-ips?internal_ip=not-an-ip", http.StatusBadRequest, 0},
+		{true, "/external-ips?label=service=web", http.StatusOK, 0},
+		{true, "/external-ips?label=service", http.StatusBadRequest, 0},
+		{true, "/external-ips?older_than=720h", http.StatusOK, 0},
+		{true, "/external-ips?older_than=quarterly", http.StatusBadRequest, 0},
+		{true, "/external-ips?older_than=-1h", http.StatusBadRequest, 0},
+		{false, "/8a497c68-a88a-4c1c-be56-12a4883208d3/external-ips?internal_ip=172.16.0.1", http.StatusOK, 1},
+		{false, "/8a497c68-a88a-4c1c-be56-12a4883208d3/external-ips?internal_ip=172.16.0.2", http.StatusOK, 0},
+		{false, "/8a497c68-a88a-4c1c-be56-12a4883208d3/external-ips?state=reserved", http.StatusOK, 1},
+		{false, "/8a497c68-a88a-4c1c-be56-12a4883208d3/external-ips?state=attached", http.StatusOK, 0},
+		{false, "/8a497c68-a88a-4c1c-be56-12a4883208d3/external-ips?state=stale", http.StatusBadRequest, 0},
+		{false, "/external-ips", http.StatusUnauthorized, 0},
+		{false, "/8a497c68-a88a-4c1c-be56-12a4883208d3/external-ips", http.StatusOK, 1},
+		{false, "/8a497c68-a88a-4c1c-be56-12a4883208d3/external-ips?tenant_id=8a497c68-a88a-4c1c-be56-12a4883208d3", http.StatusOK, 1},
+		{false, "/8a497c68-a88a-4c1c-be56-12a4883208d3/external-ips?tenant_id=19df9b86-eda3-489d-b75f-d38710e210cb", http.StatusForbidden, 0},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", tt.request, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), tt.privileged))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", ExternalIPsV1))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.expectedStatus {
+			t.Errorf("test %d: got %v, expected %v", i, rr.Code, tt.expectedStatus)
+			continue
+		}
+
+		if rr.Code != http.StatusOK {
+			continue
+		}
+
+		count := strings.Count(rr.Body.String(), "mapping_id")
+		if count != tt.expectedIDs {
+			t.Errorf("test %d: got %d mappings, expected %d", i, count, tt.expectedIDs)
+		}
+
+		if count == 0 && rr.Body.String() != "[]" {
+			t.Errorf("test %d: expected an empty array, got %s", i, rr.Body.String())
+		}
+	}
+}
+
+func TestListCount(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	tests := []struct {
+		privileged bool
+		request    string
+		media      string
+		field      string
+	}{
+		{true, "/external-ips", ExternalIPsV1, "mapping_id"},
+		{true, "/external-ips?state=attached", ExternalIPsV1, "mapping_id"},
+		{true, "/external-ips?tenant_id=19df9b86-eda3-489d-b75f-d38710e210cb", ExternalIPsV1, "mapping_id"},
+		{false, "/8a497c68-a88a-4c1c-be56-12a4883208d3/external-ips?internal_ip=172.16.0.1", ExternalIPsV1, "mapping_id"},
+		{false, "/19df9b86-eda3-489d-b75f-d38710e210cb/external-ips", ExternalIPsV1, "mapping_id"},
+		{true, "/workloads", WorkloadsV1, `"id"`},
+		{true, "/workloads?fw_type=efi", WorkloadsV1, `"id"`},
+	}
+
+	get := func(privileged bool, request string, media string) string {
+		req, err := http.NewRequest("GET", request, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), privileged))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", media))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: got %v, expected %v", request, rr.Code, http.StatusOK)
+		}
+
+		return rr.Body.String()
+	}
+
+	for _, tt := range tests {
+		listed := strings.Count(get(tt.privileged, tt.request, tt.media), tt.field)
+
+		sep := "?"
+		if strings.Contains(tt.request, "?") {
+			sep = "&"
+		}
+
+		var resp types.CountResponse
+		err := json.Unmarshal([]byte(get(tt.privileged, tt.request+sep+"count=true", tt.media)), &resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Count != listed {
+			t.Errorf("%s: got count %d, expected %d", tt.request, resp.Count, listed)
+		}
+	}
+}
+
+// multiMappingCiaoService gives one instance two external IPs, listed
+// out of index order, and another instance a single external IP.
+type multiMappingCiaoService struct {
+	testCiaoService
+}
+
+func (ts multiMappingCiaoService) ListMappedAddresses(tenant *string) []types.MappedIP {
+	mapping := func(ID, externalIP, instanceID string, index int, role string) types.MappedIP {
+		return types.MappedIP{
+			ID:         ID,
+			ExternalIP: externalIP,
+			InternalIP: "172.16.0.1",
+			InstanceID: instanceID,
+			TenantID:   "8a497c68-a88a-4c1c-be56-12a4883208d3",
+			PoolID:     "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e",
+			PoolName:   "mypool",
+			Status:     types.MappedIPAttached,
+			Index:      index,
+			Role:       role,
+		}
+	}
+
+	return []types.MappedIP{
+		mapping("0b9d3e51-58a2-4e3e-9f58-6d8f7a43dd8a", "192.168.0.2", "e2d3a5b8-1505-48e6-9c8a-b0a50e4e5cb2", 1, "management"),
+		mapping("5c7d4f5e-4c0a-44bb-a35d-1a1b4e6fd0a1", "192.168.0.3", "7f1b8c55-2c0d-4ad0-9b0e-2a1e0a3d4c9f", 0, ""),
+		mapping("ba58f471-0735-4773-9550-188e2d012941", "192.168.0.1", "e2d3a5b8-1505-48e6-9c8a-b0a50e4e5cb2", 0, ""),
+	}
+}
+
+// agedMappingCiaoService has external IPs created a day, a week and a
+// quarter ago, and one whose creation was not recorded.
+type agedMappingCiaoService struct {
+	testCiaoService
+}
+
+func (ts agedMappingCiaoService) ListMappedAddresses(tenant *string) []types.MappedIP {
+	now := time.Now()
+
+	mapping := func(ID, externalIP, poolID string, age time.Duration) types.MappedIP {
+		m := types.MappedIP{
+			ID:         ID,
+			ExternalIP: externalIP,
+			TenantID:   "8a497c68-a88a-4c1c-be56-12a4883208d3",
+			PoolID:     poolID,
+			Status:     types.MappedIPReserved,
+		}
+		if age > 0 {
+			created := now.Add(-age)
+			m.Created = &created
+		}
+		return m
+	}
+
+	return []types.MappedIP{
+		mapping("0b9d3e51-58a2-4e3e-9f58-6d8f7a43dd8a", "192.168.0.1", "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e", 24*time.Hour),
+		mapping("5c7d4f5e-4c0a-44bb-a35d-1a1b4e6fd0a1", "192.168.0.2", "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e", 7*24*time.Hour),
+		mapping("ba58f471-0735-4773-9550-188e2d012941", "192.168.0.3", "19df9b86-eda3-489d-b75f-d38710e210cb", 90*24*time.Hour),
+		mapping("e2d3a5b8-1505-48e6-9c8a-b0a50e4e5cb2", "192.168.0.4", "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e", 0),
+	}
+}
+
+func TestListMappedIPsOlderThan(t *testing.T) {
+	var ts agedMappingCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	tests := []struct {
+		privileged bool
+		request    string
+		expected   []string
+	}{
+		{true, "/external-ips?older_than=1h", []string{"192.168.0.1", "192.168.0.2", "192.168.0.3"}},
+		{true, "/external-ips?older_than=72h", []string{"192.168.0.2", "192.168.0.3"}},
+		{true, "/external-ips?older_than=720h", []string{"192.168.0.3"}},
+		{true, "/external-ips?older_than=72h&pool_id=f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e", []string{"192.168.0.2"}},
+		{false, "/8a497c68-a88a-4c1c-be56-12a4883208d3/external-ips?older_than=2400h", []string{}},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", tt.request, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), tt.privileged))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", ExternalIPsV1))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("test %d: got %v, expected %v", i, rr.Code, http.StatusOK)
+			continue
+		}
+
+		var IPs []types.MappedIPShort
+		err = json.Unmarshal(rr.Body.Bytes(), &IPs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addresses := []string{}
+		for _, IP := range IPs {
+			addresses = append(addresses, IP.ExternalIP)
+		}
+
+		if !reflect.DeepEqual(addresses, tt.expected) {
+			t.Errorf("test %d: got %v, expected %v", i, addresses, tt.expected)
+		}
+	}
+}
+
+func TestListMappedIPsInstanceFilter(t *testing.T) {
+	var ts multiMappingCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	tests := []struct {
+		privileged bool
+		request    string
+		expected   []string
+	}{
+		{true, "/external-ips?instance_id=e2d3a5b8-1505-48e6-9c8a-b0a50e4e5cb2", []string{"192.168.0.1", "192.168.0.2"}},
+		{true, "/external-ips?instance_id=7f1b8c55-2c0d-4ad0-9b0e-2a1e0a3d4c9f", []string{"192.168.0.3"}},
+		{true, "/external-ips?instance_id=19df9b86-eda3-489d-b75f-d38710e210cb", []string{}},
+		{false, "/8a497c68-a88a-4c1c-be56-12a4883208d3/external-ips?instance_id=e2d3a5b8-1505-48e6-9c8a-b0a50e4e5cb2", []string{"192.168.0.1", "192.168.0.2"}},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", tt.request, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), tt.privileged))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", ExternalIPsV1))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("test %d: got %v, expected %v", i, rr.Code, http.StatusOK)
+			continue
+		}
+
+		var IPs []types.MappedIPShort
+		err = json.Unmarshal(rr.Body.Bytes(), &IPs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addresses := []string{}
+		for index, IP := range IPs {
+			if IP.Index != index {
+				t.Errorf("test %d: mapping %d has index %d", i, index, IP.Index)
+			}
+			addresses = append(addresses, IP.ExternalIP)
+		}
+
+		if !reflect.DeepEqual(addresses, tt.expected) {
+			t.Errorf("test %d: got %v, expected %v", i, addresses, tt.expected)
+		}
+
+		if len(IPs) == 2 && IPs[1].Role != "management" {
+			t.Errorf("test %d: expected role management, got %q", i, IPs[1].Role)
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	var ts testCiaoService
+
+	tests := []struct {
+		config   Config
+		expected map[string]bool
+	}{
+		{
+			Config{URL: "", CiaoService: ts},
+			map[string]bool{"webhooks": false, "request_timeout": false, "verify_mapped_instances": false, "strict_content_type": false, "watch": true},
+		},
+		{
+			Config{URL: "", CiaoService: ts, WebhookURL: "http://127.0.0.1:1/hook", RequestTimeout: time.Minute, VerifyMappedInstances: true, StrictContentType: true},
+			map[string]bool{"webhooks": true, "request_timeout": true, "verify_mapped_instances": true, "strict_content_type": true, "watch": true},
+		},
+	}
+
+	for i, tt := range tests {
+		mux := Routes(tt.config, nil)
+
+		req, err := http.NewRequest("GET", "/capabilities", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), false))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("test %d: got %v, expected %v", i, rr.Code, http.StatusOK)
+		}
+
+		var capabilities map[string]bool
+		err = json.Unmarshal(rr.Body.Bytes(), &capabilities)
+		if err != nil {
+			t.Fatalf("test %d: %v", i, err)
+		}
+
+		for name, enabled := range tt.expected {
+			got, ok := capabilities[name]
+			if !ok || got != enabled {
+				t.Errorf("test %d: expected %s to be %v, got %v", i, name, enabled, got)
+			}
+		}
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "https://example.com", BasePath: "/ciao/api", CiaoService: ts}, nil)
+
+	tests := []struct {
+		path     string
+		expected int
+	}{
+		{"/ciao/api/", http.StatusOK},
+		{"/ciao/api/pools", http.StatusOK},
+		{"/pools", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.expected {
+			t.Errorf("%s: got %v, expected %v", tt.path, rr.Code, tt.expected)
+		}
+	}
+
+	req, err := http.NewRequest("GET", "/ciao/api/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req = req.WithContext(service.SetPrivilege(req.Context(), true))
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	var links []types.APILink
+	err = json.Unmarshal(rr.Body.Bytes(), &links)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, link := range links {
+		expected := "https://example.com/ciao/api/" + link.Rel
+		if link.Href != expected {
+			t.Errorf("got %s link %s, expected %s", link.Rel, link.Href, expected)
+		}
+	}
+}
+
+func TestAddPoolWarning(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	tests := []struct {
+		body    string
+		warning bool
+	}{
+		{`{"name":"testpool"}`, true},
+		{`{"name":"testpool","ips":[]}`, true},
+		{`{"name":"testpool","subnet":"192.168.0.0/24"}`, false},
+		{`{"name":"testpool","ips":[{"ip":"192.168.0.1"}]}`, false},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("POST", "/pools", bytes.NewBufferString(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", PoolsV1))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusNoContent {
+			t.Errorf("%s: got %v, expected %v", tt.body, rr.Code, http.StatusNoContent)
+		}
+
+		if warned := rr.Header().Get("Warning") != ""; warned != tt.warning {
+			t.Errorf("%s: expected warning %v, got %q", tt.body, tt.warning, rr.Header().Get("Warning"))
+		}
+	}
+}
+
+func TestPoolRevisionETag(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	req, err := http.NewRequest("GET", "/pools/ba58f471-0735-4773-9550-188e2d012941", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req = req.WithContext(service.SetPrivilege(req.Context(), true))
+	req.Header.Set("Content-Type", fmt.Sprintf("application/%s", PoolsV1))
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	if etag := rr.Header().Get("ETag"); etag != `"3"` {
+		t.Fatalf("expected ETag \"3\", got %q", etag)
+	}
+
+	tests := []struct {
+		ifMatch string
+		status  int
+	}{
+		{"", http.StatusNoContent},
+		{`"3"`, http.StatusNoContent},
+		{`"2", "3"`, http.StatusNoContent},
+		{"*", http.StatusNoContent},
+		{`"2"`, http.StatusPreconditionFailed},
+		{`W/"3"`, http.StatusPreconditionFailed},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("DELETE", "/pools/ba58f471-0735-4773-9550-188e2d012941", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", PoolsV1))
+		if tt.ifMatch != "" {
+			req.Header.Set("If-Match", tt.ifMatch)
+		}
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.status {
+			t.Errorf("If-Match %q: got %v, expected %v", tt.ifMatch, rr.Code, tt.status)
+		}
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	tests := []struct {
+		request      string
+		media        string
+		cacheControl string
+	}{
+		{"/", "application/json", "private, max-age=3600"},
+		{"/capabilities", "application/json", "private, max-age=3600"},
+		{"/pools", fmt.Sprintf("application/%s", PoolsV1), "no-cache"},
+		{"/external-ips", fmt.Sprintf("application/%s", ExternalIPsV1), "no-cache"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.request, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", tt.media)
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: got %v, expected %v", tt.request, rr.Code, http.StatusOK)
+		}
+
+		if rr.Header().Get("ETag") == "" {
+			t.Errorf("%s: no ETag", tt.request)
+		}
+
+		if got := rr.Header().Get("Cache-Control"); got != tt.cacheControl {
+			t.Errorf("%s: got Cache-Control %q, expected %q", tt.request, got, tt.cacheControl)
+		}
+	}
+}
+
+// unsortedMappingCiaoService lists external IPs whose order as strings
+// differs from their numeric order.
+type unsortedMappingCiaoService struct {
+	testCiaoService
+}
+
+func (ts unsortedMappingCiaoService) ListMappedAddresses(tenant *string) []types.MappedIP {
+	mapping := func(ID, externalIP, internalIP, instanceID string) types.MappedIP {
+		return types.MappedIP{
+			ID:         ID,
+			ExternalIP: externalIP,
+			InternalIP: internalIP,
+			InstanceID: instanceID,
+			TenantID:   "8a497c68-a88a-4c1c-be56-12a4883208d3",
+			PoolID:     "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e",
+			PoolName:   "mypool",
+			Status:     types.MappedIPAttached,
+		}
+	}
+
+	return []types.MappedIP{
+		mapping("0b9d3e51-58a2-4e3e-9f58-6d8f7a43dd8a", "192.168.0.10", "172.16.0.2", "e2d3a5b8-1505-48e6-9c8a-b0a50e4e5cb2"),
+		mapping("5c7d4f5e-4c0a-44bb-a35d-1a1b4e6fd0a1", "192.168.0.9", "172.16.0.11", "7f1b8c55-2c0d-4ad0-9b0e-2a1e0a3d4c9f"),
+		mapping("ba58f471-0735-4773-9550-188e2d012941", "192.168.0.100", "172.16.0.1", "a1c2e2a6-56f8-4f3f-9c2e-4b1c8f2d5e77"),
+	}
+}
+
+func TestListMappedIPsSort(t *testing.T) {
+	var ts unsortedMappingCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	tests := []struct {
+		request  string
+		status   int
+		expected []string
+	}{
+		{"/external-ips", http.StatusOK, []string{"192.168.0.10", "192.168.0.9", "192.168.0.100"}},
+		{"/external-ips?sort=external_ip", http.StatusOK, []string{"192.168.0.9", "192.168.0.10", "192.168.0.100"}},
+		{"/external-ips?sort=-external_ip", http.StatusOK, []string{"192.168.0.100", "192.168.0.10", "192.168.0.9"}},
+		{"/external-ips?sort=internal_ip", http.StatusOK, []string{"192.168.0.100", "192.168.0.10", "192.168.0.9"}},
+		{"/external-ips?sort=instance_id", http.StatusOK, []string{"192.168.0.9", "192.168.0.100", "192.168.0.10"}},
+		{"/external-ips?sort=-instance_id", http.StatusOK, []string{"192.168.0.10", "192.168.0.100", "192.168.0.9"}},
+		{"/external-ips?sort=pool_id", http.StatusBadRequest, nil},
+		{"/external-ips?sort=-", http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.request, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", ExternalIPsV1))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.status {
+			t.Errorf("%s: got %v, expected %v", tt.request, rr.Code, tt.status)
+			continue
+		}
+
+		if tt.status != http.StatusOK {
+			continue
+		}
+
+		var IPs []types.MappedIP
+		err = json.Unmarshal(rr.Body.Bytes(), &IPs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addresses := []string{}
+		for _, IP := range IPs {
+			addresses = append(addresses, IP.ExternalIP)
+		}
+
+		if !reflect.DeepEqual(addresses, tt.expected) {
+			t.Errorf("%s: got %v, expected %v", tt.request, addresses, tt.expected)
+		}
+	}
+}
+
+func TestListMappedIPsPagination(t *testing.T) {
+	var ts unsortedMappingCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	get := func(request string) (int, []string, string) {
+		req, err := http.NewRequest("GET", request, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", ExternalIPsV1))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			return rr.Code, nil, ""
+		}
+
+		var IPs []types.MappedIP
+		err = json.Unmarshal(rr.Body.Bytes(), &IPs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addresses := []string{}
+		for _, IP := range IPs {
+			addresses = append(addresses, IP.ExternalIP)
+		}
+
+		return rr.Code, addresses, rr.Header().Get("X-Next-Cursor")
+	}
+
+	// walk the cursor pages, which are in mapping ID order.
+	var addresses []string
+	request := "/external-ips?cursor=&limit=2"
+	for pages := 0; request != ""; pages++ {
+		if pages > 2 {
+			t.Fatal("cursor pagination does not end")
+		}
+
+		status, page, next := get(request)
+		if status != http.StatusOK {
+			t.Fatalf("%s: got %v, expected %v", request, status, http.StatusOK)
+		}
+
+		addresses = append(addresses, page...)
+
+		request = ""
+		if next != "" {
+			request = "/external-ips?limit=2&cursor=" + next
+		}
+	}
+
+	expected := []string{"192.168.0.10", "192.168.0.9", "192.168.0.100"}
+	if !reflect.DeepEqual(addresses, expected) {
+		t.Errorf("got %v, expected %v", addresses, expected)
+	}
+
+	tests := []struct {
+		request  string
+		status   int
+		expected []string
+	}{
+		{"/external-ips?offset=1&limit=1", http.StatusOK, []string{"192.168.0.9"}},
+		{"/external-ips?offset=5", http.StatusOK, []string{}},
+		{"/external-ips?limit=-1", http.StatusBadRequest, nil},
+		{"/external-ips?cursor=&offset=1", http.StatusBadRequest, nil},
+		{"/external-ips?cursor=&sort=external_ip", http.StatusBadRequest, nil},
+		{"/external-ips?cursor=not-a-cursor", http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		status, page, _ := get(tt.request)
+		if status != tt.status {
+			t.Errorf("%s: got %v, expected %v", tt.request, status, tt.status)
+			continue
+		}
+
+		if tt.status == http.StatusOK && !reflect.DeepEqual(page, tt.expected) {
+			t.Errorf("%s: got %v, expected %v", tt.request, page, tt.expected)
+		}
+	}
+}
+
+// testInstanceInfo describes the instances it holds, keyed by ID.
+type testInstanceInfo map[string]types.InstanceInfo
+
+func (ti testInstanceInfo) InstanceInfo(tenantID string, instanceID string) (types.InstanceInfo, error) {
+	info, ok := ti[instanceID]
+	if !ok {
+		return types.InstanceInfo{}, types.ErrInstanceNotFound
+	}
+
+	return info, nil
+}
+
+// orphanCiaoService serves workloads whose storage is made from images.
+type orphanCiaoService struct {
+	testCiaoService
+}
+
+func (ts orphanCiaoService) ListWorkloads(tenant string) ([]types.Workload, error) {
+	return []types.Workload{
+		{
+			ID:          "ba58f471-0735-4773-9550-188e2d012941",
+			Description: "testWorkload",
+			Storage: []types.StorageResource{
+				{SourceType: types.ImageService, SourceID: "73a86d7e-93c0-480e-9c41-ab42f69b7799"},
+				{SourceType: types.Empty, Size: 10},
+			},
+		},
+		{
+			ID:          "76f4fa99-e533-4cbd-ab36-f6c0f51292ed",
+			Description: "testEFIWorkload",
+			Storage: []types.StorageResource{
+				{SourceType: types.ImageService, SourceID: "df3768da-31f5-4ba6-82f0-127a1a705169"},
+				{SourceType: types.VolumeService, SourceID: "9f1ff2cc-1ef1-4d12-a2d5-0ac9a2e1c1a7"},
+			},
+		},
+	}, nil
+}
+
+// testImageChecker holds the IDs of the images which exist.
+type testImageChecker map[string]bool
+
+func (ti testImageChecker) ImageExists(tenantID string, imageID string) (bool, error) {
+	return ti[imageID], nil
+}
+
+func TestListOrphanedWorkloads(t *testing.T) {
+	var ts orphanCiaoService
+
+	images := testImageChecker{"73a86d7e-93c0-480e-9c41-ab42f69b7799": true}
+
+	tests := []struct {
+		config   Config
+		status   int
+		expected string
+	}{
+		{
+			Config{CiaoService: ts, ImageChecker: images},
+			http.StatusOK,
+			`{"workloads":[{"workload_id":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","description":"testEFIWorkload","missing_images":["df3768da-31f5-4ba6-82f0-127a1a705169"]}]}`,
+		},
+		{
+			Config{CiaoService: ts, ImageChecker: testImageChecker{}},
+			http.StatusOK,
+			`{"workloads":[{"workload_id":"ba58f471-0735-4773-9550-188e2d012941","description":"testWorkload","missing_images":["73a86d7e-93c0-480e-9c41-ab42f69b7799"]},{"workload_id":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","description":"testEFIWorkload","missing_images":["df3768da-31f5-4ba6-82f0-127a1a705169"]}]}`,
+		},
+		{
+			Config{CiaoService: ts},
+			http.StatusNotFound,
+			`{"error":{"code":404,"name":"Not Found","message":"No image checker configured"}}
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		mux := Routes(tt.config, nil)
+
+		req, err := http.NewRequest("GET", "/workloads/orphaned", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", WorkloadsV1))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.status {
+			t.Errorf("got %v, expected %v", rr.Code, tt.status)
+			continue
+		}
+
+		if rr.Body.String() != tt.expected {
+			t.Errorf("got %s, expected %s", rr.Body.String(), tt.expected)
+		}
+	}
+}
+
+func TestListMappedIPsExpand(t *testing.T) {
+	var ts unsortedMappingCiaoService
+
+	instances := testInstanceInfo{
+		"e2d3a5b8-1505-48e6-9c8a-b0a50e4e5cb2": {
+			ID:     "e2d3a5b8-1505-48e6-9c8a-b0a50e4e5cb2",
+			Name:   "web-0",
+			Status: "running",
+		},
+	}
+
+	tests := []struct {
+		config     Config
+		request    string
+		privileged bool
+		status     int
+		expected   []string
+	}{
+		{Config{CiaoService: ts, InstanceInfo: instances}, "/external-ips?expand=instance", true, http.StatusOK, []string{"web-0", "", ""}},
+		{Config{CiaoService: ts, InstanceInfo: instances}, "/8a497c68-a88a-4c1c-be56-12a4883208d3/external-ips?expand=instance", false, http.StatusOK, []string{"web-0", "", ""}},
+		{Config{CiaoService: ts}, "/external-ips?expand=instance", true, http.StatusOK, []string{"", "", ""}},
+		{Config{CiaoService: ts, InstanceInfo: instances}, "/external-ips", true, http.StatusOK, nil},
+		{Config{CiaoService: ts, InstanceInfo: instances}, "/external-ips?expand=pool", true, http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		mux := Routes(tt.config, nil)
+
+		req, err := http.NewRequest("GET", tt.request, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), tt.privileged))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", ExternalIPsV1))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.status {
+			t.Errorf("%s: got %v, expected %v", tt.request, rr.Code, tt.status)
+			continue
+		}
+
+		if tt.status != http.StatusOK {
+			continue
+		}
+
+		var IPs []map[string]json.RawMessage
+		err = json.Unmarshal(rr.Body.Bytes(), &IPs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, IP := range IPs {
+			raw, ok := IP["instance"]
+			if tt.expected == nil {
+				if ok {
+					t.Errorf("%s: unexpected instance %s", tt.request, raw)
+				}
+				continue
+			}
+
+			var info *types.InstanceInfo
+			err = json.Unmarshal(raw, &info)
+			if !ok || err != nil {
+				t.Errorf("%s: mapping %d has no instance", tt.request, i)
+				continue
+			}
+
+			name := ""
+			if info != nil {
+				name = info.Name
+			}
+
+			if name != tt.expected[i] {
+				t.Errorf("%s: mapping %d got instance %q, expected %q", tt.request, i, name, tt.expected[i])
+			}
+		}
+	}
+}
+
+func TestListMappedIPsCSV(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	tests := []struct {
+		privileged bool
+		request    string
+		expected   string
+	}{
+		{
+			true,
+			"/external-ips",
+			"mapping_id,external_ip,internal_ip,instance_id,tenant_id,pool_name\n" +
+				"ba58f471-0735-4773-9550-188e2d012941,192.168.0.1,172.16.0.1,,8a497c68-a88a-4c1c-be56-12a4883208d3,mypool\n",
+		},
+		{
+			true,
+			"/external-ips?state=attached",
+			"mapping_id,external_ip,internal_ip,instance_id,tenant_id,pool_name\n",
+		},
+		{
+			false,
+			"/8a497c68-a88a-4c1c-be56-12a4883208d3/external-ips",
+			"mapping_id,external_ip,internal_ip,instance_id,tenant_id,pool_name\n" +
+				"ba58f471-0735-4773-9550-188e2d012941,192.168.0.1,172.16.0.1,,8a497c68-a88a-4c1c-be56-12a4883208d3,\n",
+		},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.request, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), tt.privileged))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", ExternalIPsV1))
+		req.Header.Set("Accept", "text/csv")
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: got %v, expected %v", tt.request, rr.Code, http.StatusOK)
+			continue
+		}
+
+		if contentType := rr.Header().Get("Content-Type"); contentType != "text/csv" {
+			t.Errorf("%s: got Content-Type %q, expected text/csv", tt.request, contentType)
+		}
+
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%s: got %q, expected %q", tt.request, rr.Body.String(), tt.expected)
+		}
+	}
+}
+
+func TestListMappedIPsRoutes(t *testing.T) {
+	tests := []struct {
+		service  Service
+		request  string
+		expected string
+	}{
+		{
+			multiMappingCiaoService{},
+			"/external-ips",
+			"nat 192.168.0.2 172.16.0.1\nnat 192.168.0.3 172.16.0.1\nnat 192.168.0.1 172.16.0.1\n",
+		},
+		{
+			multiMappingCiaoService{},
+			"/external-ips?instance_id=7f1b8c55-2c0d-4ad0-9b0e-2a1e0a3d4c9f",
+			"nat 192.168.0.3 172.16.0.1\n",
+		},
+		{
+			// reservations have nowhere to route to.
+			testCiaoService{},
+			"/external-ips",
+			"",
+		},
+	}
+
+	for _, tt := range tests {
+		mux := Routes(Config{URL: "", CiaoService: tt.service}, nil)
+
+		req, err := http.NewRequest("GET", tt.request, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", ExternalIPsV1))
+		req.Header.Set("Accept", routesContentType)
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: got %v, expected %v", tt.request, rr.Code, http.StatusOK)
+			continue
+		}
+
+		if contentType := rr.Header().Get("Content-Type"); contentType != routesContentType {
+			t.Errorf("%s: got Content-Type %q, expected %s", tt.request, contentType, routesContentType)
+		}
+
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%s: got %q, expected %q", tt.request, rr.Body.String(), tt.expected)
+		}
+	}
+}
+
+func TestImportWorkloadsNDJSON(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	body := `{"workloads":[{"fw_type":"legacy","vm_type":"qemu"},{"fw_type":"efi","vm_type":"docker"},{"fw_type":"legacy","vm_type":"qemu"}]}`
+
+	req, err := http.NewRequest("POST", "/workloads/import", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req = req.WithContext(service.SetPrivilege(req.Context(), true))
+	req.Header.Set("Content-Type", fmt.Sprintf("application/%s", WorkloadsV1))
+	req.Header.Set("Accept", "application/x-ndjson")
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusMultiStatus {
+		t.Fatalf("got %v, expected %v", rr.Code, http.StatusMultiStatus)
+	}
+
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/x-ndjson" {
+		t.Errorf("got Content-Type %q, expected application/x-ndjson", contentType)
+	}
+
+	if !rr.Flushed {
+		t.Error("results were not flushed as they were written")
+	}
+
+	expected := `{"index":0,"status":201,"id":"ba58f471-0735-4773-9550-188e2d012941"}
+{"index":1,"status":422,"error":"Firmware type not supported by VM type"}
+{"index":2,"status":201,"id":"ba58f471-0735-4773-9550-188e2d012941"}
+`
+	if rr.Body.String() != expected {
+		t.Errorf("got %q, expected %q", rr.Body.String(), expected)
+	}
+}
+
+func TestStreamTenantEvents(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	tests := []struct {
+		tenant string
+		caller string
+		status int
+	}{
+		{"093ae09b-f653-464e-9ae6-5ae28bd03a22", "093ae09b-f653-464e-9ae6-5ae28bd03a22", http.StatusOK},
+		{"093ae09b-f653-464e-9ae6-5ae28bd03a22", "19df9b86-eda3-489d-b75f-d38710e210cb", http.StatusForbidden},
+		{"19df9b86-eda3-489d-b75f-d38710e210cb", "19df9b86-eda3-489d-b75f-d38710e210cb", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/tenants/"+tt.tenant+"/events/stream", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetTenantID(req.Context(), tt.caller))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.status {
+			t.Fatalf("%s: got %v, expected %v", tt.tenant, rr.Code, tt.status)
+		}
+
+		if tt.status != http.StatusOK {
+			continue
+		}
+
+		if contentType := rr.Header().Get("Content-Type"); contentType != "text/event-stream" {
+			t.Errorf("got Content-Type %q, expected text/event-stream", contentType)
+		}
+
+		if !rr.Flushed {
+			t.Error("events were not flushed as they were written")
+		}
+
+		expected := "event: map-external-ip\ndata: " +
+			`{"time_stamp":"2017-06-01T12:00:00Z","tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","operation":"map-external-ip","error":""}` +
+			"\n\nevent: external-ip-change\ndata: " +
+			`{"time_stamp":"2017-06-01T12:00:01Z","tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","operation":"external-ip-change","error":"","change":{"type":"deleted","mapping":{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","external_ip":"192.168.0.1","internal_ip":"","instance_id":"","tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","pool_id":"","pool_name":"","status":"","index":0,"links":null}}}` +
+			"\n\n"
+		if rr.Body.String() != expected {
+			t.Errorf("got %q, expected %q", rr.Body.String(), expected)
+		}
+	}
+}
+
+func TestAddWorkloadAsyncLocation(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	body := `{"id":"","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"this will totally work!","defaults":[]}`
+
+	tests := []struct {
+		request  string
+		status   int
+		location string
+	}{
+		{"/workloads", http.StatusCreated, ""},
+		{"/workloads?async=true", http.StatusAccepted, "/workloads/ba58f471-0735-4773-9550-188e2d012941/status"},
+		{"/8a497c68-a88a-4c1c-be56-12a4883208d3/workloads?async=true", http.StatusAccepted, "/8a497c68-a88a-4c1c-be56-12a4883208d3/workloads/ba58f471-0735-4773-9550-188e2d012941/status"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("POST", tt.request, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), !strings.HasPrefix(tt.request, "/8a497c68")))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", WorkloadsV1))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.status {
+			t.Errorf("%s: got %v, expected %v", tt.request, rr.Code, tt.status)
+		}
+
+		if location := rr.Header().Get("Location"); location != tt.location {
+			t.Errorf("%s: got Location %q, expected %q", tt.request, location, tt.location)
+		}
+	}
+}
+
+func TestExportPoolsRange(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	get := func(rangeHeader string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/pools/export", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", PoolsV1))
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		return rr
+	}
+
+	full := get("")
+	if full.Code != http.StatusOK {
+		t.Fatalf("got %v, expected %v", full.Code, http.StatusOK)
+	}
+
+	if full.Header().Get("Accept-Ranges") != "bytes" {
+		t.Errorf("expected Accept-Ranges: bytes, got %q", full.Header().Get("Accept-Ranges"))
+	}
+
+	if full.Header().Get("Content-Type") != fmt.Sprintf("application/%s", PoolsV1) {
+		t.Errorf("unexpected Content-Type %q", full.Header().Get("Content-Type"))
+	}
+
+	body := full.Body.String()
+
+	part := get("bytes=10-19")
+	if part.Code != http.StatusPartialContent {
+		t.Fatalf("got %v, expected %v", part.Code, http.StatusPartialContent)
+	}
+
+	if part.Body.String() != body[10:20] {
+		t.Errorf("got range %q, expected %q", part.Body.String(), body[10:20])
+	}
+
+	contentRange := fmt.Sprintf("bytes 10-19/%d", len(body))
+	if part.Header().Get("Content-Range") != contentRange {
+		t.Errorf("got Content-Range %q, expected %q", part.Header().Get("Content-Range"), contentRange)
+	}
+}
+
+func TestMapExternalIPVerifyInstance(t *testing.T) {
+	var ts testCiaoService
+
+	tests := []struct {
+		verify   bool
+		instance string
+		status   int
+	}{
+		{true, "validinstanceID", http.StatusCreated},
+		{true, "unknowninstanceID", http.StatusNotFound},
+		{false, "unknowninstanceID", http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		mux := Routes(Config{URL: "", CiaoService: ts, VerifyMappedInstances: tt.verify}, nil)
+
+		body := fmt.Sprintf(`{"pool_name":"apool","instance_id":%q}`, tt.instance)
+		req, err := http.NewRequest("POST", "/19df9b86-eda3-489d-b75f-d38710e210cb/external-ips", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", ExternalIPsV1))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.status {
+			t.Errorf("verify %v, instance %s: got %v, expected %v", tt.verify, tt.instance, rr.Code, tt.status)
+		}
+	}
+}
+
+func TestPoolExhaustedRetryAfter(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	tests := []struct {
+		pool       string
+		retryAfter string
+	}{
+		{"leasedpool", "70"},
+		{"fullpool", ""},
+	}
+
+	for _, tt := range tests {
+		body := fmt.Sprintf(`{"pool_name":%q}`, tt.pool)
+		req, err := http.NewRequest("POST", "/external-ips", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", ExternalIPsV1))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusConflict {
+			t.Fatalf("%s: got %d, expected %d", tt.pool, rr.Code, http.StatusConflict)
+		}
+
+		if rr.Header().Get("Retry-After") != tt.retryAfter {
+			t.Errorf("%s: got Retry-After %q, expected %q", tt.pool, rr.Header().Get("Retry-After"), tt.retryAfter)
+		}
+	}
+}
+
+func TestMapExternalIPInstanceIDPattern(t *testing.T) {
+	var ts testCiaoService
+
+	tests := []struct {
+		pattern  *regexp.Regexp
+		instance string
+		status   int
+	}{
+		{regexp.MustCompile(`^valid[A-Za-z]+$`), "validinstanceID", http.StatusCreated},
+		{regexp.MustCompile(`^valid[A-Za-z]+$`), "valid-instanceID", http.StatusBadRequest},
+		{regexp.MustCompile(`^valid[A-Za-z]+$`), "", http.StatusCreated},
+		{nil, "valid-instanceID", http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		mux := Routes(Config{URL: "", CiaoService: ts, InstanceIDPattern: tt.pattern}, nil)
+
+		body := fmt.Sprintf(`{"pool_name":"apool","instance_id":%q}`, tt.instance)
+		req, err := http.NewRequest("POST", "/19df9b86-eda3-489d-b75f-d38710e210cb/external-ips", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", ExternalIPsV1))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.status {
+			t.Errorf("pattern %v, instance %q: got %v, expected %v", tt.pattern, tt.instance, rr.Code, tt.status)
+		}
+	}
+}
+
+func TestDeprecatedVersion(t *testing.T) {
+	var ts testCiaoService
+
+	sunset := time.Date(2018, time.January, 1, 0, 0, 0, 0, time.UTC)
+	config := Config{
+		URL:                "",
+		CiaoService:        ts,
+		DeprecatedVersions: map[string]time.Time{PoolsV1: sunset},
+	}
+
+	mux := Routes(config, nil)
+
+	tests := []struct {
+		media       string
+		deprecation string
+		sunset      string
+	}{
+		{fmt.Sprintf("application/%s", PoolsV1), "true", "Mon, 01 Jan 2018 00:00:00 GMT"},
+		{"application/json", "", ""},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/pools", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", tt.media)
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: got %v, expected %v", tt.media, rr.Code, http.StatusOK)
+		}
+
+		if rr.Header().Get("Deprecation") != tt.deprecation {
+			t.Errorf("%s: got Deprecation %q, expected %q", tt.media, rr.Header().Get("Deprecation"), tt.deprecation)
+		}
+
+		if rr.Header().Get("Sunset") != tt.sunset {
+			t.Errorf("%s: got Sunset %q, expected %q", tt.media, rr.Header().Get("Sunset"), tt.sunset)
+		}
+	}
+}
+
+func TestConfigChecksum(t *testing.T) {
+	wl := types.Workload{
+		Config:   "this will totally work!",
+		Defaults: []payloads.RequestedResource{{Type: payloads.VCPUs, Value: 2}},
+	}
+
+	sum := wl.ConfigChecksum()
+
+	same := wl
+	same.Description = "renamed"
+	if same.ConfigChecksum() != sum {
+		t.Error("checksum changed with the description")
+	}
+
+	config := wl
+	config.Config = "this will also work!"
+	if config.ConfigChecksum() == sum {
+		t.Error("checksum unchanged with the config")
+	}
+
+	defaults := wl
+	defaults.Defaults = []payloads.RequestedResource{{Type: payloads.VCPUs, Value: 4}}
+	if defaults.ConfigChecksum() == sum {
+		t.Error("checksum unchanged with the defaults")
+	}
+
+	none := types.Workload{Config: wl.Config}
+	empty := types.Workload{Config: wl.Config, Defaults: []payloads.RequestedResource{}}
+	if none.ConfigChecksum() != empty.ConfigChecksum() {
+		t.Error("checksum differs between no and empty defaults")
+	}
+}
+
+func TestDiffValues(t *testing.T) {
+	var a, b interface{}
+
+	err := json.Unmarshal([]byte(`{"config":"x","storage":[{"size":10},{"size":2}],"defaults":[{"type":"vcpus","value":2}]}`), &a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = json.Unmarshal([]byte(`{"config":"y","storage":[{"size":20}],"defaults":[{"type":"vcpus","value":2}]}`), &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diffs := diffValues(nil, "", a, b)
+
+	expected := []string{"config", "storage[0].size", "storage[1]"}
+	if len(diffs) != len(expected) {
+		t.Fatalf("expected %d differences, got %+v", len(expected), diffs)
+	}
+
+	for i, field := range expected {
+		if diffs[i].Field != field {
+			t.Errorf("expected difference in %s, got %+v", field, diffs[i])
+		}
+	}
+
+	if diffs[2].B != nil {
+		t.Errorf("expected missing element to be null, got %v", diffs[2].B)
+	}
+}
+
+func TestPTRName(t *testing.T) {
+	tests := []struct {
+		template string
+		address  string
+		expected string
+	}{
+		{"ip-{ip}.example.com", "203.0.113.5", "ip-203-0-113-5.example.com"},
+		{"{reverse}.in-addr.arpa", "203.0.113.5", "5.113.0.203.in-addr.arpa"},
+		{"", "203.0.113.5", ""},
+		{"ip-{ip}.example.com", "2001:db8::1", ""},
+		{"ip-{ip}.example.com", "not-an-ip", ""},
+	}
+
+	for _, tt := range tests {
+		if got := ptrName(tt.template, tt.address); got != tt.expected {
+			t.Errorf("%q %s: got %q, expected %q", tt.template, tt.address, got, tt.expected)
+		}
+	}
+}
+
+func TestListMappedIPsPTR(t *testing.T) {
+	var ts testCiaoService
+
+	tests := []struct {
+		config     Config
+		request    string
+		privileged bool
+		expected   string
+	}{
+		{Config{CiaoService: ts, PTRTemplate: "ip-{ip}.example.com"}, "/external-ips", true, "ip-192-168-0-1.example.com"},
+		{Config{CiaoService: ts, PTRTemplate: "ip-{ip}.example.com"}, "/8a497c68-a88a-4c1c-be56-12a4883208d3/external-ips", false, "ip-192-168-0-1.example.com"},
+		{Config{CiaoService: ts}, "/external-ips", true, ""},
+	}
+
+	for _, tt := range tests {
+		mux := Routes(tt.config, nil)
+
+		req, err := http.NewRequest("GET", tt.request, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), tt.privileged))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", ExternalIPsV1))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: got %v, expected %v", tt.request, rr.Code, http.StatusOK)
+		}
+
+		var IPs []map[string]interface{}
+		err = json.Unmarshal(rr.Body.Bytes(), &IPs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(IPs) != 1 {
+			t.Fatalf("%s: expected 1 external IP, got %d", tt.request, len(IPs))
+		}
+
+		ptr, ok := IPs[0]["ptr"]
+		if tt.expected == "" {
+			if ok {
+				t.Errorf("%s: unexpected ptr %v", tt.request, ptr)
+			}
+			continue
+		}
+
+		if ptr != tt.expected {
+			t.Errorf("%s: got ptr %v, expected %s", tt.request, ptr, tt.expected)
+		}
+	}
+}
+
+func TestLinkRelNamespace(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts, LinkRelNamespace: "ciao"}, nil)
+
+	tests := []struct {
+		request  string
+		media    string
+		expected []string
+	}{
+		{"/", "application/json", []string{"ciao:pools", "ciao:external-ips", "ciao:workloads", "ciao:tenants"}},
+		{"/pools/ba58f471-0735-4773-9550-188e2d012941", fmt.Sprintf("application/%s", PoolsV1), []string{"ciao:self"}},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.request, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", tt.media)
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: got %v, expected %v", tt.request, rr.Code, http.StatusOK)
+		}
+
+		var links []types.Link
+		if tt.request == "/" {
+			err = json.Unmarshal(rr.Body.Bytes(), &links)
+		} else {
+			var pool types.Pool
+			err = json.Unmarshal(rr.Body.Bytes(), &pool)
+			links = pool.Links
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var rels []string
+		for _, l := range links {
+			rels = append(rels, l.Rel)
+		}
+
+		if !reflect.DeepEqual(rels, tt.expected) {
+			t.Errorf("%s: expected rels %v, got %v", tt.request, tt.expected, rels)
+		}
+	}
+}
+
+func TestPoolActivityLimit(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts, PoolActivityLimit: 1}, nil)
+
+	req, err := http.NewRequest("GET", "/pools/ba58f471-0735-4773-9550-188e2d012941?include_activity=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req = req.WithContext(service.SetPrivilege(req.Context(), true))
+	req.Header.Set("Content-Type", fmt.Sprintf("application/%s", PoolsV1))
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got %v, expected %v", rr.Code, http.StatusOK)
+	}
+
+	var pool types.PoolDetails
+	err = json.Unmarshal(rr.Body.Bytes(), &pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pool.Activity) != 1 {
+		t.Errorf("expected 1 activity entry, got %d", len(pool.Activity))
+	}
+}
+
+func TestStrictContentType(t *testing.T) {
+	var ts testCiaoService
+
+	tests := []struct {
+		strict         bool
+		method         string
+		request        string
+		media          string
+		expectedStatus int
+	}{
+		{false, "POST", "/workloads/validate", "application/json", http.StatusOK},
+		{true, "POST", "/workloads/validate", "application/json", http.StatusUnsupportedMediaType},
+		{true, "POST", "/workloads/validate", fmt.Sprintf("application/%s", WorkloadsV1), http.StatusOK},
+		{true, "PATCH", "/workloads/ba58f471-0735-4773-9550-188e2d012941", fmt.Sprintf("application/%s", MergePatch), http.StatusOK},
+		{true, "GET", "/workloads", "application/json", http.StatusOK},
+		{true, "DELETE", "/workloads/ba58f471-0735-4773-9550-188e2d012941", "application/json", http.StatusNoContent},
+	}
+
+	body := `{"description":"testWorkload","fw_type":"legacy","vm_type":"qemu","config":"this will totally work!","defaults":[]}`
+
+	for _, tt := range tests {
+		mux := Routes(Config{URL: "", CiaoService: ts, StrictContentType: tt.strict}, nil)
+
+		var b io.Reader
+		switch tt.method {
+		case http.MethodPost, http.MethodPatch:
+			b = bytes.NewBufferString(body)
+		}
+
+		req, err := http.NewRequest(tt.method, tt.request, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", tt.media)
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.expectedStatus {
+			t.Errorf("%s %s as %s: got %v, expected %v", tt.method, tt.request, tt.media, rr.Code, tt.expectedStatus)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	var ts testCiaoService
+
+	sunset := time.Date(2018, time.January, 1, 0, 0, 0, 0, time.UTC)
+	config := Config{
+		URL:                "",
+		CiaoService:        ts,
+		DeprecatedVersions: map[string]time.Time{PoolsV1: sunset},
+	}
+
+	mux := Routes(config, nil)
+
+	tests := []struct {
+		query            string
+		expectedStatus   int
+		expectedResponse string
+	}{
+		{
+			"resource=pools&accept=" + url.QueryEscape("application/"+PoolsV1),
+			http.StatusOK,
+			`{"resource":"pools","accept":"application/x.ciao.pools.v1","media_type":"application/x.ciao.pools.v1","version":"x.ciao.pools.v1","deprecated":true,"sunset":"2018-01-01T00:00:00Z"}`,
+		},
+		{
+			"resource=pools",
+			http.StatusOK,
+			`{"resource":"pools","accept":"","media_type":"application/x.ciao.pools.v1","version":"x.ciao.pools.v1","deprecated":false}`,
+		},
+		{
+			"resource=workloads&accept=" + url.QueryEscape("text/html, application/json;q=0.5"),
+			http.StatusOK,
+			`{"resource":"workloads","accept":"text/html, application/json;q=0.5","media_type":"application/x.ciao.workloads.v1","version":"x.ciao.workloads.v1","deprecated":false}`,
+		},
+		{
+			"resource=tenants&accept=" + url.QueryEscape("application/x.ciao.tenants.v2, application/json;q=0"),
+			http.StatusNotAcceptable,
+			`{"error":{"code":406,"name":"Not Acceptable","message":"No acceptable media type"}}
+`,
+		},
+		{
+			"resource=instances",
+			http.StatusBadRequest,
+			`{"error":{"code":400,"name":"Bad Request","message":"Unknown resource"}}
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/negotiate?"+tt.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.expectedStatus {
+			t.Errorf("%s: got %v, expected %v", tt.query, rr.Code, tt.expectedStatus)
+		}
+
+		if rr.Body.String() != tt.expectedResponse {
+			t.Errorf("%s: got %s, expected %s", tt.query, rr.Body.String(), tt.expectedResponse)
+		}
+	}
+}
+
+func TestShowSchema(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	tests := []struct {
+		resource       string
+		expectedStatus int
+		properties     []string
+		notRequired    []string
+	}{
+		{"pools", http.StatusOK, []string{"id", "name", "free", "subnets", "ips", "revision"}, []string{"tags", "drained"}},
+		{"external-ips", http.StatusOK, []string{"mapping_id", "external_ip", "created", "labels"}, []string{"created", "labels", "role"}},
+		{"workloads", http.StatusOK, []string{"id", "config", "defaults", "storage"}, []string{"environment"}},
+		{"tenants", http.StatusOK, []string{"id", "name", "enabled"}, nil},
+		{"quotas", http.StatusOK, []string{"name", "value", "usage", "usage_percent"}, []string{"usage"}},
+		{"instances", http.StatusNotFound, nil, nil},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/schema/"+tt.resource, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.expectedStatus {
+			t.Errorf("%s: got %v, expected %v", tt.resource, rr.Code, tt.expectedStatus)
+			continue
+		}
+
+		if rr.Code != http.StatusOK {
+			continue
+		}
+
+		var schema struct {
+			Title      string                     `json:"title"`
+			Type       string                     `json:"type"`
+			Properties map[string]json.RawMessage `json:"properties"`
+			Required   []string                   `json:"required"`
+		}
+
+		err = json.Unmarshal(rr.Body.Bytes(), &schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if schema.Title != tt.resource || schema.Type != "object" {
+			t.Errorf("%s: got title %q and type %q", tt.resource, schema.Title, schema.Type)
+		}
+
+		required := make(map[string]bool)
+		for _, name := range schema.Required {
+			required[name] = true
+		}
+
+		for _, name := range tt.properties {
+			if _, ok := schema.Properties[name]; !ok {
+				t.Errorf("%s: property %s missing", tt.resource, name)
+			}
+		}
+
+		for _, name := range tt.notRequired {
+			if required[name] {
+				t.Errorf("%s: property %s should not be required", tt.resource, name)
+			}
+		}
+	}
+
+	// hidden fields are not described.
+	req, err := http.NewRequest("GET", "/schema/tenants", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	expected := `{"$schema":"http://json-schema.org/draft-04/schema#","properties":{"enabled":{"type":"boolean"},"id":{"type":"string"},"name":{"type":"string"}},"required":["id","name","enabled"],"title":"tenants","type":"object"}`
+	if rr.Body.String() != expected {
+		t.Errorf("got %s, expected %s", rr.Body.String(), expected)
+	}
+}
+
+func TestQuotaSnapshotRestore(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", TenantsV1))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := request("GET", "/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas/snapshot", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got %v, expected %v", rr.Code, http.StatusOK)
+	}
+
+	var resp types.QuotaSnapshotResponse
+	err := json.Unmarshal(rr.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.TenantID != "093ae09b-f653-464e-9ae6-5ae28bd03a22" || resp.Snapshot == "" {
+		t.Fatalf("unexpected snapshot %+v", resp)
+	}
+
+	rr = request("GET", "/tenants/3cf5b53d-4a21-4a1b-8c4d-6a7fb3fc0a2e/quotas/snapshot", "")
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("got %v, expected %v", rr.Code, http.StatusNotFound)
+	}
+
+	body, _ := json.Marshal(types.QuotaRestoreRequest{Snapshot: resp.Snapshot})
+
+	rr = request("POST", "/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas/restore", string(body))
+	expected := `{"quotas":[{"name":"test-quota-1","value":"10","usage":"3","unit":"count","usage_percent":30},{"name":"test-quota-2","value":"unlimited","usage":"10","usage_percent":null},{"name":"test-limit","value":"123","unit":"mb"}],"skipped":[]}`
+	if rr.Code != http.StatusOK || rr.Body.String() != expected {
+		t.Fatalf("got %v %s, expected %v %s", rr.Code, rr.Body.String(), http.StatusOK, expected)
+	}
+
+	// snapshots may only be restored to the tenant they were taken of.
+	rr = request("POST", "/tenants/19df9b86-eda3-489d-b75f-d38710e210cb/quotas/restore", string(body))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("got %v, expected %v", rr.Code, http.StatusBadRequest)
+	}
+
+	rr = request("POST", "/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas/restore", `{"snapshot":"not a snapshot"}`)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("got %v, expected %v", rr.Code, http.StatusBadRequest)
+	}
+
+	snapshot := types.QuotaSnapshot{
+		TenantID: "093ae09b-f653-464e-9ae6-5ae28bd03a22",
+		Quotas:   []types.QuotaDetails{{Name: "tenant-retired-quota", Value: 1}},
+	}
+	b, _ := json.Marshal(snapshot)
+	body, _ = json.Marshal(types.QuotaRestoreRequest{Snapshot: base64.StdEncoding.EncodeToString(b)})
+
+	rr = request("POST", "/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas/restore", string(body))
+	var restored types.QuotaRestoreResponse
+	err = json.Unmarshal(rr.Body.Bytes(), &restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(restored.Skipped) != 1 || restored.Skipped[0].Name != "tenant-retired-quota" {
+		t.Fatalf("expected tenant-retired-quota skipped, got %+v", restored.Skipped)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req = req.WithContext(service.SetPrivilege(req.Context(), true))
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got %v, expected %v", rr.Code, http.StatusOK)
+	}
+
+	if ct := rr.Header().Get("Content-Type"); ct != metricsContentType {
+		t.Fatalf("expected Content-Type %q, got %q", metricsContentType, ct)
+	}
+
+	for _, line := range []string{
+		"# TYPE ciao_pool_free gauge",
+		`ciao_pool_free{pool="testpool"} 0`,
+		"# TYPE ciao_pool_total gauge",
+		`ciao_pool_total{pool="testpool"} 0`,
+	} {
+		if !strings.Contains(rr.Body.String(), line+"\n") {
+			t.Errorf("expected %q in metrics:\n%s", line, rr.Body.String())
+		}
+	}
+
+	// only the admin may scrape them.
+	req = req.WithContext(service.SetPrivilege(req.Context(), false))
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("got %v, expected %v", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	var ts testCiaoService
+
+	tests := []struct {
+		budget time.Duration
+		header string
+	}{
+		{0, ""},
+		{500 * time.Millisecond, "budget;dur=500.000"},
+	}
+
+	for _, tt := range tests {
+		mux := Routes(Config{URL: "", CiaoService: ts, ResponseTimeBudget: tt.budget}, nil)
+
+		req, err := http.NewRequest("GET", "/pools", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", PoolsV1))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("got %v, expected %v", rr.Code, http.StatusOK)
+		}
+
+		timing := rr.Header().Get("Server-Timing")
+		if tt.header == "" {
+			if timing != "" {
+				t.Errorf("unexpected Server-Timing %q", timing)
+			}
+			continue
+		}
+
+		if !strings.Contains(timing, `service;desc="calls=1";dur=`) ||
+			!strings.Contains(timing, "handler;dur=") ||
+			!strings.Contains(timing, tt.header) {
+			t.Errorf("unexpected Server-Timing %q", timing)
+		}
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	var ts testCiaoService
+
+	config := Config{
+		URL:               "",
+		CiaoService:       ts,
+		MaxBodySize:       64,
+		RouteMaxBodySizes: map[string]int64{"/workloads": 1024},
+	}
+
+	mux := Routes(config, nil)
+
+	workload := `{"id":"","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"this will totally work!","defaults":[]}`
+
+	tests := []struct {
+		request        string
+		requestBody    string
+		media          string
+		expectedStatus int
+	}{
+		{"/pools", `{"name":"testpool"}`, PoolsV1, http.StatusNoContent},
+		{"/pools", `{"name":"` + strings.Repeat("a", 64) + `"}`, PoolsV1, http.StatusRequestEntityTooLarge},
+		{"/workloads", workload, WorkloadsV1, http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("POST", tt.request, bytes.NewBuffer([]byte(tt.requestBody)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", tt.media))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.expectedStatus {
+			t.Errorf("%s: got %v, expected %v", tt.request, rr.Code, tt.expectedStatus)
+		}
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	var ts testCiaoService
+
+	webhookRetryInterval = time.Millisecond
+
+	events := make(chan ExternalIPEvent)
+	failed := false
+
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fail the first delivery to make sure it is retried.
+		if !failed {
+			failed = true
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var event ExternalIPEvent
+		err := json.NewDecoder(r.Body).Decode(&event)
+		if err != nil {
+			t.Error(err)
+		}
+		events <- event
+	}))
+	defer hook.Close()
+
+	config := Config{URL: "", CiaoService: ts, WebhookURL: hook.URL}
+	mux := Routes(config, nil)
+
+	tests := []struct {
+		method      string
+		request     string
+		requestBody string
+		eventType   string
+	}{
+		{"POST", "/external-ips", `{"pool_name":"apool","instance_id":"validinstanceID"}`, ExternalIPMapped},
+		{"DELETE", "/external-ips/ba58f471-0735-4773-9550-188e2d012941", "", ExternalIPUnmapped},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.request, bytes.NewBuffer([]byte(tt.requestBody)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", ExternalIPsV1))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code >= http.StatusBadRequest {
+			t.Fatalf("%s %s: got %v", tt.method, tt.request, rr.Code)
+		}
+
+		select {
+		case event := <-events:
+			if event.Type != tt.eventType {
+				t.Errorf("got event %s, expected %s", event.Type, tt.eventType)
+			}
+
+			if event.Mapping.ExternalIP != "192.168.0.1" {
+				t.Errorf("unexpected mapping in event: %+v", event.Mapping)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s %s: no event delivered", tt.method, tt.request)
+		}
+	}
+}
+
+func TestTestWebhook(t *testing.T) {
+	var ts testCiaoService
+
+	status := http.StatusNoContent
+
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event ExternalIPEvent
+		err := json.NewDecoder(r.Body).Decode(&event)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if event.Type != WebhookTest {
+			t.Errorf("got event %s, expected %s", event.Type, WebhookTest)
+		}
+
+		w.WriteHeader(status)
+	}))
+	defer hook.Close()
+
+	testWebhook := func(webhookURL string) (int, WebhookTestResult) {
+		mux := Routes(Config{URL: "", CiaoService: ts, WebhookURL: webhookURL}, nil)
+
+		req, err := http.NewRequest("POST", "/config/webhook/test", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		var result WebhookTestResult
+		if rr.Code == http.StatusOK {
+			err = json.Unmarshal(rr.Body.Bytes(), &result)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return rr.Code, result
+	}
+
+	code, result := testWebhook(hook.URL)
+	if code != http.StatusOK || result.Status != http.StatusNoContent || result.Error != "" || result.URL != hook.URL {
+		t.Errorf("unexpected result of good delivery: %d %+v", code, result)
+	}
+
+	// a failed delivery is still a successful test.
+	status = http.StatusInternalServerError
+
+	code, result = testWebhook(hook.URL)
+	if code != http.StatusOK || result.Status != http.StatusInternalServerError || result.Error == "" {
+		t.Errorf("unexpected result of failed delivery: %d %+v", code, result)
+	}
+
+	code, _ = testWebhook("")
+	if code != http.StatusNotFound {
+		t.Errorf("got %d without a webhook, expected %d", code, http.StatusNotFound)
+	}
+}
+
+func TestQuotaAdminForbidden(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	for _, request := range []string{
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas/recalculate",
+		"/quotas/bulk",
+	} {
+		req, err := http.NewRequest("POST", request, bytes.NewBufferString("[]"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), false))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", TenantsV1))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("%s: got %v, expected %v", request, rr.Code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestListTenantPoolsAccess(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	tests := []struct {
+		caller         string
+		expectedStatus int
+	}{
+		{"093ae09b-f653-464e-9ae6-5ae28bd03a22", http.StatusOK},
+		{"8a497c68-a88a-4c1c-be56-12a4883208d3", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/pools", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := service.SetPrivilege(req.Context(), false)
+		ctx = service.SetTenantID(ctx, tt.caller)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", PoolsV1))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.expectedStatus {
+			t.Errorf("%s: got %v, expected %v", tt.caller, rr.Code, tt.expectedStatus)
+		}
+	}
+}
+
+func TestListTenantResourcesAccess(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	tests := []struct {
+		caller         string
+		expectedStatus int
+	}{
+		{"093ae09b-f653-464e-9ae6-5ae28bd03a22", http.StatusOK},
+		{"8a497c68-a88a-4c1c-be56-12a4883208d3", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := service.SetPrivilege(req.Context(), false)
+		ctx = service.SetTenantID(ctx, tt.caller)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", TenantsV1))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.expectedStatus {
+			t.Errorf("%s: got %v, expected %v", tt.caller, rr.Code, tt.expectedStatus)
+		}
+	}
+}
+
+type recordingCiaoService struct {
+	testCiaoService
+	events chan types.Event
+}
+
+func (rs recordingCiaoService) RecordTenantEvent(event types.Event) {
+	rs.events <- event
+}
+
+func TestRecordTenantEvents(t *testing.T) {
+	rs := recordingCiaoService{events: make(chan types.Event, 1)}
+
+	mux := Routes(Config{URL: "", CiaoService: rs}, nil)
+
+	tests := []struct {
+		request  string
+		body     string
+		recorded bool
+	}{
+		{"/19df9b86-eda3-489d-b75f-d38710e210cb/external-ips", `{"pool_name":"fullpool"}`, true},
+		{"/19df9b86-eda3-489d-b75f-d38710e210cb/external-ips", `{"pool_name":"apool"}`, false},
+		{"/external-ips", `{"pool_name":"fullpool"}`, false},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("POST", tt.request, bytes.NewBufferString(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", ExternalIPsV1))
+		req.Header.Set("X-Request-ID", "test-request")
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		select {
+		case event := <-rs.events:
+			if !tt.recorded {
+				t.Fatalf("%s %s: unexpected event %+v", tt.request, tt.body, event)
+			}
+
+			if event.TenantID != "19df9b86-eda3-489d-b75f-d38710e210cb" ||
+				event.Operation != types.EventMapExternalIP ||
+				event.RequestID != "test-request" ||
+				event.Error != "Pool fullpool has no free IPs" {
+				t.Errorf("%s %s: unexpected event %+v", tt.request, tt.body, event)
+			}
+		default:
+			if tt.recorded {
+				t.Errorf("%s %s: no event recorded", tt.request, tt.body)
+			}
+		}
+	}
+}
+
+func TestPoolAvailableTo(t *testing.T) {
+	tenantID := "093ae09b-f653-464e-9ae6-5ae28bd03a22"
+
+	tests := []struct {
+		owner    string
+		expected bool
+	}{
+		{"", true},
+		{tenantID, true},
+		{"8a497c68-a88a-4c1c-be56-12a4883208d3", false},
+	}
+
+	for _, tt := range tests {
+		pool := types.Pool{TenantID: tt.owner}
+
+		if pool.AvailableTo(tenantID) != tt.expected {
+			t.Errorf("pool owned by %q: expected %v", tt.owner, tt.expected)
+		}
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	tests := []struct {
+		method         string
+		request        string
+		media          string
+		expectedStatus int
+		expectedAllow  string
+	}{
+		{"PUT", "/pools", "application/json", http.StatusMethodNotAllowed, "GET, POST"},
+		{"POST", "/workloads/ba58f471-0735-4773-9550-188e2d012941", "application/json", http.StatusMethodNotAllowed, "GET, DELETE"},
+		{"PUT", "/external-ips", "application/json", http.StatusMethodNotAllowed, "GET, POST"},
+		{"GET", "/pools", "text/plain", http.StatusNotFound, ""},
+		{"GET", "/no-such-resource", "application/json", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.request, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", tt.media)
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.expectedStatus {
+			t.Errorf("%s %s: got %v, expected %v", tt.method, tt.request, rr.Code, tt.expectedStatus)
+		}
+
+		allow := rr.Header().Get("Allow")
+		if allow != tt.expectedAllow {
+			t.Errorf("%s %s: got Allow %q, expected %q", tt.method, tt.request, allow, tt.expectedAllow)
+		}
+	}
+}
+
+func TestOmitLinks(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	workload := `{"id":"","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"this will totally work!","defaults":[]}`
+
+	tests := []struct {
+		method string
+		url    string
+		body   string
+		media  string
+		accept string
+		links  bool
+	}{
+		{"GET", "/pools/ba58f471-0735-4773-9550-188e2d012941", "", PoolsV1, "", true},
+		{"GET", "/pools/ba58f471-0735-4773-9550-188e2d012941?links=false", "", PoolsV1, "", false},
+		{"GET", "/external-ips", "", ExternalIPsV1, "", true},
+		{"GET", "/external-ips?links=false", "", ExternalIPsV1, "", false},
+		{"GET", "/external-ips", "", ExternalIPsV1, "application/json; links=false", false},
+		{"POST", "/workloads", workload, WorkloadsV1, "", true},
+		{"POST", "/workloads?links=false", workload, WorkloadsV1, "", false},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.url, bytes.NewBufferString(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", tt.media))
+		req.Header.Set("Accept", tt.accept)
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code >= http.StatusBadRequest {
+			t.Fatalf("%s %s: unexpected status %v", tt.method, tt.url, rr.Code)
+		}
+
+		links := strings.Contains(rr.Body.String(), `"link`)
+		if links != tt.links {
+			t.Errorf("%s %s (%s): expected links %v in %s", tt.method, tt.url, tt.accept, tt.links, rr.Body.String())
+		}
+	}
+}
+
+func TestProblemDetails(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	tests := []struct {
+		method   string
+		request  string
+		accept   string
+		status   int
+		media    string
+		expected string
+	}{
+		{
+			"DELETE",
+			"/pools/76f4fa99-e533-4cbd-ab36-f6c0f51292ed",
+			"application/problem+json",
+			http.StatusConflict,
+			"application/problem+json",
+			`{"type":"about:blank","title":"Conflict","status":409,"detail":"Pool busypool still has 1 subnets, 2 IPs and 3 mappings","instance":"/pools/76f4fa99-e533-4cbd-ab36-f6c0f51292ed","details":{"pool_id":"76f4fa99-e533-4cbd-ab36-f6c0f51292ed","pool_name":"busypool","subnets":1,"ips":2,"mappings":3}}`,
+		},
+		{
+			"GET",
+			"/pools?contains=192.168.0.6",
+			"application/problem+json, application/json",
+			http.StatusNotFound,
+			"application/problem+json",
+			`{"type":"about:blank","title":"Not Found","status":404,"detail":"Pool not found","instance":"/pools?contains=192.168.0.6"}`,
+		},
+		{
+			"GET",
+			"/pools?contains=192.168.0.6",
+			"application/json",
+			http.StatusNotFound,
+			"text/plain; charset=utf-8",
+			`{"error":{"code":404,"name":"Not Found","message":"Pool not found"}}
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.request, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", PoolsV1))
+		req.Header.Set("Accept", tt.accept)
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.status {
+			t.Errorf("%s %s: got %v, expected %v", tt.method, tt.request, rr.Code, tt.status)
+		}
+
+		if contentType := rr.Header().Get("Content-Type"); contentType != tt.media {
+			t.Errorf("%s %s: got Content-Type %q, expected %q", tt.method, tt.request, contentType, tt.media)
+		}
+
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%s %s: got %s, expected %s", tt.method, tt.request, rr.Body.String(), tt.expected)
+		}
+	}
+}
+
+func TestMemberNaming(t *testing.T) {
+	names := map[string]string{
+		"id":                "id",
+		"mapping_id":        "mappingId",
+		"total_ips":         "totalIps",
+		"ipv4_only_pool_id": "ipv4OnlyPoolId",
+	}
+
+	for snake, camel := range names {
+		if camelCase(snake) != camel {
+			t.Errorf("camelCase(%q): got %q, expected %q", snake, camelCase(snake), camel)
+		}
+
+		if snakeCase(camel) != snake {
+			t.Errorf("snakeCase(%q): got %q, expected %q", camel, snakeCase(camel), snake)
+		}
+
+		if snakeCase(snake) != snake {
+			t.Errorf("snakeCase(%q): got %q, expected it unchanged", snake, snakeCase(snake))
+		}
+	}
+}
+
+func TestCamelCaseResponses(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	tests := []struct {
+		method   string
+		url      string
+		body     string
+		media    string
+		accept   string
+		status   int
+		response string
+	}{
+		{
+			"GET",
+			"/external-ips",
+			"",
+			ExternalIPsV1,
+			"application/json; naming=camel",
+			http.StatusOK,
+			`[{"externalIp":"192.168.0.1","index":0,"instanceId":"","internalIp":"172.16.0.1","links":[{"href":"/external-ips/ba58f471-0735-4773-9550-188e2d012941","rel":"self"},{"href":"/pools/f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","rel":"pool"}],"mappingId":"ba58f471-0735-4773-9550-188e2d012941","poolId":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","poolName":"mypool","status":"reserved","tenantId":"8a497c68-a88a-4c1c-be56-12a4883208d3"}]`,
+		},
+		{
+			"POST",
+			"/19df9b86-eda3-489d-b75f-d38710e210cb/external-ips",
+			`{"poolName":"fullpool","instanceId":"validinstanceID"}`,
+			ExternalIPsV1,
+			"application/json; naming=camel",
+			http.StatusConflict,
+			`{"error":{"code":409,"details":{"poolId":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","poolName":"fullpool"},"message":"Pool fullpool has no free IPs","name":"Conflict"}}
+`,
+		},
+		{
+			"POST",
+			"/19df9b86-eda3-489d-b75f-d38710e210cb/external-ips",
+			`{"poolName":"fullpool","instanceId":"validinstanceID"}`,
+			ExternalIPsV1,
+			"",
+			http.StatusCreated,
+			`{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","external_ip":"192.168.0.1","internal_ip":"172.16.0.1","instance_id":"","tenant_id":"19df9b86-eda3-489d-b75f-d38710e210cb","pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"mypool","status":"attached","index":0,"links":null}`,
+		},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.url, bytes.NewBufferString(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", tt.media))
+		req.Header.Set("Accept", tt.accept)
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.status {
+			t.Errorf("%s %s (%s): got %v, expected %v", tt.method, tt.url, tt.accept, rr.Code, tt.status)
+		}
+
+		if rr.Body.String() != tt.response {
+			t.Errorf("%s %s (%s): failed\ngot: %v\nexp: %v", tt.method, tt.url, tt.accept, rr.Body.String(), tt.response)
+		}
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	var ts testCiaoService
+
+	tests := []struct {
+		config    Config
+		accept    string
+		requestID string
+		enveloped bool
+	}{
+		{Config{CiaoService: ts}, "", "", false},
+		{Config{CiaoService: ts}, "application/json; envelope=true", "test-request", true},
+		{Config{CiaoService: ts}, "text/plain, application/json;envelope=true", "", true},
+		{Config{CiaoService: ts, EnvelopeResponses: true}, "", "test-request", true},
+	}
+
+	for i, tt := range tests {
+		mux := Routes(tt.config, nil)
+
+		req, err := http.NewRequest("GET", "/pools", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", PoolsV1))
+		req.Header.Set("Accept", tt.accept)
+		req.Header.Set("X-Request-ID", tt.requestID)
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("test %d: got %v, expected %v", i, rr.Code, http.StatusOK)
+		}
+
+		var envelope struct {
+			Data *types.ListPoolsResponse `json:"data"`
+			Meta EnvelopeMeta             `json:"meta"`
+		}
+
+		err = json.Unmarshal(rr.Body.Bytes(), &envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !tt.enveloped {
+			if envelope.Data != nil {
+				t.Errorf("test %d: unexpected envelope: %s", i, rr.Body.String())
+			}
+			continue
+		}
+
+		if envelope.Data == nil || len(envelope.Data.Pools) != 1 {
+			t.Errorf("test %d: expected one pool in envelope: %s", i, rr.Body.String())
+		}
+
+		if envelope.Meta.APIVersion != PoolsV1 {
+			t.Errorf("test %d: got version %q, expected %q", i, envelope.Meta.APIVersion, PoolsV1)
+		}
+
+		if envelope.Meta.RequestID == "" {
+			t.Errorf("test %d: no request ID", i)
+		}
+
+		if tt.requestID != "" && envelope.Meta.RequestID != tt.requestID {
+			t.Errorf("test %d: got request ID %q, expected %q", i, envelope.Meta.RequestID, tt.requestID)
+		}
+
+		if rr.Header().Get("X-Request-ID") != envelope.Meta.RequestID {
+			t.Errorf("test %d: X-Request-ID header does not match envelope", i)
+		}
+	}
+}
+
+func TestSortPoolsByUtilization(t *testing.T) {
+	pools := []types.Pool{
+		{Name: "empty", TotalIPs: 0, Free: 0},
+		{Name: "half-b", TotalIPs: 4, Free: 2},
+		{Name: "full", TotalIPs: 8, Free: 0},
+		{Name: "half-a", TotalIPs: 2, Free: 1},
+		{Name: "unused", TotalIPs: 4, Free: 4},
+	}
+
+	sortPoolsByUtilization(pools)
+
+	expected := []string{"full", "half-a", "half-b", "empty", "unused"}
+	for i, p := range pools {
+		if p.Name != expected[i] {
+			t.Fatalf("pool %d: got %s, expected %s", i, p.Name, expected[i])
+		}
+	}
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	request := func(method string, path string, body string, privileged bool) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
 
-type testCiaoService struct{}
+		req = req.WithContext(service.SetPrivilege(req.Context(), privileged))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", ExternalIPsV1))
 
-func (ts testCiaoService) ListPools() ([]types.Pool, error) {
-	self := types.Link{
-		Rel:  "self",
-		Href: "/pools/ba58f471-0735-4773-9550-188e2d012941",
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		return rr
 	}
 
-	resp := types.Pool{
-		ID:       "ba58f471-0735-4773-9550-188e2d012941",
-		Name:     "testpool",
-		Free:     0,
-		TotalIPs: 0,
-		Subnets:  []types.ExternalSubnet{},
-		IPs:      []types.ExternalIP{},
-		Links:    []types.Link{self},
+	mapIP := `{"pool_name":"apool","instance_id":"validinstanceID"}`
+
+	tests := []struct {
+		method     string
+		path       string
+		body       string
+		privileged bool
+		status     int
+	}{
+		{"POST", "/admin/maintenance", `{"enabled":true,"retry_after":120}`, true, http.StatusOK},
+		{"POST", "/external-ips", mapIP, true, http.StatusServiceUnavailable},
+		{"GET", "/external-ips", "", true, http.StatusOK},
+		{"GET", "/admin/maintenance", "", true, http.StatusOK},
+		{"POST", "/admin/maintenance", `{"enabled":true,"allow_privileged":true}`, true, http.StatusOK},
+		{"POST", "/external-ips", mapIP, true, http.StatusCreated},
+		{"POST", "/admin/maintenance", `{"enabled":false}`, false, http.StatusUnauthorized},
+		{"POST", "/admin/maintenance", `{"enabled":false}`, true, http.StatusOK},
+		{"POST", "/external-ips", mapIP, true, http.StatusCreated},
 	}
 
-	return []types.Pool{resp}, nil
-}
+	for _, tt := range tests {
+		rr := request(tt.method, tt.path, tt.body, tt.privileged)
+		if rr.Code != tt.status {
+			t.Fatalf("%s %s %s: got %d, expected %d", tt.method, tt.path, tt.body, rr.Code, tt.status)
+		}
 
-func (ts testCiaoService) AddPool(name string, subnet *string, ips []string) (types.Pool, error) {
-	return types.Pool{}, nil
+		if rr.Code == http.StatusServiceUnavailable && rr.Header().Get("Retry-After") != "120" {
+			t.Errorf("%s %s: got Retry-After %q, expected 120", tt.method, tt.path, rr.Header().Get("Retry-After"))
+		}
+	}
+
+	rr := request("GET", "/admin/maintenance", "", true)
+	expected := `{"enabled":false,"allow_privileged":false,"retry_after":60}`
+	if rr.Body.String() != expected {
+		t.Errorf("got %s, expected %s", rr.Body.String(), expected)
+	}
 }
 
-func (ts testCiaoService) ShowPool(id string) (types.Pool, error) {
-	fmt.Println("ShowPool")
-	self := types.Link{
-		Rel:  "self",
-		Href: "/pools/ba58f471-0735-4773-9550-188e2d012941",
+func TestRequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	slow := func(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		return Response{http.StatusOK, nil}, nil
 	}
 
-	resp := types.Pool{
-		ID:       "ba58f471-0735-4773-9550-188e2d012941",
-		Name:     "testpool",
-		Free:     0,
-		TotalIPs: 0,
-		Subnets:  []types.ExternalSubnet{},
-		IPs:      []types.ExternalIP{},
-		Links:    []types.Link{self},
+	fast := func(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+		return Response{http.StatusOK, nil}, nil
 	}
 
-	return resp, nil
+	context := &Context{timeout: 10 * time.Millisecond}
+
+	tests := []struct {
+		handler        func(*Context, http.ResponseWriter, *http.Request) (Response, error)
+		expectedStatus int
+	}{
+		{slow, http.StatusServiceUnavailable},
+		{fast, http.StatusOK},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", "/pools", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		Handler{context, tt.handler, false}.ServeHTTP(rr, req)
+
+		if rr.Code != tt.expectedStatus {
+			t.Errorf("test %d: got %v, expected %v", i, rr.Code, tt.expectedStatus)
+		}
+	}
 }
 
-func (ts testCiaoService) DeletePool(id string) error {
-	return nil
+func TestRequestTimeoutWrites(t *testing.T) {
+	wrote := make(chan struct{})
+
+	// writes once the timeout has been reported must not reach the
+	// response.
+	late := func(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+		defer close(wrote)
+
+		<-r.Context().Done()
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("late"))
+
+		return Response{http.StatusOK, streamedResponse{}}, nil
+	}
+
+	context := &Context{timeout: 10 * time.Millisecond}
+
+	req, err := http.NewRequest("GET", "/pools", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	Handler{context, late, false}.ServeHTTP(rr, req)
+	<-wrote
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got %v, expected %v", rr.Code, http.StatusServiceUnavailable)
+	}
+
+	if strings.Contains(rr.Body.String(), "late") || rr.Header().Get("Retry-After") != "" {
+		t.Fatalf("late write reached the response: %q", rr.Body.String())
+	}
+
+	// writes made in time are passed on.
+	streamed := func(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("in time"))
+
+		return Response{http.StatusOK, streamedResponse{}}, nil
+	}
+
+	context = &Context{timeout: time.Second}
+
+	rr = httptest.NewRecorder()
+	Handler{context, streamed, false}.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Body.String() != "in time" || rr.Header().Get("Content-Type") != "text/plain" {
+		t.Fatalf("got %v %q, expected the handler's response", rr.Code, rr.Body.String())
+	}
 }
 
-func (ts testCiaoService) AddAddress(poolID string, subnet *string, ips []string) error {
-	return nil
+// contextService is a ContextService which records the context it is
+// given.
+type contextService struct {
+	testCiaoService
+	ctx context.Context
 }
 
-func (ts testCiaoService) RemoveAddress(poolID string, subnet *string, extIP *string) error {
-	return nil
+func (s contextService) WithContext(ctx context.Context) Service {
+	return contextService{ctx: ctx}
 }
 
-func (ts testCiaoService) ListMappedAddresses(tenant *string) []types.MappedIP {
-	var ref string
+func TestRequestTimeoutContext(t *testing.T) {
+	handler := func(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+		svc := c.Service
+		if timed, ok := svc.(*timedService); ok {
+			svc = timed.Service
+		}
 
-	m := types.MappedIP{
-		ID:         "ba58f471-0735-4773-9550-188e2d012941",
-		ExternalIP: "192.168.0.1",
-		InternalIP: "172.16.0.1",
-		TenantID:   "8a497c68-a88a-4c1c-be56-12a4883208d3",
-		PoolID:     "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e",
-		PoolName:   "mypool",
+		s, ok := svc.(contextService)
+		if !ok || s.ctx != r.Context() {
+			return Response{http.StatusInternalServerError, nil}, nil
+		}
+
+		return Response{http.StatusOK, nil}, nil
 	}
 
-	if tenant != nil {
-		ref = fmt.Sprintf("%s/external-ips/%s", *tenant, m.ID)
-	} else {
-		ref = fmt.Sprintf("/external-ips/%s", m.ID)
+	for _, budget := range []time.Duration{0, time.Second} {
+		context := &Context{Service: contextService{}, timeout: time.Second, budget: budget}
+
+		req, err := http.NewRequest("GET", "/pools", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		Handler{context, handler, false}.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("budget %v: service not given the request context, got %v", budget, rr.Code)
+		}
 	}
+}
 
-	link := types.Link{
-		Rel:  "self",
-		Href: ref,
+func TestUntimedRoutes(t *testing.T) {
+	var ts testCiaoService
+
+	router := Routes(Config{URL: "", CiaoService: ts, RequestTimeout: time.Second}, nil)
+
+	untimed := map[string]bool{
+		"/external-ips/watch":                 true,
+		"/{tenant}/external-ips/watch":        true,
+		"/tenants/{for_tenant}/events/stream": true,
 	}
 
-	m.Links = []types.Link{link}
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
 
-	if tenant == nil {
-		ref := fmt.Sprintf("/pools/%s", m.PoolID)
+		h, ok := route.GetHandler().(Handler)
+		if !ok {
+			return nil
+		}
 
-		link := types.Link{
-			Rel:  "pool",
-			Href: ref,
+		if untimed[path] && h.timeout != 0 {
+			t.Errorf("%s has request timeout %v", path, h.timeout)
 		}
 
-		m.Links = append(m.Links, link)
-	}
+		if path == "/pools" && h.timeout != time.Second {
+			t.Errorf("%s has request timeout %v, expected %v", path, h.timeout, time.Second)
+		}
 
-	return []types.MappedIP{m}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
 }
 
-func (ts testCiaoService) MapAddress(tenantID string, name *string, instanceID string) error {
-	return nil
-}
+func TestUnmapIdempotent(t *testing.T) {
+	var ts testCiaoService
 
-func (ts testCiaoService) UnMapAddress(string) error {
-	return nil
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	owner := "/8a497c68-a88a-4c1c-be56-12a4883208d3"
+	other := "/19df9b86-eda3-489d-b75f-d38710e210cb"
+	mapping := "/external-ips/ba58f471-0735-4773-9550-188e2d012941"
+	missing := "/external-ips/76f4fa99-e533-4cbd-ab36-f6c0f51292ed"
+
+	tests := []struct {
+		request        string
+		privileged     bool
+		expectedStatus int
+	}{
+		{mapping, true, http.StatusNoContent},
+		{mapping, true, http.StatusNoContent},
+		{owner + mapping, false, http.StatusNoContent},
+		{owner + mapping, false, http.StatusNoContent},
+		{missing, true, http.StatusNoContent},
+		{owner + missing, false, http.StatusNoContent},
+		{other + mapping, false, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("DELETE", tt.request, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), tt.privileged))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", ExternalIPsV1))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.expectedStatus {
+			t.Errorf("DELETE %s: got %v, expected %v", tt.request, rr.Code, tt.expectedStatus)
+		}
+	}
 }
 
-func (ts testCiaoService) CreateWorkload(req types.Workload) (types.Workload, error) {
-	req.ID = "ba58f471-0735-4773-9550-188e2d012941"
-	return req, nil
+func TestWatchMappedIPs(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	tests := []struct {
+		request          string
+		privileged       bool
+		expectedStatus   int
+		expectedResponse string
+	}{
+		{
+			"/external-ips/watch",
+			true,
+			http.StatusOK,
+			`[{"type":"created","mapping":{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","external_ip":"192.168.0.1","internal_ip":"172.16.0.1","instance_id":"","tenant_id":"8a497c68-a88a-4c1c-be56-12a4883208d3","pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"mypool","status":"reserved","index":0,"links":[{"rel":"self","href":"/external-ips/ba58f471-0735-4773-9550-188e2d012941"},{"rel":"pool","href":"/pools/f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e"}]}}]`,
+		},
+		{
+			"/8a497c68-a88a-4c1c-be56-12a4883208d3/external-ips/watch",
+			false,
+			http.StatusOK,
+			`"tenant_id":"8a497c68-a88a-4c1c-be56-12a4883208d3"`,
+		},
+		{
+			"/19df9b86-eda3-489d-b75f-d38710e210cb/external-ips/watch?timeout=1",
+			false,
+			http.StatusNotModified,
+			"",
+		},
+		{
+			"/external-ips/watch?timeout=0",
+			true,
+			http.StatusBadRequest,
+			"Invalid watch timeout",
+		},
+		{
+			"/external-ips/watch?timeout=soon",
+			true,
+			http.StatusBadRequest,
+			"Invalid watch timeout",
+		},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.request, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), tt.privileged))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", ExternalIPsV1))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.expectedStatus {
+			t.Errorf("%s: got %v, expected %v", tt.request, rr.Code, tt.expectedStatus)
+		}
+
+		if tt.expectedResponse == "" && rr.Body.Len() != 0 {
+			t.Errorf("%s: expected no body, got %s", tt.request, rr.Body.String())
+		}
+
+		if !strings.Contains(rr.Body.String(), tt.expectedResponse) {
+			t.Errorf("%s: expected %s in %s", tt.request, tt.expectedResponse, rr.Body.String())
+		}
+	}
 }
 
-func (ts testCiaoService) DeleteWorkload(tenant string, workload string) error {
-	return nil
+// testAuthorizer denies changes to pools, keeping the requests it is
+// asked about.
+type testAuthorizer struct {
+	requests *[]AuthorizationRequest
 }
 
-func (ts testCiaoService) ShowWorkload(tenant string, ID string) (types.Workload, error) {
-	return types.Workload{
-		ID:          "ba58f471-0735-4773-9550-188e2d012941",
-		TenantID:    tenant,
-		Description: "testWorkload",
-		FWType:      payloads.Legacy,
-		VMType:      payloads.QEMU,
-		Config:      "this will totally work!",
-	}, nil
+func (ta testAuthorizer) Authorize(req AuthorizationRequest) bool {
+	*ta.requests = append(*ta.requests, req)
+
+	return req.Method == http.MethodGet || !strings.HasPrefix(req.Route, "/pools")
 }
 
-func (ts testCiaoService) ListQuotas(tenantID string) []types.QuotaDetails {
-	return []types.QuotaDetails{
-		{Name: "test-quota-1", Value: 10, Usage: 3},
-		{Name: "test-quota-2", Value: -1, Usage: 10},
-		{Name: "test-limit", Value: 123, Usage: 0},
+func TestAuthorizer(t *testing.T) {
+	var ts testCiaoService
+	var requests []AuthorizationRequest
+
+	mux := Routes(Config{URL: "", BasePath: "/ciao", CiaoService: ts, Authorizer: testAuthorizer{&requests}}, nil)
+
+	tests := []struct {
+		method         string
+		request        string
+		expectedStatus int
+	}{
+		{"GET", "/ciao/pools", http.StatusOK},
+		{"DELETE", "/ciao/pools/f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.request, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetScopes(req.Context(), service.ScopePoolsWrite))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", PoolsV1))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.expectedStatus {
+			t.Errorf("%s %s: got %v, expected %v", tt.method, tt.request, rr.Code, tt.expectedStatus)
+		}
+	}
+
+	expected := AuthorizationRequest{
+		Method:     "DELETE",
+		Path:       "/pools/f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e",
+		Route:      "/pools/{pool}",
+		Privileged: true,
+		Scopes:     []string{service.ScopePoolsWrite},
+	}
+
+	if len(requests) != 2 || !reflect.DeepEqual(requests[1], expected) {
+		t.Fatalf("expected %+v, got %+v", expected, requests)
 	}
 }
 
-func (ts testCiaoService) UpdateQuotas(tenantID string, qds []types.QuotaDetails) error {
-	return nil
+type testConfigTransformer struct{}
+
+func (tc testConfigTransformer) TransformConfig(tenantID string, config string) (string, error) {
+	if strings.Contains(config, "forbidden") {
+		return "", errors.New("forbidden config")
+	}
+
+	return config + "\n# added for " + tenantID, nil
 }
 
-func TestResponse(t *testing.T) {
+func TestConfigTransformer(t *testing.T) {
 	var ts testCiaoService
 
-	mux := Routes(Config{"", ts}, nil)
+	mux := Routes(Config{URL: "", CiaoService: ts, ConfigTransformer: testConfigTransformer{}}, nil)
 
-	for i, tt := range tests {
-		req, err := http.NewRequest(tt.method, tt.request, bytes.NewBuffer([]byte(tt.requestBody)))
+	tests := []struct {
+		config           string
+		expectedStatus   int
+		expectedResponse string
+	}{
+		{
+			"this will totally work!",
+			http.StatusCreated,
+			`"config":"this will totally work!\n# added for public"`,
+		},
+		{
+			"forbidden",
+			http.StatusUnprocessableEntity,
+			`{"error":{"code":422,"name":"Unprocessable Entity","message":"Workload config rejected","details":{"reason":"forbidden config"}}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		body := fmt.Sprintf(`{"description":"testWorkload","fw_type":"legacy","vm_type":"qemu","config":%q}`, tt.config)
+
+		req, err := http.NewRequest("POST", "/workloads", bytes.NewBufferString(body))
 		if err != nil {
 			t.Fatal(err)
 		}
 
 		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", WorkloadsV1))
 
 		rr := httptest.NewRecorder()
-		req.Header.Set("Content-Type", tt.media)
-
 		mux.ServeHTTP(rr, req)
 
-		status := rr.Code
-		if status != tt.expectedStatus {
-			t.Errorf("test %d: got %v, expected %v", i, status, tt.expectedStatus)
+		if rr.Code != tt.expectedStatus {
+			t.Errorf("%s: got %v, expected %v", tt.config, rr.Code, tt.expectedStatus)
 		}
 
-		if rr.Body.String() != tt.expectedResponse {
-			t.Errorf("test %d: %s: failed\ngot: %v\nexp: %v", i, tt.request, rr.Body.String(), tt.expectedResponse)
+		if !strings.Contains(rr.Body.String(), tt.expectedResponse) {
+			t.Errorf("%s: expected %s in %s", tt.config, tt.expectedResponse, rr.Body.String())
+		}
+	}
+}
+
+func TestWorkloadOwnership(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	owner := "/8a497c68-a88a-4c1c-be56-12a4883208d3"
+	other := "/19df9b86-eda3-489d-b75f-d38710e210cb"
+	private := "/workloads/ba58f471-0735-4773-9550-188e2d012941"
+	public := "/workloads/76f4fa99-e533-4cbd-ab36-f6c0f51292ed"
+
+	tests := []struct {
+		method         string
+		request        string
+		privileged     bool
+		expectedStatus int
+	}{
+		{"GET", owner + private, false, http.StatusOK},
+		{"GET", other + private, false, http.StatusNotFound},
+		{"GET", private, true, http.StatusOK},
+		{"GET", other + public, false, http.StatusOK},
+		{"DELETE", owner + private, false, http.StatusNoContent},
+		{"DELETE", other + private, false, http.StatusNotFound},
+		{"DELETE", private, true, http.StatusNoContent},
+		{"DELETE", other + public, false, http.StatusForbidden},
+		{"DELETE", public, true, http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.request, nil)
+		if err != nil {
+			t.Fatal(err)
 		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), tt.privileged))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", WorkloadsV1))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.expectedStatus {
+			t.Errorf("%s %s: got %v, expected %v", tt.method, tt.request, rr.Code, tt.expectedStatus)
+		}
+	}
+}
+
+func TestSummarizeQuotas(t *testing.T) {
+	qds := []types.QuotaDetails{
+		{Name: "tenant-instances-quota", Value: 10, Usage: 9},
+		{Name: "tenant-vcpu-quota", Value: 10, Usage: 8},
+		{Name: "tenant-mem-quota", Value: -1, Usage: 1024},
+		{Name: "tenant-storage-quota", Value: 0, Usage: 0},
+		{Name: "tenant-external-ips-quota", Value: 5, Usage: 5},
+		{Name: "instance-vcpu-limit", Value: 1},
+		{Name: "instance-mem-limit", Value: -1},
+	}
+
+	expected := types.QuotaSummary{Total: 7, NearLimit: 2, Unlimited: 2}
+
+	summary := summarizeQuotas(qds)
+	if summary != expected {
+		t.Fatalf("got %+v, expected %+v", summary, expected)
 	}
 }
 
 func TestRoutes(t *testing.T) {
 	var ts testCiaoService
-	config := Config{"", ts}
+	config := Config{URL: "", CiaoService: ts}
 
 	r := Routes(config, nil)
 	if r == nil {
 		t.Fatalf("No routes returned")
 	}
 }
+
+func TestShutdown(t *testing.T) {
+	for _, test := range []struct {
+		timeout  time.Duration
+		finishes bool
+	}{
+		{10 * time.Second, true},
+		{50 * time.Millisecond, false},
+	} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		started := make(chan struct{})
+		release := make(chan struct{})
+
+		server := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				<-release
+				w.WriteHeader(http.StatusOK)
+			}),
+		}
+		go func() { _ = server.Serve(listener) }()
+
+		result := make(chan error)
+		go func() {
+			resp, err := http.Get(fmt.Sprintf("http://%s/", listener.Addr()))
+			if err == nil {
+				resp.Body.Close()
+			}
+			result <- err
+		}()
+
+		<-started
+
+		shutdown := make(chan error)
+		go func() { shutdown <- Shutdown(server, test.timeout) }()
+
+		if test.finishes {
+			close(release)
+
+			if err := <-result; err != nil {
+				t.Fatalf("in-flight request failed: %v", err)
+			}
+
+			if err := <-shutdown; err != nil {
+				t.Fatalf("unexpected shutdown error: %v", err)
+			}
+		} else {
+			if err := <-shutdown; err != context.DeadlineExceeded {
+				t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+			}
+
+			if err := <-result; err == nil {
+				t.Fatal("request outlasting the shutdown timeout not cut off")
+			}
+
+			close(release)
+		}
+
+		_, err = net.Dial("tcp", listener.Addr().String())
+		if err == nil {
+			t.Fatal("server still accepting connections")
+		}
+	}
+}
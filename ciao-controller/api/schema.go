@@ -0,0 +1,176 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/01org/ciao/ciao-controller/types"
+	"github.com/gorilla/mux"
+)
+
+// errNoSchema is returned when the schema of a resource the API does not
+// describe is asked for.
+var errNoSchema = errors.New("No schema for resource")
+
+// schemaTypes are the types whose JSON schemas are served, keyed by the
+// name of the resource as it appears in paths.
+var schemaTypes = map[string]reflect.Type{
+	"pools":        reflect.TypeOf(types.Pool{}),
+	"external-ips": reflect.TypeOf(types.MappedIP{}),
+	"workloads":    reflect.TypeOf(types.Workload{}),
+	"tenants":      reflect.TypeOf(types.Tenant{}),
+	"quotas":       reflect.TypeOf(types.QuotaDetails{}),
+}
+
+// schemaOverrides describe the types with their own JSON marshallers,
+// whose fields say nothing about what they are marshalled as.
+var schemaOverrides = map[reflect.Type]map[string]interface{}{
+	reflect.TypeOf(time.Time{}): {
+		"type":   "string",
+		"format": "date-time",
+	},
+	// quota values are strings so that they may be "unlimited", and
+	// limits have no usage.
+	reflect.TypeOf(types.QuotaDetails{}): {
+		"type": "object",
+		"properties": map[string]interface{}{
+			"name":          map[string]interface{}{"type": "string"},
+			"value":         map[string]interface{}{"type": "string"},
+			"usage":         map[string]interface{}{"type": "string"},
+			"unit":          map[string]interface{}{"type": "string"},
+			"usage_percent": map[string]interface{}{"type": []string{"number", "null"}},
+		},
+		"required": []string{"name", "value"},
+	},
+}
+
+// jsonSchema describes the JSON encoding/json gives values of type t.
+func jsonSchema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if s, ok := schemaOverrides[t]; ok {
+		return s
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		// byte slices are base64 encoded.
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string"}
+		}
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		return structSchema(t)
+	}
+
+	// interfaces may hold anything.
+	return map[string]interface{}{}
+}
+
+// structSchema describes a struct by the fields encoding/json marshals,
+// using the names given in their json tags. Fields which are not omitted
+// when empty are always present, so are required.
+func structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := []string{}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		options := strings.Split(tag, ",")
+		name := options[0]
+
+		// the fields of untagged embedded structs are promoted.
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			embedded := structSchema(f.Type)
+			for k, v := range embedded["properties"].(map[string]interface{}) {
+				properties[k] = v
+			}
+			required = append(required, embedded["required"].([]string)...)
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		properties[name] = jsonSchema(f.Type)
+
+		omitEmpty := false
+		for _, o := range options[1:] {
+			if o == "omitempty" {
+				omitEmpty = true
+			}
+		}
+
+		if !omitEmpty {
+			required = append(required, name)
+		}
+	}
+
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+}
+
+// showSchema returns the JSON schema of one of the resources of the API,
+// for clients which want to check a single type rather than the whole of
+// the API.
+func showSchema(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	resource := mux.Vars(r)["resource"]
+
+	t, ok := schemaTypes[resource]
+	if !ok {
+		return errorResponse(errNoSchema), errNoSchema
+	}
+
+	schema := map[string]interface{}{
+		"$schema": "http://json-schema.org/draft-04/schema#",
+		"title":   resource,
+	}
+	for k, v := range jsonSchema(t) {
+		schema[k] = v
+	}
+
+	return Response{http.StatusOK, staticDocument{schema}}, nil
+}
@@ -0,0 +1,499 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/01org/ciao/ciao-controller/types"
+)
+
+// serverTiming records how long a request has spent in the service
+// layer. Requests which time out leave their handler running, so it may
+// be added to while the response is being written.
+type serverTiming struct {
+	sync.Mutex
+	service time.Duration
+	calls   int
+}
+
+// mark starts timing a service call, returning the function which ends
+// it.
+func (t *serverTiming) mark() func() {
+	start := time.Now()
+
+	return func() {
+		t.Lock()
+		t.service += time.Since(start)
+		t.calls++
+		t.Unlock()
+	}
+}
+
+// milliseconds formats a duration as the dur of a Server-Timing metric.
+func milliseconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", float64(d)/float64(time.Millisecond))
+}
+
+// setHeader sets the Server-Timing header of a response, giving the time
+// spent in the service layer, in the handler as a whole and the budget
+// the response was expected to be made within.
+func (t *serverTiming) setHeader(w http.ResponseWriter, handler time.Duration, budget time.Duration) {
+	t.Lock()
+	metrics := []string{
+		fmt.Sprintf(`service;desc="calls=%d";dur=%s`, t.calls, milliseconds(t.service)),
+		fmt.Sprintf("handler;dur=%s", milliseconds(handler)),
+		fmt.Sprintf("budget;dur=%s", milliseconds(budget)),
+	}
+	t.Unlock()
+
+	w.Header().Set("Server-Timing", strings.Join(metrics, ", "))
+}
+
+// timedService adds the time spent in each call to a Service to a
+// request's serverTiming.
+type timedService struct {
+	Service
+	timing *serverTiming
+}
+
+func (s *timedService) AddPool(name string, subnet *string, ips []string, tags []string, description string, tenantID string) (types.Pool, error) {
+	defer s.timing.mark()()
+	return s.Service.AddPool(name, subnet, ips, tags, description, tenantID)
+}
+
+func (s *timedService) ListPools() ([]types.Pool, error) {
+	defer s.timing.mark()()
+	return s.Service.ListPools()
+}
+
+func (s *timedService) ShowPool(id string) (types.Pool, error) {
+	defer s.timing.mark()()
+	return s.Service.ShowPool(id)
+}
+
+func (s *timedService) PoolActivity(id string, limit int) ([]types.LogEntry, error) {
+	defer s.timing.mark()()
+	return s.Service.PoolActivity(id, limit)
+}
+
+func (s *timedService) DeletePool(id string, force bool) error {
+	defer s.timing.mark()()
+	return s.Service.DeletePool(id, force)
+}
+
+func (s *timedService) UpdatePoolDescription(id string, description string) error {
+	defer s.timing.mark()()
+	return s.Service.UpdatePoolDescription(id, description)
+}
+
+func (s *timedService) UpdatePoolTags(id string, tags []string) error {
+	defer s.timing.mark()()
+	return s.Service.UpdatePoolTags(id, tags)
+}
+
+func (s *timedService) ExportPools() (types.PoolExport, error) {
+	defer s.timing.mark()()
+	return s.Service.ExportPools()
+}
+
+func (s *timedService) ImportPools(export types.PoolExport) ([]types.Pool, error) {
+	defer s.timing.mark()()
+	return s.Service.ImportPools(export)
+}
+
+func (s *timedService) AddPools(reqs []types.NewPoolRequest) ([]types.Pool, []error) {
+	defer s.timing.mark()()
+	return s.Service.AddPools(reqs)
+}
+
+func (s *timedService) ValidatePools(reqs []types.NewPoolRequest) ([]types.PoolConflict, error) {
+	defer s.timing.mark()()
+	return s.Service.ValidatePools(reqs)
+}
+
+func (s *timedService) RenamePool(id string, name string) error {
+	defer s.timing.mark()()
+	return s.Service.RenamePool(id, name)
+}
+
+func (s *timedService) UpdatePoolIPs(poolID string, add []string, remove []string, force bool) error {
+	defer s.timing.mark()()
+	return s.Service.UpdatePoolIPs(poolID, add, remove, force)
+}
+
+func (s *timedService) DrainPool(id string, drained bool) error {
+	defer s.timing.mark()()
+	return s.Service.DrainPool(id, drained)
+}
+
+func (s *timedService) DrainSubnet(poolID string, subnetID string, drained bool) error {
+	defer s.timing.mark()()
+	return s.Service.DrainSubnet(poolID, subnetID, drained)
+}
+
+func (s *timedService) ShowSubnet(poolID string, subnetID string, offset int, limit int) (types.SubnetInventory, error) {
+	defer s.timing.mark()()
+	return s.Service.ShowSubnet(poolID, subnetID, offset, limit)
+}
+
+func (s *timedService) SubnetBitmap(poolID string, subnetID string) (types.SubnetBitmap, error) {
+	defer s.timing.mark()()
+	return s.Service.SubnetBitmap(poolID, subnetID)
+}
+
+func (s *timedService) PoolFragmentation(poolID string) (types.PoolFragmentation, error) {
+	defer s.timing.mark()()
+	return s.Service.PoolFragmentation(poolID)
+}
+
+func (s *timedService) PoolSelection() string {
+	defer s.timing.mark()()
+	return s.Service.PoolSelection()
+}
+
+func (s *timedService) MigratePool(fromID string, toID string, dryRun bool) (types.PoolMigration, error) {
+	defer s.timing.mark()()
+	return s.Service.MigratePool(fromID, toID, dryRun)
+}
+
+func (s *timedService) PoolCapacity() types.PoolCapacity {
+	defer s.timing.mark()()
+	return s.Service.PoolCapacity()
+}
+
+func (s *timedService) RebalancePools(apply bool) (types.PoolRebalance, error) {
+	defer s.timing.mark()()
+	return s.Service.RebalancePools(apply)
+}
+
+func (s *timedService) FindPoolByIP(address string) (types.Pool, error) {
+	defer s.timing.mark()()
+	return s.Service.FindPoolByIP(address)
+}
+
+func (s *timedService) AddAddress(poolID string, subnet *string, IPs []string) error {
+	defer s.timing.mark()()
+	return s.Service.AddAddress(poolID, subnet, IPs)
+}
+
+func (s *timedService) RemoveAddress(poolID string, subnetID *string, IPID *string) error {
+	defer s.timing.mark()()
+	return s.Service.RemoveAddress(poolID, subnetID, IPID)
+}
+
+func (s *timedService) ListMappedAddresses(tenantID *string) []types.MappedIP {
+	defer s.timing.mark()()
+	return s.Service.ListMappedAddresses(tenantID)
+}
+
+func (s *timedService) CountMappedAddresses(filter types.MappedIPFilter) int {
+	defer s.timing.mark()()
+	return s.Service.CountMappedAddresses(filter)
+}
+
+func (s *timedService) WatchMappedAddresses(tenantID *string) (<-chan types.MappedIPChange, func()) {
+	defer s.timing.mark()()
+	return s.Service.WatchMappedAddresses(tenantID)
+}
+
+func (s *timedService) MapAddress(tenantID string, poolName *string, instanceID string, internalIP string, role string, lease time.Duration) (types.MappedIP, error) {
+	defer s.timing.mark()()
+	return s.Service.MapAddress(tenantID, poolName, instanceID, internalIP, role, lease)
+}
+
+func (s *timedService) InstanceExists(tenantID string, instanceID string) (bool, error) {
+	defer s.timing.mark()()
+	return s.Service.InstanceExists(tenantID, instanceID)
+}
+
+func (s *timedService) PreviewAllocation(tenantID string, poolName string) (types.ExternalIP, error) {
+	defer s.timing.mark()()
+	return s.Service.PreviewAllocation(tenantID, poolName)
+}
+
+func (s *timedService) NextFreeAddress(poolID string) (types.ExternalIP, error) {
+	defer s.timing.mark()()
+	return s.Service.NextFreeAddress(poolID)
+}
+
+func (s *timedService) RemapAddress(tenantID string, address string, instanceID string) error {
+	defer s.timing.mark()()
+	return s.Service.RemapAddress(tenantID, address, instanceID)
+}
+
+func (s *timedService) SwapAddresses(a string, b string) error {
+	defer s.timing.mark()()
+	return s.Service.SwapAddresses(a, b)
+}
+
+func (s *timedService) SetMappingLabels(tenantID string, address string, labels map[string]string) (types.MappedIP, error) {
+	defer s.timing.mark()()
+	return s.Service.SetMappingLabels(tenantID, address, labels)
+}
+
+func (s *timedService) LabelMappings(filter types.MappedIPFilter, labels map[string]string) (int, error) {
+	defer s.timing.mark()()
+	return s.Service.LabelMappings(filter, labels)
+}
+
+func (s *timedService) AddressHistory(address string) ([]types.AssignmentRecord, error) {
+	defer s.timing.mark()()
+	return s.Service.AddressHistory(address)
+}
+
+func (s *timedService) UnMapAddress(ID string) error {
+	defer s.timing.mark()()
+	return s.Service.UnMapAddress(ID)
+}
+
+func (s *timedService) ReleaseInstanceAddresses(instanceID string) (int, error) {
+	defer s.timing.mark()()
+	return s.Service.ReleaseInstanceAddresses(instanceID)
+}
+
+func (s *timedService) AddAddressReservation(cidr string, label string) (types.AddressReservation, error) {
+	defer s.timing.mark()()
+	return s.Service.AddAddressReservation(cidr, label)
+}
+
+func (s *timedService) ListAddressReservations() []types.AddressReservation {
+	defer s.timing.mark()()
+	return s.Service.ListAddressReservations()
+}
+
+func (s *timedService) DeleteAddressReservation(ID string) error {
+	defer s.timing.mark()()
+	return s.Service.DeleteAddressReservation(ID)
+}
+
+func (s *timedService) ReleaseAddresses(tenantID string, poolID string) ([]types.MappedIP, error) {
+	defer s.timing.mark()()
+	return s.Service.ReleaseAddresses(tenantID, poolID)
+}
+
+func (s *timedService) ReserveBlock(tenantID string, poolName string, count int) ([]types.MappedIP, error) {
+	defer s.timing.mark()()
+	return s.Service.ReserveBlock(tenantID, poolName, count)
+}
+
+func (s *timedService) ReleaseBlock(tenantID string, blockID string) (int, error) {
+	defer s.timing.mark()()
+	return s.Service.ReleaseBlock(tenantID, blockID)
+}
+
+func (s *timedService) ClaimAddresses(tenantID string, poolName string, count int, ttl time.Duration) (types.ExternalIPClaim, error) {
+	defer s.timing.mark()()
+	return s.Service.ClaimAddresses(tenantID, poolName, count, ttl)
+}
+
+func (s *timedService) CommitClaim(tenantID string, token string, instanceIDs []string) ([]types.MappedIP, error) {
+	defer s.timing.mark()()
+	return s.Service.CommitClaim(tenantID, token, instanceIDs)
+}
+
+func (s *timedService) ReclaimableAddresses(poolID string, olderThan time.Duration) ([]types.ReclaimableAddress, error) {
+	defer s.timing.mark()()
+	return s.Service.ReclaimableAddresses(poolID, olderThan)
+}
+
+func (s *timedService) ReclaimAddresses(poolID string, olderThan time.Duration) (int, error) {
+	defer s.timing.mark()()
+	return s.Service.ReclaimAddresses(poolID, olderThan)
+}
+
+func (s *timedService) CreateWorkload(req types.Workload) (types.Workload, error) {
+	defer s.timing.mark()()
+	return s.Service.CreateWorkload(req)
+}
+
+func (s *timedService) CreateWorkloadAsync(req types.Workload) (types.WorkloadOperation, error) {
+	defer s.timing.mark()()
+	return s.Service.CreateWorkloadAsync(req)
+}
+
+func (s *timedService) Provision(tenantID string, req *types.Workload, workloadID string, poolName *string) (types.Workload, types.MappedIP, error) {
+	defer s.timing.mark()()
+	return s.Service.Provision(tenantID, req, workloadID, poolName)
+}
+
+func (s *timedService) WorkloadStatus(tenantID string, workloadID string) (types.WorkloadOperation, error) {
+	defer s.timing.mark()()
+	return s.Service.WorkloadStatus(tenantID, workloadID)
+}
+
+func (s *timedService) ValidateWorkload(req types.Workload) types.WorkloadValidation {
+	defer s.timing.mark()()
+	return s.Service.ValidateWorkload(req)
+}
+
+func (s *timedService) DeleteWorkload(tenantID string, workloadID string) error {
+	defer s.timing.mark()()
+	return s.Service.DeleteWorkload(tenantID, workloadID)
+}
+
+func (s *timedService) TransferWorkload(workloadID string, targetTenantID string) error {
+	defer s.timing.mark()()
+	return s.Service.TransferWorkload(workloadID, targetTenantID)
+}
+
+func (s *timedService) UpdateWorkload(req types.Workload) (types.Workload, error) {
+	defer s.timing.mark()()
+	return s.Service.UpdateWorkload(req)
+}
+
+func (s *timedService) ShowWorkload(tenantID string, workloadID string) (types.Workload, error) {
+	defer s.timing.mark()()
+	return s.Service.ShowWorkload(tenantID, workloadID)
+}
+
+func (s *timedService) WorkloadInstanceCounts(tenantID string) map[string]int {
+	defer s.timing.mark()()
+	return s.Service.WorkloadInstanceCounts(tenantID)
+}
+
+func (s *timedService) CountWorkloads(tenantID string, fwType string) (int, error) {
+	defer s.timing.mark()()
+	return s.Service.CountWorkloads(tenantID, fwType)
+}
+
+func (s *timedService) ListWorkloads(tenantID string) ([]types.Workload, error) {
+	defer s.timing.mark()()
+	return s.Service.ListWorkloads(tenantID)
+}
+
+func (s *timedService) CreateTenant(t types.Tenant) (types.Tenant, error) {
+	defer s.timing.mark()()
+	return s.Service.CreateTenant(t)
+}
+
+func (s *timedService) SetTenantEnabled(tenantID string, enabled bool) error {
+	defer s.timing.mark()()
+	return s.Service.SetTenantEnabled(tenantID, enabled)
+}
+
+func (s *timedService) DeleteTenantResources(tenantID string, cascade bool) ([]types.TenantResourceResult, []error, error) {
+	defer s.timing.mark()()
+	return s.Service.DeleteTenantResources(tenantID, cascade)
+}
+
+func (s *timedService) ListQuotas(tenantID string) []types.QuotaDetails {
+	defer s.timing.mark()()
+	return s.Service.ListQuotas(tenantID)
+}
+
+func (s *timedService) QuotaBreakdown(tenantID string) ([]types.QuotaBreakdown, error) {
+	defer s.timing.mark()()
+	return s.Service.QuotaBreakdown(tenantID)
+}
+
+func (s *timedService) ListQuotaDefinitions() []types.QuotaDefinition {
+	defer s.timing.mark()()
+	return s.Service.ListQuotaDefinitions()
+}
+
+func (s *timedService) ExceededQuotas() ([]types.TenantExceededQuotas, error) {
+	defer s.timing.mark()()
+	return s.Service.ExceededQuotas()
+}
+
+func (s *timedService) QuotaSnapshot(tenantID string) (types.QuotaSnapshot, error) {
+	defer s.timing.mark()()
+	return s.Service.QuotaSnapshot(tenantID)
+}
+
+func (s *timedService) RestoreQuotas(tenantID string, snapshot types.QuotaSnapshot) ([]types.SkippedQuota, error) {
+	defer s.timing.mark()()
+	return s.Service.RestoreQuotas(tenantID, snapshot)
+}
+
+func (s *timedService) EffectiveQuotas(tenantID string) ([]types.EffectiveQuota, error) {
+	defer s.timing.mark()()
+	return s.Service.EffectiveQuotas(tenantID)
+}
+
+func (s *timedService) UpdateQuotas(tenantID string, qds []types.QuotaDetails) error {
+	defer s.timing.mark()()
+	return s.Service.UpdateQuotas(tenantID, qds)
+}
+
+func (s *timedService) ListSubQuotas(tenantID string, sub string) []types.QuotaDetails {
+	defer s.timing.mark()()
+	return s.Service.ListSubQuotas(tenantID, sub)
+}
+
+func (s *timedService) UpdateSubQuotas(tenantID string, sub string, qds []types.QuotaDetails) error {
+	defer s.timing.mark()()
+	return s.Service.UpdateSubQuotas(tenantID, sub, qds)
+}
+
+func (s *timedService) RecordTenantEvent(event types.Event) {
+	defer s.timing.mark()()
+	s.Service.RecordTenantEvent(event)
+}
+
+func (s *timedService) TenantEvents(tenantID string) ([]types.Event, error) {
+	defer s.timing.mark()()
+	return s.Service.TenantEvents(tenantID)
+}
+
+func (s *timedService) WatchTenantEvents(tenantID string) (<-chan types.Event, func(), error) {
+	defer s.timing.mark()()
+	return s.Service.WatchTenantEvents(tenantID)
+}
+
+func (s *timedService) TenantChurn(tenantID string, window time.Duration) (types.TenantChurn, error) {
+	defer s.timing.mark()()
+	return s.Service.TenantChurn(tenantID, window)
+}
+
+func (s *timedService) TenantDefaultPool(tenantID string) (types.DefaultPool, error) {
+	defer s.timing.mark()()
+	return s.Service.TenantDefaultPool(tenantID)
+}
+
+func (s *timedService) SetTenantDefaultPool(tenantID string, poolName string) error {
+	defer s.timing.mark()()
+	return s.Service.SetTenantDefaultPool(tenantID, poolName)
+}
+
+func (s *timedService) TenantPoolStrategy(tenantID string) (types.TenantPoolStrategy, error) {
+	defer s.timing.mark()()
+	return s.Service.TenantPoolStrategy(tenantID)
+}
+
+func (s *timedService) SetTenantPoolStrategy(tenantID string, strategy string) error {
+	defer s.timing.mark()()
+	return s.Service.SetTenantPoolStrategy(tenantID, strategy)
+}
+
+func (s *timedService) PoolOrder(tenantID string) (types.PoolOrder, error) {
+	defer s.timing.mark()()
+	return s.Service.PoolOrder(tenantID)
+}
+
+func (s *timedService) RecalculateUsage(tenantID string) error {
+	defer s.timing.mark()()
+	return s.Service.RecalculateUsage(tenantID)
+}
+
+func (s *timedService) Health() (types.HealthReport, error) {
+	defer s.timing.mark()()
+	return s.Service.Health()
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/01org/ciao/ciao-controller/types"
+	"github.com/golang/glog"
+)
+
+const (
+	// ExternalIPMapped is the type of the event sent when an external
+	// IP is mapped or reserved.
+	ExternalIPMapped = "external-ip-mapped"
+
+	// ExternalIPUnmapped is the type of the event sent when an external
+	// IP is unmapped.
+	ExternalIPUnmapped = "external-ip-unmapped"
+
+	// WebhookTest is the type of the synthetic event sent when the
+	// webhook is tested. It concerns no mapping.
+	WebhookTest = "webhook-test"
+)
+
+// webhookAttempts is the number of times delivery of an event is tried.
+const webhookAttempts = 3
+
+// webhookRetryInterval is how long to wait after the first failed delivery.
+// The wait doubles after each further failure.
+var webhookRetryInterval = time.Second
+
+// ExternalIPEvent is the body of the request sent to the webhook.
+type ExternalIPEvent struct {
+	Type     string         `json:"type"`
+	TenantID string         `json:"tenant_id"`
+	Mapping  types.MappedIP `json:"mapping"`
+}
+
+// WebhookTestResult is the outcome of sending a WebhookTest event to the
+// webhook. Status is the HTTP status code of the webhook's response, and
+// is zero if it could not be reached.
+type WebhookTestResult struct {
+	URL       string `json:"url"`
+	Status    int    `json:"status,omitempty"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+type webhook struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhook(url string) *webhook {
+	if url == "" {
+		return nil
+	}
+
+	return &webhook{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// notify sends an event to the webhook in the background. Delivery
+// failures are logged, they never fail the request which caused them.
+func (wh *webhook) notify(eventType string, m types.MappedIP) {
+	if wh == nil {
+		return
+	}
+
+	event := ExternalIPEvent{
+		Type:     eventType,
+		TenantID: m.TenantID,
+		Mapping:  m,
+	}
+
+	go wh.deliver(event)
+}
+
+func (wh *webhook) deliver(event ExternalIPEvent) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		glog.Warningf("Unable to marshal %s event: %v", event.Type, err)
+		return
+	}
+
+	delay := webhookRetryInterval
+
+	for attempt := 1; ; attempt++ {
+		_, err = wh.post(b)
+		if err == nil {
+			return
+		}
+
+		if attempt == webhookAttempts {
+			break
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+
+	glog.Warningf("Unable to deliver %s event for %s: %v", event.Type, event.Mapping.ExternalIP, err)
+}
+
+// test sends a WebhookTest event to the webhook once, without retrying,
+// and reports how the delivery went.
+func (wh *webhook) test() WebhookTestResult {
+	result := WebhookTestResult{
+		URL: wh.url,
+	}
+
+	b, err := json.Marshal(ExternalIPEvent{Type: WebhookTest})
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	start := time.Now()
+	result.Status, err = wh.post(b)
+	result.LatencyMS = int64(time.Since(start) / time.Millisecond)
+
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+// post sends b to the webhook, returning the status code of its response.
+func (wh *webhook) post(b []byte) (int, error) {
+	resp, err := wh.client.Post(wh.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
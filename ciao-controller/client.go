@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/01org/ciao/ciao-controller/types"
@@ -44,22 +45,32 @@ type controllerClient interface {
 	attachVolume(volID string, instanceID string, nodeID string) error
 	detachVolume(volID string, instanceID string, nodeID string) error
 	ssntpClient() *ssntp.Client
+	isConnected() bool
 }
 
 type ssntpClient struct {
 	ctl   *controller
 	ssntp ssntp.Client
 	name  string
+
+	// connected is 1 while the client is connected to the scheduler.
+	connected int32
 }
 
 func (client *ssntpClient) ConnectNotify() {
+	atomic.StoreInt32(&client.connected, 1)
 	glog.Info(client.name, " connected")
 }
 
 func (client *ssntpClient) DisconnectNotify() {
+	atomic.StoreInt32(&client.connected, 0)
 	glog.Info(client.name, " disconnected")
 }
 
+func (client *ssntpClient) isConnected() bool {
+	return atomic.LoadInt32(&client.connected) == 1
+}
+
 func (client *ssntpClient) StatusNotify(status ssntp.Status, frame *ssntp.Frame) {
 	glog.Info("STATUS for ", client.name)
 }
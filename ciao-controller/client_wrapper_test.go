@@ -119,6 +119,10 @@ func (client *ssntpClientWrapper) ssntpClient() *ssntp.Client {
 	return client.realClient.ssntpClient()
 }
 
+func (client *ssntpClientWrapper) isConnected() bool {
+	return client.realClient.isConnected()
+}
+
 func (client *ssntpClientWrapper) Disconnect() {
 	client.realClient.Disconnect()
 	client.closeClientChans()
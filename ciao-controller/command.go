@@ -22,6 +22,7 @@ import (
 
 	"github.com/01org/ciao/ciao-controller/types"
 	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp/uuid"
 	"github.com/pkg/errors"
 )
 
@@ -122,6 +123,136 @@ func (c *controller) confirmTenantRaw(tenantID string) error {
 	return nil
 }
 
+// CreateTenant creates a named tenant along with its CNCI manager. A
+// new ID is generated if one is not supplied.
+func (c *controller) CreateTenant(t types.Tenant) (types.Tenant, error) {
+	if t.Name == "" {
+		return types.Tenant{}, types.ErrInvalidTenantName
+	}
+
+	if t.ID == "" {
+		t.ID = uuid.Generate().String()
+	}
+
+	tenant, err := c.ds.CreateTenant(t.ID, t.Name)
+	if err != nil {
+		return types.Tenant{}, err
+	}
+
+	tenant.CNCIctrl, err = newCNCIManager(c, tenant.ID)
+	if err != nil {
+		return types.Tenant{}, err
+	}
+
+	return *tenant, nil
+}
+
+// SetTenantEnabled suspends or resumes a tenant. A suspended tenant
+// keeps its resources but cannot change them.
+func (c *controller) SetTenantEnabled(tenantID string, enabled bool) error {
+	return c.ds.SetTenantEnabled(tenantID, enabled)
+}
+
+// DeleteTenantResources removes the external IPs, workloads and quota
+// overrides of a tenant, returning the result of removing each along
+// with any error. Unless cascade is set nothing is removed, and
+// types.ErrTenantHasResources returned, if the tenant has any workloads,
+// instances or external IPs. Resources which have already gone are not
+// errors, so a deletion which failed part way can be repeated. The
+// tenant itself, with its network, is kept.
+func (c *controller) DeleteTenantResources(tenantID string, cascade bool) ([]types.TenantResourceResult, []error, error) {
+	t, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if t == nil {
+		return nil, nil, types.ErrTenantNotFound
+	}
+
+	wls, err := c.ds.GetWorkloads(tenantID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// public workloads are not the tenant's.
+	var owned []types.Workload
+	for _, wl := range wls {
+		if wl.TenantID == tenantID {
+			owned = append(owned, wl)
+		}
+	}
+
+	mappings := c.ds.GetMappedIPs(&tenantID)
+
+	if !cascade {
+		instances, err := c.ds.GetAllInstancesFromTenant(tenantID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(owned) > 0 || len(mappings) > 0 || len(instances) > 0 {
+			return nil, nil, types.ErrTenantHasResources
+		}
+	}
+
+	results := []types.TenantResourceResult{}
+	var errs []error
+
+	for _, m := range mappings {
+		err := c.UnMapAddress(m.ExternalIP)
+		if err == types.ErrAddressNotFound {
+			err = nil
+		}
+
+		results = append(results, types.TenantResourceResult{Type: types.TenantResourceExternalIP, ID: m.ID})
+		errs = append(errs, err)
+	}
+
+	for _, wl := range owned {
+		err := c.ds.DeleteWorkload(tenantID, wl.ID)
+		if err == types.ErrWorkloadNotFound {
+			err = nil
+		}
+
+		results = append(results, types.TenantResourceResult{Type: types.TenantResourceWorkload, ID: wl.ID})
+		errs = append(errs, err)
+	}
+
+	overrides, err := c.ds.GetQuotas(tenantID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(overrides) > 0 {
+		err = c.ds.DeleteQuotas(tenantID)
+
+		defaults := make([]types.QuotaDetails, 0, len(overrides))
+		for _, qd := range overrides {
+			results = append(results, types.TenantResourceResult{Type: types.TenantResourceQuota, ID: qd.Name})
+			errs = append(errs, err)
+			defaults = append(defaults, types.QuotaDetails{Name: qd.Name, Value: -1})
+		}
+
+		if err == nil {
+			c.qs.Update(tenantID, defaults)
+		}
+	}
+
+	return results, errs, nil
+}
+
+// TenantEnabled returns false if the tenant has been suspended. Tenants
+// which are not yet known to the controller are enabled.
+func (c *controller) TenantEnabled(tenantID string) (bool, error) {
+	tenant, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return false, err
+	}
+
+	return tenant == nil || tenant.Enabled, nil
+}
+
 func (c *controller) confirmTenant(tenantID string) error {
 	c.tenantReadinessLock.Lock()
 	memo := c.tenantReadiness[tenantID]
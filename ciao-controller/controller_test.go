@@ -17,13 +17,19 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -35,9 +41,11 @@ import (
 	"github.com/01org/ciao/ciao-storage"
 	"github.com/01org/ciao/openstack/block"
 	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/service"
 	"github.com/01org/ciao/ssntp"
 	"github.com/01org/ciao/ssntp/uuid"
 	"github.com/01org/ciao/testutil"
+	"github.com/gorilla/mux"
 )
 
 func addTestWorkload(tenantID string) error {
@@ -1516,7 +1524,7 @@ func TestListVolumesDetail(t *testing.T) {
 }
 
 func testAddPool(t *testing.T, name string, subnet *string, ips []string) {
-	pool, err := ctl.AddPool(name, subnet, ips)
+	pool, err := ctl.AddPool(name, subnet, ips, nil, "", "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1525,9 +1533,14 @@ func testAddPool(t *testing.T, name string, subnet *string, ips []string) {
 		t.Fatal("id not set")
 	}
 
+	if pool.Revision < 1 {
+		t.Fatal("revision not set")
+	}
+
 	expected := types.Pool{
-		ID:   pool.ID,
-		Name: name,
+		ID:       pool.ID,
+		Name:     name,
+		Revision: pool.Revision,
 	}
 
 	if subnet != nil {
@@ -1578,7 +1591,7 @@ func deletePool(name string) error {
 
 	for _, pool := range pools {
 		if pool.Name == name {
-			return ctl.DeletePool(pool.ID)
+			return ctl.DeletePool(pool.ID, true)
 		}
 	}
 
@@ -1616,7 +1629,7 @@ func TestListPools(t *testing.T) {
 
 	for _, pool := range pools {
 		if pool.Name == "listPoolTest" {
-			err := ctl.DeletePool(pool.ID)
+			err := ctl.DeletePool(pool.ID, true)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -1646,7 +1659,7 @@ func TestShowPool(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			err = ctl.DeletePool(pool.ID)
+			err = ctl.DeletePool(pool.ID, true)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -1672,7 +1685,7 @@ func TestDeletePool(t *testing.T) {
 
 	for _, pool := range pools {
 		if pool.Name == "deletePoolTest" {
-			err := ctl.DeletePool(pool.ID)
+			err := ctl.DeletePool(pool.ID, true)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -1688,6 +1701,133 @@ func TestDeletePool(t *testing.T) {
 	t.Fatal("Could not delete pool")
 }
 
+func TestAddPools(t *testing.T) {
+	existing, err := ctl.AddPool("batchExisting", nil, []string{"10.40.3.1"}, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeletePool(existing.ID, true)
+
+	subnet := "10.40.0.0/30"
+
+	var reqs []types.NewPoolRequest
+	err = json.Unmarshal([]byte(`[
+		{"name": "batchSubnet", "subnet": "10.40.0.0/30"},
+		{"name": "batchOverlap", "ips": [{"ip": "10.40.0.1"}]},
+		{"name": "batchIPs", "ips": [{"ip": "10.40.1.1"}, {"ip": "10.40.1.2"}]},
+		{"name": "BatchExisting", "ips": [{"ip": "10.40.2.1"}]},
+		{"name": "batchUsed", "ips": [{"ip": "10.40.3.1"}]}
+	]`), &reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []error{
+		types.ErrDuplicateSubnet,
+		types.ErrDuplicateIP,
+		nil,
+		types.ErrDuplicatePoolName,
+		types.ErrDuplicateIP,
+	}
+
+	pools, errs := ctl.AddPools(reqs)
+	for i := range reqs {
+		if errs[i] != expected[i] {
+			t.Errorf("%s: expected %v, got %v", reqs[i].Name, expected[i], errs[i])
+		}
+
+		if errs[i] == nil {
+			defer ctl.DeletePool(pools[i].ID, true)
+		}
+	}
+
+	if pools[2].Name != "batchIPs" || pools[2].TotalIPs != 2 || len(pools[2].Links) == 0 {
+		t.Errorf("unexpected pool %+v", pools[2])
+	}
+
+	// nothing clashing with another pool of the batch is created.
+	all, err := ctl.ListPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range all {
+		if p.Name == "batchSubnet" || p.Name == "batchOverlap" {
+			t.Errorf("pool %s should not have been created", p.Name)
+		}
+
+		for _, s := range p.Subnets {
+			if s.CIDR == subnet {
+				t.Errorf("subnet %s should not have been added", subnet)
+			}
+		}
+	}
+}
+
+func TestValidatePools(t *testing.T) {
+	existing, err := ctl.AddPool("validateExisting", nil, []string{"10.40.14.1", "10.40.14.2"}, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeletePool(existing.ID, true)
+
+	var reqs []types.NewPoolRequest
+	err = json.Unmarshal([]byte(`[
+		{"name": "validateSubnet", "subnet": "10.40.14.0/30"},
+		{"name": "ValidateExisting", "ips": [{"ip": "10.40.15.1"}]},
+		{"name": "validateSubnet", "ips": [{"ip": "10.40.14.3"}]},
+		{"name": "validateFree", "ips": [{"ip": "10.40.15.2"}]}
+	]`), &reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conflicts, err := ctl.ValidatePools(reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type conflict struct {
+		index   int
+		kind    string
+		address string
+		pool    string
+		other   int
+	}
+
+	expected := []conflict{
+		{0, types.PoolConflictOverlap, "10.40.14.0/30", existing.ID, -1},
+		{1, types.PoolConflictName, "", existing.ID, -1},
+		{2, types.PoolConflictName, "", "", 0},
+		{2, types.PoolConflictOverlap, "10.40.14.3", "", 0},
+	}
+
+	var got []conflict
+	for _, c := range conflicts {
+		other := -1
+		if c.OtherIndex != nil {
+			other = *c.OtherIndex
+		}
+		got = append(got, conflict{c.Index, c.Kind, c.Address, c.PoolID, other})
+	}
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected conflicts %v, got %v", expected, got)
+	}
+
+	// nothing is created.
+	pools, err := ctl.ListPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range pools {
+		if p.Name == "validateSubnet" || p.Name == "validateFree" {
+			t.Errorf("pool %s should not have been created", p.Name)
+		}
+	}
+}
+
 func TestAddPoolSubnet(t *testing.T) {
 	subnet := "192.168.0.0/24"
 
@@ -1719,7 +1859,7 @@ func TestAddPoolSubnet(t *testing.T) {
 				t.Fatalf("expectd %s subnet got %s", subnet, p1.Subnets[0].CIDR)
 			}
 
-			err = ctl.DeletePool(pool.ID)
+			err = ctl.DeletePool(pool.ID, true)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -1760,7 +1900,7 @@ func TestAddPoolAddress(t *testing.T) {
 				t.Fatalf("expected %s address got %s", address, p1.IPs[0].Address)
 			}
 
-			err = ctl.DeletePool(pool.ID)
+			err = ctl.DeletePool(pool.ID, true)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -1829,101 +1969,3705 @@ func TestRemovePoolSubnet(t *testing.T) {
 	}
 }
 
-func TestMapAddress(t *testing.T) {
-	var reason payloads.StartFailureReason
+func TestDeleteTenantResources(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	client, instances := testStartWorkload(t, 1, false, reason)
-	defer client.Shutdown()
+	poolName := "testdeletetenant"
+	pool, err := ctl.AddPool(poolName, nil, []string{"10.40.18.1"}, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeletePool(pool.ID, true)
 
-	ips := []string{"10.10.0.1"}
-	poolName := "testmap"
+	m, err := ctl.MapAddress(tenant.ID, &poolName, "", "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	testAddPool(t, poolName, nil, ips)
+	wl, err := ctl.CreateWorkload(types.Workload{
+		TenantID:    tenant.ID,
+		Description: "testDeleteTenant",
+		FWType:      string(payloads.EFI),
+		VMType:      payloads.QEMU,
+		Config:      "this will totally work!",
+		Storage: []types.StorageResource{{
+			Bootable:   true,
+			Ephemeral:  true,
+			Size:       10,
+			SourceType: types.ImageService,
+			SourceID:   uuid.Generate().String(),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	pools, err := ctl.ListPools()
+	err = ctl.UpdateQuotas(tenant.ID, []types.QuotaDetails{{Name: "tenant-vcpu-quota", Value: 4}})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if len(pools) < 1 {
-		t.Fatal("Unable to retrieve pools")
+	_, _, err = ctl.DeleteTenantResources(tenant.ID, false)
+	if err != types.ErrTenantHasResources {
+		t.Fatalf("expected %v, got %v", types.ErrTenantHasResources, err)
 	}
 
-	for _, pool := range pools {
-		if pool.Name == "testmap" {
-			if pool.Free != 1 {
-				t.Fatal("Pool Free not correct")
-			}
+	results, errs, err := ctl.DeleteTenantResources(tenant.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed := make(map[types.TenantResourceResult]bool)
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("%s %s: %v", results[i].Type, results[i].ID, err)
 		}
+		removed[results[i]] = true
 	}
 
-	err = ctl.MapAddress(instances[0].TenantID, &poolName, instances[0].ID)
+	expected := []types.TenantResourceResult{
+		{Type: types.TenantResourceExternalIP, ID: m.ID},
+		{Type: types.TenantResourceWorkload, ID: wl.ID},
+		{Type: types.TenantResourceQuota, ID: "tenant-vcpu-quota"},
+	}
+
+	for _, e := range expected {
+		if !removed[e] {
+			t.Errorf("expected %s %s to be removed, got %+v", e.Type, e.ID, results)
+		}
+	}
+
+	_, err = ctl.ds.GetMappedIP(m.ExternalIP)
+	if err != types.ErrAddressNotFound {
+		t.Fatalf("expected %s to be released, got %v", m.ExternalIP, err)
+	}
+
+	_, err = ctl.ShowWorkload(tenant.ID, wl.ID)
+	if err != types.ErrWorkloadNotFound {
+		t.Fatalf("expected %v, got %v", types.ErrWorkloadNotFound, err)
+	}
+
+	qd := findQuota(ctl.ListQuotas(tenant.ID), "tenant-vcpu-quota")
+	if qd == nil || qd.Value != -1 {
+		t.Fatalf("expected quota override removed, got %+v", qd)
+	}
+
+	// a repeated deletion finds nothing left to remove.
+	results, _, err = ctl.DeleteTenantResources(tenant.ID, false)
+	if err != nil || len(results) != 0 {
+		t.Fatalf("expected nothing removed, got %+v, %v", results, err)
+	}
+
+	_, _, err = ctl.DeleteTenantResources(uuid.Generate().String(), true)
+	if err != types.ErrTenantNotFound {
+		t.Fatalf("expected %v, got %v", types.ErrTenantNotFound, err)
+	}
+}
+
+func TestProvision(t *testing.T) {
+	tenant, err := addTestTenant()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	pools, err = ctl.ListPools()
+	poolName := "testprovision"
+	pool, err := ctl.AddPool(poolName, nil, []string{"10.40.22.1"}, nil, "", "")
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer ctl.DeletePool(pool.ID, true)
 
-	if len(pools) < 1 {
-		t.Fatal("Unable to retrieve pools")
+	req := types.Workload{
+		Description: "testProvision",
+		FWType:      string(payloads.EFI),
+		VMType:      payloads.QEMU,
+		Config:      "this will totally work!",
+		Storage: []types.StorageResource{{
+			Bootable:   true,
+			Ephemeral:  true,
+			Size:       10,
+			SourceType: types.ImageService,
+			SourceID:   uuid.Generate().String(),
+		}},
 	}
 
-	for _, pool := range pools {
-		if pool.Name == "testmap" {
-			if pool.Free != 0 {
-				fmt.Printf("%v", pool)
-				t.Fatal("Pool Free not decremented")
-			}
-		}
+	wl, m, err := ctl.Provision(tenant.ID, &req, "", &poolName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.UnMapAddress(m.ExternalIP)
+
+	if m.ExternalIP != "10.40.22.1" || m.TenantID != tenant.ID {
+		t.Fatalf("unexpected external IP %+v", m)
+	}
+
+	_, err = ctl.ShowWorkload(tenant.ID, wl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := ctl.ListWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the pool is now exhausted, so the workload created for the
+	// second request is deleted again.
+	_, _, err = ctl.Provision(tenant.ID, &req, "", &poolName)
+	if _, ok := err.(types.PoolExhaustedError); !ok {
+		t.Fatalf("expected pool exhausted error, got %v", err)
+	}
+
+	after, err := ctl.ListWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(after) != len(before) {
+		t.Fatalf("expected %d workloads after a failed provision, got %d", len(before), len(after))
+	}
+
+	// an existing workload is not deleted when no IP can be reserved.
+	_, _, err = ctl.Provision(tenant.ID, nil, wl.ID, &poolName)
+	if _, ok := err.(types.PoolExhaustedError); !ok {
+		t.Fatalf("expected pool exhausted error, got %v", err)
+	}
+
+	_, err = ctl.ShowWorkload(tenant.ID, wl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = ctl.Provision(tenant.ID, nil, "", &poolName)
+	if err != types.ErrBadRequest {
+		t.Fatalf("expected %v, got %v", types.ErrBadRequest, err)
 	}
 }
 
-func TestMapAddressNoPool(t *testing.T) {
-	var reason payloads.StartFailureReason
+func TestCreateWorkloadStorage(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	client, instances := testStartWorkload(t, 1, false, reason)
-	defer client.Shutdown()
+	storage := []types.StorageResource{
+		{
+			Bootable:   true,
+			Ephemeral:  true,
+			Size:       10,
+			SourceType: types.ImageService,
+			SourceID:   uuid.Generate().String(),
+			Tag:        "root",
+		},
+		{
+			Size:       20,
+			SourceType: types.Empty,
+		},
+	}
+
+	req := types.Workload{
+		TenantID:    tenant.ID,
+		Description: "testStorageWorkload",
+		FWType:      string(payloads.EFI),
+		VMType:      payloads.QEMU,
+		Config:      "this will totally work!",
+		Storage:     storage,
+	}
 
-	ips := []string{"10.10.0.2"}
-	poolName := "testmapnopool"
+	wl, err := ctl.CreateWorkload(req)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	testAddPool(t, poolName, nil, ips)
+	shown, err := ctl.ShowWorkload(tenant.ID, wl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(shown.Storage, storage) {
+		t.Fatalf("expected storage %+v, got %+v", storage, shown.Storage)
+	}
 
-	err := ctl.MapAddress(instances[0].TenantID, nil, instances[0].ID)
+	// the admin can find the workload without knowing its tenant.
+	shown, err = ctl.ShowWorkload("", wl.ID)
+	if err != nil || shown.TenantID != tenant.ID {
+		t.Fatalf("workload not found for any tenant: %v", err)
+	}
+
+	err = ctl.DeleteWorkload(tenant.ID, wl.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	pools, err := ctl.ListPools()
+	invalid := []types.StorageResource{
+		// bootable volume with no size
+		{Bootable: true, SourceType: types.ImageService, SourceID: uuid.Generate().String()},
+		// negative size
+		{Bootable: true, Size: -1, SourceType: types.ImageService, SourceID: uuid.Generate().String()},
+		// bad source reference
+		{Bootable: true, Size: 10, SourceType: types.ImageService, SourceID: "not-an-image"},
+		// unknown source type
+		{Bootable: true, Size: 10, SourceType: "nfs", SourceID: uuid.Generate().String()},
+	}
+
+	for _, s := range invalid {
+		req.Storage = []types.StorageResource{s}
+
+		_, err = ctl.CreateWorkload(req)
+		if err != types.ErrInvalidStorage {
+			t.Errorf("%+v: expected %v, got %v", s, types.ErrInvalidStorage, err)
+		}
+	}
+}
+
+func TestCreateWorkloadEnvironment(t *testing.T) {
+	tenant, err := addTestTenant()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if len(pools) < 1 {
-		t.Fatal("Unable to retrieve pools")
+	env := []types.WorkloadDefault{
+		{Name: "MONITORING_URL", Value: "http://monitor", Required: true},
+		{Name: "LOG_LEVEL"},
 	}
 
-	for _, pool := range pools {
-		if pool.Name == "testmapnopool" {
-			if pool.Free != 0 {
-				fmt.Printf("%v", pool)
-				t.Fatal("Pool Free not decremented")
-			}
+	req := types.Workload{
+		TenantID:    tenant.ID,
+		Description: "testEnvWorkload",
+		FWType:      string(payloads.EFI),
+		VMType:      payloads.QEMU,
+		Config:      "this will totally work!",
+		Storage: []types.StorageResource{
+			{
+				Bootable:   true,
+				Ephemeral:  true,
+				Size:       10,
+				SourceType: types.ImageService,
+				SourceID:   uuid.Generate().String(),
+			},
+		},
+		Environment: env,
+	}
+
+	wl, err := ctl.CreateWorkload(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeleteWorkload(tenant.ID, wl.ID)
+
+	shown, err := ctl.ShowWorkload(tenant.ID, wl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(shown.Environment, env) {
+		t.Fatalf("expected environment %+v, got %+v", env, shown.Environment)
+	}
+
+	invalid := [][]types.WorkloadDefault{
+		{{Name: "MONITORING_URL", Required: true}},
+		{{Value: "unnamed"}},
+		{{Name: "LOG_LEVEL"}, {Name: "LOG_LEVEL", Value: "debug"}},
+	}
+
+	for _, e := range invalid {
+		req.Environment = e
+
+		_, err = ctl.CreateWorkload(req)
+		if err != types.ErrInvalidWorkloadDefault {
+			t.Errorf("%+v: expected %v, got %v", e, types.ErrInvalidWorkloadDefault, err)
 		}
 	}
+}
 
-	mappedIPs := ctl.ListMappedAddresses(&instances[0].TenantID)
-	if len(mappedIPs) != 1 {
-		t.Fatal("mapped IP not in list")
+func TestUpdateWorkload(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := types.Workload{
+		TenantID:    tenant.ID,
+		Description: "testUpdateWorkload",
+		FWType:      string(payloads.EFI),
+		VMType:      payloads.QEMU,
+		Config:      "this will totally work!",
+		Storage: []types.StorageResource{
+			{
+				Bootable:   true,
+				Ephemeral:  true,
+				Size:       10,
+				SourceType: types.ImageService,
+				SourceID:   uuid.Generate().String(),
+			},
+		},
+	}
+
+	wl, err := ctl.CreateWorkload(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeleteWorkload(tenant.ID, wl.ID)
+
+	wl.Description = "updated"
+
+	_, err = ctl.UpdateWorkload(wl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shown, err := ctl.ShowWorkload(tenant.ID, wl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if shown.Description != "updated" {
+		t.Fatalf("expected description updated, got %s", shown.Description)
+	}
+
+	wl.Config = ""
+
+	_, err = ctl.UpdateWorkload(wl)
+	if err != types.ErrBadRequest {
+		t.Fatalf("expected %v, got %v", types.ErrBadRequest, err)
 	}
 }
 
-var ctl *controller
-var server *testutil.SsntpTestServer
-var wrappedClient *ssntpClientWrapper
+func TestCreateWorkloadIncompatibleFirmware(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := types.Workload{
+		TenantID:    tenant.ID,
+		Description: "testFirmwareWorkload",
+		FWType:      string(payloads.EFI),
+		VMType:      payloads.QEMU,
+		Config:      "this will totally work!",
+		Storage: []types.StorageResource{
+			{
+				Bootable:   true,
+				Ephemeral:  true,
+				Size:       10,
+				SourceType: types.ImageService,
+				SourceID:   uuid.Generate().String(),
+			},
+		},
+	}
+
+	wl, err := ctl.CreateWorkload(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeleteWorkload(tenant.ID, wl.ID)
+
+	invalid := []struct {
+		vmType payloads.Hypervisor
+		fwType string
+	}{
+		{payloads.QEMU, ""},
+		{payloads.QEMU, "bios"},
+		{payloads.Docker, string(payloads.EFI)},
+		{payloads.Docker, payloads.Legacy},
+		{"xen", payloads.Legacy},
+	}
+
+	for _, tt := range invalid {
+		bad := req
+		bad.VMType = tt.vmType
+		bad.FWType = tt.fwType
+		bad.ImageName = "ubuntu:latest"
+
+		_, err = ctl.CreateWorkload(bad)
+		if err != types.ErrIncompatibleFirmware {
+			t.Errorf("create %s with %q: expected %v, got %v", tt.vmType, tt.fwType, types.ErrIncompatibleFirmware, err)
+		}
+
+		bad.ID = wl.ID
+		_, err = ctl.UpdateWorkload(bad)
+		if err != types.ErrIncompatibleFirmware {
+			t.Errorf("update %s with %q: expected %v, got %v", tt.vmType, tt.fwType, types.ErrIncompatibleFirmware, err)
+		}
+	}
+}
+
+func TestValidateWorkload(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := types.Workload{
+		TenantID:    tenant.ID,
+		Description: "testValidateWorkload",
+		FWType:      string(payloads.EFI),
+		VMType:      payloads.QEMU,
+		Config:      "this will totally work!",
+		Defaults: []payloads.RequestedResource{
+			{Type: payloads.VCPUs, Value: 2},
+		},
+		Storage: []types.StorageResource{
+			{
+				Bootable:   true,
+				Ephemeral:  true,
+				Size:       10,
+				SourceType: types.ImageService,
+				SourceID:   uuid.Generate().String(),
+			},
+		},
+	}
+
+	v := ctl.ValidateWorkload(req)
+	if len(v.Errors) != 0 {
+		t.Fatalf("expected no errors, got %v", v.Errors)
+	}
+
+	if len(v.Warnings) != 1 || !strings.Contains(v.Warnings[0], string(payloads.MemMB)) {
+		t.Fatalf("expected a warning about %s, got %v", payloads.MemMB, v.Warnings)
+	}
+
+	wls, err := ctl.ListWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, wl := range wls {
+		if wl.Description == req.Description {
+			t.Fatalf("validated workload was created: %+v", wl)
+		}
+	}
+
+	req.Storage = nil
+
+	v = ctl.ValidateWorkload(req)
+	if len(v.Errors) != 1 || v.Errors[0] != types.ErrBadRequest.Error() {
+		t.Fatalf("expected error %v, got %v", types.ErrBadRequest, v.Errors)
+	}
+}
+
+func TestValidateWorkloadFields(t *testing.T) {
+	req := types.Workload{
+		FWType: string(payloads.EFI),
+		VMType: payloads.QEMU,
+		Config: "this will totally work!",
+		Storage: []types.StorageResource{
+			{
+				Bootable:   true,
+				Size:       10,
+				SourceType: types.ImageService,
+				SourceID:   uuid.Generate().String(),
+			},
+			{
+				Size:       -1,
+				SourceType: types.ImageService,
+				SourceID:   "not a uuid",
+			},
+		},
+		Environment: []types.WorkloadDefault{
+			{Name: "PORT", Required: true},
+		},
+	}
+
+	v := ctl.ValidateWorkload(req)
+	if len(v.Errors) != 1 || v.Errors[0] != types.ErrInvalidStorage.Error() {
+		t.Fatalf("expected error %v, got %v", types.ErrInvalidStorage, v.Errors)
+	}
+
+	expected := []types.FieldError{
+		{Field: "storage[1].size", Message: "must not be negative"},
+		{Field: "storage[1].source_id", Message: "must be a UUID"},
+		{Field: "environment[0].value", Message: "must be set for a required default"},
+	}
+
+	if !reflect.DeepEqual(v.Fields, expected) {
+		t.Fatalf("expected fields %+v, got %+v", expected, v.Fields)
+	}
+
+	_, err := ctl.CreateWorkload(req)
+	if err != types.ErrInvalidStorage {
+		t.Fatalf("expected %v, got %v", types.ErrInvalidStorage, err)
+	}
+}
+
+func TestCreateWorkloadAsync(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := types.Workload{
+		TenantID:    tenant.ID,
+		Description: "testCreateWorkloadAsync",
+		FWType:      string(payloads.EFI),
+		VMType:      payloads.QEMU,
+		Config:      "this will totally work!",
+		Storage: []types.StorageResource{
+			{
+				Bootable:   true,
+				Ephemeral:  true,
+				Size:       10,
+				SourceType: types.ImageService,
+				SourceID:   uuid.Generate().String(),
+			},
+		},
+	}
+
+	op, err := ctl.CreateWorkloadAsync(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if op.Status != types.WorkloadPending {
+		t.Fatalf("expected %s, got %s", types.WorkloadPending, op.Status)
+	}
+
+	for i := 0; ; i++ {
+		status, err := ctl.WorkloadStatus(tenant.ID, op.WorkloadID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if status.Status == types.WorkloadReady {
+			break
+		}
+
+		if status.Status != types.WorkloadPending || i == 50 {
+			t.Fatalf("workload not created: %+v", status)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	_, err = ctl.ShowWorkload(tenant.ID, op.WorkloadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// other tenants cannot see the workload.
+	other, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ctl.WorkloadStatus(other.ID, op.WorkloadID)
+	if err != types.ErrWorkloadNotFound {
+		t.Fatalf("expected %v, got %v", types.ErrWorkloadNotFound, err)
+	}
+
+	// requests which are malformed fail at once.
+	req.Storage = nil
+	_, err = ctl.CreateWorkloadAsync(req)
+	if err != types.ErrBadRequest {
+		t.Fatalf("expected %v, got %v", types.ErrBadRequest, err)
+	}
+}
+
+func TestMapAddress(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	ips := []string{"10.10.0.1"}
+	poolName := "testmap"
+
+	testAddPool(t, poolName, nil, ips)
+
+	pools, err := ctl.ListPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pools) < 1 {
+		t.Fatal("Unable to retrieve pools")
+	}
+
+	for _, pool := range pools {
+		if pool.Name == "testmap" {
+			if pool.Free != 1 {
+				t.Fatal("Pool Free not correct")
+			}
+		}
+	}
+
+	_, err = ctl.MapAddress(instances[0].TenantID, &poolName, instances[0].ID, "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pools, err = ctl.ListPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pools) < 1 {
+		t.Fatal("Unable to retrieve pools")
+	}
+
+	for _, pool := range pools {
+		if pool.Name == "testmap" {
+			if pool.Free != 0 {
+				fmt.Printf("%v", pool)
+				t.Fatal("Pool Free not decremented")
+			}
+		}
+	}
+}
+
+func TestSwapAddresses(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 2, false, reason)
+	defer client.Shutdown()
+
+	poolName := "testswap"
+	testAddPool(t, poolName, nil, []string{"10.40.10.1", "10.40.10.2", "10.40.10.3"})
+
+	tenantID := instances[0].TenantID
+
+	a, err := ctl.MapAddress(tenantID, &poolName, instances[0].ID, "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ctl.MapAddress(tenantID, &poolName, instances[1].ID, "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reserved, err := ctl.MapAddress(tenantID, &poolName, "", "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.SwapAddresses(a.ExternalIP, reserved.ExternalIP)
+	if err != types.ErrAddressNotAttached {
+		t.Fatalf("expected %v, got %v", types.ErrAddressNotAttached, err)
+	}
+
+	err = ctl.SwapAddresses(a.ExternalIP, "10.40.10.254")
+	if err != types.ErrAddressNotFound {
+		t.Fatalf("expected %v, got %v", types.ErrAddressNotFound, err)
+	}
+
+	err = ctl.SwapAddresses(a.ExternalIP, b.ExternalIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		address    string
+		instanceID string
+		internalIP string
+	}{
+		{a.ExternalIP, b.InstanceID, b.InternalIP},
+		{b.ExternalIP, a.InstanceID, a.InternalIP},
+	} {
+		m, err := ctl.ds.GetMappedIP(tt.address)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if m.InstanceID != tt.instanceID || m.InternalIP != tt.internalIP {
+			t.Errorf("%s: got %s (%s), expected %s (%s)", tt.address, m.InstanceID, m.InternalIP, tt.instanceID, tt.internalIP)
+		}
+	}
+}
+
+func TestMapAddressInternalIP(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	poolName := "testmapinternalip"
+	testAddPool(t, poolName, nil, []string{"10.40.7.1"})
+
+	i := instances[0]
+
+	for _, internalIP := range []string{"172.31.255.254", "not-an-ip"} {
+		_, err := ctl.MapAddress(i.TenantID, &poolName, i.ID, internalIP, "", 0)
+		if _, ok := err.(types.InternalIPMismatchError); !ok {
+			t.Fatalf("expected internal IP mismatch for %s, got %v", internalIP, err)
+		}
+	}
+
+	_, err := ctl.MapAddress(i.TenantID, &poolName, "", i.IPAddress, "", 0)
+	if _, ok := err.(types.InternalIPMismatchError); !ok {
+		t.Fatalf("expected internal IP mismatch for reservation, got %v", err)
+	}
+
+	m, err := ctl.MapAddress(i.TenantID, &poolName, i.ID, i.IPAddress, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.InternalIP != i.IPAddress {
+		t.Fatalf("expected internal IP %s, got %s", i.IPAddress, m.InternalIP)
+	}
+}
+
+func TestMapAddressNoPool(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	ips := []string{"10.10.0.2"}
+	poolName := "testmapnopool"
+
+	testAddPool(t, poolName, nil, ips)
+
+	_, err := ctl.MapAddress(instances[0].TenantID, nil, instances[0].ID, "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pools, err := ctl.ListPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pools) < 1 {
+		t.Fatal("Unable to retrieve pools")
+	}
+
+	for _, pool := range pools {
+		if pool.Name == "testmapnopool" {
+			if pool.Free != 0 {
+				fmt.Printf("%v", pool)
+				t.Fatal("Pool Free not decremented")
+			}
+		}
+	}
+
+	mappedIPs := ctl.ListMappedAddresses(&instances[0].TenantID)
+	if len(mappedIPs) != 1 {
+		t.Fatal("mapped IP not in list")
+	}
+}
+
+func TestReleaseInstanceAddresses(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	ips := []string{"10.40.4.1", "10.40.4.2"}
+	poolName := "testreleaseinstance"
+
+	testAddPool(t, poolName, nil, ips)
+
+	tenantID := instances[0].TenantID
+	instanceID := instances[0].ID
+
+	for _, role := range []string{"", "management"} {
+		_, err := ctl.MapAddress(tenantID, &poolName, instanceID, "", role, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	usage := func() int {
+		for _, qd := range ctl.ListQuotas(tenantID) {
+			if qd.Name == "tenant-external-ips-quota" {
+				return qd.Usage
+			}
+		}
+		return -1
+	}
+
+	before := usage()
+
+	for _, expected := range []int{2, 0} {
+		released, err := ctl.ReleaseInstanceAddresses(instanceID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if released != expected {
+			t.Fatalf("expected %d addresses released, got %d", expected, released)
+		}
+	}
+
+	for _, m := range ctl.ListMappedAddresses(&tenantID) {
+		if m.InstanceID == instanceID {
+			t.Fatalf("mapping %s not released", m.ExternalIP)
+		}
+	}
+
+	if after := usage(); after != before-2 {
+		t.Fatalf("expected external IP usage %d, got %d", before-2, after)
+	}
+}
+
+func TestReleaseAddresses(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	pool, err := ctl.AddPool("testreleaseaddresses", nil, []string{"10.40.24.1", "10.40.24.2"}, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenantID := instances[0].TenantID
+	instanceID := instances[0].ID
+
+	mapped, err := ctl.MapAddress(tenantID, &pool.Name, instanceID, "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reserved, err := ctl.MapAddress(tenantID, &pool.Name, "", "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ctl.ReleaseAddresses(tenantID, "nopool")
+	if err != types.ErrPoolNotFound {
+		t.Fatalf("expected %v, got %v", types.ErrPoolNotFound, err)
+	}
+
+	released, err := ctl.ReleaseAddresses(tenantID, pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(released) != 2 {
+		t.Fatalf("expected 2 addresses released, got %d", len(released))
+	}
+
+	for _, m := range released {
+		switch m.ExternalIP {
+		case mapped.ExternalIP:
+			if m.InstanceID != instanceID {
+				t.Fatalf("expected %s attached to %s, got %q", m.ExternalIP, instanceID, m.InstanceID)
+			}
+		case reserved.ExternalIP:
+			if m.InstanceID != "" {
+				t.Fatalf("expected %s unattached, got %s", m.ExternalIP, m.InstanceID)
+			}
+		default:
+			t.Fatalf("unexpected address %s released", m.ExternalIP)
+		}
+	}
+
+	for _, m := range ctl.ListMappedAddresses(&tenantID) {
+		if m.PoolID == pool.ID {
+			t.Fatalf("mapping %s not released", m.ExternalIP)
+		}
+	}
+
+	released, err = ctl.ReleaseAddresses(tenantID, pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(released) != 0 {
+		t.Fatalf("expected no addresses released, got %d", len(released))
+	}
+}
+
+func TestMigratePool(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	from, err := ctl.AddPool("testmigratefrom", nil, []string{"10.40.27.1", "10.40.27.2"}, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	small, err := ctl.AddPool("testmigratesmall", nil, []string{"10.40.27.3"}, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	to, err := ctl.AddPool("testmigrateto", nil, []string{"10.40.28.1", "10.40.28.2"}, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenantID := instances[0].TenantID
+	instanceID := instances[0].ID
+
+	mapped, err := ctl.MapAddress(tenantID, &from.Name, instanceID, "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ctl.MapAddress(tenantID, &from.Name, "", "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ctl.MigratePool(from.ID, small.ID, false)
+	if _, ok := err.(types.PoolExhaustedError); !ok {
+		t.Fatalf("expected PoolExhaustedError, got %v", err)
+	}
+
+	inPool := func(poolID string) []types.MappedIP {
+		var mappings []types.MappedIP
+		for _, m := range ctl.ListMappedAddresses(&tenantID) {
+			if m.PoolID == poolID {
+				mappings = append(mappings, m)
+			}
+		}
+		return mappings
+	}
+
+	if len(inPool(from.ID)) != 2 || len(inPool(small.ID)) != 0 {
+		t.Fatal("mappings moved to pool too small for them")
+	}
+
+	plan, err := ctl.MigratePool(from.ID, to.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !plan.DryRun || plan.Attached != 1 || len(plan.Mappings) != 2 {
+		t.Fatalf("unexpected dry run %+v", plan)
+	}
+
+	if len(inPool(from.ID)) != 2 {
+		t.Fatal("mappings moved in dry run")
+	}
+
+	migration, err := ctl.MigratePool(from.ID, to.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(migration.Addresses, plan.Addresses) {
+		t.Fatalf("expected addresses %v, got %v", plan.Addresses, migration.Addresses)
+	}
+
+	if len(inPool(from.ID)) != 0 {
+		t.Fatal("mappings left in migrated pool")
+	}
+
+	moved, err := ctl.ds.GetMappedIP(migration.Addresses[mapped.ExternalIP])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if moved.PoolID != to.ID || moved.InstanceID != instanceID {
+		t.Fatalf("expected %s mapped to %s from %s, got %+v", moved.ExternalIP, instanceID, to.ID, moved)
+	}
+
+	if migration.Failed != 0 {
+		t.Fatalf("expected the CNCI to be updated, got %+v", migration.Mappings)
+	}
+}
+
+func TestAddressReservations(t *testing.T) {
+	reservation, err := ctl.AddAddressReservation("10.40.25.0/24", "handover")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ctl.AddAddressReservation("10.40.25.128/25", "other")
+	if _, ok := err.(types.AddressReservedError); !ok {
+		t.Fatalf("expected AddressReservedError, got %v", err)
+	}
+
+	subnet := "10.40.25.0/28"
+	_, err = ctl.AddPool("testaddressreservations", &subnet, nil, nil, "", "")
+	if e, ok := err.(types.AddressReservedError); !ok || e.ReservationID != reservation.ID {
+		t.Fatalf("expected AddressReservedError for %s, got %v", reservation.ID, err)
+	}
+
+	pools, err := ctl.ListPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range pools {
+		if p.Name == "testaddressreservations" {
+			t.Fatal("pool created within reserved address space")
+		}
+	}
+
+	pool, err := ctl.AddPool("testaddressreservations", nil, []string{"10.40.26.1"}, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.AddAddress(pool.ID, nil, []string{"10.40.25.5"})
+	if _, ok := err.(types.AddressReservedError); !ok {
+		t.Fatalf("expected AddressReservedError, got %v", err)
+	}
+
+	_, err = ctl.AddAddressReservation("10.40.26.0/24", "pooled")
+	if err != types.ErrDuplicateIP {
+		t.Fatalf("expected %v, got %v", types.ErrDuplicateIP, err)
+	}
+
+	conflicts, err := ctl.ValidatePools([]types.NewPoolRequest{{Name: "validatereserved", Subnet: &subnet}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(conflicts) != 1 || conflicts[0].Kind != types.PoolConflictOverlap {
+		t.Fatalf("expected reservation overlap, got %+v", conflicts)
+	}
+
+	err = ctl.DeleteAddressReservation(reservation.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.DeleteAddressReservation(reservation.ID)
+	if err != types.ErrReservationNotFound {
+		t.Fatalf("expected %v, got %v", types.ErrReservationNotFound, err)
+	}
+
+	err = ctl.AddAddress(pool.ID, nil, []string{"10.40.25.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	report, err := ctl.Health()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Checks) == 0 || report.Checks[0].Name != "datastore" || report.Checks[0].Status != types.HealthOK {
+		t.Fatalf("expected healthy datastore, got %+v", report.Checks)
+	}
+
+	stuck := make(chan struct{})
+	defer close(stuck)
+
+	checks := []healthCheck{
+		{"quick", func() error { return nil }},
+		{"broken", func() error { return fmt.Errorf("broken") }},
+		{"stuck", func() error { <-stuck; return nil }},
+	}
+
+	report = runHealthChecks(checks, 50*time.Millisecond)
+	if report.Status != types.HealthUnhealthy {
+		t.Fatalf("expected %s, got %s", types.HealthUnhealthy, report.Status)
+	}
+
+	expected := []string{types.HealthOK, types.HealthUnhealthy, types.HealthTimeout}
+	for i, check := range report.Checks {
+		if check.Name != checks[i].name || check.Status != expected[i] {
+			t.Fatalf("expected %s %s, got %+v", checks[i].name, expected[i], check)
+		}
+	}
+}
+
+func TestMappingLabels(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	poolName := "testmappinglabels"
+	testAddPool(t, poolName, nil, []string{"10.40.6.1"})
+
+	m, err := ctl.MapAddress(tenant.ID, &poolName, "", "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := map[string]string{"ticket": "OPS-42"}
+
+	m, err = ctl.SetMappingLabels(tenant.ID, m.ExternalIP, labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(m.Labels, labels) {
+		t.Fatalf("expected labels %v, got %v", labels, m.Labels)
+	}
+
+	filter := types.MappedIPFilter{Labels: labels}
+	if count := ctl.CountMappedAddresses(filter); count != 1 {
+		t.Fatalf("expected 1 labelled mapping, got %d", count)
+	}
+
+	_, err = ctl.SetMappingLabels(uuid.Generate().String(), m.ExternalIP, nil)
+	if err != types.ErrAddressNotFound {
+		t.Fatalf("expected %v, got %v", types.ErrAddressNotFound, err)
+	}
+
+	tooMany := make(map[string]string)
+	for i := 0; i <= types.MaxMappingLabels; i++ {
+		tooMany[fmt.Sprintf("label%d", i)] = "x"
+	}
+
+	_, err = ctl.SetMappingLabels(tenant.ID, m.ExternalIP, tooMany)
+	if err != types.ErrInvalidLabels {
+		t.Fatalf("expected %v, got %v", types.ErrInvalidLabels, err)
+	}
+
+	m, err = ctl.SetMappingLabels(tenant.ID, m.ExternalIP, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Labels != nil {
+		t.Fatalf("labels not removed: %v", m.Labels)
+	}
+
+	if count := ctl.CountMappedAddresses(filter); count != 0 {
+		t.Fatalf("expected no labelled mappings, got %d", count)
+	}
+
+	err = ctl.UnMapAddress(m.ExternalIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = deletePool(poolName)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLabelMappings(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	poolName := "testlabelmappings"
+	pool, err := ctl.AddPool(poolName, nil, []string{"10.40.16.1", "10.40.16.2"}, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeletePool(pool.ID, true)
+
+	var mappings []types.MappedIP
+	for i := 0; i < 2; i++ {
+		m, err := ctl.MapAddress(tenant.ID, &poolName, "", "", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ctl.UnMapAddress(m.ExternalIP)
+		mappings = append(mappings, m)
+	}
+
+	_, err = ctl.SetMappingLabels(tenant.ID, mappings[0].ExternalIP, map[string]string{"ticket": "OPS-42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filter := types.MappedIPFilter{PoolID: pool.ID, TenantID: tenant.ID, Status: types.MappedIPReserved}
+
+	count, err := ctl.LabelMappings(filter, map[string]string{"team": "web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 2 {
+		t.Fatalf("expected 2 mappings labelled, got %d", count)
+	}
+
+	m, err := ctl.ds.GetMappedIP(mappings[0].ExternalIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"ticket": "OPS-42", "team": "web"}
+	if !reflect.DeepEqual(m.Labels, expected) {
+		t.Fatalf("expected labels %v, got %v", expected, m.Labels)
+	}
+
+	tooMany := make(map[string]string)
+	for i := 0; i < types.MaxMappingLabels; i++ {
+		tooMany[fmt.Sprintf("label%d", i)] = "x"
+	}
+
+	// the first mapping would have too many, so neither is labelled.
+	_, err = ctl.LabelMappings(filter, tooMany)
+	if err != types.ErrInvalidLabels {
+		t.Fatalf("expected %v, got %v", types.ErrInvalidLabels, err)
+	}
+
+	m, err = ctl.ds.GetMappedIP(mappings[1].ExternalIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.Labels) != 1 {
+		t.Fatalf("expected labels unchanged, got %v", m.Labels)
+	}
+
+	count, err = ctl.LabelMappings(types.MappedIPFilter{PoolID: pool.ID, Status: types.MappedIPAttached}, map[string]string{"team": "db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 0 {
+		t.Fatalf("expected no mappings labelled, got %d", count)
+	}
+}
+
+func TestClaimAddresses(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 2, false, reason)
+	defer client.Shutdown()
+
+	tenantID := instances[0].TenantID
+	instanceIDs := []string{instances[0].ID, instances[1].ID}
+
+	poolName := "testclaim"
+	testAddPool(t, poolName, nil, []string{"10.40.20.1", "10.40.20.2", "10.40.20.3"})
+
+	_, err := ctl.ClaimAddresses(tenantID, poolName, 2, 0)
+	if err != types.ErrBadRequest {
+		t.Fatalf("expected %v, got %v", types.ErrBadRequest, err)
+	}
+
+	claim, err := ctl.ClaimAddresses(tenantID, poolName, 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claim.Token == "" || claim.Expires == nil || len(claim.Mappings) != 2 {
+		t.Fatalf("unexpected claim %+v", claim)
+	}
+
+	_, err = ctl.CommitClaim(tenantID, claim.Token, instanceIDs[:1])
+	if err != types.ErrBadRequest {
+		t.Fatalf("expected %v, got %v", types.ErrBadRequest, err)
+	}
+
+	_, err = ctl.CommitClaim(tenantID, claim.Token, []string{instanceIDs[0], uuid.Generate().String()})
+	if err != types.ErrInstanceNotFound {
+		t.Fatalf("expected %v, got %v", types.ErrInstanceNotFound, err)
+	}
+
+	// committing again changes nothing.
+	for i := 0; i < 2; i++ {
+		committed, err := ctl.CommitClaim("", claim.Token, instanceIDs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for j, m := range committed {
+			if m.InstanceID != instanceIDs[j] || m.Status != types.MappedIPAttached || m.Expires != nil {
+				t.Fatalf("unexpected committed mapping %+v", m)
+			}
+		}
+	}
+
+	_, err = ctl.ReleaseBlock(tenantID, claim.Token)
+	if err != types.ErrAddressAttached {
+		t.Fatalf("expected %v, got %v", types.ErrAddressAttached, err)
+	}
+
+	for _, m := range claim.Mappings {
+		defer func(address string) { _ = ctl.UnMapAddress(address) }(m.ExternalIP)
+	}
+
+	// claims which are not committed in time are released.
+	abandoned, err := ctl.ClaimAddresses(tenantID, poolName, 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctl.releaseExpiredReservations(time.Now().Add(2 * time.Minute))
+
+	_, err = ctl.CommitClaim(tenantID, abandoned.Token, instanceIDs[:1])
+	if err != types.ErrAddressNotFound {
+		t.Fatalf("expected %v, got %v", types.ErrAddressNotFound, err)
+	}
+}
+
+func TestReserveBlock(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	poolName := "testreserveblock"
+	testAddPool(t, poolName, nil, []string{"10.40.5.1", "10.40.5.2", "10.40.5.3"})
+
+	usage := func() int {
+		for _, qd := range ctl.ListQuotas(tenant.ID) {
+			if qd.Name == "tenant-external-ips-quota" {
+				return qd.Usage
+			}
+		}
+		return -1
+	}
+
+	before := usage()
+
+	block, err := ctl.ReserveBlock(tenant.ID, poolName, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(block) != 2 || block[0].BlockID == "" || block[0].BlockID != block[1].BlockID {
+		t.Fatalf("unexpected block %+v", block)
+	}
+
+	if after := usage(); after != before+2 {
+		t.Fatalf("expected external IP usage %d, got %d", before+2, after)
+	}
+
+	_, err = ctl.ReserveBlock(tenant.ID, poolName, 2)
+	if _, ok := err.(types.PoolExhaustedError); !ok {
+		t.Fatalf("expected pool exhausted, got %v", err)
+	}
+
+	if after := usage(); after != before+2 {
+		t.Fatalf("failed block changed external IP usage to %d", after)
+	}
+
+	_, err = ctl.ReserveBlock(tenant.ID, poolName, 0)
+	if err != types.ErrInvalidBlockSize {
+		t.Fatalf("expected %v, got %v", types.ErrInvalidBlockSize, err)
+	}
+
+	released, err := ctl.ReleaseBlock(tenant.ID, block[0].BlockID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if released != 2 {
+		t.Fatalf("expected 2 addresses released, got %d", released)
+	}
+
+	if after := usage(); after != before {
+		t.Fatalf("expected external IP usage %d, got %d", before, after)
+	}
+
+	for _, m := range ctl.ListMappedAddresses(&tenant.ID) {
+		if m.BlockID == block[0].BlockID {
+			t.Fatalf("mapping %s not released", m.ExternalIP)
+		}
+	}
+
+	err = deletePool(poolName)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMapMultipleAddresses(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	ips := []string{"10.10.3.1", "10.10.3.2", "10.10.3.3"}
+	poolName := "testmapmulti"
+
+	testAddPool(t, poolName, nil, ips)
+
+	tenantID := instances[0].TenantID
+	instanceID := instances[0].ID
+
+	for _, role := range []string{"", "management"} {
+		_, err := ctl.MapAddress(tenantID, &poolName, instanceID, "", role, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := ctl.MapAddress(tenantID, &poolName, instanceID, "", "management", 0)
+	if err != types.ErrDuplicateMappingRole {
+		t.Fatalf("expected %v, got %v", types.ErrDuplicateMappingRole, err)
+	}
+
+	var mapped []types.MappedIP
+	for _, m := range ctl.ListMappedAddresses(&tenantID) {
+		if m.InstanceID == instanceID {
+			mapped = append(mapped, m)
+		}
+	}
+	sort.Sort(types.SortedMappedIPsByIndex(mapped))
+
+	if len(mapped) != 2 {
+		t.Fatalf("expected 2 mappings for instance, got %d", len(mapped))
+	}
+
+	if mapped[0].Index != 0 || mapped[0].Role != "" ||
+		mapped[1].Index != 1 || mapped[1].Role != "management" {
+		t.Fatalf("unexpected mappings %v", mapped)
+	}
+
+	// the failed mapping must not use up an address.
+	pools, err := ctl.ListPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pool := range pools {
+		if pool.Name == poolName && pool.Free != 1 {
+			t.Fatalf("expected 1 free address, got %d", pool.Free)
+		}
+	}
+
+	for _, m := range mapped {
+		err = ctl.UnMapAddress(m.ExternalIP)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCreateTenant(t *testing.T) {
+	name := "tenant-" + uuid.Generate().String()
+
+	tenant, err := ctl.CreateTenant(types.Tenant{Name: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tenant.ID == "" || tenant.Name != name {
+		t.Fatalf("Unexpected tenant %+v", tenant)
+	}
+
+	stored, err := ctl.ds.GetTenant(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored == nil || stored.Name != name || stored.CNCIctrl == nil {
+		t.Fatalf("Tenant %s not stored correctly", tenant.ID)
+	}
+
+	_, err = ctl.CreateTenant(types.Tenant{Name: name})
+	if err != types.ErrTenantExists {
+		t.Fatalf("Expected %v creating a duplicate tenant, got %v", types.ErrTenantExists, err)
+	}
+
+	_, err = ctl.CreateTenant(types.Tenant{ID: tenant.ID, Name: name + "-2"})
+	if err != types.ErrTenantExists {
+		t.Fatalf("Expected %v reusing a tenant ID, got %v", types.ErrTenantExists, err)
+	}
+
+	_, err = ctl.CreateTenant(types.Tenant{})
+	if err != types.ErrInvalidTenantName {
+		t.Fatalf("Expected %v for an empty name, got %v", types.ErrInvalidTenantName, err)
+	}
+}
+
+func TestSuspendedTenant(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	r := mux.NewRouter()
+	r.Handle("/{tenant}/test", &suspendedTenantHandler{ctl: ctl, Next: next})
+
+	request := func(method string, privileged bool) int {
+		req := httptest.NewRequest(method, "/"+tenant.ID+"/test", nil)
+		req = req.WithContext(service.SetPrivilege(req.Context(), privileged))
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := request("POST", false); code != http.StatusNoContent {
+		t.Fatalf("Expected %d from enabled tenant, got %d", http.StatusNoContent, code)
+	}
+
+	err = ctl.SetTenantEnabled(tenant.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method     string
+		privileged bool
+		code       int
+	}{
+		{"POST", false, http.StatusForbidden},
+		{"DELETE", false, http.StatusForbidden},
+		{"GET", false, http.StatusNoContent},
+		{"POST", true, http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		if code := request(tt.method, tt.privileged); code != tt.code {
+			t.Errorf("%s (privileged %v): expected %d, got %d", tt.method, tt.privileged, tt.code, code)
+		}
+	}
+
+	err = ctl.SetTenantEnabled(tenant.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := request("POST", false); code != http.StatusNoContent {
+		t.Fatalf("Expected %d once re-enabled, got %d", http.StatusNoContent, code)
+	}
+}
+
+func TestInstanceExists(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	tenantID := instances[0].TenantID
+	instanceID := instances[0].ID
+
+	tests := []struct {
+		tenantID   string
+		instanceID string
+		exists     bool
+	}{
+		{tenantID, instanceID, true},
+		{"", instanceID, true},
+		{uuid.Generate().String(), instanceID, false},
+		{tenantID, uuid.Generate().String(), false},
+	}
+
+	for _, tt := range tests {
+		exists, err := ctl.InstanceExists(tt.tenantID, tt.instanceID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if exists != tt.exists {
+			t.Errorf("tenant %q, instance %s: expected %v, got %v", tt.tenantID, tt.instanceID, tt.exists, exists)
+		}
+	}
+}
+
+func TestPoolSelection(t *testing.T) {
+	defer func(strategy string) {
+		ctl.poolSelection = strategy
+	}(ctl.poolSelection)
+
+	pools := []types.Pool{
+		{ID: "1", Name: "full", Free: 0, TotalIPs: 4},
+		{ID: "2", Name: "busy", Free: 1, TotalIPs: 4},
+		{ID: "3", Name: "quiet", Free: 3, TotalIPs: 4},
+		{ID: "4", Name: "large", Free: 6, TotalIPs: 8},
+	}
+
+	tests := []struct {
+		strategy string
+		last     string
+		expected string
+	}{
+		{"", "", "busy"},
+		{types.PoolSelectionFillFirst, "2", "busy"},
+		{types.PoolSelectionRoundRobin, "", "busy"},
+		{types.PoolSelectionRoundRobin, "2", "quiet"},
+		{types.PoolSelectionRoundRobin, "3", "large"},
+		{types.PoolSelectionRoundRobin, "4", "busy"},
+		{types.PoolSelectionLeastUsed, "", "quiet"},
+	}
+
+	for _, tt := range tests {
+		ctl.poolSelection = tt.strategy
+		ctl.poolAllocated(tt.last)
+
+		pool, err := ctl.choosePool(pools, ctl.PoolSelection())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if pool.Name != tt.expected {
+			t.Errorf("%s after %q: got pool %s, expected %s", ctl.PoolSelection(), tt.last, pool.Name, tt.expected)
+		}
+	}
+
+	_, err := ctl.choosePool(pools[:1], ctl.PoolSelection())
+	if _, ok := err.(types.PoolExhaustedError); !ok {
+		t.Fatalf("expected PoolExhaustedError, got %v", err)
+	}
+}
+
+func TestOrderPools(t *testing.T) {
+	defer func(strategy string) {
+		ctl.poolSelection = strategy
+	}(ctl.poolSelection)
+
+	pools := []types.Pool{
+		{ID: "1", Name: "full", Free: 0, TotalIPs: 4},
+		{ID: "2", Name: "busy", Free: 1, TotalIPs: 4},
+		{ID: "3", Name: "quiet", Free: 3, TotalIPs: 4},
+		{ID: "4", Name: "drained", Free: 4, TotalIPs: 4, Drained: true},
+		{ID: "5", Name: "large", Free: 6, TotalIPs: 8},
+	}
+
+	tests := []struct {
+		strategy string
+		last     string
+		expected []string
+	}{
+		{types.PoolSelectionFillFirst, "", []string{"busy", "quiet", "large"}},
+		{types.PoolSelectionRoundRobin, "3", []string{"large", "busy", "quiet"}},
+		{types.PoolSelectionLeastUsed, "", []string{"quiet", "large", "busy"}},
+	}
+
+	for _, tt := range tests {
+		ctl.poolSelection = tt.strategy
+		ctl.poolAllocated(tt.last)
+
+		order, excluded := ctl.orderPools(pools, ctl.PoolSelection())
+
+		var names []string
+		for _, choice := range order {
+			names = append(names, choice.pool.Name)
+		}
+
+		if !reflect.DeepEqual(names, tt.expected) {
+			t.Errorf("%s after %q: got order %v, expected %v", tt.strategy, tt.last, names, tt.expected)
+		}
+
+		if len(excluded) != 2 || excluded[0].reason != "no free addresses" || excluded[1].reason != "drained" {
+			t.Errorf("%s: unexpected excluded pools %+v", tt.strategy, excluded)
+		}
+	}
+}
+
+func TestPoolOrder(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	poolName := "testpoolorder"
+	pool, err := ctl.AddPool(poolName, nil, []string{"10.40.17.1"}, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeletePool(pool.ID, true)
+
+	err = ctl.SetTenantDefaultPool(tenant.ID, poolName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.SetTenantDefaultPool(tenant.ID, "")
+
+	order, err := ctl.PoolOrder(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if order.DefaultPool == nil || order.DefaultPool.PoolID != pool.ID {
+		t.Fatalf("expected default pool %s, got %+v", pool.ID, order.DefaultPool)
+	}
+
+	if len(order.Pools) != 1 || order.Pools[0].PoolID != pool.ID || order.Pools[0].Rank != 1 {
+		t.Fatalf("expected only the default pool to be considered, got %+v", order.Pools)
+	}
+
+	_, err = ctl.PoolOrder(uuid.Generate().String())
+	if err != types.ErrTenantNotFound {
+		t.Fatalf("expected %v, got %v", types.ErrTenantNotFound, err)
+	}
+}
+
+func TestTenantPoolStrategy(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	strategy, err := ctl.TenantPoolStrategy(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strategy.Inherited || strategy.Strategy != ctl.PoolSelection() {
+		t.Fatalf("expected the controller's strategy, got %+v", strategy)
+	}
+
+	override := types.PoolSelectionRoundRobin
+	if ctl.PoolSelection() == override {
+		override = types.PoolSelectionLeastUsed
+	}
+
+	err = ctl.SetTenantPoolStrategy(tenant.ID, override)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	strategy, err = ctl.TenantPoolStrategy(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strategy.Inherited || strategy.Strategy != override {
+		t.Fatalf("expected strategy %s, got %+v", override, strategy)
+	}
+
+	order, err := ctl.PoolOrder(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if order.Strategy != override {
+		t.Fatalf("expected pools ordered by %s, got %s", override, order.Strategy)
+	}
+
+	err = ctl.SetTenantPoolStrategy(tenant.ID, "random")
+	if err != types.ErrInvalidPoolSelection {
+		t.Fatalf("expected %v, got %v", types.ErrInvalidPoolSelection, err)
+	}
+
+	err = ctl.SetTenantPoolStrategy(tenant.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	strategy, err = ctl.TenantPoolStrategy(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strategy.Inherited || strategy.Strategy != ctl.PoolSelection() {
+		t.Fatalf("expected the controller's strategy once cleared, got %+v", strategy)
+	}
+
+	err = ctl.SetTenantPoolStrategy(uuid.Generate().String(), override)
+	if err != types.ErrTenantNotFound {
+		t.Fatalf("expected %v, got %v", types.ErrTenantNotFound, err)
+	}
+}
+
+var ctl *controller
+var server *testutil.SsntpTestServer
+var wrappedClient *ssntpClientWrapper
+
+func TestMapAddressPoolExhausted(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	poolName := "testexhausted"
+	pool, err := ctl.AddPool(poolName, nil, []string{}, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeletePool(pool.ID, true)
+
+	_, err = ctl.MapAddress(instances[0].TenantID, &poolName, instances[0].ID, "", "", 0)
+	exhausted, ok := err.(types.PoolExhaustedError)
+	if !ok {
+		t.Fatalf("expected pool exhausted error, got %v", err)
+	}
+
+	if exhausted.PoolID != pool.ID || exhausted.PoolName != poolName {
+		t.Fatalf("unexpected pool in error: %+v", exhausted)
+	}
+
+	missing := "testexhaustednopool"
+	_, err = ctl.MapAddress(instances[0].TenantID, &missing, instances[0].ID, "", "", 0)
+	if err != types.ErrPoolNotFound {
+		t.Fatalf("expected %v, got %v", types.ErrPoolNotFound, err)
+	}
+}
+
+func TestReclaimAddresses(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	poolName := "testreclaim"
+	pool, err := ctl.AddPool(poolName, nil, []string{"10.40.13.1", "10.40.13.2"}, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeletePool(pool.ID, true)
+
+	stale, err := ctl.MapAddress(tenant.ID, &poolName, "", "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.UnMapAddress(stale.ExternalIP)
+
+	leased, err := ctl.MapAddress(tenant.ID, &poolName, "", "", "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.UnMapAddress(leased.ExternalIP)
+
+	addresses, err := ctl.ReclaimableAddresses(pool.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(addresses) != 0 {
+		t.Fatalf("expected nothing reclaimable, got %+v", addresses)
+	}
+
+	addresses, err = ctl.ReclaimableAddresses(pool.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(addresses) != 1 || addresses[0].MappingID != stale.ID || addresses[0].TenantID != tenant.ID {
+		t.Fatalf("expected %s to be reclaimable, got %+v", stale.ExternalIP, addresses)
+	}
+
+	count, err := ctl.ReclaimAddresses(pool.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 1 {
+		t.Fatalf("expected 1 reclaimed, got %d", count)
+	}
+
+	_, err = ctl.ds.GetMappedIP(stale.ExternalIP)
+	if err != types.ErrAddressNotFound {
+		t.Fatalf("expected %s to be released, got %v", stale.ExternalIP, err)
+	}
+
+	_, err = ctl.ReclaimableAddresses(uuid.Generate().String(), 0)
+	if err != types.ErrPoolNotFound {
+		t.Fatalf("expected %v, got %v", types.ErrPoolNotFound, err)
+	}
+}
+
+func TestPoolExhaustedRetryAfter(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	poolName := "testexhaustedlease"
+	pool, err := ctl.AddPool(poolName, nil, []string{"10.40.12.1"}, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeletePool(pool.ID, true)
+
+	m, err := ctl.MapAddress(tenant.ID, &poolName, "", "", "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.UnMapAddress(m.ExternalIP)
+
+	_, err = ctl.MapAddress(tenant.ID, &poolName, "", "", "", 0)
+	exhausted, ok := err.(types.PoolExhaustedError)
+	if !ok {
+		t.Fatalf("expected pool exhausted error, got %v", err)
+	}
+
+	max := int((time.Minute + leaseReaperInterval) / time.Second)
+	if exhausted.RetryAfter < max-5 || exhausted.RetryAfter > max {
+		t.Fatalf("expected retry after about %d seconds, got %d", max, exhausted.RetryAfter)
+	}
+}
+
+func TestReserveAddress(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	tenantID := instances[0].TenantID
+	poolName := "testreserve"
+
+	pool, err := ctl.AddPool(poolName, nil, []string{"10.30.0.1", "10.30.0.2"}, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ctl.MapAddress("", &poolName, "", "", "", 0)
+	if err != types.ErrBadRequest {
+		t.Fatalf("expected %v, got %v", types.ErrBadRequest, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err = ctl.MapAddress(tenantID, &poolName, "", "", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var reserved []types.MappedIP
+	for _, m := range ctl.ListMappedAddresses(&tenantID) {
+		if m.PoolID != pool.ID {
+			continue
+		}
+
+		if m.Status != types.MappedIPReserved || m.InstanceID != "" {
+			t.Fatalf("expected unattached reservation, got %+v", m)
+		}
+
+		reserved = append(reserved, m)
+	}
+
+	if len(reserved) != 2 {
+		t.Fatalf("expected 2 reserved addresses, got %d", len(reserved))
+	}
+
+	err = ctl.RemapAddress(tenantID, reserved[0].ExternalIP, instances[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := ctl.ds.GetMappedIP(reserved[0].ExternalIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Status != types.MappedIPAttached || m.InstanceID != instances[0].ID {
+		t.Fatalf("expected address attached to instance, got %+v", m)
+	}
+
+	err = ctl.RemapAddress(tenantID, reserved[0].ExternalIP, instances[0].ID)
+	if err != types.ErrAddressAttached {
+		t.Fatalf("expected %v, got %v", types.ErrAddressAttached, err)
+	}
+
+	// releasing a reservation doesn't need the CNCI.
+	err = ctl.UnMapAddress(reserved[1].ExternalIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := ctl.ShowPool(pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Free != 1 {
+		t.Fatalf("expected 1 free address, got %d", p.Free)
+	}
+}
+
+func TestReservationLease(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	tenantID := instances[0].TenantID
+	poolName := "testlease"
+
+	pool, err := ctl.AddPool(poolName, nil, []string{"10.30.1.1", "10.30.1.2"}, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reserved []types.MappedIP
+	for i := 0; i < 2; i++ {
+		m, err := ctl.MapAddress(tenantID, &poolName, "", "", "", time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if m.Expires == nil {
+			t.Fatalf("expected reservation %s to have an expiry time", m.ExternalIP)
+		}
+
+		reserved = append(reserved, m)
+	}
+
+	// mapping an instance cancels the lease.
+	err = ctl.RemapAddress(tenantID, reserved[0].ExternalIP, instances[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctl.releaseExpiredReservations(time.Now())
+
+	p, err := ctl.ShowPool(pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Free != 0 {
+		t.Fatalf("expected no reservations to be released before expiry, got %d free", p.Free)
+	}
+
+	ctl.releaseExpiredReservations(time.Now().Add(2 * time.Hour))
+
+	m, err := ctl.ds.GetMappedIP(reserved[0].ExternalIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Status != types.MappedIPAttached || m.Expires != nil {
+		t.Fatalf("expected mapped address to have no lease, got %+v", m)
+	}
+
+	_, err = ctl.ds.GetMappedIP(reserved[1].ExternalIP)
+	if err != types.ErrAddressNotFound {
+		t.Fatalf("expected expired reservation to be released, got %v", err)
+	}
+
+	p, err = ctl.ShowPool(pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Free != 1 {
+		t.Fatalf("expected 1 free address, got %d", p.Free)
+	}
+}
+
+func TestWatchMappedAddresses(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	tenantID := instances[0].TenantID
+	otherID := uuid.Generate().String()
+	poolName := "testwatch"
+
+	pool, err := ctl.AddPool(poolName, nil, []string{"10.31.0.1", "10.31.0.2"}, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, stop := ctl.WatchMappedAddresses(&tenantID)
+	defer stop()
+
+	others, stopOthers := ctl.WatchMappedAddresses(&otherID)
+	defer stopOthers()
+
+	expectChange := func(changeType string) types.MappedIP {
+		select {
+		case change := <-changes:
+			if change.Type != changeType || change.Mapping.PoolID != pool.ID {
+				t.Fatalf("expected %s change in pool %s, got %+v", changeType, pool.ID, change)
+			}
+			return change.Mapping
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s change", changeType)
+		}
+		return types.MappedIP{}
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err = ctl.MapAddress(tenantID, &poolName, "", "", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first := expectChange(types.MappedIPCreated)
+	second := expectChange(types.MappedIPCreated)
+
+	err = ctl.RemapAddress(tenantID, first.ExternalIP, instances[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := expectChange(types.MappedIPChanged)
+	if m.Status != types.MappedIPAttached || m.InstanceID != instances[0].ID {
+		t.Fatalf("expected address attached to instance, got %+v", m)
+	}
+
+	err = ctl.UnMapAddress(second.ExternalIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m = expectChange(types.MappedIPDeleted)
+	if m.ExternalIP != second.ExternalIP {
+		t.Fatalf("expected %s to be unmapped, got %s", second.ExternalIP, m.ExternalIP)
+	}
+
+	select {
+	case change := <-others:
+		t.Fatalf("unexpected change for other tenant: %+v", change)
+	default:
+	}
+}
+
+func TestExceededQuotas(t *testing.T) {
+	over, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	under, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tenant := range []*types.Tenant{over, under} {
+		err = ctl.UpdateQuotas(tenant.ID, []types.QuotaDetails{{Name: "tenant-vcpu-quota", Value: 2}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctl.qs.SetUsage(over.ID, payloads.RequestedResource{Type: payloads.VCPUs, Value: 3})
+	ctl.qs.SetUsage(under.ID, payloads.RequestedResource{Type: payloads.VCPUs, Value: 2})
+
+	exceeded, err := ctl.ExceededQuotas()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, e := range exceeded {
+		if e.TenantID == under.ID {
+			t.Fatalf("tenant %s at its quota reported as exceeding it", under.ID)
+		}
+
+		if e.TenantID != over.ID {
+			continue
+		}
+
+		found = true
+		if len(e.Quotas) != 1 || e.Quotas[0].Name != "tenant-vcpu-quota" || e.Quotas[0].Usage != 3 {
+			t.Fatalf("unexpected exceeded quotas %+v", e.Quotas)
+		}
+	}
+
+	if !found {
+		t.Fatalf("tenant %s over its quota not reported", over.ID)
+	}
+}
+
+func TestEffectiveQuotas(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.UpdateQuotas(tenant.ID, []types.QuotaDetails{{Name: "tenant-vcpu-quota", Value: 8}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.UpdateSubQuotas(tenant.ID, "web", []types.QuotaDetails{{Name: "tenant-vcpu-quota", Value: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eqs, err := ctl.EffectiveQuotas(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := make(map[string]types.EffectiveQuota)
+	for _, eq := range eqs {
+		found[eq.Quota.Name] = eq
+	}
+
+	vcpu := found["tenant-vcpu-quota"]
+	if vcpu.Source != types.QuotaSourceOverride || vcpu.Quota.Value != 8 || vcpu.SubQuotas["web"] != 3 {
+		t.Errorf("unexpected vcpu quota %+v", vcpu)
+	}
+
+	mem, ok := found["tenant-mem-quota"]
+	if !ok || mem.Source != types.QuotaSourceDefault || mem.Quota.Value != -1 || mem.SubQuotas != nil {
+		t.Errorf("unexpected memory quota %+v", mem)
+	}
+}
+
+func TestQuotaSnapshot(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.UpdateQuotas(tenant.ID, []types.QuotaDetails{{Name: "tenant-vcpu-quota", Value: 8}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.UpdateSubQuotas(tenant.ID, "web", []types.QuotaDetails{{Name: "tenant-vcpu-quota", Value: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := ctl.QuotaSnapshot(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// experiment with the tenant's quotas, tightening vcpus so the old
+	// sub-quota would not fit and limiting memory.
+	err = ctl.UpdateSubQuotas(tenant.ID, "web", []types.QuotaDetails{{Name: "tenant-vcpu-quota", Value: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.UpdateQuotas(tenant.ID, []types.QuotaDetails{
+		{Name: "tenant-vcpu-quota", Value: 2},
+		{Name: "tenant-mem-quota", Value: 1024},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.UpdateSubQuotas(tenant.ID, "batch", []types.QuotaDetails{{Name: "tenant-vcpu-quota", Value: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot.Quotas = append(snapshot.Quotas, types.QuotaDetails{Name: "tenant-retired-quota", Value: 1})
+
+	skipped, err := ctl.RestoreQuotas(tenant.ID, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []types.SkippedQuota{{Name: "tenant-retired-quota", Reason: "unknown quota"}}
+	if !reflect.DeepEqual(skipped, expected) {
+		t.Fatalf("expected %v skipped, got %v", expected, skipped)
+	}
+
+	eqs, err := ctl.EffectiveQuotas(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := make(map[string]types.EffectiveQuota)
+	for _, eq := range eqs {
+		found[eq.Quota.Name] = eq
+	}
+
+	vcpu := found["tenant-vcpu-quota"]
+	if vcpu.Source != types.QuotaSourceOverride || vcpu.Quota.Value != 8 || !reflect.DeepEqual(vcpu.SubQuotas, map[string]int{"web": 3}) {
+		t.Errorf("unexpected vcpu quota %+v", vcpu)
+	}
+
+	mem := found["tenant-mem-quota"]
+	if mem.Source != types.QuotaSourceDefault || mem.Quota.Value != -1 {
+		t.Errorf("unexpected memory quota %+v", mem)
+	}
+
+	_, err = ctl.QuotaSnapshot("3cf5b53d-4a21-4a1b-8c4d-6a7fb3fc0a2e")
+	if err != types.ErrTenantNotFound {
+		t.Fatalf("expected %v, got %v", types.ErrTenantNotFound, err)
+	}
+}
+
+func TestAccrueIPTime(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	poolName := "iphourspool"
+	testAddPool(t, poolName, nil, []string{"10.10.7.1"})
+
+	m, err := ctl.MapAddress(tenant.ID, &poolName, "", "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.UnMapAddress(m.ExternalIP)
+
+	usage := func() int {
+		for _, qd := range ctl.ListQuotas(tenant.ID) {
+			if qd.Name == "tenant-ip-hours-quota" {
+				return qd.Usage
+			}
+		}
+		t.Fatal("ip-hours quota not found")
+		return 0
+	}
+
+	ctl.accrueIPTime(90 * time.Minute)
+	if usage() != 1 {
+		t.Fatalf("expected 1 ip-hour, got %d", usage())
+	}
+
+	ctl.accrueIPTime(30 * time.Minute)
+	if usage() != 2 {
+		t.Fatalf("expected 2 ip-hours, got %d", usage())
+	}
+
+	// accrued time is not counted again from the datastore.
+	err = ctl.RecalculateUsage(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if usage() != 2 {
+		t.Fatalf("expected 2 ip-hours after recalculation, got %d", usage())
+	}
+}
+
+func TestRecalculateUsage(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	tenantID := instances[0].TenantID
+
+	usage := func() int {
+		for _, qd := range ctl.ListQuotas(tenantID) {
+			if qd.Name == "tenant-external-ips-quota" {
+				return qd.Usage
+			}
+		}
+		t.Fatal("external IP quota not found")
+		return 0
+	}
+
+	expected := len(ctl.ListMappedAddresses(&tenantID))
+
+	// pretend some external IPs were leaked.
+	<-ctl.qs.Consume(tenantID, payloads.RequestedResource{Type: payloads.ExternalIP, Value: 5})
+	if usage() != expected+5 {
+		t.Fatal("usage not consumed")
+	}
+
+	err := ctl.RecalculateUsage(tenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if usage() != expected {
+		t.Fatalf("expected external IP usage of %d, got %d", expected, usage())
+	}
+}
+
+func TestNextFreeAddress(t *testing.T) {
+	subnet := "10.40.21.0/30"
+	pool, err := ctl.AddPool("testnextfree", &subnet, []string{}, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ctl.DeletePool(pool.ID, true) }()
+
+	other := "10.40.21.8/30"
+	err = ctl.AddAddress(pool.ID, &other, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := ctl.ShowPool(pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	IP, err := ctl.NextFreeAddress(pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if IP.Address != "10.40.21.1" {
+		t.Fatalf("unexpected next free address %s", IP.Address)
+	}
+
+	p, err := ctl.ShowPool(pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Free != before.Free {
+		t.Fatal("peeking changed the number of free addresses")
+	}
+
+	// drained subnets are skipped.
+	for _, sub := range p.Subnets {
+		err = ctl.DrainSubnet(pool.ID, sub.ID, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		IP, err = ctl.NextFreeAddress(pool.ID)
+		if sub.CIDR == subnet {
+			if err != nil || IP.Address != "10.40.21.9" {
+				t.Fatalf("expected 10.40.21.9, got %s, %v", IP.Address, err)
+			}
+			continue
+		}
+
+		if _, ok := err.(types.PoolExhaustedError); !ok {
+			t.Fatalf("expected pool exhausted, got %v", err)
+		}
+	}
+
+	_, err = ctl.NextFreeAddress(uuid.Generate().String())
+	if err != types.ErrPoolNotFound {
+		t.Fatalf("expected %v, got %v", types.ErrPoolNotFound, err)
+	}
+}
+
+func TestPreviewAllocation(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	poolName := "testpreview"
+	subnet := "10.20.0.0/30"
+	pool, err := ctl.AddPool(poolName, &subnet, []string{}, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	IP, err := ctl.PreviewAllocation(instances[0].TenantID, poolName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if IP.Address != "10.20.0.1" {
+		t.Fatalf("unexpected preview address %s", IP.Address)
+	}
+
+	// previewing must not allocate anything.
+	p, err := ctl.ShowPool(pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Free != pool.Free {
+		t.Fatal("preview changed the number of free addresses")
+	}
+
+	_, err = ctl.MapAddress(instances[0].TenantID, &poolName, instances[0].ID, "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenantID := instances[0].TenantID
+	found := false
+	for _, m := range ctl.ListMappedAddresses(&tenantID) {
+		if m.ExternalIP == IP.Address {
+			found = true
+			err = ctl.UnMapAddress(m.ExternalIP)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if !found {
+		t.Fatalf("allocation did not use previewed address %s", IP.Address)
+	}
+}
+
+func TestPoolTags(t *testing.T) {
+	pool, err := ctl.AddPool("tagpool", nil, []string{}, []string{"dmz", "dmz", "partner"}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeletePool(pool.ID, true)
+
+	if !reflect.DeepEqual(pool.Tags, []string{"dmz", "partner"}) {
+		t.Fatalf("unexpected tags %v", pool.Tags)
+	}
+
+	err = ctl.UpdatePoolTags(pool.ID, []string{"internal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err = ctl.ShowPool(pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(pool.Tags, []string{"internal"}) {
+		t.Fatalf("tags not updated: %v", pool.Tags)
+	}
+
+	err = ctl.UpdatePoolTags(pool.ID, []string{""})
+	if err != types.ErrBadRequest {
+		t.Fatalf("expected %v, got %v", types.ErrBadRequest, err)
+	}
+}
+
+func TestMapAddressTimedOut(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	poolName := "testmapaddresstimedout"
+	pool, err := ctl.AddPool(poolName, nil, []string{"10.40.32.1"}, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeletePool(pool.ID, true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = ctl.WithContext(ctx).MapAddress(tenant.ID, &poolName, "", "", "", 0)
+	if err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+
+	if IPs := ctl.ListMappedAddresses(&tenant.ID); len(IPs) != 0 {
+		t.Fatalf("expected no mappings once the request was given up, got %+v", IPs)
+	}
+
+	pool, err = ctl.ShowPool(pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pool.Free != 1 {
+		t.Fatalf("expected the address to be left free, got %d free", pool.Free)
+	}
+}
+
+func TestTenantScopedPool(t *testing.T) {
+	owner, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	poolName := "testtenantscopedpool"
+	pool, err := ctl.AddPool(poolName, nil, []string{"10.40.31.1", "10.40.31.2"}, nil, "", owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeletePool(pool.ID, true)
+
+	if pool.TenantID != owner.ID {
+		t.Fatalf("expected pool scoped to %s, got %q", owner.ID, pool.TenantID)
+	}
+
+	_, err = ctl.MapAddress(other.ID, &poolName, "", "", "", 0)
+	if err != types.ErrForbidden {
+		t.Fatalf("expected %v, got %v", types.ErrForbidden, err)
+	}
+
+	_, err = ctl.ds.ReserveExternalIPBlock(pool.ID, other.ID, 2, 0)
+	if err != types.ErrForbidden {
+		t.Fatalf("expected %v, got %v", types.ErrForbidden, err)
+	}
+
+	order, err := ctl.PoolOrder(other.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range append(order.Pools, order.Excluded...) {
+		if e.PoolID == pool.ID {
+			t.Fatalf("pool scoped to %s offered to %s", owner.ID, other.ID)
+		}
+	}
+
+	m, err := ctl.MapAddress(owner.ID, &poolName, "", "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.UnMapAddress(m.ExternalIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRenamePool(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	poolName := "renamepool"
+	pool, err := ctl.AddPool(poolName, nil, []string{"10.40.29.1"}, []string{}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeletePool(pool.ID, true)
+
+	m, err := ctl.MapAddress(tenant.ID, &poolName, "", "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.UnMapAddress(m.ExternalIP)
+
+	other, err := ctl.AddPool("otherpool", nil, []string{}, []string{}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeletePool(other.ID, true)
+
+	err = ctl.RenamePool(pool.ID, "renamedpool")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err = ctl.ShowPool(pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pool.Name != "renamedpool" {
+		t.Fatalf("pool not renamed: %s", pool.Name)
+	}
+
+	IPs := ctl.ListMappedAddresses(&tenant.ID)
+	if len(IPs) != 1 || IPs[0].PoolName != "renamedpool" {
+		t.Fatalf("expected the mapping to show the new pool name, got %+v", IPs)
+	}
+
+	// keeping the same name is not a collision.
+	err = ctl.RenamePool(pool.ID, "renamedpool")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.RenamePool(pool.ID, "otherpool")
+	if err != types.ErrDuplicatePoolName {
+		t.Fatalf("expected %v, got %v", types.ErrDuplicatePoolName, err)
+	}
+
+	err = ctl.RenamePool(pool.ID, "OtherPool")
+	if err != types.ErrDuplicatePoolName {
+		t.Fatalf("expected %v, got %v", types.ErrDuplicatePoolName, err)
+	}
+
+	err = ctl.RenamePool(pool.ID, "")
+	if err != types.ErrInvalidPoolName {
+		t.Fatalf("expected %v, got %v", types.ErrInvalidPoolName, err)
+	}
+}
+
+func TestPoolNameCase(t *testing.T) {
+	pool, err := ctl.AddPool("MixedCasePool", nil, []string{"10.10.4.1"}, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeletePool(pool.ID, true)
+
+	_, err = ctl.AddPool("mixedcasepool", nil, []string{}, nil, "", "")
+	if err != types.ErrDuplicatePoolName {
+		t.Fatalf("expected %v, got %v", types.ErrDuplicatePoolName, err)
+	}
+
+	name := "MIXEDCASEPOOL"
+	selected, err := ctl.selectPool("", &name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if selected.ID != pool.ID {
+		t.Fatalf("expected pool %s, got %s", pool.ID, selected.ID)
+	}
+
+	// the name keeps the case it was given.
+	if selected.Name != "MixedCasePool" {
+		t.Fatalf("expected name MixedCasePool, got %s", selected.Name)
+	}
+}
+
+func TestTenantDefaultPool(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err := ctl.AddPool("defaultpool", nil, []string{"10.10.5.1"}, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	private := types.Pool{
+		ID:       uuid.Generate().String(),
+		Name:     "privatedefaultpool",
+		TenantID: uuid.Generate().String(),
+	}
+
+	_, err = ctl.ImportPools(types.PoolExport{Pools: []types.Pool{private}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeletePool(private.ID, true)
+
+	err = ctl.SetTenantDefaultPool(tenant.ID, private.Name)
+	if err != types.ErrForbidden {
+		t.Fatalf("expected %v, got %v", types.ErrForbidden, err)
+	}
+
+	err = ctl.SetTenantDefaultPool(tenant.ID, "DefaultPool")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	def, err := ctl.TenantDefaultPool(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if def.PoolID != pool.ID || def.PoolName != "defaultpool" {
+		t.Fatalf("unexpected default pool %+v", def)
+	}
+
+	selected, err := ctl.selectPool(tenant.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if selected.ID != pool.ID {
+		t.Fatalf("expected default pool %s, got %s", pool.ID, selected.ID)
+	}
+
+	err = ctl.SetTenantDefaultPool(tenant.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	def, err = ctl.TenantDefaultPool(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if def.PoolID != "" {
+		t.Fatalf("default pool not removed: %+v", def)
+	}
+
+	// deleting a pool removes it as a default.
+	err = ctl.SetTenantDefaultPool(tenant.ID, pool.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.DeletePool(pool.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	def, err = ctl.TenantDefaultPool(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if def.PoolID != "" {
+		t.Fatalf("deleted pool still a default: %+v", def)
+	}
+
+	_, err = ctl.TenantDefaultPool(uuid.Generate().String())
+	if err != types.ErrTenantNotFound {
+		t.Fatalf("expected %v, got %v", types.ErrTenantNotFound, err)
+	}
+}
+
+func TestDrainPool(t *testing.T) {
+	subnet := "10.10.6.0/30"
+	pool, err := ctl.AddPool("drainpool", &subnet, nil, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.AddAddress(pool.ID, nil, []string{"10.10.6.9"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err = ctl.ShowPool(pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.DrainSubnet(pool.ID, pool.Subnets[0].ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.DrainSubnet(pool.ID, "unknown", true)
+	if err != types.ErrInvalidPoolAddress {
+		t.Fatalf("expected %v, got %v", types.ErrInvalidPoolAddress, err)
+	}
+
+	IP, err := ctl.PreviewAllocation("", pool.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if IP.Address != "10.10.6.9" {
+		t.Fatalf("expected 10.10.6.9 from outside the drained subnet, got %s", IP.Address)
+	}
+
+	err = ctl.DrainPool(pool.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err = ctl.ShowPool(pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !pool.Drained || !pool.Subnets[0].Drained {
+		t.Fatalf("expected a drained pool and subnet, got %+v", pool)
+	}
+
+	_, err = ctl.PreviewAllocation("", pool.Name)
+	if err != types.ErrPoolDrained {
+		t.Fatalf("expected %v, got %v", types.ErrPoolDrained, err)
+	}
+
+	// a drained pool is never the last of a family, but it must still
+	// be emptied first.
+	err = ctl.DeletePool(pool.ID, false)
+	if _, ok := err.(types.PoolNotEmptyError); !ok {
+		t.Fatalf("expected pool not empty, got %v", err)
+	}
+
+	err = ctl.DeletePool(pool.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubnetBitmap(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subnet := "10.40.11.0/29"
+	pool, err := ctl.AddPool("bitmappool", &subnet, nil, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeletePool(pool.ID, true)
+
+	var mappings []types.MappedIP
+	for i := 0; i < 3; i++ {
+		m, err := ctl.MapAddress(tenant.ID, &pool.Name, "", "", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ctl.UnMapAddress(m.ExternalIP)
+
+		mappings = append(mappings, m)
+	}
+
+	err = ctl.UnMapAddress(mappings[1].ExternalIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bitmap, err := ctl.SubnetBitmap(pool.ID, pool.Subnets[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := types.SubnetBitmap{
+		ID:        pool.Subnets[0].ID,
+		CIDR:      subnet,
+		Allocated: 2,
+		Bitmap:    "UA==",
+		Ranges: []types.AddressRange{
+			{First: "10.40.11.1", Last: "10.40.11.1"},
+			{First: "10.40.11.3", Last: "10.40.11.3"},
+		},
+	}
+
+	if !reflect.DeepEqual(bitmap, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, bitmap)
+	}
+
+	_, err = ctl.SubnetBitmap(pool.ID, "a6e7f58b-2b8c-4f77-9117-0b6bd4cbe1f2")
+	if err != types.ErrInvalidPoolAddress {
+		t.Fatalf("expected %v, got %v", types.ErrInvalidPoolAddress, err)
+	}
+}
+
+func TestPoolFragmentation(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subnet := "10.40.23.0/29"
+	pool, err := ctl.AddPool("fragmentationpool", &subnet, nil, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeletePool(pool.ID, true)
+
+	frag, err := ctl.PoolFragmentation(pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if frag.Free != 6 || frag.FreeBlocks != 1 || frag.LargestFreeBlock != 6 || frag.Fragmentation != 0 {
+		t.Fatalf("unexpected fragmentation of an empty pool %+v", frag)
+	}
+
+	var mappings []types.MappedIP
+	for i := 0; i < 3; i++ {
+		m, err := ctl.MapAddress(tenant.ID, &pool.Name, "", "", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ctl.UnMapAddress(m.ExternalIP)
+
+		mappings = append(mappings, m)
+	}
+
+	// leaving .1 and .3 allocated splits the free addresses into .2
+	// and .4 to .6.
+	err = ctl.UnMapAddress(mappings[1].ExternalIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frag, err = ctl.PoolFragmentation(pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := types.SubnetFragmentation{
+		ID:               pool.Subnets[0].ID,
+		CIDR:             subnet,
+		Free:             4,
+		FreeBlocks:       2,
+		LargestFreeBlock: 3,
+		LargestFreeRange: &types.AddressRange{First: "10.40.23.4", Last: "10.40.23.6"},
+	}
+
+	if len(frag.Subnets) != 1 || !reflect.DeepEqual(frag.Subnets[0], expected) {
+		t.Fatalf("expected %+v, got %+v", expected, frag.Subnets)
+	}
+
+	if frag.Free != 4 || frag.FreeBlocks != 2 || frag.LargestFreeBlock != 3 || frag.Fragmentation != 0.25 {
+		t.Fatalf("unexpected fragmentation %+v", frag)
+	}
+
+	_, err = ctl.PoolFragmentation("a6e7f58b-2b8c-4f77-9117-0b6bd4cbe1f2")
+	if err != types.ErrPoolNotFound {
+		t.Fatalf("expected %v, got %v", types.ErrPoolNotFound, err)
+	}
+}
+
+func TestShowSubnet(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subnet := "10.10.8.0/29"
+	pool, err := ctl.AddPool("inventorypool", &subnet, nil, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeletePool(pool.ID, true)
+
+	m, err := ctl.MapAddress(tenant.ID, &pool.Name, "", "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.UnMapAddress(m.ExternalIP)
+
+	subnetID := pool.Subnets[0].ID
+
+	inventory, err := ctl.ShowSubnet(pool.ID, subnetID, 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(inventory.Addresses) != 3 || inventory.Addresses[0].Address != "10.10.8.1" ||
+		inventory.Addresses[2].Address != "10.10.8.3" {
+		t.Fatalf("unexpected addresses %+v", inventory.Addresses)
+	}
+
+	first := inventory.Addresses[0]
+	if first.Address != m.ExternalIP || first.Status != types.MappedIPReserved ||
+		first.MappingID != m.ID || first.TenantID != tenant.ID {
+		t.Fatalf("expected %s to be reserved, got %+v", m.ExternalIP, first)
+	}
+
+	if inventory.Addresses[1].Status != types.SubnetAddressFree {
+		t.Fatalf("expected a free address, got %+v", inventory.Addresses[1])
+	}
+
+	hasNext := func(inventory types.SubnetInventory) bool {
+		for _, l := range inventory.Links {
+			if l.Rel == "next" {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !hasNext(inventory) {
+		t.Fatal("expected a next link")
+	}
+
+	inventory, err = ctl.ShowSubnet(pool.ID, subnetID, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(inventory.Addresses) != 2 || inventory.Addresses[1].Address != "10.10.8.7" || hasNext(inventory) {
+		t.Fatalf("unexpected last page %+v", inventory)
+	}
+
+	inventory, err = ctl.ShowSubnet(pool.ID, subnetID, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(inventory.Addresses) != 0 {
+		t.Fatalf("expected no addresses past the end, got %+v", inventory.Addresses)
+	}
+
+	_, err = ctl.ShowSubnet(pool.ID, "unknown", 0, 0)
+	if err != types.ErrInvalidPoolAddress {
+		t.Fatalf("expected %v, got %v", types.ErrInvalidPoolAddress, err)
+	}
+}
+
+func TestCertScopes(t *testing.T) {
+	units := []string{"Engineering", service.ScopePoolsWrite, "Operations", service.ScopeQuotasWrite}
+
+	scopes := certScopes(units)
+	expected := []string{service.ScopePoolsWrite, service.ScopeQuotasWrite}
+	if !reflect.DeepEqual(scopes, expected) {
+		t.Fatalf("expected %v, got %v", expected, scopes)
+	}
+
+	if scopes := certScopes([]string{"Engineering"}); len(scopes) != 0 {
+		t.Fatalf("expected no scopes, got %v", scopes)
+	}
+}
+
+func TestWatchTenantEvents(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	poolName := "testwatchtenantevents"
+	pool, err := ctl.AddPool(poolName, nil, []string{"10.40.30.1"}, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeletePool(pool.ID, true)
+
+	events, stop, err := ctl.WatchTenantEvents(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	m, err := ctl.MapAddress(tenant.ID, &poolName, "", "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.UnMapAddress(m.ExternalIP)
+
+	err = ctl.ds.LogEvent(tenant.ID, "testwatchtenantevents")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctl.RecordTenantEvent(types.Event{TenantID: tenant.ID, Operation: types.EventCreateWorkload, Error: "Invalid Request"})
+
+	// other tenants' events are not sent.
+	ctl.RecordTenantEvent(types.Event{TenantID: "other", Operation: types.EventCreateWorkload})
+
+	seen := make(map[string]bool)
+	timeout := time.After(5 * time.Second)
+	for len(seen) < 3 {
+		select {
+		case event := <-events:
+			if event.TenantID != tenant.ID {
+				t.Fatalf("expected events of %s, got %+v", tenant.ID, event)
+			}
+
+			switch event.Operation {
+			case types.EventExternalIPChange:
+				if event.Change.Type == types.MappedIPCreated && event.Change.Mapping.ExternalIP == m.ExternalIP {
+					seen[event.Operation] = true
+				}
+			case types.EventLog:
+				if event.Message == "testwatchtenantevents" {
+					seen[event.Operation] = true
+				}
+			case types.EventCreateWorkload:
+				seen[event.Operation] = true
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for events, saw %v", seen)
+		}
+	}
+}
+
+func TestTenantEvents(t *testing.T) {
+	te := newTenantEvents(2)
+
+	for _, op := range []string{types.EventMapExternalIP, types.EventUnmapExternalIP, types.EventCreateWorkload} {
+		te.add(types.Event{TenantID: "tenant-1", Operation: op})
+	}
+	te.add(types.Event{TenantID: "tenant-2", Operation: types.EventMapExternalIP})
+
+	events := te.list("tenant-1")
+	if len(events) != 2 ||
+		events[0].Operation != types.EventUnmapExternalIP ||
+		events[1].Operation != types.EventCreateWorkload {
+		t.Fatalf("expected the 2 most recent events, got %+v", events)
+	}
+
+	if len(te.list("tenant-2")) != 1 {
+		t.Fatalf("expected 1 event for tenant-2, got %+v", te.list("tenant-2"))
+	}
+
+	watched, stop := te.watch("tenant-2")
+	te.add(types.Event{TenantID: "tenant-1", Operation: types.EventMapExternalIP})
+	te.add(types.Event{TenantID: "tenant-2", Operation: types.EventUnmapExternalIP})
+
+	select {
+	case event := <-watched:
+		if event.TenantID != "tenant-2" || event.Operation != types.EventUnmapExternalIP {
+			t.Fatalf("expected the unmap of tenant-2, got %+v", event)
+		}
+	default:
+		t.Fatal("expected the watcher to be sent the event of its tenant")
+	}
+
+	stop()
+	te.add(types.Event{TenantID: "tenant-2", Operation: types.EventMapExternalIP})
+	if len(watched) != 0 {
+		t.Fatal("expected no events once the watch is stopped")
+	}
+
+	if _, _, err := ctl.WatchTenantEvents("unknown"); err != types.ErrTenantNotFound {
+		t.Fatalf("expected %v, got %v", types.ErrTenantNotFound, err)
+	}
+
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctl.RecordTenantEvent(types.Event{TenantID: tenant.ID, Operation: types.EventCreateWorkload, Error: "Invalid Request"})
+
+	events, err = ctl.TenantEvents(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 || events[0].Error != "Invalid Request" {
+		t.Fatalf("expected recorded event, got %+v", events)
+	}
+
+	_, err = ctl.TenantEvents(uuid.Generate().String())
+	if err != types.ErrTenantNotFound {
+		t.Fatalf("expected %v, got %v", types.ErrTenantNotFound, err)
+	}
+}
+
+func TestTenantChurn(t *testing.T) {
+	tc := newTenantChurn()
+	now := time.Now()
+
+	tc.add("tenant-1", now.Add(-48*time.Hour), 5, 5)
+	tc.add("tenant-1", now.Add(-2*time.Hour), 1, 0)
+	tc.add("tenant-1", now, 2, 1)
+	tc.add("tenant-1", now, 1, 1)
+	tc.add("tenant-2", now, 1, 0)
+
+	// counts older than the longest window are dropped.
+	if len(tc.buckets["tenant-1"]) != 2 {
+		t.Fatalf("expected 2 buckets, got %+v", tc.buckets["tenant-1"])
+	}
+
+	maps, unmaps := tc.count("tenant-1", now.Add(-time.Hour))
+	if maps != 3 || unmaps != 2 {
+		t.Fatalf("expected 3 maps and 2 unmaps, got %d and %d", maps, unmaps)
+	}
+
+	maps, unmaps = tc.count("tenant-1", now.Add(-3*time.Hour))
+	if maps != 4 || unmaps != 2 {
+		t.Fatalf("expected 4 maps and 2 unmaps, got %d and %d", maps, unmaps)
+	}
+
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctl.churn.add(tenant.ID, now, 6, 6)
+
+	churn, err := ctl.TenantChurn(tenant.ID, 10*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if churn.Maps != 6 || churn.Unmaps != 6 || churn.PerMinute != 1.2 || churn.WindowSeconds != 600 {
+		t.Fatalf("unexpected churn %+v", churn)
+	}
+
+	_, err = ctl.TenantChurn(uuid.Generate().String(), time.Hour)
+	if err != types.ErrTenantNotFound {
+		t.Fatalf("expected %v, got %v", types.ErrTenantNotFound, err)
+	}
+}
+
+func TestQuotaBreakdown(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 2, false, reason)
+	defer client.Shutdown()
+
+	tenantID := instances[0].TenantID
+
+	breakdowns, err := ctl.QuotaBreakdown(tenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(breakdowns) != 2 {
+		t.Fatalf("expected 2 breakdowns, got %+v", breakdowns)
+	}
+
+	for _, b := range breakdowns {
+		qd := findQuota(ctl.ListQuotas(tenantID), b.Name)
+		if qd == nil || qd.Usage != b.Usage {
+			t.Fatalf("breakdown usage %d does not match quota %+v", b.Usage, qd)
+		}
+
+		if len(b.Instances) != len(instances) {
+			t.Fatalf("expected %d instances in %s, got %+v", len(instances), b.Name, b.Instances)
+		}
+
+		sum := b.Unattributed
+		for _, iu := range b.Instances {
+			sum += iu.Usage
+		}
+
+		if sum != b.Usage {
+			t.Fatalf("%s breakdown sums to %d, expected %d", b.Name, sum, b.Usage)
+		}
+	}
+
+	if breakdowns[0].Instances[0].Usage != 2 || breakdowns[1].Instances[0].Usage != 512 {
+		t.Fatalf("unexpected breakdowns %+v", breakdowns)
+	}
+}
+
+func TestPoolActivity(t *testing.T) {
+	subnet := "10.40.19.0/30"
+	pool, err := ctl.AddPool("activitypool", &subnet, []string{}, []string{}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ctl.DeletePool(pool.ID, true) }()
+
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []string{
+		"Mapped 10.40.19.1 to 172.16.0.2",
+		"Mapped 10.40.191.1 to 172.16.0.3",
+		"Reserved 2 external IPs from pool activitypool as block b1",
+		"Released 10.40.19.2, its reservation lease expired",
+	}
+	for _, msg := range msgs {
+		err = ctl.ds.LogEvent(tenant.ID, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	activity, err := ctl.PoolActivity(pool.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(activity) != 3 ||
+		activity[0].Message != msgs[3] ||
+		activity[1].Message != msgs[2] ||
+		activity[2].Message != msgs[0] {
+		t.Fatalf("unexpected activity %+v", activity)
+	}
+
+	activity, err = ctl.PoolActivity(pool.ID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(activity) != 1 || activity[0].Message != msgs[3] {
+		t.Fatalf("unexpected activity %+v", activity)
+	}
+
+	_, err = ctl.PoolActivity(uuid.Generate().String(), 10)
+	if err != types.ErrPoolNotFound {
+		t.Fatalf("expected %v, got %v", types.ErrPoolNotFound, err)
+	}
+}
+
+func TestPoolDescription(t *testing.T) {
+	long := strings.Repeat("a", types.MaxPoolDescriptionLength+1)
+
+	_, err := ctl.AddPool("longdescpool", nil, []string{}, []string{}, long, "")
+	if err != types.ErrPoolDescriptionTooLong {
+		t.Fatalf("expected %v, got %v", types.ErrPoolDescriptionTooLong, err)
+	}
+
+	pool, err := ctl.AddPool("descpool", nil, []string{}, []string{}, "partner DMZ", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeletePool(pool.ID, true)
+
+	if pool.Description != "partner DMZ" {
+		t.Fatalf("expected description %q, got %q", "partner DMZ", pool.Description)
+	}
+
+	err = ctl.UpdatePoolDescription(pool.ID, "owned by netops")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err = ctl.ShowPool(pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pool.Description != "owned by netops" {
+		t.Fatalf("description not updated: %q", pool.Description)
+	}
+
+	pools, err := ctl.ListPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range pools {
+		if p.ID == pool.ID && p.Description != "owned by netops" {
+			t.Fatalf("listed pool has description %q", p.Description)
+		}
+	}
+
+	err = ctl.UpdatePoolDescription(pool.ID, long)
+	if err != types.ErrPoolDescriptionTooLong {
+		t.Fatalf("expected %v, got %v", types.ErrPoolDescriptionTooLong, err)
+	}
+}
+
+func TestExportImportPools(t *testing.T) {
+	subnet := "192.168.220.0/30"
+
+	pool, err := ctl.AddPool("exportpool", &subnet, []string{}, []string{"dmz"}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.AddAddress(pool.ID, nil, []string{"10.10.220.1", "10.10.220.2"})
+	if err != nil {
+		ctl.DeletePool(pool.ID, true)
+		t.Fatal(err)
+	}
+
+	export, err := ctl.ExportPools()
+	if err != nil {
+		ctl.DeletePool(pool.ID, true)
+		t.Fatal(err)
+	}
+
+	var exported *types.Pool
+
+	for i := range export.Pools {
+		if export.Pools[i].ID == pool.ID {
+			exported = &export.Pools[i]
+		}
+	}
+
+	if exported == nil {
+		ctl.DeletePool(pool.ID, true)
+		t.Fatal("pool not exported")
+	}
+
+	only := types.PoolExport{Pools: []types.Pool{*exported}}
+
+	_, err = ctl.ImportPools(only)
+	if err != types.ErrPoolExists {
+		ctl.DeletePool(pool.ID, true)
+		t.Fatalf("expected %v, got %v", types.ErrPoolExists, err)
+	}
+
+	err = ctl.DeletePool(pool.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported, err := ctl.ImportPools(only)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeletePool(pool.ID, true)
+
+	if len(imported) != 1 {
+		t.Fatalf("expected 1 pool, got %d", len(imported))
+	}
+
+	p := imported[0]
+	if p.ID != exported.ID || p.Name != exported.Name || p.TotalIPs != exported.TotalIPs {
+		t.Fatalf("expected %+v, got %+v", *exported, p)
+	}
+
+	if p.Free != p.TotalIPs || len(p.Subnets) != 1 || len(p.IPs) != 2 {
+		t.Fatalf("pool not fully imported: %+v", p)
+	}
+
+	if !reflect.DeepEqual(p.Tags, exported.Tags) {
+		t.Fatalf("expected tags %v, got %v", exported.Tags, p.Tags)
+	}
+}
+
+func TestDeletePoolNotEmpty(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// neither pool is the last of its family.
+	other, err := ctl.AddPool("notemptyother", nil, []string{"10.40.8.9"}, []string{}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeletePool(other.ID, true)
+
+	subnet := "10.40.8.0/29"
+	pool, err := ctl.AddPool("notempty", &subnet, nil, []string{}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := ctl.MapAddress(tenant.ID, &pool.Name, "", "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := types.PoolNotEmptyError{
+		PoolID:   pool.ID,
+		PoolName: pool.Name,
+		Subnets:  1,
+		Mappings: 1,
+	}
+
+	err = ctl.DeletePool(pool.ID, false)
+	if err != expected {
+		t.Fatalf("expected %v, got %v", expected, err)
+	}
+
+	err = ctl.DeletePool(pool.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ctl.ds.GetMappedIP(m.ExternalIP)
+	if err != types.ErrAddressNotFound {
+		t.Fatalf("mapping of deleted pool not released: %v", err)
+	}
+
+	_, err = ctl.ShowPool(pool.ID)
+	if err != types.ErrPoolNotFound {
+		t.Fatalf("expected %v, got %v", types.ErrPoolNotFound, err)
+	}
+}
+
+func TestRebalancePools(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pools left behind by other tests are drained, so that the
+	// plan only involves the pools made here.
+	existing, err := ctl.ListPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range existing {
+		if p.Drained {
+			continue
+		}
+
+		err = ctl.DrainPool(p.ID, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ctl.DrainPool(p.ID, false)
+	}
+
+	full, err := ctl.AddPool("rebalancefull", nil, []string{"10.40.9.1", "10.40.9.2", "10.40.9.3", "10.40.9.4", "10.40.9.5"}, []string{}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeletePool(full.ID, true)
+
+	empty, err := ctl.AddPool("rebalanceempty", nil, []string{"10.40.9.11", "10.40.9.12", "10.40.9.13", "10.40.9.14", "10.40.9.15"}, []string{}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeletePool(empty.ID, true)
+
+	reserved := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		m, err := ctl.MapAddress(tenant.ID, &full.Name, "", "", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reserved[m.ExternalIP] = true
+	}
+
+	// blocks are kept together, so are not moved.
+	block, err := ctl.ReserveBlock(tenant.ID, full.Name, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := ctl.RebalancePools(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// moving a third would leave the empty pool the fuller.
+	if plan.Applied || len(plan.Plan) != 2 || plan.Moves != nil {
+		t.Fatalf("unexpected plan: %+v", plan)
+	}
+
+	for _, move := range plan.Plan {
+		if !reserved[move.ExternalIP] || move.FromPoolID != full.ID || move.ToPoolID != empty.ID || move.TenantID != tenant.ID {
+			t.Fatalf("unexpected move: %+v", move)
+		}
+	}
+
+	p, err := ctl.ShowPool(full.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Free != 0 {
+		t.Fatalf("dry run changed the pool: %d free", p.Free)
+	}
+
+	applied, err := ctl.RebalancePools(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !applied.Applied || len(applied.Moves) != 2 {
+		t.Fatalf("unexpected rebalance: %+v", applied)
+	}
+
+	for _, move := range applied.Moves {
+		if move.Error != "" {
+			t.Fatalf("move failed: %+v", move)
+		}
+
+		_, err = ctl.ds.GetMappedIP(move.ExternalIP)
+		if err != types.ErrAddressNotFound {
+			t.Fatalf("old reservation of %s kept: %v", move.ExternalIP, err)
+		}
+
+		m, err := ctl.ds.GetMappedIP(move.NewExternalIP)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if m.PoolID != empty.ID || m.TenantID != tenant.ID || m.Status != types.MappedIPReserved {
+			t.Fatalf("unexpected moved reservation: %+v", m)
+		}
+	}
+
+	_, err = ctl.ds.GetMappedIP(block[0].ExternalIP)
+	if err != nil {
+		t.Fatalf("block reservation moved: %v", err)
+	}
+
+	for ID, free := range map[string]int{full.ID: 2, empty.ID: 3} {
+		p, err := ctl.ShowPool(ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if p.Free != free {
+			t.Fatalf("expected %d free in %s, got %d", free, p.Name, p.Free)
+		}
+	}
+
+	// the pools are now as even as they can be.
+	plan, err = ctl.RebalancePools(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(plan.Plan) != 0 {
+		t.Fatalf("unexpected plan after rebalancing: %+v", plan.Plan)
+	}
+}
+
+func TestDeleteLastPoolInFamily(t *testing.T) {
+	existing, err := ctl.ListPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// other tests leave IPv4 pools behind, so the guard is checked
+	// with the IPv6 family.
+	for _, p := range existing {
+		if poolFamilies(p)["IPv6"] {
+			t.Skip("IPv6 pools already exist")
+		}
+	}
+
+	pool, err := ctl.AddPool("lastv6pool", nil, []string{"fd00::1"}, []string{}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.DeletePool(pool.ID, true)
+
+	expected := types.LastPoolInFamilyError{
+		PoolID:   pool.ID,
+		PoolName: pool.Name,
+		Family:   "IPv6",
+	}
+
+	err = ctl.DeletePool(pool.ID, false)
+	if err != expected {
+		t.Fatalf("expected %v, got %v", expected, err)
+	}
+
+	second, err := ctl.AddPool("secondv6pool", nil, []string{"fd00::2"}, []string{}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// with another IPv6 pool, the second is only refused for not
+	// being empty.
+	err = ctl.DeletePool(second.ID, false)
+	if _, ok := err.(types.PoolNotEmptyError); !ok {
+		t.Fatalf("expected pool not empty, got %v", err)
+	}
+
+	err = ctl.DeletePool(second.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.DeletePool(pool.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
 
 func TestMain(m *testing.M) {
 	flag.Parse()
@@ -1933,8 +5677,11 @@ func TestMain(m *testing.M) {
 
 	ctl = new(controller)
 	ctl.tenantReadiness = make(map[string]*tenantConfirmMemo)
+	ctl.workloadOps = make(map[string]*workloadOp)
 	ctl.ds = new(datastore.Datastore)
 	ctl.qs = new(quotas.Quotas)
+	ctl.events = newTenantEvents(*tenantEventsSize)
+	ctl.churn = newTenantChurn()
 
 	ctl.BlockDriver = func() storage.BlockDriver {
 		return &storage.NoopDriver{}
@@ -15,11 +15,19 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/01org/ciao/ciao-controller/types"
 	"github.com/01org/ciao/payloads"
 	"github.com/01org/ciao/ssntp/uuid"
+	"github.com/golang/glog"
 )
 
 func (c *controller) makePoolLinks(pool *types.Pool) {
@@ -27,7 +35,7 @@ func (c *controller) makePoolLinks(pool *types.Pool) {
 		subnet := &pool.Subnets[i]
 
 		ref := fmt.Sprintf("%s/pools/%s/subnets/%s",
-			c.apiURL, pool.ID, subnet.ID)
+			c.baseURL(), pool.ID, subnet.ID)
 
 		link := types.Link{
 			Rel:  "self",
@@ -41,7 +49,7 @@ func (c *controller) makePoolLinks(pool *types.Pool) {
 		IP := &pool.IPs[i]
 
 		ref := fmt.Sprintf("%s/pools/%s/external-ips/%s",
-			c.apiURL, pool.ID, IP.ID)
+			c.baseURL(), pool.ID, IP.ID)
 
 		link := types.Link{
 			Rel:  "self",
@@ -51,7 +59,7 @@ func (c *controller) makePoolLinks(pool *types.Pool) {
 		IP.Links = []types.Link{link}
 	}
 
-	selfRef := fmt.Sprintf("%s/pools/%s", c.apiURL, pool.ID)
+	selfRef := fmt.Sprintf("%s/pools/%s", c.baseURL(), pool.ID)
 	link := types.Link{
 		Rel:  "self",
 		Href: selfRef,
@@ -65,10 +73,10 @@ func (c *controller) makeMappedIPLinks(IP *types.MappedIP, tenant *string) {
 
 	if tenant != nil {
 		ref = fmt.Sprintf("%s/%s/external-ips/%s",
-			c.apiURL, *tenant, IP.ID)
+			c.baseURL(), *tenant, IP.ID)
 	} else {
 		ref = fmt.Sprintf("%s/external-ips/%s",
-			c.apiURL, IP.ID)
+			c.baseURL(), IP.ID)
 	}
 
 	selfLink := types.Link{
@@ -79,7 +87,7 @@ func (c *controller) makeMappedIPLinks(IP *types.MappedIP, tenant *string) {
 	IP.Links = []types.Link{selfLink}
 
 	if tenant == nil {
-		poolRef := fmt.Sprintf("%s/pools/%s", c.apiURL, IP.PoolID)
+		poolRef := fmt.Sprintf("%s/pools/%s", c.baseURL(), IP.PoolID)
 		link := types.Link{
 			Rel:  "pool",
 			Href: poolRef,
@@ -88,21 +96,62 @@ func (c *controller) makeMappedIPLinks(IP *types.MappedIP, tenant *string) {
 	}
 }
 
-func (c *controller) AddPool(name string, subnet *string, ips []string) (types.Pool, error) {
+// validatePoolTags rejects empty tags and removes any duplicates while
+// preserving the order the tags were given in.
+func validatePoolTags(tags []string) ([]string, error) {
+	var valid []string
+
+	seen := make(map[string]bool)
+
+	for _, tag := range tags {
+		if tag == "" {
+			return nil, types.ErrBadRequest
+		}
+
+		if seen[tag] {
+			continue
+		}
+
+		seen[tag] = true
+		valid = append(valid, tag)
+	}
+
+	return valid, nil
+}
+
+func (c *controller) AddPool(name string, subnet *string, ips []string, tags []string, description string, tenantID string) (types.Pool, error) {
+	tags, err := validatePoolTags(tags)
+	if err != nil {
+		return types.Pool{}, err
+	}
+
+	if len(description) > types.MaxPoolDescriptionLength {
+		return types.Pool{}, types.ErrPoolDescriptionTooLong
+	}
+
 	pools, err := c.ds.GetPools()
 	if err != nil {
 		return types.Pool{}, err
 	}
 
 	for _, p := range pools {
-		if p.Name == name {
+		if strings.EqualFold(p.Name, name) {
 			return types.Pool{}, types.ErrDuplicatePoolName
 		}
 	}
 
+	// a pool is not created at all if its addresses would be refused.
+	err = c.ds.CheckPoolAddresses(subnet, ips)
+	if err != nil {
+		return types.Pool{}, err
+	}
+
 	pool := types.Pool{
-		ID:   uuid.Generate().String(),
-		Name: name,
+		ID:          uuid.Generate().String(),
+		Name:        name,
+		Tags:        tags,
+		Description: description,
+		TenantID:    tenantID,
 	}
 
 	err = c.ds.AddPool(pool)
@@ -145,118 +194,2281 @@ func (c *controller) ShowPool(ID string) (types.Pool, error) {
 	return pool, nil
 }
 
-func (c *controller) AddAddress(poolID string, subnet *string, ips []string) error {
-	if subnet != nil {
-		return c.ds.AddExternalSubnet(poolID, *subnet)
+// PoolActivity returns up to limit of the most recent entries of the event
+// log concerning the pool, newest first. The log is free text, so entries
+// are taken to concern the pool if they name it or one of its addresses.
+func (c *controller) PoolActivity(ID string, limit int) ([]types.LogEntry, error) {
+	pool, err := c.ds.GetPool(ID)
+	if err != nil {
+		return nil, err
 	}
 
-	return c.ds.AddExternalIPs(poolID, ips)
-}
+	var nets []*net.IPNet
+	for _, subnet := range pool.Subnets {
+		_, ipNet, err := net.ParseCIDR(subnet.CIDR)
+		if err == nil {
+			nets = append(nets, ipNet)
+		}
+	}
 
-func (c *controller) DeletePool(ID string) error {
-	return c.ds.DeletePool(ID)
+	addresses := make(map[string]bool)
+	for _, IP := range pool.IPs {
+		addresses[IP.Address] = true
+	}
+
+	concerns := func(msg string) bool {
+		fields := strings.Fields(msg)
+		for i, f := range fields {
+			if i > 0 && fields[i-1] == "pool" && f == pool.Name {
+				return true
+			}
+
+			IP := net.ParseIP(strings.Trim(f, ",.;:()"))
+			if IP == nil {
+				continue
+			}
+
+			if addresses[IP.String()] {
+				return true
+			}
+
+			for _, n := range nets {
+				if n.Contains(IP) {
+					return true
+				}
+			}
+		}
+
+		return false
+	}
+
+	logs, err := c.ds.GetEventLog()
+	if err != nil {
+		return nil, err
+	}
+
+	activity := []types.LogEntry{}
+	for i := len(logs) - 1; i >= 0 && len(activity) < limit; i-- {
+		if concerns(logs[i].Message) {
+			activity = append(activity, *logs[i])
+		}
+	}
+
+	return activity, nil
 }
 
-func (c *controller) RemoveAddress(poolID string, subnetID *string, IPID *string) error {
-	if subnetID != nil {
-		return c.ds.DeleteSubnet(poolID, *subnetID)
+// FindPoolByIP returns the pool which address belongs to, for tracing
+// an external IP back to where it came from.
+func (c *controller) FindPoolByIP(address string) (types.Pool, error) {
+	IP := net.ParseIP(address)
+	if IP == nil {
+		return types.Pool{}, types.ErrInvalidIP
 	}
 
-	if IPID != nil {
-		return c.ds.DeleteExternalIP(poolID, *IPID)
+	pool, err := c.ds.GetPoolContaining(IP)
+	if err != nil {
+		return pool, err
 	}
 
-	return types.ErrBadRequest
+	c.makePoolLinks(&pool)
+
+	return pool, nil
 }
 
-func (c *controller) ListMappedAddresses(tenant *string) []types.MappedIP {
-	IPs := c.ds.GetMappedIPs(tenant)
+func (c *controller) UpdatePoolTags(ID string, tags []string) error {
+	tags, err := validatePoolTags(tags)
+	if err != nil {
+		return err
+	}
 
-	for i := range IPs {
-		IP := &IPs[i]
-		c.makeMappedIPLinks(IP, tenant)
+	return c.ds.UpdatePoolTags(ID, tags)
+}
+
+func (c *controller) UpdatePoolDescription(ID string, description string) error {
+	if len(description) > types.MaxPoolDescriptionLength {
+		return types.ErrPoolDescriptionTooLong
 	}
 
-	return IPs
+	return c.ds.UpdatePoolDescription(ID, description)
 }
 
-func (c *controller) MapAddress(tenantID string, poolName *string, instanceID string) (err error) {
-	var m types.MappedIP
-	var i *types.Instance
+// The number of addresses ShowSubnet lists by default, and at most.
+const (
+	defaultSubnetAddresses = 256
+	maxSubnetAddresses     = 1024
+)
 
-	if tenantID == "" {
-		// we allow the admin to map anyone's instance
-		i, err = c.ds.GetInstance(instanceID)
-	} else {
-		i, err = c.ds.GetTenantInstance(tenantID, instanceID)
+// ShowSubnet lists the addresses of a subnet of a pool, and what uses
+// them, starting offset addresses into the subnet. At most limit addresses
+// are listed, or defaultSubnetAddresses if limit is 0, and never more
+// than maxSubnetAddresses.
+func (c *controller) ShowSubnet(poolID string, subnetID string, offset int, limit int) (types.SubnetInventory, error) {
+	if offset < 0 || limit < 0 {
+		return types.SubnetInventory{}, types.ErrInvalidFilter
+	}
+
+	if limit == 0 {
+		limit = defaultSubnetAddresses
+	} else if limit > maxSubnetAddresses {
+		limit = maxSubnetAddresses
 	}
+
+	inventory, more, err := c.ds.GetSubnetAddresses(poolID, subnetID, offset, limit)
 	if err != nil {
-		return err
+		return types.SubnetInventory{}, err
 	}
 
-	// A matching release for this is in the client unAssignEvent
-	res := <-c.qs.Consume(i.TenantID, payloads.RequestedResource{Type: payloads.ExternalIP, Value: 1})
-	defer func() {
-		if err != nil {
-			c.qs.Release(i.TenantID, payloads.RequestedResource{Type: payloads.ExternalIP, Value: 1})
+	ref := fmt.Sprintf("%s/pools/%s/subnets/%s", c.baseURL(), poolID, subnetID)
+
+	inventory.Links = []types.Link{
+		{
+			Rel:  "self",
+			Href: fmt.Sprintf("%s?offset=%d&limit=%d", ref, offset, limit),
+		},
+		{
+			Rel:  "pool",
+			Href: fmt.Sprintf("%s/pools/%s", c.baseURL(), poolID),
+		},
+	}
+
+	if more {
+		next := types.Link{
+			Rel:  "next",
+			Href: fmt.Sprintf("%s?offset=%d&limit=%d", ref, offset+limit, limit),
 		}
-	}()
 
-	if !res.Allowed() {
-		return types.ErrQuota
+		inventory.Links = append(inventory.Links, next)
+	}
+
+	return inventory, nil
+}
+
+// SubnetBitmap reports which addresses of a subnet of a pool are
+// allocated.
+func (c *controller) SubnetBitmap(poolID string, subnetID string) (types.SubnetBitmap, error) {
+	return c.ds.GetSubnetBitmap(poolID, subnetID)
+}
+
+// PoolFragmentation reports how the free addresses of the subnets of a pool
+// are split up.
+func (c *controller) PoolFragmentation(poolID string) (types.PoolFragmentation, error) {
+	return c.ds.GetPoolFragmentation(poolID)
+}
+
+// DrainPool stops, or restarts, new allocations from a pool.
+func (c *controller) DrainPool(ID string, drained bool) error {
+	return c.ds.DrainPool(ID, drained)
+}
+
+// DrainSubnet stops, or restarts, new allocations from a subnet of a pool.
+func (c *controller) DrainSubnet(poolID string, subnetID string, drained bool) error {
+	return c.ds.DrainSubnet(poolID, subnetID, drained)
+}
+
+func (c *controller) RenamePool(ID string, name string) error {
+	if name == "" {
+		return types.ErrInvalidPoolName
 	}
 
+	return c.ds.RenamePool(ID, name)
+}
+
+// ExportPools returns every pool, with its subnets and addresses, along
+// with the external IPs currently mapped from them.
+func (c *controller) ExportPools() (types.PoolExport, error) {
 	pools, err := c.ds.GetPools()
 	if err != nil {
-		return err
+		return types.PoolExport{}, err
 	}
 
-	err = types.ErrPoolEmpty
+	export := types.PoolExport{
+		Pools:    pools,
+		Mappings: c.ds.GetMappedIPs(nil),
+	}
 
-	for _, pool := range pools {
-		if poolName != nil {
-			if pool.Name == *poolName {
-				m, err = c.ds.MapExternalIP(pool.ID, instanceID)
-				break
+	return export, nil
+}
+
+// ImportPools recreates the pools of an export, keeping their IDs. Nothing
+// is imported if any pool conflicts with an existing one. Mappings are not
+// restored, as the instances they were for are not known here.
+func (c *controller) ImportPools(export types.PoolExport) ([]types.Pool, error) {
+	existing, err := c.ds.GetPools()
+	if err != nil {
+		return nil, err
+	}
+
+	IDs := make(map[string]bool)
+	names := make(map[string]bool)
+
+	for _, p := range existing {
+		IDs[p.ID] = true
+		names[strings.ToLower(p.Name)] = true
+	}
+
+	for _, p := range export.Pools {
+		if p.ID == "" {
+			return nil, types.ErrBadRequest
+		}
+
+		if p.Name == "" {
+			return nil, types.ErrInvalidPoolName
+		}
+
+		if IDs[p.ID] {
+			return nil, types.ErrPoolExists
+		}
+
+		if names[strings.ToLower(p.Name)] {
+			return nil, types.ErrDuplicatePoolName
+		}
+
+		IDs[p.ID] = true
+		names[strings.ToLower(p.Name)] = true
+	}
+
+	var imported []types.Pool
+
+	for _, p := range export.Pools {
+		pool, err := c.importPool(p)
+		if err != nil {
+			for _, p := range imported {
+				_ = c.ds.DeletePool(p.ID)
 			}
-		} else if pool.Free > 0 {
-			m, err = c.ds.MapExternalIP(pool.ID, instanceID)
-			break
+			return nil, err
 		}
+
+		imported = append(imported, pool)
 	}
 
+	return imported, nil
+}
+
+// importPool adds a single exported pool, with all of its addresses free.
+func (c *controller) importPool(p types.Pool) (types.Pool, error) {
+	tags, err := validatePoolTags(p.Tags)
 	if err != nil {
-		return err
+		return types.Pool{}, err
 	}
 
-	// get tenant CNCI info
-	t, err := c.ds.GetTenant(m.TenantID)
+	pool := types.Pool{
+		ID:       p.ID,
+		Name:     p.Name,
+		Tags:     tags,
+		TenantID: p.TenantID,
+	}
+
+	err = c.ds.AddPool(pool)
 	if err != nil {
-		_ = c.UnMapAddress(m.ExternalIP)
-		return err
+		return types.Pool{}, err
 	}
 
-	err = c.client.mapExternalIP(*t, m)
+	for _, subnet := range p.Subnets {
+		err = c.ds.AddExternalSubnet(pool.ID, subnet.CIDR)
+		if err != nil {
+			_ = c.ds.DeletePool(pool.ID)
+			return types.Pool{}, err
+		}
+	}
+
+	var IPs []string
+
+	for _, IP := range p.IPs {
+		IPs = append(IPs, IP.Address)
+	}
+
+	if len(IPs) > 0 {
+		err = c.ds.AddExternalIPs(pool.ID, IPs)
+		if err != nil {
+			_ = c.ds.DeletePool(pool.ID)
+			return types.Pool{}, err
+		}
+	}
+
+	return c.ShowPool(pool.ID)
+}
+
+// hostNet returns the network holding only IP.
+func hostNet(IP net.IP) *net.IPNet {
+	if IP4 := IP.To4(); IP4 != nil {
+		IP = IP4
+	}
+
+	bits := len(IP) * 8
+	return &net.IPNet{IP: IP, Mask: net.CIDRMask(bits, bits)}
+}
+
+// poolRequestNets returns the addresses a request would add to a new
+// pool, as networks so that subnets and single addresses can be
+// compared. Addresses which cannot be parsed are left for AddPool to
+// reject.
+func poolRequestNets(req types.NewPoolRequest) []*net.IPNet {
+	var nets []*net.IPNet
+
+	if req.Subnet != nil {
+		_, ipNet, err := net.ParseCIDR(*req.Subnet)
+		if err == nil {
+			nets = append(nets, ipNet)
+		}
+		return nets
+	}
+
+	for _, ip := range req.IPs {
+		IP := net.ParseIP(ip.IP)
+		if IP != nil {
+			nets = append(nets, hostNet(IP))
+		}
+	}
+
+	return nets
+}
+
+// poolNets returns the subnets and addresses of an existing pool as
+// networks.
+func poolNets(p types.Pool) []*net.IPNet {
+	var nets []*net.IPNet
+
+	for _, subnet := range p.Subnets {
+		_, ipNet, err := net.ParseCIDR(subnet.CIDR)
+		if err == nil {
+			nets = append(nets, ipNet)
+		}
+	}
+
+	for _, IP := range p.IPs {
+		if IP := net.ParseIP(IP.Address); IP != nil {
+			nets = append(nets, hostNet(IP))
+		}
+	}
+
+	return nets
+}
+
+// netAddress formats a network made by poolRequestNets as it would have
+// been given in the request.
+func netAddress(n *net.IPNet) string {
+	ones, bits := n.Mask.Size()
+	if ones == bits {
+		return n.IP.String()
+	}
+
+	return n.String()
+}
+
+// netsOverlap reports whether any network in a overlaps any in b.
+func netsOverlap(a []*net.IPNet, b []*net.IPNet) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x.Contains(y.IP) || y.Contains(x.IP) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// AddPools creates a batch of pools. The batch is checked as a whole
+// before any pool is created, and a pool whose name or addresses clash
+// with those of an existing pool, or of any other pool in the batch, is
+// not created. The pool and error at each index are the outcome of the
+// request at that index.
+func (c *controller) AddPools(reqs []types.NewPoolRequest) ([]types.Pool, []error) {
+	pools := make([]types.Pool, len(reqs))
+	errs := make([]error, len(reqs))
+
+	existing, err := c.ds.GetPools()
 	if err != nil {
-		// can never fail at this point.
-		_ = c.UnMapAddress(m.ExternalIP)
+		for i := range errs {
+			errs[i] = err
+		}
+		return pools, errs
 	}
 
-	return err
+	names := make(map[string]int)
+	var used []*net.IPNet
+
+	for _, p := range existing {
+		names[strings.ToLower(p.Name)]++
+		used = append(used, poolNets(p)...)
+	}
+
+	nets := make([][]*net.IPNet, len(reqs))
+
+	for i, req := range reqs {
+		names[strings.ToLower(req.Name)]++
+		nets[i] = poolRequestNets(req)
+	}
+
+	for i, req := range reqs {
+		if strings.TrimSpace(req.Name) == "" {
+			errs[i] = types.ErrPoolNameRequired
+			continue
+		}
+
+		if names[strings.ToLower(req.Name)] > 1 {
+			errs[i] = types.ErrDuplicatePoolName
+			continue
+		}
+
+		overlaps := netsOverlap(nets[i], used)
+		for j := range reqs {
+			if j != i && netsOverlap(nets[i], nets[j]) {
+				overlaps = true
+			}
+		}
+
+		if !overlaps {
+			continue
+		}
+
+		if req.Subnet != nil {
+			errs[i] = types.ErrDuplicateSubnet
+		} else {
+			errs[i] = types.ErrDuplicateIP
+		}
+	}
+
+	for i, req := range reqs {
+		if errs[i] != nil {
+			continue
+		}
+
+		var ips []string
+
+		for _, ip := range req.IPs {
+			ips = append(ips, ip.IP)
+		}
+
+		pools[i], errs[i] = c.AddPool(req.Name, req.Subnet, ips, req.Tags, req.Description, req.TenantID)
+		if errs[i] == nil {
+			c.makePoolLinks(&pools[i])
+		}
+	}
+
+	return pools, errs
 }
 
-func (c *controller) UnMapAddress(address string) error {
-	// get mapping
-	m, err := c.ds.GetMappedIP(address)
+// ValidatePools checks a batch of proposed pools against the existing
+// pools, and against each other, without creating any of them. Every
+// conflict is returned, so a pool may appear more than once. A conflict
+// between two proposed pools is reported against the later of them.
+func (c *controller) ValidatePools(reqs []types.NewPoolRequest) ([]types.PoolConflict, error) {
+	existing, err := c.ds.GetPools()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// get tenant CNCI info
-	t, err := c.ds.GetTenant(m.TenantID)
+	existingNets := make([][]*net.IPNet, len(existing))
+	for i, p := range existing {
+		existingNets[i] = poolNets(p)
+	}
+
+	nets := make([][]*net.IPNet, len(reqs))
+	for i, req := range reqs {
+		nets[i] = poolRequestNets(req)
+	}
+
+	reservations := c.ds.GetAddressReservations()
+
+	conflicts := []types.PoolConflict{}
+
+	for i, req := range reqs {
+		conflict := func(kind string, err error) types.PoolConflict {
+			return types.PoolConflict{
+				Index:   i,
+				Name:    req.Name,
+				Kind:    kind,
+				Message: err.Error(),
+			}
+		}
+
+		overlapErr := types.ErrDuplicateIP
+		if req.Subnet != nil {
+			overlapErr = types.ErrDuplicateSubnet
+		}
+
+		if strings.TrimSpace(req.Name) == "" {
+			conflicts = append(conflicts, conflict(types.PoolConflictName, types.ErrPoolNameRequired))
+		}
+
+		for j, p := range existing {
+			if req.Name != "" && strings.EqualFold(req.Name, p.Name) {
+				pc := conflict(types.PoolConflictName, types.ErrDuplicatePoolName)
+				pc.PoolID = p.ID
+				pc.PoolName = p.Name
+				conflicts = append(conflicts, pc)
+			}
+
+			for _, n := range nets[i] {
+				if netsOverlap([]*net.IPNet{n}, existingNets[j]) {
+					pc := conflict(types.PoolConflictOverlap, overlapErr)
+					pc.Address = netAddress(n)
+					pc.PoolID = p.ID
+					pc.PoolName = p.Name
+					conflicts = append(conflicts, pc)
+				}
+			}
+		}
+
+		for _, res := range reservations {
+			_, reserved, err := net.ParseCIDR(res.CIDR)
+			if err != nil {
+				continue
+			}
+
+			for _, n := range nets[i] {
+				if netsOverlap([]*net.IPNet{n}, []*net.IPNet{reserved}) {
+					pc := conflict(types.PoolConflictOverlap, types.AddressReservedError{
+						Address:       netAddress(n),
+						ReservationID: res.ID,
+						Label:         res.Label,
+					})
+					pc.Address = netAddress(n)
+					conflicts = append(conflicts, pc)
+				}
+			}
+		}
+
+		for j := 0; j < i; j++ {
+			other := j
+
+			if req.Name != "" && strings.EqualFold(req.Name, reqs[j].Name) {
+				pc := conflict(types.PoolConflictName, types.ErrDuplicatePoolName)
+				pc.OtherIndex = &other
+				conflicts = append(conflicts, pc)
+			}
+
+			for _, n := range nets[i] {
+				if netsOverlap([]*net.IPNet{n}, nets[j]) {
+					pc := conflict(types.PoolConflictOverlap, overlapErr)
+					pc.Address = netAddress(n)
+					pc.OtherIndex = &other
+					conflicts = append(conflicts, pc)
+				}
+			}
+		}
+	}
+
+	return conflicts, nil
+}
+
+// AddAddressReservation reserves the address space of cidr, so that no
+// pool may use it until the reservation is deleted.
+func (c *controller) AddAddressReservation(cidr string, label string) (types.AddressReservation, error) {
+	if strings.TrimSpace(label) == "" {
+		return types.AddressReservation{}, types.ErrInvalidReservation
+	}
+
+	r := types.AddressReservation{
+		ID:      uuid.Generate().String(),
+		CIDR:    cidr,
+		Label:   label,
+		Created: time.Now().UTC(),
+	}
+
+	return c.ds.AddAddressReservation(r)
+}
+
+// ListAddressReservations returns every address reservation, oldest
+// first.
+func (c *controller) ListAddressReservations() []types.AddressReservation {
+	return c.ds.GetAddressReservations()
+}
+
+// DeleteAddressReservation releases reserved address space to pools.
+func (c *controller) DeleteAddressReservation(ID string) error {
+	r, err := c.ds.DeleteAddressReservation(ID)
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("Released address reservation %s (%s) of %s", r.ID, r.Label, r.CIDR)
+
+	return nil
+}
+
+func (c *controller) AddAddress(poolID string, subnet *string, ips []string) error {
+	if subnet != nil {
+		return c.ds.AddExternalSubnet(poolID, *subnet)
+	}
+
+	return c.ds.AddExternalIPs(poolID, ips)
+}
+
+// poolFamilies returns the address families, "IPv4" or "IPv6", of the
+// subnets and addresses in a pool which can still be allocated from.
+// A drained pool has none.
+func poolFamilies(pool types.Pool) map[string]bool {
+	families := make(map[string]bool)
+
+	if pool.Drained {
+		return families
+	}
+
+	add := func(IP net.IP) {
+		if IP == nil {
+			return
+		}
+
+		if IP.To4() != nil {
+			families["IPv4"] = true
+		} else {
+			families["IPv6"] = true
+		}
+	}
+
+	for _, subnet := range pool.Subnets {
+		if subnet.Drained {
+			continue
+		}
+
+		IP, _, err := net.ParseCIDR(subnet.CIDR)
+		if err == nil {
+			add(IP)
+		}
+	}
+
+	for _, IP := range pool.IPs {
+		add(net.ParseIP(IP.Address))
+	}
+
+	return families
+}
+
+// DeletePool deletes an empty pool. Unless force is set, the last pool
+// with addresses of a family cannot be deleted, as allocations of that
+// family would then fail. Drained pools and subnets are not allocated
+// from, so they are never the last of a family. Pools with subnets, IPs
+// or mappings left are only deleted with force, which releases the
+// mappings and deletes the addresses with the pool.
+func (c *controller) DeletePool(ID string, force bool) error {
+	if !force {
+		pools, err := c.ds.GetPools()
+		if err != nil {
+			return err
+		}
+
+		var pool *types.Pool
+		others := make(map[string]bool)
+
+		for i := range pools {
+			if pools[i].ID == ID {
+				pool = &pools[i]
+				continue
+			}
+
+			for family := range poolFamilies(pools[i]) {
+				others[family] = true
+			}
+		}
+
+		if pool == nil {
+			return types.ErrPoolNotFound
+		}
+
+		for family := range poolFamilies(*pool) {
+			if !others[family] {
+				return types.LastPoolInFamilyError{
+					PoolID:   pool.ID,
+					PoolName: pool.Name,
+					Family:   family,
+				}
+			}
+		}
+
+		mappings := c.ds.CountMappedIPs(types.MappedIPFilter{PoolID: ID})
+		if len(pool.Subnets) > 0 || len(pool.IPs) > 0 || mappings > 0 {
+			return types.PoolNotEmptyError{
+				PoolID:   pool.ID,
+				PoolName: pool.Name,
+				Subnets:  len(pool.Subnets),
+				IPs:      len(pool.IPs),
+				Mappings: mappings,
+			}
+		}
+
+		return c.ds.DeletePool(ID)
+	}
+
+	// forcing the delete releases the pool's mappings first.
+	for _, m := range c.ds.GetMappedIPs(nil) {
+		if m.PoolID != ID {
+			continue
+		}
+
+		released, err := c.releaseMapping(m)
+		if err != nil {
+			return err
+		}
+
+		if released {
+			msg := fmt.Sprintf("Released %s when its pool was deleted", m.ExternalIP)
+			c.ds.LogEvent(m.TenantID, msg)
+		}
+	}
+
+	return c.ds.DeletePool(ID)
+}
+
+func (c *controller) RemoveAddress(poolID string, subnetID *string, IPID *string) error {
+	if subnetID != nil {
+		return c.ds.DeleteSubnet(poolID, *subnetID)
+	}
+
+	if IPID != nil {
+		return c.ds.DeleteExternalIP(poolID, *IPID)
+	}
+
+	return types.ErrBadRequest
+}
+
+// UpdatePoolIPs adds and removes individual IPs of a pool in one call.
+// If force is set, addresses which are mapped may be removed, and their
+// mappings are released.
+func (c *controller) UpdatePoolIPs(poolID string, add []string, remove []string, force bool) error {
+	unmapped, err := c.ds.UpdatePoolIPs(poolID, add, remove, force)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range unmapped {
+		c.qs.Release(m.TenantID, payloads.RequestedResource{Type: payloads.ExternalIP, Value: 1})
+
+		// reserved IPs are not known to the CNCI.
+		if m.InstanceID == "" {
+			continue
+		}
+
+		t, err := c.ds.GetTenant(m.TenantID)
+		if err == nil {
+			err = c.client.unMapExternalIP(*t, m)
+		}
+		if err != nil {
+			glog.Warningf("Error unmapping removed address %s: %v", m.ExternalIP, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *controller) ListMappedAddresses(tenant *string) []types.MappedIP {
+	IPs := c.ds.GetMappedIPs(tenant)
+
+	for i := range IPs {
+		IP := &IPs[i]
+		c.makeMappedIPLinks(IP, tenant)
+	}
+
+	return IPs
+}
+
+// CountMappedAddresses returns the number of mapped external IPs selected
+// by filter.
+func (c *controller) CountMappedAddresses(filter types.MappedIPFilter) int {
+	return c.ds.CountMappedIPs(filter)
+}
+
+// WatchMappedAddresses returns a channel on which subsequent changes to the
+// mapped external IPs are sent, and a function which stops the watch. If
+// tenant is not nil only changes to that tenant's mappings are sent.
+func (c *controller) WatchMappedAddresses(tenant *string) (<-chan types.MappedIPChange, func()) {
+	changes, stopWatch := c.ds.WatchMappedIPs()
+	out := make(chan types.MappedIPChange, cap(changes))
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case change := <-changes:
+				if tenant != nil && change.Mapping.TenantID != *tenant {
+					continue
+				}
+
+				c.makeMappedIPLinks(&change.Mapping, tenant)
+
+				select {
+				case out <- change:
+				case <-done:
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	stop := func() {
+		stopWatch()
+		close(done)
+	}
+
+	return out, stop
+}
+
+// PoolCapacity returns the free and total external IPs of all of the
+// pools, by address family.
+func (c *controller) PoolCapacity() types.PoolCapacity {
+	return c.ds.GetPoolCapacity()
+}
+
+// RebalancePools plans moves of reservations from the fullest pools to
+// the emptiest ones, so that the pools are used more evenly, and makes
+// them if apply is set. Only reservations are moved, since moving an IP
+// mapped to an instance would change the address it is reached at, and
+// reservations made as blocks are kept together. Each move is made only
+// if it leaves the pool moved to less full than the one moved from, and
+// only to pools the reservation's tenant may allocate from. Drained pools
+// are left alone.
+func (c *controller) RebalancePools(apply bool) (types.PoolRebalance, error) {
+	pools, err := c.ds.GetPools()
+	if err != nil {
+		return types.PoolRebalance{}, err
+	}
+
+	var candidates []types.Pool
+	used := make(map[string]int)
+	for _, pool := range pools {
+		if pool.Drained || pool.TotalIPs == 0 {
+			continue
+		}
+
+		candidates = append(candidates, pool)
+		used[pool.ID] = pool.TotalIPs - pool.Free
+	}
+
+	movable := make(map[string][]types.MappedIP)
+	for _, m := range c.ds.GetMappedIPs(nil) {
+		if m.Status == types.MappedIPReserved && m.BlockID == "" {
+			movable[m.PoolID] = append(movable[m.PoolID], m)
+		}
+	}
+
+	for _, reservations := range movable {
+		sort.Slice(reservations, func(i, j int) bool {
+			return reservations[i].ExternalIP < reservations[j].ExternalIP
+		})
+	}
+
+	// fuller reports whether pool a would be more used than pool b
+	// with the given number of addresses in use.
+	fuller := func(a types.Pool, usedA int, b types.Pool, usedB int) bool {
+		return usedA*b.TotalIPs > usedB*a.TotalIPs
+	}
+
+	rebalance := types.PoolRebalance{
+		Plan: []types.PoolMove{},
+	}
+
+	for {
+		var from *types.Pool
+		for i, pool := range candidates {
+			if len(movable[pool.ID]) == 0 {
+				continue
+			}
+
+			if from == nil || fuller(pool, used[pool.ID], *from, used[from.ID]) {
+				from = &candidates[i]
+			}
+		}
+
+		if from == nil {
+			break
+		}
+
+		m := movable[from.ID][0]
+		movable[from.ID] = movable[from.ID][1:]
+
+		var to *types.Pool
+		for i, pool := range candidates {
+			if pool.ID == from.ID || used[pool.ID] >= pool.TotalIPs {
+				continue
+			}
+
+			if !pool.AvailableTo(m.TenantID) {
+				continue
+			}
+
+			if to == nil || fuller(*to, used[to.ID], pool, used[pool.ID]) {
+				to = &candidates[i]
+			}
+		}
+
+		if to == nil || !fuller(*from, used[from.ID], *to, used[to.ID]+1) {
+			continue
+		}
+
+		rebalance.Plan = append(rebalance.Plan, types.PoolMove{
+			MappingID:    m.ID,
+			TenantID:     m.TenantID,
+			ExternalIP:   m.ExternalIP,
+			FromPoolID:   from.ID,
+			FromPoolName: from.Name,
+			ToPoolID:     to.ID,
+			ToPoolName:   to.Name,
+		})
+
+		used[from.ID]--
+		used[to.ID]++
+	}
+
+	if !apply {
+		return rebalance, nil
+	}
+
+	rebalance.Applied = true
+	rebalance.Moves = []types.PoolMove{}
+
+	for _, move := range rebalance.Plan {
+		moved, err := c.ds.MoveReservation(move.ExternalIP, move.ToPoolID)
+		if err != nil {
+			move.Error = err.Error()
+		} else {
+			move.NewExternalIP = moved.ExternalIP
+
+			msg := fmt.Sprintf("Moved reservation of %s to %s in pool %s", move.ExternalIP, moved.ExternalIP, move.ToPoolName)
+			c.ds.LogEvent(move.TenantID, msg)
+		}
+
+		rebalance.Moves = append(rebalance.Moves, move)
+	}
+
+	return rebalance, nil
+}
+
+// MigratePool moves every mapping of the pool fromID to the pool toID,
+// e.g. so that the addresses of fromID can be replaced. Every mapping
+// gets a new address, including those mapped to instances, which are
+// unmapped from their old addresses at the CNCI and mapped to their new.
+// Nothing is moved unless toID can hold all of the mappings, and nothing
+// at all in a dry run. Mappings which the CNCI could not be moved for are
+// reported with the error, and counted as failed.
+func (c *controller) MigratePool(fromID string, toID string, dryRun bool) (types.PoolMigration, error) {
+	old, moved, err := c.ds.MigrateMappings(fromID, toID, dryRun)
+	if err != nil {
+		return types.PoolMigration{}, err
+	}
+
+	migration := types.PoolMigration{
+		FromPoolID: fromID,
+		ToPoolID:   toID,
+		DryRun:     dryRun,
+		Addresses:  make(map[string]string),
+		Mappings:   []types.MigratedMapping{},
+	}
+
+	for i, m := range old {
+		n := moved[i]
+
+		mm := types.MigratedMapping{
+			MappingID:     m.ID,
+			NewMappingID:  n.ID,
+			TenantID:      m.TenantID,
+			InstanceID:    m.InstanceID,
+			ExternalIP:    m.ExternalIP,
+			NewExternalIP: n.ExternalIP,
+			Attached:      m.InstanceID != "",
+		}
+
+		if m.InstanceID != "" {
+			migration.Attached++
+		}
+
+		// reserved IPs are not known to the CNCI.
+		if !dryRun && m.InstanceID != "" {
+			err = c.remapMigrated(m, n)
+			if err != nil {
+				glog.Warningf("Error remapping migrated address %s to %s: %v", m.ExternalIP, n.ExternalIP, err)
+				mm.Error = err.Error()
+				migration.Failed++
+			}
+		}
+
+		if !dryRun {
+			msg := fmt.Sprintf("Migrated %s to %s in pool %s", m.ExternalIP, n.ExternalIP, n.PoolName)
+			if mm.Error != "" {
+				msg = fmt.Sprintf("%s, but the CNCI was not updated: %s", msg, mm.Error)
+			}
+			c.ds.LogEvent(m.TenantID, msg)
+		}
+
+		migration.Addresses[m.ExternalIP] = n.ExternalIP
+		migration.Mappings = append(migration.Mappings, mm)
+	}
+
+	return migration, nil
+}
+
+// remapMigrated moves the instance of a migrated mapping from its old
+// address to its new at the CNCI.
+func (c *controller) remapMigrated(old types.MappedIP, moved types.MappedIP) error {
+	t, err := c.ds.GetTenant(old.TenantID)
+	if err != nil {
+		return err
+	}
+
+	if t == nil {
+		return types.ErrTenantNotFound
+	}
+
+	err = c.client.unMapExternalIP(*t, old)
+	if err != nil {
+		return err
+	}
+
+	return c.client.mapExternalIP(*t, moved)
+}
+
+// PoolSelection returns the strategy used to choose a pool for
+// allocations which do not name one.
+func (c *controller) PoolSelection() string {
+	if c.poolSelection == "" {
+		return types.PoolSelectionFillFirst
+	}
+
+	return c.poolSelection
+}
+
+// strategyFor returns the pool selection strategy used for a tenant: its
+// own if it has one, otherwise the controller's.
+func (c *controller) strategyFor(tenantID string) string {
+	if strategy := c.ds.GetTenantPoolStrategy(tenantID); strategy != "" {
+		return strategy
+	}
+
+	return c.PoolSelection()
+}
+
+// findPool returns the pool with the given name, ignoring case.
+func findPool(pools []types.Pool, name string) (types.Pool, bool) {
+	for _, pool := range pools {
+		if strings.EqualFold(pool.Name, name) {
+			return pool, true
+		}
+	}
+
+	return types.Pool{}, false
+}
+
+// availablePools returns the pools a tenant may allocate from.
+func availablePools(pools []types.Pool, tenantID string) []types.Pool {
+	var available []types.Pool
+	for _, pool := range pools {
+		if pool.AvailableTo(tenantID) {
+			available = append(available, pool)
+		}
+	}
+
+	return available
+}
+
+// selectPool returns the pool that an allocation for a tenant should be
+// made from. If poolName is nil the tenant's default pool is used, and
+// if the tenant has none a pool with free addresses is chosen by the
+// tenant's pool selection strategy. Pools scoped to other tenants are
+// never chosen, and ErrForbidden is returned if one is named.
+func (c *controller) selectPool(tenantID string, poolName *string) (types.Pool, error) {
+	pools, err := c.ds.GetPools()
+	if err != nil {
+		return types.Pool{}, err
+	}
+
+	var pool types.Pool
+
+	if poolName != nil {
+		var ok bool
+
+		pool, ok = findPool(pools, *poolName)
+		if !ok {
+			return types.Pool{}, types.ErrPoolNotFound
+		}
+	} else if defaultID := c.ds.GetTenantDefaultPool(tenantID); defaultID != "" {
+		pool, err = c.ds.GetPool(defaultID)
+		if err != nil {
+			return types.Pool{}, err
+		}
+	} else {
+		return c.choosePool(availablePools(pools, tenantID), c.strategyFor(tenantID))
+	}
+
+	if !pool.AvailableTo(tenantID) {
+		return pool, types.ErrForbidden
+	}
+
+	if pool.Drained {
+		return pool, types.ErrPoolDrained
+	}
+
+	if pool.Free == 0 {
+		return pool, c.poolExhausted(pool)
+	}
+
+	return pool, nil
+}
+
+// poolChoice is a pool placed by orderPools, with the reason for its
+// place.
+type poolChoice struct {
+	pool   types.Pool
+	reason string
+}
+
+// orderPools puts the pools, which are in ID order, that are not drained
+// and have free addresses in the order the given pool selection strategy
+// would choose them. The pools which cannot be chosen are returned separately.
+// Round-robin selection starts after the pool last allocated from, which
+// is recorded by poolAllocated.
+func (c *controller) orderPools(pools []types.Pool, strategy string) ([]poolChoice, []poolChoice) {
+	var free, excluded []poolChoice
+
+	for _, pool := range pools {
+		switch {
+		case pool.Drained:
+			excluded = append(excluded, poolChoice{pool, "drained"})
+		case pool.Free == 0:
+			excluded = append(excluded, poolChoice{pool, "no free addresses"})
+		default:
+			free = append(free, poolChoice{pool, "in ID order"})
+		}
+	}
+
+	switch strategy {
+	case types.PoolSelectionRoundRobin:
+		c.lastPoolLock.Lock()
+		last := c.lastPool
+		c.lastPoolLock.Unlock()
+
+		var after, before []poolChoice
+		for _, choice := range free {
+			if choice.pool.ID > last {
+				choice.reason = "after the pool last allocated from, in ID order"
+				after = append(after, choice)
+			} else {
+				choice.reason = "not after the pool last allocated from, so used once those after it are full"
+				before = append(before, choice)
+			}
+		}
+		free = append(after, before...)
+	case types.PoolSelectionLeastUsed:
+		sort.SliceStable(free, func(i, j int) bool {
+			return free[i].pool.TotalIPs-free[i].pool.Free < free[j].pool.TotalIPs-free[j].pool.Free
+		})
+		for i := range free {
+			free[i].reason = fmt.Sprintf("%d addresses in use", free[i].pool.TotalIPs-free[i].pool.Free)
+		}
+	}
+
+	return free, excluded
+}
+
+// choosePool picks the first of the pools in the order given by
+// orderPools.
+func (c *controller) choosePool(pools []types.Pool, strategy string) (types.Pool, error) {
+	free, _ := c.orderPools(pools, strategy)
+	if len(free) == 0 {
+		return types.Pool{}, c.poolExhausted(types.Pool{})
+	}
+
+	return free[0].pool, nil
+}
+
+// PoolOrder returns the order in which pools would be considered for an
+// allocation for a tenant which does not name a pool. Only the default
+// pool of a tenant which has one is considered.
+func (c *controller) PoolOrder(tenantID string) (types.PoolOrder, error) {
+	t, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return types.PoolOrder{}, err
+	}
+
+	if t == nil {
+		return types.PoolOrder{}, types.ErrTenantNotFound
+	}
+
+	pools, err := c.ds.GetPools()
+	if err != nil {
+		return types.PoolOrder{}, err
+	}
+
+	order := types.PoolOrder{
+		TenantID: tenantID,
+		Strategy: c.strategyFor(tenantID),
+		Pools:    []types.PoolOrderEntry{},
+		Excluded: []types.PoolOrderEntry{},
+	}
+
+	var ranked, excluded []poolChoice
+
+	// pools scoped to other tenants are left out altogether, as the
+	// tenant is not told of them.
+	pools = availablePools(pools, tenantID)
+
+	if defaultID := c.ds.GetTenantDefaultPool(tenantID); defaultID != "" {
+		for _, pool := range pools {
+			if pool.ID != defaultID {
+				excluded = append(excluded, poolChoice{pool, "not the default pool of the tenant"})
+				continue
+			}
+
+			order.DefaultPool = &types.DefaultPool{PoolID: pool.ID, PoolName: pool.Name}
+
+			switch {
+			case pool.Drained:
+				excluded = append(excluded, poolChoice{pool, "default pool of the tenant, but drained"})
+			case pool.Free == 0:
+				excluded = append(excluded, poolChoice{pool, "default pool of the tenant, but no free addresses"})
+			default:
+				ranked = append(ranked, poolChoice{pool, "default pool of the tenant"})
+			}
+		}
+	} else {
+		ranked, excluded = c.orderPools(pools, order.Strategy)
+	}
+
+	entry := func(choice poolChoice) types.PoolOrderEntry {
+		return types.PoolOrderEntry{
+			PoolID:   choice.pool.ID,
+			PoolName: choice.pool.Name,
+			Free:     choice.pool.Free,
+			Reason:   choice.reason,
+		}
+	}
+
+	for i, choice := range ranked {
+		e := entry(choice)
+		e.Rank = i + 1
+		order.Pools = append(order.Pools, e)
+	}
+
+	for _, choice := range excluded {
+		order.Excluded = append(order.Excluded, entry(choice))
+	}
+
+	return order, nil
+}
+
+// TenantDefaultPool returns the pool a tenant's external IPs are allocated
+// from when no pool is named.
+func (c *controller) TenantDefaultPool(tenantID string) (types.DefaultPool, error) {
+	t, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return types.DefaultPool{}, err
+	}
+
+	if t == nil {
+		return types.DefaultPool{}, types.ErrTenantNotFound
+	}
+
+	ID := c.ds.GetTenantDefaultPool(tenantID)
+	if ID == "" {
+		return types.DefaultPool{}, nil
+	}
+
+	pool, err := c.ds.GetPool(ID)
+	if err != nil {
+		return types.DefaultPool{}, err
+	}
+
+	return types.DefaultPool{PoolID: pool.ID, PoolName: pool.Name}, nil
+}
+
+// SetTenantDefaultPool makes the named pool the default for a tenant. The
+// pool must be one the tenant may allocate from. An empty poolName returns
+// the tenant to the controller's pool selection strategy.
+func (c *controller) SetTenantDefaultPool(tenantID string, poolName string) error {
+	t, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return err
+	}
+
+	if t == nil {
+		return types.ErrTenantNotFound
+	}
+
+	if poolName == "" {
+		return c.ds.SetTenantDefaultPool(tenantID, "")
+	}
+
+	pools, err := c.ds.GetPools()
+	if err != nil {
+		return err
+	}
+
+	pool, ok := findPool(pools, poolName)
+	if !ok {
+		return types.ErrPoolNotFound
+	}
+
+	if !pool.AvailableTo(tenantID) {
+		return types.ErrForbidden
+	}
+
+	return c.ds.SetTenantDefaultPool(tenantID, pool.ID)
+}
+
+// TenantPoolStrategy returns the pool selection strategy used for a
+// tenant's allocations which name no pool.
+func (c *controller) TenantPoolStrategy(tenantID string) (types.TenantPoolStrategy, error) {
+	t, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return types.TenantPoolStrategy{}, err
+	}
+
+	if t == nil {
+		return types.TenantPoolStrategy{}, types.ErrTenantNotFound
+	}
+
+	strategy := c.ds.GetTenantPoolStrategy(tenantID)
+	if strategy == "" {
+		return types.TenantPoolStrategy{
+			TenantID:  tenantID,
+			Strategy:  c.PoolSelection(),
+			Inherited: true,
+		}, nil
+	}
+
+	return types.TenantPoolStrategy{TenantID: tenantID, Strategy: strategy}, nil
+}
+
+// SetTenantPoolStrategy sets the pool selection strategy of a tenant. An
+// empty strategy returns the tenant to the controller's strategy.
+func (c *controller) SetTenantPoolStrategy(tenantID string, strategy string) error {
+	t, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return err
+	}
+
+	if t == nil {
+		return types.ErrTenantNotFound
+	}
+
+	if strategy != "" && !types.ValidPoolSelection(strategy) {
+		return types.ErrInvalidPoolSelection
+	}
+
+	return c.ds.SetTenantPoolStrategy(tenantID, strategy)
+}
+
+// poolAllocated records the pool an external IP was last allocated from.
+func (c *controller) poolAllocated(poolID string) {
+	c.lastPoolLock.Lock()
+	c.lastPool = poolID
+	c.lastPoolLock.Unlock()
+}
+
+// PreviewAllocation returns the address which the next MapAddress call with
+// the same arguments would allocate. Nothing is reserved, so a concurrent
+// allocation may take the address first.
+func (c *controller) PreviewAllocation(tenantID string, poolName string) (types.ExternalIP, error) {
+	var name *string
+
+	if poolName != "" {
+		name = &poolName
+	}
+
+	pool, err := c.selectPool(tenantID, name)
+	if err != nil {
+		return types.ExternalIP{}, err
+	}
+
+	return c.previewAddress(pool)
+}
+
+// NextFreeAddress returns the address a pool would give out next, skipping
+// drained subnets, without allocating it. It is only a snapshot: another
+// request may take the address before it is next allocated.
+func (c *controller) NextFreeAddress(poolID string) (types.ExternalIP, error) {
+	pool, err := c.ds.GetPool(poolID)
+	if err != nil {
+		return types.ExternalIP{}, err
+	}
+
+	return c.previewAddress(pool)
+}
+
+// previewAddress returns the next free address of a pool, linked to the
+// pool and the subnet it is in.
+func (c *controller) previewAddress(pool types.Pool) (types.ExternalIP, error) {
+	IP, subnetID, err := c.ds.PreviewExternalIP(pool.ID)
+	if err == types.ErrPoolEmpty {
+		err = c.poolExhausted(pool)
+	}
+	if err != nil {
+		return types.ExternalIP{}, err
+	}
+
+	poolLink := types.Link{
+		Rel:  "pool",
+		Href: fmt.Sprintf("%s/pools/%s", c.baseURL(), pool.ID),
+	}
+
+	IP.Links = []types.Link{poolLink}
+
+	if subnetID != "" {
+		subnetLink := types.Link{
+			Rel:  "subnet",
+			Href: fmt.Sprintf("%s/pools/%s/subnets/%s", c.baseURL(), pool.ID, subnetID),
+		}
+
+		IP.Links = append(IP.Links, subnetLink)
+	}
+
+	return IP, nil
+}
+
+// MapAddress allocates an external IP and maps it to an instance. If no
+// instanceID is given the external IP is only reserved for the tenant, and
+// can be mapped to an instance later with RemapAddress. An instance may
+// be given several external IPs, each with a different role. If
+// internalIP is given it must be the address of the instance.
+func (c *controller) MapAddress(tenantID string, poolName *string, instanceID string, internalIP string, role string, lease time.Duration) (types.MappedIP, error) {
+	return c.mapAddress(context.Background(), tenantID, poolName, instanceID, internalIP, role, lease)
+}
+
+// mapAddress maps an address as MapAddress does, giving up once ctx is
+// done. An address allocated by then is released again rather than left
+// with a client which was told the request failed.
+func (c *controller) mapAddress(ctx context.Context, tenantID string, poolName *string, instanceID string, internalIP string, role string, lease time.Duration) (m types.MappedIP, err error) {
+	// reservations count against the quota of the tenant they are for.
+	owner := tenantID
+
+	if instanceID == "" {
+		// the admin must say who a reservation is for.
+		if tenantID == "" {
+			return types.MappedIP{}, types.ErrBadRequest
+		}
+
+		if internalIP != "" {
+			return types.MappedIP{}, types.InternalIPMismatchError{
+				InternalIP: internalIP,
+				Reason:     "reservations are not mapped to an internal IP",
+			}
+		}
+	} else {
+		var i *types.Instance
+
+		if tenantID == "" {
+			// we allow the admin to map anyone's instance
+			i, err = c.ds.GetInstance(instanceID)
+		} else {
+			i, err = c.ds.GetTenantInstance(tenantID, instanceID)
+		}
+		if err != nil {
+			return types.MappedIP{}, err
+		}
+
+		err = checkInternalIP(i, internalIP)
+		if err != nil {
+			return types.MappedIP{}, err
+		}
+
+		owner = i.TenantID
+	}
+
+	// A matching release for this is in the client unAssignEvent,
+	// or in UnMapAddress for reserved IPs.
+	res := <-c.qs.Consume(owner, payloads.RequestedResource{Type: payloads.ExternalIP, Value: 1})
+	defer func() {
+		if err != nil {
+			c.qs.Release(owner, payloads.RequestedResource{Type: payloads.ExternalIP, Value: 1})
+		}
+	}()
+
+	if !res.Allowed() {
+		return types.MappedIP{}, types.ErrQuota
+	}
+
+	pool, err := c.selectPool(owner, poolName)
+	if err != nil {
+		return types.MappedIP{}, err
+	}
+
+	err = ctx.Err()
+	if err != nil {
+		return types.MappedIP{}, err
+	}
+
+	if instanceID == "" {
+		m, err = c.ds.ReserveExternalIP(pool.ID, owner, role, lease)
+	} else {
+		m, err = c.ds.MapExternalIP(pool.ID, instanceID, role)
+	}
+	if err == types.ErrPoolEmpty {
+		err = c.poolExhausted(pool)
+	}
+	if err != nil {
+		return types.MappedIP{}, err
+	}
+
+	// the CNCI has not been asked yet, so only the datastore need
+	// forget the address. The quota is released as for any error.
+	err = ctx.Err()
+	if err != nil {
+		_ = c.ds.UnMapExternalIP(m.ExternalIP)
+		return types.MappedIP{}, err
+	}
+
+	if poolName == nil && c.ds.GetTenantDefaultPool(owner) == "" {
+		c.poolAllocated(pool.ID)
+	}
+
+	// reserved IPs are left for RemapAddress to hand to the CNCI.
+	if m.InstanceID != "" {
+		var t *types.Tenant
+
+		// get tenant CNCI info
+		t, err = c.ds.GetTenant(m.TenantID)
+		if err == nil {
+			err = c.client.mapExternalIP(*t, m)
+		}
+		if err != nil {
+			_ = c.UnMapAddress(m.ExternalIP)
+			return types.MappedIP{}, err
+		}
+	}
+
+	c.churn.add(owner, time.Now(), 1, 0)
+
+	if tenantID == "" {
+		c.makeMappedIPLinks(&m, nil)
+	} else {
+		c.makeMappedIPLinks(&m, &tenantID)
+	}
+
+	return m, nil
+}
+
+// checkInternalIP returns an InternalIPMismatchError if internalIP is
+// given and is not the address of the instance.
+func checkInternalIP(i *types.Instance, internalIP string) error {
+	if internalIP == "" {
+		return nil
+	}
+
+	mismatch := types.InternalIPMismatchError{
+		InstanceID: i.ID,
+		InternalIP: internalIP,
+	}
+
+	IP := net.ParseIP(internalIP)
+	switch {
+	case IP == nil:
+		mismatch.Reason = "not a valid IP address"
+	case i.IPAddress == "":
+		mismatch.Reason = "the instance has no internal IP yet"
+	case !IP.Equal(net.ParseIP(i.IPAddress)):
+		mismatch.Reason = fmt.Sprintf("the instance's internal IP is %s", i.IPAddress)
+	default:
+		return nil
+	}
+
+	return mismatch
+}
+
+// InstanceExists reports whether an instance exists. If tenantID is
+// not empty the instance must also belong to that tenant.
+func (c *controller) InstanceExists(tenantID string, instanceID string) (bool, error) {
+	var err error
+
+	if tenantID == "" {
+		_, err = c.ds.GetInstance(instanceID)
+	} else {
+		_, err = c.ds.GetTenantInstance(tenantID, instanceID)
+	}
+
+	switch err {
+	case nil:
+		return true, nil
+	case types.ErrInstanceNotFound:
+		return false, nil
+	}
+
+	return false, err
+}
+
+// InstanceInfo returns the name and state of an instance, which must
+// belong to tenantID unless it is empty.
+func (c *controller) InstanceInfo(tenantID string, instanceID string) (types.InstanceInfo, error) {
+	var i *types.Instance
+	var err error
+
+	if tenantID == "" {
+		i, err = c.ds.GetInstance(instanceID)
+	} else {
+		i, err = c.ds.GetTenantInstance(tenantID, instanceID)
+	}
+
+	if err != nil {
+		return types.InstanceInfo{}, err
+	}
+
+	i.StateLock.RLock()
+	defer i.StateLock.RUnlock()
+
+	return types.InstanceInfo{
+		ID:     i.ID,
+		Name:   i.Name,
+		Status: i.State,
+	}, nil
+}
+
+// RemapAddress maps an external IP reserved by MapAddress to an instance
+// of the tenant it was reserved for.
+func (c *controller) RemapAddress(tenantID string, address string, instanceID string) error {
+	m, err := c.ds.GetMappedIP(address)
+	if err != nil {
+		return err
+	}
+
+	if tenantID != "" && m.TenantID != tenantID {
+		return types.ErrAddressNotFound
+	}
+
+	if m.InstanceID != "" {
+		return types.ErrAddressAttached
+	}
+
+	_, err = c.ds.GetTenantInstance(m.TenantID, instanceID)
+	if err != nil {
+		return err
+	}
+
+	t, err := c.ds.GetTenant(m.TenantID)
+	if err != nil {
+		return err
+	}
+
+	m, err = c.ds.RemapExternalIP(address, instanceID)
+	if err != nil {
+		return err
+	}
+
+	err = c.client.mapExternalIP(*t, m)
+	if err != nil {
+		// keep the reservation, it can be remapped again.
+		_, _ = c.ds.RemapExternalIP(address, "")
+	}
+
+	return err
+}
+
+// SwapAddresses swaps the instances two external IPs are mapped to, so
+// that neither instance is ever left without an address. The CNCI is asked
+// to map each address to its new instance, which replaces its old
+// mapping; unmapping the old one would release the address. If the CNCI
+// cannot be asked, the mappings are swapped back.
+func (c *controller) SwapAddresses(a string, b string) error {
+	ma, mb, err := c.ds.SwapExternalIPs(a, b)
+	if err != nil {
+		return err
+	}
+
+	t, err := c.ds.GetTenant(ma.TenantID)
+	if err == nil {
+		err = c.client.mapExternalIP(*t, ma)
+	}
+	if err == nil {
+		err = c.client.mapExternalIP(*t, mb)
+	}
+	if err == nil {
+		return nil
+	}
+
+	ma, mb, swapErr := c.ds.SwapExternalIPs(a, b)
+	if swapErr != nil {
+		glog.Warningf("Error restoring swapped addresses %s and %s: %v", a, b, swapErr)
+		return err
+	}
+
+	if t != nil {
+		for _, m := range []types.MappedIP{ma, mb} {
+			if mapErr := c.client.mapExternalIP(*t, m); mapErr != nil {
+				glog.Warningf("Error remapping address %s: %v", m.ExternalIP, mapErr)
+			}
+		}
+	}
+
+	return err
+}
+
+// SetMappingLabels replaces the labels of the mapping of an external IP,
+// which must belong to tenantID unless it is empty.
+func (c *controller) SetMappingLabels(tenantID string, address string, labels map[string]string) (types.MappedIP, error) {
+	err := types.ValidateMappingLabels(labels)
+	if err != nil {
+		return types.MappedIP{}, err
+	}
+
+	m, err := c.ds.GetMappedIP(address)
+	if err != nil {
+		return types.MappedIP{}, err
+	}
+
+	if tenantID != "" && m.TenantID != tenantID {
+		return types.MappedIP{}, types.ErrAddressNotFound
+	}
+
+	m, err = c.ds.SetMappedIPLabels(address, labels)
+	if err != nil {
+		return types.MappedIP{}, err
+	}
+
+	if tenantID == "" {
+		c.makeMappedIPLinks(&m, nil)
+	} else {
+		c.makeMappedIPLinks(&m, &tenantID)
+	}
+
+	return m, nil
+}
+
+// LabelMappings adds labels to every mapping matched by filter, returning
+// how many were labelled. No mapping is labelled if the labels would
+// leave any of them with more than types.MaxMappingLabels.
+func (c *controller) LabelMappings(filter types.MappedIPFilter, labels map[string]string) (int, error) {
+	if len(labels) == 0 {
+		return 0, types.ErrInvalidLabels
+	}
+
+	var matched []types.MappedIP
+	var merged []map[string]string
+
+	for _, m := range c.ds.GetMappedIPs(nil) {
+		if !filter.Matches(m) {
+			continue
+		}
+
+		l := make(map[string]string, len(m.Labels)+len(labels))
+		for k, v := range m.Labels {
+			l[k] = v
+		}
+		for k, v := range labels {
+			l[k] = v
+		}
+
+		err := types.ValidateMappingLabels(l)
+		if err != nil {
+			return 0, err
+		}
+
+		matched = append(matched, m)
+		merged = append(merged, l)
+	}
+
+	for i, m := range matched {
+		_, err := c.ds.SetMappedIPLabels(m.ExternalIP, merged[i])
+		if err != nil {
+			return i, err
+		}
+	}
+
+	return len(matched), nil
+}
+
+// reclaimableReservations returns the reservations of a pool which have
+// been without an instance since before cutoff, the longest unattached
+// first. Reservations with a lease, which the reaper releases, and those
+// which are part of a block, which are released together, are left out.
+func (c *controller) reclaimableReservations(poolID string, cutoff time.Time) ([]types.MappedIP, error) {
+	_, err := c.ds.GetPool(poolID)
+	if err != nil {
+		return nil, err
+	}
+
+	var reclaimable []types.MappedIP
+	for _, m := range c.ds.GetMappedIPs(nil) {
+		if m.PoolID != poolID || m.Status != types.MappedIPReserved {
+			continue
+		}
+
+		if m.Expires != nil || m.BlockID != "" || m.ReservedSince == nil {
+			continue
+		}
+
+		if m.ReservedSince.After(cutoff) {
+			continue
+		}
+
+		reclaimable = append(reclaimable, m)
+	}
+
+	sort.SliceStable(reclaimable, func(i, j int) bool {
+		return reclaimable[i].ReservedSince.Before(*reclaimable[j].ReservedSince)
+	})
+
+	return reclaimable, nil
+}
+
+// ReclaimableAddresses reports the reservations of a pool which have been
+// without an instance for at least olderThan.
+func (c *controller) ReclaimableAddresses(poolID string, olderThan time.Duration) ([]types.ReclaimableAddress, error) {
+	now := time.Now()
+
+	reservations, err := c.reclaimableReservations(poolID, now.Add(-olderThan))
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := make([]types.ReclaimableAddress, 0, len(reservations))
+	for _, m := range reservations {
+		addresses = append(addresses, types.ReclaimableAddress{
+			MappingID:         m.ID,
+			ExternalIP:        m.ExternalIP,
+			TenantID:          m.TenantID,
+			ReservedSince:     *m.ReservedSince,
+			UnattachedSeconds: int64(now.Sub(*m.ReservedSince) / time.Second),
+			Labels:            m.Labels,
+		})
+	}
+
+	return addresses, nil
+}
+
+// ReclaimAddresses releases the reservations ReclaimableAddresses would
+// report, recording each release in the event log of its tenant. It
+// returns the number released.
+func (c *controller) ReclaimAddresses(poolID string, olderThan time.Duration) (int, error) {
+	cutoff := time.Now().Add(-olderThan)
+
+	reservations, err := c.reclaimableReservations(poolID, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, m := range reservations {
+		released, err := c.ds.ReleaseStaleReservation(m.ExternalIP, cutoff)
+		if err != nil {
+			return count, err
+		}
+
+		// the IP was mapped or released since it was listed.
+		if !released {
+			continue
+		}
+
+		c.qs.Release(m.TenantID, payloads.RequestedResource{Type: payloads.ExternalIP, Value: 1})
+		count++
+
+		msg := fmt.Sprintf("Reclaimed %s, reserved without an instance since %s", m.ExternalIP, m.ReservedSince.Format(time.RFC3339))
+		c.ds.LogEvent(m.TenantID, msg)
+	}
+
+	return count, nil
+}
+
+// AddressHistory returns who an external IP has been mapped to or
+// reserved for, oldest first. Addresses never assigned have an empty
+// history.
+func (c *controller) AddressHistory(address string) ([]types.AssignmentRecord, error) {
+	IP := net.ParseIP(address)
+	if IP == nil {
+		return nil, types.ErrInvalidIP
+	}
+
+	return c.ds.AddressHistory(IP.String())
+}
+
+// leaseReaperInterval is how often reservations whose lease has run out
+// are released.
+const leaseReaperInterval = 10 * time.Second
+
+// poolExhausted returns the error for a pool with no free addresses, or
+// for there being no pool with any if pool has no ID. If leased
+// reservations will free addresses, it says how long to wait before
+// trying again: until the soonest lease has run out and the reaper has
+// had the chance to release it.
+func (c *controller) poolExhausted(pool types.Pool) types.PoolExhaustedError {
+	e := types.PoolExhaustedError{
+		PoolID:   pool.ID,
+		PoolName: pool.Name,
+	}
+
+	var soonest *time.Time
+	for _, m := range c.ds.GetMappedIPs(nil) {
+		if m.Expires == nil || (pool.ID != "" && m.PoolID != pool.ID) {
+			continue
+		}
+
+		if soonest == nil || m.Expires.Before(*soonest) {
+			soonest = m.Expires
+		}
+	}
+
+	if soonest == nil {
+		return e
+	}
+
+	wait := time.Until(*soonest)
+	if wait < 0 {
+		wait = 0
+	}
+	wait += leaseReaperInterval
+
+	e.RetryAfter = int((wait + time.Second - 1) / time.Second)
+
+	return e
+}
+
+// startLeaseReaper releases expired reservations every interval. It
+// returns a function which stops the reaper.
+func (c *controller) startLeaseReaper(interval time.Duration) func() {
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				c.releaseExpiredReservations(now)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+		wg.Wait()
+	}
+}
+
+// releaseExpiredReservations releases the reserved external IPs whose
+// lease ran out before now, recording each release in the event log.
+func (c *controller) releaseExpiredReservations(now time.Time) {
+	for _, m := range c.ds.GetExpiredReservations(now) {
+		released, err := c.ds.ReleaseExpiredReservation(m.ExternalIP, now)
+		if err != nil {
+			glog.Warningf("Error releasing expired reservation of %s: %v", m.ExternalIP, err)
+			continue
+		}
+
+		// the IP was mapped since it was found to have expired.
+		if !released {
+			continue
+		}
+
+		c.qs.Release(m.TenantID, payloads.RequestedResource{Type: payloads.ExternalIP, Value: 1})
+
+		msg := fmt.Sprintf("Released %s, its reservation lease expired at %s", m.ExternalIP, m.Expires.Format(time.RFC3339))
+		c.ds.LogEvent(m.TenantID, msg)
+	}
+}
+
+// ReleaseInstanceAddresses frees every external IP mapped to an instance
+// without waiting for the CNCI to confirm, so that the addresses of
+// instances destroyed out of band are not leaked. The CNCI is still told
+// to unmap them, but failures to do so are only logged. The number of
+// addresses released is returned.
+func (c *controller) ReleaseInstanceAddresses(instanceID string) (int, error) {
+	released := 0
+
+	for _, m := range c.ds.GetMappedIPs(nil) {
+		if m.InstanceID != instanceID {
+			continue
+		}
+
+		ok, err := c.releaseMapping(m)
+		if err != nil {
+			return released, err
+		}
+
+		if !ok {
+			continue
+		}
+
+		released++
+
+		msg := fmt.Sprintf("Released %s from instance %s", m.ExternalIP, instanceID)
+		c.ds.LogEvent(m.TenantID, msg)
+	}
+
+	return released, nil
+}
+
+// ReleaseAddresses frees every external IP a tenant has from a pool,
+// whether reserved or mapped to an instance, returning the mappings which
+// were released.
+func (c *controller) ReleaseAddresses(tenantID string, poolID string) ([]types.MappedIP, error) {
+	_, err := c.ds.GetPool(poolID)
+	if err != nil {
+		return nil, err
+	}
+
+	var released []types.MappedIP
+
+	for _, m := range c.ds.GetMappedIPs(&tenantID) {
+		if m.PoolID != poolID {
+			continue
+		}
+
+		ok, err := c.releaseMapping(m)
+		if err != nil {
+			return released, err
+		}
+
+		if !ok {
+			continue
+		}
+
+		released = append(released, m)
+
+		msg := fmt.Sprintf("Released %s from pool %s", m.ExternalIP, m.PoolName)
+		c.ds.LogEvent(m.TenantID, msg)
+	}
+
+	return released, nil
+}
+
+// releaseMapping frees a mapped external IP and its quota straight away,
+// rather than waiting for the CNCI to confirm the unmap, which is only
+// asked for. It returns false if the IP was unmapped since m was listed.
+func (c *controller) releaseMapping(m types.MappedIP) (bool, error) {
+	err := c.ds.UnMapExternalIP(m.ExternalIP)
+	if err == types.ErrAddressNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	c.qs.Release(m.TenantID, payloads.RequestedResource{Type: payloads.ExternalIP, Value: 1})
+
+	// reserved IPs are not known to the CNCI.
+	if m.InstanceID == "" {
+		return true, nil
+	}
+
+	t, err := c.ds.GetTenant(m.TenantID)
+	if err == nil {
+		err = c.client.unMapExternalIP(*t, m)
+	}
+	if err != nil {
+		glog.Warningf("Error unmapping released address %s: %v", m.ExternalIP, err)
+	}
+
+	return true, nil
+}
+
+// ReserveBlock reserves count consecutive external IPs from a pool for a
+// tenant, as one block which is released with ReleaseBlock. If the pool
+// cannot supply the whole block nothing is reserved. If poolName is empty
+// the pool is chosen as for MapAddress.
+func (c *controller) ReserveBlock(tenantID string, poolName string, count int) ([]types.MappedIP, error) {
+	return c.reserveBlock(tenantID, poolName, count, 0)
+}
+
+// reserveBlock reserves a block as ReserveBlock does, the reservations
+// expiring after lease if it is not zero.
+func (c *controller) reserveBlock(tenantID string, poolName string, count int, lease time.Duration) (block []types.MappedIP, err error) {
+	if count < 1 {
+		return nil, types.ErrInvalidBlockSize
+	}
+
+	t, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return nil, types.ErrTenantNotFound
+	}
+
+	// released in ReleaseBlock.
+	res := <-c.qs.Consume(tenantID, payloads.RequestedResource{Type: payloads.ExternalIP, Value: count})
+	defer func() {
+		if err != nil {
+			c.qs.Release(tenantID, payloads.RequestedResource{Type: payloads.ExternalIP, Value: count})
+		}
+	}()
+
+	if !res.Allowed() {
+		return nil, types.ErrQuota
+	}
+
+	var name *string
+	if poolName != "" {
+		name = &poolName
+	}
+
+	pool, err := c.selectPool(tenantID, name)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err = c.ds.ReserveExternalIPBlock(pool.ID, tenantID, count, lease)
+	if err == types.ErrPoolEmpty {
+		err = c.poolExhausted(pool)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range block {
+		c.makeMappedIPLinks(&block[i], nil)
+	}
+
+	msg := fmt.Sprintf("Reserved %d external IPs from pool %s as block %s", count, pool.Name, block[0].BlockID)
+	c.ds.LogEvent(tenantID, msg)
+
+	return block, nil
+}
+
+// ReleaseBlock releases all of a block of external IPs reserved for a
+// tenant by ReserveBlock, returning how many were released. The block is
+// kept whole if any of its addresses are mapped to an instance.
+func (c *controller) ReleaseBlock(tenantID string, blockID string) (int, error) {
+	block, err := c.ds.ReleaseExternalIPBlock(tenantID, blockID)
+	if len(block) > 0 {
+		// the admin may release a block without naming its tenant.
+		tenantID = block[0].TenantID
+
+		c.qs.Release(tenantID, payloads.RequestedResource{Type: payloads.ExternalIP, Value: len(block)})
+
+		msg := fmt.Sprintf("Released %d external IPs of block %s", len(block), blockID)
+		c.ds.LogEvent(tenantID, msg)
+	}
+
+	return len(block), err
+}
+
+// ClaimAddresses reserves a block of count external IPs for a tenant, the
+// first phase of provisioning them. The block's ID is the claim's token.
+// Claims which are neither committed nor abandoned within ttl are released
+// by the lease reaper.
+func (c *controller) ClaimAddresses(tenantID string, poolName string, count int, ttl time.Duration) (types.ExternalIPClaim, error) {
+	if ttl <= 0 {
+		return types.ExternalIPClaim{}, types.ErrBadRequest
+	}
+
+	block, err := c.reserveBlock(tenantID, poolName, count, ttl)
+	if err != nil {
+		return types.ExternalIPClaim{}, err
+	}
+
+	claim := types.ExternalIPClaim{
+		Token:    block[0].BlockID,
+		Expires:  block[0].Expires,
+		Mappings: block,
+	}
+
+	return claim, nil
+}
+
+// CommitClaim maps the external IPs of a claim to instances, in the order of
+// their addresses, completing their provisioning. An empty tenantID matches
+// the claim of any tenant. If mapping fails part way, committing the claim
+// again maps the addresses which are left.
+func (c *controller) CommitClaim(tenantID string, token string, instanceIDs []string) ([]types.MappedIP, error) {
+	var tenant *string
+	if tenantID != "" {
+		tenant = &tenantID
+	}
+
+	var claim []types.MappedIP
+	for _, m := range c.ds.GetMappedIPs(tenant) {
+		if m.BlockID == token {
+			claim = append(claim, m)
+		}
+	}
+
+	if len(claim) == 0 {
+		return nil, types.ErrAddressNotFound
+	}
+
+	sort.Slice(claim, func(i, j int) bool {
+		return bytes.Compare(net.ParseIP(claim[i].ExternalIP), net.ParseIP(claim[j].ExternalIP)) < 0
+	})
+
+	if len(instanceIDs) != len(claim) {
+		return nil, types.ErrBadRequest
+	}
+
+	// everything is checked first, so that a claim is not left partly
+	// committed for want of an instance.
+	now := time.Now()
+	for i, m := range claim {
+		if m.InstanceID == instanceIDs[i] {
+			continue
+		}
+
+		if m.InstanceID != "" {
+			return nil, types.ErrAddressAttached
+		}
+
+		// expired claims are as good as released.
+		if m.Expires != nil && m.Expires.Before(now) {
+			return nil, types.ErrAddressNotFound
+		}
+
+		_, err := c.ds.GetTenantInstance(m.TenantID, instanceIDs[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i, m := range claim {
+		if m.InstanceID == instanceIDs[i] {
+			continue
+		}
+
+		err := c.RemapAddress(m.TenantID, m.ExternalIP, instanceIDs[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	committed := make([]types.MappedIP, 0, len(claim))
+	for _, m := range claim {
+		m, err := c.ds.GetMappedIP(m.ExternalIP)
+		if err != nil {
+			return nil, err
+		}
+
+		c.makeMappedIPLinks(&m, tenant)
+		committed = append(committed, m)
+	}
+
+	msg := fmt.Sprintf("Committed claim %s of %d external IPs", token, len(committed))
+	c.ds.LogEvent(committed[0].TenantID, msg)
+
+	return committed, nil
+}
+
+func (c *controller) UnMapAddress(address string) error {
+	// get mapping
+	m, err := c.ds.GetMappedIP(address)
+	if err != nil {
+		return err
+	}
+
+	// reserved IPs are not known to the CNCI, so can be
+	// released straight away.
+	if m.InstanceID == "" {
+		err = c.ds.UnMapExternalIP(address)
+		if err != nil {
+			return err
+		}
+
+		c.qs.Release(m.TenantID, payloads.RequestedResource{Type: payloads.ExternalIP, Value: 1})
+		c.churn.add(m.TenantID, time.Now(), 0, 1)
+		return nil
+	}
+
+	// get tenant CNCI info
+	t, err := c.ds.GetTenant(m.TenantID)
+	if err != nil {
+		return err
+	}
+
+	err = c.client.unMapExternalIP(*t, m)
 	if err != nil {
 		return err
 	}
 
-	return c.client.unMapExternalIP(*t, m)
+	c.churn.add(m.TenantID, time.Now(), 0, 1)
+	return nil
 }
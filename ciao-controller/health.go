@@ -0,0 +1,143 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/01org/ciao/ciao-controller/types"
+	"github.com/pkg/errors"
+)
+
+// healthCheck checks one dependency of the controller.
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+// healthChecks returns the checks of the dependencies the controller
+// has. The webhook is only checked if one is configured.
+func (c *controller) healthChecks() []healthCheck {
+	checks := []healthCheck{
+		{"datastore", c.ds.Ping},
+		{"scheduler", func() error {
+			if c.client == nil || !c.client.isConnected() {
+				return errors.New("not connected to scheduler")
+			}
+			return nil
+		}},
+	}
+
+	if *externalIPWebhook != "" {
+		checks = append(checks, healthCheck{"webhook", func() error {
+			return checkWebhook(*externalIPWebhook, *healthCheckTimeout)
+		}})
+	}
+
+	return checks
+}
+
+// checkWebhook checks that the webhook answers. Only its own errors
+// count against it, as it need not accept anything but POSTs.
+func checkWebhook(url string, timeout time.Duration) error {
+	client := &http.Client{Timeout: timeout}
+
+	resp, err := client.Head(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+// runHealthChecks runs checks at once, reporting any which have not
+// finished within timeout as timed out rather than waiting for them.
+func runHealthChecks(checks []healthCheck, timeout time.Duration) types.HealthReport {
+	type outcome struct {
+		index int
+		check types.HealthCheck
+	}
+
+	// buffered so checks finishing after the timeout do not block.
+	done := make(chan outcome, len(checks))
+
+	for i, hc := range checks {
+		go func(i int, hc healthCheck) {
+			start := time.Now()
+			err := hc.check()
+
+			check := types.HealthCheck{
+				Name:      hc.name,
+				Status:    types.HealthOK,
+				LatencyMS: int64(time.Since(start) / time.Millisecond),
+			}
+			if err != nil {
+				check.Status = types.HealthUnhealthy
+				check.Error = err.Error()
+			}
+
+			done <- outcome{i, check}
+		}(i, hc)
+	}
+
+	report := types.HealthReport{
+		Status: types.HealthOK,
+		Checks: make([]types.HealthCheck, len(checks)),
+	}
+
+	for i, hc := range checks {
+		report.Checks[i] = types.HealthCheck{
+			Name:      hc.name,
+			Status:    types.HealthTimeout,
+			LatencyMS: int64(timeout / time.Millisecond),
+			Error:     fmt.Sprintf("no answer within %v", timeout),
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+wait:
+	for range checks {
+		select {
+		case o := <-done:
+			report.Checks[o.index] = o.check
+		case <-timer.C:
+			break wait
+		}
+	}
+
+	for _, check := range report.Checks {
+		if check.Status != types.HealthOK {
+			report.Status = types.HealthUnhealthy
+		}
+	}
+
+	return report
+}
+
+// Health reports the health of each dependency of the controller. A
+// dependency which does not answer in time is reported as timed out, so
+// the report is never held up by it.
+func (c *controller) Health() (types.HealthReport, error) {
+	return runHealthChecks(c.healthChecks(), *healthCheckTimeout), nil
+}
@@ -20,10 +20,14 @@
 package datastore
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/binary"
 	"fmt"
+	"math/big"
 	"net"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -48,6 +52,20 @@ type Config struct {
 	PersistentURI     string
 	TransientURI      string
 	InitWorkloadsPath string
+
+	// MaxPools and MaxMappings limit the number of pools and of
+	// mapped or reserved external IPs across the whole deployment.
+	// Zero or less means no limit.
+	MaxPools    int
+	MaxMappings int
+
+	// MaxInstanceMappings limits the number of external IPs mapped to
+	// each instance. Zero or less means no limit.
+	MaxInstanceMappings int
+
+	// AllowedNets, if not empty, are the networks which the subnets
+	// and addresses of pools must be within.
+	AllowedNets []*net.IPNet
 }
 
 type userEventType string
@@ -79,6 +97,7 @@ type attachment struct {
 type persistentStore interface {
 	init(config Config) error
 	disconnect()
+	ping() error
 
 	// interfaces related to logging
 	logEvent(tenantID string, eventType string, message string) error
@@ -87,12 +106,14 @@ type persistentStore interface {
 
 	// interfaces related to workloads
 	updateWorkload(wl types.Workload) error
+	updateWorkloadTenant(ID string, tenantID string) error
 	deleteWorkload(ID string) error
 
 	// interfaces related to tenants
 	addTenant(id string, MAC string) (err error)
 	getTenant(id string) (t *tenant, err error)
 	getTenants() ([]*tenant, error)
+	updateTenantEnabled(id string, enabled bool) error
 	releaseTenantIP(tenantID string, subnetInt int, rest int) (err error)
 	claimTenantIP(tenantID string, subnetInt int, rest int) (err error)
 
@@ -127,12 +148,29 @@ type persistentStore interface {
 	deletePool(ID string) error
 
 	addMappedIP(m types.MappedIP) error
+	updateMappedIP(m types.MappedIP) error
 	deleteMappedIP(ID string) error
 	getMappedIPs() map[string]types.MappedIP
 
+	addAssignmentRecord(address string, r types.AssignmentRecord) error
+	getAddressHistory(address string) ([]types.AssignmentRecord, error)
+
+	updateDefaultPool(tenantID string, poolID string) error
+	getDefaultPools() map[string]string
+
+	updatePoolStrategy(tenantID string, strategy string) error
+	getPoolStrategies() map[string]string
+
+	addAddressReservation(r types.AddressReservation) error
+	deleteAddressReservation(ID string) error
+	getAddressReservations() map[string]types.AddressReservation
+
 	// quotas
 	updateQuotas(tenantID string, qds []types.QuotaDetails) error
 	getQuotas(tenantID string) ([]types.QuotaDetails, error)
+	deleteQuotas(tenantID string) error
+	updateSubQuotas(tenantID string, sub string, qds []types.QuotaDetails) error
+	getSubQuotas(tenantID string) (map[string][]types.QuotaDetails, error)
 }
 
 // Datastore provides context for the datastore package.
@@ -172,9 +210,36 @@ type Datastore struct {
 	externalSubnets map[string]bool
 	externalIPs     map[string]bool
 	mappedIPs       map[string]types.MappedIP
+	defaultPools    map[string]string
+	poolStrategies  map[string]string
+	reservations    map[string]types.AddressReservation
 	poolsLock       *sync.RWMutex
+	maxPools        int
+	maxMappings     int
+	maxInstanceMaps int
+	allowedNets     []*net.IPNet
+
+	mappedIPWatchers    map[chan types.MappedIPChange]struct{}
+	mappedIPWatchesLock *sync.Mutex
+
+	logWatchers    map[chan types.LogEntry]struct{}
+	logWatchesLock *sync.Mutex
+
+	// assignments are the latest entry in the history of each external
+	// IP, so that changes which do not reassign an IP, such as to its
+	// labels, are left out of its history.
+	assignments     map[string]types.AssignmentRecord
+	assignmentsLock *sync.Mutex
 }
 
+// mappedIPWatchQueue is the number of changes queued for a watcher
+// before further changes are dropped.
+const mappedIPWatchQueue = 16
+
+// logWatchQueue is the number of log entries queued for a watcher before
+// further entries are dropped.
+const logWatchQueue = 16
+
 func (ds *Datastore) initExternalIPs() {
 	ds.poolsLock = &sync.RWMutex{}
 	ds.externalSubnets = make(map[string]bool)
@@ -193,6 +258,138 @@ func (ds *Datastore) initExternalIPs() {
 	}
 
 	ds.mappedIPs = ds.db.getMappedIPs()
+
+	now := time.Now()
+	for address, m := range ds.mappedIPs {
+		m = withSubnet(ds.pools[m.PoolID], m)
+
+		// reservations and mappings made before their times were
+		// recorded are treated as made now.
+		if m.Status == types.MappedIPReserved && m.ReservedSince == nil {
+			m.ReservedSince = &now
+			if err := ds.db.updateMappedIP(m); err != nil {
+				glog.Warningf("Error recording reservation time of %s: %v", address, err)
+			}
+		}
+
+		if m.Created == nil {
+			m.Created = &now
+			if err := ds.db.updateMappedIP(m); err != nil {
+				glog.Warningf("Error recording creation time of %s: %v", address, err)
+			}
+		}
+
+		ds.mappedIPs[address] = m
+	}
+
+	ds.defaultPools = ds.db.getDefaultPools()
+	ds.poolStrategies = ds.db.getPoolStrategies()
+	ds.reservations = ds.db.getAddressReservations()
+
+	ds.mappedIPWatchers = make(map[chan types.MappedIPChange]struct{})
+	ds.mappedIPWatchesLock = &sync.Mutex{}
+
+	ds.assignments = make(map[string]types.AssignmentRecord)
+	ds.assignmentsLock = &sync.Mutex{}
+	for address, m := range ds.mappedIPs {
+		ds.assignments[address] = assignmentOf(types.MappedIPCreated, m)
+	}
+}
+
+// assignmentOf returns the entry in the history of an external IP for a
+// change to its mapping, without its time.
+func assignmentOf(changeType string, m types.MappedIP) types.AssignmentRecord {
+	r := types.AssignmentRecord{
+		MappingID:  m.ID,
+		TenantID:   m.TenantID,
+		InstanceID: m.InstanceID,
+		InternalIP: m.InternalIP,
+	}
+
+	switch {
+	case changeType == types.MappedIPDeleted:
+		r.Action = types.AssignmentReleased
+	case m.Status == types.MappedIPAttached:
+		r.Action = types.AssignmentMapped
+	default:
+		r.Action = types.AssignmentReserved
+	}
+
+	return r
+}
+
+// recordAssignment adds a change to a mapping to the history of its
+// external IP, unless the IP is still assigned as it was. The change has
+// already been made, so failing to record it is only logged.
+func (ds *Datastore) recordAssignment(changeType string, m types.MappedIP) {
+	r := assignmentOf(changeType, m)
+
+	ds.assignmentsLock.Lock()
+	defer ds.assignmentsLock.Unlock()
+
+	if last, ok := ds.assignments[m.ExternalIP]; ok && last == r {
+		return
+	}
+	ds.assignments[m.ExternalIP] = r
+
+	r.Timestamp = time.Now()
+	err := ds.db.addAssignmentRecord(m.ExternalIP, r)
+	if err != nil {
+		glog.Warningf("Error recording history of external IP %s: %v", m.ExternalIP, err)
+	}
+}
+
+// mappedIPChanged records a change to a mapping in the history of its
+// external IP and tells those watching mappings about it.
+func (ds *Datastore) mappedIPChanged(changeType string, m types.MappedIP) {
+	ds.recordAssignment(changeType, m)
+	ds.notifyMappedIPWatchers(changeType, m)
+}
+
+// AddressHistory returns who an external IP has been assigned to, oldest
+// first.
+func (ds *Datastore) AddressHistory(address string) ([]types.AssignmentRecord, error) {
+	// like the event log, the history is not cached.
+	return ds.db.getAddressHistory(address)
+}
+
+// WatchMappedIPs returns a channel on which every subsequent change to the
+// mapped external IPs is sent, and a function which stops the watch. The
+// stop function must be called once the caller is done with the channel.
+// Changes are dropped, rather than block the datastore, when the caller
+// falls behind.
+func (ds *Datastore) WatchMappedIPs() (<-chan types.MappedIPChange, func()) {
+	ch := make(chan types.MappedIPChange, mappedIPWatchQueue)
+
+	ds.mappedIPWatchesLock.Lock()
+	ds.mappedIPWatchers[ch] = struct{}{}
+	ds.mappedIPWatchesLock.Unlock()
+
+	stop := func() {
+		ds.mappedIPWatchesLock.Lock()
+		delete(ds.mappedIPWatchers, ch)
+		ds.mappedIPWatchesLock.Unlock()
+	}
+
+	return ch, stop
+}
+
+func (ds *Datastore) notifyMappedIPWatchers(changeType string, m types.MappedIP) {
+	change := types.MappedIPChange{
+		Type:    changeType,
+		Mapping: m,
+	}
+
+	ds.mappedIPWatchesLock.Lock()
+	defer ds.mappedIPWatchesLock.Unlock()
+
+	for ch := range ds.mappedIPWatchers {
+		select {
+		case ch <- change:
+		default:
+			glog.Warningf("Dropping change to external IP %s for slow watcher", m.ExternalIP)
+		}
+	}
 }
 
 // Init initializes the private data for the Datastore object.
@@ -219,6 +416,9 @@ func (ds *Datastore) Init(config Config) error {
 	ds.instanceLastStat = make(map[string]types.CiaoServerStats)
 	ds.instanceLastStatLock = &sync.RWMutex{}
 
+	ds.logWatchers = make(map[chan types.LogEntry]struct{})
+	ds.logWatchesLock = &sync.Mutex{}
+
 	// warning, do not use the tenant cache to get
 	// networking information right now.  that is not
 	// updated, just the resources
@@ -305,6 +505,11 @@ func (ds *Datastore) Init(config Config) error {
 
 	ds.initExternalIPs()
 
+	ds.maxPools = config.MaxPools
+	ds.maxMappings = config.MaxMappings
+	ds.maxInstanceMaps = config.MaxInstanceMappings
+	ds.allowedNets = config.AllowedNets
+
 	return nil
 }
 
@@ -313,6 +518,11 @@ func (ds *Datastore) Exit() {
 	ds.db.disconnect()
 }
 
+// Ping checks that the backing database can still be reached.
+func (ds *Datastore) Ping() error {
+	return ds.db.ping()
+}
+
 // AddTenant stores information about a tenant into the datastore.
 // and makes sure that this new tenant is cached.
 func (ds *Datastore) AddTenant(id string) (*types.Tenant, error) {
@@ -333,6 +543,60 @@ func (ds *Datastore) AddTenant(id string) (*types.Tenant, error) {
 	return &t.Tenant, nil
 }
 
+// CreateTenant adds a named tenant. Neither the ID nor the name may
+// already be in use by another tenant.
+func (ds *Datastore) CreateTenant(id string, name string) (*types.Tenant, error) {
+	ds.tenantsLock.Lock()
+	defer ds.tenantsLock.Unlock()
+
+	if ds.tenants[id] != nil {
+		return nil, types.ErrTenantExists
+	}
+
+	for _, t := range ds.tenants {
+		if t.Name == name {
+			return nil, types.ErrTenantExists
+		}
+	}
+
+	err := ds.db.addTenant(id, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error adding tenant (%v) to database", id)
+	}
+
+	t, err := ds.db.getTenant(id)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting tenant (%v) from database", id)
+	}
+	if t == nil {
+		return nil, types.ErrTenantNotFound
+	}
+
+	ds.tenants[id] = t
+
+	return &t.Tenant, nil
+}
+
+// SetTenantEnabled suspends or resumes a tenant.
+func (ds *Datastore) SetTenantEnabled(id string, enabled bool) error {
+	ds.tenantsLock.Lock()
+	defer ds.tenantsLock.Unlock()
+
+	t := ds.tenants[id]
+	if t == nil {
+		return types.ErrTenantNotFound
+	}
+
+	err := ds.db.updateTenantEnabled(id, enabled)
+	if err != nil {
+		return errors.Wrapf(err, "error updating tenant (%v) in database", id)
+	}
+
+	t.Enabled = enabled
+
+	return nil
+}
+
 func (ds *Datastore) getTenant(id string) (*tenant, error) {
 	// check cache first
 	ds.tenantsLock.RLock()
@@ -360,6 +624,9 @@ func (ds *Datastore) GetTenant(id string) (*types.Tenant, error) {
 // AddWorkload is used to add a new workload to the datastore.
 // Both cache and persistent store are updated.
 func (ds *Datastore) AddWorkload(w types.Workload) error {
+	// instance counts are worked out when listing, not stored.
+	w.InstanceCount = nil
+
 	ds.tenantsLock.Lock()
 	defer ds.tenantsLock.Unlock()
 
@@ -422,6 +689,89 @@ func (ds *Datastore) DeleteWorkload(tenantID string, workloadID string) error {
 	return types.ErrWorkloadNotFound
 }
 
+// TransferWorkload moves a workload from the tenant which owns it to
+// another. Public workloads and workloads with instances cannot be moved.
+func (ds *Datastore) TransferWorkload(workloadID string, targetTenantID string) error {
+	ds.instancesLock.RLock()
+	defer ds.instancesLock.RUnlock()
+
+	// the instances of a workload must belong to its tenant.
+	for _, val := range ds.instances {
+		if val.WorkloadID == workloadID {
+			return types.ErrWorkloadInUse
+		}
+	}
+
+	ds.tenantsLock.Lock()
+	defer ds.tenantsLock.Unlock()
+
+	target, ok := ds.tenants[targetTenantID]
+	if !ok {
+		return types.ErrTenantNotFound
+	}
+
+	for tenantID, t := range ds.tenants {
+		for i, wl := range t.workloads {
+			if wl.ID != workloadID {
+				continue
+			}
+
+			if tenantID == "public" {
+				return types.ErrWorkloadPublic
+			}
+
+			if tenantID == targetTenantID {
+				return nil
+			}
+
+			err := ds.db.updateWorkloadTenant(workloadID, targetTenantID)
+			if err != nil {
+				return errors.Wrapf(err, "error updating workload %v in database", wl.ID)
+			}
+
+			wl.TenantID = targetTenantID
+			t.workloads = append(t.workloads[:i], t.workloads[i+1:]...)
+			target.workloads = append(target.workloads, wl)
+
+			return nil
+		}
+	}
+
+	return types.ErrWorkloadNotFound
+}
+
+// UpdateWorkload replaces a workload in the datastore with w. The
+// workload must already belong to w.TenantID. Both cache and persistent
+// store are updated.
+func (ds *Datastore) UpdateWorkload(w types.Workload) error {
+	w.InstanceCount = nil
+
+	ds.tenantsLock.Lock()
+	defer ds.tenantsLock.Unlock()
+
+	tenant, ok := ds.tenants[w.TenantID]
+	if !ok {
+		return ErrNoTenant
+	}
+
+	for i, wl := range tenant.workloads {
+		if wl.ID != w.ID {
+			continue
+		}
+
+		err := ds.db.updateWorkload(w)
+		if err != nil {
+			return errors.Wrapf(err, "error updating workload (%v) in database", w.ID)
+		}
+
+		tenant.workloads[i] = w
+
+		return nil
+	}
+
+	return types.ErrWorkloadNotFound
+}
+
 // GetWorkload returns details about a specific workload referenced by id
 func (ds *Datastore) GetWorkload(tenantID string, ID string) (types.Workload, error) {
 	if ID == ds.cnciWorkload.ID {
@@ -442,6 +792,19 @@ func (ds *Datastore) GetWorkload(tenantID string, ID string) (types.Workload, er
 		}
 	}
 
+	// without a tenant, the workloads of every tenant are searched.
+	if tenantID == "" {
+		for _, tenant := range ds.tenants {
+			for _, wl := range tenant.workloads {
+				if wl.ID == ID {
+					return wl, nil
+				}
+			}
+		}
+
+		return types.Workload{}, types.ErrWorkloadNotFound
+	}
+
 	tenant, ok := ds.tenants[tenantID]
 	if !ok {
 		return types.Workload{}, ErrNoTenant
@@ -486,6 +849,35 @@ func (ds *Datastore) GetWorkloads(tenantID string) ([]types.Workload, error) {
 	return workloads, nil
 }
 
+// CountWorkloads returns the number of workloads GetWorkloads would return
+// for a tenant. If fwType is not empty only workloads with that firmware
+// type are counted.
+func (ds *Datastore) CountWorkloads(tenantID string, fwType string) int {
+	ds.tenantsLock.RLock()
+	defer ds.tenantsLock.RUnlock()
+
+	count := 0
+	countTenant := func(ID string) {
+		tenant, ok := ds.tenants[ID]
+		if !ok {
+			return
+		}
+
+		for _, wl := range tenant.workloads {
+			if fwType == "" || wl.FWType == fwType {
+				count++
+			}
+		}
+	}
+
+	countTenant("public")
+	if tenantID != "public" {
+		countTenant(tenantID)
+	}
+
+	return count
+}
+
 // UpdateInstance will update certain fields of an instance
 func (ds *Datastore) UpdateInstance(instance *types.Instance) error {
 	return ds.db.updateInstance(instance)
@@ -759,6 +1151,27 @@ func (ds *Datastore) GetTenantCNCIs(tenantID string) ([]*types.Instance, error)
 	return ds.getTenantInstances(tenantID, true)
 }
 
+// WorkloadInstanceCounts counts the instances of every workload at once,
+// keyed by workload ID, so that listings need not look up the instances of
+// each workload. If tenantID is not empty only the instances of that
+// tenant are counted. CNCIs are never counted.
+func (ds *Datastore) WorkloadInstanceCounts(tenantID string) map[string]int {
+	counts := make(map[string]int)
+
+	ds.instancesLock.RLock()
+	defer ds.instancesLock.RUnlock()
+
+	for _, instance := range ds.instances {
+		if instance.CNCI || (tenantID != "" && instance.TenantID != tenantID) {
+			continue
+		}
+
+		counts[instance.WorkloadID]++
+	}
+
+	return counts
+}
+
 // GetAllInstancesByNode will retrieve all the instances running on a specific compute Node.
 func (ds *Datastore) GetAllInstancesByNode(nodeID string) ([]*types.Instance, error) {
 	var instances []*types.Instance
@@ -825,7 +1238,7 @@ func (ds *Datastore) RestartFailure(instanceID string, reason payloads.RestartFa
 	}
 
 	msg := fmt.Sprintf("Restart Failure %s: %s", instanceID, reason.String())
-	return errors.Wrap(ds.db.logEvent(i.TenantID, string(userError), msg), "Error logging event")
+	return errors.Wrap(ds.logEvent(i.TenantID, string(userError), msg), "Error logging event")
 }
 
 // StopFailure logs a StopFailure in the datastore
@@ -837,7 +1250,7 @@ func (ds *Datastore) StopFailure(instanceID string, reason payloads.StopFailureR
 
 	msg := fmt.Sprintf("Stop Failure %s: %s", instanceID, reason.String())
 
-	return errors.Wrap(ds.db.logEvent(i.TenantID, string(userError), msg), "Error logging event")
+	return errors.Wrap(ds.logEvent(i.TenantID, string(userError), msg), "Error logging event")
 }
 
 // StartFailure will clean up after a failure to start an instance.
@@ -867,7 +1280,7 @@ func (ds *Datastore) StartFailure(instanceID string, reason payloads.StartFailur
 	}
 
 	msg := fmt.Sprintf("Start Failure %s: %s", instanceID, reason.String())
-	return errors.Wrap(ds.db.logEvent(i.TenantID, string(userError), msg), "Error logging event")
+	return errors.Wrap(ds.logEvent(i.TenantID, string(userError), msg), "Error logging event")
 }
 
 // AttachVolumeFailure will clean up after a failure to attach a volume.
@@ -896,7 +1309,7 @@ func (ds *Datastore) AttachVolumeFailure(instanceID string, volumeID string, rea
 
 	msg := fmt.Sprintf("Attach Volume Failure %s to %s: %s", volumeID, instanceID, reason.String())
 
-	return errors.Wrap(ds.db.logEvent(i.TenantID, string(userError), msg), "Error logging event")
+	return errors.Wrap(ds.logEvent(i.TenantID, string(userError), msg), "Error logging event")
 }
 
 // DetachVolumeFailure will clean up after a failure to detach a volume.
@@ -928,7 +1341,7 @@ func (ds *Datastore) DetachVolumeFailure(instanceID string, volumeID string, rea
 
 	msg := fmt.Sprintf("Detach Volume Failure %s from %s: %s", volumeID, instanceID, reason.String())
 
-	return errors.Wrap(ds.db.logEvent(i.TenantID, string(userError), msg), "Error logging event")
+	return errors.Wrap(ds.logEvent(i.TenantID, string(userError), msg), "Error logging event")
 }
 
 func (ds *Datastore) deleteInstance(instanceID string) (string, error) {
@@ -988,7 +1401,7 @@ func (ds *Datastore) DeleteInstance(instanceID string) error {
 	}
 
 	msg := fmt.Sprintf("Deleted Instance %s", instanceID)
-	return errors.Wrap(ds.db.logEvent(tenantID, string(userInfo), msg), "Error logging event")
+	return errors.Wrap(ds.logEvent(tenantID, string(userInfo), msg), "Error logging event")
 }
 
 func (ds *Datastore) updateInstanceStatus(status, instanceID string) error {
@@ -1467,14 +1880,63 @@ func (ds *Datastore) ClearLog() error {
 	return ds.db.clearLog()
 }
 
+// logEvent adds a message to the persistent event log, and sends it to
+// those watching the log.
+func (ds *Datastore) logEvent(tenant string, eventType string, msg string) error {
+	err := ds.db.logEvent(tenant, eventType, msg)
+	if err != nil {
+		return err
+	}
+
+	entry := types.LogEntry{
+		Timestamp: time.Now(),
+		TenantID:  tenant,
+		EventType: eventType,
+		Message:   msg,
+	}
+
+	ds.logWatchesLock.Lock()
+	defer ds.logWatchesLock.Unlock()
+
+	for ch := range ds.logWatchers {
+		select {
+		case ch <- entry:
+		default:
+			glog.Warningf("Dropping log entry of tenant %s for slow watcher", tenant)
+		}
+	}
+
+	return nil
+}
+
+// WatchEventLog returns a channel on which every subsequent entry of the
+// event log is sent, and a function which stops the watch. Entries are
+// dropped, rather than block those logging them, when the caller falls
+// behind.
+func (ds *Datastore) WatchEventLog() (<-chan types.LogEntry, func()) {
+	ch := make(chan types.LogEntry, logWatchQueue)
+
+	ds.logWatchesLock.Lock()
+	ds.logWatchers[ch] = struct{}{}
+	ds.logWatchesLock.Unlock()
+
+	stop := func() {
+		ds.logWatchesLock.Lock()
+		delete(ds.logWatchers, ch)
+		ds.logWatchesLock.Unlock()
+	}
+
+	return ch, stop
+}
+
 // LogEvent will add a message to the persistent event log.
 func (ds *Datastore) LogEvent(tenant string, msg string) error {
-	return ds.db.logEvent(tenant, string(userInfo), msg)
+	return ds.logEvent(tenant, string(userInfo), msg)
 }
 
 // LogError will add a message to the persistent event log as an error
 func (ds *Datastore) LogError(tenant string, msg string) error {
-	return ds.db.logEvent(tenant, string(userError), msg)
+	return ds.logEvent(tenant, string(userError), msg)
 }
 
 // AddBlockDevice will store information about new BlockData into
@@ -1819,7 +2281,7 @@ func (ds *Datastore) GetPool(ID string) (types.Pool, error) {
 	return p, nil
 }
 
-// GetPools will return a list of external IP Pools
+// GetPools will return a list of external IP Pools sorted by ID.
 func (ds *Datastore) GetPools() ([]types.Pool, error) {
 	var pools []types.Pool
 
@@ -1831,70 +2293,287 @@ func (ds *Datastore) GetPools() ([]types.Pool, error) {
 
 	ds.poolsLock.RUnlock()
 
+	sort.Sort(types.SortedPoolsByID(pools))
+
 	return pools, nil
 }
 
-// lock for the map must be held by caller.
-func (ds *Datastore) isDuplicateSubnet(new *net.IPNet) bool {
-	for s, exists := range ds.externalSubnets {
-		if exists == true {
-			// this will always succeed
-			_, subnet, _ := net.ParseCIDR(s)
+// GetPoolContaining returns the pool with a subnet or individual IP
+// holding IP.
+func (ds *Datastore) GetPoolContaining(IP net.IP) (types.Pool, error) {
+	ds.poolsLock.RLock()
+	defer ds.poolsLock.RUnlock()
 
-			if subnet.Contains(new.IP) || new.Contains(subnet.IP) {
-				return true
+	for _, p := range ds.pools {
+		for _, subnet := range p.Subnets {
+			_, ipNet, err := net.ParseCIDR(subnet.CIDR)
+			if err == nil && ipNet.Contains(IP) {
+				return p, nil
+			}
+		}
+
+		for _, ext := range p.IPs {
+			if IP.Equal(net.ParseIP(ext.Address)) {
+				return p, nil
 			}
 		}
 	}
 
-	return false
+	return types.Pool{}, types.ErrPoolNotFound
 }
 
-// lock for the map must be held by the caller
-func (ds *Datastore) isDuplicateIP(new net.IP) bool {
-	// first make sure the IP isn't covered by a subnet
-	for s, exists := range ds.externalSubnets {
-		// this will always succeed
-		_, subnet, _ := net.ParseCIDR(s)
+// GetPoolCapacity adds up the addresses of every pool, by address family.
+func (ds *Datastore) GetPoolCapacity() types.PoolCapacity {
+	var capacity types.PoolCapacity
 
-		if exists == true {
-			if subnet.Contains(new) {
-				return true
-			}
+	family := func(IP net.IP) *types.AddressCapacity {
+		if IP.To4() != nil {
+			return &capacity.IPv4
 		}
+		return &capacity.IPv6
 	}
 
-	// next make sure that the IP isn't already in a
-	// different pool
-	return ds.externalIPs[new.String()]
-}
+	ds.poolsLock.RLock()
+	defer ds.poolsLock.RUnlock()
 
-// AddPool will add a brand new pool to our datastore.
-func (ds *Datastore) AddPool(pool types.Pool) error {
-	ds.poolsLock.Lock()
+	// the free addresses of a pool are counted from its subnets and
+	// IPs, less those mapped.
+	drained := make(map[string][]*net.IPNet)
 
-	if len(pool.Subnets) > 0 {
-		// check each one to make sure it's not in use.
-		for _, subnet := range pool.Subnets {
-			_, newSubnet, err := net.ParseCIDR(subnet.CIDR)
+	for _, p := range ds.pools {
+		for _, subnet := range p.Subnets {
+			IP, ipNet, err := net.ParseCIDR(subnet.CIDR)
 			if err != nil {
-				ds.poolsLock.Unlock()
-				return errors.Wrapf(err, "unable to parse subnet CIDR (%v)", subnet.CIDR)
+				continue
 			}
 
-			if ds.isDuplicateSubnet(newSubnet) {
-				ds.poolsLock.Unlock()
-				return types.ErrDuplicateSubnet
-			}
+			ones, bits := ipNet.Mask.Size()
+			size := (1 << uint32(bits-ones)) - 2
 
-			// update our list of used subnets
-			ds.externalSubnets[subnet.CIDR] = true
+			c := family(IP)
+			c.Total += size
+
+			if p.Drained || subnet.Drained {
+				drained[p.ID] = append(drained[p.ID], ipNet)
+			} else {
+				c.Free += size
+			}
 		}
-	} else if len(pool.IPs) > 0 {
-		var newIPs []net.IP
 
-		// make sure valid and not duplicate
-		for _, newIP := range pool.IPs {
+		for _, ext := range p.IPs {
+			IP := net.ParseIP(ext.Address)
+			if IP == nil {
+				continue
+			}
+
+			c := family(IP)
+			c.Total++
+
+			if !p.Drained {
+				c.Free++
+			}
+		}
+	}
+
+	for _, m := range ds.mappedIPs {
+		IP := net.ParseIP(m.ExternalIP)
+		if IP == nil {
+			continue
+		}
+
+		// drained addresses were never counted as free.
+		if ds.pools[m.PoolID].Drained {
+			continue
+		}
+
+		inDrained := false
+		for _, ipNet := range drained[m.PoolID] {
+			if ipNet.Contains(IP) {
+				inDrained = true
+				break
+			}
+		}
+
+		if !inDrained {
+			family(IP).Free--
+		}
+	}
+
+	return capacity
+}
+
+// lock for the map must be held by caller.
+func (ds *Datastore) isDuplicateSubnet(new *net.IPNet) bool {
+	for s, exists := range ds.externalSubnets {
+		if exists == true {
+			// this will always succeed
+			_, subnet, _ := net.ParseCIDR(s)
+
+			if subnet.Contains(new.IP) || new.Contains(subnet.IP) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// lock for the map must be held by the caller
+func (ds *Datastore) isDuplicateIP(new net.IP) bool {
+	// first make sure the IP isn't covered by a subnet
+	for s, exists := range ds.externalSubnets {
+		// this will always succeed
+		_, subnet, _ := net.ParseCIDR(s)
+
+		if exists == true {
+			if subnet.Contains(new) {
+				return true
+			}
+		}
+	}
+
+	// next make sure that the IP isn't already in a
+	// different pool
+	return ds.externalIPs[new.String()]
+}
+
+// reservedOverlap returns an AddressReservedError if the network, which
+// is a subnet or a single address, overlaps any address reservation.
+//
+// lock for the map must be held by the caller.
+func (ds *Datastore) reservedOverlap(n *net.IPNet, address string) error {
+	for _, r := range ds.reservations {
+		// this will always succeed
+		_, reserved, _ := net.ParseCIDR(r.CIDR)
+
+		if reserved.Contains(n.IP) || n.Contains(reserved.IP) {
+			return types.AddressReservedError{
+				Address:       address,
+				ReservationID: r.ID,
+				Label:         r.Label,
+			}
+		}
+	}
+
+	return nil
+}
+
+// netWithin reports whether inner is entirely within outer.
+func netWithin(inner *net.IPNet, outer *net.IPNet) bool {
+	innerOnes, innerBits := inner.Mask.Size()
+	outerOnes, outerBits := outer.Mask.Size()
+
+	return innerBits == outerBits && outerOnes <= innerOnes && outer.Contains(inner.IP)
+}
+
+// checkAllowed returns an AddressNotAllowedError if the network, which
+// is a pool's subnet or a single address, is not within any of the
+// allowed networks. Any network is allowed if none are set.
+func (ds *Datastore) checkAllowed(n *net.IPNet, address string) error {
+	if len(ds.allowedNets) == 0 {
+		return nil
+	}
+
+	allowed := make([]string, 0, len(ds.allowedNets))
+	for _, a := range ds.allowedNets {
+		if netWithin(n, a) {
+			return nil
+		}
+		allowed = append(allowed, a.String())
+	}
+
+	return types.AddressNotAllowedError{Address: address, Allowed: allowed}
+}
+
+// hostNet returns the network holding only IP.
+func hostNet(IP net.IP) *net.IPNet {
+	if IP4 := IP.To4(); IP4 != nil {
+		IP = IP4
+	}
+
+	bits := len(IP) * 8
+	return &net.IPNet{IP: IP, Mask: net.CIDRMask(bits, bits)}
+}
+
+// CheckPoolAddresses returns an AddressNotAllowedError if the subnet or
+// any of the addresses is not within the networks pools may be created
+// from, or an AddressReservedError if it is reserved. Those which cannot
+// be parsed are left for AddExternalSubnet and AddExternalIPs to reject.
+func (ds *Datastore) CheckPoolAddresses(subnet *string, IPs []string) error {
+	ds.poolsLock.RLock()
+	defer ds.poolsLock.RUnlock()
+
+	if subnet != nil {
+		_, ipNet, err := net.ParseCIDR(*subnet)
+		if err != nil {
+			return nil
+		}
+
+		err = ds.checkAllowed(ipNet, *subnet)
+		if err != nil {
+			return err
+		}
+
+		return ds.reservedOverlap(ipNet, *subnet)
+	}
+
+	for _, address := range IPs {
+		IP := net.ParseIP(address)
+		if IP == nil {
+			continue
+		}
+
+		err := ds.checkAllowed(hostNet(IP), address)
+		if err != nil {
+			return err
+		}
+
+		err = ds.reservedOverlap(hostNet(IP), address)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AddPool will add a brand new pool to our datastore.
+func (ds *Datastore) AddPool(pool types.Pool) error {
+	ds.poolsLock.Lock()
+
+	if ds.maxPools > 0 && len(ds.pools) >= ds.maxPools {
+		ds.poolsLock.Unlock()
+		return types.ErrPoolLimitReached
+	}
+
+	if len(pool.Subnets) > 0 {
+		// check each one to make sure it's not in use.
+		for _, subnet := range pool.Subnets {
+			_, newSubnet, err := net.ParseCIDR(subnet.CIDR)
+			if err != nil {
+				ds.poolsLock.Unlock()
+				return errors.Wrapf(err, "unable to parse subnet CIDR (%v)", subnet.CIDR)
+			}
+
+			if ds.isDuplicateSubnet(newSubnet) {
+				ds.poolsLock.Unlock()
+				return types.ErrDuplicateSubnet
+			}
+
+			err = ds.reservedOverlap(newSubnet, subnet.CIDR)
+			if err != nil {
+				ds.poolsLock.Unlock()
+				return err
+			}
+
+			// update our list of used subnets
+			ds.externalSubnets[subnet.CIDR] = true
+		}
+	} else if len(pool.IPs) > 0 {
+		var newIPs []net.IP
+
+		// make sure valid and not duplicate
+		for _, newIP := range pool.IPs {
 			IP := net.ParseIP(newIP.Address)
 			if IP == nil {
 				ds.poolsLock.Unlock()
@@ -1906,6 +2585,12 @@ func (ds *Datastore) AddPool(pool types.Pool) error {
 				return types.ErrDuplicateIP
 			}
 
+			err := ds.reservedOverlap(hostNet(IP), newIP.Address)
+			if err != nil {
+				ds.poolsLock.Unlock()
+				return err
+			}
+
 			newIPs = append(newIPs, IP)
 		}
 
@@ -1915,6 +2600,8 @@ func (ds *Datastore) AddPool(pool types.Pool) error {
 		}
 	}
 
+	pool.Revision = 1
+
 	ds.pools[pool.ID] = pool
 	err := ds.db.addPool(pool)
 
@@ -1959,341 +2646,1791 @@ func (ds *Datastore) DeletePool(ID string) error {
 	// delete the whole pool
 	delete(ds.pools, ID)
 
-	return err
+	// tenants whose default it was fall back to the global default.
+	for tenantID, poolID := range ds.defaultPools {
+		if poolID == ID {
+			delete(ds.defaultPools, tenantID)
+		}
+	}
+
+	return err
+}
+
+// UpdatePoolTags will replace the set of tags associated with a pool.
+func (ds *Datastore) UpdatePoolTags(poolID string, tags []string) error {
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
+
+	p, ok := ds.pools[poolID]
+	if !ok {
+		return types.ErrPoolNotFound
+	}
+
+	p.Tags = tags
+	p.Revision++
+
+	err := ds.db.updatePool(p)
+	if err != nil {
+		return errors.Wrap(err, "error updating pool in database")
+	}
+
+	ds.pools[poolID] = p
+
+	return nil
+}
+
+// UpdatePoolDescription replaces the description of a pool.
+func (ds *Datastore) UpdatePoolDescription(poolID string, description string) error {
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
+
+	p, ok := ds.pools[poolID]
+	if !ok {
+		return types.ErrPoolNotFound
+	}
+
+	p.Description = description
+	p.Revision++
+
+	err := ds.db.updatePool(p)
+	if err != nil {
+		return errors.Wrap(err, "error updating pool in database")
+	}
+
+	ds.pools[poolID] = p
+
+	return nil
+}
+
+// DrainPool stops, or with drained false restarts, new allocations from
+// a pool. Existing mappings are not affected.
+func (ds *Datastore) DrainPool(poolID string, drained bool) error {
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
+
+	p, ok := ds.pools[poolID]
+	if !ok {
+		return types.ErrPoolNotFound
+	}
+
+	p.Drained = drained
+	p.Revision++
+
+	err := ds.db.updatePool(p)
+	if err != nil {
+		return errors.Wrap(err, "error updating pool in database")
+	}
+
+	ds.pools[poolID] = p
+
+	return nil
+}
+
+// DrainSubnet stops, or with drained false restarts, new allocations from
+// one subnet of a pool. Existing mappings are not affected.
+func (ds *Datastore) DrainSubnet(poolID string, subnetID string, drained bool) error {
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
+
+	p, ok := ds.pools[poolID]
+	if !ok {
+		return types.ErrPoolNotFound
+	}
+
+	// the subnets are copied so that the cached pool is unchanged
+	// if the update fails.
+	subnets := make([]types.ExternalSubnet, len(p.Subnets))
+	copy(subnets, p.Subnets)
+
+	found := false
+	for i := range subnets {
+		if subnets[i].ID == subnetID {
+			subnets[i].Drained = drained
+			found = true
+		}
+	}
+
+	if !found {
+		return types.ErrInvalidPoolAddress
+	}
+
+	p.Subnets = subnets
+	p.Revision++
+
+	err := ds.db.updatePool(p)
+	if err != nil {
+		return errors.Wrap(err, "error updating pool in database")
+	}
+
+	ds.pools[poolID] = p
+
+	return nil
+}
+
+// GetTenantDefaultPool returns the ID of the pool a tenant's external IPs
+// are allocated from when no pool is named, or "" if the tenant has no
+// default of its own.
+func (ds *Datastore) GetTenantDefaultPool(tenantID string) string {
+	ds.poolsLock.RLock()
+	defer ds.poolsLock.RUnlock()
+
+	return ds.defaultPools[tenantID]
+}
+
+// SetTenantDefaultPool sets the default pool of a tenant. An empty
+// poolID removes the tenant's default.
+func (ds *Datastore) SetTenantDefaultPool(tenantID string, poolID string) error {
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
+
+	if poolID != "" {
+		if _, ok := ds.pools[poolID]; !ok {
+			return types.ErrPoolNotFound
+		}
+	}
+
+	err := ds.db.updateDefaultPool(tenantID, poolID)
+	if err != nil {
+		return errors.Wrap(err, "error updating default pool in database")
+	}
+
+	if poolID == "" {
+		delete(ds.defaultPools, tenantID)
+	} else {
+		ds.defaultPools[tenantID] = poolID
+	}
+
+	return nil
+}
+
+// GetTenantPoolStrategy returns the pool selection strategy of a tenant, or
+// "" if the tenant uses the controller's.
+func (ds *Datastore) GetTenantPoolStrategy(tenantID string) string {
+	ds.poolsLock.RLock()
+	defer ds.poolsLock.RUnlock()
+
+	return ds.poolStrategies[tenantID]
+}
+
+// SetTenantPoolStrategy sets the pool selection strategy of a tenant. An
+// empty strategy returns the tenant to the controller's.
+func (ds *Datastore) SetTenantPoolStrategy(tenantID string, strategy string) error {
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
+
+	err := ds.db.updatePoolStrategy(tenantID, strategy)
+	if err != nil {
+		return errors.Wrap(err, "error updating pool strategy in database")
+	}
+
+	if strategy == "" {
+		delete(ds.poolStrategies, tenantID)
+	} else {
+		ds.poolStrategies[tenantID] = strategy
+	}
+
+	return nil
+}
+
+// AddAddressReservation holds the address space of r back from pools.
+// Space which any pool, or another reservation, already holds cannot be
+// reserved.
+func (ds *Datastore) AddAddressReservation(r types.AddressReservation) (types.AddressReservation, error) {
+	_, ipNet, err := net.ParseCIDR(r.CIDR)
+	if err != nil {
+		return r, types.ErrInvalidReservation
+	}
+	r.CIDR = ipNet.String()
+
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
+
+	if ds.isDuplicateSubnet(ipNet) {
+		return r, types.ErrDuplicateSubnet
+	}
+
+	for address, exists := range ds.externalIPs {
+		if exists && ipNet.Contains(net.ParseIP(address)) {
+			return r, types.ErrDuplicateIP
+		}
+	}
+
+	err = ds.reservedOverlap(ipNet, r.CIDR)
+	if err != nil {
+		return r, err
+	}
+
+	err = ds.db.addAddressReservation(r)
+	if err != nil {
+		return r, errors.Wrap(err, "error adding address reservation to database")
+	}
+
+	ds.reservations[r.ID] = r
+
+	return r, nil
+}
+
+// GetAddressReservations returns every address reservation, oldest
+// first.
+func (ds *Datastore) GetAddressReservations() []types.AddressReservation {
+	ds.poolsLock.RLock()
+	defer ds.poolsLock.RUnlock()
+
+	reservations := make([]types.AddressReservation, 0, len(ds.reservations))
+	for _, r := range ds.reservations {
+		reservations = append(reservations, r)
+	}
+
+	sort.Slice(reservations, func(i, j int) bool {
+		if reservations[i].Created.Equal(reservations[j].Created) {
+			return reservations[i].ID < reservations[j].ID
+		}
+		return reservations[i].Created.Before(reservations[j].Created)
+	})
+
+	return reservations
+}
+
+// DeleteAddressReservation releases the address space of a reservation
+// to pools.
+func (ds *Datastore) DeleteAddressReservation(ID string) (types.AddressReservation, error) {
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
+
+	r, ok := ds.reservations[ID]
+	if !ok {
+		return r, types.ErrReservationNotFound
+	}
+
+	err := ds.db.deleteAddressReservation(ID)
+	if err != nil {
+		return r, errors.Wrap(err, "error deleting address reservation from database")
+	}
+
+	delete(ds.reservations, ID)
+
+	return r, nil
+}
+
+// RenamePool changes the name of a pool. The name must not be used by
+// any other pool, in any case.
+func (ds *Datastore) RenamePool(poolID string, name string) error {
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
+
+	p, ok := ds.pools[poolID]
+	if !ok {
+		return types.ErrPoolNotFound
+	}
+
+	for ID, pool := range ds.pools {
+		if ID != poolID && strings.EqualFold(pool.Name, name) {
+			return types.ErrDuplicatePoolName
+		}
+	}
+
+	p.Name = name
+	p.Revision++
+
+	err := ds.db.updatePool(p)
+	if err != nil {
+		return errors.Wrap(err, "error updating pool in database")
+	}
+
+	ds.pools[poolID] = p
+
+	// the pool's mappings carry its name, so that listings need not look
+	// up the pool of each.
+	for address, m := range ds.mappedIPs {
+		if m.PoolID == poolID {
+			m.PoolName = name
+			ds.mappedIPs[address] = m
+		}
+	}
+
+	return nil
+}
+
+// AddExternalSubnet will add a new subnet to an existing pool.
+func (ds *Datastore) AddExternalSubnet(poolID string, subnet string) error {
+	sub := types.ExternalSubnet{
+		ID:   uuid.Generate().String(),
+		CIDR: subnet,
+	}
+
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return errors.Wrapf(err, "unable to parse subnet CIDR (%v)", subnet)
+	}
+
+	err = ds.checkAllowed(ipNet, subnet)
+	if err != nil {
+		return err
+	}
+
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
+
+	p, ok := ds.pools[poolID]
+	if !ok {
+		return types.ErrPoolNotFound
+	}
+
+	if ds.isDuplicateSubnet(ipNet) {
+		return types.ErrDuplicateSubnet
+	}
+
+	err = ds.reservedOverlap(ipNet, subnet)
+	if err != nil {
+		return err
+	}
+
+	ones, bits := ipNet.Mask.Size()
+
+	// intentionally do not support /32 here, user should add by IP address instead
+	// deduct gateway and broadcast
+	newIPs := (1 << uint32(bits-ones)) - 2
+	if newIPs <= 0 {
+		return types.ErrSubnetTooSmall
+	}
+	p.TotalIPs += newIPs
+	p.Free += newIPs
+	p.Subnets = append(p.Subnets, sub)
+	p.Revision++
+
+	err = ds.db.updatePool(p)
+	if err != nil {
+		return errors.Wrap(err, "error updating pool in database")
+	}
+
+	// we are committed now.
+	ds.pools[poolID] = p
+	ds.externalSubnets[sub.CIDR] = true
+
+	return nil
+}
+
+// AddExternalIPs will add a list of individual IPs to an existing pool.
+func (ds *Datastore) AddExternalIPs(poolID string, IPs []string) error {
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
+
+	p, ok := ds.pools[poolID]
+	if !ok {
+		return types.ErrPoolNotFound
+	}
+
+	// sort to allow duplicate detection in IPs
+	sort.Strings(IPs)
+
+	// make sure valid and not duplicate
+	lastIP := ""
+	for _, newIP := range IPs {
+		if lastIP == newIP {
+			return types.ErrDuplicateIP
+		}
+
+		IP := net.ParseIP(newIP)
+		if IP == nil {
+			return types.ErrInvalidIP
+		}
+
+		err := ds.checkAllowed(hostNet(IP), newIP)
+		if err != nil {
+			return err
+		}
+
+		if ds.isDuplicateIP(IP) {
+			return types.ErrDuplicateIP
+		}
+
+		err = ds.reservedOverlap(hostNet(IP), newIP)
+		if err != nil {
+			return err
+		}
+
+		ExtIP := types.ExternalIP{
+			ID:      uuid.Generate().String(),
+			Address: IP.String(),
+		}
+
+		p.TotalIPs++
+		p.Free++
+		p.IPs = append(p.IPs, ExtIP)
+		lastIP = newIP
+	}
+
+	p.Revision++
+
+	// update persistent store.
+	err := ds.db.updatePool(p)
+	if err != nil {
+		return errors.Wrap(err, "error updating pool in database")
+	}
+
+	// update cache.
+	for _, IP := range p.IPs {
+		ds.externalIPs[IP.Address] = true
+	}
+	ds.pools[poolID] = p
+
+	return nil
+}
+
+// DeleteSubnet will remove an unused subnet from an existing pool.
+func (ds *Datastore) DeleteSubnet(poolID string, subnetID string) error {
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
+
+	p, ok := ds.pools[poolID]
+	if !ok {
+		return types.ErrPoolNotFound
+	}
+
+	for i, sub := range p.Subnets {
+		if sub.ID != subnetID {
+			continue
+		}
+
+		// this path will be taken only once.
+		IP, ipNet, err := net.ParseCIDR(sub.CIDR)
+		if err != nil {
+			return errors.Wrapf(err, "unable to parse subnet CIDR (%v)", sub.CIDR)
+		}
+
+		// check each address in this subnet is not mapped.
+		for IP := IP.Mask(ipNet.Mask); ipNet.Contains(IP); incrementIP(IP) {
+			_, ok := ds.mappedIPs[IP.String()]
+			if ok {
+				return types.ErrPoolNotEmpty
+			}
+		}
+
+		ones, bits := ipNet.Mask.Size()
+		numIPs := (1 << uint32(bits-ones)) - 2
+		p.TotalIPs -= numIPs
+		p.Free -= numIPs
+		p.Subnets = append(p.Subnets[:i], p.Subnets[i+1:]...)
+		p.Revision++
+
+		err = ds.db.updatePool(p)
+		if err != nil {
+			return errors.Wrap(err, "error updating pool in database")
+		}
+
+		delete(ds.externalSubnets, sub.CIDR)
+		ds.pools[poolID] = p
+
+		return nil
+	}
+
+	return types.ErrInvalidPoolAddress
+}
+
+// DeleteExternalIP will remove an individual IP address from a pool.
+func (ds *Datastore) DeleteExternalIP(poolID string, addrID string) error {
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
+
+	p, ok := ds.pools[poolID]
+	if !ok {
+		return types.ErrPoolNotFound
+	}
+
+	for i, extIP := range p.IPs {
+		if extIP.ID != addrID {
+			continue
+		}
+
+		// this path will be taken only once.
+		// check address is not mapped.
+		_, ok := ds.mappedIPs[extIP.Address]
+		if ok {
+			return types.ErrPoolNotEmpty
+		}
+
+		p.TotalIPs--
+		p.Free--
+		p.IPs = append(p.IPs[:i], p.IPs[i+1:]...)
+		p.Revision++
+
+		err := ds.db.updatePool(p)
+		if err != nil {
+			return errors.Wrap(err, "error updating pool in database")
+		}
+
+		delete(ds.externalIPs, extIP.Address)
+		ds.pools[poolID] = p
+
+		return nil
+	}
+
+	return types.ErrInvalidPoolAddress
+}
+
+// UpdatePoolIPs adds and removes individual IPs of a pool in one update.
+// Removing an address which is mapped or reserved fails with
+// ErrAddressInUse unless force is set, in which case the mapping is
+// removed too and returned so that the caller can release it. Nothing is
+// changed if any of the addresses cannot be added or removed.
+func (ds *Datastore) UpdatePoolIPs(poolID string, add []string, remove []string, force bool) ([]types.MappedIP, error) {
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
+
+	p, ok := ds.pools[poolID]
+	if !ok {
+		return nil, types.ErrPoolNotFound
+	}
+
+	removed := make(map[string]bool)
+	for _, address := range remove {
+		IP := net.ParseIP(address)
+		if IP == nil {
+			return nil, types.ErrInvalidIP
+		}
+		removed[IP.String()] = true
+	}
+
+	var unmapped []types.MappedIP
+	kept := []types.ExternalIP{}
+	found := 0
+
+	for _, extIP := range p.IPs {
+		if !removed[extIP.Address] {
+			kept = append(kept, extIP)
+			continue
+		}
+
+		found++
+
+		m, mapped := ds.mappedIPs[extIP.Address]
+		if mapped {
+			if !force {
+				return nil, types.ErrAddressInUse
+			}
+			unmapped = append(unmapped, m)
+		}
+	}
+
+	if found != len(removed) {
+		return nil, types.ErrInvalidPoolAddress
+	}
+
+	// mapped addresses were not free, so only the others come
+	// off the free count.
+	p.TotalIPs -= found
+	p.Free -= found - len(unmapped)
+
+	// sort a copy to allow duplicate detection in add.
+	sorted := append([]string(nil), add...)
+	sort.Strings(sorted)
+
+	lastIP := ""
+	for _, newIP := range sorted {
+		if lastIP == newIP {
+			return nil, types.ErrDuplicateIP
+		}
+
+		IP := net.ParseIP(newIP)
+		if IP == nil {
+			return nil, types.ErrInvalidIP
+		}
+
+		err := ds.checkAllowed(hostNet(IP), newIP)
+		if err != nil {
+			return nil, err
+		}
+
+		if ds.isDuplicateIP(IP) {
+			return nil, types.ErrDuplicateIP
+		}
+
+		err = ds.reservedOverlap(hostNet(IP), newIP)
+		if err != nil {
+			return nil, err
+		}
+
+		kept = append(kept, types.ExternalIP{
+			ID:      uuid.Generate().String(),
+			Address: IP.String(),
+		})
+
+		p.TotalIPs++
+		p.Free++
+		lastIP = newIP
+	}
+
+	p.IPs = kept
+	p.Revision++
+
+	err := ds.db.updatePool(p)
+	if err != nil {
+		return nil, errors.Wrap(err, "error updating pool in database")
+	}
+
+	for _, m := range unmapped {
+		err = ds.db.deleteMappedIP(m.ID)
+		if err != nil {
+			return nil, errors.Wrap(err, "error deleting IP mapping from database")
+		}
+		delete(ds.mappedIPs, m.ExternalIP)
+
+		ds.mappedIPChanged(types.MappedIPDeleted, m)
+	}
+
+	// update cache.
+	for address := range removed {
+		delete(ds.externalIPs, address)
+	}
+	for _, IP := range p.IPs {
+		ds.externalIPs[IP.Address] = true
+	}
+	ds.pools[poolID] = p
+
+	return unmapped, nil
+}
+
+func incrementIP(IP net.IP) {
+	for i := len(IP) - 1; i >= 0; i-- {
+		IP[i]++
+		if IP[i] > 0 {
+			break
+		}
+	}
+}
+
+// GetSubnetAddresses lists up to limit of the addresses of a subnet which
+// can be allocated, starting offset addresses after the first, with the
+// mappings of any which are in use. It also reports whether there are
+// more addresses after those listed.
+func (ds *Datastore) GetSubnetAddresses(poolID string, subnetID string, offset int, limit int) (types.SubnetInventory, bool, error) {
+	ds.poolsLock.RLock()
+	defer ds.poolsLock.RUnlock()
+
+	pool, ok := ds.pools[poolID]
+	if !ok {
+		return types.SubnetInventory{}, false, types.ErrPoolNotFound
+	}
+
+	for _, sub := range pool.Subnets {
+		if sub.ID != subnetID {
+			continue
+		}
+
+		IP, ipNet, err := net.ParseCIDR(sub.CIDR)
+		if err != nil {
+			return types.SubnetInventory{}, false, errors.Wrapf(err, "error parsing subnet CIDR (%v)", sub.CIDR)
+		}
+
+		inventory := types.SubnetInventory{
+			ID:        sub.ID,
+			CIDR:      sub.CIDR,
+			Drained:   sub.Drained,
+			Offset:    offset,
+			Addresses: []types.SubnetAddress{},
+		}
+
+		// the addresses are walked as findFreeAddress does, skipping
+		// the gateway. The offset is added arithmetically so that
+		// large subnets need not be walked to reach it.
+		start := new(big.Int).SetBytes(IP.Mask(ipNet.Mask))
+		start.Add(start, big.NewInt(int64(offset)+1))
+
+		addr := start.Bytes()
+		IP = make(net.IP, len(ipNet.IP))
+		if len(addr) > len(IP) {
+			return inventory, false, nil
+		}
+		copy(IP[len(IP)-len(addr):], addr)
+
+		for ; ipNet.Contains(IP); incrementIP(IP) {
+			if len(inventory.Addresses) == limit {
+				return inventory, true, nil
+			}
+
+			a := types.SubnetAddress{
+				Address: IP.String(),
+				Status:  types.SubnetAddressFree,
+			}
+
+			if m, ok := ds.mappedIPs[a.Address]; ok {
+				a.Status = m.Status
+				a.MappingID = m.ID
+				a.InstanceID = m.InstanceID
+				a.TenantID = m.TenantID
+			}
+
+			inventory.Addresses = append(inventory.Addresses, a)
+		}
+
+		return inventory, false, nil
+	}
+
+	return types.SubnetInventory{}, false, types.ErrInvalidPoolAddress
+}
+
+// offsetAddress returns the address offset addresses after network, as an
+// IP of size bytes.
+func offsetAddress(network *big.Int, offset int64, size int) string {
+	b := new(big.Int).Add(network, big.NewInt(offset)).Bytes()
+
+	IP := make(net.IP, size)
+	copy(IP[size-len(b):], b)
+
+	return IP.String()
+}
+
+// GetPoolFragmentation reports how the free addresses of the subnets of a
+// pool are split into runs of consecutive addresses. As for the free count
+// of the pool, the gateway and broadcast addresses of each subnet are not
+// counted. Only the mapped addresses are visited.
+func (ds *Datastore) GetPoolFragmentation(poolID string) (types.PoolFragmentation, error) {
+	ds.poolsLock.RLock()
+	defer ds.poolsLock.RUnlock()
+
+	pool, ok := ds.pools[poolID]
+	if !ok {
+		return types.PoolFragmentation{}, types.ErrPoolNotFound
+	}
+
+	frag := types.PoolFragmentation{
+		PoolID:  poolID,
+		Subnets: []types.SubnetFragmentation{},
+	}
+
+	for _, sub := range pool.Subnets {
+		_, ipNet, err := net.ParseCIDR(sub.CIDR)
+		if err != nil {
+			return types.PoolFragmentation{}, errors.Wrapf(err, "error parsing subnet CIDR (%v)", sub.CIDR)
+		}
+
+		network := new(big.Int).SetBytes(ipNet.IP)
+
+		var offsets []int64
+		for address := range ds.mappedIPs {
+			IP := net.ParseIP(address)
+			if IP == nil || !ipNet.Contains(IP) {
+				continue
+			}
+
+			if IP4 := IP.To4(); len(ipNet.IP) == net.IPv4len && IP4 != nil {
+				IP = IP4
+			}
+
+			offset := new(big.Int).SetBytes(IP)
+			offsets = append(offsets, offset.Sub(offset, network).Int64())
+		}
+
+		sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+		// the usable addresses are at offsets 1 to broadcast - 1, and
+		// the free runs lie between the allocated ones.
+		ones, bits := ipNet.Mask.Size()
+		broadcast := int64(1)<<uint(bits-ones) - 1
+
+		s := types.SubnetFragmentation{
+			ID:   sub.ID,
+			CIDR: sub.CIDR,
+		}
+
+		next := int64(1)
+		for _, o := range append(offsets, broadcast) {
+			if o < next {
+				continue
+			}
+
+			if n := o - next; n > 0 {
+				s.Free += int(n)
+				s.FreeBlocks++
+
+				if int(n) > s.LargestFreeBlock {
+					s.LargestFreeBlock = int(n)
+					s.LargestFreeRange = &types.AddressRange{
+						First: offsetAddress(network, next, len(ipNet.IP)),
+						Last:  offsetAddress(network, o-1, len(ipNet.IP)),
+					}
+				}
+			}
+
+			next = o + 1
+		}
+
+		frag.Free += s.Free
+		frag.FreeBlocks += s.FreeBlocks
+		if s.LargestFreeBlock > frag.LargestFreeBlock {
+			frag.LargestFreeBlock = s.LargestFreeBlock
+			frag.LargestFreeRange = s.LargestFreeRange
+		}
+
+		frag.Subnets = append(frag.Subnets, s)
+	}
+
+	if frag.Free > 0 {
+		frag.Fragmentation = 1 - float64(frag.LargestFreeBlock)/float64(frag.Free)
+	}
+
+	return frag, nil
+}
+
+// GetSubnetBitmap reports which addresses of a subnet of a pool are
+// allocated. Only the mapped addresses are visited, so the cost does not
+// depend on the size of the subnet.
+func (ds *Datastore) GetSubnetBitmap(poolID string, subnetID string) (types.SubnetBitmap, error) {
+	ds.poolsLock.RLock()
+	defer ds.poolsLock.RUnlock()
+
+	pool, ok := ds.pools[poolID]
+	if !ok {
+		return types.SubnetBitmap{}, types.ErrPoolNotFound
+	}
+
+	for _, sub := range pool.Subnets {
+		if sub.ID != subnetID {
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(sub.CIDR)
+		if err != nil {
+			return types.SubnetBitmap{}, errors.Wrapf(err, "error parsing subnet CIDR (%v)", sub.CIDR)
+		}
+
+		network := new(big.Int).SetBytes(ipNet.IP)
+
+		type position struct {
+			offset  *big.Int
+			address string
+		}
+
+		var positions []position
+		for address := range ds.mappedIPs {
+			IP := net.ParseIP(address)
+			if IP == nil || !ipNet.Contains(IP) {
+				continue
+			}
+
+			if IP4 := IP.To4(); len(ipNet.IP) == net.IPv4len && IP4 != nil {
+				IP = IP4
+			}
+
+			offset := new(big.Int).SetBytes(IP)
+			offset.Sub(offset, network)
+			positions = append(positions, position{offset, address})
+		}
+
+		sort.Slice(positions, func(i, j int) bool {
+			return positions[i].offset.Cmp(positions[j].offset) < 0
+		})
+
+		bitmap := types.SubnetBitmap{
+			ID:        sub.ID,
+			CIDR:      sub.CIDR,
+			Allocated: len(positions),
+			Ranges:    []types.AddressRange{},
+		}
+
+		one := big.NewInt(1)
+		for i, p := range positions {
+			last := len(bitmap.Ranges) - 1
+			if i > 0 && new(big.Int).Sub(p.offset, positions[i-1].offset).Cmp(one) == 0 {
+				bitmap.Ranges[last].Last = p.address
+				continue
+			}
+
+			bitmap.Ranges = append(bitmap.Ranges, types.AddressRange{First: p.address, Last: p.address})
+		}
+
+		// the size is only worked out for subnets small enough that
+		// it cannot overflow.
+		ones, bits := ipNet.Mask.Size()
+		if size := 1 << uint(bits-ones); bits-ones < 31 && size <= types.MaxBitmapAddresses {
+			b := make([]byte, (size+7)/8)
+			for _, p := range positions {
+				n := p.offset.Int64()
+				b[n/8] |= 0x80 >> uint(n%8)
+			}
+
+			bitmap.Bitmap = base64.StdEncoding.EncodeToString(b)
+		}
+
+		return bitmap, nil
+	}
+
+	return types.SubnetBitmap{}, types.ErrInvalidPoolAddress
+}
+
+// GetMappedIPs will return a list of mapped external IPs by tenant,
+// sorted by mapping ID.
+func (ds *Datastore) GetMappedIPs(tenant *string) []types.MappedIP {
+	var mappedIPs []types.MappedIP
+
+	ds.poolsLock.RLock()
+	defer ds.poolsLock.RUnlock()
+
+	for _, m := range ds.mappedIPs {
+		if tenant != nil {
+			if m.TenantID != *tenant {
+				continue
+			}
+		}
+		mappedIPs = append(mappedIPs, m)
+	}
+
+	sort.Sort(types.SortedMappedIPsByID(mappedIPs))
+
+	return mappedIPs
+}
+
+// CountMappedIPs returns the number of mapped external IPs selected by
+// filter, without copying them.
+func (ds *Datastore) CountMappedIPs(filter types.MappedIPFilter) int {
+	ds.poolsLock.RLock()
+	defer ds.poolsLock.RUnlock()
+
+	count := 0
+	for _, m := range ds.mappedIPs {
+		if filter.Matches(m) {
+			count++
+		}
+	}
+
+	return count
+}
+
+// GetMappedIP will return a MappedIP struct for the given address.
+func (ds *Datastore) GetMappedIP(address string) (types.MappedIP, error) {
+	ds.poolsLock.RLock()
+	defer ds.poolsLock.RUnlock()
+
+	m, ok := ds.mappedIPs[address]
+	if !ok {
+		return types.MappedIP{}, types.ErrAddressNotFound
+	}
+
+	return m, nil
+}
+
+// findFreeAddress returns the first unmapped address in a pool, searching
+// the subnets which are not drained before the individual IPs. If the address is one of the
+// individual IPs the returned ExternalIP has its ID set, otherwise the
+// ID of the subnet the address belongs to is returned.
+// lock for the map must be held by the caller.
+func (ds *Datastore) findFreeAddress(pool types.Pool) (types.ExternalIP, string, error) {
+	return ds.findFreeAddressExcept(pool, nil)
+}
+
+// findFreeAddressExcept returns the first unmapped address in a pool as
+// findFreeAddress does, skipping those in taken.
+// lock for the map must be held by the caller.
+func (ds *Datastore) findFreeAddressExcept(pool types.Pool, taken map[string]bool) (types.ExternalIP, string, error) {
+	drained := false
+
+	// find a free IP address in any subnet.
+	for _, sub := range pool.Subnets {
+		if sub.Drained {
+			drained = true
+			continue
+		}
+
+		IP, ipNet, err := net.ParseCIDR(sub.CIDR)
+		if err != nil {
+			return types.ExternalIP{}, "", errors.Wrapf(err, "error parsing subnet CIDR (%v)", sub.CIDR)
+		}
+
+		initIP := IP.Mask(ipNet.Mask)
+
+		// skip gateway
+		incrementIP(initIP)
+
+		// check each address in this subnet
+		for IP := initIP; ipNet.Contains(IP); incrementIP(IP) {
+			_, ok := ds.mappedIPs[IP.String()]
+			if !ok && !taken[IP.String()] {
+				return types.ExternalIP{Address: IP.String()}, sub.ID, nil
+			}
+		}
+	}
+
+	// we are still looking. Check our individual IPs
+	for _, IP := range pool.IPs {
+		_, ok := ds.mappedIPs[IP.Address]
+		if !ok && !taken[IP.Address] {
+			return types.ExternalIP{ID: IP.ID, Address: IP.Address}, "", nil
+		}
+	}
+
+	// if you got here you are out of luck. But unless the free
+	// addresses are in drained subnets you never should.
+	if !drained {
+		glog.Warningf("Pool reports %d free addresses but none found", pool.Free)
+	}
+	return types.ExternalIP{}, "", types.ErrPoolEmpty
+}
+
+// PreviewExternalIP will return the address that the next call to
+// MapExternalIP for the pool would allocate, without allocating it.
+// The ID of the subnet the address comes from is also returned if the
+// address is not one of the pool's individual IPs.
+func (ds *Datastore) PreviewExternalIP(poolID string) (types.ExternalIP, string, error) {
+	ds.poolsLock.RLock()
+	defer ds.poolsLock.RUnlock()
+
+	pool, ok := ds.pools[poolID]
+	if !ok {
+		return types.ExternalIP{}, "", types.ErrPoolNotFound
+	}
+
+	if pool.Drained {
+		return types.ExternalIP{}, "", types.ErrPoolDrained
+	}
+
+	if pool.Free == 0 {
+		return types.ExternalIP{}, "", types.ErrPoolEmpty
+	}
+
+	return ds.findFreeAddress(pool)
+}
+
+// allocateExternalIP takes the next free address from a pool for the
+// mapping m, filling in the mapping's ID, address and pool.
+func (ds *Datastore) allocateExternalIP(poolID string, m types.MappedIP) (types.MappedIP, error) {
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
+
+	if ds.mappingLimitReached(1) {
+		return types.MappedIP{}, types.ErrMappingLimitReached
+	}
+
+	return ds.addMapping(poolID, m)
+}
+
+// addMapping gives m a free external IP from a pool and records it.
+// lock for the map must be held by the caller.
+func (ds *Datastore) addMapping(poolID string, m types.MappedIP) (types.MappedIP, error) {
+	pool, ok := ds.pools[poolID]
+	if !ok {
+		return types.MappedIP{}, types.ErrPoolNotFound
+	}
+
+	if !pool.AvailableTo(m.TenantID) {
+		return types.MappedIP{}, types.ErrForbidden
+	}
+
+	if pool.Drained {
+		return types.MappedIP{}, types.ErrPoolDrained
+	}
+
+	if pool.Free == 0 {
+		return types.MappedIP{}, types.ErrPoolEmpty
+	}
+
+	if m.InstanceID != "" {
+		index, err := ds.nextMappingIndex(m.InstanceID, m.Role)
+		if err != nil {
+			return types.MappedIP{}, err
+		}
+		m.Index = index
+	}
+
+	IP, subnetID, err := ds.findFreeAddress(pool)
+	if err != nil {
+		return types.MappedIP{}, err
+	}
+
+	return ds.recordMapping(pool, m, IP, subnetID)
+}
+
+// recordMapping records m as the mapping of IP, a free address of pool
+// found with findFreeAddress.
+// lock for the map must be held by the caller.
+func (ds *Datastore) recordMapping(pool types.Pool, m types.MappedIP, IP types.ExternalIP, subnetID string) (types.MappedIP, error) {
+	now := time.Now()
+	m.ID = uuid.Generate().String()
+	m.Created = &now
+	m.ExternalIP = IP.Address
+	m.PoolID = pool.ID
+	m.PoolName = pool.Name
+	m.SubnetID = subnetID
+	m = withSubnet(pool, m)
+
+	pool.Free--
+	pool.Revision++
+
+	err := ds.db.addMappedIP(m)
+	if err != nil {
+		return types.MappedIP{}, errors.Wrap(err, "error adding IP mapping to database")
+	}
+	ds.mappedIPs[m.ExternalIP] = m
+
+	err = ds.db.updatePool(pool)
+	if err != nil {
+		return types.MappedIP{}, errors.Wrap(err, "error updating pool in database")
+	}
+
+	ds.pools[pool.ID] = pool
+
+	ds.mappedIPChanged(types.MappedIPCreated, m)
+
+	return m, nil
+}
+
+// nextMappingIndex returns the lowest index not used by any external IP
+// mapped to the instance, or ErrDuplicateMappingRole if one of them already
+// has the given role. An InstanceMappingLimitError is returned if the
+// instance may not have another external IP.
+// lock for the map must be held by the caller.
+func (ds *Datastore) nextMappingIndex(instanceID string, role string) (int, error) {
+	used := make(map[int]bool)
+	count := 0
+
+	for _, m := range ds.mappedIPs {
+		if m.InstanceID != instanceID {
+			continue
+		}
+
+		if role != "" && m.Role == role {
+			return 0, types.ErrDuplicateMappingRole
+		}
+
+		used[m.Index] = true
+		count++
+	}
+
+	if ds.maxInstanceMaps > 0 && count >= ds.maxInstanceMaps {
+		return 0, types.InstanceMappingLimitError{
+			InstanceID: instanceID,
+			Mappings:   count,
+			Limit:      ds.maxInstanceMaps,
+		}
+	}
+
+	index := 0
+	for used[index] {
+		index++
+	}
+
+	return index, nil
+}
+
+// withSubnet returns m with the ID and CIDR of the subnet of pool its
+// external IP belongs to. Mappings made before the subnet was recorded
+// have it found from the address.
+func withSubnet(pool types.Pool, m types.MappedIP) types.MappedIP {
+	IP := net.ParseIP(m.ExternalIP)
+
+	for _, sub := range pool.Subnets {
+		if m.SubnetID != "" {
+			if sub.ID == m.SubnetID {
+				m.SubnetCIDR = sub.CIDR
+				return m
+			}
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(sub.CIDR)
+		if err == nil && ipNet.Contains(IP) {
+			m.SubnetID = sub.ID
+			m.SubnetCIDR = sub.CIDR
+			return m
+		}
+	}
+
+	return m
+}
+
+// mappingLimitReached reports whether adding count mappings would take the
+// number of them past the configured maximum.
+// lock for the map must be held by the caller.
+func (ds *Datastore) mappingLimitReached(count int) bool {
+	return ds.maxMappings > 0 && len(ds.mappedIPs)+count > ds.maxMappings
+}
+
+// MapExternalIP will allocate an external IP to an instance from a given
+// pool. An instance may have up to MaxInstanceMappings external IPs, role
+// optionally labels this one.
+func (ds *Datastore) MapExternalIP(poolID string, instanceID string, role string) (types.MappedIP, error) {
+	instance, err := ds.GetInstance(instanceID)
+	if err != nil {
+		return types.MappedIP{}, errors.Wrapf(err, "error getting instance (%v)", instanceID)
+	}
+
+	m := types.MappedIP{
+		InternalIP: instance.IPAddress,
+		InstanceID: instanceID,
+		TenantID:   instance.TenantID,
+		Status:     types.MappedIPAttached,
+		Role:       role,
+	}
+
+	return ds.allocateExternalIP(poolID, m)
+}
+
+// ReserveExternalIP will allocate an external IP to a tenant from a given
+// pool without mapping it to an instance. The role is kept for when the
+// IP is later mapped. If lease is not zero the reservation expires once
+// the lease has passed, unless the IP has been mapped by then.
+func (ds *Datastore) ReserveExternalIP(poolID string, tenantID string, role string, lease time.Duration) (types.MappedIP, error) {
+	now := time.Now()
+	m := types.MappedIP{
+		TenantID:      tenantID,
+		Status:        types.MappedIPReserved,
+		Role:          role,
+		ReservedSince: &now,
+	}
+
+	if lease > 0 {
+		expires := now.Add(lease)
+		m.Expires = &expires
+	}
+
+	return ds.allocateExternalIP(poolID, m)
+}
+
+// findFreeBlock returns count consecutive unmapped addresses from one
+// subnet of a pool which is not drained or, failing that, from the
+// pool's individual IPs.
+// lock for the map must be held by the caller.
+func (ds *Datastore) findFreeBlock(pool types.Pool, count int) ([]types.ExternalIP, error) {
+	for _, sub := range pool.Subnets {
+		if sub.Drained {
+			continue
+		}
+
+		IP, ipNet, err := net.ParseCIDR(sub.CIDR)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing subnet CIDR (%v)", sub.CIDR)
+		}
+
+		initIP := IP.Mask(ipNet.Mask)
+
+		// skip gateway
+		incrementIP(initIP)
+
+		var block []types.ExternalIP
+		for IP := initIP; ipNet.Contains(IP); incrementIP(IP) {
+			if _, ok := ds.mappedIPs[IP.String()]; ok {
+				block = nil
+				continue
+			}
+
+			block = append(block, types.ExternalIP{Address: IP.String()})
+			if len(block) == count {
+				return block, nil
+			}
+		}
+	}
+
+	// individual IPs may be added in any order, so are sorted to find
+	// consecutive addresses.
+	IPs := make([]types.ExternalIP, len(pool.IPs))
+	copy(IPs, pool.IPs)
+	sort.Slice(IPs, func(i, j int) bool {
+		return bytes.Compare(net.ParseIP(IPs[i].Address), net.ParseIP(IPs[j].Address)) < 0
+	})
+
+	var block []types.ExternalIP
+	var next net.IP
+	for _, IP := range IPs {
+		addr := net.ParseIP(IP.Address)
+		_, mapped := ds.mappedIPs[IP.Address]
+
+		if mapped || !addr.Equal(next) {
+			block = nil
+		}
+
+		next = append(net.IP(nil), addr...)
+		incrementIP(next)
+
+		if mapped {
+			continue
+		}
+
+		block = append(block, IP)
+		if len(block) == count {
+			return block, nil
+		}
+	}
+
+	return nil, types.ErrPoolEmpty
+}
+
+// ReserveExternalIPBlock allocates count consecutive external IPs to a
+// tenant from a pool without mapping them to an instance. The
+// reservations share a new block ID. Either every address is reserved,
+// or, with ErrPoolEmpty if the pool has no such block, none are. If lease
+// is not zero each reservation expires once the lease has passed, unless
+// its IP has been mapped by then.
+func (ds *Datastore) ReserveExternalIPBlock(poolID string, tenantID string, count int, lease time.Duration) ([]types.MappedIP, error) {
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
+
+	if ds.mappingLimitReached(count) {
+		return nil, types.ErrMappingLimitReached
+	}
+
+	pool, ok := ds.pools[poolID]
+	if !ok {
+		return nil, types.ErrPoolNotFound
+	}
+
+	if !pool.AvailableTo(tenantID) {
+		return nil, types.ErrForbidden
+	}
+
+	if pool.Drained {
+		return nil, types.ErrPoolDrained
+	}
+
+	if pool.Free < count {
+		return nil, types.ErrPoolEmpty
+	}
+
+	IPs, err := ds.findFreeBlock(pool, count)
+	if err != nil {
+		return nil, err
+	}
+
+	blockID := uuid.Generate().String()
+	block := make([]types.MappedIP, 0, count)
+	now := time.Now()
+
+	var expires *time.Time
+	if lease > 0 {
+		e := now.Add(lease)
+		expires = &e
+	}
+
+	for _, IP := range IPs {
+		m := types.MappedIP{
+			ID:            uuid.Generate().String(),
+			ExternalIP:    IP.Address,
+			TenantID:      tenantID,
+			PoolID:        pool.ID,
+			PoolName:      pool.Name,
+			Status:        types.MappedIPReserved,
+			ReservedSince: &now,
+			Created:       &now,
+			Expires:       expires,
+			BlockID:       blockID,
+		}
+		m = withSubnet(pool, m)
+
+		err = ds.db.addMappedIP(m)
+		if err != nil {
+			// nothing is reserved unless all of the block is.
+			for _, added := range block {
+				_ = ds.db.deleteMappedIP(added.ID)
+			}
+			return nil, errors.Wrap(err, "error adding IP mapping to database")
+		}
+
+		block = append(block, m)
+	}
+
+	pool.Free -= count
+	pool.Revision++
+
+	err = ds.db.updatePool(pool)
+	if err != nil {
+		for _, added := range block {
+			_ = ds.db.deleteMappedIP(added.ID)
+		}
+		return nil, errors.Wrap(err, "error updating pool in database")
+	}
+
+	ds.pools[poolID] = pool
+
+	for _, m := range block {
+		ds.mappedIPs[m.ExternalIP] = m
+		ds.mappedIPChanged(types.MappedIPCreated, m)
+	}
+
+	return block, nil
+}
+
+// ReleaseExternalIPBlock releases every reservation in a block of a
+// tenant's external IPs, returning the mappings released. Nothing is
+// released, and ErrAddressAttached is returned, if any address of the
+// block has since been mapped to an instance. An empty tenantID matches
+// the block of any tenant.
+func (ds *Datastore) ReleaseExternalIPBlock(tenantID string, blockID string) ([]types.MappedIP, error) {
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
+
+	var block []types.MappedIP
+
+	for _, m := range ds.mappedIPs {
+		if m.BlockID != blockID || (tenantID != "" && m.TenantID != tenantID) {
+			continue
+		}
+
+		if m.InstanceID != "" {
+			return nil, types.ErrAddressAttached
+		}
+
+		block = append(block, m)
+	}
+
+	if len(block) == 0 {
+		return nil, types.ErrAddressNotFound
+	}
+
+	for i, m := range block {
+		err := ds.unMapExternalIP(m)
+		if err != nil {
+			return block[:i], err
+		}
+	}
+
+	return block, nil
 }
 
-// AddExternalSubnet will add a new subnet to an existing pool.
-func (ds *Datastore) AddExternalSubnet(poolID string, subnet string) error {
-	sub := types.ExternalSubnet{
-		ID:   uuid.Generate().String(),
-		CIDR: subnet,
-	}
+// RemapExternalIP will map a reserved external IP to an instance, returning
+// ErrAddressAttached if it is already mapped to one. If instanceID is empty
+// the external IP goes back to being reserved for its tenant.
+func (ds *Datastore) RemapExternalIP(address string, instanceID string) (types.MappedIP, error) {
+	var instance *types.Instance
+	var err error
 
-	_, ipNet, err := net.ParseCIDR(subnet)
-	if err != nil {
-		return errors.Wrapf(err, "unable to parse subnet CIDR (%v)", subnet)
+	if instanceID != "" {
+		instance, err = ds.GetInstance(instanceID)
+		if err != nil {
+			return types.MappedIP{}, errors.Wrapf(err, "error getting instance (%v)", instanceID)
+		}
 	}
 
 	ds.poolsLock.Lock()
 	defer ds.poolsLock.Unlock()
 
-	p, ok := ds.pools[poolID]
+	m, ok := ds.mappedIPs[address]
 	if !ok {
-		return types.ErrPoolNotFound
+		return types.MappedIP{}, types.ErrAddressNotFound
 	}
 
-	if ds.isDuplicateSubnet(ipNet) {
-		return types.ErrDuplicateSubnet
-	}
+	if instance != nil {
+		// checked under the lock, so that concurrent remaps of one
+		// reservation cannot both attach it.
+		if m.InstanceID != "" {
+			return types.MappedIP{}, types.ErrAddressAttached
+		}
 
-	ones, bits := ipNet.Mask.Size()
+		m.Index, err = ds.nextMappingIndex(instance.ID, m.Role)
+		if err != nil {
+			return types.MappedIP{}, err
+		}
+		m.InstanceID = instance.ID
+		m.InternalIP = instance.IPAddress
+		m.Status = types.MappedIPAttached
+		m.ReservedSince = nil
 
-	// intentionally do not support /32 here, user should add by IP address instead
-	// deduct gateway and broadcast
-	newIPs := (1 << uint32(bits-ones)) - 2
-	if newIPs <= 0 {
-		return types.ErrSubnetTooSmall
+		// mapping the IP cancels any lease on its reservation.
+		m.Expires = nil
+	} else {
+		if m.Status != types.MappedIPReserved {
+			now := time.Now()
+			m.ReservedSince = &now
+		}
+		m.InstanceID = ""
+		m.InternalIP = ""
+		m.Status = types.MappedIPReserved
+		m.Index = 0
 	}
-	p.TotalIPs += newIPs
-	p.Free += newIPs
-	p.Subnets = append(p.Subnets, sub)
 
-	err = ds.db.updatePool(p)
+	err = ds.db.updateMappedIP(m)
 	if err != nil {
-		return errors.Wrap(err, "error updating pool in database")
+		return types.MappedIP{}, errors.Wrap(err, "error updating IP mapping in database")
 	}
+	ds.mappedIPs[address] = m
 
-	// we are committed now.
-	ds.pools[poolID] = p
-	ds.externalSubnets[sub.CIDR] = true
+	ds.mappedIPChanged(types.MappedIPChanged, m)
 
-	return nil
+	return m, nil
 }
 
-// AddExternalIPs will add a list of individual IPs to an existing pool.
-func (ds *Datastore) AddExternalIPs(poolID string, IPs []string) error {
+// SwapExternalIPs swaps the instances two external IPs of the same tenant
+// are mapped to. Both must be mapped to instances. Either both mappings
+// are changed or, if an error is returned, neither is.
+func (ds *Datastore) SwapExternalIPs(a string, b string) (types.MappedIP, types.MappedIP, error) {
 	ds.poolsLock.Lock()
 	defer ds.poolsLock.Unlock()
 
-	p, ok := ds.pools[poolID]
-	if !ok {
-		return types.ErrPoolNotFound
+	ma, okA := ds.mappedIPs[a]
+	mb, okB := ds.mappedIPs[b]
+	if !okA || !okB {
+		return types.MappedIP{}, types.MappedIP{}, types.ErrAddressNotFound
 	}
 
-	// sort to allow duplicate detection in IPs
-	sort.Strings(IPs)
-
-	// make sure valid and not duplicate
-	lastIP := ""
-	for _, newIP := range IPs {
-		if lastIP == newIP {
-			return types.ErrDuplicateIP
-		}
+	if a == b || ma.TenantID != mb.TenantID {
+		return types.MappedIP{}, types.MappedIP{}, types.ErrBadRequest
+	}
 
-		IP := net.ParseIP(newIP)
-		if IP == nil {
-			return types.ErrInvalidIP
-		}
+	if ma.InstanceID == "" || mb.InstanceID == "" {
+		return types.MappedIP{}, types.MappedIP{}, types.ErrAddressNotAttached
+	}
 
-		if ds.isDuplicateIP(IP) {
-			return types.ErrDuplicateIP
-		}
+	old := ma
 
-		ExtIP := types.ExternalIP{
-			ID:      uuid.Generate().String(),
-			Address: IP.String(),
-		}
+	ma.InstanceID, mb.InstanceID = mb.InstanceID, ma.InstanceID
+	ma.InternalIP, mb.InternalIP = mb.InternalIP, ma.InternalIP
+	ma.Index, mb.Index = mb.Index, ma.Index
 
-		p.TotalIPs++
-		p.Free++
-		p.IPs = append(p.IPs, ExtIP)
-		lastIP = newIP
+	err := ds.db.updateMappedIP(ma)
+	if err != nil {
+		return types.MappedIP{}, types.MappedIP{}, errors.Wrap(err, "error updating IP mapping in database")
 	}
 
-	// update persistent store.
-	err := ds.db.updatePool(p)
+	err = ds.db.updateMappedIP(mb)
 	if err != nil {
-		return errors.Wrap(err, "error updating pool in database")
+		_ = ds.db.updateMappedIP(old)
+		return types.MappedIP{}, types.MappedIP{}, errors.Wrap(err, "error updating IP mapping in database")
 	}
 
-	// update cache.
-	for _, IP := range p.IPs {
-		ds.externalIPs[IP.Address] = true
-	}
-	ds.pools[poolID] = p
+	ds.mappedIPs[a] = ma
+	ds.mappedIPs[b] = mb
 
-	return nil
+	ds.mappedIPChanged(types.MappedIPChanged, ma)
+	ds.mappedIPChanged(types.MappedIPChanged, mb)
+
+	return ma, mb, nil
 }
 
-// DeleteSubnet will remove an unused subnet from an existing pool.
-func (ds *Datastore) DeleteSubnet(poolID string, subnetID string) error {
+// MoveReservation moves the reservation of an external IP to a free
+// address of another pool, keeping its tenant, role, lease and labels.
+// The reservation's address changes, so IPs mapped to instances are not
+// moved, nor are reservations made as part of a block.
+func (ds *Datastore) MoveReservation(address string, poolID string) (types.MappedIP, error) {
 	ds.poolsLock.Lock()
 	defer ds.poolsLock.Unlock()
 
-	p, ok := ds.pools[poolID]
+	m, ok := ds.mappedIPs[address]
 	if !ok {
-		return types.ErrPoolNotFound
+		return types.MappedIP{}, types.ErrAddressNotFound
 	}
 
-	for i, sub := range p.Subnets {
-		if sub.ID != subnetID {
-			continue
-		}
-
-		// this path will be taken only once.
-		IP, ipNet, err := net.ParseCIDR(sub.CIDR)
-		if err != nil {
-			return errors.Wrapf(err, "unable to parse subnet CIDR (%v)", sub.CIDR)
-		}
-
-		// check each address in this subnet is not mapped.
-		for IP := IP.Mask(ipNet.Mask); ipNet.Contains(IP); incrementIP(IP) {
-			_, ok := ds.mappedIPs[IP.String()]
-			if ok {
-				return types.ErrPoolNotEmpty
-			}
-		}
+	if m.Status != types.MappedIPReserved {
+		return types.MappedIP{}, types.ErrAddressAttached
+	}
 
-		ones, bits := ipNet.Mask.Size()
-		numIPs := (1 << uint32(bits-ones)) - 2
-		p.TotalIPs -= numIPs
-		p.Free -= numIPs
-		p.Subnets = append(p.Subnets[:i], p.Subnets[i+1:]...)
+	if m.BlockID != "" || m.PoolID == poolID {
+		return types.MappedIP{}, types.ErrBadRequest
+	}
 
-		err = ds.db.updatePool(p)
-		if err != nil {
-			return errors.Wrap(err, "error updating pool in database")
-		}
+	moved := m
+	moved.SubnetID = ""
+	moved.SubnetCIDR = ""
 
-		delete(ds.externalSubnets, sub.CIDR)
-		ds.pools[poolID] = p
+	moved, err := ds.addMapping(poolID, moved)
+	if err != nil {
+		return types.MappedIP{}, err
+	}
 
-		return nil
+	err = ds.unMapExternalIP(m)
+	if err != nil {
+		_ = ds.unMapExternalIP(moved)
+		return types.MappedIP{}, err
 	}
 
-	return types.ErrInvalidPoolAddress
+	return moved, nil
 }
 
-// DeleteExternalIP will remove an individual IP address from a pool.
-func (ds *Datastore) DeleteExternalIP(poolID string, addrID string) error {
+// MigrateMappings moves every mapping of the pool fromID to free addresses
+// of the pool toID, keeping their tenant, instance, role, lease and labels.
+// The old mappings are returned with the new ones at the same index. The
+// addresses change, including those mapped to instances, and the new
+// mappings have new IDs. No mapping is moved unless the pool toID can hold
+// them all, and with dryRun none are moved at all: the new mappings have
+// the addresses they would be given but no IDs.
+func (ds *Datastore) MigrateMappings(fromID string, toID string, dryRun bool) ([]types.MappedIP, []types.MappedIP, error) {
 	ds.poolsLock.Lock()
 	defer ds.poolsLock.Unlock()
 
-	p, ok := ds.pools[poolID]
-	if !ok {
-		return types.ErrPoolNotFound
+	_, okFrom := ds.pools[fromID]
+	to, okTo := ds.pools[toID]
+	if !okFrom || !okTo {
+		return nil, nil, types.ErrPoolNotFound
 	}
 
-	for i, extIP := range p.IPs {
-		if extIP.ID != addrID {
+	if fromID == toID {
+		return nil, nil, types.ErrBadRequest
+	}
+
+	if to.Drained {
+		return nil, nil, types.ErrPoolDrained
+	}
+
+	old := []types.MappedIP{}
+	for _, m := range ds.mappedIPs {
+		if m.PoolID != fromID {
 			continue
 		}
 
-		// this path will be taken only once.
-		// check address is not mapped.
-		_, ok := ds.mappedIPs[extIP.Address]
-		if ok {
-			return types.ErrPoolNotEmpty
+		if !to.AvailableTo(m.TenantID) {
+			return nil, nil, types.ErrForbidden
 		}
 
-		p.TotalIPs--
-		p.Free--
-		p.IPs = append(p.IPs[:i], p.IPs[i+1:]...)
+		old = append(old, m)
+	}
 
-		err := ds.db.updatePool(p)
-		if err != nil {
-			return errors.Wrap(err, "error updating pool in database")
-		}
+	sort.Slice(old, func(i, j int) bool {
+		return old[i].ExternalIP < old[j].ExternalIP
+	})
 
-		delete(ds.externalIPs, extIP.Address)
-		ds.pools[poolID] = p
+	exhausted := types.PoolExhaustedError{PoolID: to.ID, PoolName: to.Name}
+	if len(old) > to.Free {
+		return nil, nil, exhausted
+	}
 
-		return nil
+	// the addresses are all found first, so that nothing is moved
+	// unless every mapping can be.
+	taken := make(map[string]bool, len(old))
+	IPs := make([]types.ExternalIP, len(old))
+	subnetIDs := make([]string, len(old))
+	for i := range old {
+		IP, subnetID, err := ds.findFreeAddressExcept(to, taken)
+		if err == types.ErrPoolEmpty {
+			return nil, nil, exhausted
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		taken[IP.Address] = true
+		IPs[i] = IP
+		subnetIDs[i] = subnetID
 	}
 
-	return types.ErrInvalidPoolAddress
-}
+	moved := make([]types.MappedIP, 0, len(old))
 
-func incrementIP(IP net.IP) {
-	for i := len(IP) - 1; i >= 0; i-- {
-		IP[i]++
-		if IP[i] > 0 {
-			break
+	if dryRun {
+		for i, m := range old {
+			m.ID = ""
+			m.ExternalIP = IPs[i].Address
+			m.PoolID = to.ID
+			m.PoolName = to.Name
+			m.SubnetID = subnetIDs[i]
+			m.SubnetCIDR = ""
+			moved = append(moved, withSubnet(to, m))
 		}
+
+		return old, moved, nil
 	}
-}
 
-// GetMappedIPs will return a list of mapped external IPs by tenant.
-func (ds *Datastore) GetMappedIPs(tenant *string) []types.MappedIP {
-	var mappedIPs []types.MappedIP
+	for i, m := range old {
+		m.SubnetID = ""
+		m.SubnetCIDR = ""
 
-	ds.poolsLock.RLock()
-	defer ds.poolsLock.RUnlock()
+		n, err := ds.recordMapping(ds.pools[toID], m, IPs[i], subnetIDs[i])
+		if err != nil {
+			for _, n := range moved {
+				_ = ds.unMapExternalIP(n)
+			}
+			return nil, nil, err
+		}
 
-	for _, m := range ds.mappedIPs {
-		if tenant != nil {
-			if m.TenantID != *tenant {
-				continue
+		moved = append(moved, n)
+	}
+
+	for i, m := range old {
+		err := ds.unMapExternalIP(m)
+		if err != nil {
+			// the mappings removed so far stay moved, but no
+			// mapping is left in both pools.
+			for _, n := range moved[i:] {
+				_ = ds.unMapExternalIP(n)
 			}
+			return nil, nil, err
 		}
-		mappedIPs = append(mappedIPs, m)
 	}
 
-	return mappedIPs
+	return old, moved, nil
 }
 
-// GetMappedIP will return a MappedIP struct for the given address.
-func (ds *Datastore) GetMappedIP(address string) (types.MappedIP, error) {
-	ds.poolsLock.RLock()
-	defer ds.poolsLock.RUnlock()
+// SetMappedIPLabels replaces the labels of the mapping of an external IP.
+// An empty map removes them.
+func (ds *Datastore) SetMappedIPLabels(address string, labels map[string]string) (types.MappedIP, error) {
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
 
 	m, ok := ds.mappedIPs[address]
 	if !ok {
 		return types.MappedIP{}, types.ErrAddressNotFound
 	}
 
-	return m, nil
-}
-
-// MapExternalIP will allocate an external IP to an instance from a given pool.
-func (ds *Datastore) MapExternalIP(poolID string, instanceID string) (types.MappedIP, error) {
-	var m types.MappedIP
+	// the old map may still be held by callers which listed the
+	// mapping, so it is replaced rather than changed.
+	m.Labels = nil
+	if len(labels) > 0 {
+		m.Labels = make(map[string]string, len(labels))
+		for k, v := range labels {
+			m.Labels[k] = v
+		}
+	}
 
-	instance, err := ds.GetInstance(instanceID)
+	err := ds.db.updateMappedIP(m)
 	if err != nil {
-		return m, errors.Wrapf(err, "error getting instance (%v)", instanceID)
+		return types.MappedIP{}, errors.Wrap(err, "error updating IP mapping in database")
 	}
+	ds.mappedIPs[address] = m
 
-	ds.poolsLock.Lock()
-	defer ds.poolsLock.Unlock()
-
-	pool, ok := ds.pools[poolID]
-	if !ok {
-		return m, types.ErrPoolNotFound
-	}
+	ds.mappedIPChanged(types.MappedIPChanged, m)
 
-	if pool.Free == 0 {
-		return m, types.ErrPoolEmpty
-	}
+	return m, nil
+}
 
-	// find a free IP address in any subnet.
-	for _, sub := range pool.Subnets {
-		IP, ipNet, err := net.ParseCIDR(sub.CIDR)
-		if err != nil {
-			return m, errors.Wrapf(err, "error parsing subnet CIDR (%v)", sub.CIDR)
-		}
+// GetExpiredReservations returns the reserved external IPs whose lease
+// ran out before now.
+func (ds *Datastore) GetExpiredReservations(now time.Time) []types.MappedIP {
+	var expired []types.MappedIP
 
-		initIP := IP.Mask(ipNet.Mask)
+	ds.poolsLock.RLock()
+	defer ds.poolsLock.RUnlock()
 
-		// skip gateway
-		incrementIP(initIP)
+	for _, m := range ds.mappedIPs {
+		if m.InstanceID == "" && m.Expires != nil && m.Expires.Before(now) {
+			expired = append(expired, m)
+		}
+	}
 
-		// check each address in this subnet
-		for IP := initIP; ipNet.Contains(IP); incrementIP(IP) {
-			_, ok := ds.mappedIPs[IP.String()]
-			if !ok {
-				m.ID = uuid.Generate().String()
-				m.ExternalIP = IP.String()
-				m.InternalIP = instance.IPAddress
-				m.InstanceID = instanceID
-				m.TenantID = instance.TenantID
-				m.PoolID = pool.ID
-				m.PoolName = pool.Name
-
-				pool.Free--
-
-				err = ds.db.addMappedIP(m)
-				if err != nil {
-					return types.MappedIP{}, errors.Wrap(err, "error adding IP mapping to database")
-				}
-				ds.mappedIPs[IP.String()] = m
+	sort.Sort(types.SortedMappedIPsByID(expired))
 
-				err = ds.db.updatePool(pool)
-				if err != nil {
-					return types.MappedIP{}, errors.Wrap(err, "error updating pool in database")
-				}
+	return expired
+}
 
-				ds.pools[poolID] = pool
+// ReleaseExpiredReservation releases a reserved external IP if its lease
+// ran out before now. It returns false, and leaves the IP alone, if the IP
+// has since been mapped to an instance or has no expired lease.
+func (ds *Datastore) ReleaseExpiredReservation(address string, now time.Time) (bool, error) {
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
 
-				return m, nil
-			}
-		}
+	m, ok := ds.mappedIPs[address]
+	if !ok {
+		return false, types.ErrAddressNotFound
 	}
 
-	// we are still looking. Check our individual IPs
-	for _, IP := range pool.IPs {
-		_, ok := ds.mappedIPs[IP.Address]
-		if !ok {
-			m.ID = uuid.Generate().String()
-			m.ExternalIP = IP.Address
-			m.InternalIP = instance.IPAddress
-			m.InstanceID = instanceID
-			m.TenantID = instance.TenantID
-			m.PoolID = pool.ID
-			m.PoolName = pool.Name
-
-			pool.Free--
+	if m.InstanceID != "" || m.Expires == nil || !m.Expires.Before(now) {
+		return false, nil
+	}
 
-			err = ds.db.addMappedIP(m)
-			if err != nil {
-				return types.MappedIP{}, errors.Wrap(err, "error adding IP mapping to database")
-			}
-			ds.mappedIPs[IP.Address] = m
+	return true, ds.unMapExternalIP(m)
+}
 
-			err = ds.db.updatePool(pool)
-			if err != nil {
-				return types.MappedIP{}, errors.Wrap(err, "error updating pool in database")
-			}
+// ReleaseStaleReservation releases a reserved external IP which has been
+// without an instance since before cutoff. It returns false, and leaves
+// the IP alone, if the IP has since been mapped to an instance or was
+// reserved again after cutoff.
+func (ds *Datastore) ReleaseStaleReservation(address string, cutoff time.Time) (bool, error) {
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
 
-			ds.pools[poolID] = pool
+	m, ok := ds.mappedIPs[address]
+	if !ok {
+		return false, nil
+	}
 
-			return m, nil
-		}
+	if m.InstanceID != "" || m.ReservedSince == nil || m.ReservedSince.After(cutoff) {
+		return false, nil
 	}
 
-	// if you got here you are out of luck. But you never should.
-	glog.Warningf("Pool reports %d free addresses but none found", pool.Free)
-	return m, types.ErrPoolEmpty
+	return true, ds.unMapExternalIP(m)
 }
 
 // UnMapExternalIP will stop associating a given address with an instance.
@@ -2306,6 +4443,14 @@ func (ds *Datastore) UnMapExternalIP(address string) error {
 		return types.ErrAddressNotFound
 	}
 
+	return ds.unMapExternalIP(m)
+}
+
+// unMapExternalIP removes the mapping m, returning its address to the pool.
+// lock for the map must be held by the caller.
+func (ds *Datastore) unMapExternalIP(m types.MappedIP) error {
+	address := m.ExternalIP
+
 	// get pool and update Free
 	pool, ok := ds.pools[m.PoolID]
 	if !ok {
@@ -2313,6 +4458,7 @@ func (ds *Datastore) UnMapExternalIP(address string) error {
 	}
 
 	pool.Free++
+	pool.Revision++
 
 	err := ds.db.deleteMappedIP(m.ID)
 	if err != nil {
@@ -2327,6 +4473,8 @@ func (ds *Datastore) UnMapExternalIP(address string) error {
 
 	ds.pools[pool.ID] = pool
 
+	ds.mappedIPChanged(types.MappedIPDeleted, m)
+
 	return nil
 }
 
@@ -2397,6 +4545,23 @@ func (ds *Datastore) UpdateQuotas(tenantID string, qds []types.QuotaDetails) err
 	return ds.db.updateQuotas(tenantID, qds)
 }
 
+// DeleteQuotas removes all the quotas set for a tenant from the database,
+// leaving it with the defaults.
+func (ds *Datastore) DeleteQuotas(tenantID string) error {
+	return ds.db.deleteQuotas(tenantID)
+}
+
+// GetSubQuotas returns the sub-quotas of a tenant from the database, keyed
+// by the name of the sub-quota.
+func (ds *Datastore) GetSubQuotas(tenantID string) (map[string][]types.QuotaDetails, error) {
+	return ds.db.getSubQuotas(tenantID)
+}
+
+// UpdateSubQuotas updates a sub-quota of a tenant in the database.
+func (ds *Datastore) UpdateSubQuotas(tenantID string, sub string, qds []types.QuotaDetails) error {
+	return ds.db.updateSubQuotas(tenantID, sub, qds)
+}
+
 // ResolveInstance maps an instance name to an uuid, returning "" if not found
 // TODO: Replace this O(n) algorithm with another name to id map.
 func (ds *Datastore) ResolveInstance(tenantID string, name string) (string, error) {
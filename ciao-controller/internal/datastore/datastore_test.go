@@ -24,6 +24,7 @@ import (
 	"net"
 	"os"
 	"reflect"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -2078,6 +2079,9 @@ func TestGetPool(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	// new pools start at revision 1.
+	orig.Revision = 1
+
 	if reflect.DeepEqual(orig, pool) == false {
 		t.Fatalf("expected %v, got %v\n", orig, pool)
 	}
@@ -2147,6 +2151,285 @@ func TestAddExternalSubnet(t *testing.T) {
 	}
 }
 
+func TestGetPoolContaining(t *testing.T) {
+	pool := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "containing",
+	}
+
+	err := ds.AddPool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.DeletePool(pool.ID)
+
+	err = ds.AddExternalSubnet(pool.ID, "203.0.113.32/29")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.AddExternalIPs(pool.ID, []string{"203.0.113.100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, address := range []string{"203.0.113.33", "203.0.113.100"} {
+		p, err := ds.GetPoolContaining(net.ParseIP(address))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if p.ID != pool.ID {
+			t.Fatalf("expected pool %s for %s, got %s", pool.ID, address, p.ID)
+		}
+	}
+
+	_, err = ds.GetPoolContaining(net.ParseIP("203.0.113.101"))
+	if err != types.ErrPoolNotFound {
+		t.Fatalf("expected %v, got %v", types.ErrPoolNotFound, err)
+	}
+}
+
+func TestGetPoolCapacity(t *testing.T) {
+	before := ds.GetPoolCapacity()
+
+	pool := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "capacity",
+	}
+
+	err := ds.AddPool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.DeletePool(pool.ID)
+
+	err = ds.AddExternalSubnet(pool.ID, "203.0.113.16/29")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.AddExternalIPs(pool.ID, []string{"2001:db8::1", "2001:db8::2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := ds.ReserveExternalIP(pool.ID, uuid.Generate().String(), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(v4 types.AddressCapacity, v6 types.AddressCapacity) {
+		t.Helper()
+
+		expected := before
+		expected.IPv4.Free += v4.Free
+		expected.IPv4.Total += v4.Total
+		expected.IPv6.Free += v6.Free
+		expected.IPv6.Total += v6.Total
+
+		capacity := ds.GetPoolCapacity()
+		if capacity != expected {
+			t.Fatalf("expected capacity %+v, got %+v", expected, capacity)
+		}
+	}
+
+	// the subnet has 6 usable addresses, one now reserved.
+	check(types.AddressCapacity{Free: 5, Total: 6}, types.AddressCapacity{Free: 2, Total: 2})
+
+	p, err := ds.GetPool(pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.DrainSubnet(pool.ID, p.Subnets[0].ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(types.AddressCapacity{Free: 0, Total: 6}, types.AddressCapacity{Free: 2, Total: 2})
+
+	err = ds.DrainPool(pool.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(types.AddressCapacity{Free: 0, Total: 6}, types.AddressCapacity{Free: 0, Total: 2})
+
+	err = ds.UnMapExternalIP(m.ExternalIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolRevision(t *testing.T) {
+	pool := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "revised",
+	}
+
+	err := ds.AddPool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.DeletePool(pool.ID)
+
+	revision := func() int {
+		p, err := ds.GetPool(pool.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p.Revision
+	}
+
+	if revision() != 1 {
+		t.Fatalf("expected revision 1, got %d", revision())
+	}
+
+	err = ds.UpdatePoolTags(pool.ID, []string{"dmz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.AddExternalIPs(pool.ID, []string{"198.51.100.20"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if revision() != 3 {
+		t.Fatalf("expected revision 3, got %d", revision())
+	}
+
+	m, err := ds.ReserveExternalIP(pool.ID, uuid.Generate().String(), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if revision() != 4 {
+		t.Fatalf("expected revision 4 after mapping, got %d", revision())
+	}
+
+	err = ds.UnMapExternalIP(m.ExternalIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if revision() != 5 {
+		t.Fatalf("expected revision 5 after unmapping, got %d", revision())
+	}
+
+	// a failed update leaves the revision alone.
+	err = ds.UpdatePoolTags(uuid.Generate().String(), nil)
+	if err != types.ErrPoolNotFound {
+		t.Fatalf("expected %v, got %v", types.ErrPoolNotFound, err)
+	}
+
+	if revision() != 5 {
+		t.Fatalf("expected revision 5, got %d", revision())
+	}
+}
+
+func TestUpdatePoolIPs(t *testing.T) {
+	pool := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "patched",
+	}
+
+	err := ds.AddPool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.AddExternalIPs(pool.ID, []string{"198.51.100.1", "198.51.100.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := ds.ReserveExternalIP(pool.ID, uuid.Generate().String(), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addresses := func() []string {
+		p, err := ds.GetPool(pool.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var IPs []string
+		for _, IP := range p.IPs {
+			IPs = append(IPs, IP.Address)
+		}
+		sort.Strings(IPs)
+		return IPs
+	}
+
+	tests := []struct {
+		add    []string
+		remove []string
+		err    error
+	}{
+		{[]string{"198.51.100.3"}, []string{m.ExternalIP}, types.ErrAddressInUse},
+		{[]string{"198.51.100.3"}, []string{"198.51.100.9"}, types.ErrInvalidPoolAddress},
+		{[]string{"198.51.100.3", "198.51.100.3"}, nil, types.ErrDuplicateIP},
+		{[]string{"not-an-ip"}, nil, types.ErrInvalidIP},
+	}
+
+	for _, tt := range tests {
+		_, err := ds.UpdatePoolIPs(pool.ID, tt.add, tt.remove, false)
+		if err != tt.err {
+			t.Fatalf("add %v remove %v: expected %v, got %v", tt.add, tt.remove, tt.err, err)
+		}
+
+		if !reflect.DeepEqual(addresses(), []string{"198.51.100.1", "198.51.100.2"}) {
+			t.Fatalf("failed update changed the pool: %v", addresses())
+		}
+	}
+
+	free := m.ExternalIP
+	if free == "198.51.100.1" {
+		free = "198.51.100.2"
+	} else {
+		free = "198.51.100.1"
+	}
+
+	unmapped, err := ds.UpdatePoolIPs(pool.ID, []string{"198.51.100.3"}, []string{free}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(unmapped) != 0 {
+		t.Fatalf("expected no mappings to be removed, got %v", unmapped)
+	}
+
+	unmapped, err = ds.UpdatePoolIPs(pool.ID, nil, []string{m.ExternalIP}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(unmapped) != 1 || unmapped[0].ID != m.ID {
+		t.Fatalf("expected mapping %s to be removed, got %v", m.ID, unmapped)
+	}
+
+	if !reflect.DeepEqual(addresses(), []string{"198.51.100.3"}) {
+		t.Fatalf("unexpected addresses %v", addresses())
+	}
+
+	p, err := ds.GetPool(pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.TotalIPs != 1 || p.Free != 1 {
+		t.Fatalf("expected 1 free address of 1, got %d of %d", p.Free, p.TotalIPs)
+	}
+
+	err = ds.DeletePool(pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestAddExternalIPs(t *testing.T) {
 	orig := types.Pool{
 		ID:   uuid.Generate().String(),
@@ -2264,7 +2547,7 @@ func TestDeleteExternalSubnet(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	m, err := ds.MapExternalIP(pool.ID, instance.ID)
+	m, err := ds.MapExternalIP(pool.ID, instance.ID, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -2343,7 +2626,7 @@ func TestDeleteExternalIPs(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	m, err := ds.MapExternalIP(pool.ID, instance.ID)
+	m, err := ds.MapExternalIP(pool.ID, instance.ID, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -2410,13 +2693,13 @@ func TestMapIPs(t *testing.T) {
 	}
 
 	// try to map to an invalid instance.
-	_, err = ds.MapExternalIP(pool.ID, uuid.Generate().String())
+	_, err = ds.MapExternalIP(pool.ID, uuid.Generate().String(), "")
 	if err == nil {
 		t.Fatal("map to invalid instance allowed")
 	}
 
 	// try to map to an invalid pool
-	_, err = ds.MapExternalIP(uuid.Generate().String(), instance.ID)
+	_, err = ds.MapExternalIP(uuid.Generate().String(), instance.ID, "")
 	if err != types.ErrPoolNotFound {
 		t.Fatal("map to invalid pool allowed")
 	}
@@ -2427,7 +2710,7 @@ func TestMapIPs(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err = ds.MapExternalIP(pool.ID, instance.ID)
+	_, err = ds.MapExternalIP(pool.ID, instance.ID, "")
 	if err != types.ErrPoolEmpty {
 		t.Fatal(err)
 	}
@@ -2438,7 +2721,7 @@ func TestMapIPs(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	m, err := ds.MapExternalIP(pool.ID, instance.ID)
+	m, err := ds.MapExternalIP(pool.ID, instance.ID, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -2456,117 +2739,829 @@ func TestMapIPs(t *testing.T) {
 	}
 }
 
-func TestGetMappedIPs(t *testing.T) {
-	orig := types.Pool{
+func TestReserveExternalIPBlockLease(t *testing.T) {
+	pool := types.Pool{
 		ID:   uuid.Generate().String(),
-		Name: "test",
+		Name: "leasedblock",
 	}
 
-	err := ds.AddPool(orig)
+	err := ds.AddPool(pool)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer ds.DeletePool(pool.ID)
 
-	IPs := []string{"192.168.0.1"}
-	err = ds.AddExternalIPs(orig.ID, IPs)
+	err = ds.AddExternalIPs(pool.ID, []string{"203.0.113.210", "203.0.113.211"})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	pool, err := ds.GetPool(orig.ID)
+	tenantID := uuid.Generate().String()
+
+	block, err := ds.ReserveExternalIPBlock(pool.ID, tenantID, 2, time.Minute)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// prepare for map
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
+	for _, m := range block {
+		if m.Expires == nil {
+			t.Fatalf("expected reservation of %s to expire", m.ExternalIP)
+		}
 	}
 
-	wls, err := ds.GetWorkloads(tenant.ID)
+	expired := ds.GetExpiredReservations(time.Now().Add(2 * time.Minute))
+	count := 0
+	for _, m := range expired {
+		if m.BlockID == block[0].BlockID {
+			count++
+		}
+	}
+
+	if count != 2 {
+		t.Fatalf("expected 2 expired reservations, got %d", count)
+	}
+
+	// any tenant's block may be released when no tenant is given.
+	released, err := ds.ReleaseExternalIPBlock("", block[0].BlockID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	instance, err := addTestInstance(tenant, wls[0])
+	if len(released) != 2 {
+		t.Fatalf("expected 2 addresses released, got %d", len(released))
+	}
+}
+
+func TestReserveExternalIPBlock(t *testing.T) {
+	pool := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "block",
+	}
+
+	err := ds.AddPool(pool)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer ds.DeletePool(pool.ID)
 
-	m, err := ds.MapExternalIP(pool.ID, instance.ID)
+	// added out of order, with a gap after .2
+	err = ds.AddExternalIPs(pool.ID, []string{"203.0.113.5", "203.0.113.1", "203.0.113.4", "203.0.113.2", "203.0.113.6"})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// get mapped ips with tenant
-	ips := ds.GetMappedIPs(&instance.TenantID)
-	if len(ips) != 1 {
-		t.Fatal("GetMappedIPs failed")
-	}
+	tenantID := uuid.Generate().String()
 
-	// get without tenant.
-	ips = ds.GetMappedIPs(nil)
-	if len(ips) != 1 {
-		t.Fatal("GetMappedIPs failed")
+	addresses := func(block []types.MappedIP) []string {
+		var IPs []string
+		for _, m := range block {
+			IPs = append(IPs, m.ExternalIP)
+		}
+		return IPs
 	}
 
-	// get specific mapped IP
-	_, err = ds.GetMappedIP(m.ExternalIP)
+	block, err := ds.ReserveExternalIPBlock(pool.ID, tenantID, 3, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// get invalid mapped IP
-	_, err = ds.GetMappedIP("192.168.0.2")
-	if err != types.ErrAddressNotFound {
-		t.Fatal("found invalid address")
+	expected := []string{"203.0.113.4", "203.0.113.5", "203.0.113.6"}
+	if !reflect.DeepEqual(addresses(block), expected) {
+		t.Fatalf("expected block %v, got %v", expected, addresses(block))
 	}
 
-	// unmap
-	err = ds.UnMapExternalIP(m.ExternalIP)
-	if err != nil {
-		t.Fatal(err)
+	for _, m := range block {
+		if m.BlockID == "" || m.BlockID != block[0].BlockID || m.Status != types.MappedIPReserved {
+			t.Fatalf("unexpected mapping in block: %+v", m)
+		}
 	}
 
-	// cleanup.
-	err = ds.DeletePool(pool.ID)
-	if err != nil {
-		t.Fatal(err)
+	// the two addresses left are too few, and none are taken.
+	_, err = ds.ReserveExternalIPBlock(pool.ID, tenantID, 3, 0)
+	if err != types.ErrPoolEmpty {
+		t.Fatalf("expected %v, got %v", types.ErrPoolEmpty, err)
 	}
-}
 
-func TestDeleteWorkload(t *testing.T) {
-	tenant, err := addTestTenant()
+	p, err := ds.GetPool(pool.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	wls, err := ds.GetWorkloads(tenant.ID)
-	if err != nil {
-		t.Fatal(err)
+	if p.Free != 2 {
+		t.Fatalf("expected 2 free addresses, got %d", p.Free)
 	}
 
-	instance, err := addTestInstance(tenant, wls[0])
+	_, err = ds.ReleaseExternalIPBlock(uuid.Generate().String(), block[0].BlockID)
+	if err != types.ErrAddressNotFound {
+		t.Fatalf("expected %v releasing another tenant's block, got %v", types.ErrAddressNotFound, err)
+	}
+
+	released, err := ds.ReleaseExternalIPBlock(tenantID, block[0].BlockID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// attempt to delete this workload, should fail.
-	err = ds.DeleteWorkload(tenant.ID, wls[0].ID)
-	if err != types.ErrWorkloadInUse {
-		t.Fatal("Deleting an in use workload did not fail")
+	if len(released) != 3 {
+		t.Fatalf("expected 3 addresses released, got %d", len(released))
 	}
 
-	err = ds.DeleteInstance(instance.ID)
+	p, err = ds.GetPool(pool.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// attempt to delete this workload, should pass
-	err = ds.DeleteWorkload(tenant.ID, wls[0].ID)
-	if err != nil {
-		t.Fatal(err)
+	if p.Free != 5 {
+		t.Fatalf("expected 5 free addresses, got %d", p.Free)
+	}
+
+	_, err = ds.ReleaseExternalIPBlock(tenantID, block[0].BlockID)
+	if err != types.ErrAddressNotFound {
+		t.Fatalf("expected %v, got %v", types.ErrAddressNotFound, err)
+	}
+}
+
+func TestPoolAndMappingLimits(t *testing.T) {
+	defer func() {
+		ds.maxPools = 0
+		ds.maxMappings = 0
+	}()
+
+	pool := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "limits",
+	}
+
+	ds.maxPools = len(ds.pools) + 1
+
+	err := ds.AddPool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.DeletePool(pool.ID)
+
+	err = ds.AddPool(types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "overlimit",
+	})
+	if err != types.ErrPoolLimitReached {
+		t.Fatalf("expected %v, got %v", types.ErrPoolLimitReached, err)
+	}
+
+	err = ds.AddExternalSubnet(pool.ID, "203.0.113.64/29")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenantID := uuid.Generate().String()
+
+	ds.maxMappings = len(ds.mappedIPs) + 2
+
+	m, err := ds.ReserveExternalIP(pool.ID, tenantID, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.UnMapExternalIP(m.ExternalIP)
+
+	// a block is refused unless all of it fits.
+	_, err = ds.ReserveExternalIPBlock(pool.ID, tenantID, 2, 0)
+	if err != types.ErrMappingLimitReached {
+		t.Fatalf("expected %v, got %v", types.ErrMappingLimitReached, err)
+	}
+
+	m, err = ds.ReserveExternalIP(pool.ID, tenantID, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.UnMapExternalIP(m.ExternalIP)
+
+	_, err = ds.ReserveExternalIP(pool.ID, tenantID, "", 0)
+	if err != types.ErrMappingLimitReached {
+		t.Fatalf("expected %v, got %v", types.ErrMappingLimitReached, err)
+	}
+
+	// no limit is the default.
+	ds.maxMappings = 0
+
+	m, err = ds.ReserveExternalIP(pool.ID, tenantID, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.UnMapExternalIP(m.ExternalIP)
+}
+
+func TestPoolAllowedNets(t *testing.T) {
+	_, allowed, _ := net.ParseCIDR("198.18.0.0/24")
+	ds.allowedNets = []*net.IPNet{allowed}
+	defer func() {
+		ds.allowedNets = nil
+	}()
+
+	pool := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "allowednets",
+	}
+
+	err := ds.AddPool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.DeletePool(pool.ID)
+
+	for _, subnet := range []string{"198.18.1.0/29", "198.18.0.0/23"} {
+		err = ds.AddExternalSubnet(pool.ID, subnet)
+		if _, ok := err.(types.AddressNotAllowedError); !ok {
+			t.Fatalf("expected subnet %s to be refused, got %v", subnet, err)
+		}
+	}
+
+	err = ds.AddExternalIPs(pool.ID, []string{"198.18.0.200", "198.18.1.1"})
+	if _, ok := err.(types.AddressNotAllowedError); !ok {
+		t.Fatalf("expected address to be refused, got %v", err)
+	}
+
+	err = ds.CheckPoolAddresses(nil, []string{"198.18.1.1"})
+	if _, ok := err.(types.AddressNotAllowedError); !ok {
+		t.Fatalf("expected address to be refused, got %v", err)
+	}
+
+	err = ds.AddExternalSubnet(pool.ID, "198.18.0.8/29")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.AddExternalIPs(pool.ID, []string{"198.18.0.200"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMappedIPSubnet(t *testing.T) {
+	pool := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "subnets",
+	}
+
+	err := ds.AddPool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.DeletePool(pool.ID)
+
+	err = ds.AddExternalSubnet(pool.ID, "203.0.113.80/29")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	individual := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "individual",
+	}
+
+	err = ds.AddPool(individual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.DeletePool(individual.ID)
+
+	err = ds.AddExternalIPs(individual.ID, []string{"203.0.113.101"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := ds.GetPool(pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subnet := p.Subnets[0]
+
+	tenantID := uuid.Generate().String()
+
+	m, err := ds.ReserveExternalIP(pool.ID, tenantID, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.UnMapExternalIP(m.ExternalIP)
+
+	if m.SubnetID != subnet.ID || m.SubnetCIDR != subnet.CIDR {
+		t.Fatalf("expected subnet %s (%s), got %s (%s)", subnet.ID, subnet.CIDR, m.SubnetID, m.SubnetCIDR)
+	}
+
+	IP, err := ds.ReserveExternalIP(individual.ID, tenantID, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.UnMapExternalIP(IP.ExternalIP)
+
+	if IP.SubnetID != "" || IP.SubnetCIDR != "" {
+		t.Fatalf("expected no subnet for %s, got %s (%s)", IP.ExternalIP, IP.SubnetID, IP.SubnetCIDR)
+	}
+
+	// mappings made before subnets were recorded have them found from
+	// their address.
+	legacy := m
+	legacy.SubnetID = ""
+	legacy.SubnetCIDR = ""
+
+	legacy = withSubnet(p, legacy)
+	if legacy.SubnetID != subnet.ID || legacy.SubnetCIDR != subnet.CIDR {
+		t.Fatalf("expected subnet %s (%s), got %s (%s)", subnet.ID, subnet.CIDR, legacy.SubnetID, legacy.SubnetCIDR)
+	}
+}
+
+func TestGetMappedIPs(t *testing.T) {
+	orig := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "test",
+	}
+
+	err := ds.AddPool(orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	IPs := []string{"192.168.0.1"}
+	err = ds.AddExternalIPs(orig.ID, IPs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err := ds.GetPool(orig.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// prepare for map
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := ds.GetWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instance, err := addTestInstance(tenant, wls[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := ds.MapExternalIP(pool.ID, instance.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// get mapped ips with tenant
+	ips := ds.GetMappedIPs(&instance.TenantID)
+	if len(ips) != 1 {
+		t.Fatal("GetMappedIPs failed")
+	}
+
+	// get without tenant.
+	ips = ds.GetMappedIPs(nil)
+	if len(ips) != 1 {
+		t.Fatal("GetMappedIPs failed")
+	}
+
+	// get specific mapped IP
+	_, err = ds.GetMappedIP(m.ExternalIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// get invalid mapped IP
+	_, err = ds.GetMappedIP("192.168.0.2")
+	if err != types.ErrAddressNotFound {
+		t.Fatal("found invalid address")
+	}
+
+	// unmap
+	err = ds.UnMapExternalIP(m.ExternalIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cleanup.
+	err = ds.DeletePool(pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInstanceMappingLimit(t *testing.T) {
+	ds.maxInstanceMaps = 1
+	defer func() {
+		ds.maxInstanceMaps = 0
+	}()
+
+	pool := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "instancelimit",
+	}
+
+	err := ds.AddPool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.AddExternalIPs(pool.ID, []string{"192.168.7.1", "192.168.7.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := ds.GetWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instance, err := addTestInstance(tenant, wls[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := ds.MapExternalIP(pool.ID, instance.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := types.InstanceMappingLimitError{
+		InstanceID: instance.ID,
+		Mappings:   1,
+		Limit:      1,
+	}
+
+	_, err = ds.MapExternalIP(pool.ID, instance.ID, "")
+	if err != expected {
+		t.Fatalf("expected %v, got %v", expected, err)
+	}
+
+	// nor may a reservation be mapped to it.
+	reserved, err := ds.ReserveExternalIP(pool.ID, tenant.ID, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ds.RemapExternalIP(reserved.ExternalIP, instance.ID)
+	if err != expected {
+		t.Fatalf("expected %v, got %v", expected, err)
+	}
+
+	for _, m := range []types.MappedIP{first, reserved} {
+		err = ds.UnMapExternalIP(m.ExternalIP)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = ds.DeletePool(pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddressHistory(t *testing.T) {
+	pool := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "history",
+	}
+
+	err := ds.AddPool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.AddExternalIPs(pool.ID, []string{"192.168.8.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := ds.GetWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instance, err := addTestInstance(tenant, wls[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := ds.ReserveExternalIP(pool.ID, tenant.ID, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ds.RemapExternalIP(m.ExternalIP, instance.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an attached mapping cannot be attached again.
+	_, err = ds.RemapExternalIP(m.ExternalIP, instance.ID)
+	if err != types.ErrAddressAttached {
+		t.Fatalf("expected %v, got %v", types.ErrAddressAttached, err)
+	}
+
+	// labelling the mapping does not reassign it.
+	_, err = ds.SetMappedIPLabels(m.ExternalIP, map[string]string{"team": "red"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.UnMapExternalIP(m.ExternalIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := ds.AddressHistory(m.ExternalIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actions := []string{types.AssignmentReserved, types.AssignmentMapped, types.AssignmentReleased}
+	if len(history) != len(actions) {
+		t.Fatalf("expected %d records, got %+v", len(actions), history)
+	}
+
+	for i, r := range history {
+		if r.Action != actions[i] || r.MappingID != m.ID || r.TenantID != tenant.ID || r.Timestamp.IsZero() {
+			t.Errorf("unexpected record %d: %+v", i, r)
+		}
+	}
+
+	if history[1].InstanceID != instance.ID || history[1].InternalIP != instance.IPAddress {
+		t.Errorf("expected mapping to instance %s, got %+v", instance.ID, history[1])
+	}
+
+	err = ds.DeletePool(pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMapMultipleExternalIPs(t *testing.T) {
+	orig := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "test",
+	}
+
+	err := ds.AddPool(orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	IPs := []string{"192.168.0.1", "192.168.0.2", "192.168.0.3"}
+	err = ds.AddExternalIPs(orig.ID, IPs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := ds.GetWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instance, err := addTestInstance(tenant, wls[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := ds.MapExternalIP(orig.ID, instance.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := ds.MapExternalIP(orig.ID, instance.ID, "management")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.Index != 0 || second.Index != 1 || second.Role != "management" {
+		t.Fatalf("unexpected labels %d/%q and %d/%q", first.Index, first.Role, second.Index, second.Role)
+	}
+
+	_, err = ds.MapExternalIP(orig.ID, instance.ID, "management")
+	if err != types.ErrDuplicateMappingRole {
+		t.Fatalf("expected %v, got %v", types.ErrDuplicateMappingRole, err)
+	}
+
+	// the lowest free index is reused.
+	err = ds.UnMapExternalIP(first.ExternalIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	third, err := ds.MapExternalIP(orig.ID, instance.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if third.Index != 0 {
+		t.Fatalf("expected index 0, got %d", third.Index)
+	}
+
+	for _, m := range []types.MappedIP{second, third} {
+		err = ds.UnMapExternalIP(m.ExternalIP)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = ds.DeletePool(orig.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteWorkload(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := ds.GetWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instance, err := addTestInstance(tenant, wls[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// attempt to delete this workload, should fail.
+	err = ds.DeleteWorkload(tenant.ID, wls[0].ID)
+	if err != types.ErrWorkloadInUse {
+		t.Fatal("Deleting an in use workload did not fail")
+	}
+
+	err = ds.DeleteInstance(instance.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// attempt to delete this workload, should pass
+	err = ds.DeleteWorkload(tenant.ID, wls[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCountWorkloads(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := ds.GetWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fwType := range []string{"", payloads.Legacy, string(payloads.EFI)} {
+		expected := 0
+		for _, wl := range wls {
+			if fwType == "" || wl.FWType == fwType {
+				expected++
+			}
+		}
+
+		count := ds.CountWorkloads(tenant.ID, fwType)
+		if count != expected {
+			t.Errorf("fw_type %q: got %d workloads, expected %d", fwType, count, expected)
+		}
+	}
+}
+
+func TestWorkloadInstanceCounts(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := ds.GetWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var instances []*types.Instance
+	for _, owner := range []*types.Tenant{tenant, tenant, other} {
+		instance, err := addTestInstance(owner, wls[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		instances = append(instances, instance)
+	}
+
+	if count := ds.WorkloadInstanceCounts(tenant.ID)[wls[0].ID]; count != 2 {
+		t.Errorf("expected 2 instances of the tenant, got %d", count)
+	}
+
+	if count := ds.WorkloadInstanceCounts("")[wls[0].ID]; count < 3 {
+		t.Errorf("expected at least 3 instances in all, got %d", count)
+	}
+
+	if count := ds.WorkloadInstanceCounts(other.ID)[wls[0].ID]; count != 1 {
+		t.Errorf("expected 1 instance of the other tenant, got %d", count)
+	}
+
+	for _, instance := range instances {
+		err = ds.DeleteInstance(instance.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTransferWorkload(t *testing.T) {
+	source, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hasWorkload := func(tenantID string, ID string) bool {
+		wls, err := ds.GetWorkloads(tenantID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, wl := range wls {
+			if wl.ID == ID {
+				return wl.TenantID == tenantID
+			}
+		}
+
+		return false
+	}
+
+	wls, err := ds.GetWorkloads(source.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wl types.Workload
+	for _, w := range wls {
+		if w.TenantID == source.ID {
+			wl = w
+		}
+	}
+
+	instance, err := addTestInstance(source, wl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.TransferWorkload(wl.ID, target.ID)
+	if err != types.ErrWorkloadInUse {
+		t.Fatalf("expected %v, got %v", types.ErrWorkloadInUse, err)
+	}
+
+	err = ds.DeleteInstance(instance.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.TransferWorkload(wl.ID, uuid.Generate().String())
+	if err != types.ErrTenantNotFound {
+		t.Fatalf("expected %v, got %v", types.ErrTenantNotFound, err)
+	}
+
+	err = ds.TransferWorkload(uuid.Generate().String(), target.ID)
+	if err != types.ErrWorkloadNotFound {
+		t.Fatalf("expected %v, got %v", types.ErrWorkloadNotFound, err)
+	}
+
+	err = ds.TransferWorkload(wl.ID, target.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hasWorkload(source.ID, wl.ID) || !hasWorkload(target.ID, wl.ID) {
+		t.Fatal("workload not transferred")
 	}
 }
 
@@ -32,6 +32,7 @@ type MemoryDB struct {
 	attachments     map[string]types.StorageAttachment
 	instanceVolumes map[attachment]string
 	logEntries      []*types.LogEntry
+	addressHistory  map[string][]types.AssignmentRecord
 
 	workloadsPath string
 }
@@ -49,6 +50,7 @@ func (db *MemoryDB) init(config Config) error {
 	db.blockDevices = make(map[string]types.BlockData)
 	db.attachments = make(map[string]types.StorageAttachment)
 	db.instanceVolumes = make(map[attachment]string)
+	db.addressHistory = make(map[string][]types.AssignmentRecord)
 
 	db.workloadsPath = config.InitWorkloadsPath
 	return db.fillWorkloads()
@@ -58,6 +60,10 @@ func (db *MemoryDB) disconnect() {
 
 }
 
+func (db *MemoryDB) ping() error {
+	return nil
+}
+
 func (db *MemoryDB) logEvent(tenantID string, eventType string, message string) error {
 	entry := types.LogEntry{
 		TenantID:  tenantID,
@@ -82,8 +88,9 @@ func (db *MemoryDB) getEventLog() ([]*types.LogEntry, error) {
 func (db *MemoryDB) addTenant(id string, name string) error {
 	t := &tenant{
 		Tenant: types.Tenant{
-			ID:   id,
-			Name: name,
+			ID:      id,
+			Name:    name,
+			Enabled: true,
 		},
 		network:   make(map[int]map[int]bool),
 		instances: make(map[string]*types.Instance),
@@ -101,6 +108,10 @@ func (db *MemoryDB) getTenant(id string) (*tenant, error) {
 	return tenant, nil
 }
 
+func (db *MemoryDB) updateTenantEnabled(id string, enabled bool) error {
+	return nil
+}
+
 func (db *MemoryDB) getTenants() ([]*tenant, error) {
 	var tenants []*tenant
 	for _, t := range db.tenants {
@@ -209,6 +220,10 @@ func (db *MemoryDB) addMappedIP(m types.MappedIP) error {
 	return nil
 }
 
+func (db *MemoryDB) updateMappedIP(m types.MappedIP) error {
+	return nil
+}
+
 func (db *MemoryDB) deleteMappedIP(ID string) error {
 	return nil
 }
@@ -221,10 +236,54 @@ func (db *MemoryDB) updateWorkload(wl types.Workload) error {
 	return nil
 }
 
+func (db *MemoryDB) updateWorkloadTenant(ID string, tenantID string) error {
+	return nil
+}
+
 func (db *MemoryDB) deleteWorkload(ID string) error {
 	return nil
 }
 
+func (db *MemoryDB) addAssignmentRecord(address string, r types.AssignmentRecord) error {
+	db.addressHistory[address] = append(db.addressHistory[address], r)
+	return nil
+}
+
+func (db *MemoryDB) getAddressHistory(address string) ([]types.AssignmentRecord, error) {
+	records := make([]types.AssignmentRecord, len(db.addressHistory[address]))
+	copy(records, db.addressHistory[address])
+
+	return records, nil
+}
+
+func (db *MemoryDB) updateDefaultPool(tenantID string, poolID string) error {
+	return nil
+}
+
+func (db *MemoryDB) getDefaultPools() map[string]string {
+	return make(map[string]string)
+}
+
+func (db *MemoryDB) updatePoolStrategy(tenantID string, strategy string) error {
+	return nil
+}
+
+func (db *MemoryDB) getPoolStrategies() map[string]string {
+	return make(map[string]string)
+}
+
+func (db *MemoryDB) addAddressReservation(r types.AddressReservation) error {
+	return nil
+}
+
+func (db *MemoryDB) deleteAddressReservation(ID string) error {
+	return nil
+}
+
+func (db *MemoryDB) getAddressReservations() map[string]types.AddressReservation {
+	return make(map[string]types.AddressReservation)
+}
+
 func (db *MemoryDB) updateQuotas(tenantID string, qds []types.QuotaDetails) error {
 	return nil
 }
@@ -233,6 +292,18 @@ func (db *MemoryDB) getQuotas(tenantID string) ([]types.QuotaDetails, error) {
 	return []types.QuotaDetails{}, nil
 }
 
+func (db *MemoryDB) deleteQuotas(tenantID string) error {
+	return nil
+}
+
+func (db *MemoryDB) updateSubQuotas(tenantID string, sub string, qds []types.QuotaDetails) error {
+	return nil
+}
+
+func (db *MemoryDB) getSubQuotas(tenantID string) (map[string][]types.QuotaDetails, error) {
+	return map[string][]types.QuotaDetails{}, nil
+}
+
 func (db *MemoryDB) updateInstance(instance *types.Instance) error {
 	return nil
 }
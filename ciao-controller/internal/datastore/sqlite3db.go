@@ -195,6 +195,25 @@ func (d workloadStorage) Init() error {
 	return d.ds.exec(d.db, cmd)
 }
 
+// workload environment defaults
+
+type workloadEnvData struct {
+	namedData
+}
+
+func (d workloadEnvData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS workload_env
+		(
+		workload_id string,
+		name string,
+		value string,
+		required int,
+		unique(workload_id, name)
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
 // Tenants data
 type tenantData struct {
 	namedData
@@ -380,6 +399,82 @@ func (d addressData) Init() error {
 	return d.ds.exec(d.db, cmd)
 }
 
+type poolTagData struct {
+	namedData
+}
+
+func (d poolTagData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS pool_tags
+		(
+			pool_id varchar(32),
+			tag string,
+			unique(pool_id, tag)
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type poolDescriptionData struct {
+	namedData
+}
+
+func (d poolDescriptionData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS pool_descriptions
+		(
+			pool_id varchar(32) primary key,
+			description string
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type poolTenantData struct {
+	namedData
+}
+
+// pool_tenants holds a row for each pool which only one tenant may
+// allocate from.
+func (d poolTenantData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS pool_tenants
+		(
+			pool_id varchar(32) primary key,
+			tenant_id varchar(32)
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type poolRevisionData struct {
+	namedData
+}
+
+func (d poolRevisionData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS pool_revisions
+		(
+			pool_id varchar(32) primary key,
+			revision int
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type drainedData struct {
+	namedData
+}
+
+// drained holds a row for each drained pool, with an empty subnet_id,
+// and for each drained subnet.
+func (d drainedData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS drained
+		(
+			pool_id varchar(32),
+			subnet_id varchar(32),
+			primary key (pool_id, subnet_id)
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
 type mappedIPData struct {
 	namedData
 }
@@ -396,6 +491,214 @@ func (d mappedIPData) Init() error {
 	return d.ds.exec(d.db, cmd)
 }
 
+type reservedIPData struct {
+	namedData
+}
+
+func (d reservedIPData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS reserved_ips
+		(
+			mapping_id varchar(32) primary key,
+			tenant_id varchar(32)
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type mappedIPLabelData struct {
+	namedData
+}
+
+func (d mappedIPLabelData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS mapped_ip_labels
+		(
+			mapping_id varchar(32) primary key,
+			idx int,
+			role string
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type ipLeaseData struct {
+	namedData
+}
+
+// ip_leases holds the expiry time of each reservation made with a lease.
+func (d ipLeaseData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS ip_leases
+		(
+			mapping_id varchar(32) primary key,
+			expires DATETIME
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type ipBlockData struct {
+	namedData
+}
+
+// ip_blocks holds the block of each reservation made by
+// ReserveExternalIPBlock.
+func (d ipBlockData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS ip_blocks
+		(
+			mapping_id varchar(32) primary key,
+			block_id varchar(32)
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type ipSubnetData struct {
+	namedData
+}
+
+// ip_subnets holds the subnet of its pool each mapping was allocated from.
+func (d ipSubnetData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS ip_subnets
+		(
+			mapping_id varchar(32) primary key,
+			subnet_id varchar(32)
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type ipReservedSinceData struct {
+	namedData
+}
+
+// ip_reserved_since holds when each reserved IP was last left without an
+// instance.
+func (d ipReservedSinceData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS ip_reserved_since
+		(
+			mapping_id varchar(32) primary key,
+			since DATETIME
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type ipCreatedData struct {
+	namedData
+}
+
+// ip_created holds when each mapping was created.
+func (d ipCreatedData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS ip_created
+		(
+			mapping_id varchar(32) primary key,
+			created DATETIME
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type ipLabelData struct {
+	namedData
+}
+
+// ip_labels holds the labels clients have given each mapping. They are
+// not to be confused with mapped_ip_labels, which holds the index and
+// role of a mapping.
+func (d ipLabelData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS ip_labels
+		(
+			mapping_id varchar(32),
+			key string,
+			value string,
+			unique(mapping_id, key)
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type addressHistoryData struct {
+	namedData
+}
+
+// address_history records who each external IP has been assigned to, in
+// the order the assignments were made.
+func (d addressHistoryData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS address_history
+		(
+			id integer primary key,
+			address string,
+			timestamp DATETIME,
+			action string,
+			mapping_id varchar(32),
+			tenant_id varchar(32),
+			instance_id varchar(32),
+			internal_ip string
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type defaultPoolData struct {
+	namedData
+}
+
+func (d defaultPoolData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS default_pools
+		(
+			tenant_id varchar(32) primary key,
+			pool_id varchar(32)
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type poolStrategyData struct {
+	namedData
+}
+
+// pool_strategies holds the pool selection strategy of each tenant which
+// overrides the controller's.
+func (d poolStrategyData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS pool_strategies
+		(
+			tenant_id varchar(32) primary key,
+			strategy string
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type addressReservationData struct {
+	namedData
+}
+
+// address_reservations holds the address space no pool may use.
+func (d addressReservationData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS address_reservations
+		(
+			id string primary key,
+			cidr string,
+			label string,
+			created string
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type disabledTenantData struct {
+	namedData
+}
+
+// disabled_tenants holds a row for each suspended tenant.
+func (d disabledTenantData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS disabled_tenants
+		(
+			tenant_id varchar(32) primary key
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
 type quotaData struct {
 	namedData
 }
@@ -412,6 +715,23 @@ func (d quotaData) Init() error {
 	return d.ds.exec(d.db, cmd)
 }
 
+type subQuotaData struct {
+	namedData
+}
+
+func (d subQuotaData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS sub_quotas
+		(
+			tenant_id string,
+			sub string,
+			name string,
+			value int,
+			unique(tenant_id, sub, name)
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
 func (ds *sqliteDB) exec(db *sql.DB, cmd string) error {
 	glog.V(2).Info("exec: ", cmd)
 
@@ -517,11 +837,31 @@ func (ds *sqliteDB) init(config Config) error {
 		blockData{namedData{ds: ds, name: "block_data", db: ds.db}},
 		attachments{namedData{ds: ds, name: "attachments", db: ds.db}},
 		workloadStorage{namedData{ds: ds, name: "workload_storage", db: ds.db}},
+		workloadEnvData{namedData{ds: ds, name: "workload_env", db: ds.db}},
 		poolData{namedData{ds: ds, name: "pools", db: ds.db}},
 		subnetPoolData{namedData{ds: ds, name: "subnet_pool", db: ds.db}},
 		addressData{namedData{ds: ds, name: "address_pool", db: ds.db}},
+		poolTagData{namedData{ds: ds, name: "pool_tags", db: ds.db}},
+		poolDescriptionData{namedData{ds: ds, name: "pool_descriptions", db: ds.db}},
+		poolTenantData{namedData{ds: ds, name: "pool_tenants", db: ds.db}},
+		poolRevisionData{namedData{ds: ds, name: "pool_revisions", db: ds.db}},
+		drainedData{namedData{ds: ds, name: "drained", db: ds.db}},
 		mappedIPData{namedData{ds: ds, name: "mapped_ips", db: ds.db}},
+		reservedIPData{namedData{ds: ds, name: "reserved_ips", db: ds.db}},
+		mappedIPLabelData{namedData{ds: ds, name: "mapped_ip_labels", db: ds.db}},
+		ipLeaseData{namedData{ds: ds, name: "ip_leases", db: ds.db}},
+		ipBlockData{namedData{ds: ds, name: "ip_blocks", db: ds.db}},
+		ipSubnetData{namedData{ds: ds, name: "ip_subnets", db: ds.db}},
+		ipReservedSinceData{namedData{ds: ds, name: "ip_reserved_since", db: ds.db}},
+		ipCreatedData{namedData{ds: ds, name: "ip_created", db: ds.db}},
+		ipLabelData{namedData{ds: ds, name: "ip_labels", db: ds.db}},
+		addressHistoryData{namedData{ds: ds, name: "address_history", db: ds.db}},
+		defaultPoolData{namedData{ds: ds, name: "default_pools", db: ds.db}},
+		poolStrategyData{namedData{ds: ds, name: "pool_strategies", db: ds.db}},
+		addressReservationData{namedData{ds: ds, name: "address_reservations", db: ds.db}},
+		disabledTenantData{namedData{ds: ds, name: "disabled_tenants", db: ds.db}},
 		quotaData{namedData{ds: ds, name: "quotas", db: ds.db}},
+		subQuotaData{namedData{ds: ds, name: "sub_quotas", db: ds.db}},
 	}
 
 	ds.workloadsPath = config.InitWorkloadsPath
@@ -615,6 +955,15 @@ func (ds *sqliteDB) disconnect() {
 	ds.tdb.Close()
 }
 
+func (ds *sqliteDB) ping() error {
+	err := ds.db.Ping()
+	if err != nil {
+		return err
+	}
+
+	return ds.tdb.Ping()
+}
+
 func (ds *sqliteDB) logEvent(tenantID string, eventType string, message string) error {
 	datastore := ds.getTableDB("log")
 
@@ -743,6 +1092,48 @@ func (ds *sqliteDB) deleteWorkloadStorage(tx *sql.Tx, workloadID string) error {
 	return err
 }
 
+// lock must be held by caller
+func (ds *sqliteDB) createWorkloadEnv(tx *sql.Tx, workloadID string, d types.WorkloadDefault) error {
+	_, err := tx.Exec("INSERT INTO workload_env (workload_id, name, value, required) VALUES (?, ?, ?, ?)", workloadID, d.Name, d.Value, d.Required)
+
+	return err
+}
+
+// lock must be held by caller
+func (ds *sqliteDB) deleteWorkloadEnv(tx *sql.Tx, workloadID string) error {
+	_, err := tx.Exec("DELETE FROM workload_env WHERE workload_id = ?", workloadID)
+
+	return err
+}
+
+func (ds *sqliteDB) getWorkloadEnv(ID string) ([]types.WorkloadDefault, error) {
+	query := `SELECT name, value, required
+		  FROM workload_env
+		  WHERE workload_id = ?
+		  ORDER BY rowid`
+
+	rows, err := ds.db.Query(query, ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var env []types.WorkloadDefault
+
+	for rows.Next() {
+		var d types.WorkloadDefault
+
+		err = rows.Scan(&d.Name, &d.Value, &d.Required)
+		if err != nil {
+			return nil, err
+		}
+
+		env = append(env, d)
+	}
+
+	return env, rows.Err()
+}
+
 func (ds *sqliteDB) getWorkloadStorage(ID string) ([]types.StorageResource, error) {
 	query := `SELECT volume_id, bootable, ephemeral, size,
 			 source_type, source_id, tag
@@ -803,6 +1194,11 @@ func (ds *sqliteDB) getTenant(ID string) (*tenant, error) {
 		return nil, err
 	}
 
+	t.Enabled, err = ds.getTenantEnabled(t.ID)
+	if err != nil {
+		return nil, err
+	}
+
 	// for these items below, its ok to get err returned
 	// because a tenant could simply not have used any
 	// resources or networks yet.
@@ -872,6 +1268,11 @@ func (ds *sqliteDB) getTenantWorkloads(tenantID string) ([]types.Workload, error
 			return nil, err
 		}
 
+		wl.Environment, err = ds.getWorkloadEnv(wl.ID)
+		if err != nil {
+			return nil, err
+		}
+
 		wl.VMType = payloads.Hypervisor(VMType)
 
 		workloads = append(workloads, wl)
@@ -903,56 +1304,93 @@ func (ds *sqliteDB) updateWorkload(w types.Workload) error {
 		return err
 	}
 
-	// if this is a new workload, put it in, otherwise just update.
+	// an existing workload has its resources replaced.
 	_, ok := m[w.ID]
-	if !ok {
-		// add in workload resources
-		for _, d := range w.Defaults {
-			err := ds.createWorkloadDefault(tx, w.ID, d)
-			if err != nil {
-				tx.Rollback()
-				return err
-			}
+	if ok {
+		err = ds.deleteWorkloadDefault(tx, w.ID)
+		if err != nil {
+			tx.Rollback()
+			return err
 		}
 
-		// add in any workload storage resources
-		if len(w.Storage) > 0 {
-			for i := range w.Storage {
-				err := ds.createWorkloadStorage(tx, w.ID, &w.Storage[i])
-				if err != nil {
-					tx.Rollback()
-					return err
-				}
-			}
+		err = ds.deleteWorkloadStorage(tx, w.ID)
+		if err != nil {
+			tx.Rollback()
+			return err
 		}
 
-		// write config to file.
-		filename := fmt.Sprintf("%s_config.yaml", w.ID)
-		path := fmt.Sprintf("%s/%s", ds.workloadsPath, filename)
-		err := ioutil.WriteFile(path, []byte(w.Config), 0644)
+		err = ds.deleteWorkloadEnv(tx, w.ID)
 		if err != nil {
 			tx.Rollback()
 			return err
 		}
+	}
 
-		_, err = tx.Exec("INSERT INTO workload_template (id, tenant_id, description, filename, fw_type, vm_type, image_name, internal) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", w.ID, w.TenantID, w.Description, filename, w.FWType, string(w.VMType), w.ImageName, false)
+	// add in workload resources
+	for _, d := range w.Defaults {
+		err := ds.createWorkloadDefault(tx, w.ID, d)
 		if err != nil {
 			tx.Rollback()
 			return err
 		}
-	} else {
-		// update not supported yet.
-		tx.Rollback()
-		return errors.New("Workload Update not supported yet")
 	}
 
-	tx.Commit()
-	return nil
-}
-
-func (ds *sqliteDB) deleteWorkload(ID string) error {
-	db := ds.getTableDB("workload_template")
-
+	// add in any workload storage resources
+	if len(w.Storage) > 0 {
+		for i := range w.Storage {
+			err := ds.createWorkloadStorage(tx, w.ID, &w.Storage[i])
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	// add in any environment defaults
+	for _, d := range w.Environment {
+		err := ds.createWorkloadEnv(tx, w.ID, d)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	// write config to file.
+	filename := fmt.Sprintf("%s_config.yaml", w.ID)
+	path := fmt.Sprintf("%s/%s", ds.workloadsPath, filename)
+	err = ioutil.WriteFile(path, []byte(w.Config), 0644)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if !ok {
+		_, err = tx.Exec("INSERT INTO workload_template (id, tenant_id, description, filename, fw_type, vm_type, image_name, internal) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", w.ID, w.TenantID, w.Description, filename, w.FWType, string(w.VMType), w.ImageName, false)
+	} else {
+		_, err = tx.Exec("UPDATE workload_template SET description = ?, fw_type = ?, vm_type = ?, image_name = ? WHERE id = ?", w.Description, w.FWType, string(w.VMType), w.ImageName, w.ID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	tx.Commit()
+	return nil
+}
+
+func (ds *sqliteDB) updateWorkloadTenant(ID string, tenantID string) error {
+	db := ds.getTableDB("workload_template")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("UPDATE workload_template SET tenant_id = ? WHERE id = ?", tenantID, ID)
+	return err
+}
+
+func (ds *sqliteDB) deleteWorkload(ID string) error {
+	db := ds.getTableDB("workload_template")
+
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
@@ -973,6 +1411,12 @@ func (ds *sqliteDB) deleteWorkload(ID string) error {
 		return err
 	}
 
+	err = ds.deleteWorkloadEnv(tx, ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
 	_, err = tx.Exec("DELETE FROM workload_template WHERE id = ?", ID)
 	if err != nil {
 		tx.Rollback()
@@ -1024,6 +1468,11 @@ func (ds *sqliteDB) getTenants() ([]*tenant, error) {
 			t.Name = name.String
 		}
 
+		t.Enabled, err = ds.getTenantEnabled(t.ID)
+		if err != nil {
+			return nil, err
+		}
+
 		err = ds.getTenantNetwork(t)
 		if err != nil {
 			return nil, err
@@ -1098,6 +1547,35 @@ func (ds *sqliteDB) releaseTenantIP(tenantID string, subnetInt int, rest int) er
 	return err
 }
 
+// getTenantEnabled returns false if the tenant has been suspended.
+func (ds *sqliteDB) getTenantEnabled(tenantID string) (bool, error) {
+	datastore := ds.getTableDB("disabled_tenants")
+
+	var id string
+	err := datastore.QueryRow("SELECT tenant_id FROM disabled_tenants WHERE tenant_id = ?", tenantID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+
+	return false, err
+}
+
+func (ds *sqliteDB) updateTenantEnabled(ID string, enabled bool) error {
+	db := ds.getTableDB("disabled_tenants")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	var err error
+	if enabled {
+		_, err = db.Exec("DELETE FROM disabled_tenants WHERE tenant_id = ?", ID)
+	} else {
+		_, err = db.Exec("REPLACE INTO disabled_tenants (tenant_id) VALUES (?)", ID)
+	}
+
+	return err
+}
+
 func (ds *sqliteDB) getTenantNetwork(tenant *tenant) error {
 	tenant.network = make(map[int]map[int]bool)
 
@@ -2061,6 +2539,76 @@ func (ds *sqliteDB) updateAddresses(tx *sql.Tx, pool types.Pool) error {
 	return nil
 }
 
+// lock must be held by caller. Any rollbacks will need to be handled
+// by caller.
+func (ds *sqliteDB) updateTags(tx *sql.Tx, pool types.Pool) error {
+	_, err := tx.Exec("DELETE FROM pool_tags WHERE pool_id = ?", pool.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range pool.Tags {
+		_, err = tx.Exec("INSERT OR IGNORE INTO pool_tags (pool_id, tag) VALUES (?, ?)", pool.ID, tag)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ds *sqliteDB) updateDescription(tx *sql.Tx, pool types.Pool) error {
+	if pool.Description == "" {
+		_, err := tx.Exec("DELETE FROM pool_descriptions WHERE pool_id = ?", pool.ID)
+		return err
+	}
+
+	_, err := tx.Exec("REPLACE INTO pool_descriptions (pool_id, description) VALUES (?, ?)", pool.ID, pool.Description)
+	return err
+}
+
+func (ds *sqliteDB) updatePoolTenant(tx *sql.Tx, pool types.Pool) error {
+	if pool.TenantID == "" {
+		_, err := tx.Exec("DELETE FROM pool_tenants WHERE pool_id = ?", pool.ID)
+		return err
+	}
+
+	_, err := tx.Exec("REPLACE INTO pool_tenants (pool_id, tenant_id) VALUES (?, ?)", pool.ID, pool.TenantID)
+	return err
+}
+
+func (ds *sqliteDB) updateRevision(tx *sql.Tx, pool types.Pool) error {
+	_, err := tx.Exec("REPLACE INTO pool_revisions (pool_id, revision) VALUES (?, ?)", pool.ID, pool.Revision)
+	return err
+}
+
+func (ds *sqliteDB) updateDrained(tx *sql.Tx, pool types.Pool) error {
+	_, err := tx.Exec("DELETE FROM drained WHERE pool_id = ?", pool.ID)
+	if err != nil {
+		return err
+	}
+
+	if pool.Drained {
+		_, err = tx.Exec("INSERT INTO drained (pool_id, subnet_id) VALUES (?, '')", pool.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, subnet := range pool.Subnets {
+		if !subnet.Drained {
+			continue
+		}
+
+		_, err = tx.Exec("INSERT INTO drained (pool_id, subnet_id) VALUES (?, ?)", pool.ID, subnet.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // updatePool is used to update all pool related fields even if they
 // are in different tables.
 func (ds *sqliteDB) updatePool(pool types.Pool) error {
@@ -2089,6 +2637,36 @@ func (ds *sqliteDB) updatePool(pool types.Pool) error {
 		return err
 	}
 
+	err = ds.updateTags(tx, pool)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = ds.updateDescription(tx, pool)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = ds.updatePoolTenant(tx, pool)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = ds.updateDrained(tx, pool)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = ds.updateRevision(tx, pool)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
 	// if this is a new pool, put it in, otherwise just update.
 	_, ok := pools[pool.ID]
 	if !ok {
@@ -2098,8 +2676,8 @@ func (ds *sqliteDB) updatePool(pool types.Pool) error {
 			return err
 		}
 	} else {
-		// update free and total counts.
-		_, err = tx.Exec("UPDATE pools SET free = ?, total = ? WHERE id = ?", pool.Free, pool.TotalIPs, pool.ID)
+		// update the name and the free and total counts.
+		_, err = tx.Exec("UPDATE pools SET name = ?, free = ?, total = ? WHERE id = ?", pool.Name, pool.Free, pool.TotalIPs, pool.ID)
 		if err != nil {
 			tx.Rollback()
 			return err
@@ -2146,6 +2724,31 @@ func (ds *sqliteDB) getAllPools() map[string]types.Pool {
 			continue
 		}
 
+		pool.Tags, err = ds.getPoolTags(pool.ID)
+		if err != nil {
+			continue
+		}
+
+		pool.Description, err = ds.getPoolDescription(pool.ID)
+		if err != nil {
+			continue
+		}
+
+		pool.TenantID, err = ds.getPoolTenant(pool.ID)
+		if err != nil {
+			continue
+		}
+
+		err = ds.getPoolDrained(&pool)
+		if err != nil {
+			continue
+		}
+
+		pool.Revision, err = ds.getPoolRevision(pool.ID)
+		if err != nil {
+			continue
+		}
+
 		pools[pool.ID] = pool
 	}
 
@@ -2195,6 +2798,42 @@ func (ds *sqliteDB) deletePool(ID string) error {
 		}
 	}
 
+	_, err = tx.Exec("DELETE FROM pool_tags WHERE pool_id = ?", ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM pool_descriptions WHERE pool_id = ?", ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM pool_tenants WHERE pool_id = ?", ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM drained WHERE pool_id = ?", ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM pool_revisions WHERE pool_id = ?", ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM default_pools WHERE pool_id = ?", ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
 	_, err = tx.Exec("DELETE FROM pools WHERE id = ?", ID)
 	if err != nil {
 		tx.Rollback()
@@ -2274,91 +2913,776 @@ func (ds *sqliteDB) getPoolAddresses(poolID string) ([]types.ExternalIP, error)
 	return IPs, nil
 }
 
-func (ds *sqliteDB) addMappedIP(m types.MappedIP) error {
-	datastore := ds.getTableDB("mapped_ips")
+func (ds *sqliteDB) getPoolDescription(poolID string) (string, error) {
+	var description string
 
-	ds.dbLock.Lock()
-	defer ds.dbLock.Unlock()
+	datastore := ds.getTableDB("pool_descriptions")
 
-	tx, err := datastore.Begin()
-	if err != nil {
-		return err
-	}
+	query := `SELECT	description
+		  FROM	pool_descriptions
+		  WHERE pool_id = ?`
 
-	_, err = tx.Exec("INSERT INTO mapped_ips (id, pool_id, external_ip, instance_id) VALUES (?, ?, ?, ?)", m.ID, m.PoolID, m.ExternalIP, m.InstanceID)
-	if err != nil {
-		tx.Rollback()
-		return err
+	err := datastore.QueryRow(query, poolID).Scan(&description)
+	if err == sql.ErrNoRows {
+		return "", nil
 	}
 
-	tx.Commit()
-
-	return nil
+	return description, err
 }
 
-func (ds *sqliteDB) deleteMappedIP(ID string) error {
-	datastore := ds.getTableDB("mapped_ips")
+// getPoolTenant returns the tenant which a pool is scoped to, or an empty
+// string for a global pool.
+func (ds *sqliteDB) getPoolTenant(poolID string) (string, error) {
+	var tenantID string
 
-	ds.dbLock.Lock()
-	defer ds.dbLock.Unlock()
+	datastore := ds.getTableDB("pool_tenants")
 
-	tx, err := datastore.Begin()
-	if err != nil {
-		return err
-	}
+	query := `SELECT	tenant_id
+		  FROM	pool_tenants
+		  WHERE pool_id = ?`
 
-	_, err = tx.Exec("DELETE FROM mapped_ips WHERE id = ?", ID)
-	if err != nil {
-		tx.Rollback()
-		return err
+	err := datastore.QueryRow(query, poolID).Scan(&tenantID)
+	if err == sql.ErrNoRows {
+		return "", nil
 	}
 
-	tx.Commit()
-
-	return err
+	return tenantID, err
 }
 
-func (ds *sqliteDB) getMappedIPs() map[string]types.MappedIP {
-	IPs := make(map[string]types.MappedIP)
+// getPoolRevision returns the revision of a pool. Pools stored before
+// revisions were kept start again from revision 1.
+func (ds *sqliteDB) getPoolRevision(poolID string) (int, error) {
+	var revision int
 
-	datastore := ds.getTableDB("mapped_ips")
+	datastore := ds.getTableDB("pool_revisions")
 
-	query := `SELECT	mapped_ips.id,
-				mapped_ips.pool_id,
-				mapped_ips.external_ip,
-				mapped_ips.instance_id,
-				instances.ip,
-				instances.tenant_id,
-				pools.name
-		  FROM	mapped_ips
-		  JOIN instances
-		  ON instances.id = mapped_ips.instance_id
-		  JOIN pools
-		  ON pools.id = mapped_ips.pool_id`
+	query := `SELECT	revision
+		  FROM	pool_revisions
+		  WHERE pool_id = ?`
 
-	rows, err := datastore.Query(query)
+	err := datastore.QueryRow(query, poolID).Scan(&revision)
+	if err == sql.ErrNoRows {
+		return 1, nil
+	}
+
+	return revision, err
+}
+
+// getPoolDrained sets the drained flags of a pool and its subnets.
+func (ds *sqliteDB) getPoolDrained(pool *types.Pool) error {
+	datastore := ds.getTableDB("drained")
+
+	query := `SELECT	subnet_id
+		  FROM	drained
+		  WHERE pool_id = ?`
+
+	rows, err := datastore.Query(query, pool.ID)
 	if err != nil {
-		fmt.Println(err)
-		return IPs
+		return err
 	}
 	defer rows.Close()
 
+	drained := make(map[string]bool)
 	for rows.Next() {
-		var IP types.MappedIP
+		var subnetID string
 
-		err = rows.Scan(&IP.ID, &IP.PoolID, &IP.ExternalIP, &IP.InstanceID, &IP.InternalIP, &IP.TenantID, &IP.PoolName)
+		err = rows.Scan(&subnetID)
 		if err != nil {
 			continue
 		}
 
-		IPs[IP.ExternalIP] = IP
+		drained[subnetID] = true
 	}
 
 	if err = rows.Err(); err != nil {
-		fmt.Println(err)
+		return err
 	}
 
-	return IPs
+	pool.Drained = drained[""]
+	for i := range pool.Subnets {
+		pool.Subnets[i].Drained = drained[pool.Subnets[i].ID]
+	}
+
+	return nil
+}
+
+func (ds *sqliteDB) getPoolTags(poolID string) ([]string, error) {
+	var tags []string
+
+	datastore := ds.getTableDB("pool_tags")
+
+	query := `SELECT	tag
+		  FROM	pool_tags
+		  WHERE pool_id = ?`
+
+	rows, err := datastore.Query(query, poolID)
+	if err != nil {
+		return tags, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tag string
+
+		err = rows.Scan(&tag)
+		if err != nil {
+			continue
+		}
+
+		tags = append(tags, tag)
+	}
+
+	if err = rows.Err(); err != nil {
+		return tags, err
+	}
+
+	return tags, nil
+}
+
+func (ds *sqliteDB) addMappedIP(m types.MappedIP) error {
+	datastore := ds.getTableDB("mapped_ips")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	tx, err := datastore.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO mapped_ips (id, pool_id, external_ip, instance_id) VALUES (?, ?, ?, ?)", m.ID, m.PoolID, m.ExternalIP, m.InstanceID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = updateReservation(tx, m)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = updateMappedIPLabel(tx, m)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = updateLease(tx, m)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = updateBlock(tx, m)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = updateSubnet(tx, m)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = updateReservedSince(tx, m)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = updateCreated(tx, m)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = updateLabels(tx, m)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	tx.Commit()
+
+	return nil
+}
+
+// updateReservation records the tenant of an external IP which is not
+// mapped to an instance, since it cannot be found from the instance.
+func updateReservation(tx *sql.Tx, m types.MappedIP) error {
+	if m.InstanceID != "" {
+		_, err := tx.Exec("DELETE FROM reserved_ips WHERE mapping_id = ?", m.ID)
+		return err
+	}
+
+	_, err := tx.Exec("REPLACE INTO reserved_ips (mapping_id, tenant_id) VALUES (?, ?)", m.ID, m.TenantID)
+	return err
+}
+
+// updateMappedIPLabel records the index and role of a mapping. Most
+// instances have only the one external IP, which needs no label.
+func updateMappedIPLabel(tx *sql.Tx, m types.MappedIP) error {
+	if m.Index == 0 && m.Role == "" {
+		_, err := tx.Exec("DELETE FROM mapped_ip_labels WHERE mapping_id = ?", m.ID)
+		return err
+	}
+
+	_, err := tx.Exec("REPLACE INTO mapped_ip_labels (mapping_id, idx, role) VALUES (?, ?, ?)", m.ID, m.Index, m.Role)
+	return err
+}
+
+// updateLease records when a reservation made with a lease expires.
+func updateLease(tx *sql.Tx, m types.MappedIP) error {
+	if m.Expires == nil {
+		_, err := tx.Exec("DELETE FROM ip_leases WHERE mapping_id = ?", m.ID)
+		return err
+	}
+
+	_, err := tx.Exec("REPLACE INTO ip_leases (mapping_id, expires) VALUES (?, ?)", m.ID, m.Expires.Format(time.RFC3339Nano))
+	return err
+}
+
+// updateBlock records the reservation block a mapping belongs to.
+func updateBlock(tx *sql.Tx, m types.MappedIP) error {
+	if m.BlockID == "" {
+		_, err := tx.Exec("DELETE FROM ip_blocks WHERE mapping_id = ?", m.ID)
+		return err
+	}
+
+	_, err := tx.Exec("REPLACE INTO ip_blocks (mapping_id, block_id) VALUES (?, ?)", m.ID, m.BlockID)
+	return err
+}
+
+// updateSubnet records the subnet a mapping was allocated from.
+func updateSubnet(tx *sql.Tx, m types.MappedIP) error {
+	if m.SubnetID == "" {
+		_, err := tx.Exec("DELETE FROM ip_subnets WHERE mapping_id = ?", m.ID)
+		return err
+	}
+
+	_, err := tx.Exec("REPLACE INTO ip_subnets (mapping_id, subnet_id) VALUES (?, ?)", m.ID, m.SubnetID)
+	return err
+}
+
+// updateReservedSince records when a reserved IP was left without an
+// instance.
+func updateReservedSince(tx *sql.Tx, m types.MappedIP) error {
+	if m.ReservedSince == nil {
+		_, err := tx.Exec("DELETE FROM ip_reserved_since WHERE mapping_id = ?", m.ID)
+		return err
+	}
+
+	_, err := tx.Exec("REPLACE INTO ip_reserved_since (mapping_id, since) VALUES (?, ?)", m.ID, m.ReservedSince.Format(time.RFC3339Nano))
+	return err
+}
+
+// updateCreated records when a mapping was created.
+func updateCreated(tx *sql.Tx, m types.MappedIP) error {
+	if m.Created == nil {
+		_, err := tx.Exec("DELETE FROM ip_created WHERE mapping_id = ?", m.ID)
+		return err
+	}
+
+	_, err := tx.Exec("REPLACE INTO ip_created (mapping_id, created) VALUES (?, ?)", m.ID, m.Created.Format(time.RFC3339Nano))
+	return err
+}
+
+// updateLabels replaces the labels of a mapping.
+func updateLabels(tx *sql.Tx, m types.MappedIP) error {
+	_, err := tx.Exec("DELETE FROM ip_labels WHERE mapping_id = ?", m.ID)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range m.Labels {
+		_, err = tx.Exec("INSERT INTO ip_labels (mapping_id, key, value) VALUES (?, ?, ?)", m.ID, k, v)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ds *sqliteDB) updateMappedIP(m types.MappedIP) error {
+	datastore := ds.getTableDB("mapped_ips")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	tx, err := datastore.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE mapped_ips SET instance_id = ? WHERE id = ?", m.InstanceID, m.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = updateReservation(tx, m)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = updateMappedIPLabel(tx, m)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = updateLease(tx, m)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = updateBlock(tx, m)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = updateSubnet(tx, m)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = updateReservedSince(tx, m)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = updateCreated(tx, m)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = updateLabels(tx, m)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	tx.Commit()
+
+	return nil
+}
+
+func (ds *sqliteDB) deleteMappedIP(ID string) error {
+	datastore := ds.getTableDB("mapped_ips")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	tx, err := datastore.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM mapped_ips WHERE id = ?", ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM reserved_ips WHERE mapping_id = ?", ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM mapped_ip_labels WHERE mapping_id = ?", ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM ip_leases WHERE mapping_id = ?", ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM ip_blocks WHERE mapping_id = ?", ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM ip_subnets WHERE mapping_id = ?", ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM ip_reserved_since WHERE mapping_id = ?", ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM ip_created WHERE mapping_id = ?", ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM ip_labels WHERE mapping_id = ?", ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	tx.Commit()
+
+	return err
+}
+
+// getMappedIPLabels returns the labels of every mapping which has any,
+// keyed by mapping ID.
+func (ds *sqliteDB) getMappedIPLabels() (map[string]map[string]string, error) {
+	labels := make(map[string]map[string]string)
+
+	datastore := ds.getTableDB("ip_labels")
+
+	query := `SELECT	mapping_id,
+				key,
+				value
+		  FROM	ip_labels`
+
+	rows, err := datastore.Query(query)
+	if err != nil {
+		return labels, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ID, key, value string
+
+		err = rows.Scan(&ID, &key, &value)
+		if err != nil {
+			continue
+		}
+
+		if labels[ID] == nil {
+			labels[ID] = make(map[string]string)
+		}
+		labels[ID][key] = value
+	}
+
+	return labels, rows.Err()
+}
+
+func (ds *sqliteDB) getMappedIPs() map[string]types.MappedIP {
+	IPs := make(map[string]types.MappedIP)
+
+	labels, err := ds.getMappedIPLabels()
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	datastore := ds.getTableDB("mapped_ips")
+
+	query := `SELECT	mapped_ips.id,
+				mapped_ips.pool_id,
+				mapped_ips.external_ip,
+				mapped_ips.instance_id,
+				instances.ip,
+				instances.tenant_id,
+				pools.name,
+				IFNULL(mapped_ip_labels.idx, 0),
+				IFNULL(mapped_ip_labels.role, ''),
+				IFNULL(ip_blocks.block_id, ''),
+				IFNULL(ip_subnets.subnet_id, ''),
+				ip_created.created
+		  FROM	mapped_ips
+		  JOIN instances
+		  ON instances.id = mapped_ips.instance_id
+		  JOIN pools
+		  ON pools.id = mapped_ips.pool_id
+		  LEFT JOIN mapped_ip_labels
+		  ON mapped_ip_labels.mapping_id = mapped_ips.id
+		  LEFT JOIN ip_blocks
+		  ON ip_blocks.mapping_id = mapped_ips.id
+		  LEFT JOIN ip_subnets
+		  ON ip_subnets.mapping_id = mapped_ips.id
+		  LEFT JOIN ip_created
+		  ON ip_created.mapping_id = mapped_ips.id`
+
+	rows, err := datastore.Query(query)
+	if err != nil {
+		fmt.Println(err)
+		return IPs
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var IP types.MappedIP
+
+		err = rows.Scan(&IP.ID, &IP.PoolID, &IP.ExternalIP, &IP.InstanceID, &IP.InternalIP, &IP.TenantID, &IP.PoolName, &IP.Index, &IP.Role, &IP.BlockID, &IP.SubnetID, &IP.Created)
+		if err != nil {
+			continue
+		}
+
+		IP.Status = types.MappedIPAttached
+		IP.Labels = labels[IP.ID]
+		IPs[IP.ExternalIP] = IP
+	}
+
+	if err = rows.Err(); err != nil {
+		fmt.Println(err)
+	}
+
+	// reserved IPs have no instance to get the tenant from.
+	query = `SELECT	mapped_ips.id,
+			mapped_ips.pool_id,
+			mapped_ips.external_ip,
+			reserved_ips.tenant_id,
+			pools.name,
+			IFNULL(mapped_ip_labels.role, ''),
+			ip_leases.expires,
+			ip_reserved_since.since,
+			IFNULL(ip_blocks.block_id, ''),
+			IFNULL(ip_subnets.subnet_id, ''),
+			ip_created.created
+		  FROM	mapped_ips
+		  JOIN reserved_ips
+		  ON reserved_ips.mapping_id = mapped_ips.id
+		  JOIN pools
+		  ON pools.id = mapped_ips.pool_id
+		  LEFT JOIN mapped_ip_labels
+		  ON mapped_ip_labels.mapping_id = mapped_ips.id
+		  LEFT JOIN ip_leases
+		  ON ip_leases.mapping_id = mapped_ips.id
+		  LEFT JOIN ip_reserved_since
+		  ON ip_reserved_since.mapping_id = mapped_ips.id
+		  LEFT JOIN ip_blocks
+		  ON ip_blocks.mapping_id = mapped_ips.id
+		  LEFT JOIN ip_subnets
+		  ON ip_subnets.mapping_id = mapped_ips.id
+		  LEFT JOIN ip_created
+		  ON ip_created.mapping_id = mapped_ips.id`
+
+	reserved, err := datastore.Query(query)
+	if err != nil {
+		fmt.Println(err)
+		return IPs
+	}
+	defer reserved.Close()
+
+	for reserved.Next() {
+		var IP types.MappedIP
+
+		err = reserved.Scan(&IP.ID, &IP.PoolID, &IP.ExternalIP, &IP.TenantID, &IP.PoolName, &IP.Role, &IP.Expires, &IP.ReservedSince, &IP.BlockID, &IP.SubnetID, &IP.Created)
+		if err != nil {
+			continue
+		}
+
+		IP.Status = types.MappedIPReserved
+		IP.Labels = labels[IP.ID]
+		IPs[IP.ExternalIP] = IP
+	}
+
+	if err = reserved.Err(); err != nil {
+		fmt.Println(err)
+	}
+
+	return IPs
+}
+
+func (ds *sqliteDB) addAssignmentRecord(address string, r types.AssignmentRecord) error {
+	datastore := ds.getTableDB("address_history")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := datastore.Exec("INSERT INTO address_history (address, timestamp, action, mapping_id, tenant_id, instance_id, internal_ip) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		address, r.Timestamp.Format(time.RFC3339Nano), r.Action, r.MappingID, r.TenantID, r.InstanceID, r.InternalIP)
+
+	return err
+}
+
+func (ds *sqliteDB) getAddressHistory(address string) ([]types.AssignmentRecord, error) {
+	datastore := ds.getTableDB("address_history")
+
+	rows, err := datastore.Query("SELECT timestamp, action, mapping_id, tenant_id, instance_id, internal_ip FROM address_history WHERE address = ? ORDER BY id", address)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []types.AssignmentRecord{}
+	for rows.Next() {
+		var r types.AssignmentRecord
+
+		err = rows.Scan(&r.Timestamp, &r.Action, &r.MappingID, &r.TenantID, &r.InstanceID, &r.InternalIP)
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, r)
+	}
+
+	return records, rows.Err()
+}
+
+func (ds *sqliteDB) updateDefaultPool(tenantID string, poolID string) error {
+	datastore := ds.getTableDB("default_pools")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	var err error
+	if poolID == "" {
+		_, err = datastore.Exec("DELETE FROM default_pools WHERE tenant_id = ?", tenantID)
+	} else {
+		_, err = datastore.Exec("REPLACE INTO default_pools (tenant_id, pool_id) VALUES (?, ?)", tenantID, poolID)
+	}
+
+	return err
+}
+
+func (ds *sqliteDB) updatePoolStrategy(tenantID string, strategy string) error {
+	datastore := ds.getTableDB("pool_strategies")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	var err error
+	if strategy == "" {
+		_, err = datastore.Exec("DELETE FROM pool_strategies WHERE tenant_id = ?", tenantID)
+	} else {
+		_, err = datastore.Exec("REPLACE INTO pool_strategies (tenant_id, strategy) VALUES (?, ?)", tenantID, strategy)
+	}
+
+	return err
+}
+
+func (ds *sqliteDB) getPoolStrategies() map[string]string {
+	strategies := make(map[string]string)
+
+	datastore := ds.getTableDB("pool_strategies")
+
+	rows, err := datastore.Query("SELECT tenant_id, strategy FROM pool_strategies")
+	if err != nil {
+		fmt.Println(err)
+		return strategies
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tenantID, strategy string
+
+		err = rows.Scan(&tenantID, &strategy)
+		if err != nil {
+			continue
+		}
+
+		strategies[tenantID] = strategy
+	}
+
+	if err = rows.Err(); err != nil {
+		fmt.Println(err)
+	}
+
+	return strategies
+}
+
+func (ds *sqliteDB) addAddressReservation(r types.AddressReservation) error {
+	datastore := ds.getTableDB("address_reservations")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := datastore.Exec("INSERT INTO address_reservations (id, cidr, label, created) VALUES (?, ?, ?, ?)",
+		r.ID, r.CIDR, r.Label, r.Created.Format(time.RFC3339Nano))
+
+	return err
+}
+
+func (ds *sqliteDB) deleteAddressReservation(ID string) error {
+	datastore := ds.getTableDB("address_reservations")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := datastore.Exec("DELETE FROM address_reservations WHERE id = ?", ID)
+
+	return err
+}
+
+func (ds *sqliteDB) getAddressReservations() map[string]types.AddressReservation {
+	reservations := make(map[string]types.AddressReservation)
+
+	datastore := ds.getTableDB("address_reservations")
+
+	rows, err := datastore.Query("SELECT id, cidr, label, created FROM address_reservations")
+	if err != nil {
+		fmt.Println(err)
+		return reservations
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r types.AddressReservation
+		var created string
+
+		err = rows.Scan(&r.ID, &r.CIDR, &r.Label, &created)
+		if err != nil {
+			continue
+		}
+
+		r.Created, err = time.Parse(time.RFC3339Nano, created)
+		if err != nil {
+			continue
+		}
+
+		reservations[r.ID] = r
+	}
+
+	if err = rows.Err(); err != nil {
+		fmt.Println(err)
+	}
+
+	return reservations
+}
+
+func (ds *sqliteDB) getDefaultPools() map[string]string {
+	pools := make(map[string]string)
+
+	datastore := ds.getTableDB("default_pools")
+
+	rows, err := datastore.Query("SELECT tenant_id, pool_id FROM default_pools")
+	if err != nil {
+		fmt.Println(err)
+		return pools
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tenantID, poolID string
+
+		err = rows.Scan(&tenantID, &poolID)
+		if err != nil {
+			continue
+		}
+
+		pools[tenantID] = poolID
+	}
+
+	if err = rows.Err(); err != nil {
+		fmt.Println(err)
+	}
+
+	return pools
 }
 
 func (ds *sqliteDB) updateQuotas(tenantID string, qds []types.QuotaDetails) error {
@@ -2412,3 +3736,70 @@ func (ds *sqliteDB) getQuotas(tenantID string) ([]types.QuotaDetails, error) {
 
 	return results, nil
 }
+
+func (ds *sqliteDB) deleteQuotas(tenantID string) error {
+	datastore := ds.getTableDB("quotas")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := datastore.Exec("DELETE FROM quotas WHERE tenant_id = ?", tenantID)
+	if err != nil {
+		return errors.Wrap(err, "error deleting quotas from database")
+	}
+
+	return nil
+}
+
+func (ds *sqliteDB) updateSubQuotas(tenantID string, sub string, qds []types.QuotaDetails) error {
+	datastore := ds.getTableDB("sub_quotas")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	tx, err := datastore.Begin()
+	if err != nil {
+		return errors.Wrap(err, "error starting transaction for sub-quota update")
+	}
+
+	for i := range qds {
+		_, err = tx.Exec("REPLACE INTO sub_quotas (tenant_id, sub, name, value) VALUES (?, ?, ?, ?)", tenantID, sub, qds[i].Name, qds[i].Value)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "error executing query for sub-quota update")
+		}
+	}
+
+	tx.Commit()
+
+	return nil
+}
+
+func (ds *sqliteDB) getSubQuotas(tenantID string) (map[string][]types.QuotaDetails, error) {
+	query := `SELECT sub, name, value from sub_quotas WHERE tenant_id = ?`
+
+	db := ds.getTableDB("sub_quotas")
+
+	rows, err := db.Query(query, tenantID)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting sub-quotas from database")
+	}
+	defer rows.Close()
+
+	results := make(map[string][]types.QuotaDetails)
+	for rows.Next() {
+		var sub string
+		var name string
+		var value int
+
+		err = rows.Scan(&sub, &name, &value)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading sub-quota row from database")
+		}
+
+		q := types.QuotaDetails{Name: name, Value: value}
+		results[sub] = append(results[sub], q)
+	}
+
+	return results, nil
+}
@@ -359,6 +359,78 @@ func TestUpdatePool(t *testing.T) {
 		t.Fatal("pool not updated")
 	}
 
+	pool.Tags = []string{"dmz", "partner"}
+
+	err = db.updatePool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p = db.getAllPools()[pool.ID]
+	if len(p.Tags) != 2 {
+		t.Fatalf("pool tags not updated: %v", p.Tags)
+	}
+
+	pool.Name = "renamed"
+
+	err = db.updatePool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p = db.getAllPools()[pool.ID]
+	if p.Name != "renamed" {
+		t.Fatalf("pool name not updated: %s", p.Name)
+	}
+
+	pool.Description = "partner DMZ"
+
+	err = db.updatePool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p = db.getAllPools()[pool.ID]
+	if p.Description != "partner DMZ" {
+		t.Fatalf("pool description not updated: %s", p.Description)
+	}
+
+	pool.Description = ""
+
+	err = db.updatePool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p = db.getAllPools()[pool.ID]
+	if p.Description != "" {
+		t.Fatalf("pool description not cleared: %s", p.Description)
+	}
+
+	pool.TenantID = "tenant-1"
+
+	err = db.updatePool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p = db.getAllPools()[pool.ID]
+	if p.TenantID != "tenant-1" {
+		t.Fatalf("pool tenant not updated: %s", p.TenantID)
+	}
+
+	pool.Revision = 7
+
+	err = db.updatePool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p = db.getAllPools()[pool.ID]
+	if p.Revision != 7 {
+		t.Fatalf("pool revision not updated: %d", p.Revision)
+	}
+
 	db.disconnect()
 }
 
@@ -503,7 +575,736 @@ func TestDeleteSubnet(t *testing.T) {
 	db.disconnect()
 }
 
-func TestCreateAddress(t *testing.T) {
+func TestCreateAddress(t *testing.T) {
+	db, err := getPersistentStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "test",
+	}
+
+	IP := types.ExternalIP{
+		ID:      uuid.Generate().String(),
+		Address: "192.168.0.1",
+	}
+
+	pool.IPs = append(pool.IPs, IP)
+
+	err = db.addPool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pools := db.getAllPools()
+	if pools == nil {
+		t.Fatal("pool not stored")
+	}
+
+	p, ok := pools[pool.ID]
+	if !ok || (p.Name != "test") {
+		t.Fatal("pool not stored")
+	}
+
+	addrs := p.IPs
+	if len(addrs) != 1 || addrs[0].ID != IP.ID || addrs[0].Address != IP.Address {
+		t.Fatal("address not stored correctly")
+	}
+
+	db.disconnect()
+}
+
+func TestDeleteAddress(t *testing.T) {
+	db, err := getPersistentStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "test",
+	}
+
+	IP := types.ExternalIP{
+		ID:      uuid.Generate().String(),
+		Address: "192.168.0.1",
+	}
+
+	pool.IPs = append(pool.IPs, IP)
+
+	err = db.addPool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool.IPs = []types.ExternalIP{}
+
+	err = db.updatePool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pools := db.getAllPools()
+	if pools == nil {
+		t.Fatal("pool not stored")
+	}
+
+	p, ok := pools[pool.ID]
+	if !ok || (p.Name != "test") {
+		t.Fatal("pool not stored")
+	}
+
+	addrs := p.IPs
+	if len(addrs) != 0 {
+		t.Fatal("address not deleted")
+	}
+
+	db.disconnect()
+}
+
+func TestCreateMappedIP(t *testing.T) {
+	db, err := getPersistentStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := types.Instance{
+		ID:         uuid.Generate().String(),
+		TenantID:   uuid.Generate().String(),
+		WorkloadID: uuid.Generate().String(),
+		IPAddress:  "172.16.0.2",
+	}
+
+	err = db.addInstance(&i)
+	if err != nil {
+		t.Fatalf("unable to store instance: %v\n", err)
+	}
+
+	instances, err := db.getInstances()
+	if err != nil || len(instances) != 1 {
+		t.Fatal(err)
+	}
+
+	pool := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "test",
+	}
+
+	err = db.addPool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := types.MappedIP{
+		ID:         uuid.Generate().String(),
+		ExternalIP: "192.168.0.1",
+		InternalIP: i.IPAddress,
+		InstanceID: i.ID,
+		TenantID:   i.TenantID,
+		PoolID:     pool.ID,
+		PoolName:   pool.Name,
+		Status:     types.MappedIPAttached,
+	}
+
+	err = db.addMappedIP(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	IPs := db.getMappedIPs()
+	if len(IPs) != 1 {
+		t.Fatal("could not get mapped IP")
+	}
+
+	if reflect.DeepEqual(IPs[m.ExternalIP], m) == false {
+		t.Fatalf("expected %v, got %v\n", m, IPs[m.ExternalIP])
+	}
+}
+
+func TestDeleteMappedIP(t *testing.T) {
+	db, err := getPersistentStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := types.Instance{
+		ID:         uuid.Generate().String(),
+		TenantID:   uuid.Generate().String(),
+		WorkloadID: uuid.Generate().String(),
+		IPAddress:  "172.16.0.2",
+	}
+
+	err = db.addInstance(&i)
+	if err != nil {
+		t.Fatalf("unable to store instance: %v\n", err)
+	}
+
+	instances, err := db.getInstances()
+	if err != nil || len(instances) != 1 {
+		t.Fatal(err)
+	}
+
+	pool := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "test",
+	}
+
+	err = db.addPool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := types.MappedIP{
+		ID:         uuid.Generate().String(),
+		ExternalIP: "192.168.0.1",
+		InternalIP: i.IPAddress,
+		InstanceID: i.ID,
+		TenantID:   i.TenantID,
+		PoolID:     pool.ID,
+		PoolName:   pool.Name,
+		Status:     types.MappedIPAttached,
+	}
+
+	err = db.addMappedIP(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	IPs := db.getMappedIPs()
+	if len(IPs) != 1 {
+		t.Fatal("could not get mapped IP")
+	}
+
+	if reflect.DeepEqual(IPs[m.ExternalIP], m) == false {
+		t.Fatalf("expected %v, got %v\n", m, IPs[m.ExternalIP])
+	}
+
+	err = db.deleteMappedIP(m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	IPs = db.getMappedIPs()
+	if len(IPs) != 0 {
+		t.Fatal("IP not deleted")
+	}
+}
+
+func TestReservedMappedIP(t *testing.T) {
+	db, err := getPersistentStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := types.Instance{
+		ID:         uuid.Generate().String(),
+		TenantID:   uuid.Generate().String(),
+		WorkloadID: uuid.Generate().String(),
+		IPAddress:  "172.16.0.2",
+	}
+
+	err = db.addInstance(&i)
+	if err != nil {
+		t.Fatalf("unable to store instance: %v\n", err)
+	}
+
+	pool := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "test",
+	}
+
+	err = db.addPool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := types.MappedIP{
+		ID:         uuid.Generate().String(),
+		ExternalIP: "192.168.0.1",
+		TenantID:   i.TenantID,
+		PoolID:     pool.ID,
+		PoolName:   pool.Name,
+		Status:     types.MappedIPReserved,
+	}
+
+	err = db.addMappedIP(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	IPs := db.getMappedIPs()
+	if reflect.DeepEqual(IPs[m.ExternalIP], m) == false {
+		t.Fatalf("expected %v, got %v\n", m, IPs[m.ExternalIP])
+	}
+
+	m.InstanceID = i.ID
+	m.InternalIP = i.IPAddress
+	m.Status = types.MappedIPAttached
+
+	err = db.updateMappedIP(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	IPs = db.getMappedIPs()
+	if len(IPs) != 1 {
+		t.Fatal("remapped IP listed more than once")
+	}
+
+	if reflect.DeepEqual(IPs[m.ExternalIP], m) == false {
+		t.Fatalf("expected %v, got %v\n", m, IPs[m.ExternalIP])
+	}
+
+	err = db.deleteMappedIP(m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	IPs = db.getMappedIPs()
+	if len(IPs) != 0 {
+		t.Fatal("IP not deleted")
+	}
+
+	db.disconnect()
+}
+
+func TestLeasedMappedIPs(t *testing.T) {
+	db, err := getPersistentStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "test",
+	}
+
+	err = db.addPool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expires := time.Now().Add(time.Hour)
+
+	m := types.MappedIP{
+		ID:         uuid.Generate().String(),
+		ExternalIP: "192.168.0.1",
+		TenantID:   uuid.Generate().String(),
+		PoolID:     pool.ID,
+		PoolName:   pool.Name,
+		Status:     types.MappedIPReserved,
+		Expires:    &expires,
+	}
+
+	err = db.addMappedIP(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	IP := db.getMappedIPs()[m.ExternalIP]
+	if IP.Expires == nil || !IP.Expires.Equal(expires) {
+		t.Fatalf("expected expiry %v, got %v", expires, IP.Expires)
+	}
+
+	m.Expires = nil
+
+	err = db.updateMappedIP(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	IP = db.getMappedIPs()[m.ExternalIP]
+	if IP.Expires != nil {
+		t.Fatalf("expected lease to be removed, got %v", IP.Expires)
+	}
+
+	err = db.deleteMappedIP(m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.disconnect()
+}
+
+func TestBlockMappedIPs(t *testing.T) {
+	db, err := getPersistentStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "test",
+	}
+
+	err = db.addPool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := types.MappedIP{
+		ID:         uuid.Generate().String(),
+		ExternalIP: "192.168.0.1",
+		TenantID:   uuid.Generate().String(),
+		PoolID:     pool.ID,
+		PoolName:   pool.Name,
+		Status:     types.MappedIPReserved,
+		BlockID:    uuid.Generate().String(),
+	}
+
+	err = db.addMappedIP(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	IP := db.getMappedIPs()[m.ExternalIP]
+	if IP.BlockID != m.BlockID {
+		t.Fatalf("expected block %s, got %s", m.BlockID, IP.BlockID)
+	}
+
+	err = db.deleteMappedIP(m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.disconnect()
+}
+
+func TestMappedIPClientLabels(t *testing.T) {
+	db, err := getPersistentStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "test",
+	}
+
+	err = db.addPool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := types.MappedIP{
+		ID:         uuid.Generate().String(),
+		ExternalIP: "192.168.0.1",
+		TenantID:   uuid.Generate().String(),
+		PoolID:     pool.ID,
+		PoolName:   pool.Name,
+		Status:     types.MappedIPReserved,
+		Labels: map[string]string{
+			"ticket":  "OPS-42",
+			"service": "web",
+		},
+	}
+
+	err = db.addMappedIP(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	IP := db.getMappedIPs()[m.ExternalIP]
+	if !reflect.DeepEqual(IP.Labels, m.Labels) {
+		t.Fatalf("expected labels %v, got %v", m.Labels, IP.Labels)
+	}
+
+	m.Labels = map[string]string{"service": "db"}
+
+	err = db.updateMappedIP(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	IP = db.getMappedIPs()[m.ExternalIP]
+	if !reflect.DeepEqual(IP.Labels, m.Labels) {
+		t.Fatalf("expected labels %v, got %v", m.Labels, IP.Labels)
+	}
+
+	err = db.deleteMappedIP(m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// labels must not outlive their mapping.
+	m.Labels = nil
+
+	err = db.addMappedIP(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	IP = db.getMappedIPs()[m.ExternalIP]
+	if IP.Labels != nil {
+		t.Fatalf("labels not deleted with mapping: %v", IP.Labels)
+	}
+
+	err = db.deleteMappedIP(m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.disconnect()
+}
+
+func TestMappedIPSubnetID(t *testing.T) {
+	db, err := getPersistentStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "test",
+	}
+
+	err = db.addPool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := types.MappedIP{
+		ID:         uuid.Generate().String(),
+		ExternalIP: "192.168.0.1",
+		TenantID:   uuid.Generate().String(),
+		PoolID:     pool.ID,
+		PoolName:   pool.Name,
+		Status:     types.MappedIPReserved,
+		SubnetID:   uuid.Generate().String(),
+	}
+
+	err = db.addMappedIP(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	IP := db.getMappedIPs()[m.ExternalIP]
+	if IP.SubnetID != m.SubnetID {
+		t.Fatalf("expected subnet %s, got %s", m.SubnetID, IP.SubnetID)
+	}
+
+	err = db.deleteMappedIP(m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.disconnect()
+}
+
+func TestMappedIPReservedSince(t *testing.T) {
+	db, err := getPersistentStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "test",
+	}
+
+	err = db.addPool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	since := time.Date(2017, time.June, 1, 12, 0, 0, 0, time.UTC)
+	m := types.MappedIP{
+		ID:            uuid.Generate().String(),
+		ExternalIP:    "192.168.0.1",
+		TenantID:      uuid.Generate().String(),
+		PoolID:        pool.ID,
+		PoolName:      pool.Name,
+		Status:        types.MappedIPReserved,
+		ReservedSince: &since,
+	}
+
+	err = db.addMappedIP(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	IP := db.getMappedIPs()[m.ExternalIP]
+	if IP.ReservedSince == nil || !IP.ReservedSince.Equal(since) {
+		t.Fatalf("expected reserved since %v, got %v", since, IP.ReservedSince)
+	}
+
+	err = db.deleteMappedIP(m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.disconnect()
+}
+
+func TestMappedIPCreated(t *testing.T) {
+	db, err := getPersistentStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := types.Instance{
+		ID:         uuid.Generate().String(),
+		TenantID:   uuid.Generate().String(),
+		WorkloadID: uuid.Generate().String(),
+		IPAddress:  "172.16.0.2",
+	}
+
+	err = db.addInstance(&i)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "test",
+	}
+
+	err = db.addPool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := time.Date(2017, time.March, 1, 12, 0, 0, 0, time.UTC)
+	m := types.MappedIP{
+		ID:         uuid.Generate().String(),
+		ExternalIP: "192.168.0.1",
+		TenantID:   i.TenantID,
+		PoolID:     pool.ID,
+		PoolName:   pool.Name,
+		Status:     types.MappedIPReserved,
+		Created:    &created,
+	}
+
+	err = db.addMappedIP(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	IP := db.getMappedIPs()[m.ExternalIP]
+	if IP.Created == nil || !IP.Created.Equal(created) {
+		t.Fatalf("expected created %v, got %v", created, IP.Created)
+	}
+
+	// the creation time is kept once the IP is mapped.
+	m.InstanceID = i.ID
+	m.InternalIP = i.IPAddress
+	m.Status = types.MappedIPAttached
+
+	err = db.updateMappedIP(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	IP = db.getMappedIPs()[m.ExternalIP]
+	if IP.Created == nil || !IP.Created.Equal(created) {
+		t.Fatalf("expected created %v, got %v", created, IP.Created)
+	}
+
+	err = db.deleteMappedIP(m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.disconnect()
+}
+
+func TestLabelledMappedIPs(t *testing.T) {
+	db, err := getPersistentStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := types.Instance{
+		ID:         uuid.Generate().String(),
+		TenantID:   uuid.Generate().String(),
+		WorkloadID: uuid.Generate().String(),
+		IPAddress:  "172.16.0.2",
+	}
+
+	err = db.addInstance(&i)
+	if err != nil {
+		t.Fatalf("unable to store instance: %v\n", err)
+	}
+
+	pool := types.Pool{
+		ID:   uuid.Generate().String(),
+		Name: "test",
+	}
+
+	err = db.addPool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mappings []types.MappedIP
+	for index, role := range []string{"", "management"} {
+		m := types.MappedIP{
+			ID:         uuid.Generate().String(),
+			ExternalIP: fmt.Sprintf("192.168.0.%d", index+1),
+			InternalIP: i.IPAddress,
+			InstanceID: i.ID,
+			TenantID:   i.TenantID,
+			PoolID:     pool.ID,
+			PoolName:   pool.Name,
+			Status:     types.MappedIPAttached,
+			Index:      index,
+			Role:       role,
+		}
+
+		err = db.addMappedIP(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mappings = append(mappings, m)
+	}
+
+	IPs := db.getMappedIPs()
+	if len(IPs) != len(mappings) {
+		t.Fatalf("expected %d mapped IPs, got %d", len(mappings), len(IPs))
+	}
+
+	for _, m := range mappings {
+		if reflect.DeepEqual(IPs[m.ExternalIP], m) == false {
+			t.Fatalf("expected %v, got %v\n", m, IPs[m.ExternalIP])
+		}
+	}
+
+	// the role is kept when the IP goes back to being reserved.
+	m := mappings[1]
+	m.InstanceID = ""
+	m.InternalIP = ""
+	m.Status = types.MappedIPReserved
+	m.Index = 0
+
+	err = db.updateMappedIP(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	IPs = db.getMappedIPs()
+	if reflect.DeepEqual(IPs[m.ExternalIP], m) == false {
+		t.Fatalf("expected %v, got %v\n", m, IPs[m.ExternalIP])
+	}
+
+	for _, m := range mappings {
+		err = db.deleteMappedIP(m.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	IPs = db.getMappedIPs()
+	if len(IPs) != 0 {
+		t.Fatal("IPs not deleted")
+	}
+
+	db.disconnect()
+}
+
+func TestDefaultPools(t *testing.T) {
 	db, err := getPersistentStore()
 	if err != nil {
 		t.Fatal(err)
@@ -514,168 +1315,164 @@ func TestCreateAddress(t *testing.T) {
 		Name: "test",
 	}
 
-	IP := types.ExternalIP{
-		ID:      uuid.Generate().String(),
-		Address: "192.168.0.1",
+	err = db.addPool(pool)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	pool.IPs = append(pool.IPs, IP)
+	tenantID := uuid.Generate().String()
 
-	err = db.addPool(pool)
+	err = db.updateDefaultPool(tenantID, pool.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	pools := db.getAllPools()
-	if pools == nil {
-		t.Fatal("pool not stored")
+	pools := db.getDefaultPools()
+	if pools[tenantID] != pool.ID {
+		t.Fatalf("expected default pool %s, got %s", pool.ID, pools[tenantID])
 	}
 
-	p, ok := pools[pool.ID]
-	if !ok || (p.Name != "test") {
-		t.Fatal("pool not stored")
+	err = db.updateDefaultPool(tenantID, "")
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	addrs := p.IPs
-	if len(addrs) != 1 || addrs[0].ID != IP.ID || addrs[0].Address != IP.Address {
-		t.Fatal("address not stored correctly")
+	if _, ok := db.getDefaultPools()[tenantID]; ok {
+		t.Fatal("default pool not removed")
 	}
 
-	db.disconnect()
-}
-
-func TestDeleteAddress(t *testing.T) {
-	db, err := getPersistentStore()
+	// deleting a pool removes it as a default.
+	err = db.updateDefaultPool(tenantID, pool.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	pool := types.Pool{
-		ID:   uuid.Generate().String(),
-		Name: "test",
+	err = db.deletePool(pool.ID)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	IP := types.ExternalIP{
-		ID:      uuid.Generate().String(),
-		Address: "192.168.0.1",
+	if _, ok := db.getDefaultPools()[tenantID]; ok {
+		t.Fatal("deleted pool still a default")
 	}
 
-	pool.IPs = append(pool.IPs, IP)
+	db.disconnect()
+}
 
-	err = db.addPool(pool)
+func TestPoolStrategies(t *testing.T) {
+	db, err := getPersistentStore()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	pool.IPs = []types.ExternalIP{}
+	tenantID := uuid.Generate().String()
 
-	err = db.updatePool(pool)
+	err = db.updatePoolStrategy(tenantID, types.PoolSelectionRoundRobin)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	pools := db.getAllPools()
-	if pools == nil {
-		t.Fatal("pool not stored")
+	strategies := db.getPoolStrategies()
+	if strategies[tenantID] != types.PoolSelectionRoundRobin {
+		t.Fatalf("expected strategy %s, got %s", types.PoolSelectionRoundRobin, strategies[tenantID])
 	}
 
-	p, ok := pools[pool.ID]
-	if !ok || (p.Name != "test") {
-		t.Fatal("pool not stored")
+	err = db.updatePoolStrategy(tenantID, "")
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	addrs := p.IPs
-	if len(addrs) != 0 {
-		t.Fatal("address not deleted")
+	if _, ok := db.getPoolStrategies()[tenantID]; ok {
+		t.Fatal("pool strategy not removed")
 	}
 
 	db.disconnect()
 }
 
-func TestCreateMappedIP(t *testing.T) {
+func TestAddressReservations(t *testing.T) {
 	db, err := getPersistentStore()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	i := types.Instance{
-		ID:         uuid.Generate().String(),
-		TenantID:   uuid.Generate().String(),
-		WorkloadID: uuid.Generate().String(),
-		IPAddress:  "172.16.0.2",
+	r := types.AddressReservation{
+		ID:      uuid.Generate().String(),
+		CIDR:    "10.40.25.0/24",
+		Label:   "handover",
+		Created: time.Now().UTC(),
 	}
 
-	err = db.addInstance(&i)
+	err = db.addAddressReservation(r)
 	if err != nil {
-		t.Fatalf("unable to store instance: %v\n", err)
-	}
-
-	instances, err := db.getInstances()
-	if err != nil || len(instances) != 1 {
 		t.Fatal(err)
 	}
 
-	pool := types.Pool{
-		ID:   uuid.Generate().String(),
-		Name: "test",
-	}
-
-	err = db.addPool(pool)
-	if err != nil {
-		t.Fatal(err)
+	got, ok := db.getAddressReservations()[r.ID]
+	if !ok {
+		t.Fatal("address reservation not found")
 	}
 
-	m := types.MappedIP{
-		ID:         uuid.Generate().String(),
-		ExternalIP: "192.168.0.1",
-		InternalIP: i.IPAddress,
-		InstanceID: i.ID,
-		TenantID:   i.TenantID,
-		PoolID:     pool.ID,
-		PoolName:   pool.Name,
+	if got.CIDR != r.CIDR || got.Label != r.Label || !got.Created.Equal(r.Created) {
+		t.Fatalf("expected %+v, got %+v", r, got)
 	}
 
-	err = db.addMappedIP(m)
+	err = db.deleteAddressReservation(r.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	IPs := db.getMappedIPs()
-	if len(IPs) != 1 {
-		t.Fatal("could not get mapped IP")
+	if _, ok := db.getAddressReservations()[r.ID]; ok {
+		t.Fatal("address reservation not removed")
 	}
 
-	if reflect.DeepEqual(IPs[m.ExternalIP], m) == false {
-		t.Fatalf("expected %v, got %v\n", m, IPs[m.ExternalIP])
-	}
+	db.disconnect()
 }
 
-func TestDeleteMappedIP(t *testing.T) {
+func TestTenantEnabled(t *testing.T) {
 	db, err := getPersistentStore()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	i := types.Instance{
-		ID:         uuid.Generate().String(),
-		TenantID:   uuid.Generate().String(),
-		WorkloadID: uuid.Generate().String(),
-		IPAddress:  "172.16.0.2",
-	}
+	tenantID := uuid.Generate().String()
 
-	err = db.addInstance(&i)
+	err = db.addTenant(tenantID, "test")
 	if err != nil {
-		t.Fatalf("unable to store instance: %v\n", err)
+		t.Fatal(err)
 	}
 
-	instances, err := db.getInstances()
-	if err != nil || len(instances) != 1 {
+	for _, enabled := range []bool{false, false, true} {
+		err = db.updateTenantEnabled(tenantID, enabled)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tenant, err := db.getTenant(tenantID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tenant.Enabled != enabled {
+			t.Fatalf("Expected enabled %v, got %v", enabled, tenant.Enabled)
+		}
+	}
+
+	db.disconnect()
+}
+
+func TestDrainedPools(t *testing.T) {
+	db, err := getPersistentStore()
+	if err != nil {
 		t.Fatal(err)
 	}
 
 	pool := types.Pool{
 		ID:   uuid.Generate().String(),
 		Name: "test",
+		Subnets: []types.ExternalSubnet{
+			{ID: uuid.Generate().String(), CIDR: "192.168.10.0/24"},
+			{ID: uuid.Generate().String(), CIDR: "192.168.11.0/24", Drained: true},
+		},
 	}
 
 	err = db.addPool(pool)
@@ -683,39 +1480,47 @@ func TestDeleteMappedIP(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	m := types.MappedIP{
-		ID:         uuid.Generate().String(),
-		ExternalIP: "192.168.0.1",
-		InternalIP: i.IPAddress,
-		InstanceID: i.ID,
-		TenantID:   i.TenantID,
-		PoolID:     pool.ID,
-		PoolName:   pool.Name,
+	err = db.updatePool(pool)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	err = db.addMappedIP(m)
+	p := db.getAllPools()[pool.ID]
+	if p.Drained || len(p.Subnets) != 2 {
+		t.Fatalf("unexpected pool %+v", p)
+	}
+
+	for _, subnet := range p.Subnets {
+		if subnet.Drained != (subnet.ID == pool.Subnets[1].ID) {
+			t.Fatalf("subnet %s drained state not stored", subnet.CIDR)
+		}
+	}
+
+	pool.Drained = true
+	pool.Subnets[1].Drained = false
+
+	err = db.updatePool(pool)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	IPs := db.getMappedIPs()
-	if len(IPs) != 1 {
-		t.Fatal("could not get mapped IP")
+	p = db.getAllPools()[pool.ID]
+	if !p.Drained {
+		t.Fatal("pool drained state not stored")
 	}
 
-	if reflect.DeepEqual(IPs[m.ExternalIP], m) == false {
-		t.Fatalf("expected %v, got %v\n", m, IPs[m.ExternalIP])
+	for _, subnet := range p.Subnets {
+		if subnet.Drained {
+			t.Fatalf("subnet %s still drained", subnet.CIDR)
+		}
 	}
 
-	err = db.deleteMappedIP(m.ID)
+	err = db.deletePool(pool.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	IPs = db.getMappedIPs()
-	if len(IPs) != 0 {
-		t.Fatal("IP not deleted")
-	}
+	db.disconnect()
 }
 
 func createTestTenant(db persistentStore, t *testing.T) *tenant {
@@ -954,6 +1759,10 @@ users:
 		Config:      testConfig,
 		Defaults:    []payloads.RequestedResource{mem, cpus},
 		Storage:     []types.StorageResource{storage},
+		Environment: []types.WorkloadDefault{
+			{Name: "MONITORING_URL", Value: "http://monitor", Required: true},
+			{Name: "LOG_LEVEL"},
+		},
 	}
 
 	// file will be added, so we will want to remove it.
@@ -982,6 +1791,33 @@ users:
 		t.Fatal("Expected workload equality")
 	}
 
+	// updating the workload replaces its resources.
+	wl.Description = "updatedWorkload"
+	wl.Config = "updated config"
+	wl.Defaults = []payloads.RequestedResource{cpus}
+	wl.Storage = []types.StorageResource{}
+	wl.Environment = []types.WorkloadDefault{{Name: "LOG_LEVEL", Value: "debug"}}
+
+	err = db.updateWorkload(wl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenant, err = db.getTenant(tn.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tenant.workloads) != 1 {
+		t.Fatal("Expected a workload associated with tenant")
+	}
+
+	wl2 = tenant.workloads[0]
+	if wl2.Description != wl.Description || wl2.Config != wl.Config || len(wl2.Storage) != 0 ||
+		!reflect.DeepEqual(wl2.Defaults, wl.Defaults) || !reflect.DeepEqual(wl2.Environment, wl.Environment) {
+		t.Fatalf("got %+v, expected %+v", wl2, wl)
+	}
+
 	// now try to delete the workload
 	err = db.deleteWorkload(wl.ID)
 	if err != nil {
@@ -1106,6 +1942,140 @@ func TestSQLiteDBUpdateQuotas(t *testing.T) {
 	}
 }
 
+func TestSQLiteDBDeleteQuotas(t *testing.T) {
+	db, err := getPersistentStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.updateQuotas("test-delete-tenant-id", []types.QuotaDetails{{Name: "test-quota-name", Value: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.deleteQuotas("test-delete-tenant-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qds, err := db.getQuotas("test-delete-tenant-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(qds) != 0 {
+		t.Fatalf("Expected zero quota entries: got %d", len(qds))
+	}
+
+	// deleting again is not an error.
+	err = db.deleteQuotas("test-delete-tenant-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLiteDBAddressHistory(t *testing.T) {
+	db, err := getPersistentStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	records := []types.AssignmentRecord{
+		{
+			Timestamp:  now,
+			Action:     types.AssignmentMapped,
+			MappingID:  uuid.Generate().String(),
+			TenantID:   uuid.Generate().String(),
+			InstanceID: uuid.Generate().String(),
+			InternalIP: "172.16.0.2",
+		},
+		{
+			Timestamp: now.Add(time.Minute),
+			Action:    types.AssignmentReleased,
+			MappingID: uuid.Generate().String(),
+			TenantID:  uuid.Generate().String(),
+		},
+	}
+
+	for _, r := range records {
+		err = db.addAssignmentRecord("203.0.113.200", r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	history, err := db.getAddressHistory("203.0.113.200")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(history) != len(records) {
+		t.Fatalf("expected %d records, got %+v", len(records), history)
+	}
+
+	for i := range records {
+		if !history[i].Timestamp.Equal(records[i].Timestamp) {
+			t.Errorf("expected time %v, got %v", records[i].Timestamp, history[i].Timestamp)
+		}
+		history[i].Timestamp = records[i].Timestamp
+
+		if history[i] != records[i] {
+			t.Errorf("expected %+v, got %+v", records[i], history[i])
+		}
+	}
+
+	history, err = db.getAddressHistory("203.0.113.201")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(history) != 0 {
+		t.Fatalf("expected no history, got %+v", history)
+	}
+}
+
+func TestSQLiteDBUpdateSubQuotas(t *testing.T) {
+	db, err := getPersistentStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenantID := uuid.Generate().String()
+
+	err = db.updateSubQuotas(tenantID, "project-1", []types.QuotaDetails{{Name: "test-quota-name", Value: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.updateSubQuotas(tenantID, "project-2", []types.QuotaDetails{{Name: "test-quota-name", Value: 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.updateSubQuotas(tenantID, "project-1", []types.QuotaDetails{{Name: "test-quota-name", Value: 20}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subs, err := db.getSubQuotas(tenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(subs) != 2 {
+		t.Fatalf("Expected 2 sub-quotas: got %d", len(subs))
+	}
+
+	if len(subs["project-1"]) != 1 || !findQuota(subs["project-1"], "test-quota-name", 20) {
+		t.Fatal("Updated sub-quota not found")
+	}
+
+	if !findQuota(subs["project-2"], "test-quota-name", 5) {
+		t.Fatal("Added sub-quota not found")
+	}
+}
+
 func TestInstanceNameConstraint(t *testing.T) {
 	t.Skip("Name constraint not currently enforced #1365")
 	db, err := getPersistentStore()
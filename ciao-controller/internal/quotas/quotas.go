@@ -15,6 +15,8 @@
 package quotas
 
 import (
+	"time"
+
 	"github.com/01org/ciao/ciao-controller/types"
 	"github.com/01org/ciao/payloads"
 )
@@ -27,9 +29,17 @@ type quota struct {
 type tenantData struct {
 	quotas map[payloads.Resource]*quota
 
+	// subQuotas divide the quotas of the tenant between its projects,
+	// keyed by the name of the sub-quota.
+	subQuotas map[string]map[payloads.Resource]*quota
+
 	perInstanceVCPUs  int
 	perInstanceMemory int
 	perVolumeSize     int
+
+	// ipTime is the total time the tenant's external IPs have been
+	// allocated for. Its usage is reported in whole hours.
+	ipTime time.Duration
 }
 
 // Quotas provides a quota and limit service
@@ -46,12 +56,14 @@ type Result interface {
 
 type consumeOp struct {
 	tenantID  string
+	sub       string
 	resources []payloads.RequestedResource
 	ch        chan Result
 }
 
 type releaseOp struct {
 	tenantID  string
+	sub       string
 	resources []payloads.RequestedResource
 }
 
@@ -61,6 +73,30 @@ type updateOp struct {
 	doneCh   chan struct{}
 }
 
+type updateSubOp struct {
+	tenantID string
+	sub      string
+	quotas   []types.QuotaDetails
+	ch       chan error
+}
+
+type dumpSubOp struct {
+	tenantID string
+	sub      string
+	ch       chan []types.QuotaDetails
+}
+
+type setUsageOp struct {
+	tenantID  string
+	resources []payloads.RequestedResource
+	doneCh    chan struct{}
+}
+
+type accrueOp struct {
+	tenantID string
+	d        time.Duration
+}
+
 type dumpOp struct {
 	tenantID string
 	ch       chan []types.QuotaDetails
@@ -80,16 +116,24 @@ var supportedResources = [...]payloads.Resource{
 	payloads.Instance,
 	payloads.Image,
 	payloads.ExternalIP,
+	payloads.ExternalIPHours,
 }
 
-func makeTentantData() *tenantData {
-	td := tenantData{}
-	td.quotas = make(map[payloads.Resource]*quota)
+func makeQuotas() map[payloads.Resource]*quota {
+	quotas := make(map[payloads.Resource]*quota)
 
 	for _, resource := range supportedResources {
-		td.quotas[resource] = &quota{-1, 0}
+		quotas[resource] = &quota{-1, 0}
 	}
 
+	return quotas
+}
+
+func makeTentantData() *tenantData {
+	td := tenantData{}
+	td.quotas = makeQuotas()
+	td.subQuotas = make(map[string]map[payloads.Resource]*quota)
+
 	td.perInstanceMemory = -1
 	td.perInstanceVCPUs = -1
 	td.perVolumeSize = -1
@@ -107,12 +151,23 @@ func getTenantData(tenantDetails map[string]*tenantData, tenantID string) *tenan
 	return td
 }
 
-func consumeQuota(tenantDetails map[string]*tenantData, op *consumeOp) Result {
-	td := getTenantData(tenantDetails, op.tenantID)
+func getSubQuotas(td *tenantData, sub string) map[payloads.Resource]*quota {
+	quotas, ok := td.subQuotas[sub]
+	if !ok {
+		quotas = makeQuotas()
+		td.subQuotas[sub] = quotas
+	}
+
+	return quotas
+}
+
+// consume debits resources from quotas, returning false if any quota
+// is then exceeded.
+func consume(quotas map[payloads.Resource]*quota, resources []payloads.RequestedResource) bool {
 	allowed := true
 
-	for _, r := range op.resources {
-		q, ok := td.quotas[r.Type]
+	for _, r := range resources {
+		q, ok := quotas[r.Type]
 
 		if ok {
 			q.consumed += r.Value
@@ -122,6 +177,22 @@ func consumeQuota(tenantDetails map[string]*tenantData, op *consumeOp) Result {
 		}
 	}
 
+	return allowed
+}
+
+func consumeQuota(tenantDetails map[string]*tenantData, op *consumeOp) Result {
+	td := getTenantData(tenantDetails, op.tenantID)
+
+	allowed := consume(td.quotas, op.resources)
+
+	// resources used by a project count against both its sub-quota
+	// and the quota of the tenant.
+	if op.sub != "" {
+		if !consume(getSubQuotas(td, op.sub), op.resources) {
+			allowed = false
+		}
+	}
+
 	res := &result{resources: op.resources}
 	res.allowed = allowed
 	if !allowed {
@@ -160,21 +231,60 @@ func checkLimit(tenantDetails map[string]*tenantData, op *consumeOp) Result {
 	return res
 }
 
+func releaseQuotas(quotas map[payloads.Resource]*quota, resources []payloads.RequestedResource) {
+	for _, r := range resources {
+		q, ok := quotas[r.Type]
+
+		if ok {
+			q.consumed -= r.Value
+			if q.consumed < 0 {
+				q.consumed = 0
+			}
+		}
+	}
+}
+
 func release(tenantDetails map[string]*tenantData, op *releaseOp) {
 	td := getTenantData(tenantDetails, op.tenantID)
 
+	releaseQuotas(td.quotas, op.resources)
+
+	if op.sub != "" {
+		releaseQuotas(getSubQuotas(td, op.sub), op.resources)
+	}
+}
+
+// setUsage replaces the usage of a tenant. Time based usage is accrued
+// rather than counted, so it is not changed.
+func setUsage(tenantDetails map[string]*tenantData, op *setUsageOp) {
+	td := getTenantData(tenantDetails, op.tenantID)
+
+	for r, q := range td.quotas {
+		if r != payloads.ExternalIPHours {
+			q.consumed = 0
+		}
+	}
+
 	for _, r := range op.resources {
+		if r.Type == payloads.ExternalIPHours {
+			continue
+		}
+
 		q, ok := td.quotas[r.Type]
 
 		if ok {
-			q.consumed -= r.Value
-			if q.consumed < 0 {
-				q.consumed = 0
-			}
+			q.consumed += r.Value
 		}
 	}
 }
 
+func accrue(tenantDetails map[string]*tenantData, op *accrueOp) {
+	td := getTenantData(tenantDetails, op.tenantID)
+
+	td.ipTime += op.d
+	td.quotas[payloads.ExternalIPHours].consumed = int(td.ipTime / time.Hour)
+}
+
 func quotaNameToResource(name string) payloads.Resource {
 	switch name {
 	case "tenant-vcpu-quota":
@@ -191,6 +301,8 @@ func quotaNameToResource(name string) payloads.Resource {
 		return payloads.Image
 	case "tenant-external-ips-quota":
 		return payloads.ExternalIP
+	case "tenant-ip-hours-quota":
+		return payloads.ExternalIPHours
 	}
 
 	return ""
@@ -212,10 +324,92 @@ func resourceToQuotaName(r payloads.Resource) string {
 		return "tenant-images-quota"
 	case payloads.ExternalIP:
 		return "tenant-external-ips-quota"
+	case payloads.ExternalIPHours:
+		return "tenant-ip-hours-quota"
 	}
 	return ""
 }
 
+// resourceUnit returns the unit the quota for a resource is measured in.
+func resourceUnit(r payloads.Resource) string {
+	switch r {
+	case payloads.VCPUs:
+		return types.QuotaUnitVCPU
+	case payloads.MemMB:
+		return types.QuotaUnitMB
+	case payloads.SharedDiskGiB:
+		return types.QuotaUnitGB
+	case payloads.ExternalIPHours:
+		return types.QuotaUnitHour
+	}
+
+	return types.QuotaUnitCount
+}
+
+// quotaKind returns the kind of quota measured in unit.
+func quotaKind(unit string) string {
+	switch unit {
+	case types.QuotaUnitMB, types.QuotaUnitGB:
+		return types.QuotaKindSize
+	case types.QuotaUnitHour:
+		return types.QuotaKindDuration
+	}
+
+	return types.QuotaKindCount
+}
+
+var resourceDescriptions = map[payloads.Resource]string{
+	payloads.VCPUs:           "Total VCPUs of the tenant's instances",
+	payloads.MemMB:           "Total memory of the tenant's instances",
+	payloads.Volume:          "Number of volumes",
+	payloads.SharedDiskGiB:   "Total size of the tenant's volumes",
+	payloads.Instance:        "Number of instances",
+	payloads.Image:           "Number of images",
+	payloads.ExternalIP:      "Number of mapped or reserved external IPs",
+	payloads.ExternalIPHours: "Total time external IPs have been held for",
+}
+
+// limitDefinitions are the quotas which limit each instance or volume,
+// rather than the tenant's total usage.
+var limitDefinitions = []types.QuotaDefinition{
+	{
+		Name:        "tenant-vcpu-per-instance-limit",
+		Unit:        types.QuotaUnitVCPU,
+		Kind:        types.QuotaKindCount,
+		Description: "VCPUs of each instance",
+	},
+	{
+		Name:        "tenant-mem-per-instance-limit",
+		Unit:        types.QuotaUnitMB,
+		Kind:        types.QuotaKindSize,
+		Description: "Memory of each instance",
+	},
+	{
+		Name:        "tenant-volume-size-limit",
+		Unit:        types.QuotaUnitGB,
+		Kind:        types.QuotaKindSize,
+		Description: "Size of each volume",
+	},
+}
+
+// Definitions returns every quota which can be set for a tenant, in the
+// order they are listed.
+func Definitions() []types.QuotaDefinition {
+	defs := make([]types.QuotaDefinition, 0, len(supportedResources)+len(limitDefinitions))
+
+	for _, r := range supportedResources {
+		unit := resourceUnit(r)
+		defs = append(defs, types.QuotaDefinition{
+			Name:        resourceToQuotaName(r),
+			Unit:        unit,
+			Kind:        quotaKind(unit),
+			Description: resourceDescriptions[r],
+		})
+	}
+
+	return append(defs, limitDefinitions...)
+}
+
 func update(tenantDetails map[string]*tenantData, op *updateOp) {
 	td := getTenantData(tenantDetails, op.tenantID)
 
@@ -237,6 +431,69 @@ func update(tenantDetails map[string]*tenantData, op *updateOp) {
 	}
 }
 
+// updateSub sets the limits of a sub-quota. The limits of the sub-quotas of
+// a tenant may not add up to more than the tenant's own limit, though a
+// sub-quota without a limit is only bounded by the tenant's limit. No
+// limit is changed if any would exceed its tenant limit.
+func updateSub(tenantDetails map[string]*tenantData, op *updateSubOp) error {
+	td := getTenantData(tenantDetails, op.tenantID)
+
+	for _, q := range op.quotas {
+		r := quotaNameToResource(q.Name)
+		if r == "" || q.Value < 0 {
+			continue
+		}
+
+		parent := td.quotas[r].limit
+		if parent < 0 {
+			continue
+		}
+
+		available := parent
+		for name, quotas := range td.subQuotas {
+			if name != op.sub && quotas[r].limit > -1 {
+				available -= quotas[r].limit
+			}
+		}
+
+		if q.Value > available {
+			return types.SubQuotaExceedsParentError{
+				Name:      q.Name,
+				Value:     q.Value,
+				Available: available,
+			}
+		}
+	}
+
+	quotas := getSubQuotas(td, op.sub)
+	for _, q := range op.quotas {
+		r := quotaNameToResource(q.Name)
+		if r != "" {
+			quotas[r].limit = q.Value
+		}
+	}
+
+	return nil
+}
+
+func dumpSub(tenantDetails map[string]*tenantData, op *dumpSubOp) []types.QuotaDetails {
+	td := getTenantData(tenantDetails, op.tenantID)
+
+	qds := []types.QuotaDetails{}
+
+	for r, q := range getSubQuotas(td, op.sub) {
+		qd := types.QuotaDetails{
+			Name:  resourceToQuotaName(r),
+			Value: q.limit,
+			Usage: q.consumed,
+			Unit:  resourceUnit(r),
+		}
+		qds = append(qds, qd)
+	}
+
+	return qds
+}
+
 func dump(tenantDetails map[string]*tenantData, op *dumpOp) []types.QuotaDetails {
 	td := getTenantData(tenantDetails, op.tenantID)
 
@@ -249,6 +506,7 @@ func dump(tenantDetails map[string]*tenantData, op *dumpOp) []types.QuotaDetails
 				Name:  name,
 				Value: q.limit,
 				Usage: q.consumed,
+				Unit:  resourceUnit(r),
 			}
 			qds = append(qds, qd)
 		}
@@ -257,16 +515,19 @@ func dump(tenantDetails map[string]*tenantData, op *dumpOp) []types.QuotaDetails
 	qd := types.QuotaDetails{
 		Name:  "tenant-vcpu-per-instance-limit",
 		Value: td.perInstanceVCPUs,
+		Unit:  types.QuotaUnitVCPU,
 	}
 	qds = append(qds, qd)
 	qd = types.QuotaDetails{
 		Name:  "tenant-mem-per-instance-limit",
 		Value: td.perInstanceMemory,
+		Unit:  types.QuotaUnitMB,
 	}
 	qds = append(qds, qd)
 	qd = types.QuotaDetails{
 		Name:  "tenant-volume-size-limit",
 		Value: td.perVolumeSize,
+		Unit:  types.QuotaUnitGB,
 	}
 	qds = append(qds, qd)
 
@@ -309,6 +570,25 @@ func (qs *Quotas) Init() {
 				update(tenantDetails, updateData)
 				close(updateData.doneCh)
 
+			case *updateSubOp:
+				updateSubData := data.(*updateSubOp)
+				updateSubData.ch <- updateSub(tenantDetails, updateSubData)
+				close(updateSubData.ch)
+
+			case *dumpSubOp:
+				dumpSubData := data.(*dumpSubOp)
+				dumpSubData.ch <- dumpSub(tenantDetails, dumpSubData)
+				close(dumpSubData.ch)
+
+			case *setUsageOp:
+				setUsageData := data.(*setUsageOp)
+				setUsage(tenantDetails, setUsageData)
+				close(setUsageData.doneCh)
+
+			case *accrueOp:
+				accrueData := data.(*accrueOp)
+				accrue(tenantDetails, accrueData)
+
 			case *dumpOp:
 				dumpData := data.(*dumpOp)
 				dumpData.ch <- dump(tenantDetails, dumpData)
@@ -344,7 +624,19 @@ func copyResources(resources []payloads.RequestedResource) []payloads.RequestedR
 // Result.Reason() returns an explanation that can be shared with the user.
 func (qs *Quotas) Consume(tenantID string, resources ...payloads.RequestedResource) chan Result {
 	ch := make(chan Result, 1)
-	data := &consumeOp{tenantID, copyResources(resources), ch}
+	data := &consumeOp{tenantID, "", copyResources(resources), ch}
+	qs.ch <- data
+
+	return ch
+}
+
+// ConsumeSubQuota is like Consume, but the resources are used by a project
+// of the tenant and so count against the named sub-quota as well as the
+// tenant's quota. The consumption is only allowed if neither is exceeded.
+// Resources consumed this way must be released with ReleaseSubQuota.
+func (qs *Quotas) ConsumeSubQuota(tenantID string, sub string, resources ...payloads.RequestedResource) chan Result {
+	ch := make(chan Result, 1)
+	data := &consumeOp{tenantID, sub, copyResources(resources), ch}
 	qs.ch <- data
 
 	return ch
@@ -353,7 +645,14 @@ func (qs *Quotas) Consume(tenantID string, resources ...payloads.RequestedResour
 // Release will update the quota records for a tenant to indicate that it is no
 // longer using the supplied resources.
 func (qs *Quotas) Release(tenantID string, resources ...payloads.RequestedResource) {
-	data := &releaseOp{tenantID, copyResources(resources)}
+	data := &releaseOp{tenantID, "", copyResources(resources)}
+	qs.ch <- data
+}
+
+// ReleaseSubQuota returns resources used by a project of a tenant to both
+// the named sub-quota and the tenant's quota.
+func (qs *Quotas) ReleaseSubQuota(tenantID string, sub string, resources ...payloads.RequestedResource) {
+	data := &releaseOp{tenantID, sub, copyResources(resources)}
 	qs.ch <- data
 }
 
@@ -371,6 +670,46 @@ func (qs *Quotas) Update(tenantID string, quotas []types.QuotaDetails) {
 	<-ch
 }
 
+// UpdateSubQuota sets the limits of the named sub-quota of a tenant. A
+// types.SubQuotaExceedsParentError is returned, and nothing is changed, if
+// the limits of the tenant's sub-quotas would add up to more than its own.
+// Per instance and per volume limits do not apply to sub-quotas and are
+// ignored.
+func (qs *Quotas) UpdateSubQuota(tenantID string, sub string, quotas []types.QuotaDetails) error {
+	ch := make(chan error, 1)
+	op := &updateSubOp{tenantID, sub, quotas, ch}
+	qs.ch <- op
+	return <-ch
+}
+
+// DumpSubQuota provides the limits and usage of the named sub-quota of a
+// tenant.
+func (qs *Quotas) DumpSubQuota(tenantID string, sub string) []types.QuotaDetails {
+	ch := make(chan []types.QuotaDetails, 1)
+	op := &dumpSubOp{tenantID, sub, ch}
+	qs.ch <- op
+	return <-ch
+}
+
+// SetUsage replaces the recorded usage of a tenant with the total of the
+// supplied resources. Any resource which is not supplied is recorded as
+// unused. Unlike Consume the usage is not checked against the quotas.
+func (qs *Quotas) SetUsage(tenantID string, resources ...payloads.RequestedResource) {
+	ch := make(chan struct{})
+	op := &setUsageOp{tenantID, copyResources(resources), ch}
+	qs.ch <- op
+	<-ch
+}
+
+// AccrueIPTime adds to the time a tenant's external IPs have been
+// allocated for, which is reported as the usage of the
+// tenant-ip-hours-quota. The time is only kept by the quota service and
+// so starts again from zero when the controller is restarted.
+func (qs *Quotas) AccrueIPTime(tenantID string, d time.Duration) {
+	data := &accrueOp{tenantID, d}
+	qs.ch <- data
+}
+
 // DumpQuotas provides the list of quotas and limits along with usage
 // for a given tenant
 func (qs *Quotas) DumpQuotas(tenantID string) []types.QuotaDetails {
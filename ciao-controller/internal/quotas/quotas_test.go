@@ -17,6 +17,7 @@ package quotas
 import (
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/01org/ciao/ciao-controller/types"
 	"github.com/01org/ciao/payloads"
@@ -75,8 +76,8 @@ func TestDumpQuotas(t *testing.T) {
 	qs.Init()
 
 	quotas := []types.QuotaDetails{
-		{Name: "tenant-vcpu-quota", Value: 10},
-		{Name: "tenant-mem-quota", Value: 100},
+		{Name: "tenant-vcpu-quota", Value: 10, Unit: types.QuotaUnitVCPU},
+		{Name: "tenant-mem-quota", Value: 100, Unit: types.QuotaUnitMB},
 	}
 
 	qs.Update("test-tenant-1", quotas)
@@ -89,20 +90,67 @@ func TestDumpQuotas(t *testing.T) {
 	qs.Shutdown()
 }
 
-func TestTenantSeparation(t *testing.T) {
+func TestSetUsage(t *testing.T) {
 	qs := &Quotas{}
 	qs.Init()
 
-	t1Quotas := []types.QuotaDetails{
+	quotas := []types.QuotaDetails{
 		{Name: "tenant-vcpu-quota", Value: 10},
 		{Name: "tenant-mem-quota", Value: 100},
 	}
 
+	qs.Update("test-tenant-1", quotas)
+
+	<-qs.Consume("test-tenant-1",
+		payloads.RequestedResource{Type: payloads.VCPUs, Value: 8},
+		payloads.RequestedResource{Type: payloads.MemMB, Value: 50})
+
+	qs.SetUsage("test-tenant-1",
+		payloads.RequestedResource{Type: payloads.VCPUs, Value: 2},
+		payloads.RequestedResource{Type: payloads.VCPUs, Value: 1})
+
+	dumpedQuotas := qs.DumpQuotas("test-tenant-1")
+
+	testHasQuota(t, dumpedQuotas, types.QuotaDetails{Name: "tenant-vcpu-quota", Value: 10, Usage: 3, Unit: types.QuotaUnitVCPU})
+	testHasQuota(t, dumpedQuotas, types.QuotaDetails{Name: "tenant-mem-quota", Value: 100, Usage: 0, Unit: types.QuotaUnitMB})
+
+	qs.Shutdown()
+}
+
+func TestAccrueIPTime(t *testing.T) {
+	qs := &Quotas{}
+	qs.Init()
+
+	qs.Update("test-tenant-1", []types.QuotaDetails{{Name: "tenant-ip-hours-quota", Value: 100}})
+
+	qs.AccrueIPTime("test-tenant-1", 40*time.Minute)
+	qs.AccrueIPTime("test-tenant-1", 40*time.Minute)
+	qs.AccrueIPTime("test-tenant-2", 3*time.Hour)
+
+	testHasQuota(t, qs.DumpQuotas("test-tenant-1"), types.QuotaDetails{Name: "tenant-ip-hours-quota", Value: 100, Usage: 1, Unit: types.QuotaUnitHour})
+	testHasQuota(t, qs.DumpQuotas("test-tenant-2"), types.QuotaDetails{Name: "tenant-ip-hours-quota", Value: -1, Usage: 3, Unit: types.QuotaUnitHour})
+
+	// the accrued time survives the usage being replaced.
+	qs.SetUsage("test-tenant-1", payloads.RequestedResource{Type: payloads.ExternalIP, Value: 1})
+	testHasQuota(t, qs.DumpQuotas("test-tenant-1"), types.QuotaDetails{Name: "tenant-ip-hours-quota", Value: 100, Usage: 1, Unit: types.QuotaUnitHour})
+
+	qs.Shutdown()
+}
+
+func TestTenantSeparation(t *testing.T) {
+	qs := &Quotas{}
+	qs.Init()
+
+	t1Quotas := []types.QuotaDetails{
+		{Name: "tenant-vcpu-quota", Value: 10, Unit: types.QuotaUnitVCPU},
+		{Name: "tenant-mem-quota", Value: 100, Unit: types.QuotaUnitMB},
+	}
+
 	qs.Update("test-tenant-1", t1Quotas)
 
 	t2Quotas := []types.QuotaDetails{
-		{Name: "tenant-vcpu-quota", Value: 20},
-		{Name: "tenant-mem-quota", Value: 40},
+		{Name: "tenant-vcpu-quota", Value: 20, Unit: types.QuotaUnitVCPU},
+		{Name: "tenant-mem-quota", Value: 40, Unit: types.QuotaUnitMB},
 	}
 
 	qs.Update("test-tenant-2", t2Quotas)
@@ -120,6 +168,59 @@ func TestTenantSeparation(t *testing.T) {
 	qs.Shutdown()
 }
 
+func TestSubQuotas(t *testing.T) {
+	qs := &Quotas{}
+	qs.Init()
+
+	qs.Update("test-tenant-1", []types.QuotaDetails{{Name: "tenant-vcpu-quota", Value: 10}})
+
+	err := qs.UpdateSubQuota("test-tenant-1", "project-1", []types.QuotaDetails{{Name: "tenant-vcpu-quota", Value: 6}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = qs.UpdateSubQuota("test-tenant-1", "project-2", []types.QuotaDetails{{Name: "tenant-vcpu-quota", Value: 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// increasing a sub-quota past what the others leave is refused.
+	err = qs.UpdateSubQuota("test-tenant-1", "project-2", []types.QuotaDetails{{Name: "tenant-vcpu-quota", Value: 5}})
+	expected := types.SubQuotaExceedsParentError{Name: "tenant-vcpu-quota", Value: 5, Available: 4}
+	if err != expected {
+		t.Fatalf("expected %v, got %v", expected, err)
+	}
+
+	testHasQuota(t, qs.DumpSubQuota("test-tenant-1", "project-2"),
+		types.QuotaDetails{Name: "tenant-vcpu-quota", Value: 4, Unit: types.QuotaUnitVCPU})
+
+	// using a sub-quota debits the tenant quota too.
+	res := <-qs.ConsumeSubQuota("test-tenant-1", "project-1", payloads.RequestedResource{Type: payloads.VCPUs, Value: 6})
+	if !res.Allowed() {
+		t.Fatal("Expected to be allowed")
+	}
+
+	testHasQuota(t, qs.DumpSubQuota("test-tenant-1", "project-1"),
+		types.QuotaDetails{Name: "tenant-vcpu-quota", Value: 6, Usage: 6, Unit: types.QuotaUnitVCPU})
+	testHasQuota(t, qs.DumpQuotas("test-tenant-1"),
+		types.QuotaDetails{Name: "tenant-vcpu-quota", Value: 10, Usage: 6, Unit: types.QuotaUnitVCPU})
+
+	res = <-qs.ConsumeSubQuota("test-tenant-1", "project-1", payloads.RequestedResource{Type: payloads.VCPUs, Value: 1})
+	if res.Allowed() {
+		t.Fatal("Expected to be denied")
+	}
+	qs.ReleaseSubQuota("test-tenant-1", "project-1", res.Resources()...)
+
+	qs.ReleaseSubQuota("test-tenant-1", "project-1", payloads.RequestedResource{Type: payloads.VCPUs, Value: 6})
+
+	testHasQuota(t, qs.DumpSubQuota("test-tenant-1", "project-1"),
+		types.QuotaDetails{Name: "tenant-vcpu-quota", Value: 6, Usage: 0, Unit: types.QuotaUnitVCPU})
+	testHasQuota(t, qs.DumpQuotas("test-tenant-1"),
+		types.QuotaDetails{Name: "tenant-vcpu-quota", Value: 10, Usage: 0, Unit: types.QuotaUnitVCPU})
+
+	qs.Shutdown()
+}
+
 func TestResourceQuotaMapping(t *testing.T) {
 	resources := []payloads.Resource{
 		payloads.VCPUs,
@@ -129,6 +230,7 @@ func TestResourceQuotaMapping(t *testing.T) {
 		payloads.Instance,
 		payloads.Image,
 		payloads.ExternalIP,
+		payloads.ExternalIPHours,
 	}
 
 	for _, resource := range resources {
@@ -141,14 +243,67 @@ func TestResourceQuotaMapping(t *testing.T) {
 	}
 }
 
+func TestResourceUnit(t *testing.T) {
+	units := map[payloads.Resource]string{
+		payloads.VCPUs:           types.QuotaUnitVCPU,
+		payloads.MemMB:           types.QuotaUnitMB,
+		payloads.SharedDiskGiB:   types.QuotaUnitGB,
+		payloads.Volume:          types.QuotaUnitCount,
+		payloads.Instance:        types.QuotaUnitCount,
+		payloads.Image:           types.QuotaUnitCount,
+		payloads.ExternalIP:      types.QuotaUnitCount,
+		payloads.ExternalIPHours: types.QuotaUnitHour,
+	}
+
+	for resource, unit := range units {
+		if resourceUnit(resource) != unit {
+			t.Errorf("%s: got unit %s, expected %s", resource, resourceUnit(resource), unit)
+		}
+	}
+}
+
+func TestDefinitions(t *testing.T) {
+	qs := &Quotas{}
+	qs.Init()
+
+	defs := make(map[string]types.QuotaDefinition)
+	for _, d := range Definitions() {
+		if d.Description == "" {
+			t.Errorf("%s has no description", d.Name)
+		}
+		defs[d.Name] = d
+	}
+
+	dumpedQuotas := qs.DumpQuotas("test-tenant-defs")
+	if len(defs) != len(dumpedQuotas) {
+		t.Fatalf("got %d definitions, expected %d", len(defs), len(dumpedQuotas))
+	}
+
+	for _, qd := range dumpedQuotas {
+		d, ok := defs[qd.Name]
+		if !ok {
+			t.Errorf("%s has no definition", qd.Name)
+			continue
+		}
+
+		if d.Unit != qd.Unit {
+			t.Errorf("%s: got unit %s, expected %s", qd.Name, d.Unit, qd.Unit)
+		}
+	}
+
+	if defs["tenant-mem-quota"].Kind != types.QuotaKindSize || defs["tenant-instances-quota"].Kind != types.QuotaKindCount {
+		t.Errorf("unexpected kinds %+v", defs)
+	}
+}
+
 func TestAllLimits(t *testing.T) {
 	qs := &Quotas{}
 	qs.Init()
 
 	limits := []types.QuotaDetails{
-		{Name: "tenant-vcpu-per-instance-limit", Value: 4},
-		{Name: "tenant-mem-per-instance-limit", Value: 128},
-		{Name: "tenant-volume-size-limit", Value: 10},
+		{Name: "tenant-vcpu-per-instance-limit", Value: 4, Unit: types.QuotaUnitVCPU},
+		{Name: "tenant-mem-per-instance-limit", Value: 128, Unit: types.QuotaUnitMB},
+		{Name: "tenant-volume-size-limit", Value: 10, Unit: types.QuotaUnitGB},
 	}
 
 	qs.Update("test-tenant-1", limits)
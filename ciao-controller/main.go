@@ -20,15 +20,20 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/01org/ciao/ciao-controller/api"
 	"github.com/01org/ciao/ciao-controller/internal/datastore"
 	"github.com/01org/ciao/ciao-controller/internal/quotas"
+	"github.com/01org/ciao/ciao-controller/types"
 	storage "github.com/01org/ciao/ciao-storage"
 	"github.com/01org/ciao/clogger/gloginterface"
 	"github.com/01org/ciao/database"
@@ -48,10 +53,28 @@ type controller struct {
 	ds                  *datastore.Datastore
 	is                  *ImageService
 	apiURL              string
+	apiBasePath         string
 	tenantReadiness     map[string]*tenantConfirmMemo
 	tenantReadinessLock sync.Mutex
 	qs                  *quotas.Quotas
 	httpServers         []*http.Server
+	events              *tenantEvents
+	churn               *tenantChurn
+
+	// instanceIDPattern, if set, is matched against the instance IDs
+	// given when external IPs are mapped.
+	instanceIDPattern *regexp.Regexp
+
+	// poolSelection is the strategy used to choose a pool when an
+	// external IP is mapped without naming one.
+	poolSelection string
+	lastPool      string
+	lastPoolLock  sync.Mutex
+
+	// workloadOps holds the workloads being created by
+	// CreateWorkloadAsync, keyed by workload ID.
+	workloadOps     map[string]*workloadOp
+	workloadOpsLock sync.Mutex
 }
 
 var cert = flag.String("cert", "", "Client certificate")
@@ -71,6 +94,26 @@ var imagesPath = flag.String("images_path", "/var/lib/ciao/images", "path to cia
 
 var cephID = flag.String("ceph_id", "", "ceph client id")
 
+var externalIPWebhook = flag.String("external_ip_webhook", "", "URL notified when external IPs are mapped or unmapped")
+var healthCheckTimeout = flag.Duration("health_check_timeout", 2*time.Second, "Time after which each dependency checked by the admin health report is reported as timed out")
+var apiRequestTimeout = flag.Duration("api_request_timeout", 0, "Time after which ciao API requests fail with 503, 0 for no timeout")
+var apiShutdownTimeout = flag.Duration("api_shutdown_timeout", 5*time.Second, "Time allowed for in-flight ciao API requests to finish when shutting down")
+var apiStrictContentType = flag.Bool("api_strict_content_type", false, "Reject ciao API requests which change something without a ciao media type as their Content-Type")
+var apiSlowRequest = flag.Duration("api_slow_request", 5*time.Second, "Log ciao API requests which take at least this long, 0 to disable")
+var apiPoolActivityLimit = flag.Int("api_pool_activity_limit", api.DefaultPoolActivityLimit, "Most event log entries embedded in a pool shown with its activity")
+var apiExpensiveConcurrency = flag.Int("api_expensive_concurrency", 0, "Most requests each expensive ciao API route, such as pool export, serves at once, 0 for no limit")
+var apiPTRTemplate = flag.String("api_ptr_template", "", "Template of the reverse DNS name given to each external IP in listings, e.g. ip-{ip}.example.com, empty for none")
+var apiLinkRelNamespace = flag.String("api_link_rel_namespace", "", "Namespace prefixed to the rel of every ciao API link, e.g. ciao for ciao:pools, empty for none")
+var apiResponseBudget = flag.Duration("api_response_budget", 0, "Expected ciao API response time, given with timings in a Server-Timing header, 0 to disable")
+var tenantEventsSize = flag.Int("tenant_events", 100, "Number of recent failed operations kept for each tenant")
+var apiBasePath = flag.String("api_base_path", "", "Path below which the ciao API is served, e.g. /ciao/api")
+var maxPools = flag.Int("max_pools", 0, "Maximum number of external IP pools, 0 for no limit")
+var poolAllowedCIDRs = flag.String("pool_allowed_cidrs", "", "Comma separated CIDRs which the subnets and addresses of pools must be within, empty for no restriction")
+var maxMappings = flag.Int("max_mappings", 0, "Maximum number of mapped or reserved external IPs, 0 for no limit")
+var maxInstanceMappings = flag.Int("max_instance_mappings", 0, "Maximum number of external IPs mapped to each instance, 0 for no limit")
+var instanceIDPattern = flag.String("instance_id_pattern", "", "Regular expression the instance IDs of mapped external IPs must match, e.g. ^[0-9a-f-]{36}$")
+var poolSelection = flag.String("pool_selection", types.PoolSelectionFillFirst, "How to choose the pool for external IPs mapped without one: fill-first, round-robin or least-used")
+
 var adminSSHKey = ""
 
 // default password set to "ciao"
@@ -101,14 +144,52 @@ func main() {
 
 	ctl := new(controller)
 	ctl.tenantReadiness = make(map[string]*tenantConfirmMemo)
+	ctl.workloadOps = make(map[string]*workloadOp)
 	ctl.ds = new(datastore.Datastore)
 	ctl.qs = new(quotas.Quotas)
 	ctl.is = new(ImageService)
+	ctl.events = newTenantEvents(*tenantEventsSize)
+	ctl.churn = newTenantChurn()
+
+	if !types.ValidPoolSelection(*poolSelection) {
+		glog.Fatalf("Unknown pool selection strategy %q", *poolSelection)
+	}
+	ctl.poolSelection = *poolSelection
+
+	if *apiBasePath != "" && !strings.HasPrefix(*apiBasePath, "/") {
+		glog.Fatalf("API base path %q must start with /", *apiBasePath)
+	}
+	ctl.apiBasePath = strings.TrimSuffix(*apiBasePath, "/")
+
+	if *instanceIDPattern != "" {
+		ctl.instanceIDPattern, err = regexp.Compile(*instanceIDPattern)
+		if err != nil {
+			glog.Fatalf("Invalid instance ID pattern %q: %v", *instanceIDPattern, err)
+		}
+	}
+
+	var allowedNets []*net.IPNet
+	for _, cidr := range strings.Split(*poolAllowedCIDRs, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			glog.Fatalf("Invalid allowed pool CIDR %q: %v", cidr, err)
+		}
+		allowedNets = append(allowedNets, ipNet)
+	}
 
 	dsConfig := datastore.Config{
-		PersistentURI:     "file:" + *persistentDatastoreLocation,
-		TransientURI:      "file:transient?mode=memory&cache=shared",
-		InitWorkloadsPath: *workloadsPath,
+		PersistentURI:       "file:" + *persistentDatastoreLocation,
+		TransientURI:        "file:transient?mode=memory&cache=shared",
+		InitWorkloadsPath:   *workloadsPath,
+		MaxPools:            *maxPools,
+		MaxMappings:         *maxMappings,
+		MaxInstanceMappings: *maxInstanceMappings,
+		AllowedNets:         allowedNets,
 	}
 
 	err = ctl.ds.Init(dsConfig)
@@ -119,6 +200,8 @@ func main() {
 
 	ctl.qs.Init()
 	populateQuotasFromDatastore(ctl.qs, ctl.ds)
+	stopIPHoursAccounting := ctl.startIPHoursAccounting(ipHoursInterval)
+	stopLeaseReaper := ctl.startLeaseReaper(leaseReaperInterval)
 
 	config := &ssntp.Config{
 		URI:    *serverURL,
@@ -220,6 +303,8 @@ func main() {
 
 	wg.Wait()
 	glog.Warning("Controller shutdown initiated")
+	stopLeaseReaper()
+	stopIPHoursAccounting()
 	ctl.qs.Shutdown()
 	ctl.ds.Exit()
 	ctl.is.ds.Shutdown()
@@ -204,6 +204,26 @@ func (is *ImageService) GetImage(tenantID, imageID string) (image.DefaultRespons
 	return response, nil
 }
 
+// ImageExists reports whether an image of a tenant, or a public image,
+// exists.
+func (c *controller) ImageExists(tenantID string, imageID string) (bool, error) {
+	for _, tenant := range []string{tenantID, string(image.Public)} {
+		img, err := c.is.ds.GetImage(tenant, imageID)
+		if err == image.ErrNoImage {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+
+		if img != (imageDatastore.Image{}) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
 // Init initialises the image service
 func (is *ImageService) Init(qs *quotas.Quotas) error {
 	dbDir := filepath.Dir(*imageDatastoreLocation)
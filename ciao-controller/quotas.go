@@ -15,6 +15,10 @@
 package main
 
 import (
+	"sort"
+	"sync"
+	"time"
+
 	"github.com/01org/ciao/ciao-controller/internal/datastore"
 	"github.com/01org/ciao/ciao-controller/internal/quotas"
 	"github.com/01org/ciao/ciao-controller/types"
@@ -35,6 +39,423 @@ func (c *controller) ListQuotas(tenantID string) []types.QuotaDetails {
 	return c.qs.DumpQuotas(tenantID)
 }
 
+// breakdownResources are the resources whose quotas can be broken down by
+// the instances consuming them.
+var breakdownResources = []struct {
+	quota    string
+	resource payloads.Resource
+}{
+	{"tenant-vcpu-quota", payloads.VCPUs},
+	{"tenant-mem-quota", payloads.MemMB},
+}
+
+// QuotaBreakdown reports which of a tenant's instances use its vcpu and
+// memory quotas, the largest users first. Usage which no instance accounts
+// for, e.g. because the quota service has drifted from the datastore, is
+// reported as unattributed.
+func (c *controller) QuotaBreakdown(tenantID string) ([]types.QuotaBreakdown, error) {
+	instances, err := c.ds.GetAllInstancesFromTenant(tenantID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting tenant instances")
+	}
+
+	usage := make(map[string]int)
+	for _, qd := range c.ListQuotas(tenantID) {
+		usage[qd.Name] = qd.Usage
+	}
+
+	breakdowns := make([]types.QuotaBreakdown, len(breakdownResources))
+	for i, br := range breakdownResources {
+		breakdowns[i] = types.QuotaBreakdown{
+			Name:         br.quota,
+			Usage:        usage[br.quota],
+			Instances:    []types.InstanceUsage{},
+			Unattributed: usage[br.quota],
+		}
+	}
+
+	for _, instance := range instances {
+		// CNCI resources are not quota tracked
+		if instance.CNCI {
+			continue
+		}
+
+		wl, err := c.ds.GetWorkload(tenantID, instance.WorkloadID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error getting workload")
+		}
+
+		for i, br := range breakdownResources {
+			used := 0
+			for _, d := range wl.Defaults {
+				if d.Type == br.resource {
+					used += d.Value
+				}
+			}
+
+			if used == 0 {
+				continue
+			}
+
+			breakdowns[i].Instances = append(breakdowns[i].Instances, types.InstanceUsage{
+				InstanceID: instance.ID,
+				Name:       instance.Name,
+				WorkloadID: instance.WorkloadID,
+				Usage:      used,
+			})
+			breakdowns[i].Unattributed -= used
+		}
+	}
+
+	for _, b := range breakdowns {
+		iu := b.Instances
+		sort.Slice(iu, func(i, j int) bool {
+			if iu[i].Usage != iu[j].Usage {
+				return iu[i].Usage > iu[j].Usage
+			}
+			return iu[i].InstanceID < iu[j].InstanceID
+		})
+	}
+
+	return breakdowns, nil
+}
+
+// ListQuotaDefinitions returns the quotas which can be set for a tenant.
+func (c *controller) ListQuotaDefinitions() []types.QuotaDefinition {
+	return quotas.Definitions()
+}
+
+// EffectiveQuotas reports, for each quota of a tenant, its value and usage
+// along with whether the value was set for the tenant and how much of it
+// has been given to sub-quotas.
+func (c *controller) EffectiveQuotas(tenantID string) ([]types.EffectiveQuota, error) {
+	overrides, err := c.ds.GetQuotas(tenantID)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting quotas from datastore")
+	}
+
+	subQuotas, err := c.ds.GetSubQuotas(tenantID)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting sub-quotas from datastore")
+	}
+
+	overridden := make(map[string]bool)
+	for _, qd := range overrides {
+		overridden[qd.Name] = true
+	}
+
+	eqs := []types.EffectiveQuota{}
+
+	for _, qd := range c.ListQuotas(tenantID) {
+		eq := types.EffectiveQuota{
+			Quota:  qd,
+			Source: types.QuotaSourceDefault,
+		}
+
+		if overridden[qd.Name] {
+			eq.Source = types.QuotaSourceOverride
+		}
+
+		for sub, sqds := range subQuotas {
+			for _, sqd := range sqds {
+				if sqd.Name != qd.Name || sqd.Value == -1 {
+					continue
+				}
+
+				if eq.SubQuotas == nil {
+					eq.SubQuotas = make(map[string]int)
+				}
+				eq.SubQuotas[sub] = sqd.Value
+			}
+		}
+
+		eqs = append(eqs, eq)
+	}
+
+	return eqs, nil
+}
+
+// QuotaSnapshot returns the quotas set for a tenant and its sub-quotas, so
+// that they can be restored later.
+func (c *controller) QuotaSnapshot(tenantID string) (types.QuotaSnapshot, error) {
+	t, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return types.QuotaSnapshot{}, err
+	}
+
+	if t == nil {
+		return types.QuotaSnapshot{}, types.ErrTenantNotFound
+	}
+
+	overrides, err := c.ds.GetQuotas(tenantID)
+	if err != nil {
+		return types.QuotaSnapshot{}, errors.Wrap(err, "error getting quotas from datastore")
+	}
+
+	subQuotas, err := c.ds.GetSubQuotas(tenantID)
+	if err != nil {
+		return types.QuotaSnapshot{}, errors.Wrap(err, "error getting sub-quotas from datastore")
+	}
+
+	return types.QuotaSnapshot{
+		TenantID:  tenantID,
+		Quotas:    overrides,
+		SubQuotas: subQuotas,
+	}, nil
+}
+
+// RestoreQuotas puts the quotas of a tenant back as they were in a
+// snapshot. Quotas set since the snapshot was taken go back to their
+// defaults, and sub-quotas made since become unlimited. Entries naming
+// quotas which no longer exist, and sub-quotas which no longer fit in the
+// tenant's quotas, are skipped and returned.
+func (c *controller) RestoreQuotas(tenantID string, snapshot types.QuotaSnapshot) ([]types.SkippedQuota, error) {
+	t, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	if t == nil {
+		return nil, types.ErrTenantNotFound
+	}
+
+	known := make(map[string]bool)
+	for _, def := range quotas.Definitions() {
+		known[def.Name] = true
+	}
+
+	skipped := []types.SkippedQuota{}
+
+	// sub-quotas are cleared first so that they cannot stop the
+	// tenant's quotas from shrinking.
+	current, err := c.ds.GetSubQuotas(tenantID)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting sub-quotas from datastore")
+	}
+
+	for sub, qds := range current {
+		cleared := make([]types.QuotaDetails, 0, len(qds))
+		for _, qd := range qds {
+			cleared = append(cleared, types.QuotaDetails{Name: qd.Name, Value: -1})
+		}
+
+		err = c.UpdateSubQuotas(tenantID, sub, cleared)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	overrides, err := c.ds.GetQuotas(tenantID)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting quotas from datastore")
+	}
+
+	err = c.ds.DeleteQuotas(tenantID)
+	if err != nil {
+		return nil, errors.Wrap(err, "error deleting quotas from database")
+	}
+
+	defaults := make([]types.QuotaDetails, 0, len(overrides))
+	for _, qd := range overrides {
+		defaults = append(defaults, types.QuotaDetails{Name: qd.Name, Value: -1})
+	}
+	c.qs.Update(tenantID, defaults)
+
+	var restored []types.QuotaDetails
+	for _, qd := range snapshot.Quotas {
+		if !known[qd.Name] {
+			skipped = append(skipped, types.SkippedQuota{Name: qd.Name, Reason: "unknown quota"})
+			continue
+		}
+
+		restored = append(restored, types.QuotaDetails{Name: qd.Name, Value: qd.Value})
+	}
+
+	err = c.UpdateQuotas(tenantID, restored)
+	if err != nil {
+		return nil, err
+	}
+
+	subs := make([]string, 0, len(snapshot.SubQuotas))
+	for sub := range snapshot.SubQuotas {
+		subs = append(subs, sub)
+	}
+	sort.Strings(subs)
+
+	for _, sub := range subs {
+		for _, qd := range snapshot.SubQuotas[sub] {
+			if !known[qd.Name] {
+				skipped = append(skipped, types.SkippedQuota{Sub: sub, Name: qd.Name, Reason: "unknown quota"})
+				continue
+			}
+
+			// each is set alone so that one which no longer fits
+			// does not stop the others.
+			err = c.UpdateSubQuotas(tenantID, sub, []types.QuotaDetails{{Name: qd.Name, Value: qd.Value}})
+			if err != nil {
+				skipped = append(skipped, types.SkippedQuota{Sub: sub, Name: qd.Name, Reason: err.Error()})
+			}
+		}
+	}
+
+	return skipped, nil
+}
+
+// ExceededQuotas finds the tenants which are using more than the value of
+// any of their quotas, sorted by tenant ID. Unlimited quotas are never
+// exceeded.
+func (c *controller) ExceededQuotas() ([]types.TenantExceededQuotas, error) {
+	tenants, err := c.ds.GetAllTenants()
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting tenants from datastore")
+	}
+
+	exceeded := []types.TenantExceededQuotas{}
+
+	for _, t := range tenants {
+		var qds []types.QuotaDetails
+
+		for _, qd := range c.ListQuotas(t.ID) {
+			if qd.Value != -1 && qd.Usage > qd.Value {
+				qds = append(qds, qd)
+			}
+		}
+
+		if len(qds) > 0 {
+			exceeded = append(exceeded, types.TenantExceededQuotas{
+				TenantID: t.ID,
+				Quotas:   qds,
+			})
+		}
+	}
+
+	sort.Slice(exceeded, func(i, j int) bool {
+		return exceeded[i].TenantID < exceeded[j].TenantID
+	})
+
+	return exceeded, nil
+}
+
+// UpdateSubQuotas sets the limits of a sub-quota of a tenant. The quota
+// service checks that they fit in the tenant's quota before they are
+// stored.
+func (c *controller) UpdateSubQuotas(tenantID string, sub string, qds []types.QuotaDetails) error {
+	err := c.qs.UpdateSubQuota(tenantID, sub, qds)
+	if err != nil {
+		return err
+	}
+
+	err = c.ds.UpdateSubQuotas(tenantID, sub, qds)
+	if err != nil {
+		return errors.Wrap(err, "error updating sub-quotas in database")
+	}
+	return nil
+}
+
+// ListSubQuotas returns the limits and usage of a sub-quota of a tenant.
+func (c *controller) ListSubQuotas(tenantID string, sub string) []types.QuotaDetails {
+	return c.qs.DumpSubQuota(tenantID, sub)
+}
+
+// RecalculateUsage replaces the usage the quota service has recorded for a
+// tenant with the usage of the resources the tenant has in the datastore.
+func (c *controller) RecalculateUsage(tenantID string) error {
+	resources, err := tenantUsage(c.ds, tenantID)
+	if err != nil {
+		return err
+	}
+
+	c.qs.SetUsage(tenantID, resources...)
+	return nil
+}
+
+// ipHoursInterval is how often the time for which external IPs have been
+// allocated is added to the usage of their tenants' ip-hours quotas.
+const ipHoursInterval = time.Minute
+
+// startIPHoursAccounting accrues the time each tenant's external IPs are
+// allocated for every interval. It returns a function which stops the
+// accounting, and which must be called before the quota service is shut
+// down.
+func (c *controller) startIPHoursAccounting(interval time.Duration) func() {
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-ticker.C:
+				c.accrueIPTime(interval)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+		wg.Wait()
+	}
+}
+
+// accrueIPTime adds d to the ip-hours usage of each tenant for every
+// external IP, mapped or reserved, which the tenant has.
+func (c *controller) accrueIPTime(d time.Duration) {
+	counts := make(map[string]int)
+
+	for _, m := range c.ds.GetMappedIPs(nil) {
+		counts[m.TenantID]++
+	}
+
+	for tenantID, n := range counts {
+		c.qs.AccrueIPTime(tenantID, time.Duration(n)*d)
+	}
+}
+
+// tenantUsage counts the resources used by a tenant in the datastore.
+func tenantUsage(ds *datastore.Datastore, tenantID string) ([]payloads.RequestedResource, error) {
+	// TODO: count image usage
+	bds, err := ds.GetBlockDevices(tenantID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting block devices for tenant %s", tenantID)
+	}
+	var size, count int
+	for _, bd := range bds {
+		if bd.Internal {
+			continue
+		}
+		size += bd.Size
+		count++
+	}
+
+	resources := []payloads.RequestedResource{
+		{Type: payloads.Volume, Value: count},
+		{Type: payloads.SharedDiskGiB, Value: size},
+		{Type: payloads.ExternalIP, Value: len(ds.GetMappedIPs(&tenantID))},
+	}
+
+	instances, err := ds.GetAllInstancesFromTenant(tenantID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting tenant instances")
+	}
+
+	for _, instance := range instances {
+		wl, err := ds.GetWorkload(tenantID, instance.WorkloadID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error getting workload")
+		}
+		resources = append(resources, payloads.RequestedResource{Type: payloads.Instance, Value: 1})
+		resources = append(resources, wl.Defaults...)
+	}
+
+	return resources, nil
+}
+
 func populateQuotasFromDatastore(qs *quotas.Quotas, ds *datastore.Datastore) error {
 	ts, err := ds.GetAllTenants()
 	if err != nil {
@@ -49,40 +470,25 @@ func populateQuotasFromDatastore(qs *quotas.Quotas, ds *datastore.Datastore) err
 		}
 		qs.Update(t.ID, qds)
 
-		// Populate volume usage
-		// TODO: populate image usage
-		// TODO: populate external IP usage
-		bds, err := ds.GetBlockDevices(t.ID)
+		subs, err := ds.GetSubQuotas(t.ID)
 		if err != nil {
-			return errors.Wrapf(err, "error getting block devices for tenant %s", t.ID)
+			return errors.Wrapf(err, "error getting sub-quotas for tenant %s", t.ID)
 		}
-		var size, count int
-		for _, bd := range bds {
-			if bd.Internal {
-				continue
+
+		for sub, qds := range subs {
+			err = qs.UpdateSubQuota(t.ID, sub, qds)
+			if err != nil {
+				return errors.Wrapf(err, "error restoring sub-quota %s of tenant %s", sub, t.ID)
 			}
-			size += bd.Size
-			count++
 		}
-		// With initial population we disregard the result of consumption
-		<-qs.Consume(t.ID,
-			payloads.RequestedResource{Type: payloads.Volume, Value: count},
-			payloads.RequestedResource{Type: payloads.SharedDiskGiB, Value: size})
 
-		instances, err := ds.GetAllInstancesFromTenant(t.ID)
+		resources, err := tenantUsage(ds, t.ID)
 		if err != nil {
-			return errors.Wrapf(err, "error getting tenant instances")
+			return err
 		}
 
-		for _, instance := range instances {
-			wl, err := ds.GetWorkload(t.ID, instance.WorkloadID)
-			if err != nil {
-				return errors.Wrapf(err, "error getting workload")
-			}
-			resources := []payloads.RequestedResource{{Type: payloads.Instance, Value: 1}}
-			resources = append(resources, wl.Defaults...)
-			<-qs.Consume(t.ID, resources...)
-		}
+		// With initial population we disregard the result of consumption
+		<-qs.Consume(t.ID, resources...)
 	}
 
 	return nil
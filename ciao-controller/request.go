@@ -0,0 +1,44 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/01org/ciao/ciao-controller/api"
+	"github.com/01org/ciao/ciao-controller/types"
+)
+
+// requestController serves a single API request, stopping the work of
+// the calls which change the most once the request's context is done.
+type requestController struct {
+	*controller
+	ctx context.Context
+}
+
+// WithContext returns the controller which serves a request with the
+// given context.
+func (c *controller) WithContext(ctx context.Context) api.Service {
+	return &requestController{controller: c, ctx: ctx}
+}
+
+func (rc *requestController) MapAddress(tenantID string, poolName *string, instanceID string, internalIP string, role string, lease time.Duration) (types.MappedIP, error) {
+	return rc.mapAddress(rc.ctx, tenantID, poolName, instanceID, internalIP, role, lease)
+}
+
+func (rc *requestController) CreateWorkload(req types.Workload) (types.Workload, error) {
+	return rc.createWorkload(rc.ctx, req)
+}
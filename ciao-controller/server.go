@@ -15,16 +15,15 @@
 package main
 
 import (
-	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"sync"
-	"time"
 
 	"github.com/01org/ciao/ciao-controller/api"
+	"github.com/01org/ciao/ciao-controller/types"
 	"github.com/01org/ciao/service"
 	"github.com/golang/glog"
 	"github.com/gorilla/mux"
@@ -33,6 +32,25 @@ import (
 
 type clientCertAuthHandler struct {
 	Next http.Handler
+
+	// public routes concern no tenant, so any caller may use them.
+	public bool
+}
+
+// certScopes returns the organizational units of a certificate which
+// name scopes, ignoring any others.
+func certScopes(units []string) []string {
+	var scopes []string
+	for _, unit := range units {
+		for _, scope := range service.Scopes {
+			if unit == scope {
+				scopes = append(scopes, unit)
+				break
+			}
+		}
+	}
+
+	return scopes
 }
 
 func (h *clientCertAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -50,10 +68,38 @@ func (h *clientCertAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 		privileged = true
 	}
 
-	r = r.WithContext(service.SetPrivilege(r.Context(), true))
+	// admin certificates may be limited to the scopes listed as their
+	// organizational units, e.g. for automation which only manages
+	// pools. Those listing no scope have every scope, so that ordinary
+	// organizational units do not take away the right to change things.
+	scopes := certScopes(cert.Subject.OrganizationalUnit)
+	if privileged && len(scopes) > 0 {
+		r = r.WithContext(service.SetScopes(r.Context(), scopes...))
+	} else {
+		r = r.WithContext(service.SetPrivilege(r.Context(), privileged))
+	}
+
+	if h.public {
+		h.Next.ServeHTTP(w, r)
+		return
+	}
 
 	vars := mux.Vars(r)
-	tenantFromVars := vars["tenant"]
+	tenantFromVars, ok := vars["tenant"]
+
+	// routes which act on another tenant check access themselves,
+	// so only need to know who the caller is.
+	if _, forTenant := vars["for_tenant"]; forTenant && !ok && !privileged {
+		if len(tenants) != 1 {
+			http.Error(w, "Unexpected number of tenants in certificate", http.StatusUnauthorized)
+			return
+		}
+
+		r = r.WithContext(service.SetTenantID(r.Context(), tenants[0]))
+		h.Next.ServeHTTP(w, r)
+		return
+	}
+
 	if !privileged {
 		tenantMatched := false
 		for i := range tenants {
@@ -72,14 +118,89 @@ func (h *clientCertAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 	h.Next.ServeHTTP(w, r)
 }
 
+// suspendedTenantHandler refuses requests which would change the
+// resources of a suspended tenant. Reads are still allowed so the tenant
+// can see its state, and privileged callers are not affected.
+type suspendedTenantHandler struct {
+	ctl  *controller
+	Next http.Handler
+}
+
+func (h *suspendedTenantHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		h.Next.ServeHTTP(w, r)
+		return
+	}
+
+	tenantID := mux.Vars(r)["tenant"]
+	if tenantID == "" || service.GetPrivilege(r.Context()) {
+		h.Next.ServeHTTP(w, r)
+		return
+	}
+
+	enabled, err := h.ctl.TenantEnabled(tenantID)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if !enabled {
+		http.Error(w, types.ErrTenantSuspended.Error(), http.StatusForbidden)
+		return
+	}
+
+	h.Next.ServeHTTP(w, r)
+}
+
+// baseURL returns the URL, including any base path, from which links to
+// the API's resources are made.
+func (c *controller) baseURL() string {
+	return c.apiURL + c.apiBasePath
+}
+
 func (c *controller) createCiaoRoutes(r *mux.Router) error {
-	config := api.Config{URL: c.apiURL, CiaoService: c}
+	limits := make(map[string]int)
+	for _, path := range api.ExpensiveRoutes {
+		limits[path] = *apiExpensiveConcurrency
+	}
+
+	config := api.Config{
+		URL:         c.apiURL,
+		BasePath:    c.apiBasePath,
+		CiaoService: c,
+		WebhookURL:  *externalIPWebhook,
+
+		RequestTimeout:        *apiRequestTimeout,
+		SlowRequestThreshold:  *apiSlowRequest,
+		StrictContentType:     *apiStrictContentType,
+		PoolActivityLimit:     *apiPoolActivityLimit,
+		LinkRelNamespace:      *apiLinkRelNamespace,
+		PTRTemplate:           *apiPTRTemplate,
+		ConcurrencyLimits:     limits,
+		ResponseTimeBudget:    *apiResponseBudget,
+		VerifyMappedInstances: true,
+		InstanceIDPattern:     c.instanceIDPattern,
+		InstanceInfo:          c,
+		ImageChecker:          c,
+	}
 
 	r = api.Routes(config, r)
 
+	public := make(map[string]bool)
+	for _, path := range api.PublicRoutes {
+		public[c.apiBasePath+path] = true
+	}
+
 	err := r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, _ := route.GetPathTemplate()
+
 		h := &clientCertAuthHandler{
-			Next: route.GetHandler(),
+			public: public[path],
+			Next: &suspendedTenantHandler{
+				ctl:  c,
+				Next: route.GetHandler(),
+			},
 		}
 		route.Handler(h)
 
@@ -140,11 +261,9 @@ func (c *controller) ShutdownHTTPServers() {
 	for _, server := range c.httpServers {
 		wg.Add(1)
 		go func(server *http.Server) {
-			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-			defer cancel()
-			err := server.Shutdown(ctx)
+			err := api.Shutdown(server, *apiShutdownTimeout)
 			if err != nil {
-				glog.Errorf("Error during HTTP server shutdown")
+				glog.Errorf("Error during HTTP server shutdown: %v", err)
 			}
 			wg.Done()
 		}(server)
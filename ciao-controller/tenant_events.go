@@ -0,0 +1,286 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/01org/ciao/ciao-controller/api"
+	"github.com/01org/ciao/ciao-controller/types"
+	"github.com/golang/glog"
+)
+
+// tenantEventWatchQueue is how many events may wait for each watcher
+// before further events are dropped.
+const tenantEventWatchQueue = 16
+
+// tenantEvents keeps the most recent events of each tenant in memory. Once
+// a tenant has size events the oldest is dropped to make room for the next.
+// Watchers are sent each event of their tenant as it is added.
+type tenantEvents struct {
+	sync.Mutex
+	size     int
+	events   map[string][]types.Event
+	watchers map[chan types.Event]string
+}
+
+func newTenantEvents(size int) *tenantEvents {
+	return &tenantEvents{
+		size:     size,
+		events:   make(map[string][]types.Event),
+		watchers: make(map[chan types.Event]string),
+	}
+}
+
+func (te *tenantEvents) add(event types.Event) {
+	te.Lock()
+	defer te.Unlock()
+
+	for ch, tenantID := range te.watchers {
+		if tenantID != event.TenantID {
+			continue
+		}
+
+		select {
+		case ch <- event:
+		default:
+			glog.Warningf("Dropping %s event of tenant %s for slow watcher", event.Operation, event.TenantID)
+		}
+	}
+
+	if te.size <= 0 {
+		return
+	}
+
+	events := append(te.events[event.TenantID], event)
+	if len(events) > te.size {
+		events = events[len(events)-te.size:]
+	}
+
+	te.events[event.TenantID] = events
+}
+
+// list returns the events of a tenant, oldest first.
+func (te *tenantEvents) list(tenantID string) []types.Event {
+	te.Lock()
+	defer te.Unlock()
+
+	events := make([]types.Event, len(te.events[tenantID]))
+	copy(events, te.events[tenantID])
+
+	return events
+}
+
+// watch returns a channel on which each subsequent event of a tenant is
+// sent, and a function which stops the watch. Events are dropped, rather
+// than block those recording them, when the watcher falls behind.
+func (te *tenantEvents) watch(tenantID string) (<-chan types.Event, func()) {
+	ch := make(chan types.Event, tenantEventWatchQueue)
+
+	te.Lock()
+	te.watchers[ch] = tenantID
+	te.Unlock()
+
+	stop := func() {
+		te.Lock()
+		delete(te.watchers, ch)
+		te.Unlock()
+	}
+
+	return ch, stop
+}
+
+// logEvent describes an entry of the event log as an Event.
+func logEvent(entry types.LogEntry) types.Event {
+	event := types.Event{
+		Timestamp: entry.Timestamp,
+		TenantID:  entry.TenantID,
+		Operation: types.EventLog,
+	}
+
+	// the datastore logs errors with the type "error".
+	if entry.EventType == "error" {
+		event.Error = entry.Message
+	} else {
+		event.Message = entry.Message
+	}
+
+	return event
+}
+
+// RecordTenantEvent adds an event to those kept for its tenant.
+func (c *controller) RecordTenantEvent(event types.Event) {
+	c.events.add(event)
+}
+
+// churnBucket counts the external IPs a tenant mapped and unmapped in the
+// minute starting at start.
+type churnBucket struct {
+	start  time.Time
+	maps   int
+	unmaps int
+}
+
+// tenantChurn counts, by the minute, the external IPs each tenant maps and
+// unmaps. Counts older than api.MaxChurnWindow are dropped, so a tenant
+// never has more than a day's worth of buckets however busy it is.
+type tenantChurn struct {
+	sync.Mutex
+	buckets map[string][]churnBucket
+}
+
+func newTenantChurn() *tenantChurn {
+	return &tenantChurn{
+		buckets: make(map[string][]churnBucket),
+	}
+}
+
+func (tc *tenantChurn) add(tenantID string, now time.Time, maps int, unmaps int) {
+	start := now.Truncate(time.Minute)
+
+	tc.Lock()
+	defer tc.Unlock()
+
+	buckets := tc.buckets[tenantID]
+	if len(buckets) == 0 || buckets[len(buckets)-1].start.Before(start) {
+		buckets = append(buckets, churnBucket{start: start})
+	}
+	buckets[len(buckets)-1].maps += maps
+	buckets[len(buckets)-1].unmaps += unmaps
+
+	cutoff := start.Add(-api.MaxChurnWindow)
+	i := 0
+	for i < len(buckets) && !buckets[i].start.After(cutoff) {
+		i++
+	}
+
+	tc.buckets[tenantID] = buckets[i:]
+}
+
+// count returns how many external IPs a tenant mapped and unmapped in the
+// minutes which started after since.
+func (tc *tenantChurn) count(tenantID string, since time.Time) (int, int) {
+	tc.Lock()
+	defer tc.Unlock()
+
+	maps, unmaps := 0, 0
+	for _, b := range tc.buckets[tenantID] {
+		if b.start.After(since) {
+			maps += b.maps
+			unmaps += b.unmaps
+		}
+	}
+
+	return maps, unmaps
+}
+
+// TenantChurn counts the external IPs a tenant mapped and unmapped over
+// the last window.
+func (c *controller) TenantChurn(tenantID string, window time.Duration) (types.TenantChurn, error) {
+	t, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return types.TenantChurn{}, err
+	}
+
+	if t == nil {
+		return types.TenantChurn{}, types.ErrTenantNotFound
+	}
+
+	maps, unmaps := c.churn.count(tenantID, time.Now().Add(-window))
+
+	return types.TenantChurn{
+		TenantID:      tenantID,
+		WindowSeconds: int64(window / time.Second),
+		Maps:          maps,
+		Unmaps:        unmaps,
+		PerMinute:     float64(maps+unmaps) / window.Minutes(),
+	}, nil
+}
+
+// TenantEvents returns the recent events of a tenant, oldest first.
+func (c *controller) TenantEvents(tenantID string) ([]types.Event, error) {
+	t, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	if t == nil {
+		return nil, types.ErrTenantNotFound
+	}
+
+	return c.events.list(tenantID), nil
+}
+
+// WatchTenantEvents returns a channel on which each subsequent event of a
+// tenant is sent, and a function which stops the watch. Along with the
+// failures recorded for the tenant, changes to its external IPs and
+// entries of its event log are sent.
+func (c *controller) WatchTenantEvents(tenantID string) (<-chan types.Event, func(), error) {
+	t, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if t == nil {
+		return nil, nil, types.ErrTenantNotFound
+	}
+
+	failures, stopFailures := c.events.watch(tenantID)
+	changes, stopChanges := c.WatchMappedAddresses(&tenantID)
+	entries, stopEntries := c.ds.WatchEventLog()
+
+	out := make(chan types.Event, tenantEventWatchQueue)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			var event types.Event
+
+			select {
+			case event = <-failures:
+			case change := <-changes:
+				event = types.Event{
+					Timestamp: time.Now(),
+					TenantID:  tenantID,
+					Operation: types.EventExternalIPChange,
+					Change:    &change,
+				}
+			case entry := <-entries:
+				if entry.TenantID != tenantID {
+					continue
+				}
+				event = logEvent(entry)
+			case <-done:
+				return
+			}
+
+			select {
+			case out <- event:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	stop := func() {
+		stopFailures()
+		stopChanges()
+		stopEntries()
+		close(done)
+	}
+
+	return out, stop, nil
+}
@@ -17,8 +17,15 @@
 package types
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -71,10 +78,10 @@ type StorageResource struct {
 	SourceID string `json:"source_id"`
 
 	// Tag is a piece of abitrary search/sort identifier text
-	Tag string
+	Tag string `json:"tag"`
 
 	// Internal indicates whether this storage should be shown to the user
-	Internal bool
+	Internal bool `json:"-"`
 }
 
 // Workload contains resource and configuration information for a user
@@ -89,6 +96,84 @@ type Workload struct {
 	Config      string                       `json:"config"`
 	Defaults    []payloads.RequestedResource `json:"defaults"`
 	Storage     []StorageResource            `json:"storage"`
+	Environment []WorkloadDefault            `json:"environment,omitempty"`
+
+	// InstanceCount is the number of instances made from the workload.
+	// It is only set in listings which ask for it.
+	InstanceCount *int `json:"instance_count,omitempty"`
+}
+
+// TotalStorageMB returns the size, in MB, of all the storage a workload
+// declares. Storage sizes are given in GB.
+func (w Workload) TotalStorageMB() int {
+	total := 0
+	for _, s := range w.Storage {
+		total += s.Size
+	}
+
+	return total * 1024
+}
+
+// ConfigChecksum returns the hex encoded SHA-256 of the config and the
+// defaults of a workload, so that a change to either can be noticed without
+// comparing them. The config is prefixed by its length, so that it cannot
+// be mistaken for defaults.
+func (w Workload) ConfigChecksum() string {
+	h := sha256.New()
+
+	fmt.Fprintf(h, "%d:%s", len(w.Config), w.Config)
+	for _, d := range w.Defaults {
+		b, _ := json.Marshal(d)
+		h.Write(b)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// WorkloadDetails is returned when showing a single workload. It adds
+// what is derived from the workload to its definition.
+type WorkloadDetails struct {
+	Workload
+	TotalStorageMB int    `json:"total_storage_mb"`
+	ConfigChecksum string `json:"config_checksum"`
+}
+
+// WorkloadDiff is returned when comparing two workloads. It lists each
+// field whose value differs between them.
+type WorkloadDiff struct {
+	A           string              `json:"a"`
+	B           string              `json:"b"`
+	Differences []WorkloadFieldDiff `json:"differences"`
+}
+
+// WorkloadFieldDiff is a field which differs between two workloads. Field
+// is the path of the field in the JSON form of a workload, e.g.
+// "storage[0].size". A field missing from one of the workloads is null.
+type WorkloadFieldDiff struct {
+	Field string      `json:"field"`
+	A     interface{} `json:"a"`
+	B     interface{} `json:"b"`
+}
+
+// OrphanedWorkload is a workload whose storage is made from images which
+// no longer exist, so whose instances cannot be started.
+type OrphanedWorkload struct {
+	WorkloadID    string   `json:"workload_id"`
+	Description   string   `json:"description"`
+	MissingImages []string `json:"missing_images"`
+}
+
+// OrphanedWorkloadsResponse lists the orphaned workloads.
+type OrphanedWorkloadsResponse struct {
+	Workloads []OrphanedWorkload `json:"workloads"`
+}
+
+// WorkloadDefault is an environment variable which is set in the
+// instances of a workload. A required default must be given a value.
+type WorkloadDefault struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Required bool   `json:"required,omitempty"`
 }
 
 // WorkloadResponse will be returned from /workloads apis
@@ -98,6 +183,84 @@ type WorkloadResponse struct {
 	Link     Link     `json:"link"`
 }
 
+// States of a workload being created asynchronously.
+const (
+	// WorkloadPending means the workload is still being created.
+	WorkloadPending = "pending"
+
+	// WorkloadReady means the workload has been created and can be used.
+	WorkloadReady = "ready"
+
+	// WorkloadFailed means the workload could not be created. The
+	// operation's Error says why.
+	WorkloadFailed = "failed"
+)
+
+// WorkloadOperation tracks the asynchronous creation of a workload.
+type WorkloadOperation struct {
+	WorkloadID string `json:"workload_id"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	Link       Link   `json:"link"`
+}
+
+// WorkloadTransferRequest is sent to move a workload to another tenant.
+type WorkloadTransferRequest struct {
+	TargetTenant string `json:"target_tenant"`
+}
+
+// WorkloadValidation is the result of validating a workload without
+// creating it. A workload with any errors would not be created. Warnings
+// describe problems which would not stop it being created.
+type WorkloadValidation struct {
+	Errors   []string     `json:"errors"`
+	Warnings []string     `json:"warnings"`
+	Fields   []FieldError `json:"fields,omitempty"`
+}
+
+// FieldError is a problem with a single field of a request body. Field is
+// the path to it, using the JSON names of the body, e.g. storage[1].size.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// FieldErrors is given as the details of an error response when a request
+// body has invalid fields.
+type FieldErrors struct {
+	Fields []FieldError `json:"fields"`
+}
+
+// WorkloadListResponse is returned from GET /workloads
+type WorkloadListResponse struct {
+	Workloads []Workload `json:"workloads"`
+
+	// NextCursor is given to fetch the next page of a listing
+	// paginated with a cursor. It is empty on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// WorkloadGroups is returned from GET /workloads in place of a
+// WorkloadListResponse when the workloads are grouped, e.g. by vm_type.
+// It maps each value of the field grouped by to the workloads having it.
+type WorkloadGroups map[string][]Workload
+
+// WorkloadImportResult reports the outcome of importing one workload of
+// a bundle. Index is the position of the workload in the bundle and
+// Status is the HTTP status code its creation would have had on its own.
+type WorkloadImportResult struct {
+	Index  int    `json:"index"`
+	Status int    `json:"status"`
+	ID     string `json:"id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// WorkloadImportResponse holds the layout for returning the results of
+// importing a bundle of workloads, in the order they appear in it.
+type WorkloadImportResponse struct {
+	Results []WorkloadImportResult `json:"results"`
+}
+
 // WorkloadRequest contains resource and configuration for a user
 // workload.
 type WorkloadRequest struct {
@@ -143,11 +306,79 @@ func (s SortedNodesByID) Len() int           { return len(s) }
 func (s SortedNodesByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 func (s SortedNodesByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
 
+// SortedPoolsByID implements sort.Interface for Pool by ID string
+type SortedPoolsByID []Pool
+
+func (s SortedPoolsByID) Len() int           { return len(s) }
+func (s SortedPoolsByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s SortedPoolsByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+
+// SortedMappedIPsByID implements sort.Interface for MappedIP by ID string
+type SortedMappedIPsByID []MappedIP
+
+func (s SortedMappedIPsByID) Len() int           { return len(s) }
+func (s SortedMappedIPsByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s SortedMappedIPsByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+
+// SortedMappedIPsByIndex implements sort.Interface for MappedIP by the
+// index of the mapping on its instance.
+type SortedMappedIPsByIndex []MappedIP
+
+func (s SortedMappedIPsByIndex) Len() int      { return len(s) }
+func (s SortedMappedIPsByIndex) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s SortedMappedIPsByIndex) Less(i, j int) bool {
+	if s[i].InstanceID != s[j].InstanceID {
+		return s[i].InstanceID < s[j].InstanceID
+	}
+	return s[i].Index < s[j].Index
+}
+
+// MappedIPSortKeys are the fields by which SortMappedIPs can order
+// mappings.
+var MappedIPSortKeys = map[string]func(a, b MappedIP) bool{
+	"external_ip": func(a, b MappedIP) bool { return compareIPs(a.ExternalIP, b.ExternalIP) < 0 },
+	"internal_ip": func(a, b MappedIP) bool { return compareIPs(a.InternalIP, b.InternalIP) < 0 },
+	"instance_id": func(a, b MappedIP) bool { return a.InstanceID < b.InstanceID },
+}
+
+// compareIPs compares two addresses numerically. An empty or invalid
+// address sorts before any valid one.
+func compareIPs(a, b string) int {
+	return bytes.Compare(net.ParseIP(a).To16(), net.ParseIP(b).To16())
+}
+
+// SortMappedIPs orders mappings by one of the MappedIPSortKeys. A key
+// prefixed with "-" sorts in descending order. Mappings which compare
+// equal keep their order. ErrInvalidSort is returned for an unknown key.
+func SortMappedIPs(IPs []MappedIP, key string) error {
+	descending := strings.HasPrefix(key, "-")
+
+	less, ok := MappedIPSortKeys[strings.TrimPrefix(key, "-")]
+	if !ok {
+		return ErrInvalidSort
+	}
+
+	sort.SliceStable(IPs, func(i, j int) bool {
+		if descending {
+			return less(IPs[j], IPs[i])
+		}
+		return less(IPs[i], IPs[j])
+	})
+
+	return nil
+}
+
 // Tenant contains information about a tenant or project.
 type Tenant struct {
-	ID       string
-	Name     string
-	CNCIctrl CNCIController
+	ID       string         `json:"id"`
+	Name     string         `json:"name"`
+	Enabled  bool           `json:"enabled"`
+	CNCIctrl CNCIController `json:"-"`
+}
+
+// TenantUpdateRequest holds the changes to make to a tenant.
+type TenantUpdateRequest struct {
+	Enabled *bool `json:"enabled,omitempty"`
 }
 
 // LogEntry stores information about events.
@@ -158,6 +389,121 @@ type LogEntry struct {
 	Message   string    `json:"message"`
 }
 
+const (
+	// EventMapExternalIP is the operation of an Event recorded when
+	// mapping or reserving an external IP fails.
+	EventMapExternalIP = "map-external-ip"
+
+	// EventUnmapExternalIP is the operation of an Event recorded when
+	// unmapping an external IP fails.
+	EventUnmapExternalIP = "unmap-external-ip"
+
+	// EventCreateWorkload is the operation of an Event recorded when
+	// creating a workload fails.
+	EventCreateWorkload = "create-workload"
+
+	// EventExternalIPChange is the operation of a streamed Event sent
+	// when one of the tenant's external IPs is mapped, remapped or
+	// unmapped.
+	EventExternalIPChange = "external-ip-change"
+
+	// EventLog is the operation of a streamed Event sent when an entry
+	// is added to the tenant's event log.
+	EventLog = "log"
+)
+
+// Event records the result of an operation made by a tenant, so that the
+// tenant can later find out why it failed.
+type Event struct {
+	Timestamp time.Time `json:"time_stamp"`
+	TenantID  string    `json:"tenant_id"`
+	Operation string    `json:"operation"`
+	RequestID string    `json:"request_id,omitempty"`
+	Error     string    `json:"error"`
+
+	// Message is the entry of EventLog events which are not errors.
+	Message string `json:"message,omitempty"`
+
+	// Change is the change to a mapping of EventExternalIPChange events.
+	Change *MappedIPChange `json:"change,omitempty"`
+}
+
+// EventsResponse is returned from GET /tenants/{tenant}/events.
+type EventsResponse struct {
+	Events []Event `json:"events"`
+}
+
+// TenantChurn is returned from GET /tenants/{tenant}/churn. It counts the
+// external IPs a tenant mapped and unmapped over the last WindowSeconds,
+// a high rate of which often means a client retrying in a loop.
+type TenantChurn struct {
+	TenantID      string  `json:"tenant_id"`
+	WindowSeconds int64   `json:"window_seconds"`
+	Maps          int     `json:"maps"`
+	Unmaps        int     `json:"unmaps"`
+	PerMinute     float64 `json:"operations_per_minute"`
+}
+
+// NegotiationResponse is returned from GET /negotiate. It gives the media
+// type the API would serve a resource as to a request with the Accept
+// header given, and whether that version is deprecated.
+type NegotiationResponse struct {
+	Resource   string     `json:"resource"`
+	Accept     string     `json:"accept"`
+	MediaType  string     `json:"media_type"`
+	Version    string     `json:"version"`
+	Deprecated bool       `json:"deprecated"`
+	Sunset     *time.Time `json:"sunset,omitempty"`
+}
+
+// Maintenance is the state of the API's maintenance mode, returned from
+// GET /admin/maintenance and given to POST /admin/maintenance to change
+// it. While Enabled, requests which would change anything fail with 503
+// Service Unavailable and a Retry-After of RetryAfter seconds, unless
+// AllowPrivileged is set and they are made by the admin.
+type Maintenance struct {
+	Enabled         bool `json:"enabled"`
+	AllowPrivileged bool `json:"allow_privileged"`
+	RetryAfter      int  `json:"retry_after"`
+}
+
+// TenantInventory is returned from GET /tenants/{tenant}/inventory. It
+// lists everything the tenant holds, so that nothing is left behind when
+// the tenant is removed. Mappings are the external IPs mapped to the
+// tenant's instances and Reservations those it holds without one.
+type TenantInventory struct {
+	TenantID     string      `json:"tenant_id"`
+	DefaultPool  DefaultPool `json:"default_pool"`
+	Workloads    []Workload  `json:"workloads"`
+	Mappings     []MappedIP  `json:"mappings"`
+	Reservations []MappedIP  `json:"reservations"`
+}
+
+// Types of the resources removed when a tenant is deleted.
+const (
+	TenantResourceExternalIP = "external-ip"
+	TenantResourceWorkload   = "workload"
+	TenantResourceQuota      = "quota"
+)
+
+// TenantResourceResult reports the outcome of removing one of the
+// resources of a deleted tenant. ID is the ID of the mapping or workload,
+// or the name of the quota. Status is the HTTP status code removing the
+// resource would have had on its own.
+type TenantResourceResult struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// DeleteTenantResponse holds the results of removing each of the
+// resources of a deleted tenant.
+type DeleteTenantResponse struct {
+	TenantID string                 `json:"tenant_id"`
+	Results  []TenantResourceResult `json:"results"`
+}
+
 // NodeStats stores statistics for individual nodes in the cluster.
 type NodeStats struct {
 	NodeID          string    `json:"node_id"`
@@ -497,9 +843,30 @@ var (
 	// ErrQuota is returned when a resource limit is exceeded.
 	ErrQuota = errors.New("Over Quota")
 
+	// ErrQuotaNotFound is returned when a quota name is not one of those
+	// which can be set.
+	ErrQuotaNotFound = errors.New("Quota not found")
+
 	// ErrTenantNotFound is returned when a tenant ID is unknown.
 	ErrTenantNotFound = errors.New("Tenant not found")
 
+	// ErrTenantExists is returned when a tenant is created with the
+	// ID or name of an existing tenant.
+	ErrTenantExists = errors.New("Tenant already exists")
+
+	// ErrTenantHasResources is returned when a tenant which still has
+	// workloads, instances or external IPs is deleted without removing
+	// them too.
+	ErrTenantHasResources = errors.New("Tenant still has resources")
+
+	// ErrInvalidTenantName is returned when a tenant is created without
+	// a name.
+	ErrInvalidTenantName = errors.New("Invalid tenant name")
+
+	// ErrTenantSuspended is returned when a suspended tenant attempts to
+	// change its resources.
+	ErrTenantSuspended = errors.New("Tenant suspended")
+
 	// ErrInstanceNotFound is returned when an instance is not found.
 	ErrInstanceNotFound = errors.New("Instance not found")
 
@@ -521,6 +888,14 @@ var (
 	// ErrPoolNotFound is returned when an external IP pool is not found
 	ErrPoolNotFound = errors.New("Pool not found")
 
+	// ErrReservationNotFound is returned when an address reservation is
+	// not found.
+	ErrReservationNotFound = errors.New("Reservation not found")
+
+	// ErrInvalidReservation is returned when address space is reserved
+	// without a valid CIDR or without a label.
+	ErrInvalidReservation = errors.New("Reservation needs a valid CIDR and a label")
+
 	// ErrPoolNotEmpty is returned when a pool is still in use
 	ErrPoolNotEmpty = errors.New("Pool has mapped IPs")
 
@@ -533,12 +908,30 @@ var (
 	// ErrBadRequest is returned when we have a malformed request
 	ErrBadRequest = errors.New("Invalid Request")
 
+	// ErrPoolDrained is returned when allocating from a drained pool.
+	ErrPoolDrained = errors.New("Pool is drained")
+
 	// ErrPoolEmpty is returned when a pool has no free IPs
 	ErrPoolEmpty = errors.New("Pool has no Free IPs")
 
-	// ErrDuplicatePoolName is returned when a duplicate pool name is used
+	// ErrDuplicatePoolName is returned when a duplicate pool name is used.
+	// Pool names are compared case-insensitively.
 	ErrDuplicatePoolName = errors.New("Pool by that name already exists")
 
+	// ErrPoolExists is returned when a pool with the same ID already exists
+	ErrPoolExists = errors.New("Pool already exists")
+
+	// ErrInvalidPoolName is returned when a pool is given an empty name
+	ErrInvalidPoolName = errors.New("Invalid pool name")
+
+	// ErrPoolNameRequired is returned when a new pool is not given a
+	// name
+	ErrPoolNameRequired = errors.New("Pool name is required")
+
+	// ErrPoolDescriptionTooLong is returned when a pool is given a
+	// description longer than MaxPoolDescriptionLength.
+	ErrPoolDescriptionTooLong = errors.New("Pool description too long")
+
 	// ErrInstanceMapped is returned when an instance cannot be deleted
 	// due to having an external IP assigned to it.
 	ErrInstanceMapped = errors.New("Unmap the external IP prior to deletion")
@@ -548,8 +941,208 @@ var (
 
 	// ErrWorkloadInUse is returned by DeleteWorkload when an instance of a workload is still active.
 	ErrWorkloadInUse = errors.New("Workload definition still in use")
+
+	// ErrWorkloadPublic is returned when a public workload would be
+	// transferred to a tenant.
+	ErrWorkloadPublic = errors.New("Public workloads cannot be transferred")
+
+	// ErrForbidden is returned when a caller attempts to access resources
+	// belonging to a tenant they are not permitted to see.
+	ErrForbidden = errors.New("Access to tenant not permitted")
+
+	// ErrInvalidFilter is returned when a listing is filtered by
+	// a value which is not valid for the field being filtered on.
+	ErrInvalidFilter = errors.New("Invalid filter value")
+
+	// ErrInvalidSort is returned when a listing is sorted by a field
+	// which it cannot be sorted by.
+	ErrInvalidSort = errors.New("Invalid sort key")
+
+	// ErrInvalidPoolSelection is returned when a pool selection
+	// strategy is not one of those known.
+	ErrInvalidPoolSelection = errors.New("Unknown pool selection strategy")
+
+	// ErrAddressAttached is returned when remapping an external IP
+	// which is already mapped to an instance.
+	ErrAddressAttached = errors.New("External IP is already mapped to an instance")
+
+	// ErrAddressNotAttached is returned when swapping an external IP
+	// which is not mapped to an instance.
+	ErrAddressNotAttached = errors.New("External IP is not mapped to an instance")
+
+	// ErrAddressInUse is returned when removing an address from a pool
+	// while it is mapped or reserved.
+	ErrAddressInUse = errors.New("Address is in use")
+
+	// ErrDuplicateMappingRole is returned when an instance already has
+	// an external IP mapped with the requested role.
+	ErrDuplicateMappingRole = errors.New("Instance already has an external IP with that role")
+
+	// ErrInvalidStorage is returned when the storage requested for a
+	// workload is not valid.
+	ErrInvalidStorage = errors.New("Invalid workload storage")
+
+	// ErrIncompatibleFirmware is returned when a workload's fw_type
+	// cannot be used with its vm_type.
+	ErrIncompatibleFirmware = errors.New("Firmware type not supported by VM type")
+
+	// ErrInvalidBlockSize is returned when a block of external IPs is
+	// asked for with a count less than one.
+	ErrInvalidBlockSize = errors.New("Invalid external IP block size")
+
+	// ErrInvalidLabels is returned when a mapping is given more labels
+	// than MaxMappingLabels, or a label which is empty or too long.
+	ErrInvalidLabels = errors.New("Invalid external IP labels")
+
+	// ErrPoolLimitReached is returned when adding a pool would take the
+	// deployment past its configured maximum number of pools.
+	ErrPoolLimitReached = errors.New("Pool limit reached")
+
+	// ErrMappingLimitReached is returned when mapping or reserving an
+	// external IP would take the deployment past its configured maximum
+	// number of mappings.
+	ErrMappingLimitReached = errors.New("Mapping limit reached")
+
+	// ErrInvalidWorkloadDefault is returned when the environment
+	// defaults of a workload are not valid.
+	ErrInvalidWorkloadDefault = errors.New("Invalid workload default")
 )
 
+// PoolExhaustedError is returned when an external IP cannot be allocated
+// because the pool it should come from has no free addresses. If no
+// particular pool was requested, PoolID and PoolName are empty. If leased
+// reservations will free addresses, RetryAfter is the number of seconds
+// after which one should have been released.
+type PoolExhaustedError struct {
+	PoolID     string `json:"pool_id,omitempty"`
+	PoolName   string `json:"pool_name,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+}
+
+func (e PoolExhaustedError) Error() string {
+	if e.PoolName == "" {
+		return "No pool has free IPs"
+	}
+
+	return fmt.Sprintf("Pool %s has no free IPs", e.PoolName)
+}
+
+// AddressNotAllowedError is returned when a subnet or address is added to
+// a pool which is not within any of the networks pools may be created
+// from.
+type AddressNotAllowedError struct {
+	Address string   `json:"address"`
+	Allowed []string `json:"allowed"`
+}
+
+func (e AddressNotAllowedError) Error() string {
+	return fmt.Sprintf("%s is not within the address space pools may be created from: %s", e.Address, strings.Join(e.Allowed, ", "))
+}
+
+// AddressReservedError is returned when a subnet or address which
+// overlaps an address reservation is added to a pool, or reserved again.
+type AddressReservedError struct {
+	Address       string `json:"address"`
+	ReservationID string `json:"reservation_id"`
+	Label         string `json:"label"`
+}
+
+func (e AddressReservedError) Error() string {
+	return fmt.Sprintf("%s overlaps address space reserved for %q", e.Address, e.Label)
+}
+
+// PoolNotEmptyError is returned when a pool which still has subnets, IPs
+// or mappings is deleted without force. The counts are of what must be
+// removed before the pool can be deleted.
+type PoolNotEmptyError struct {
+	PoolID   string `json:"pool_id"`
+	PoolName string `json:"pool_name"`
+	Subnets  int    `json:"subnets"`
+	IPs      int    `json:"ips"`
+	Mappings int    `json:"mappings"`
+}
+
+func (e PoolNotEmptyError) Error() string {
+	return fmt.Sprintf("Pool %s still has %d subnets, %d IPs and %d mappings", e.PoolName, e.Subnets, e.IPs, e.Mappings)
+}
+
+// InstanceMappingLimitError is returned when mapping an external IP to an
+// instance which already has the most external IPs an instance may have.
+type InstanceMappingLimitError struct {
+	InstanceID string `json:"instance_id"`
+	Mappings   int    `json:"mappings"`
+	Limit      int    `json:"limit"`
+}
+
+func (e InstanceMappingLimitError) Error() string {
+	return fmt.Sprintf("Instance %s already has %d of at most %d external IPs", e.InstanceID, e.Mappings, e.Limit)
+}
+
+// InternalIPMismatchError is returned when an external IP cannot be
+// mapped to the internal IP asked for, e.g. because it is not the
+// address of the instance. Reason explains why.
+type InternalIPMismatchError struct {
+	InstanceID string `json:"instance_id,omitempty"`
+	InternalIP string `json:"internal_ip"`
+	Reason     string `json:"reason"`
+}
+
+func (e InternalIPMismatchError) Error() string {
+	return fmt.Sprintf("Internal IP %s cannot be mapped: %s", e.InternalIP, e.Reason)
+}
+
+// SubQuotaExceedsParentError is returned when setting a sub-quota would
+// make the sub-quotas of a tenant add up to more than the tenant's quota.
+// Available is how much of the tenant quota is not given to other
+// sub-quotas.
+type SubQuotaExceedsParentError struct {
+	Name      string `json:"name"`
+	Value     int    `json:"value"`
+	Available int    `json:"available"`
+}
+
+func (e SubQuotaExceedsParentError) Error() string {
+	return fmt.Sprintf("Sub-quota %s of %d exceeds the %d left in the tenant quota",
+		e.Name, e.Value, e.Available)
+}
+
+// QuotaBelowUsage is a quota which an update would set below the usage of
+// the tenant.
+type QuotaBelowUsage struct {
+	Name  string `json:"name"`
+	Value int    `json:"value"`
+	Usage int    `json:"usage"`
+}
+
+// QuotaBelowUsageError is returned when updating the quotas of a tenant
+// would leave it over some of them straight away, and overcommitting was
+// not allowed.
+type QuotaBelowUsageError struct {
+	Quotas []QuotaBelowUsage `json:"quotas"`
+}
+
+func (e QuotaBelowUsageError) Error() string {
+	if len(e.Quotas) == 1 {
+		q := e.Quotas[0]
+		return fmt.Sprintf("Quota %s of %d is below the current usage of %d",
+			q.Name, q.Value, q.Usage)
+	}
+
+	return fmt.Sprintf("%d quotas are below the current usage", len(e.Quotas))
+}
+
+// LastPoolInFamilyError is returned when deleting a pool would leave no
+// pool with addresses of one of the pool's address families.
+type LastPoolInFamilyError struct {
+	PoolID   string `json:"pool_id"`
+	PoolName string `json:"pool_name"`
+	Family   string `json:"family"`
+}
+
+func (e LastPoolInFamilyError) Error() string {
+	return fmt.Sprintf("Deleting pool %s removes the last source of %s addresses", e.PoolName, e.Family)
+}
+
 // Link provides a url and relationship for a resource.
 type Link struct {
 	Rel  string `json:"rel"`
@@ -569,8 +1162,110 @@ type ExternalSubnet struct {
 	ID    string `json:"id"`
 	CIDR  string `json:"subnet"`
 	Links []Link `json:"links"`
+
+	// Drained subnets allocate no new external IPs, but the
+	// addresses already mapped from them keep working.
+	Drained bool `json:"drained,omitempty"`
+}
+
+// SubnetAddressFree is the status of a subnet address which is not
+// mapped. Mapped addresses have the status of their mapping, e.g.
+// MappedIPAttached.
+const SubnetAddressFree = "free"
+
+// SubnetAddress is an address of a subnet, with the mapping which uses it
+// if it is not free.
+type SubnetAddress struct {
+	Address    string `json:"address"`
+	Status     string `json:"status"`
+	MappingID  string `json:"mapping_id,omitempty"`
+	InstanceID string `json:"instance_id,omitempty"`
+	TenantID   string `json:"tenant_id,omitempty"`
+}
+
+// SubnetInventory lists the addresses of a subnet which can be allocated,
+// starting Offset addresses into the subnet. Large subnets are listed a
+// page at a time, and a "next" link is given while there are more.
+type SubnetInventory struct {
+	ID        string          `json:"id"`
+	CIDR      string          `json:"subnet"`
+	Drained   bool            `json:"drained,omitempty"`
+	Offset    int             `json:"offset"`
+	Addresses []SubnetAddress `json:"addresses"`
+	Links     []Link          `json:"links"`
+}
+
+// ReclaimableAddress is a reserved external IP which has not been mapped to
+// an instance for UnattachedSeconds, and so may no longer be needed.
+type ReclaimableAddress struct {
+	MappingID         string            `json:"mapping_id"`
+	ExternalIP        string            `json:"external_ip"`
+	TenantID          string            `json:"tenant_id"`
+	ReservedSince     time.Time         `json:"reserved_since"`
+	UnattachedSeconds int64             `json:"unattached_seconds"`
+	Labels            map[string]string `json:"labels,omitempty"`
+}
+
+// ReclaimableResponse is returned from GET /pools/{pool}/reclaimable. It
+// lists the reservations which have been unattached for at least
+// OlderThanSeconds, the longest unattached first.
+type ReclaimableResponse struct {
+	PoolID           string               `json:"pool_id"`
+	OlderThanSeconds int64                `json:"older_than_seconds"`
+	Addresses        []ReclaimableAddress `json:"addresses"`
+}
+
+// AddressRange is a run of consecutive addresses, from First to Last
+// inclusive.
+type AddressRange struct {
+	First string `json:"first"`
+	Last  string `json:"last"`
+}
+
+// SubnetBitmap shows which addresses of a subnet are allocated, as the
+// ranges of allocated addresses. Subnets of at most MaxBitmapAddresses
+// addresses are also shown as a base64 encoded bitmap, in which bit n,
+// counting from the most significant bit of the first byte, is set if
+// the address n after the subnet's network address is allocated.
+type SubnetBitmap struct {
+	ID        string         `json:"id"`
+	CIDR      string         `json:"subnet"`
+	Allocated int            `json:"allocated"`
+	Bitmap    string         `json:"bitmap,omitempty"`
+	Ranges    []AddressRange `json:"ranges"`
+}
+
+// SubnetFragmentation describes how the free addresses of a subnet are
+// split into runs of consecutive addresses. LargestFreeRange is nil if the
+// subnet has no free addresses.
+type SubnetFragmentation struct {
+	ID               string        `json:"id"`
+	CIDR             string        `json:"subnet"`
+	Free             int           `json:"free"`
+	FreeBlocks       int           `json:"free_blocks"`
+	LargestFreeBlock int           `json:"largest_free_block"`
+	LargestFreeRange *AddressRange `json:"largest_free_range,omitempty"`
+}
+
+// PoolFragmentation describes how the free addresses of the subnets of a
+// pool are split up. Fragmentation is 1 - LargestFreeBlock / Free, 0 when
+// the free addresses are one block, or there are none, and nearing 1 as
+// they are scattered. Addresses added to the pool individually are not
+// counted.
+type PoolFragmentation struct {
+	PoolID           string                `json:"pool_id"`
+	Free             int                   `json:"free"`
+	FreeBlocks       int                   `json:"free_blocks"`
+	LargestFreeBlock int                   `json:"largest_free_block"`
+	LargestFreeRange *AddressRange         `json:"largest_free_range,omitempty"`
+	Fragmentation    float64               `json:"fragmentation"`
+	Subnets          []SubnetFragmentation `json:"subnets"`
 }
 
+// MaxBitmapAddresses is the size of the largest subnet which is shown as
+// a bitmap as well as a list of ranges.
+const MaxBitmapAddresses = 1 << 16
+
 // ExternalIP represents an External IP individual address.
 type ExternalIP struct {
 	ID      string `json:"id"`
@@ -578,7 +1273,8 @@ type ExternalIP struct {
 	Links   []Link `json:"links"`
 }
 
-// Pool represents a pool of external IPs.
+// Pool represents a pool of external IPs. Pool names are unique ignoring
+// case, and are found ignoring case, but keep the case they were given.
 type Pool struct {
 	ID       string           `json:"id"`
 	Name     string           `json:"name"`
@@ -587,8 +1283,190 @@ type Pool struct {
 	Links    []Link           `json:"links"`
 	Subnets  []ExternalSubnet `json:"subnets"`
 	IPs      []ExternalIP     `json:"ips"`
+	Tags     []string         `json:"tags,omitempty"`
+
+	// Description is free-form text about the pool, e.g. why it
+	// exists. It has no effect on allocation.
+	Description string `json:"description,omitempty"`
+
+	// TenantID is set for pools which only a single tenant may
+	// allocate from. Global pools leave it empty.
+	TenantID string `json:"tenant_id,omitempty"`
+
+	// Drained pools allocate no new external IPs, but the addresses
+	// already mapped from them keep working. Once empty, a drained
+	// pool can be deleted without force.
+	Drained bool `json:"drained,omitempty"`
+
+	// Revision is incremented each time the pool changes, including
+	// when its addresses are mapped or released. It is returned as
+	// the ETag of the pool.
+	Revision int `json:"revision"`
+}
+
+// AvailableTo reports whether a tenant may allocate from the pool.
+func (p Pool) AvailableTo(tenantID string) bool {
+	return p.TenantID == "" || p.TenantID == tenantID
 }
 
+// PoolDetails is returned when showing a single pool with its recent
+// activity, the newest entry of the event log concerning it first.
+type PoolDetails struct {
+	Pool
+	Activity []LogEntry `json:"activity"`
+}
+
+// Strategies for choosing the pool an external IP is allocated from
+// when the request does not name one.
+const (
+	// PoolSelectionFillFirst allocates from the first pool, in ID
+	// order, which has free addresses. This is the default.
+	PoolSelectionFillFirst = "fill-first"
+
+	// PoolSelectionRoundRobin allocates from each pool with free
+	// addresses in turn.
+	PoolSelectionRoundRobin = "round-robin"
+
+	// PoolSelectionLeastUsed allocates from the pool with the fewest
+	// addresses in use.
+	PoolSelectionLeastUsed = "least-used"
+)
+
+// PoolSelection reports the strategy used to choose a pool when none
+// is named.
+type PoolSelection struct {
+	Strategy string `json:"strategy"`
+}
+
+// ValidPoolSelection reports whether strategy is one of the pool selection
+// strategies.
+func ValidPoolSelection(strategy string) bool {
+	switch strategy {
+	case PoolSelectionFillFirst, PoolSelectionRoundRobin, PoolSelectionLeastUsed:
+		return true
+	}
+
+	return false
+}
+
+// TenantPoolStrategy reports the strategy used to choose a pool for a
+// tenant which names none. Inherited is set if the tenant has no strategy
+// of its own, so uses the controller's.
+type TenantPoolStrategy struct {
+	TenantID  string `json:"tenant_id"`
+	Strategy  string `json:"strategy"`
+	Inherited bool   `json:"inherited"`
+}
+
+// AddressCapacity counts the external IPs of one address family. Free
+// only counts the addresses which can be allocated, so those of drained
+// pools and subnets are left out.
+type AddressCapacity struct {
+	Free  int `json:"free"`
+	Total int `json:"total"`
+}
+
+// PoolCapacity is the capacity of all of the pools together.
+type PoolCapacity struct {
+	IPv4 AddressCapacity `json:"ipv4"`
+	IPv6 AddressCapacity `json:"ipv6"`
+}
+
+// PoolMove is the move of one reservation from a fuller pool to an
+// emptier one when the pools are rebalanced. The reservation's address
+// changes, so NewExternalIP is only known once the move is made.
+type PoolMove struct {
+	MappingID     string `json:"mapping_id"`
+	TenantID      string `json:"tenant_id"`
+	ExternalIP    string `json:"external_ip"`
+	FromPoolID    string `json:"from_pool_id"`
+	FromPoolName  string `json:"from_pool_name"`
+	ToPoolID      string `json:"to_pool_id"`
+	ToPoolName    string `json:"to_pool_name"`
+	NewExternalIP string `json:"new_external_ip,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// PoolRebalance is returned from POST /pools/rebalance. Plan lists the
+// moves which would even out the use of the pools. When the plan is
+// applied Moves lists the outcome of each of them.
+type PoolRebalance struct {
+	Applied bool       `json:"applied"`
+	Plan    []PoolMove `json:"plan"`
+	Moves   []PoolMove `json:"moves,omitempty"`
+}
+
+// MigratedMapping is one mapping moved when the mappings of a pool are
+// migrated to another. Attached mappings keep their instance, whose
+// external IP changes from ExternalIP to NewExternalIP.
+type MigratedMapping struct {
+	MappingID     string `json:"mapping_id"`
+	NewMappingID  string `json:"new_mapping_id,omitempty"`
+	TenantID      string `json:"tenant_id"`
+	InstanceID    string `json:"instance_id,omitempty"`
+	ExternalIP    string `json:"external_ip"`
+	NewExternalIP string `json:"new_external_ip"`
+	Attached      bool   `json:"attached"`
+
+	// Error says why the CNCI could not be moved to the new address,
+	// in which case the instance may have no working external IP.
+	Error string `json:"error,omitempty"`
+}
+
+// PoolMigration is returned from POST /pools/{pool}/migrate. Addresses
+// maps each old external IP to its new one, and Attached counts the
+// mappings whose instances change address. A dry run changes nothing,
+// giving the addresses which would be allocated. Failed counts the
+// mappings the CNCI could not be moved for.
+type PoolMigration struct {
+	FromPoolID string            `json:"from_pool_id"`
+	ToPoolID   string            `json:"to_pool_id"`
+	DryRun     bool              `json:"dry_run"`
+	Attached   int               `json:"attached"`
+	Failed     int               `json:"failed,omitempty"`
+	Addresses  map[string]string `json:"addresses"`
+	Mappings   []MigratedMapping `json:"mappings"`
+}
+
+// DefaultPool is the pool a tenant's external IPs are allocated from when
+// a request does not name one. Both fields are empty if the tenant has no
+// default of its own.
+type DefaultPool struct {
+	PoolID   string `json:"pool_id,omitempty"`
+	PoolName string `json:"pool_name,omitempty"`
+}
+
+// PoolOrderEntry is one of the pools of a PoolOrder, with the reason it is
+// placed where it is or, for excluded pools, left out.
+type PoolOrderEntry struct {
+	Rank     int    `json:"rank,omitempty"`
+	PoolID   string `json:"pool_id"`
+	PoolName string `json:"pool_name"`
+	Free     int    `json:"free"`
+	Reason   string `json:"reason"`
+}
+
+// PoolOrder is the order in which pools are considered for an allocation
+// for a tenant which does not name a pool. The first of Pools is the one
+// allocated from. Excluded lists the pools which would not be used.
+type PoolOrder struct {
+	TenantID    string           `json:"tenant_id"`
+	Strategy    string           `json:"strategy"`
+	DefaultPool *DefaultPool     `json:"default_pool,omitempty"`
+	Pools       []PoolOrderEntry `json:"pools"`
+	Excluded    []PoolOrderEntry `json:"excluded"`
+}
+
+// DefaultPoolRequest sets the default pool of a tenant. An empty PoolName
+// removes the tenant's default.
+type DefaultPoolRequest struct {
+	PoolName string `json:"pool_name"`
+}
+
+// MaxPoolDescriptionLength is the longest description, in bytes, which a
+// pool may be given.
+const MaxPoolDescriptionLength = 1024
+
 // NewPoolRequest is used to create a new pool.
 type NewPoolRequest struct {
 	Name   string  `json:"name"`
@@ -596,15 +1474,99 @@ type NewPoolRequest struct {
 	IPs    []struct {
 		IP string `json:"ip"`
 	} `json:"ips"`
+	Tags        []string `json:"tags"`
+	Description string   `json:"description"`
+
+	// TenantID scopes the pool to a single tenant, which alone may
+	// allocate from it.
+	TenantID string `json:"tenant_id,omitempty"`
+}
+
+// PoolBatchResult reports the outcome of creating one pool of a batch.
+// Status is the HTTP status code the pool's creation would have had
+// on its own.
+type PoolBatchResult struct {
+	Name   string `json:"name"`
+	Status int    `json:"status"`
+	Pool   *Pool  `json:"pool,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// PoolBatchResponse holds the layout for returning the results of
+// creating a batch of pools, in the order they were requested.
+type PoolBatchResponse struct {
+	Results []PoolBatchResult `json:"results"`
+}
+
+// Kinds of conflict a proposed pool can have.
+const (
+	// PoolConflictName is a pool name which is missing, or which is
+	// already used by another pool.
+	PoolConflictName = "name"
+
+	// PoolConflictOverlap is an address or subnet which overlaps
+	// those of another pool.
+	PoolConflictOverlap = "overlap"
+)
+
+// PoolConflict describes why one of a set of proposed pools could not be
+// created. Index is the position of the proposed pool in the request. The
+// pool it conflicts with is either an existing pool, given by PoolID and
+// PoolName, or another proposed pool, given by OtherIndex.
+type PoolConflict struct {
+	Index      int    `json:"index"`
+	Name       string `json:"name"`
+	Kind       string `json:"kind"`
+	Address    string `json:"address,omitempty"`
+	PoolID     string `json:"pool_id,omitempty"`
+	PoolName   string `json:"pool_name,omitempty"`
+	OtherIndex *int   `json:"other_index,omitempty"`
+	Message    string `json:"message"`
+}
+
+// PoolValidationResponse is returned from POST /pools/validate and lists
+// every conflict found among the proposed pools.
+type PoolValidationResponse struct {
+	Valid     bool           `json:"valid"`
+	Conflicts []PoolConflict `json:"conflicts"`
+}
+
+// PoolUpdateRequest is used to modify attributes of an existing pool.
+// Only the fields which are present in the request are changed.
+//
+// AddIPs and RemoveIPs list individual addresses to add to and remove
+// from the pool. Either all of them are applied or none are.
+type PoolUpdateRequest struct {
+	Name        *string   `json:"name"`
+	Tags        *[]string `json:"tags"`
+	Description *string   `json:"description"`
+	Drained     *bool     `json:"drained"`
+	AddIPs      []string  `json:"add_ips,omitempty"`
+	RemoveIPs   []string  `json:"remove_ips,omitempty"`
+}
+
+// SubnetUpdateRequest is used to drain a subnet of a pool, or to put a
+// drained subnet back in use.
+type SubnetUpdateRequest struct {
+	Drained *bool `json:"drained"`
+}
+
+// PoolExport is a snapshot of every pool, with its subnets and addresses,
+// and the external IPs mapped from them.
+type PoolExport struct {
+	Pools    []Pool     `json:"pools"`
+	Mappings []MappedIP `json:"mappings"`
 }
 
 // PoolSummary is a short form of Pool.
 type PoolSummary struct {
-	ID       string `json:"id"`
-	Name     string `json:"name"`
-	Free     *int   `json:"free,omitempty"`
-	TotalIPs *int   `json:"total_ips,omitempty"`
-	Links    []Link `json:"links,omitempty"`
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Free        *int     `json:"free,omitempty"`
+	TotalIPs    *int     `json:"total_ips,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Links       []Link   `json:"links,omitempty"`
 }
 
 // ListPoolsResponse respresents a summary list of all pools.
@@ -612,6 +1574,12 @@ type ListPoolsResponse struct {
 	Pools []PoolSummary `json:"pools"`
 }
 
+// TenantPoolsResponse is returned from GET /tenants/{tenant}/pools,
+// listing the global pools and those scoped to the tenant.
+type TenantPoolsResponse struct {
+	Pools []Pool `json:"pools"`
+}
+
 // NewIPAddressRequest is used to add a new external IP to a pool.
 type NewIPAddressRequest struct {
 	IP string `json:"ip"`
@@ -623,7 +1591,19 @@ type NewAddressRequest struct {
 	IPs    []NewIPAddressRequest `json:"ips"`
 }
 
+const (
+	// MappedIPAttached is the status of an external IP which is
+	// mapped to an instance.
+	MappedIPAttached = "attached"
+
+	// MappedIPReserved is the status of an external IP which has been
+	// reserved by a tenant but is not yet mapped to an instance.
+	MappedIPReserved = "reserved"
+)
+
 // MappedIP represents a mapping of external IP -> instance IP.
+// Reserved external IPs have no instance, so InstanceID and
+// InternalIP are empty.
 type MappedIP struct {
 	ID         string `json:"mapping_id"`
 	ExternalIP string `json:"external_ip"`
@@ -632,23 +1612,401 @@ type MappedIP struct {
 	TenantID   string `json:"tenant_id"`
 	PoolID     string `json:"pool_id"`
 	PoolName   string `json:"pool_name"`
-	Links      []Link `json:"links"`
+	Status     string `json:"status"`
+
+	// SubnetID and SubnetCIDR name the subnet of the pool the external
+	// IP was allocated from. They are empty for IPs added to the pool
+	// individually.
+	SubnetID   string `json:"subnet_id,omitempty"`
+	SubnetCIDR string `json:"subnet_cidr,omitempty"`
+
+	// Index orders the external IPs mapped to one instance. The first
+	// IP mapped to an instance has index 0, and later mappings take the
+	// lowest index not in use.
+	Index int `json:"index"`
+
+	// Role is an optional label given when the IP is mapped, e.g.
+	// "public" or "management". It is unique among the mappings of
+	// an instance.
+	Role string `json:"role,omitempty"`
+
+	// Expires is when a reservation made with a lease is released if
+	// it has not been mapped to an instance. It is nil for mappings
+	// without a lease.
+	Expires *time.Time `json:"expires,omitempty"`
+
+	// ReservedSince is when a reserved IP was last left without an
+	// instance, either by being reserved or by being remapped to none.
+	// It is nil for IPs mapped to instances.
+	ReservedSince *time.Time `json:"reserved_since,omitempty"`
+
+	// Created is when the external IP was allocated to the tenant,
+	// whether it was mapped to an instance or reserved. It is kept
+	// when the IP is remapped.
+	Created *time.Time `json:"created,omitempty"`
+
+	// BlockID is set on reservations made as part of a block by
+	// ReserveBlock. The block is released as a unit.
+	BlockID string `json:"block_id,omitempty"`
+
+	// Labels are set by clients to keep their own data with the
+	// mapping. They are opaque to the controller.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// PTR is the name the reverse DNS record of the external IP is
+	// expected to give. It is only set in listings when the API is
+	// configured with a PTR template.
+	PTR   string `json:"ptr,omitempty"`
+	Links []Link `json:"links"`
+}
+
+const (
+	// MaxMappingLabels is the most labels one mapping may have.
+	MaxMappingLabels = 16
+
+	// MaxLabelKeyLength is the longest label key, in bytes.
+	MaxLabelKeyLength = 63
+
+	// MaxLabelValueLength is the longest label value, in bytes.
+	MaxLabelValueLength = 255
+)
+
+// ValidateMappingLabels returns ErrInvalidLabels if labels cannot be
+// given to a mapping.
+func ValidateMappingLabels(labels map[string]string) error {
+	if len(labels) > MaxMappingLabels {
+		return ErrInvalidLabels
+	}
+
+	for k, v := range labels {
+		if k == "" || len(k) > MaxLabelKeyLength || len(v) > MaxLabelValueLength {
+			return ErrInvalidLabels
+		}
+	}
+
+	return nil
+}
+
+const (
+	// MappedIPCreated is the type of the change made when an external IP
+	// is mapped or reserved.
+	MappedIPCreated = "created"
+
+	// MappedIPChanged is the type of the change made when an external IP
+	// is remapped to a different instance.
+	MappedIPChanged = "changed"
+
+	// MappedIPDeleted is the type of the change made when an external IP
+	// is unmapped.
+	MappedIPDeleted = "deleted"
+)
+
+// MappedIPChange describes a change to a mapped external IP.
+type MappedIPChange struct {
+	Type    string   `json:"type"`
+	Mapping MappedIP `json:"mapping"`
+}
+
+const (
+	// AssignmentMapped is the action of an AssignmentRecord made when
+	// an external IP is mapped to an instance.
+	AssignmentMapped = "mapped"
+
+	// AssignmentReserved is the action of an AssignmentRecord made when
+	// an external IP is reserved for a tenant without an instance.
+	AssignmentReserved = "reserved"
+
+	// AssignmentReleased is the action of an AssignmentRecord made when
+	// an external IP is unmapped or its reservation released.
+	AssignmentReleased = "released"
+)
+
+// AssignmentRecord is an entry in the history of an external IP, saying
+// who the IP was assigned to from Timestamp.
+type AssignmentRecord struct {
+	Timestamp  time.Time `json:"time_stamp"`
+	Action     string    `json:"action"`
+	MappingID  string    `json:"mapping_id"`
+	TenantID   string    `json:"tenant_id"`
+	InstanceID string    `json:"instance_id,omitempty"`
+	InternalIP string    `json:"internal_ip,omitempty"`
+}
+
+// AddressHistoryResponse is returned from GET
+// /external-ips/{ip}/history. The records are oldest first.
+type AddressHistoryResponse struct {
+	ExternalIP string             `json:"external_ip"`
+	History    []AssignmentRecord `json:"history"`
 }
 
 // MappedIPShort is a summary version of a MappedIP.
 type MappedIPShort struct {
-	ID         string `json:"mapping_id"`
-	ExternalIP string `json:"external_ip"`
-	InternalIP string `json:"internal_ip"`
-	InstanceID string `json:"instance_id"`
-	Links      []Link `json:"links"`
+	ID         string            `json:"mapping_id"`
+	ExternalIP string            `json:"external_ip"`
+	InternalIP string            `json:"internal_ip"`
+	InstanceID string            `json:"instance_id"`
+	Status     string            `json:"status"`
+	Index      int               `json:"index"`
+	Role       string            `json:"role,omitempty"`
+	Expires    *time.Time        `json:"expires,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	PTR        string            `json:"ptr,omitempty"`
+	Links      []Link            `json:"links"`
+}
+
+// InstanceInfo is the basic information about an instance which is
+// embedded in listings of the external IPs mapped to it.
+type InstanceInfo struct {
+	ID     string `json:"instance_id"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+// MappedIPWithInstance is a MappedIP along with the instance it is
+// mapped to. Instance is nil for reservations and for instances which
+// cannot be found.
+type MappedIPWithInstance struct {
+	MappedIP
+	Instance *InstanceInfo `json:"instance"`
+}
+
+// MappedIPShortWithInstance is a MappedIPShort along with the instance it
+// is mapped to, as for MappedIPWithInstance.
+type MappedIPShortWithInstance struct {
+	MappedIPShort
+	Instance *InstanceInfo `json:"instance"`
+}
+
+// MappedIPFilter selects mapped external IPs. A field which is empty
+// matches any mapping.
+type MappedIPFilter struct {
+	TenantID   string
+	Status     string
+	PoolID     string
+	InternalIP string
+	InstanceID string
+
+	// Labels selects the mappings which have all of these labels.
+	Labels map[string]string
+
+	// CreatedBefore, if not zero, selects the mappings created before
+	// it.
+	CreatedBefore time.Time
+}
+
+// Matches reports whether a mapping is selected by the filter.
+func (f MappedIPFilter) Matches(m MappedIP) bool {
+	if !f.CreatedBefore.IsZero() && (m.Created == nil || !m.Created.Before(f.CreatedBefore)) {
+		return false
+	}
+
+	for k, v := range f.Labels {
+		if l, ok := m.Labels[k]; !ok || l != v {
+			return false
+		}
+	}
+
+	return (f.TenantID == "" || m.TenantID == f.TenantID) &&
+		(f.Status == "" || m.Status == f.Status) &&
+		(f.PoolID == "" || m.PoolID == f.PoolID) &&
+		(f.InternalIP == "" || m.InternalIP == f.InternalIP) &&
+		(f.InstanceID == "" || m.InstanceID == f.InstanceID)
+}
+
+// CountResponse is returned by the list endpoints, in place of the list,
+// when a client asks only for the number of items with count=true.
+type CountResponse struct {
+	Count int `json:"count"`
 }
 
 // MapIPRequest is used to request that an external IP be assigned from a pool
-// to a particular instance.
+// to a particular instance. If no InstanceID is given the external IP is
+// reserved for the tenant, and may be mapped to an instance later.
+//
+// An instance may have several external IPs. Role optionally labels the
+// new mapping so that it can be told apart from the others.
+//
+// A reservation may be given a lease, in which case it is released if it
+// has not been mapped to an instance within LeaseSeconds.
+//
+// InternalIP may be given to say which address of the instance the
+// external IP must map to. It is found from the instance if omitted.
 type MapIPRequest struct {
-	PoolName   *string `json:"pool_name"`
-	InstanceID string  `json:"instance_id"`
+	PoolName     *string           `json:"pool_name"`
+	InstanceID   string            `json:"instance_id"`
+	InternalIP   string            `json:"internal_ip,omitempty"`
+	Role         string            `json:"role,omitempty"`
+	LeaseSeconds int               `json:"lease_seconds,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+}
+
+// ProvisionRequest creates a workload, or names one the tenant may use,
+// and reserves an external IP for it from the pool PoolName, chosen as for
+// MapIPRequest if not given. Exactly one of Workload and WorkloadID is set.
+// TenantID is only read from requests which do not name the tenant in
+// their path.
+type ProvisionRequest struct {
+	TenantID   string    `json:"tenant_id,omitempty"`
+	Workload   *Workload `json:"workload,omitempty"`
+	WorkloadID string    `json:"workload_id,omitempty"`
+	PoolName   *string   `json:"pool_name"`
+}
+
+// ProvisionResponse is returned by a successful ProvisionRequest. The
+// external IP is reserved for the tenant, to be mapped to an instance of
+// the workload once it has one.
+type ProvisionResponse struct {
+	Workload   WorkloadResponse `json:"workload"`
+	ExternalIP MappedIP         `json:"external_ip"`
+}
+
+// ReleaseAddressesRequest selects every mapping a tenant holds from a pool,
+// to be released at once.
+type ReleaseAddressesRequest struct {
+	TenantID string `json:"tenant_id"`
+	PoolID   string `json:"pool_id"`
+}
+
+// ReleasedAddress is an external IP released by a ReleaseAddressesRequest.
+// Attached is set if it was mapped to an instance, which has lost it.
+type ReleasedAddress struct {
+	MappingID  string `json:"mapping_id"`
+	ExternalIP string `json:"external_ip"`
+	InstanceID string `json:"instance_id,omitempty"`
+	Attached   bool   `json:"attached"`
+}
+
+// ReleaseAddressesResponse reports the external IPs released by a
+// ReleaseAddressesRequest, and the instances they were taken from.
+type ReleaseAddressesResponse struct {
+	Count             int               `json:"count"`
+	Released          []ReleasedAddress `json:"released"`
+	AffectedInstances []string          `json:"affected_instances"`
+}
+
+// ReserveBlockRequest is used to reserve Count consecutive external IPs
+// from a pool for a tenant. If no PoolName is given the pool is chosen
+// as for MapIPRequest.
+type ReserveBlockRequest struct {
+	PoolName string `json:"pool_name"`
+	Count    int    `json:"count"`
+}
+
+// ReservedBlock is returned when a block of external IPs is reserved.
+// The block is released with its BlockID.
+type ReservedBlock struct {
+	BlockID  string     `json:"block_id"`
+	Mappings []MappedIP `json:"mappings"`
+}
+
+// AddressReservation holds address space back from pools, e.g. for a
+// network which is yet to be handed over. No pool may take any address
+// within CIDR until the reservation is deleted.
+type AddressReservation struct {
+	ID      string    `json:"id"`
+	CIDR    string    `json:"cidr"`
+	Label   string    `json:"label"`
+	Created time.Time `json:"created"`
+}
+
+// NewAddressReservationRequest is used to reserve address space.
+type NewAddressReservationRequest struct {
+	CIDR  string `json:"cidr"`
+	Label string `json:"label"`
+}
+
+// ListAddressReservationsResponse is returned when address reservations
+// are listed.
+type ListAddressReservationsResponse struct {
+	Reservations []AddressReservation `json:"reservations"`
+}
+
+// Health statuses of the dependencies of the controller.
+const (
+	// HealthOK is a dependency which answered in time.
+	HealthOK = "ok"
+
+	// HealthUnhealthy is a dependency which failed its check.
+	HealthUnhealthy = "unhealthy"
+
+	// HealthTimeout is a dependency which did not answer before the
+	// check timed out.
+	HealthTimeout = "timeout"
+)
+
+// HealthCheck is the outcome of checking one dependency of the controller.
+type HealthCheck struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// HealthReport describes the health of each dependency of the controller.
+// Status is HealthOK only if every check is.
+type HealthReport struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+// ClaimRequest is used to claim Count external IPs for a tenant, as the
+// first phase of provisioning them. The claim is abandoned, and its
+// addresses released, unless it is committed within TTLSeconds. TenantID
+// is only given by the admin, tenants claim addresses for themselves.
+type ClaimRequest struct {
+	TenantID   string `json:"tenant_id,omitempty"`
+	PoolName   string `json:"pool_name"`
+	Count      int    `json:"count"`
+	TTLSeconds int    `json:"ttl_seconds,omitempty"`
+}
+
+// ExternalIPClaim holds external IPs reserved by a ClaimRequest until they
+// are committed to instances or abandoned using its Token. Expires is not
+// set once the claim has been committed.
+type ExternalIPClaim struct {
+	Token    string     `json:"token"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	Mappings []MappedIP `json:"mappings"`
+}
+
+// CommitClaimRequest maps the external IPs of a claim to instances, the
+// first address of the claim to the first instance and so on. There must
+// be one instance for each address.
+type CommitClaimRequest struct {
+	InstanceIDs []string `json:"instance_ids"`
+}
+
+// RemapIPRequest is used to request that a reserved external IP be
+// mapped to an instance, or to change the labels of a mapping. If Labels
+// is given it replaces all of the mapping's labels, an empty map removes
+// them. A request with only Labels leaves the mapping where it is.
+type RemapIPRequest struct {
+	InstanceID string            `json:"instance_id"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+// SwapIPsRequest is sent to swap the instances two external IPs are
+// mapped to. The mappings are given either by their IDs or by the IDs of
+// the instances they are mapped to, which must have only one mapping.
+type SwapIPsRequest struct {
+	MappingIDs  []string `json:"mapping_ids,omitempty"`
+	InstanceIDs []string `json:"instance_ids,omitempty"`
+}
+
+// MappingLabelFilter selects the mappings a LabelMappingsRequest applies
+// to. Fields which are empty match every mapping.
+type MappingLabelFilter struct {
+	PoolID   string `json:"pool_id"`
+	TenantID string `json:"tenant"`
+	State    string `json:"state"`
+}
+
+// LabelMappingsRequest is sent to add labels to every mapping matched by
+// the filter. The labels are added to those the mappings already have,
+// replacing any with the same key.
+type LabelMappingsRequest struct {
+	Filter MappingLabelFilter `json:"filter"`
+	Labels map[string]string  `json:"labels"`
 }
 
 // QuotaDetails holds information for updating and querying quotas
@@ -656,6 +2014,59 @@ type QuotaDetails struct {
 	Name  string
 	Value int
 	Usage int
+
+	// Unit is what Value and Usage are measured in, e.g. QuotaUnitCount.
+	Unit string
+}
+
+// Units quotas may be measured in.
+const (
+	QuotaUnitCount = "count"
+	QuotaUnitVCPU  = "vcpu"
+	QuotaUnitMB    = "mb"
+	QuotaUnitGB    = "gb"
+	QuotaUnitHour  = "hour"
+)
+
+// Kinds of quota. Count quotas limit how many of something a tenant has,
+// size quotas limit how large things are and duration quotas limit how
+// long things are held for.
+const (
+	QuotaKindCount    = "count"
+	QuotaKindSize     = "size"
+	QuotaKindDuration = "duration"
+)
+
+// QuotaDefinition describes one of the quotas which can be set for a
+// tenant, whatever its value.
+type QuotaDefinition struct {
+	Name        string `json:"name"`
+	Unit        string `json:"unit"`
+	Kind        string `json:"kind"`
+	Description string `json:"description"`
+}
+
+// QuotaDefinitionsResponse is returned from GET /quotas/definitions.
+type QuotaDefinitionsResponse struct {
+	Definitions []QuotaDefinition `json:"definitions"`
+}
+
+// UsagePercent returns how much of the quota has been used, as a
+// percentage rounded to two decimal places, or nil if the quota is
+// unlimited. A quota of zero is full as soon as anything is used.
+func (qd *QuotaDetails) UsagePercent() *float64 {
+	if qd.Value == -1 {
+		return nil
+	}
+
+	var percent float64
+	if qd.Value > 0 {
+		percent = math.Round(float64(qd.Usage)*10000/float64(qd.Value)) / 100
+	} else if qd.Usage > 0 {
+		percent = 100
+	}
+
+	return &percent
 }
 
 // MarshalJSON provides a custom marshaller for quota API
@@ -671,9 +2082,11 @@ func (qd *QuotaDetails) MarshalJSON() ([]byte, error) {
 		return json.Marshal(&struct {
 			Name  string `json:"name"`
 			Value string `json:"value"`
+			Unit  string `json:"unit,omitempty"`
 		}{
 			Name:  qd.Name,
 			Value: v,
+			Unit:  qd.Unit,
 		})
 	}
 
@@ -681,10 +2094,16 @@ func (qd *QuotaDetails) MarshalJSON() ([]byte, error) {
 		Name  string `json:"name"`
 		Value string `json:"value"`
 		Usage string `json:"usage"`
+		Unit  string `json:"unit,omitempty"`
+
+		UsagePercent *float64 `json:"usage_percent"`
 	}{
 		Name:  qd.Name,
 		Value: v,
 		Usage: strconv.Itoa(qd.Usage),
+		Unit:  qd.Unit,
+
+		UsagePercent: qd.UsagePercent(),
 	})
 }
 
@@ -694,6 +2113,7 @@ func (qd *QuotaDetails) UnmarshalJSON(data []byte) error {
 		Name  string `json:"name"`
 		Value string `json:"value"`
 		Usage string `json:"usage"`
+		Unit  string `json:"unit"`
 	}{}
 
 	err := json.Unmarshal(data, &tmp)
@@ -702,6 +2122,7 @@ func (qd *QuotaDetails) UnmarshalJSON(data []byte) error {
 	}
 
 	qd.Name = tmp.Name
+	qd.Unit = tmp.Unit
 	if tmp.Value == "unlimited" {
 		qd.Value = -1
 	} else {
@@ -711,14 +2132,156 @@ func (qd *QuotaDetails) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// CreateTenantRequest holds the layout for creating a tenant. Quotas
+// are optional and are applied once the tenant has been created.
+type CreateTenantRequest struct {
+	Name   string         `json:"name"`
+	Quotas []QuotaDetails `json:"quotas,omitempty"`
+}
+
 // QuotaUpdateRequest holds the layout for updating quota API
 type QuotaUpdateRequest struct {
 	Quotas []QuotaDetails `json:"quotas"`
 }
 
+// QuotaBulkUpdate holds the quotas to apply to one tenant as part of a
+// bulk quota update.
+type QuotaBulkUpdate struct {
+	TenantID string         `json:"tenant_id"`
+	Quotas   []QuotaDetails `json:"quotas"`
+}
+
+// QuotaBulkResult reports whether the quotas of one tenant in a bulk
+// quota update were applied. Status is the HTTP status code updating the
+// tenant's quotas would have had on its own.
+type QuotaBulkResult struct {
+	TenantID string `json:"tenant_id"`
+	Success  bool   `json:"success"`
+	Status   int    `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+// QuotaBulkResponse holds the layout for returning the results of a bulk
+// quota update, one for each tenant in the request.
+type QuotaBulkResponse struct {
+	Results []QuotaBulkResult `json:"results"`
+}
+
+// QuotaSummary gives an overview of a tenant's quotas. NearLimit counts
+// the quotas with more than 80% of their value used.
+type QuotaSummary struct {
+	Total     int `json:"total"`
+	NearLimit int `json:"near_limit"`
+	Unlimited int `json:"unlimited"`
+}
+
+// QuotaBreakdown attributes the usage of a quota to the instances which
+// consume it. Unattributed is the usage no instance accounts for, so the
+// usage of the instances and Unattributed always sum to Usage.
+type QuotaBreakdown struct {
+	Name         string          `json:"name"`
+	Usage        int             `json:"usage"`
+	Instances    []InstanceUsage `json:"instances"`
+	Unattributed int             `json:"unattributed"`
+}
+
+// InstanceUsage is what an instance contributes to the usage of a quota.
+type InstanceUsage struct {
+	InstanceID string `json:"instance_id"`
+	Name       string `json:"name,omitempty"`
+	WorkloadID string `json:"workload_id"`
+	Usage      int    `json:"usage"`
+}
+
+// QuotaRecalculateResponse is returned after recalculating a tenant's
+// quota usage. Previous holds the quotas as they were beforehand.
+type QuotaRecalculateResponse struct {
+	Previous []QuotaDetails `json:"previous"`
+	Quotas   []QuotaDetails `json:"quotas"`
+}
+
+// TenantExceededQuotas holds the quotas of a tenant whose usage is above
+// their value.
+type TenantExceededQuotas struct {
+	TenantID string         `json:"tenant_id"`
+	Quotas   []QuotaDetails `json:"quotas"`
+}
+
+// ExceededQuotasResponse lists every tenant which is over one or more of
+// its quotas.
+type ExceededQuotasResponse struct {
+	Tenants []TenantExceededQuotas `json:"tenants"`
+}
+
+// Sources of the effective value of a quota.
+const (
+	// QuotaSourceDefault is a quota whose value has never been set for
+	// the tenant.
+	QuotaSourceDefault = "default"
+
+	// QuotaSourceOverride is a quota whose value has been set for the
+	// tenant.
+	QuotaSourceOverride = "override"
+)
+
+// EffectiveQuota explains the value a tenant has for a quota. Source is
+// QuotaSourceDefault or QuotaSourceOverride and SubQuotas holds the part
+// of the value given to each of the tenant's sub-quotas which limit it.
+type EffectiveQuota struct {
+	Quota     QuotaDetails   `json:"quota"`
+	Source    string         `json:"source"`
+	SubQuotas map[string]int `json:"sub_quotas,omitempty"`
+}
+
+// EffectiveQuotaResponse holds the layout for returning the effective
+// quotas of a tenant.
+type EffectiveQuotaResponse struct {
+	Quotas []EffectiveQuota `json:"quotas"`
+}
+
+// QuotaSnapshot is the quota configuration of a tenant: the quotas set for
+// it, leaving out those it inherits, and its sub-quotas.
+type QuotaSnapshot struct {
+	TenantID  string                    `json:"tenant_id"`
+	Quotas    []QuotaDetails            `json:"quotas"`
+	SubQuotas map[string][]QuotaDetails `json:"sub_quotas,omitempty"`
+}
+
+// QuotaSnapshotResponse returns a snapshot of the quota configuration of
+// a tenant. Snapshot is opaque, and is only to be given back when
+// restoring it.
+type QuotaSnapshotResponse struct {
+	TenantID string `json:"tenant_id"`
+	Snapshot string `json:"snapshot"`
+}
+
+// QuotaRestoreRequest holds a snapshot of the quota configuration of a
+// tenant to restore.
+type QuotaRestoreRequest struct {
+	Snapshot string `json:"snapshot"`
+}
+
+// SkippedQuota is an entry of a quota snapshot which was not restored.
+// Sub is the sub-quota it belongs to, and is empty for the quotas of the
+// tenant itself.
+type SkippedQuota struct {
+	Sub    string `json:"sub,omitempty"`
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// QuotaRestoreResponse holds the quotas of a tenant once a snapshot has
+// been restored, with the entries of the snapshot which were skipped.
+type QuotaRestoreResponse struct {
+	Quotas  []QuotaDetails `json:"quotas"`
+	Skipped []SkippedQuota `json:"skipped"`
+}
+
 // QuotaListResponse holds the layout for returning quotas in the API
 type QuotaListResponse struct {
-	Quotas []QuotaDetails `json:"quotas"`
+	Quotas    []QuotaDetails   `json:"quotas"`
+	Summary   *QuotaSummary    `json:"summary,omitempty"`
+	Breakdown []QuotaBreakdown `json:"breakdown,omitempty"`
 }
 
 // CNCIController is the interface for the cnci controller associated with each tenant
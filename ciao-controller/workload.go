@@ -15,6 +15,10 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"time"
+
 	"github.com/golang/glog"
 
 	"github.com/01org/ciao/ciao-controller/types"
@@ -22,83 +26,116 @@ import (
 	"github.com/01org/ciao/ssntp/uuid"
 )
 
-func validateVMWorkload(req types.Workload) error {
-	// FWType must be either EFI or legacy.
-	if req.FWType != string(payloads.EFI) && req.FWType != payloads.Legacy {
-		return types.ErrBadRequest
+// violation is a problem with one field of a workload request. err is
+// the error CreateWorkload returns for it.
+type violation struct {
+	field   string
+	message string
+	err     error
+}
+
+// violations collects every problem with a request, rather than stopping
+// at the first.
+type violations []violation
+
+func (vs *violations) add(err error, field string, format string, args ...interface{}) {
+	*vs = append(*vs, violation{field, fmt.Sprintf(format, args...), err})
+}
+
+func (vs violations) fieldErrors() []types.FieldError {
+	fields := make([]types.FieldError, len(vs))
+	for i, v := range vs {
+		fields[i] = types.FieldError{Field: v.field, Message: v.message}
 	}
 
+	return fields
+}
+
+func validateVMWorkload(req types.Workload, vs *violations) {
 	// Must have storage for VMs
 	if len(req.Storage) == 0 {
-		return types.ErrBadRequest
+		vs.add(types.ErrBadRequest, "storage", "must not be empty for %s workloads", req.VMType)
 	}
-
-	return nil
 }
 
-func validateContainerWorkload(req types.Workload) error {
+func validateContainerWorkload(req types.Workload, vs *violations) {
 	// we should reject anything with ImageID set, but
 	// we'll just ignore it.
 	if req.ImageName == "" {
-		return types.ErrBadRequest
+		vs.add(types.ErrBadRequest, "image_name", "must be set for %s workloads", req.VMType)
 	}
-
-	return nil
 }
 
-func validateWorkloadStorage(req types.Workload) error {
+func validateWorkloadStorage(req types.Workload, vs *violations) {
+	invalid := func(i int, field string, format string, args ...interface{}) {
+		vs.add(types.ErrInvalidStorage, fmt.Sprintf("storage[%d].%s", i, field), format, args...)
+	}
+
 	bootableCount := 0
-	for i := range req.Storage {
+	for i, s := range req.Storage {
 		// check that a workload type is specified
-		if req.Storage[i].SourceType == "" {
-			return types.ErrBadRequest
+		switch s.SourceType {
+		case types.ImageService, types.VolumeService, types.Empty:
+		default:
+			invalid(i, "source_type", "must be one of %s, %s or %s", types.ImageService, types.VolumeService, types.Empty)
+		}
+
+		if s.Size < 0 {
+			invalid(i, "size", "must not be negative")
 		}
 
 		// you may not request a bootable empty volume.
-		if req.Storage[i].Bootable && req.Storage[i].SourceType == types.Empty {
-			return types.ErrBadRequest
+		if s.Bootable && s.SourceType == types.Empty {
+			invalid(i, "bootable", "must be false for %s storage", types.Empty)
 		}
 
-		if req.Storage[i].ID != "" {
+		if s.ID != "" {
 			// validate that the id is at least valid
 			// uuid4.
-			_, err := uuid.Parse(req.Storage[i].ID)
-			if err != nil {
-				return types.ErrBadRequest
+			if _, err := uuid.Parse(s.ID); err != nil {
+				invalid(i, "id", "must be a UUID")
 			}
 
 			// If we have an ID we must have a type to get it from
-			if req.Storage[i].SourceType != types.Empty {
-				return types.ErrBadRequest
+			if s.SourceType != types.Empty {
+				invalid(i, "id", "must be blank for %s storage", s.SourceType)
 			}
+		} else if s.Bootable && s.Size == 0 {
+			// a new volume to boot from must say how big it is.
+			invalid(i, "size", "must be > 0 for new bootable storage")
 		}
 
-		if req.Storage[i].SourceID == "" {
+		if s.SourceID == "" {
 			// you may only use no source id with empty type
-			if req.Storage[i].SourceType != types.Empty {
-				return types.ErrBadRequest
+			if s.SourceType != types.Empty {
+				invalid(i, "source_id", "must be set for %s storage", s.SourceType)
 			}
+		} else if _, err := uuid.Parse(s.SourceID); err != nil {
+			// images and volumes are both referred to by uuid4.
+			invalid(i, "source_id", "must be a UUID")
 		}
 
-		if req.Storage[i].Bootable {
+		if s.Bootable {
 			bootableCount++
 		}
 	}
 
 	// must be at least one bootable volume
 	if req.VMType == payloads.QEMU && bootableCount == 0 {
-		return types.ErrBadRequest
+		vs.add(types.ErrInvalidStorage, "storage", "must include a bootable volume")
 	}
-
-	return nil
 }
 
-// this is probably an insufficient amount of checking.
-func validateWorkloadRequest(req types.Workload) error {
+// workloadViolations returns every problem with a workload request, in
+// the order they are checked. This is probably an insufficient amount of
+// checking.
+func workloadViolations(req types.Workload) violations {
+	var vs violations
+
 	// ID must be blank.
 	if req.ID != "" {
 		glog.V(2).Info("Invalid workload request: ID is not blank")
-		return types.ErrBadRequest
+		vs.add(types.ErrBadRequest, "id", "must be blank")
 	}
 
 	// we don't validate the TenantID right now - it is passed
@@ -108,37 +145,108 @@ func validateWorkloadRequest(req types.Workload) error {
 	// separator, and keystone doesn't use the '-' separator for
 	// uuids.
 
+	if !payloads.CompatibleFirmware(req.VMType, payloads.Firmware(req.FWType)) {
+		glog.V(2).Infof("Invalid workload request: fw_type %q cannot be used with vm_type %q", req.FWType, req.VMType)
+		vs.add(types.ErrIncompatibleFirmware, "fw_type", "cannot be used with vm_type %q", req.VMType)
+	}
+
 	if req.VMType == payloads.QEMU {
-		err := validateVMWorkload(req)
-		if err != nil {
-			glog.V(2).Info("Invalid workload request: invalid VM workload")
-			return err
-		}
+		validateVMWorkload(req, &vs)
 	} else {
-		err := validateContainerWorkload(req)
-		if err != nil {
-			glog.V(2).Info("Invalid workload request: invalid container workload")
-			return err
-		}
+		validateContainerWorkload(req, &vs)
 	}
 
 	if req.Config == "" {
 		glog.V(2).Info("Invalid workload request: config is blank")
-		return types.ErrBadRequest
+		vs.add(types.ErrBadRequest, "config", "must not be blank")
 	}
 
-	if len(req.Storage) > 0 {
-		err := validateWorkloadStorage(req)
-		if err != nil {
-			glog.V(2).Info("Invalid workload request: invalid storage")
-			return err
+	validateWorkloadStorage(req, &vs)
+	validateWorkloadDefaults(req.Environment, &vs)
+
+	return vs
+}
+
+// validateWorkloadRequest returns the error for the first problem with a
+// workload request, if it has any.
+func validateWorkloadRequest(req types.Workload) error {
+	vs := workloadViolations(req)
+	if len(vs) == 0 {
+		return nil
+	}
+
+	glog.V(2).Infof("Invalid workload request: %s: %s", vs[0].field, vs[0].message)
+	return vs[0].err
+}
+
+// validateWorkloadDefaults checks that every default is named, that no
+// name is used twice and that required defaults have a value.
+func validateWorkloadDefaults(defaults []types.WorkloadDefault, vs *violations) {
+	names := make(map[string]bool)
+
+	for i, d := range defaults {
+		field := fmt.Sprintf("environment[%d]", i)
+
+		if d.Name == "" {
+			vs.add(types.ErrInvalidWorkloadDefault, field+".name", "must not be blank")
+		} else if names[d.Name] {
+			vs.add(types.ErrInvalidWorkloadDefault, field+".name", "%q is used more than once", d.Name)
+		}
+
+		if d.Required && d.Value == "" {
+			vs.add(types.ErrInvalidWorkloadDefault, field+".value", "must be set for a required default")
 		}
+
+		names[d.Name] = true
+	}
+}
+
+// workloadWarnings returns the problems with a valid workload request which
+// do not stop it being created.
+func workloadWarnings(req types.Workload) []string {
+	warnings := []string{}
+
+	requested := make(map[payloads.Resource]bool)
+	for _, d := range req.Defaults {
+		requested[d.Type] = true
 	}
 
-	return nil
+	for _, r := range []payloads.Resource{payloads.VCPUs, payloads.MemMB} {
+		if !requested[r] {
+			warnings = append(warnings, fmt.Sprintf("No %s default is set, the launcher's default will be used", r))
+		}
+	}
+
+	return warnings
+}
+
+// ValidateWorkload checks a workload request exactly as CreateWorkload
+// would, but does not create the workload.
+func (c *controller) ValidateWorkload(req types.Workload) types.WorkloadValidation {
+	v := types.WorkloadValidation{
+		Errors:   []string{},
+		Warnings: []string{},
+	}
+
+	vs := workloadViolations(req)
+	if len(vs) > 0 {
+		v.Errors = append(v.Errors, vs[0].err.Error())
+		v.Fields = vs.fieldErrors()
+		return v
+	}
+
+	v.Warnings = workloadWarnings(req)
+
+	return v
 }
 
 func (c *controller) CreateWorkload(req types.Workload) (types.Workload, error) {
+	return c.createWorkload(context.Background(), req)
+}
+
+// createWorkload creates a workload as CreateWorkload does, unless ctx is
+// done by the time the tenant is confirmed.
+func (c *controller) createWorkload(ctx context.Context, req types.Workload) (types.Workload, error) {
 	err := validateWorkloadRequest(req)
 	if err != nil {
 		return req, err
@@ -149,16 +257,200 @@ func (c *controller) CreateWorkload(req types.Workload) (types.Workload, error)
 		return req, err
 	}
 
+	err = ctx.Err()
+	if err != nil {
+		return req, err
+	}
+
 	req.ID = uuid.Generate().String()
 
 	err = c.ds.AddWorkload(req)
 	return req, err
 }
 
+// UpdateWorkload replaces an existing workload, checking the new
+// version exactly as CreateWorkload would. Instances already started
+// from the workload are not affected.
+func (c *controller) UpdateWorkload(req types.Workload) (types.Workload, error) {
+	// only new workloads must have a blank ID.
+	check := req
+	check.ID = ""
+
+	err := validateWorkloadRequest(check)
+	if err != nil {
+		return req, err
+	}
+
+	err = c.ds.UpdateWorkload(req)
+	return req, err
+}
+
+// failedWorkloadRetention is how long the failure of an asynchronous
+// workload creation can be reported after it happens.
+const failedWorkloadRetention = 10 * time.Minute
+
+// workloadOp is an asynchronous workload creation which has not yet
+// succeeded.
+type workloadOp struct {
+	tenantID string
+	status   string
+	err      error
+}
+
+// CreateWorkloadAsync checks a workload request and returns at once,
+// while the workload is created in the background. The returned
+// operation is pending, and its progress can be followed with
+// WorkloadStatus.
+func (c *controller) CreateWorkloadAsync(req types.Workload) (types.WorkloadOperation, error) {
+	err := validateWorkloadRequest(req)
+	if err != nil {
+		return types.WorkloadOperation{}, err
+	}
+
+	req.ID = uuid.Generate().String()
+
+	c.workloadOpsLock.Lock()
+	c.workloadOps[req.ID] = &workloadOp{
+		tenantID: req.TenantID,
+		status:   types.WorkloadPending,
+	}
+	c.workloadOpsLock.Unlock()
+
+	go c.finishWorkload(req)
+
+	return types.WorkloadOperation{
+		WorkloadID: req.ID,
+		Status:     types.WorkloadPending,
+	}, nil
+}
+
+// finishWorkload does the slow part of CreateWorkloadAsync. Once a
+// workload is stored its status comes from the datastore, so only
+// failures are kept, and then only for failedWorkloadRetention.
+func (c *controller) finishWorkload(req types.Workload) {
+	err := c.confirmTenant(req.TenantID)
+	if err == nil {
+		err = c.ds.AddWorkload(req)
+	}
+
+	c.workloadOpsLock.Lock()
+	defer c.workloadOpsLock.Unlock()
+
+	if err == nil {
+		delete(c.workloadOps, req.ID)
+		return
+	}
+
+	glog.Warningf("Unable to create workload %s: %v", req.ID, err)
+
+	op := c.workloadOps[req.ID]
+	op.status = types.WorkloadFailed
+	op.err = err
+
+	time.AfterFunc(failedWorkloadRetention, func() {
+		c.workloadOpsLock.Lock()
+		delete(c.workloadOps, req.ID)
+		c.workloadOpsLock.Unlock()
+	})
+}
+
+// WorkloadStatus reports how the creation of a workload is going. If no
+// tenantID is given the workload may belong to any tenant. Workloads
+// which were created synchronously are always ready.
+func (c *controller) WorkloadStatus(tenantID string, workloadID string) (types.WorkloadOperation, error) {
+	c.workloadOpsLock.Lock()
+	op, ok := c.workloadOps[workloadID]
+	if ok && (tenantID == "" || op.tenantID == tenantID) {
+		status := types.WorkloadOperation{
+			WorkloadID: workloadID,
+			Status:     op.status,
+		}
+		if op.err != nil {
+			status.Error = op.err.Error()
+		}
+		c.workloadOpsLock.Unlock()
+		return status, nil
+	}
+	c.workloadOpsLock.Unlock()
+
+	_, err := c.ds.GetWorkload(tenantID, workloadID)
+	if err != nil {
+		return types.WorkloadOperation{}, err
+	}
+
+	return types.WorkloadOperation{
+		WorkloadID: workloadID,
+		Status:     types.WorkloadReady,
+	}, nil
+}
+
+// Provision creates the workload req for a tenant, or uses the existing one
+// workloadID, and reserves an external IP for the tenant. The workload is
+// created first, and deleted again if no IP can be reserved, so the tenant
+// is left with both or, when the workload was created for it, neither.
+func (c *controller) Provision(tenantID string, req *types.Workload, workloadID string, poolName *string) (types.Workload, types.MappedIP, error) {
+	if tenantID == "" || (req == nil) == (workloadID == "") {
+		return types.Workload{}, types.MappedIP{}, types.ErrBadRequest
+	}
+
+	var wl types.Workload
+	var err error
+
+	if req != nil {
+		r := *req
+		r.TenantID = tenantID
+		wl, err = c.CreateWorkload(r)
+	} else {
+		wl, err = c.ShowWorkload(tenantID, workloadID)
+	}
+	if err != nil {
+		return types.Workload{}, types.MappedIP{}, err
+	}
+
+	m, err := c.MapAddress(tenantID, poolName, "", "", "", 0)
+	if err != nil {
+		if req != nil {
+			derr := c.DeleteWorkload(tenantID, wl.ID)
+			if derr != nil {
+				glog.Warningf("Unable to delete workload %s after failing to reserve an external IP: %v", wl.ID, derr)
+			}
+		}
+
+		return types.Workload{}, types.MappedIP{}, err
+	}
+
+	return wl, m, nil
+}
+
 func (c *controller) DeleteWorkload(tenantID string, workloadID string) error {
 	return c.ds.DeleteWorkload(tenantID, workloadID)
 }
 
+// TransferWorkload gives a workload to another tenant.
+func (c *controller) TransferWorkload(workloadID string, targetTenantID string) error {
+	return c.ds.TransferWorkload(workloadID, targetTenantID)
+}
+
+func (c *controller) ListWorkloads(tenantID string) ([]types.Workload, error) {
+	return c.ds.GetWorkloads(tenantID)
+}
+
+// CountWorkloads returns the number of workloads ListWorkloads would
+// return, only counting those with the firmware type fwType if it is not
+// empty.
+func (c *controller) CountWorkloads(tenantID string, fwType string) (int, error) {
+	return c.ds.CountWorkloads(tenantID, fwType), nil
+}
+
+// WorkloadInstanceCounts returns the number of instances made from each
+// workload, keyed by workload ID. If tenantID is not empty only the
+// instances of that tenant are counted.
+func (c *controller) WorkloadInstanceCounts(tenantID string) map[string]int {
+	return c.ds.WorkloadInstanceCounts(tenantID)
+}
+
+// ShowWorkload returns a workload of a tenant, or a public workload. If no
+// tenantID is given the workload may belong to any tenant.
 func (c *controller) ShowWorkload(tenantID string, workloadID string) (types.Workload, error) {
 	return c.ds.GetWorkload(tenantID, workloadID)
 }
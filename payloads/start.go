@@ -90,6 +90,10 @@ const (
 	// externally accessible IP address.
 	ExternalIP = "external_ip"
 
+	// ExternalIPHours is used for the time a tenant's external IP
+	// addresses have been allocated for. (Measured in hours)
+	ExternalIPHours = "external_ip_hours"
+
 	// SharedDiskGiB is used for shared storage across the cluster used for
 	// storing volume and images. (Measured in GiB)
 	SharedDiskGiB = "shared_disk_gib"
@@ -104,6 +108,27 @@ const (
 	Docker = "docker"
 )
 
+// compatibleFirmware lists the firmware each hypervisor can boot an
+// instance with. Containers are not booted from firmware, so they may
+// only be given none.
+var compatibleFirmware = map[Hypervisor][]Firmware{
+	QEMU:   {EFI, Legacy},
+	Docker: {""},
+}
+
+// CompatibleFirmware reports whether instances run by the hypervisor vm
+// can be started with the firmware fw. No firmware is compatible with an
+// unknown hypervisor.
+func CompatibleFirmware(vm Hypervisor, fw Firmware) bool {
+	for _, f := range compatibleFirmware[vm] {
+		if f == fw {
+			return true
+		}
+	}
+
+	return false
+}
+
 // StorageResource represents a requested storage resource for a workload.
 type StorageResource struct {
 	// ID is passed to the Block Driver to operate on the resource
@@ -109,3 +109,27 @@ func TestStartUnmarshalPartial(t *testing.T) {
 		t.Error("Unexpected values in Start")
 	}
 }
+
+func TestCompatibleFirmware(t *testing.T) {
+	tests := []struct {
+		vm         Hypervisor
+		fw         Firmware
+		compatible bool
+	}{
+		{QEMU, EFI, true},
+		{QEMU, Legacy, true},
+		{QEMU, "", false},
+		{QEMU, "bios", false},
+		{Docker, "", true},
+		{Docker, EFI, false},
+		{Docker, Legacy, false},
+		{"", "", false},
+		{"xen", Legacy, false},
+	}
+
+	for _, tt := range tests {
+		if CompatibleFirmware(tt.vm, tt.fw) != tt.compatible {
+			t.Errorf("%q with firmware %q: expected compatible %v", tt.vm, tt.fw, tt.compatible)
+		}
+	}
+}
@@ -17,27 +17,100 @@ package service
 import (
 	"context"
 	"fmt"
+	"sort"
 )
 
 type key int
 
-// PrivKey is the index of the context map which indicates whether a
-// service API has been called by a privileged user or not.
+// PrivKey is the index of the context map which holds the set of scopes
+// the caller of a service API has. Callers with no scopes are not
+// privileged.
 const PrivKey key = 0
 
 // TenantIDKey is the index of the context map which indicates the
 // tenant id which is being used in the API call
 const TenantIDKey key = 1
 
-// GetPrivilege returns the value of PrivKey
+// The scopes a privileged caller may be limited to. Callers with any
+// scope may read everything, the scopes say what they may change.
+const (
+	// ScopePoolsWrite allows external IP pools and their addresses to
+	// be changed.
+	ScopePoolsWrite = "pools:write"
+
+	// ScopeExternalIPsWrite allows the external IPs of any tenant to be
+	// mapped and released.
+	ScopeExternalIPsWrite = "external-ips:write"
+
+	// ScopeQuotasWrite allows tenant quotas to be changed.
+	ScopeQuotasWrite = "quotas:write"
+
+	// ScopeTenantsWrite allows tenants to be created, changed and
+	// deleted.
+	ScopeTenantsWrite = "tenants:write"
+
+	// ScopeWorkloadsWrite allows public workloads, and those of any
+	// tenant, to be changed.
+	ScopeWorkloadsWrite = "workloads:write"
+)
+
+// Scopes are all of the scopes, which SetPrivilege gives to privileged
+// callers.
+var Scopes = []string{
+	ScopePoolsWrite,
+	ScopeExternalIPsWrite,
+	ScopeQuotasWrite,
+	ScopeTenantsWrite,
+	ScopeWorkloadsWrite,
+}
+
+// GetPrivilege reports whether the caller holds any scope, and so may
+// use the privileged APIs.
 func GetPrivilege(ctx context.Context) bool {
-	privilege, ok := ctx.Value(PrivKey).(bool)
-	return privilege && ok
+	scopes, ok := ctx.Value(PrivKey).(map[string]bool)
+	return ok && len(scopes) > 0
 }
 
-// SetPrivilege is used to set the value of PrivKey
+// SetPrivilege gives a privileged caller every scope, or takes all of
+// them from a caller which is not.
 func SetPrivilege(ctx context.Context, privileged bool) context.Context {
-	return context.WithValue(ctx, PrivKey, privileged)
+	if !privileged {
+		return SetScopes(ctx)
+	}
+
+	return SetScopes(ctx, Scopes...)
+}
+
+// SetScopes limits the caller to the scopes given. A caller with no
+// scopes is not privileged.
+func SetScopes(ctx context.Context, scopes ...string) context.Context {
+	set := make(map[string]bool, len(scopes))
+	for _, s := range scopes {
+		set[s] = true
+	}
+
+	return context.WithValue(ctx, PrivKey, set)
+}
+
+// HasScope reports whether the caller holds scope.
+func HasScope(ctx context.Context, scope string) bool {
+	scopes, ok := ctx.Value(PrivKey).(map[string]bool)
+	return ok && scopes[scope]
+}
+
+// GetScopes returns the scopes the caller holds, sorted.
+func GetScopes(ctx context.Context) []string {
+	set, _ := ctx.Value(PrivKey).(map[string]bool)
+
+	scopes := make([]string, 0, len(set))
+	for s, ok := range set {
+		if ok {
+			scopes = append(scopes, s)
+		}
+	}
+	sort.Strings(scopes)
+
+	return scopes
 }
 
 // GetTenantID returns the value of TenantIDKey